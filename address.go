@@ -0,0 +1,333 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Services that need proof of residency, CITYNEXT_ADDRESS_REQUIRED, won't
+// book without an address, and anyone else can give one if they like.
+// With a postcode lookup configured the address has to be one the lookup
+// knows at that postcode, and it's kept the way the lookup has it. With
+// CITYNEXT_RESIDENCY_AREAS it has to be in one of those councils too
+type Address struct {
+	XMLName  xml.Name `json:"-" xml:"address"`
+	Line1    string   `json:"line1" xml:"line1"`
+	Line2    string   `json:"line2,omitempty" xml:"line2,omitempty"`
+	Town     string   `json:"town,omitempty" xml:"town,omitempty"`
+	Postcode string   `json:"postcode" xml:"postcode"`
+	UPRN     string   `json:"uprn,omitempty" xml:"uprn,omitempty"` // the property's Unique Property Reference Number
+	Area     string   `json:"area,omitempty" xml:"area,omitempty"` // the council it's in, as the lookup says
+	Ward     string   `json:"ward,omitempty" xml:"ward,omitempty"` // its ward's code from OS Places, or name from getaddress.io
+}
+
+type AddressList struct {
+	XMLName   xml.Name  `json:"-" xml:"addresses"`
+	Postcode  string    `json:"postcode" xml:"postcode"`
+	Addresses []Address `json:"addresses" xml:"address"`
+}
+
+func encodeAddress(address *Address) sql.NullString {
+	if address == nil {
+		return sql.NullString{}
+	}
+	data, _ := json.Marshal(address)
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func decodeAddress(data sql.NullString) (*Address, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var address Address
+	if err := json.Unmarshal([]byte(data.String), &address); err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// Every address at a postcode, none if there's no such postcode
+type PostcodeLookup interface {
+	Lookup(ctx context.Context, postcode string) ([]Address, error)
+}
+
+type PostcodeConfig struct {
+	Provider string // os-places or getaddress, none if empty
+	APIKey   string
+	URL      string // instead of the provider's own
+}
+
+const (
+	defaultOSPlacesURL   = "https://api.os.uk/search/places/v1"
+	defaultGetAddressURL = "https://api.getaddress.io"
+	postcodeCacheTTL     = 24 * time.Hour
+)
+
+func newPostcodeLookup(cfg PostcodeConfig) (PostcodeLookup, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case "os-places":
+		if cfg.APIKey == "" {
+			return nil, errors.New("OS Places needs CITYNEXT_POSTCODE_LOOKUP_KEY")
+		}
+		return osPlaces{url: cmp.Or(cfg.URL, defaultOSPlacesURL), key: cfg.APIKey, http: client}, nil
+	case "getaddress":
+		if cfg.APIKey == "" {
+			return nil, errors.New("getaddress.io needs CITYNEXT_POSTCODE_LOOKUP_KEY")
+		}
+		return getAddress{url: cmp.Or(cfg.URL, defaultGetAddressURL), key: cfg.APIKey, http: client}, nil
+	}
+	return nil, fmt.Errorf("CITYNEXT_POSTCODE_LOOKUP %q should be os-places or getaddress", cfg.Provider)
+}
+
+// Outer and inner code, with or without the space, in any case
+var postcodePattern = regexp.MustCompile(`^([A-Z]{1,2}[0-9][A-Z0-9]?) ?([0-9][A-Z]{2})$`)
+
+// "cf101aa" is "CF10 1AA", and anything that can't be a postcode is ""
+func normalisePostcode(postcode string) string {
+	m := postcodePattern.FindStringSubmatch(strings.ToUpper(strings.Join(strings.Fields(postcode), " ")))
+	if m == nil {
+		return ""
+	}
+	return m[1] + " " + m[2]
+}
+
+// For telling whether "1 high street." is the lookup's "1, HIGH STREET"
+func sameLine(a, b string) bool {
+	simplify := func(s string) string {
+		return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return r == ' ' || r == ',' || r == '.'
+		}), " ")
+	}
+	return simplify(a) == simplify(b)
+}
+
+// The Ordnance Survey's OS Places, by postcode. Each result's DPA is a
+// Royal Mail delivery point
+type osPlaces struct {
+	url, key string
+	http     *http.Client
+}
+
+func (p osPlaces) Lookup(ctx context.Context, postcode string) ([]Address, error) {
+	var found struct {
+		Results []struct {
+			DPA struct {
+				UPRN     string `json:"UPRN"`
+				Address  string `json:"ADDRESS"`
+				PostTown string `json:"POST_TOWN"`
+				Postcode string `json:"POSTCODE"`
+				Council  string `json:"LOCAL_CUSTODIAN_CODE_DESCRIPTION"`
+				Ward     string `json:"WARD_CODE"`
+			} `json:"DPA"`
+		} `json:"results"`
+	}
+	status, err := lookupGet(ctx, p.http, p.url+"/postcode?"+url.Values{"postcode": {postcode}, "key": {p.key}}.Encode(), &found)
+	if err != nil || status == http.StatusBadRequest {
+		return nil, err
+	}
+	var addresses []Address
+	for _, r := range found.Results {
+		// The whole address on one line, without the town and postcode
+		// on the end it's the lines we want, a house number and the
+		// street it's on being one line
+		line := strings.TrimSuffix(strings.TrimSuffix(r.DPA.Address, ", "+r.DPA.Postcode), ", "+r.DPA.PostTown)
+		parts := strings.Split(line, ", ")
+		if len(parts) > 1 && strings.Trim(parts[0], "0123456789") == "" {
+			parts = append([]string{parts[0] + " " + parts[1]}, parts[2:]...)
+		}
+		addresses = append(addresses, Address{
+			Line1:    parts[0],
+			Line2:    strings.Join(parts[1:], ", "),
+			Town:     r.DPA.PostTown,
+			Postcode: r.DPA.Postcode,
+			UPRN:     r.DPA.UPRN,
+			Area:     r.DPA.Council,
+			Ward:     r.DPA.Ward,
+		})
+	}
+	return addresses, nil
+}
+
+// getaddress.io's find, expanded so each address comes in its parts
+type getAddress struct {
+	url, key string
+	http     *http.Client
+}
+
+func (p getAddress) Lookup(ctx context.Context, postcode string) ([]Address, error) {
+	var found struct {
+		Postcode  string `json:"postcode"`
+		Addresses []struct {
+			Line1    string `json:"line_1"`
+			Line2    string `json:"line_2"`
+			Line3    string `json:"line_3"`
+			Line4    string `json:"line_4"`
+			Locality string `json:"locality"`
+			Town     string `json:"town_or_city"`
+			District string `json:"district"`
+			Ward     string `json:"ward"`
+			UPRN     string `json:"uprn"`
+		} `json:"addresses"`
+	}
+	target := p.url + "/find/" + url.PathEscape(postcode) + "?" + url.Values{"api-key": {p.key}, "expand": {"true"}}.Encode()
+	status, err := lookupGet(ctx, p.http, target, &found)
+	if err != nil || status == http.StatusNotFound || status == http.StatusBadRequest {
+		return nil, err
+	}
+	var addresses []Address
+	for _, a := range found.Addresses {
+		var rest []string
+		for _, line := range []string{a.Line2, a.Line3, a.Line4, a.Locality} {
+			if line != "" {
+				rest = append(rest, line)
+			}
+		}
+		addresses = append(addresses, Address{
+			Line1:    a.Line1,
+			Line2:    strings.Join(rest, ", "),
+			Town:     a.Town,
+			Postcode: cmp.Or(found.Postcode, postcode),
+			UPRN:     a.UPRN,
+			Area:     a.District,
+			Ward:     a.Ward,
+		})
+	}
+	return addresses, nil
+}
+
+// A 400 or 404 is for the caller to decide about, it's usually the
+// provider saying there's no such postcode
+func lookupGet(ctx context.Context, client *http.Client, target string, v any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach the postcode lookup: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound:
+		return resp.StatusCode, nil
+	default:
+		return resp.StatusCode, fmt.Errorf("postcode lookup returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to decode the postcode lookup: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// Addresses don't move much, and every lookup is paid for, so the
+// answer is kept for a day
+func (s *Server) lookupPostcode(ctx context.Context, postcode string) ([]Address, error) {
+	key := "postcodes:" + postcode
+	var addresses []Address
+	if body, ok, err := s.cache.Get(ctx, key); err == nil && ok && json.Unmarshal(body, &addresses) == nil {
+		return addresses, nil
+	}
+
+	start := time.Now()
+	addresses, err := s.postcodes.Lookup(ctx, postcode)
+	s.observeDependency(DependencyPostcodes, start, err)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(addresses)
+	if err := s.cache.Set(ctx, key, body, postcodeCacheTTL); err != nil {
+		log.Printf("Error caching addresses for %s: %v", postcode, err)
+	}
+	return addresses, nil
+}
+
+func (s *Server) requiresAddress(service string) bool {
+	return slices.Contains(s.cfg.AddressRequired, service)
+}
+
+// Fills in req.Address the way the lookup has it
+func (s *Server) validateAddress(w http.ResponseWriter, r *http.Request, req *AppointmentRequest) bool {
+	if req.Address == nil {
+		if s.requiresAddress(req.Service) {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeAddressRequired, req.Service+" needs the address they live at")
+			return false
+		}
+		return true
+	}
+	address := *req.Address
+	if address.Postcode = normalisePostcode(address.Postcode); address.Postcode == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidPostcode, "That isn't a UK postcode")
+		return false
+	}
+	if address.Line1 == "" && address.UPRN == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidAddress, "The address needs its first line")
+		return false
+	}
+	if s.postcodes == nil {
+		req.Address = &address
+		return true
+	}
+
+	known, err := s.lookupPostcode(r.Context(), address.Postcode)
+	if err != nil {
+		log.Printf("Error looking up %s: %v", address.Postcode, err)
+		s.sendErrorResponse(w, r, http.StatusServiceUnavailable, CodePostcodeLookupUnavailable, "Addresses can't be checked right now")
+		return false
+	}
+	i := slices.IndexFunc(known, func(a Address) bool {
+		if address.UPRN != "" {
+			return a.UPRN == address.UPRN
+		}
+		return sameLine(a.Line1, address.Line1)
+	})
+	if i < 0 {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownAddress, "There's no such address at "+address.Postcode)
+		return false
+	}
+	areas := s.cfg.ResidencyAreas
+	if s.requiresAddress(req.Service) && len(areas) > 0 && !slices.ContainsFunc(areas, func(area string) bool { return strings.EqualFold(area, known[i].Area) }) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeOutsideArea, req.Service+" is only for people living in "+strings.Join(areas, " or "))
+		return false
+	}
+	req.Address = &known[i]
+	return true
+}
+
+// GET /postcodes/{postcode}/addresses, for the booking form to offer a
+// list to pick from
+func (s *Server) getPostcodeAddresses(w http.ResponseWriter, r *http.Request) {
+	postcode := normalisePostcode(mux.Vars(r)["postcode"])
+	if postcode == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidPostcode, "That isn't a UK postcode")
+		return
+	}
+	addresses, err := s.lookupPostcode(r.Context(), postcode)
+	if err != nil {
+		log.Printf("Error looking up %s: %v", postcode, err)
+		s.sendErrorResponse(w, r, http.StatusServiceUnavailable, CodePostcodeLookupUnavailable, "Addresses can't be looked up right now")
+		return
+	}
+	if len(addresses) == 0 {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownPostcode, "There are no addresses at "+postcode)
+		return
+	}
+	s.respond(w, r, http.StatusOK, AddressList{Postcode: postcode, Addresses: addresses})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalisePostcode(t *testing.T) {
+	for given, want := range map[string]string{"cf101aa": "CF10 1AA", " CF10  1AA ": "CF10 1AA", "sw1a 2aa": "SW1A 2AA", "M1 1AE": "M1 1AE", "CF10": "", "12345": "", "": ""} {
+		if got := normalisePostcode(given); got != want {
+			t.Errorf("Expected %q to be %q, got %q", given, want, got)
+		}
+	}
+}
+
+// OS Places and getaddress.io, each knowing the two houses on one
+// Cardiff postcode, and counting how often they're asked
+func fakePostcodeLookups(t *testing.T, calls *int) (osPlaces, getAddress) {
+	ordnance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if r.URL.Path != "/postcode" || r.URL.Query().Get("key") != "os-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("postcode") != "CF10 1AA" {
+			w.Write([]byte(`{"header": {"totalresults": 0}}`))
+			return
+		}
+		w.Write([]byte(`{"results": [
+			{"DPA": {"UPRN": "100100001", "ADDRESS": "1, HIGH STREET, CARDIFF, CF10 1AA", "POST_TOWN": "CARDIFF", "POSTCODE": "CF10 1AA", "LOCAL_CUSTODIAN_CODE_DESCRIPTION": "CARDIFF", "WARD_CODE": "W05001010"}},
+			{"DPA": {"UPRN": "100100002", "ADDRESS": "FLAT 2, ROSE COURT, HIGH STREET, CARDIFF, CF10 1AA", "POST_TOWN": "CARDIFF", "POSTCODE": "CF10 1AA", "LOCAL_CUSTODIAN_CODE_DESCRIPTION": "CARDIFF", "WARD_CODE": "W05001011"}}]}`))
+	}))
+	t.Cleanup(ordnance.Close)
+	getaddress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if r.URL.Path != "/find/CF10 1AA" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"postcode": "CF10 1AA", "addresses": [
+			{"line_1": "1 High Street", "line_2": "", "town_or_city": "Cardiff", "district": "Cardiff", "ward": "Cathays"},
+			{"line_1": "Flat 2", "line_2": "Rose Court", "line_3": "High Street", "town_or_city": "Cardiff", "district": "Cardiff", "ward": "Adamsdown"}]}`))
+	}))
+	t.Cleanup(getaddress.Close)
+	return osPlaces{url: ordnance.URL, key: "os-key", http: http.DefaultClient}, getAddress{url: getaddress.URL, key: "ga-key", http: http.DefaultClient}
+}
+
+func TestPostcodeLookups(t *testing.T) {
+	var calls int
+	ordnance, getaddress := fakePostcodeLookups(t, &calls)
+	for name, lookup := range map[string]PostcodeLookup{"os-places": ordnance, "getaddress": getaddress} {
+		addresses, err := lookup.Lookup(t.Context(), "CF10 1AA")
+		if err != nil || len(addresses) != 2 {
+			t.Fatalf("Expected two addresses from %s, got %+v, %v", name, addresses, err)
+		}
+		if a := addresses[1]; !sameLine(a.Line1, "flat 2") || !strings.EqualFold(a.Line2, "Rose Court, High Street") || !strings.EqualFold(a.Area, "cardiff") || a.Ward == "" {
+			t.Errorf("Expected %s's flat in its lines, got %+v", name, a)
+		}
+		if !sameLine(addresses[0].Line1, "1 high street") {
+			t.Errorf("Expected %s's house number on the street's line, got %+v", name, addresses[0])
+		}
+		if addresses, err := lookup.Lookup(t.Context(), "CF99 9ZZ"); err != nil || len(addresses) != 0 {
+			t.Errorf("Expected nowhere from %s, got %+v, %v", name, addresses, err)
+		}
+	}
+	if _, err := (osPlaces{url: ordnance.url, key: "wrong", http: http.DefaultClient}).Lookup(t.Context(), "CF10 1AA"); err == nil {
+		t.Errorf("Expected a bad key to be an error")
+	}
+}
+
+func TestBookingAddress(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			var calls int
+			ordnance, _ := fakePostcodeLookups(t, &calls)
+			server, _ := closureServer(t, store)
+			server.cfg.QueueServices = []string{"general", "parking-permits"}
+			server.cfg.AddressRequired = []string{"parking-permits"}
+			server.cfg.ResidencyAreas = []string{"Cardiff"}
+			server.postcodes = ordnance
+			router := server.routes()
+
+			book := func(service string, address *Address) *httptest.ResponseRecorder {
+				t.Helper()
+				return postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Resident", VisitDate: "2075-01-09", Service: service, Address: address})
+			}
+			for _, c := range []struct {
+				address *Address
+				code    int
+				error   string
+			}{
+				{nil, http.StatusBadRequest, "address_required"},
+				{&Address{Line1: "1 High Street", Postcode: "CF10"}, http.StatusBadRequest, "invalid_postcode"},
+				{&Address{Line1: "3 High Street", Postcode: "CF10 1AA"}, http.StatusBadRequest, "unknown_address"},
+				{&Address{Line1: "1 High Street", Postcode: "CF99 9ZZ"}, http.StatusBadRequest, "unknown_address"},
+			} {
+				w := book("parking-permits", c.address)
+				var res ErrorResponse
+				json.Unmarshal(w.Body.Bytes(), &res)
+				if w.Code != c.code || res.Error != c.error {
+					t.Errorf("Expected %+v to be %d %s, got %d: %s", c.address, c.code, c.error, w.Code, w.Body.String())
+				}
+			}
+
+			// Kept the way OS Places has it
+			w := book("parking-permits", &Address{Line1: "1, high street.", Postcode: "cf101aa"})
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Expected the booking, got %d: %s", w.Code, w.Body.String())
+			}
+			var booked Appointment
+			json.Unmarshal(w.Body.Bytes(), &booked)
+			if a := booked.Address; a == nil || a.Line1 != "1 HIGH STREET" || a.UPRN != "100100001" || a.Postcode != "CF10 1AA" {
+				t.Errorf("Expected the looked up address, got %+v", a)
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/1/history", nil))
+			var history History
+			json.Unmarshal(w.Body.Bytes(), &history)
+			if len(history.Revisions) != 1 || history.Revisions[0].Address == nil || history.Revisions[0].Address.UPRN != "100100001" {
+				t.Errorf("Expected the address in the history, got %s", w.Body.String())
+			}
+
+			// Somewhere outside Cardiff can't get a permit, but can still
+			// come in for anything else
+			server.cfg.ResidencyAreas = []string{"Newport"}
+			if w := book("parking-permits", &Address{UPRN: "100100002", Postcode: "CF10 1AA"}); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "outside_area") {
+				t.Errorf("Expected someone outside the area refused, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := book("general", &Address{UPRN: "100100002", Postcode: "CF10 1AA"}); w.Code != http.StatusCreated {
+				t.Errorf("Expected anyone booking anything else, got %d: %s", w.Code, w.Body.String())
+			}
+			if calls != 2 {
+				t.Errorf("Expected each postcode looked up once, got %d", calls)
+			}
+
+			// Moving a booking without an address onto a service that needs one
+			server.cfg.ResidencyAreas = nil
+			if w := book("general", nil); w.Code != http.StatusCreated {
+				t.Fatalf("Expected a booking without an address, got %d: %s", w.Code, w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/3/transfer", []byte(`{"service": "parking-permits"}`)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "address_required") {
+				t.Errorf("Expected the transfer refused, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPostcodeAddresses(t *testing.T) {
+	var calls int
+	_, getaddress := fakePostcodeLookups(t, &calls)
+	server := setupTestServer(t)
+	server.postcodes = getaddress
+	router := server.routes()
+
+	for postcode, code := range map[string]int{"cf101aa": http.StatusOK, "CF99%209ZZ": http.StatusNotFound, "nowhere": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/postcodes/"+postcode+"/addresses", nil))
+		if w.Code != code {
+			t.Errorf("Expected %d for %s, got %d: %s", code, postcode, w.Code, w.Body.String())
+		}
+		if code == http.StatusOK {
+			var list AddressList
+			if json.Unmarshal(w.Body.Bytes(), &list); list.Postcode != "CF10 1AA" || len(list.Addresses) != 2 {
+				t.Errorf("Expected both addresses, got %s", w.Body.String())
+			}
+		}
+	}
+
+	// Nothing to look them up with, nothing there
+	server.postcodes = nil
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, httptest.NewRequest("GET", "/postcodes/CF101AA/addresses", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected no lookup without a provider, got %d", w.Code)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The admin pages, in the binary so a small deployment doesn't need a
+// front end of its own. They're plain HTML and JavaScript calling the
+// same JSON API, logged in with a session (see sessions.go)
+//
+//go:embed adminui/*
+var adminUIFiles embed.FS
+
+// GET /admin/ui/. The pages load without a login, there's nothing in
+// them until they've fetched it, and what they fetch needs one. Nothing
+// but the pages' own files can run in them, or frame them
+func (s *Server) adminUI() http.Handler {
+	files, _ := fs.Sub(adminUIFiles, "adminui")
+	fileServer := http.StripPrefix("/admin/ui/", http.FileServerFS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'; form-action 'self'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
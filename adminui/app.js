@@ -0,0 +1,292 @@
+// The admin pages. Everything comes from the same JSON API the rest of
+// the council uses, logged in with a session cookie (see POST /session).
+// No framework and no build step, so it's what's in the binary
+"use strict";
+
+const pages = ["schedule", "search", "closures", "stats"];
+let csrf = sessionStorage.getItem("csrf") || "";
+
+class APIError extends Error {
+  constructor(status, body) {
+    super(body.message || "Something went wrong (" + status + ")");
+    this.status = status;
+  }
+}
+
+async function api(method, path, body) {
+  const headers = { Accept: "application/json" };
+  if (method !== "GET") {
+    headers["X-CSRF-Token"] = csrf;
+  }
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+  const res = await fetch(path, {
+    method,
+    headers,
+    credentials: "same-origin",
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (res.status === 204) {
+    return null;
+  }
+  const data = await res.json().catch(() => ({}));
+  if (res.status === 401) {
+    showLogin(data.message);
+    throw new APIError(res.status, data);
+  }
+  if (!res.ok) {
+    throw new APIError(res.status, data);
+  }
+  return data;
+}
+
+function say(text, isError) {
+  const el = document.getElementById("message");
+  el.textContent = text;
+  el.classList.toggle("error", Boolean(isError));
+  el.hidden = !text;
+}
+
+// Anything that fails says why, rather than nothing happening
+function handled(fn) {
+  return async (event) => {
+    if (event) {
+      event.preventDefault();
+    }
+    try {
+      await fn(event);
+    } catch (err) {
+      if (!(err instanceof APIError && err.status === 401)) {
+        say(err.message, true);
+      }
+    }
+  };
+}
+
+function cell(row, text) {
+  const td = document.createElement("td");
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  row.appendChild(td);
+  return td;
+}
+
+function fullName(a) {
+  return [a.title, a.preferredName || a.firstName, a.lastName].filter(Boolean).join(" ");
+}
+
+function localDate(d) {
+  return d.getFullYear() + "-" + String(d.getMonth() + 1).padStart(2, "0") + "-" + String(d.getDate()).padStart(2, "0");
+}
+
+function show(page) {
+  if (!pages.includes(page)) {
+    page = pages[0];
+  }
+  document.getElementById("login").hidden = true;
+  document.getElementById("nav").hidden = false;
+  for (const p of pages) {
+    document.getElementById(p).hidden = p !== page;
+    document.querySelector('nav a[href="#' + p + '"]').toggleAttribute("aria-current", p === page);
+  }
+  say("");
+  handled(loaders[page])();
+}
+
+function showLogin(why) {
+  csrf = "";
+  sessionStorage.removeItem("csrf");
+  document.getElementById("nav").hidden = true;
+  for (const p of pages) {
+    document.getElementById(p).hidden = true;
+  }
+  document.getElementById("login").hidden = false;
+  say(why || "", Boolean(why));
+}
+
+let appointments = [];
+
+async function loadAppointments() {
+  appointments = (await api("GET", "/appointments")).appointments || [];
+}
+
+// The same row in the schedule and in search, with what can be done to it
+function appointmentRow(a, withDate) {
+  const row = document.createElement("tr");
+  cell(row, a.id);
+  cell(row, fullName(a));
+  if (withDate) {
+    cell(row, a.visitDate);
+  }
+  cell(row, a.service);
+  cell(row, a.channel);
+  cell(row, 1 + (a.attendees || []).length);
+  cell(row, a.checkedInAt ? new Date(a.checkedInAt).toLocaleTimeString() : "");
+  const actions = cell(row, "");
+  actions.className = "actions";
+
+  const move = document.createElement("button");
+  move.type = "button";
+  move.textContent = "Reschedule";
+  move.addEventListener("click", handled(async () => {
+    const visitDate = prompt("Move " + fullName(a) + " to which day? (YYYY-MM-DD)", a.visitDate);
+    if (!visitDate || visitDate === a.visitDate) {
+      return;
+    }
+    await api("POST", "/admin/appointments/" + a.id + "/reschedule", { visitDate });
+    say(fullName(a) + " moved to " + visitDate);
+    await refresh();
+  }));
+  const cancel = document.createElement("button");
+  cancel.type = "button";
+  cancel.textContent = "Cancel";
+  cancel.addEventListener("click", handled(async () => {
+    if (!confirm("Cancel " + fullName(a) + "'s booking on " + a.visitDate + "?")) {
+      return;
+    }
+    await api("POST", "/admin/appointments/" + a.id + "/cancel");
+    say(fullName(a) + "'s booking cancelled");
+    await refresh();
+  }));
+  actions.append(move, " ", cancel);
+  return row;
+}
+
+function fill(tbody, rows, empty) {
+  tbody.replaceChildren(...rows);
+  if (rows.length === 0) {
+    const row = document.createElement("tr");
+    cell(row, empty).colSpan = tbody.parentElement.querySelectorAll("th").length;
+    tbody.appendChild(row);
+  }
+}
+
+async function loadSchedule() {
+  const form = document.getElementById("schedule-form");
+  if (!form.date.value) {
+    form.date.value = localDate(new Date());
+  }
+  document.getElementById("print").href = "/schedule/" + form.date.value + "/printable";
+  await loadAppointments();
+  const day = appointments.filter((a) => a.visitDate === form.date.value);
+  fill(document.getElementById("schedule-rows"), day.map((a) => appointmentRow(a, false)), "No bookings that day");
+}
+
+async function loadSearch() {
+  const q = document.getElementById("search-form").q.value.trim().toLowerCase();
+  if (!q) {
+    fill(document.getElementById("search-rows"), [], "Search for someone");
+    return;
+  }
+  await loadAppointments();
+  const found = appointments.filter((a) =>
+    String(a.id) === q ||
+    fullName(a).toLowerCase().includes(q) ||
+    (a.firstName + " " + a.lastName).toLowerCase().includes(q) ||
+    (a.email || "").toLowerCase().includes(q));
+  fill(document.getElementById("search-rows"), found.map((a) => appointmentRow(a, true)), "Nobody found");
+}
+
+async function loadClosures() {
+  const closures = (await api("GET", "/admin/closures")).closures || [];
+  fill(document.getElementById("closure-rows"), closures.map((c) => {
+    const row = document.createElement("tr");
+    cell(row, c.from);
+    cell(row, c.to);
+    cell(row, c.reason);
+    cell(row, c.action === "flag" ? "Flagged" : "Cancelled");
+    cell(row, (c.appointments || []).length);
+    cell(row, c.createdBy);
+    return row;
+  }), "No closures to come");
+}
+
+async function loadStats() {
+  const [monthly, capacity] = await Promise.all([api("GET", "/admin/reports/monthly"), api("GET", "/admin/reports/capacity")]);
+  const dl = document.getElementById("monthly");
+  dl.replaceChildren();
+  const rejections = (monthly.topRejections || []).map((r) => r.reason + " (" + r.count + ")").join(", ");
+  for (const [term, value] of [
+    ["Month", monthly.month],
+    ["Bookings", monthly.bookings],
+    ["Cancelled", monthly.cancellations],
+    ["No-shows", monthly.noShows],
+    ["Average notice", monthly.averageLeadDays + " days"],
+    ["Most turned away for", rejections || "Nothing"],
+  ]) {
+    const dt = document.createElement("dt");
+    dt.textContent = term;
+    const dd = document.createElement("dd");
+    dd.textContent = String(value);
+    dl.append(dt, dd);
+  }
+  fill(document.getElementById("capacity-rows"), (capacity.days || []).map((d) => {
+    const row = document.createElement("tr");
+    if (d.closed) {
+      row.className = "closed";
+    } else if (d.sellsOut) {
+      row.className = "full";
+    }
+    cell(row, d.date);
+    cell(row, d.closed ? "Closed" : d.booked);
+    cell(row, d.closed ? "" : d.capacity);
+    cell(row, d.closed ? "" : d.utilization + "%");
+    cell(row, d.forecast || "");
+    return row;
+  }), "Nothing to report");
+}
+
+const loaders = { schedule: loadSchedule, search: loadSearch, closures: loadClosures, stats: loadStats };
+
+function current() {
+  return location.hash.slice(1) || pages[0];
+}
+
+async function refresh() {
+  await loaders[current()]();
+}
+
+document.getElementById("login-form").addEventListener("submit", handled(async (event) => {
+  const form = event.target;
+  const session = await api("POST", "/session", { token: form.token.value });
+  form.reset();
+  csrf = session.csrfToken;
+  sessionStorage.setItem("csrf", csrf);
+  show(current());
+}));
+
+document.getElementById("logout").addEventListener("click", handled(async () => {
+  await api("DELETE", "/session");
+  showLogin("Logged out");
+}));
+
+document.getElementById("schedule-form").addEventListener("submit", handled(loadSchedule));
+document.getElementById("search-form").addEventListener("submit", handled(loadSearch));
+
+document.getElementById("closure-form").addEventListener("submit", handled(async (event) => {
+  const form = event.target;
+  const closure = { from: form.from.value, reason: form.reason.value, action: form.bookings.value };
+  if (form.to.value) {
+    closure.to = form.to.value;
+  }
+  const verb = closure.action === "flag" ? "flagged" : "cancelled";
+  if (!confirm("Close " + closure.from + (closure.to ? " to " + closure.to : "") + "? Bookings then are " + verb + ".")) {
+    return;
+  }
+  const created = await api("POST", "/admin/closures", closure);
+  form.reset();
+  say("Closed, " + (created.appointments || []).length + " bookings " + verb);
+  await loadClosures();
+}));
+
+window.addEventListener("hashchange", () => {
+  if (csrf) {
+    show(current());
+  }
+});
+
+if (csrf) {
+  show(current());
+} else {
+  showLogin();
+}
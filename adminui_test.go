@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAdminUI(t *testing.T) {
+	server, _ := closureServer(t, "sqlite")
+	router := server.routes()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	for _, path := range []string{"/admin", "/admin/ui"} {
+		if w := get(path); w.Code != http.StatusFound || w.Header().Get("Location") != "/admin/ui/" {
+			t.Errorf("Expected %s sent to the pages, got %d", path, w.Code)
+		}
+	}
+	w := get("/admin/ui/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<script src="app.js" defer></script>`) {
+		t.Fatalf("Expected the page without logging in, got %d: %s", w.Code, w.Body.String())
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") || !strings.Contains(csp, "frame-ancestors 'none'") {
+		t.Errorf("Expected only the page's own files allowed, got %q", csp)
+	}
+	for _, file := range []string{"app.js", "style.css"} {
+		if w := get("/admin/ui/" + file); w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("Expected %s, got %d", file, w.Code)
+		}
+	}
+	if w := get("/admin/ui/nothing.js"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for a file that isn't there, got %d", w.Code)
+	}
+	// The rest of /admin is still behind the token
+	if w := get("/admin/closures"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the API still to need a login, got %d", w.Code)
+	}
+
+	// Everything the pages call is a route that's there, with a session
+	script, _ := fs.ReadFile(adminUIFiles, "adminui/app.js")
+	calls := regexp.MustCompile(`api\("(GET|POST|DELETE)", "([^"]+)"`).FindAllStringSubmatch(string(script), -1)
+	if len(calls) < 6 {
+		t.Fatalf("Expected the pages to call the API, found %v", calls)
+	}
+	login := httptest.NewRecorder()
+	router.ServeHTTP(login, httptest.NewRequest("POST", "/session", strings.NewReader(`{"token": "secret"}`)))
+	cookie := login.Result().Cookies()[0]
+	for _, call := range calls {
+		path := call[2]
+		if strings.HasSuffix(path, "/") {
+			path += "1/cancel" // the rest is put together in the page
+		}
+		r := httptest.NewRequest(call[1], path, strings.NewReader("{}"))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code == http.StatusNotFound && !strings.Contains(w.Body.String(), `"error"`) || w.Code == http.StatusMethodNotAllowed {
+			t.Errorf("Expected %s %s to be a route, got %d", call[1], path, w.Code)
+		}
+	}
+}
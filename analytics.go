@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The digital team's view of the booking funnel, without anyone's
+// details in it. Each step is an event sent to CITYNEXT_ANALYTICS_SINK:
+// "file:/var/log/citynext/analytics.jsonl" for a line of JSON each,
+// or an http(s) URL they're POSTed to as a JSON array. There are no
+// names, emails, addresses or IPs in them. The booking and the visitor
+// are each an HMAC with CITYNEXT_ANALYTICS_KEY, the same for the same
+// one so steps can be joined up, and the visitor's changes every day so
+// nobody can be followed for longer than that
+const (
+	AnalyticsAvailabilityViewed = "availability_viewed"
+	AnalyticsBookingSubmitted   = "booking_submitted"
+	AnalyticsBookingRejected    = "booking_rejected"
+	AnalyticsBookingCreated     = "booking_created"
+)
+
+const (
+	analyticsBuffer   = 1000 // events waiting to go, more than that are dropped
+	analyticsBatch    = 100
+	analyticsInterval = 5 * time.Second
+)
+
+type AnalyticsEvent struct {
+	Type        string      `json:"type"`
+	At          time.Time   `json:"at"`
+	Visitor     string      `json:"visitor,omitempty"`     // this browser or caller today
+	Appointment string      `json:"appointment,omitempty"` // once there's a booking
+	Channel     string      `json:"channel"`               // online, phone, staff or walk-in
+	Device      string      `json:"device"`                // mobile, tablet, desktop or unknown, from the User-Agent
+	Service     string      `json:"service,omitempty"`
+	Language    string      `json:"language,omitempty"`
+	People      int         `json:"people,omitempty"`
+	DaysAhead   *int        `json:"daysAhead,omitempty"` // how far off the visit is
+	Reason      string      `json:"reason,omitempty"`    // the error code it was turned away with
+	Status      int         `json:"status,omitempty"`
+	Experiments Experiments `json:"experiments,omitempty"` // the variants they were in
+}
+
+type AnalyticsSink interface {
+	Write(ctx context.Context, events []AnalyticsEvent) error
+}
+
+type analyticsStream struct {
+	key     []byte
+	sink    AnalyticsSink
+	events  chan AnalyticsEvent
+	dropped sync.Once // only logged the first time
+}
+
+func newAnalytics(cfg Config) (*analyticsStream, error) {
+	if cfg.AnalyticsSink == "" {
+		return nil, nil
+	}
+	if cfg.AnalyticsKey == "" {
+		return nil, errors.New("CITYNEXT_ANALYTICS_SINK needs a CITYNEXT_ANALYTICS_KEY to hash identifiers with")
+	}
+	var sink AnalyticsSink
+	switch {
+	case strings.HasPrefix(cfg.AnalyticsSink, "file:"):
+		sink = &fileAnalyticsSink{path: strings.TrimPrefix(cfg.AnalyticsSink, "file:")}
+	case strings.HasPrefix(cfg.AnalyticsSink, "http://") || strings.HasPrefix(cfg.AnalyticsSink, "https://"):
+		sink = httpAnalyticsSink{url: cfg.AnalyticsSink, token: cfg.AnalyticsToken, http: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return nil, fmt.Errorf("CITYNEXT_ANALYTICS_SINK %q should be file:<path> or an http(s) URL", cfg.AnalyticsSink)
+	}
+	return &analyticsStream{key: []byte(cfg.AnalyticsKey), sink: sink, events: make(chan AnalyticsEvent, analyticsBuffer)}, nil
+}
+
+// The first 16 bytes of the HMAC, plenty to tell them apart
+func (a *analyticsStream) hash(parts ...string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Never waits, a full buffer means the event's lost rather than a
+// booking held up
+func (a *analyticsStream) emit(ev AnalyticsEvent) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.events <- ev:
+	default:
+		a.dropped.Do(func() { log.Printf("Analytics events are being dropped, the sink isn't keeping up") })
+	}
+}
+
+// Sends what's waiting every interval, or as soon as there's a batch
+func (s *Server) shipAnalytics(interval time.Duration, stop <-chan struct{}) {
+	a := s.analytics
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []AnalyticsEvent
+	for {
+		select {
+		case <-stop:
+			s.writeAnalytics(append(batch, a.drain()...))
+			return
+		case ev := <-a.events:
+			if batch = append(batch, ev); len(batch) < analyticsBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		s.writeAnalytics(batch)
+		batch = nil
+	}
+}
+
+func (a *analyticsStream) drain() []AnalyticsEvent {
+	var events []AnalyticsEvent
+	for {
+		select {
+		case ev := <-a.events:
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+// A batch that fails is logged and let go, it's analytics
+func (s *Server) writeAnalytics(events []AnalyticsEvent) {
+	if len(events) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := s.analytics.sink.Write(ctx, events)
+	s.observeDependency(DependencyAnalytics, start, err)
+	if err != nil {
+		log.Printf("Error sending %d analytics events: %v", len(events), err)
+	}
+}
+
+type fileAnalyticsSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (f *fileAnalyticsSink) Write(ctx context.Context, events []AnalyticsEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ev := range events {
+		enc.Encode(ev)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+type httpAnalyticsSink struct {
+	url, token string
+	http       *http.Client
+}
+
+func (h httpAnalyticsSink) Write(ctx context.Context, events []AnalyticsEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("analytics sink returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Near enough for telling phones from desktops
+func deviceFrom(userAgent string) string {
+	switch {
+	case userAgent == "":
+		return "unknown"
+	case strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "Tablet"):
+		return "tablet"
+	case strings.Contains(userAgent, "Mobi") || strings.Contains(userAgent, "Android"):
+		return "mobile"
+	}
+	return "desktop"
+}
+
+// What every event from a request starts with
+func (s *Server) analyticsEvent(r *http.Request, kind string) AnalyticsEvent {
+	a := s.analytics
+	channel := bookingChannel(r.Context())
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() == "walk-in" {
+		channel = ChannelWalkIn
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+	return AnalyticsEvent{
+		Type:        kind,
+		At:          time.Now().UTC(),
+		Visitor:     a.hash("visitor", day, clientIP(r), r.UserAgent()),
+		Channel:     channel,
+		Device:      deviceFrom(r.UserAgent()),
+		Experiments: s.experimentsFor(clientIDFrom(r)),
+	}
+}
+
+func (s *Server) trackAvailability(r *http.Request) {
+	if s.analytics == nil {
+		return
+	}
+	ev := s.analyticsEvent(r, AnalyticsAvailabilityViewed)
+	ev.Service = r.URL.Query().Get("service")
+	s.analytics.emit(ev)
+}
+
+func (s *Server) trackSubmitted(r *http.Request, req AppointmentRequest) {
+	if s.analytics == nil {
+		return
+	}
+	ev := s.analyticsEvent(r, AnalyticsBookingSubmitted)
+	ev.Service, ev.Language, ev.People = req.Service, req.PreferredLanguage, req.PartySize()
+	s.analytics.emit(ev)
+}
+
+func (s *Server) trackRejected(r *http.Request, statusCode int, reason string) {
+	if s.analytics == nil {
+		return
+	}
+	ev := s.analyticsEvent(r, AnalyticsBookingRejected)
+	ev.Reason, ev.Status = reason, statusCode
+	s.analytics.emit(ev)
+}
+
+func (s *Server) trackCreated(r *http.Request, appointment Appointment, visitDate, today time.Time) {
+	if s.analytics == nil {
+		return
+	}
+	ev := s.analyticsEvent(r, AnalyticsBookingCreated)
+	days := int(visitDate.Sub(today).Hours() / 24)
+	ev.Appointment = s.analytics.hash("appointment", strconv.Itoa(appointment.ID))
+	ev.Service, ev.Language, ev.People, ev.DaysAhead = appointment.Service, appointment.PreferredLanguage, appointment.PartySize(), &days
+	s.analytics.emit(ev)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnalyticsConfig(t *testing.T) {
+	if a, err := newAnalytics(Config{}); a != nil || err != nil {
+		t.Errorf("Expected no analytics without a sink, got %v, %v", a, err)
+	}
+	for _, cfg := range []Config{
+		{AnalyticsSink: "file:/tmp/analytics.jsonl"},
+		{AnalyticsSink: "kafka://events", AnalyticsKey: "k"},
+	} {
+		if _, err := newAnalytics(cfg); err == nil {
+			t.Errorf("Expected %+v refused", cfg)
+		}
+	}
+}
+
+func TestDeviceFrom(t *testing.T) {
+	for ua, want := range map[string]string{
+		"": "unknown",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148":    "mobile",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8)":                                "mobile",
+		"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X)":                           "tablet",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/126": "desktop",
+	} {
+		if got := deviceFrom(ua); got != want {
+			t.Errorf("Expected %q to be %s, got %s", ua, want, got)
+		}
+	}
+}
+
+func TestAnalyticsFunnel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.jsonl")
+	server, _ := closureServer(t, "sqlite")
+	var err error
+	if server.analytics, err = newAnalytics(Config{AnalyticsSink: "file:" + path, AnalyticsKey: "analytics-key"}); err != nil {
+		t.Fatal(err)
+	}
+	router := server.routes()
+
+	const phone = "Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile"
+	r := httptest.NewRequest("GET", "/availability?month=2075-01", nil)
+	r.Header.Set("User-Agent", phone)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	for _, req := range []AppointmentRequest{
+		{FirstName: "Priya", LastName: "Private", Email: "priya@example.com", VisitDate: "2075-01-09", PreferredLanguage: "cy"},
+		{FirstName: "Priya", LastName: "Private", VisitDate: "2075-13-40"},
+	} {
+		body, _ := json.Marshal(req)
+		r := httptest.NewRequest("POST", "/appointments", strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("User-Agent", phone)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	server.writeAnalytics(server.analytics.drain())
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"Priya", "Private", "priya@example.com", "192.0.2.1"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Expected nothing that identifies anyone, found %q in %s", secret, data)
+		}
+	}
+	var events []AnalyticsEvent
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		var ev AnalyticsEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	want := []string{AnalyticsAvailabilityViewed, AnalyticsBookingSubmitted, AnalyticsBookingCreated, AnalyticsBookingSubmitted, AnalyticsBookingRejected}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected %v, got %v", want, types)
+	}
+
+	// The same visitor all the way through, on a phone
+	for _, ev := range events {
+		if ev.Visitor != events[0].Visitor || ev.Device != "mobile" || ev.Channel != ChannelOnline {
+			t.Errorf("Expected the one mobile visitor online, got %+v", ev)
+		}
+	}
+	created := events[2]
+	if created.Appointment == "" || created.Appointment == "1" || created.DaysAhead == nil || *created.DaysAhead != 8 || created.Language != "cy" || created.People != 1 {
+		t.Errorf("Expected the booking hashed with its details, got %+v", created)
+	}
+	if created.Appointment != server.analytics.hash("appointment", "1") {
+		t.Errorf("Expected the booking's hash to be stable")
+	}
+	if rejected := events[4]; rejected.Reason != "invalid_date" || rejected.Status != http.StatusBadRequest {
+		t.Errorf("Expected the rejection's reason, got %+v", rejected)
+	}
+}
+
+func TestAnalyticsHTTPSink(t *testing.T) {
+	var got []AnalyticsEvent
+	var auth string
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer sink.Close()
+
+	server, _ := closureServer(t, "sqlite")
+	var err error
+	if server.analytics, err = newAnalytics(Config{AnalyticsSink: sink.URL, AnalyticsKey: "analytics-key", AnalyticsToken: "sink-token"}); err != nil {
+		t.Fatal(err)
+	}
+	server.analytics.emit(AnalyticsEvent{Type: AnalyticsBookingSubmitted, Channel: ChannelPhone})
+	stop := make(chan struct{})
+	close(stop)
+	server.shipAnalytics(analyticsInterval, stop)
+
+	if auth != "Bearer sink-token" || len(got) != 1 || got[0].Channel != ChannelPhone {
+		t.Errorf("Expected the event posted with the token, got %q %+v", auth, got)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API keys are for the other systems that call the admin routes, so each
+// gets only what it needs rather than the admin token. A key is sent the
+// same way, "Authorization: Bearer cnk_...", and carries scopes:
+// appointments:read, appointments:write, or admin:* for everything.
+// Routes not in apiKeyScopes need admin:*. Only a hash of the key is kept
+const apiKeyPrefix = "cnk_"
+
+const ScopeAdmin = "admin:*"
+
+var apiKeyScopeNames = []string{"appointments:read", "appointments:write", ScopeAdmin}
+
+// By method and route template, as registered in routes()
+var apiKeyScopes = map[string]string{
+	"GET /appointments":                                         "appointments:read",
+	"GET /appointments/export":                                  "appointments:read",
+	"GET /appointments/{id:[0-9]+}":                             "appointments:read",
+	"GET /appointments/{id:[0-9]+}/history":                     "appointments:read",
+	"GET /appointments/{id:[0-9]+}/badge":                       "appointments:read",
+	"GET /queue/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}":              "appointments:read",
+	"GET /schedule/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}/printable": "appointments:read",
+	"GET /queue/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}/events":       "appointments:read",
+	"POST /admin/appointments":                                  "appointments:write",
+	"POST /admin/walk-ins":                                      "appointments:write",
+	"POST /admin/appointments/{id:[0-9]+}/reschedule":           "appointments:write",
+	"POST /admin/appointments/{id:[0-9]+}/transfer":             "appointments:write",
+	"POST /admin/appointments/{id:[0-9]+}/cancel":               "appointments:write",
+}
+
+type APIKey struct {
+	XMLName    xml.Name   `json:"-" xml:"apiKey"`
+	ID         int64      `json:"id" xml:"id,attr"`
+	Name       string     `json:"name" xml:"name"`
+	Key        string     `json:"key,omitempty" xml:"key,omitempty"` // only when it's made
+	Prefix     string     `json:"prefix" xml:"prefix"`               // enough to tell which it is
+	Scopes     []string   `json:"scopes" xml:"scope"`
+	CreatedBy  string     `json:"createdBy" xml:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt" xml:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" xml:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" xml:"revokedAt,omitempty"`
+}
+
+type APIKeyList struct {
+	XMLName xml.Name `json:"-" xml:"apiKeys"`
+	Keys    []APIKey `json:"keys" xml:"apiKey"`
+}
+
+func (s *Server) initAPIKeysTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		revoked_at DATETIME
+	)`)
+	return err
+}
+
+// Changes made with a key are by "apikey:<name>" in the history
+func apiKeyActor(name string) string {
+	return ActorAPIKey + ":" + name
+}
+
+func hasScope(scopes []string, want string) bool {
+	return slices.Contains(scopes, want) || slices.Contains(scopes, ScopeAdmin)
+}
+
+// What the matched route needs
+func requiredScope(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			if scope, ok := apiKeyScopes[r.Method+" "+tpl]; ok {
+				return scope
+			}
+		}
+	}
+	return ScopeAdmin
+}
+
+// The key the request has if it's good for the route, sending the error if
+// not. A wrong key counts towards the admin lockout like a wrong token
+func (s *Server) checkAPIKey(w http.ResponseWriter, r *http.Request, token string) (APIKey, bool) {
+	ip := clientIP(r)
+	if s.lockedOut(w, r, ActorAdmin, ip) {
+		return APIKey{}, false
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, apiKeySelect+" WHERE key_hash = ? AND revoked_at IS NULL", sha256Hex(token)))
+	if errors.Is(err, sql.ErrNoRows) {
+		s.tokenFailed(r.Context(), ActorAdmin, ip)
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeUnauthorized, "A valid admin token is required")
+		return APIKey{}, false
+	}
+	if err != nil {
+		log.Printf("Error checking API key: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to check the API key")
+		return APIKey{}, false
+	}
+
+	if scope := requiredScope(r); !hasScope(key.Scopes, scope) {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodeInsufficientScope, "This API key needs the "+scope+" scope")
+		return APIKey{}, false
+	}
+
+	// To the minute is plenty, and saves a write on every request
+	now := time.Now().UTC()
+	if _, err := s.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		now, key.ID, now.Add(-time.Minute)); err != nil {
+		log.Printf("Error noting API key %d was used: %v", key.ID, err)
+	}
+	return key, true
+}
+
+const apiKeySelect = "SELECT id, name, prefix, scopes, created_by, created_at, last_used_at, revoked_at FROM api_keys"
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.CreatedBy, &k.CreatedAt, &lastUsedAt, &revokedAt); err != nil {
+		return k, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return k, nil
+}
+
+// GET /admin/api-keys, revoked ones too
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, apiKeySelect+" ORDER BY id")
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list the API keys")
+		return
+	}
+	defer rows.Close()
+
+	list := APIKeyList{Keys: []APIKey{}}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			log.Printf("Error reading API key: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list the API keys")
+			return
+		}
+		list.Keys = append(list.Keys, k)
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
+
+// POST /admin/api-keys with {"name": "warehouse", "scopes": ["appointments:read"]}.
+// The key is in the answer and nowhere else, it can't be had again
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Scopes) == 0 {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "Name and scopes are required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiKeyScopeNames, scope) {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidScope, "Scopes are "+strings.Join(apiKeyScopeNames, ", "))
+			return
+		}
+	}
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	token := apiKeyPrefix + randomHex(20)
+	key := APIKey{Name: req.Name, Key: token, Prefix: token[:len(apiKeyPrefix)+6], Scopes: req.Scopes, CreatedBy: actorFrom(ctx), CreatedAt: time.Now().UTC()}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO api_keys (name, key_hash, prefix, scopes, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id`, key.Name, sha256Hex(token), key.Prefix, strings.Join(key.Scopes, ","), key.CreatedBy, key.CreatedAt).Scan(&key.ID)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to create the API key")
+		return
+	}
+	log.Printf("API key %d (%s) created with %s (by %s)", key.ID, key.Name, strings.Join(key.Scopes, ","), key.CreatedBy)
+	s.respond(w, r, http.StatusCreated, key)
+}
+
+// DELETE /admin/api-keys/{id}, it stops working straight away
+func (s *Server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, `
+		UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?
+		RETURNING id, name, prefix, scopes, created_by, created_at, last_used_at, revoked_at`, time.Now().UTC(), mux.Vars(r)["id"]))
+	if errors.Is(err, sql.ErrNoRows) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No API key by that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking API key: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to revoke the API key")
+		return
+	}
+	log.Printf("API key %d (%s) revoked (by %s)", key.ID, key.Name, actorFrom(ctx))
+	s.respond(w, r, http.StatusOK, key)
+}
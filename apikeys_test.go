@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyScopes(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	router := server.routes()
+
+	create := func(body string) APIKey {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/api-keys", []byte(body)))
+		var key APIKey
+		json.Unmarshal(w.Body.Bytes(), &key)
+		if w.Code != http.StatusCreated || key.Key == "" {
+			t.Fatalf("Expected a key, got %d: %s", w.Code, w.Body.String())
+		}
+		return key
+	}
+	reader := create(`{"name": "warehouse", "scopes": ["appointments:read"]}`)
+	writer := create(`{"name": "crm", "scopes": ["appointments:write"]}`)
+	everything := create(`{"name": "ops", "scopes": ["admin:*"]}`)
+
+	call := func(key APIKey, method, url string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, bytes.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key.Key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	booking, _ := json.Marshal(AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-16"})
+
+	for _, c := range []struct {
+		key         APIKey
+		method, url string
+		body        []byte
+		want        int
+	}{
+		{writer, "POST", "/admin/appointments", booking, http.StatusCreated},
+		{reader, "POST", "/admin/appointments", booking, http.StatusForbidden},
+		{reader, "GET", "/appointments", nil, http.StatusOK},
+		{reader, "GET", "/appointments/1/history", nil, http.StatusOK},
+		{writer, "GET", "/appointments", nil, http.StatusForbidden},
+		{reader, "GET", "/admin/features", nil, http.StatusForbidden},
+		{reader, "GET", "/admin/api-keys", nil, http.StatusForbidden},
+		{everything, "GET", "/admin/features", nil, http.StatusOK},
+		{everything, "GET", "/appointments", nil, http.StatusOK},
+		{APIKey{Key: "cnk_madeup"}, "GET", "/appointments", nil, http.StatusUnauthorized},
+	} {
+		if w := call(c.key, c.method, c.url, c.body); w.Code != c.want {
+			t.Errorf("Expected %d for %s with %s %s, got %d: %s", c.want, c.key.Name, c.method, c.url, w.Code, w.Body.String())
+		}
+	}
+
+	// Booked by the key, as staff
+	var got AppointmentList
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/appointments", nil))
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if len(got.Appointments) != 1 || got.Appointments[0].Channel != ChannelStaff {
+		t.Errorf("Expected one staff booking, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/api-keys", nil))
+	var list APIKeyList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Keys) != 3 || list.Keys[0].Key != "" || list.Keys[0].Scopes[0] != "appointments:read" || list.Keys[0].LastUsedAt == nil {
+		t.Fatalf("Expected the keys without the keys themselves, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/admin/api-keys/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected it revoked, got %d", w.Code)
+	}
+	if w := call(reader, "GET", "/appointments", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key turned away, got %d", w.Code)
+	}
+
+	for body, want := range map[string]int{
+		`{"name": "x", "scopes": ["appointments:delete"]}`: http.StatusBadRequest,
+		`{"name": "", "scopes": ["admin:*"]}`:              http.StatusBadRequest,
+		`{"name": "x"}`:                                    http.StatusBadRequest,
+	} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/api-keys", []byte(body)))
+		if w.Code != want {
+			t.Errorf("Expected %d for %s, got %d", want, body, w.Code)
+		}
+	}
+}
@@ -26,6 +26,7 @@ Successfully loaded 13 public holidays for 2075
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"net/http"
@@ -34,11 +35,10 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 func setupTestServer(t *testing.T) *Server {
-	db, err := sql.Open("sqlite3", ":memory:")
+	db, err := sql.Open(sqliteDriver, sqliteDSN(":memory:", "rwc"))
 	if err != nil {
 		t.Fatalf("Failed to open test DB: %v", err)
 	}
@@ -50,23 +50,15 @@ func setupTestServer(t *testing.T) *Server {
 	}
 
 	// Load test holidays manually
-	server.publicHolidays = map[string]bool{
-		"2075-01-01": true,
-		"2075-01-02": true,
-		"2075-03-18": true,
-		"2075-04-05": true,
-		"2075-04-08": true,
-		"2075-05-06": true,
-		"2075-05-27": true,
-		"2075-07-12": true,
-		"2075-08-05": true,
-		"2075-08-26": true,
-		"2075-12-02": true,
-		"2075-12-25": true,
-		"2075-12-26": true,
-	}
-
 	server.yearStr = "2075"
+	var holidays []PublicHoliday
+	for _, date := range []string{
+		"2075-01-01", "2075-01-02", "2075-03-18", "2075-04-05", "2075-04-08", "2075-05-06", "2075-05-27",
+		"2075-07-12", "2075-08-05", "2075-08-26", "2075-12-02", "2075-12-25", "2075-12-26",
+	} {
+		holidays = append(holidays, PublicHoliday{Date: date, CountryCode: "GB"})
+	}
+	server.storeHolidays(context.Background(), newHolidaySet("2075", []string{"GB"}, holidays, time.Time{}))
 
 	// Override "today" for testing
 	fakeToday, _ := time.Parse("2006-01-02", "2075-01-01")
@@ -220,3 +212,20 @@ func TestMissingLastName(t *testing.T) {
 		t.Errorf("Expected 400 for missing last name, got %d", resp.Code)
 	}
 }
+
+func TestUnsupportedLanguage(t *testing.T) {
+	server := setupTestServer(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/appointments", server.createAppointment).Methods("POST")
+
+	resp := postAppointment(t, router, AppointmentRequest{
+		FirstName:         "Gwen",
+		LastName:          "Klingon",
+		VisitDate:         "2075-06-15",
+		PreferredLanguage: "tlh",
+	})
+
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unsupported language, got %d", resp.Code)
+	}
+}
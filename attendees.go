@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+)
+
+// Everyone else coming along on one booking, e.g. the rest of a family
+// renewing their passports together. The person who booked is the first
+// attendee and isn't repeated here. Each of them takes a place for the
+// day, so a family of four uses four of CITYNEXT_DAILY_CAPACITY
+type Attendee struct {
+	XMLName   xml.Name `json:"-" xml:"attendee"`
+	FirstName string   `json:"firstName" xml:"firstName"`
+	LastName  string   `json:"lastName" xml:"lastName"`
+}
+
+// How many places the booking takes
+func (a Appointment) PartySize() int {
+	return 1 + len(a.Attendees)
+}
+
+func (req AppointmentRequest) PartySize() int {
+	return 1 + len(req.Attendees)
+}
+
+// Never less than one, or nobody could book at all
+func (s *Server) dailyCapacity() int {
+	return max(s.live().DailyCapacity, 1)
+}
+
+func (s *Server) validateAttendees(w http.ResponseWriter, r *http.Request, req AppointmentRequest) bool {
+	for _, attendee := range req.Attendees {
+		if attendee.FirstName == "" || attendee.LastName == "" {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "Every attendee needs a first name and last name")
+			return false
+		}
+	}
+	if req.PartySize() > s.dailyCapacity() {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeTooManyAttendees, "That many people can't be seen on one day")
+		return false
+	}
+	return true
+}
+
+func (s *Server) sendFullyBooked(w http.ResponseWriter, r *http.Request) {
+	s.sendErrorResponse(w, r, http.StatusConflict, CodeDuplicateAppointment, "Not enough places left on this date")
+}
+
+// The SQLite stores keep attendees as a JSON array wherever they're
+// copied, in revisions and in the event log
+func encodeAttendees(attendees []Attendee) string {
+	if len(attendees) == 0 {
+		return "[]"
+	}
+	data, _ := json.Marshal(attendees)
+	return string(data)
+}
+
+func decodeAttendees(data string) ([]Attendee, error) {
+	var attendees []Attendee
+	if err := json.Unmarshal([]byte(data), &attendees); err != nil {
+		return nil, err
+	}
+	if len(attendees) == 0 {
+		return nil, nil
+	}
+	return attendees, nil
+}
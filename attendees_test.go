@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGroupBookings(t *testing.T) {
+	for name, server := range map[string]*Server{"sqlite": setupTestServer(t), "events": setupEventServer(t), "memory": setupTestServer(t)} {
+		t.Run(name, func(t *testing.T) {
+			if name == "memory" {
+				server.db, server.store = nil, newMemoryStore()
+			}
+			server.cfg.AdminToken = "secret"
+			server.cfg.DailyCapacity = 4
+			router := server.routes()
+
+			family := AppointmentRequest{FirstName: "Gwen", LastName: "Group", VisitDate: "2075-06-16", Attendees: []Attendee{
+				{FirstName: "Huw", LastName: "Group"},
+				{FirstName: "Nia", LastName: "Group"},
+			}}
+			w := postAppointment(t, router, family)
+			var created CreatedAppointment
+			if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &created) != nil || len(created.Attendees) != 2 || created.Attendees[1].FirstName != "Nia" {
+				t.Fatalf("Expected 201 with both attendees, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// Three of four places gone, so one more person fits and then nobody
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Solo", LastName: "Booker", VisitDate: "2075-06-16"}); w.Code != http.StatusCreated {
+				t.Fatalf("Expected 201 for the last place, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Too", LastName: "Late", VisitDate: "2075-06-16"}); w.Code != http.StatusConflict {
+				t.Errorf("Expected 409 once the day is full, got %d", w.Code)
+			}
+
+			// Nor can the family move to a day with only two places left
+			postAppointment(t, router, AppointmentRequest{FirstName: "Pair", LastName: "One", VisitDate: "2075-06-17", Attendees: []Attendee{{FirstName: "Pair", LastName: "Two"}}})
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/1/reschedule", []byte(`{"visitDate":"2075-06-17"}`)))
+			if w.Code != http.StatusConflict {
+				t.Errorf("Expected 409 moving three people into two places, got %d: %s", w.Code, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/availability?month=2075-06&people=3", nil))
+			var availability Availability
+			json.Unmarshal(w.Body.Bytes(), &availability)
+			for _, date := range availability.Dates {
+				if date == "2075-06-16" || date == "2075-06-17" {
+					t.Errorf("Expected %s to be too full for three", date)
+				}
+			}
+
+			// The schedule shows everyone coming
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments", nil))
+			var list AppointmentList
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Appointments) != 3 || len(list.Appointments[0].Attendees) != 2 {
+				t.Fatalf("Expected the family's attendees on the schedule, got %s", w.Body.String())
+			}
+
+			// Cancelling gives all their places back
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/1/cancel", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200 cancelling, got %d", w.Code)
+			}
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Now", LastName: "Fits", VisitDate: "2075-06-16", Attendees: family.Attendees}); w.Code != http.StatusCreated {
+				t.Errorf("Expected 201 after the cancellation, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGroupBookingValidation(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.DailyCapacity = 2
+	router := server.routes()
+
+	tests := []struct {
+		name      string
+		attendees []Attendee
+		want      string
+	}{
+		{"missing name", []Attendee{{FirstName: "Anon"}}, "missing_fields"},
+		{"bigger than a day", []Attendee{{FirstName: "A", LastName: "B"}, {FirstName: "C", LastName: "D"}}, "too_many_attendees"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postAppointment(t, router, AppointmentRequest{FirstName: "Lead", LastName: "Booker", VisitDate: "2075-06-16", Attendees: tt.attendees})
+			var errResp ErrorResponse
+			if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &errResp) != nil || errResp.Error != tt.want {
+				t.Errorf("Expected 400 %s, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
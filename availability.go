@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The date picker asks for these on every page view, so they're cached
+// for a short while in browsers and proxies, and availability is
+// kept in the shared cache until the next booking
+const (
+	holidaysMaxAge     = time.Hour
+	availabilityMaxAge = 30 * time.Second
+	availabilityTTL    = 5 * time.Minute
+
+	availabilityGenerationKey = "availability:generation"
+)
+
+type Availability struct {
+	XMLName xml.Name `json:"-" xml:"availability"`
+	From    string   `json:"from" xml:"from"`
+	To      string   `json:"to" xml:"to"`
+	Dates   []string `json:"dates" xml:"dates>date"` // free days, in order
+
+	Remaining []DayRemaining `json:"remaining,omitempty" xml:"remaining>day,omitempty"` // places left by channel, with channel quotas
+	Notices   []StatusNotice `json:"notices,omitempty" xml:"notices>notice,omitempty"`  // added on the way out, never cached with the rest
+}
+
+// XML needs something to hang the list off. JSON clients have always had
+// the bare array, so it's kept for them
+type HolidayList struct {
+	XMLName  xml.Name        `json:"-" xml:"holidays"`
+	Holidays []PublicHoliday `json:"holidays" xml:"holiday"`
+}
+
+func (l HolidayList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Holidays)
+}
+
+// GET /holidays, for every country the office follows, or just ?country=IE
+func (s *Server) getHolidays(w http.ResponseWriter, r *http.Request) {
+	set := s.holidaySet(r.Context())
+	all := set.list()
+
+	holidays := all
+	if country := strings.ToUpper(r.URL.Query().Get("country")); country != "" {
+		if !set.has(country) {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownCountry, "No holidays are loaded for that country")
+			return
+		}
+		holidays = nil
+		for _, holiday := range all {
+			if holiday.CountryCode == country {
+				holidays = append(holidays, holiday)
+			}
+		}
+	}
+	if holidays == nil {
+		holidays = []PublicHoliday{}
+	}
+	writeCacheable(w, r, HolidayList{Holidays: holidays}, holidaysMaxAge)
+}
+
+// GET /availability lists the days that can still be booked from today
+// to the end of the year, or just in ?month=2075-03. A household booking
+// together asks with ?people=4 to only see days with room for all of them
+func (s *Server) getAvailability(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+	s.trackAvailability(r)
+	from := today
+	to := time.Date(today.Year(), 12, 31, 0, 0, 0, 0, time.UTC)
+
+	month := r.URL.Query().Get("month")
+	if month != "" {
+		start, err := time.Parse("2006-01", month)
+		if err != nil || start.Year() != today.Year() {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidMonth, "Month must be in YYYY-MM format and in the current year")
+			return
+		}
+		if start.After(from) {
+			from = start
+		}
+		to = start.AddDate(0, 1, -1)
+	}
+
+	people := 1
+	if v := r.URL.Query().Get("people"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidPeople, "People must be a whole number, at least 1")
+			return
+		}
+		people = n
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	// Today is part of the key so yesterday's answer isn't served at midnight
+	key := "availability:" + s.availabilityGeneration(ctx) + ":" + from.Format("2006-01-02") + ":" + month + ":" + strconv.Itoa(people)
+	if body, ok, err := s.cache.Get(ctx, key); err == nil && ok {
+		var cached Availability
+		if json.Unmarshal(body, &cached) == nil {
+			s.metrics.inc("citynext_availability_lookups_total", "cached")
+			writeCacheable(w, r, s.withNotices(ctx, cached), availabilityMaxAge)
+			return
+		}
+	}
+
+	// When booking opens hundreds of date pickers miss the cache at once
+	// with the same question, so the first works it out and the rest wait
+	// for its answer rather than each going to the database
+	computed := false
+	v, err, _ := s.availabilityFlight.Do(key, func() (any, error) {
+		computed = true
+		// Not cancelled if the one who asked first gives up, the rest still want it
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.DBTimeout)
+		defer cancel()
+
+		availability, err := s.availability(ctx, from, to, people)
+		if err != nil {
+			return nil, err
+		}
+		body, _ := json.Marshal(availability)
+		if err := s.cache.Set(ctx, key, body, availabilityTTL); err != nil {
+			log.Printf("Error caching availability: %v", err)
+		}
+		return availability, nil
+	})
+	if err != nil {
+		log.Printf("Error loading booked dates: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load availability")
+		return
+	}
+	// Do says shared to the one that worked it out too, so go by who ran it
+	s.metrics.inc("citynext_availability_lookups_total", map[bool]string{true: "computed", false: "shared"}[computed])
+	writeCacheable(w, r, s.withNotices(ctx, v.(Availability)), availabilityMaxAge)
+}
+
+// Days from and to inclusive with room for people, and not a holiday
+func (s *Server) availability(ctx context.Context, from, to time.Time, people int) (Availability, error) {
+	attendance, err := s.store.Attendance(ctx, from, to)
+	if err != nil {
+		return Availability{}, err
+	}
+
+	// With quotas the date picker only offers what's left for online bookings
+	var byChannel map[string]map[string]int
+	if len(s.live().ChannelQuotas) > 0 {
+		if byChannel, err = s.store.ChannelAttendance(ctx, from, to); err != nil {
+			return Availability{}, err
+		}
+	}
+
+	closed, err := s.closedDays(ctx, from, to)
+	if err != nil {
+		return Availability{}, err
+	}
+	cuts, err := s.store.CapacityCuts(ctx, from, to)
+	if err != nil {
+		return Availability{}, err
+	}
+
+	holidays := s.holidaySet(ctx)
+	availability := Availability{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Dates: []string{}}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		if holidays.closed(d) || closed[date] {
+			continue
+		}
+		capacity := s.capacityFor(d, "")
+		if cut, ok := cuts[date]; ok {
+			capacity = min(capacity, cut)
+		}
+		if byChannel != nil {
+			availability.Remaining = append(availability.Remaining, s.remainingByChannel(date, capacity, byChannel[date]))
+			capacity = s.channelCapacity(capacity, ChannelOnline, byChannel[date])
+		}
+		if attendance[date]+people <= capacity {
+			availability.Dates = append(availability.Dates, date)
+		}
+	}
+	return availability, nil
+}
+
+// Every booking moves the generation on, which orphans all the cached
+// availability at once without having to know which keys there were
+func (s *Server) availabilityGeneration(ctx context.Context) string {
+	value, ok, err := s.cache.Get(ctx, availabilityGenerationKey)
+	if err != nil || !ok {
+		return "0"
+	}
+	return string(value)
+}
+
+func (s *Server) invalidateAvailability(ctx context.Context) {
+	if _, err := s.cache.Incr(ctx, availabilityGenerationKey, 30*24*time.Hour); err != nil {
+		log.Printf("Error invalidating cached availability: %v", err)
+	}
+}
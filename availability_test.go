@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getAvailability(t *testing.T, handler http.Handler, url, etag string) (*httptest.ResponseRecorder, Availability) {
+	r := httptest.NewRequest("GET", url, nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var availability Availability
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&availability); err != nil {
+			t.Fatalf("Failed to decode availability: %v", err)
+		}
+	}
+	return w, availability
+}
+
+func TestAvailabilityCaching(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+
+	w, availability := getAvailability(t, router, "/availability?month=2075-03", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	// 31 days less Saint Patrick's Day
+	if len(availability.Dates) != 30 {
+		t.Errorf("Expected 30 free days in March, got %d", len(availability.Dates))
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") != "public, max-age=30" {
+		t.Fatalf("Expected caching headers, got %v", w.Header())
+	}
+
+	if w, _ := getAvailability(t, router, "/availability?month=2075-03", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", w.Code)
+	}
+
+	// A booking has to show up straight away, not after the cache expires
+	postAppointment(t, router, AppointmentRequest{FirstName: "Cat", LastName: "Cache", VisitDate: "2075-03-10"})
+
+	w, availability = getAvailability(t, router, "/availability?month=2075-03", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 once the ETag is stale, got %d", w.Code)
+	}
+	for _, date := range availability.Dates {
+		if date == "2075-03-10" {
+			t.Error("Expected the booked day to be gone")
+		}
+	}
+}
+
+func TestAvailabilityInvalidMonth(t *testing.T) {
+	server := setupTestServer(t)
+	if w, _ := getAvailability(t, server.routes(), "/availability?month=2074-03", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for another year, got %d", w.Code)
+	}
+}
+
+func TestHolidaysCaching(t *testing.T) {
+	server := setupTestServer(t)
+	server.storeHolidays(context.Background(), newHolidaySet("2075", []string{"GB"}, []PublicHoliday{{Date: "2075-12-25", LocalName: "Christmas Day", CountryCode: "GB"}}, time.Time{}))
+
+	r := httptest.NewRequest("GET", "/holidays", nil)
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Fatalf("Expected a cacheable 200, got %d %v", w.Code, w.Header())
+	}
+	var holidays []PublicHoliday
+	json.NewDecoder(w.Body).Decode(&holidays)
+	if len(holidays) != 1 || holidays[0].LocalName != "Christmas Day" {
+		t.Errorf("Unexpected holidays: %+v", holidays)
+	}
+
+	// In XML they're wrapped, as that needs the one root
+	r = httptest.NewRequest("GET", "/holidays", nil)
+	r.Header.Set("Accept", "application/xml")
+	w = httptest.NewRecorder()
+	server.routes().ServeHTTP(w, r)
+	var list HolidayList
+	if err := xml.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Holidays) != 1 || list.Holidays[0].LocalName != "Christmas Day" {
+		t.Errorf("Expected the holidays in XML, got %v: %s", err, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "<holidays><holiday><date>2075-12-25</date>") {
+		t.Errorf("Expected <holidays><holiday>, got %s", w.Body.String())
+	}
+}
+
+// Holds Attendance until it's let go, counting the calls
+type slowAttendance struct {
+	AppointmentStore
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (s *slowAttendance) Attendance(ctx context.Context, from, to time.Time) (map[string]int, error) {
+	s.calls.Add(1)
+	<-s.release
+	return s.AppointmentStore.Attendance(ctx, from, to)
+}
+
+func TestAvailabilityCoalesced(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.DailyCapacity = 5
+	store := &slowAttendance{AppointmentStore: server.store, release: make(chan struct{})}
+	server.store = store
+	router := server.routes()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w, _ := getAvailability(t, router, "/availability?month=2075-06", ""); w.Code != http.StatusOK {
+				t.Errorf("Expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	if n := store.calls.Load(); n != 1 {
+		t.Errorf("Expected one trip to the database for all of them, got %d", n)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `citynext_availability_lookups_total{result="computed"} 1`) {
+		t.Errorf("Expected one computed, got %s", w.Body.String())
+	}
+}
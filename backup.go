@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// VACUUM INTO gives us a consistent, compacted copy of the live DB
+// without stopping the server or holding a lock for long
+func backupDatabase(ctx context.Context, db *sql.DB, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create backup dir: %w", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup file %s already exists", path)
+	}
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+	return nil
+}
+
+// Replace the database file with a snapshot. The server must not be running
+func restoreDatabase(snapshot, dbPath string) error {
+	// Make sure it's actually a healthy SQLite file before we clobber anything
+	snap, err := sql.Open(sqliteDriver, sqliteDSN(snapshot, "ro"))
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	var result string
+	err = snap.QueryRow("PRAGMA integrity_check").Scan(&result)
+	snap.Close()
+	if err != nil {
+		return fmt.Errorf("failed to check snapshot: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("snapshot failed integrity check: %s", result)
+	}
+
+	// Copy next to the target and rename, so we never leave half a database
+	src, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := dbPath + ".restoring"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Stale journal files would be replayed over the restored data
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+
+	return os.Rename(tmp, dbPath)
+}
+
+// Timestamped snapshot into the backup dir, copied to S3 if configured.
+// Not to the blob store, which may be a directory on the same disk
+func (s *Server) runBackup(ctx context.Context) (string, error) {
+	name := fmt.Sprintf("appointments-%s.db", time.Now().UTC().Format("20060102T150405Z"))
+	path := filepath.Join(s.cfg.BackupDir, name)
+
+	if err := backupDatabase(ctx, s.db, path); err != nil {
+		return "", err
+	}
+	log.Printf("Backed up database to %s", path)
+
+	if s.cfg.S3.Enabled() {
+		f, err := os.Open(path)
+		if err != nil {
+			return path, err
+		}
+		defer f.Close()
+
+		if err := NewS3Client(s.cfg.S3).PutObject(ctx, "backups/"+name, f, "application/vnd.sqlite3"); err != nil {
+			return path, err
+		}
+		log.Printf("Uploaded backup %s to bucket %s", name, s.cfg.S3.Bucket)
+	}
+
+	return path, nil
+}
+
+func (s *Server) scheduleBackups(schedule jobSchedule, stop <-chan struct{}) {
+	s.every("backup", schedule, stop, func(ctx context.Context) (int, error) {
+		if _, err := s.runBackup(ctx); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+}
+
+// POST /admin/backups takes a snapshot now
+func (s *Server) createBackup(w http.ResponseWriter, r *http.Request) {
+	path, err := s.runBackup(r.Context())
+	if err != nil {
+		log.Printf("Error creating backup: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeBackupFailed, "Failed to create backup")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"path":     path,
+		"uploaded": s.cfg.S3.Enabled(),
+	})
+}
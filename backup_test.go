@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+	postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-15"})
+
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "snapshot.db")
+	if err := backupDatabase(context.Background(), server.db, snapshot); err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+
+	// Refuses to overwrite an existing backup
+	if err := backupDatabase(context.Background(), server.db, snapshot); err == nil {
+		t.Error("Expected backing up over an existing file to fail")
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	if err := restoreDatabase(snapshot, restored); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+
+	db, err := sql.Open(sqliteDriver, sqliteDSN(restored, "ro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM appointments").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 restored appointment, got %d", count)
+	}
+}
+
+func TestS3PutObject(t *testing.T) {
+	var gotPath, gotAuth, gotBody string
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+	}))
+	defer s3.Close()
+
+	client := NewS3Client(S3Config{Endpoint: s3.URL, Region: "eu-west-2", Bucket: "backups", AccessKey: "AKID", SecretKey: "secret"})
+	if err := client.PutObject(context.Background(), "a/b.db", strings.NewReader("data"), ""); err != nil {
+		t.Fatalf("Failed to put object: %v", err)
+	}
+
+	if gotPath != "/backups/a/b.db" || gotBody != "data" {
+		t.Errorf("Unexpected upload %s: %q", gotPath, gotBody)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(gotAuth, "/eu-west-2/s3/aws4_request") {
+		t.Errorf("Unexpected Authorization header: %s", gotAuth)
+	}
+}
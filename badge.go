@@ -0,0 +1,167 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// GET /appointments/{id}/badge is what the front desk sends to the
+// lobby label printer. Zebras take ZPL (?format=zpl, the default),
+// the receipt printers ESC/POS. Both draw the QR code themselves
+var badgeFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"zpl":    {"text/plain; charset=utf-8", "zpl"}, // ^CI28, so names go as UTF-8
+	"escpos": {"application/octet-stream", "bin"},
+}
+
+// What a badge template has to work with
+type Badge struct {
+	ID        int
+	Name      string // the name they go by, and their last
+	Service   string
+	VisitDate string
+	Time      string // HH:MM they checked in, blank if they haven't
+	Number    int    // their queue number, 0 until they've checked in for one
+	Location  string
+	QR        string // what the code scans as, the booking ID, which the kiosk takes
+}
+
+func (s *Server) getBadge(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	format := cmp.Or(r.URL.Query().Get("format"), "zpl")
+	badgeFormat, ok := badgeFormats[format]
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidFormat, "Badge format must be 'zpl' or 'escpos'")
+		return
+	}
+	location := r.URL.Query().Get("location")
+	if _, ok := s.queueLocations()[location]; location != "" && !ok {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownLocation, "No such location")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	appointment, err := s.store.Get(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+		return
+	}
+	badge := Badge{
+		ID:        appointment.ID,
+		Name:      cmp.Or(appointment.PreferredName, appointment.FirstName) + " " + appointment.LastName,
+		Service:   cmp.Or(appointment.Service, s.queueServices()[0]),
+		VisitDate: appointment.VisitDate,
+		Location:  location,
+		QR:        strconv.Itoa(appointment.ID),
+	}
+	if appointment.CheckedInAt != nil {
+		badge.Time = appointment.CheckedInAt.UTC().Format("15:04")
+	}
+	if s.db != nil {
+		ticket, err := s.ticketFor(ctx, appointment.ID)
+		switch {
+		case err == nil:
+			badge.Service, badge.Number = ticket.Service, ticket.Number
+		case !errors.Is(err, sql.ErrNoRows):
+			// The badge is still some use without a number
+			log.Printf("Error loading the ticket for appointment %d: %v", appointment.ID, err)
+		}
+	}
+
+	payload, err := s.templates.RenderBadge(format, location, badge)
+	if err != nil {
+		log.Printf("Error rendering the badge for appointment %d: %v", appointment.ID, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeEncodingError, "Failed to render the badge")
+		return
+	}
+	w.Header().Set("Content-Type", badgeFormat.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="badge-%d.%s"`, appointment.ID, badgeFormat.extension))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(payload)
+}
+
+// For the badge templates. zpl escapes a field for ^FH, the pos ones
+// are the ESC/POS commands, which can't be typed into a text file
+var badgeFuncs = texttemplate.FuncMap{
+	"zpl":      zplField,
+	"posInit":  func() string { return "\x1b@\x1bt\x00" }, // reset, code page 437
+	"posAlign": posAlign,
+	"posBold": func(on bool) string {
+		if on {
+			return "\x1bE\x01"
+		}
+		return "\x1bE\x00"
+	},
+	"posSize": posSize,
+	"posText": posText,
+	"posQR":   posQR,
+	"posFeed": func(lines int) string { return "\x1bd" + string([]byte{byte(min(max(lines, 0), 255))}) },
+	"posCut":  func() string { return "\x1dVB\x00" }, // feed to the cutter and cut
+}
+
+// ^ and ~ start commands anywhere in ZPL, even inside ^FD, so they and
+// the _ that ^FH escapes with go as hex
+func zplField(s string) string {
+	return strings.NewReplacer("_", "_5F", "^", "_5E", "~", "_7E").Replace(s)
+}
+
+func posAlign(align string) string {
+	switch align {
+	case "center":
+		return "\x1ba\x01"
+	case "right":
+		return "\x1ba\x02"
+	}
+	return "\x1ba\x00"
+}
+
+// Characters 1 to 8 times as wide and as tall
+func posSize(width, height int) string {
+	width, height = min(max(width, 1), 8), min(max(height, 1), 8)
+	return "\x1d!" + string([]byte{byte((width-1)<<4 | (height - 1))})
+}
+
+// The printers don't know UTF-8, so text goes in code page 437, the one
+// posInit picks, with ? for anything that isn't in it
+func posText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		c, ok := charmap.CodePage437.EncodeRune(r)
+		if !ok || c < 0x20 {
+			c = '?'
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// GS ( k: model 2, size 1 to 16, medium error correction, then the data
+// stored and printed
+func posQR(data string, size int) string {
+	size = min(max(size, 1), 16)
+	n := len(data) + 3 // the 1P0 goes in the length
+	return "\x1d(k\x04\x001A2\x00" +
+		"\x1d(k\x03\x001C" + string([]byte{byte(size)}) +
+		"\x1d(k\x03\x001E1" +
+		"\x1d(k" + string([]byte{byte(n), byte(n >> 8)}) + "1P0" + data +
+		"\x1d(k\x03\x001Q0"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBadge(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "badge.annex.zpl"), []byte(`^XA^FH^FD{{zpl .Name}} at {{.Location}}^FS^XZ`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.KioskToken = "kiosk-secret"
+	server.cfg.NameCharacters = NameCharactersAny
+	server.cfg.QueueServices = []string{"general", "passports"}
+	server.cfg.QueueLocations = map[string][]string{"lobby": {"general", "passports"}, "annex": {"general"}}
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	var err error
+	if server.templates, err = NewMessageTemplates(dir); err != nil {
+		t.Fatal(err)
+	}
+	router := server.routes()
+
+	postAppointment(t, router, AppointmentRequest{FirstName: "Zoë", LastName: "Smith^Jones", PreferredName: "Zo", VisitDate: "2075-06-16"})
+	postAppointment(t, router, AppointmentRequest{FirstName: "Ann", LastName: "Later", VisitDate: "2075-06-17"})
+	badge := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", path, nil))
+		return w
+	}
+
+	// Before they've a number
+	w := badge("/appointments/2/badge")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "private, no-store" {
+		t.Fatalf("Expected a badge, got %d: %s", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "^XA") || !strings.Contains(body, "^FDAnn Later^FS") || strings.Contains(body, "No. ") || !strings.Contains(body, "^FDQA,2^FS") {
+		t.Errorf("Expected a ZPL badge without a number, got %s", body)
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), kioskRequest("POST", "/kiosk/checkin", []byte(`{"appointmentId": 1, "lastName": "Smith^Jones", "service": "passports"}`)))
+	w = badge("/appointments/1/badge")
+	body := w.Body.String()
+	if !strings.Contains(body, "^FDZo Smith_5EJones^FS") || !strings.Contains(body, "^FDpassports^FS") || !strings.Contains(body, "^FDNo. 1^FS") {
+		t.Errorf("Expected their name escaped, service and number, got %s", body)
+	}
+
+	w = badge("/appointments/1/badge?format=escpos")
+	body = w.Body.String()
+	if w.Header().Get("Content-Type") != "application/octet-stream" || !strings.HasPrefix(body, "\x1b@") || !strings.HasSuffix(body, "\x1dVB\x00") {
+		t.Fatalf("Expected ESC/POS ending in a cut, got %q", body)
+	}
+	// Code page 437, and the QR stored with its length
+	if !strings.Contains(body, "Zo Smith^Jones") || !strings.Contains(body, "\x1d(k\x04\x001P01") || strings.Contains(body, "ë") {
+		t.Errorf("Expected the name in code page 437 and the QR code, got %q", body)
+	}
+	if got := posText("Zoë 佐藤"); got != "Zo\x89 ??" {
+		t.Errorf("Expected ë as 0x89 and the rest as ?, got %q", got)
+	}
+
+	// A location's own template, or the usual one
+	if body := badge("/appointments/1/badge?location=annex").Body.String(); body != "^XA^FH^FDZo Smith_5EJones at annex^FS^XZ" {
+		t.Errorf("Expected the annex template, got %s", body)
+	}
+	if body := badge("/appointments/1/badge?location=lobby").Body.String(); !strings.Contains(body, "^BQN") {
+		t.Errorf("Expected the default template for the lobby, got %s", body)
+	}
+
+	for path, want := range map[string]int{
+		"/appointments/1/badge?format=pdf":     http.StatusBadRequest,
+		"/appointments/1/badge?location=attic": http.StatusNotFound,
+		"/appointments/9/badge":                http.StatusNotFound,
+	} {
+		if w := badge(path); w.Code != want {
+			t.Errorf("Expected %d for %s, got %d: %s", want, path, w.Code, w.Body.String())
+		}
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/appointments/1/badge", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the public turned away, got %d", w.Code)
+	}
+}
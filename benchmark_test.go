@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Uses a real file, :memory: gives every pooled connection its own database
+func setupBenchmarkServer(b testing.TB) http.Handler {
+	db, err := openDB(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	server := NewServer(db)
+	if err := server.initDB(); err != nil {
+		b.Fatal(err)
+	}
+	server.yearStr = "2075"
+	fakeToday, _ := time.Parse("2006-01-02", "2075-01-01")
+	server.todayOverride = &fakeToday
+	return server.routes()
+}
+
+func benchmarkRequest(i int) *http.Request {
+	visitDate := time.Date(2075, 1, 2, 0, 0, 0, 0, time.UTC).AddDate(0, 0, i%363)
+	body, _ := json.Marshal(AppointmentRequest{
+		FirstName: "Bench",
+		LastName:  fmt.Sprintf("Mark%d", i),
+		VisitDate: visitDate.Format("2006-01-02"),
+	})
+	r := httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// After the first 363 everything is a duplicate, which is the common case at peak
+func BenchmarkCreateAppointment(b *testing.B) {
+	handler := setupBenchmarkServer(b)
+	for i := 0; b.Loop(); i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), benchmarkRequest(i))
+	}
+}
+
+func BenchmarkCreateAppointmentParallel(b *testing.B) {
+	handler := setupBenchmarkServer(b)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, benchmarkRequest(i))
+			if w.Code == http.StatusInternalServerError {
+				b.Errorf("Server error under concurrency: %s", w.Body.String())
+			}
+			i++
+		}
+	})
+}
+
+// Same harness as "go run . loadtest", against an in-process server
+func TestLoadtestNoServerErrors(t *testing.T) {
+	srv := httptest.NewServer(setupBenchmarkServer(t))
+	defer srv.Close()
+
+	result := runLoadtest(srv.URL+"/appointments", 2075, 10, 200)
+	if len(result.latencies) != 200 {
+		t.Errorf("Expected 200 results, got %d", len(result.latencies))
+	}
+	if result.statuses[0] > 0 || result.statuses[http.StatusInternalServerError] > 0 {
+		t.Errorf("Expected no errors under concurrency, got %v", result.statuses)
+	}
+	if result.percentile(50) > result.percentile(99) {
+		t.Error("Expected p50 to be no more than p99")
+	}
+}
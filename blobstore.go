@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Somewhere to keep files: uploaded documents and stored exports, each
+// under its own prefix ("documents/", "exports/"). Handlers only see
+// keys, which of these it is comes from the environment, see
+// newBlobStore. Backups go to S3 themselves, see runBackup
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error
+	// Writes the blob to w, ErrBlobNotFound if there isn't one
+	Get(ctx context.Context, key string, w io.Writer) error
+	// Gone already isn't an error
+	Delete(ctx context.Context, key string) error
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// CITYNEXT_BLOB_DIR wins over the bucket, nil if neither is configured,
+// which turns off what needs one. CITYNEXT_DOCUMENT_DIR is the old name
+// for the directory, from when only documents went there
+func newBlobStore(cfg Config) BlobStore {
+	if cfg.BlobDir != "" {
+		return dirBlobs{dir: cfg.BlobDir}
+	}
+	if cfg.S3.Enabled() {
+		return s3Blobs{client: NewS3Client(cfg.S3)}
+	}
+	return nil
+}
+
+// Blobs kept in a directory, a mounted volume with more than one replica
+type dirBlobs struct {
+	dir string
+}
+
+func (d dirBlobs) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+func (d dirBlobs) Put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	// Rename into place so a reader never sees half a file
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (d dirBlobs) Get(ctx context.Context, key string, w io.Writer) error {
+	f, err := os.Open(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Zeroed before it's removed, so the blocks it was in don't still hold
+// it. Best effort on a copy-on-write filesystem or an SSD, which may
+// put the zeros somewhere else
+func (d dirBlobs) Delete(ctx context.Context, key string) error {
+	path := d.path(key)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, zeros{}, info.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Blobs kept in the S3 bucket, or anything that speaks its API like minio
+type s3Blobs struct {
+	client *S3Client
+}
+
+func (b s3Blobs) Put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	return b.client.PutObject(ctx, key, body, contentType)
+}
+
+func (b s3Blobs) Get(ctx context.Context, key string, w io.Writer) error {
+	return b.client.GetObject(ctx, key, w)
+}
+
+func (b s3Blobs) Delete(ctx context.Context, key string) error {
+	return b.client.DeleteObject(ctx, key)
+}
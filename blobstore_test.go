@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestDirBlobs(t *testing.T) {
+	store := dirBlobs{dir: t.TempDir()}
+	ctx := context.Background()
+	if err := store.Put(ctx, "documents/1/abc", bytes.NewReader(testPDF), "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := store.Get(ctx, "documents/1/abc", &got); err != nil || !bytes.Equal(got.Bytes(), testPDF) {
+		t.Fatalf("Expected the blob back, got %q (%v)", got.String(), err)
+	}
+
+	if err := store.Delete(ctx, "documents/1/abc"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, err := os.Stat(store.path("documents/1/abc")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file gone, got %v", err)
+	}
+	if err := store.Delete(ctx, "documents/1/abc"); err != nil {
+		t.Errorf("Expected deleting it again to be fine, got %v", err)
+	}
+	if err := store.Get(ctx, "documents/1/abc", &got); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestS3Blobs(t *testing.T) {
+	objects := map[string][]byte{}
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			var body bytes.Buffer
+			body.ReadFrom(r.Body)
+			objects[r.URL.Path] = body.Bytes()
+		case "GET":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer s3.Close()
+
+	store := newBlobStore(Config{S3: S3Config{Endpoint: s3.URL, Region: "eu-west-2", Bucket: "citynext", AccessKey: "AKID", SecretKey: "secret"}})
+	ctx := context.Background()
+	if err := store.Put(ctx, "exports/a.ndjson", bytes.NewReader([]byte("{}\n")), "application/x-ndjson"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects["/citynext/exports/a.ndjson"]; !ok {
+		t.Fatalf("Expected the object in the bucket, got %v", objects)
+	}
+	var got bytes.Buffer
+	if err := store.Get(ctx, "exports/a.ndjson", &got); err != nil || got.String() != "{}\n" {
+		t.Errorf("Expected the object back, got %q (%v)", got.String(), err)
+	}
+	if err := store.Delete(ctx, "exports/a.ndjson"); err != nil || len(objects) != 0 {
+		t.Errorf("Expected the object deleted, got %v (%v)", objects, err)
+	}
+	if err := store.Get(ctx, "exports/a.ndjson", &got); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Expected ErrBlobNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+)
+
+// Who made a booking when it wasn't the person coming, e.g. a carer
+// booking for someone they look after, or the call centre taking it
+// over the phone. It's kept on the booking and copied into every
+// revision, so the history shows who to ask about it
+const (
+	BookedByStaff = "staff"
+	BookedByCarer = "carer"
+)
+
+type BookedBy struct {
+	XMLName xml.Name `json:"-" xml:"bookedBy"`
+	Role    string   `json:"role" xml:"role"` // staff or carer
+	Name    string   `json:"name" xml:"name"`
+	StaffID string   `json:"staffId,omitempty" xml:"staffId,omitempty"` // staff only
+	Phone   string   `json:"phone,omitempty" xml:"phone,omitempty"`
+	Email   string   `json:"email,omitempty" xml:"email,omitempty"`
+}
+
+// Anyone can say they're a carer, only staff can say they're staff
+func (s *Server) validateBookedBy(w http.ResponseWriter, r *http.Request, bookedBy *BookedBy) bool {
+	if bookedBy == nil {
+		return true
+	}
+	if bookedBy.Name == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "bookedBy needs a name")
+		return false
+	}
+	switch bookedBy.Role {
+	case BookedByCarer:
+	case BookedByStaff:
+		if !isStaff(r.Context()) {
+			s.sendErrorResponse(w, r, http.StatusForbidden, CodeStaffOnly, "Only staff can book as staff, use POST /admin/appointments")
+			return false
+		}
+		if bookedBy.StaffID == "" {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "Staff bookings need a staffId")
+			return false
+		}
+	default:
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidBookedBy, "bookedBy role must be 'staff' or 'carer'")
+		return false
+	}
+	return true
+}
+
+// For the schedule, e.g. "Sam Agent (staff CC042)"
+func (b *BookedBy) String() string {
+	if b == nil {
+		return ""
+	}
+	if b.StaffID != "" {
+		return b.Name + " (" + b.Role + " " + b.StaffID + ")"
+	}
+	return b.Name + " (" + b.Role + ")"
+}
+
+// Kept as JSON in SQLite, NULL when they booked for themselves
+func encodeBookedBy(bookedBy *BookedBy) sql.NullString {
+	if bookedBy == nil {
+		return sql.NullString{}
+	}
+	data, _ := json.Marshal(bookedBy)
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func decodeBookedBy(data sql.NullString) (*BookedBy, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var bookedBy BookedBy
+	if err := json.Unmarshal([]byte(data.String), &bookedBy); err != nil {
+		return nil, err
+	}
+	return &bookedBy, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBookedBy(t *testing.T) {
+	for name, server := range map[string]*Server{"sqlite": setupTestServer(t), "events": setupEventServer(t), "memory": setupTestServer(t)} {
+		t.Run(name, func(t *testing.T) {
+			if name == "memory" {
+				server.db, server.store = nil, newMemoryStore()
+			}
+			server.cfg.AdminToken = "secret"
+			router := server.routes()
+
+			// A carer can book online for someone
+			w := postAppointment(t, router, AppointmentRequest{FirstName: "Cared", LastName: "For", VisitDate: "2075-06-16",
+				BookedBy: &BookedBy{Role: BookedByCarer, Name: "Carys Carer", Phone: "01234 567890"}})
+			var created CreatedAppointment
+			if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &created) != nil || created.BookedBy == nil || created.BookedBy.Name != "Carys Carer" {
+				t.Fatalf("Expected 201 with bookedBy, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// But can't claim to be staff
+			w = postAppointment(t, router, AppointmentRequest{FirstName: "Not", LastName: "Staff", VisitDate: "2075-06-17",
+				BookedBy: &BookedBy{Role: BookedByStaff, Name: "Fake Agent", StaffID: "CC001"}})
+			if w.Code != http.StatusForbidden {
+				t.Errorf("Expected 403 for a public staff booking, got %d", w.Code)
+			}
+
+			// Which the call centre does through admin
+			body, _ := json.Marshal(AppointmentRequest{FirstName: "Phoned", LastName: "In", VisitDate: "2075-06-17",
+				BookedBy: &BookedBy{Role: BookedByStaff, Name: "Sam Agent", StaffID: "CC042"}})
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/appointments", body))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Expected 201 for a staff booking, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// It's in the audit trail and on the schedule
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/2/history", nil))
+			var history History
+			if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history.Revisions) != 1 || history.Revisions[0].BookedBy.String() != "Sam Agent (staff CC042)" {
+				t.Errorf("Expected bookedBy in the history, got %s", w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments", nil))
+			var list AppointmentList
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Appointments) != 2 || list.Appointments[1].BookedBy == nil || list.Appointments[1].BookedBy.StaffID != "CC042" {
+				t.Errorf("Expected bookedBy on the schedule, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestBookedByValidation(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+
+	for _, bookedBy := range []*BookedBy{{Role: "friend", Name: "Pal"}, {Role: BookedByCarer}} {
+		w := postAppointment(t, router, AppointmentRequest{FirstName: "Val", LastName: "Idate", VisitDate: "2075-06-16", BookedBy: bookedBy})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %+v, got %d", bookedBy, w.Code)
+		}
+	}
+}
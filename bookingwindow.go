@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sent instead of an ErrorResponse when a service isn't taking bookings
+// yet, so the page can say when to come back
+type BookingNotOpen struct {
+	XMLName xml.Name  `json:"-" xml:"errorResponse"`
+	Error   string    `json:"error" xml:"error"`
+	Message string    `json:"message" xml:"message"`
+	Service string    `json:"service" xml:"service"`
+	OpensAt time.Time `json:"opensAt" xml:"opensAt"`
+}
+
+// Comma separated service=time pairs, e.g.
+// "passports=2075-05-01T09:00". The time is RFC 3339, or local time
+// without a zone, or just a date for midnight
+func envBookingOpens(key string) map[string]time.Time {
+	opens := map[string]time.Time{}
+	for service, values := range envMap(key) {
+		at, err := parseOpeningTime(values[0])
+		if err != nil {
+			log.Printf("Ignoring %s entry %s=%s, expected e.g. passports=2075-05-01T09:00", key, service, values[0])
+			continue
+		}
+		opens[service] = at
+	}
+	return opens
+}
+
+func parseOpeningTime(v string) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, v); err == nil {
+		return at, nil
+	}
+	if at, err := time.ParseInLocation("2006-01-02T15:04", v, time.Local); err == nil {
+		return at, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
+// Blank is the default service, anything else has to be one we queue for
+func (s *Server) resolveService(w http.ResponseWriter, r *http.Request, service string) (string, bool) {
+	service = strings.TrimSpace(service)
+	if service == "" {
+		return s.queueServices()[0], true
+	}
+	if !slices.Contains(s.queueServices(), service) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownService, "No such service")
+		return "", false
+	}
+	return service, true
+}
+
+// Today in the server year, at the time it is now
+func (s *Server) now(today time.Time) time.Time {
+	now := time.Now().UTC()
+	return today.Add(time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second)
+}
+
+// Sends booking_not_open if the service's booking window hasn't started
+func (s *Server) checkBookingOpen(w http.ResponseWriter, r *http.Request, service string, today time.Time) bool {
+	opensAt, ok := s.live().BookingOpens[service]
+	if !ok || !s.now(today).Before(opensAt) {
+		return true
+	}
+	s.countRejection(r, http.StatusForbidden, CodeBookingNotOpen)
+	s.respond(w, r, http.StatusForbidden, BookingNotOpen{
+		Error:   CodeBookingNotOpen,
+		Message: "Booking for " + service + " opens " + opensAt.Format("2 January 2006 at 15:04"),
+		Service: service,
+		OpensAt: opensAt,
+	})
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBookingNotOpen(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.DailyCapacity = 10
+	server.cfg.QueueServices = []string{"general", "passports"}
+	today := time.Date(2075, 4, 28, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	opensAt := time.Date(2075, 5, 1, 9, 0, 0, 0, time.UTC)
+	server.cfg.BookingOpens = map[string]time.Time{"passports": opensAt}
+	router := server.routes()
+
+	w := postAppointment(t, router, AppointmentRequest{FirstName: "Early", LastName: "Bird", VisitDate: "2075-06-17", Service: "passports"})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 before booking opens, got %d: %s", w.Code, w.Body.String())
+	}
+	var notOpen BookingNotOpen
+	if err := json.Unmarshal(w.Body.Bytes(), &notOpen); err != nil {
+		t.Fatal(err)
+	}
+	if notOpen.Error != "booking_not_open" || notOpen.Service != "passports" || !notOpen.OpensAt.Equal(opensAt) {
+		t.Errorf("Expected booking_not_open for passports at %s, got %+v", opensAt, notOpen)
+	}
+
+	// Other services aren't held back
+	w = postAppointment(t, router, AppointmentRequest{FirstName: "Early", LastName: "Bird", VisitDate: "2075-06-17"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for the default service, got %d: %s", w.Code, w.Body.String())
+	}
+	var appointment CreatedAppointment
+	json.Unmarshal(w.Body.Bytes(), &appointment)
+	if appointment.Service != "general" {
+		t.Errorf("Expected the default service, got %q", appointment.Service)
+	}
+
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Early", LastName: "Bird", VisitDate: "2075-06-17", Service: "fishing"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown service, got %d", w.Code)
+	}
+
+	// And once the day comes it's open
+	today = time.Date(2075, 5, 2, 0, 0, 0, 0, time.UTC)
+	w = postAppointment(t, router, AppointmentRequest{FirstName: "Early", LastName: "Bird", VisitDate: "2075-06-17", Service: "passports"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 once booking's open, got %d: %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &appointment)
+	stored, err := server.store.Get(t.Context(), appointment.ID)
+	if err != nil || stored.Service != "passports" {
+		t.Errorf("Expected passports stored, got %q (%v)", stored.Service, err)
+	}
+}
+
+func TestEnvBookingOpens(t *testing.T) {
+	t.Setenv("CITYNEXT_BOOKING_OPENS", "passports=2075-05-01T09:00:00Z,licences=2075-06-01,general=soon")
+	got := envBookingOpens("CITYNEXT_BOOKING_OPENS")
+	if len(got) != 2 {
+		t.Fatalf("Expected passports and licences only, got %v", got)
+	}
+	if want := time.Date(2075, 5, 1, 9, 0, 0, 0, time.UTC); !got["passports"].Equal(want) {
+		t.Errorf("Expected passports at %s, got %s", want, got["passports"])
+	}
+	if want := time.Date(2075, 6, 1, 0, 0, 0, 0, time.Local); !got["licences"].Equal(want) {
+		t.Errorf("Expected licences at %s, got %s", want, got["licences"])
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Small seams for state that has to be shared once there's more than one
+// replica. In memory by default, Redis when CITYNEXT_REDIS_URL is set
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Incr bumps a counter, starting the ttl when the counter is created
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type Locker interface {
+	// Lock returns ErrLockHeld if someone else has the key. The lock
+	// expires by itself after ttl in case the holder dies
+	Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(), err error)
+}
+
+var ErrLockHeld = errors.New("lock is held by someone else")
+
+type memoryEntry struct {
+	value   []byte
+	counter int64
+	expires time.Time
+}
+
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]memoryEntry)}
+}
+
+// Caller holds the mutex. Expired entries are dropped when touched,
+// which is fine for the handful of keys a single instance sees
+func (c *memoryCache) live(key string) (memoryEntry, bool) {
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, ok
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.live(key)
+	if ok && e.value == nil {
+		// A counter reads back as its number, same as in Redis
+		return []byte(strconv.FormatInt(e.counter, 10)), true, nil
+	}
+	return e.value, ok, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (c *memoryCache) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.live(key)
+	if !ok {
+		e = memoryEntry{expires: time.Now().Add(ttl)}
+	}
+	e.counter++
+	c.entries[key] = e
+	return e.counter, nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+type memoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]memoryLock
+}
+
+type memoryLock struct {
+	token   string
+	expires time.Time
+}
+
+func newMemoryLocker() *memoryLocker {
+	return &memoryLocker{locks: make(map[string]memoryLock)}
+}
+
+func (l *memoryLocker) Lock(ctx context.Context, key string, ttl time.Duration) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if held, ok := l.locks[key]; ok && time.Now().Before(held.expires) {
+		return nil, ErrLockHeld
+	}
+
+	// The token stops a holder whose lock expired from releasing someone else's
+	token := lockToken()
+	l.locks[key] = memoryLock{token: token, expires: time.Now().Add(ttl)}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.locks[key].token == token {
+			delete(l.locks, key)
+		}
+	}, nil
+}
+
+func lockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
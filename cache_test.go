@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryLocker(t *testing.T) {
+	locker := newMemoryLocker()
+	ctx := context.Background()
+
+	unlock, err := locker.Lock(ctx, "slot:2075-06-15", time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to take lock: %v", err)
+	}
+	if _, err := locker.Lock(ctx, "slot:2075-06-15", time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("Expected ErrLockHeld, got %v", err)
+	}
+
+	unlock()
+	if _, err := locker.Lock(ctx, "slot:2075-06-15", time.Minute); err != nil {
+		t.Errorf("Expected lock to be free after unlock, got %v", err)
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	cache := newMemoryCache()
+	ctx := context.Background()
+
+	cache.Set(ctx, "a", []byte("b"), -time.Second)
+	if _, ok, _ := cache.Get(ctx, "a"); ok {
+		t.Error("Expected expired entry to be gone")
+	}
+
+	cache.Incr(ctx, "n", time.Minute)
+	if n, _ := cache.Incr(ctx, "n", time.Minute); n != 2 {
+		t.Errorf("Expected counter of 2, got %d", n)
+	}
+}
+
+func TestIdempotencyKeyReplays(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+
+	post := func(lastName string, ip ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(AppointmentRequest{FirstName: "Dana", LastName: lastName, VisitDate: "2075-06-15"})
+		r := httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+		r.Header.Set("Idempotency-Key", "abc-123")
+		if len(ip) > 0 {
+			r.RemoteAddr = ip[0] + ":1234"
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	first := post("Valid")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", first.Code)
+	}
+
+	// The retry gets the same booking back instead of a 409
+	retry := post("Valid")
+	if retry.Code != http.StatusCreated || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected replayed 201, got %d", retry.Code)
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected identical body on replay")
+	}
+
+	// The same key on another request isn't a retry of it
+	if w := post("Other"); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), CodeIdempotencyKeyReused) {
+		t.Errorf("Expected 422 for another body, got %d: %s", w.Code, w.Body.String())
+	}
+	// And someone else's key is theirs, even the same one
+	if w := post("Valid", "198.51.100.7"); w.Header().Get("Idempotent-Replayed") == "true" || strings.Contains(w.Body.String(), `"id":1`) {
+		t.Errorf("Expected another caller not to get the booking, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.RateLimitPerMinute = 2
+	router := server.routes()
+
+	req := AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-15"}
+	postAppointment(t, router, req)
+	postAppointment(t, router, req)
+	if resp := postAppointment(t, router, req); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 on the third request, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Where a booking came in, kept on it for reporting
+const (
+	ChannelOnline = "online"  // POST /appointments
+	ChannelPhone  = "phone"   // the call centre, below
+	ChannelStaff  = "staff"   // POST /admin/appointments
+	ChannelWalkIn = "walk-in" // POST /admin/walk-ins, for today
+)
+
+// Anything other than a walk-in goes by who's asking
+func bookingChannel(ctx context.Context) string {
+	if _, ok := agentFrom(ctx); ok {
+		return ChannelPhone
+	}
+	if isStaff(ctx) {
+		return ChannelStaff
+	}
+	return ChannelOnline
+}
+
+// Bookings from before channels were all made online
+func channelOrOnline(channel string) string {
+	if channel == "" {
+		return ChannelOnline
+	}
+	return channel
+}
+
+// The call centre's CRM books through /channel/phone/appointments with
+// its own token, "Authorization: Bearer <CITYNEXT_PHONE_TOKEN>", and says
+// which agent is on the call and which call it is on every request.
+// Retries of the same call replay the first booking, whether or not
+// the CRM remembers to send an Idempotency-Key
+const (
+	headerAgentID       = "X-Agent-ID"
+	headerAgentName     = "X-Agent-Name"
+	headerCallReference = "X-Call-Reference"
+)
+
+type agentKey struct{}
+
+type phoneAgent struct {
+	ID   string
+	Name string
+}
+
+func agentFrom(ctx context.Context) (phoneAgent, bool) {
+	agent, ok := ctx.Value(agentKey{}).(phoneAgent)
+	return agent, ok
+}
+
+// Changes made over the phone are by "phone:<agent ID>" in the history
+func phoneActor(agentID string) string {
+	return ActorPhone + ":" + agentID
+}
+
+// Staff are on the admin token, an API key, or on the phone
+func isStaff(ctx context.Context) bool {
+	actor := actorFrom(ctx)
+	return actor == ActorAdmin || strings.HasPrefix(actor, ActorAPIKey+":") || strings.HasPrefix(actor, ActorPhone+":")
+}
+
+func (s *Server) requirePhoneChannel(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.PhoneToken == "" {
+			s.sendErrorResponse(w, r, http.StatusForbidden, CodeChannelDisabled, "The phone channel is not enabled")
+			return
+		}
+
+		if !s.checkToken(w, r, ActorPhone, s.cfg.PhoneToken, "A valid phone channel token is required") {
+			return
+		}
+
+		agent := phoneAgent{ID: r.Header.Get(headerAgentID), Name: r.Header.Get(headerAgentName)}
+		callReference := r.Header.Get(headerCallReference)
+		if agent.ID == "" || callReference == "" {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, headerAgentID+" and "+headerCallReference+" headers are required")
+			return
+		}
+		if agent.Name == "" {
+			agent.Name = "Call centre"
+		}
+
+		// One booking per call, however many times the CRM sends it
+		if r.Header.Get("Idempotency-Key") == "" {
+			r.Header.Set("Idempotency-Key", "call:"+callReference)
+		}
+
+		ctx := context.WithValue(withActor(r.Context(), phoneActor(agent.ID)), agentKey{}, agent)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func phoneRequest(agentID, callReference string, req AppointmentRequest) *http.Request {
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest("POST", "/channel/phone/appointments", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer phone-secret")
+	r.Header.Set(headerAgentID, agentID)
+	r.Header.Set(headerAgentName, "Sam Agent")
+	r.Header.Set(headerCallReference, callReference)
+	return r
+}
+
+func TestPhoneChannel(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.PhoneToken = "phone-secret"
+	server.cfg.RateLimitPerMinute = 1 // the one CRM address would hit this straight away
+	router := server.routes()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, phoneRequest("", "CALL-1", AppointmentRequest{FirstName: "No", LastName: "Agent", VisitDate: "2075-06-16"}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without an agent, got %d", w.Code)
+	}
+
+	call := AppointmentRequest{FirstName: "Phil", LastName: "Phone", VisitDate: "2075-06-16"}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, phoneRequest("CC042", "CALL-1", call))
+	var created CreatedAppointment
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &created) != nil {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if created.BookedBy.String() != "Sam Agent (staff CC042)" {
+		t.Errorf("Expected the agent as bookedBy, got %+v", created.BookedBy)
+	}
+
+	// The CRM resends the same call, with no Idempotency-Key of its own
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, phoneRequest("CC042", "CALL-1", call))
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the first booking replayed, got %d %v", w.Code, w.Header())
+	}
+
+	// Another call isn't held back by the rate limit
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, phoneRequest("CC042", "CALL-2", AppointmentRequest{FirstName: "Next", LastName: "Caller", VisitDate: "2075-06-17"}))
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for the next call, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/appointments/1/history", nil))
+	var history History
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history.Revisions) != 1 || history.Revisions[0].ChangedBy != "phone:CC042" {
+		t.Errorf("Expected one revision by phone:CC042, got %s", w.Body.String())
+	}
+}
+
+func TestPhoneChannelDisabled(t *testing.T) {
+	server := setupTestServer(t)
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, phoneRequest("CC042", "CALL-1", AppointmentRequest{FirstName: "Off", LastName: "Line", VisitDate: "2075-06-16"}))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a phone token configured, got %d", w.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"strconv"
+	"time"
+)
+
+// So the phone line always has places left, CITYNEXT_CHANNEL_QUOTAS holds
+// a percentage of each day's capacity for a channel, e.g.
+// "phone=20,walk-in=10". Rounded down, like overbooking. Until a
+// channel's used its share, nobody else can have it. Once it has, it
+// books from what's left like everyone else
+var bookingChannels = []string{ChannelOnline, ChannelPhone, ChannelStaff, ChannelWalkIn}
+
+type ChannelRemaining struct {
+	XMLName xml.Name `json:"-" xml:"channel"`
+	Channel string   `json:"channel" xml:"name,attr"`
+	Places  int      `json:"places" xml:"places,attr"`
+}
+
+type DayRemaining struct {
+	XMLName  xml.Name           `json:"-" xml:"day"`
+	Date     string             `json:"date" xml:"date,attr"`
+	Channels []ChannelRemaining `json:"channels" xml:"channel"`
+}
+
+// "phone=20" into percentages by channel
+func envChannelQuotas(key string) map[string]int {
+	quotas := map[string]int{}
+	for channel, values := range envMap(key) {
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n < 0 || n > 100 {
+			log.Printf("Ignoring %s entry %s=%s, expected e.g. phone=20", key, channel, values[0])
+			continue
+		}
+		quotas[channel] = n
+	}
+	return quotas
+}
+
+// What a channel can book up to, out of capacity, once the other
+// channels' unused shares are taken out
+func (s *Server) channelCapacity(capacity int, channel string, booked map[string]int) int {
+	for other, percent := range s.live().ChannelQuotas {
+		if other == channel {
+			continue
+		}
+		if unused := s.dailyCapacity()*percent/100 - booked[other]; unused > 0 {
+			capacity -= unused
+		}
+	}
+	return capacity
+}
+
+// The capacity for a booking on the channel that day. Without quotas it's capacity as it is
+func (s *Server) capacityOnChannel(ctx context.Context, visitDate time.Time, capacity int, channel string) (int, error) {
+	if len(s.live().ChannelQuotas) == 0 {
+		return capacity, nil
+	}
+	attendance, err := s.store.ChannelAttendance(ctx, visitDate, visitDate)
+	if err != nil {
+		return 0, err
+	}
+	return s.channelCapacity(capacity, channel, attendance[visitDate.Format("2006-01-02")]), nil
+}
+
+// Places left on the day for each channel, never below none
+func (s *Server) remainingByChannel(date string, capacity int, booked map[string]int) DayRemaining {
+	total := 0
+	for _, n := range booked {
+		total += n
+	}
+	day := DayRemaining{Date: date, Channels: []ChannelRemaining{}}
+	for _, channel := range bookingChannels {
+		day.Channels = append(day.Channels, ChannelRemaining{Channel: channel, Places: max(0, s.channelCapacity(capacity, channel, booked)-total)})
+	}
+	return day
+}
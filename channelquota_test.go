@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChannelQuotas(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 10
+	server.cfg.ChannelQuotas = map[string]int{ChannelPhone: 20, ChannelWalkIn: 10}
+	server.cfg.QueueServices = []string{"general", "passports"}
+	router := server.routes()
+
+	// Seven places are anyone's, two are the phone's and one's for walk-ins
+	party := make([]Attendee, 6)
+	for i := range party {
+		party[i] = Attendee{FirstName: "Big", LastName: "Family"}
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Big", LastName: "Family", VisitDate: "2075-06-17", Attendees: party}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for seven online, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "One", LastName: "More", VisitDate: "2075-06-17"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 online once only the held places are left, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/availability?month=2075-06", nil))
+	var availability Availability
+	if err := json.Unmarshal(w.Body.Bytes(), &availability); err != nil {
+		t.Fatal(err)
+	}
+	for _, date := range availability.Dates {
+		if date == "2075-06-17" {
+			t.Error("Expected the day to be gone from the date picker")
+		}
+	}
+	remaining := map[string]int{}
+	for _, day := range availability.Remaining {
+		if day.Date == "2075-06-17" {
+			for _, c := range day.Channels {
+				remaining[c.Channel] = c.Places
+			}
+		}
+	}
+	if remaining[ChannelOnline] != 0 || remaining[ChannelPhone] != 2 || remaining[ChannelWalkIn] != 1 || remaining[ChannelStaff] != 0 {
+		t.Errorf("Expected 2 for phone and 1 for walk-ins, got %v", remaining)
+	}
+
+	body, _ := json.Marshal(AppointmentRequest{FirstName: "Over", LastName: "Phone", VisitDate: "2075-06-17", BookedBy: &BookedBy{Role: BookedByStaff, Name: "Sam Agent", StaffID: "CC042"}})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments", body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for staff, who have no share, got %d", w.Code)
+	}
+
+	// Nor can an online booking be moved into the places held back
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Moving", LastName: "Along", VisitDate: "2075-06-18"}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on another day, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, c := range []struct{ path, body string }{
+		{"/admin/appointments/2/reschedule", `{"visitDate":"2075-06-17"}`},
+		{"/admin/appointments/2/transfer", `{"service":"passports","visitDate":"2075-06-17"}`},
+	} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", c.path, []byte(c.body)))
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected 409 from %s into the held places, got %d: %s", c.path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestChannelCapacity(t *testing.T) {
+	server := NewServer(nil)
+	server.cfg.DailyCapacity = 10
+	server.cfg.ChannelQuotas = map[string]int{ChannelPhone: 20}
+
+	if got := server.channelCapacity(10, ChannelPhone, nil); got != 10 {
+		t.Errorf("Expected the phone to have everything, got %d", got)
+	}
+	if got := server.channelCapacity(10, ChannelOnline, map[string]int{ChannelPhone: 1}); got != 9 {
+		t.Errorf("Expected the phone's one unused place held back, got %d", got)
+	}
+	if got := server.channelCapacity(10, ChannelOnline, map[string]int{ChannelPhone: 5}); got != 10 {
+		t.Errorf("Expected nothing held once the phone's past its share, got %d", got)
+	}
+}
+
+func TestEnvChannelQuotas(t *testing.T) {
+	t.Setenv("CITYNEXT_CHANNEL_QUOTAS", "phone=20,walk-in=lots,staff=150")
+	if got := envChannelQuotas("CITYNEXT_CHANNEL_QUOTAS"); len(got) != 1 || got[ChannelPhone] != 20 {
+		t.Errorf("Expected the phone only, got %v", got)
+	}
+}
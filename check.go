@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// check [year] - that this config can actually run, for deploy pipelines
+// to try before switching traffic over. Prints a line for each thing
+// checked and fails if any of them did. Nothing is changed, pending
+// migrations are only reported, they're run when the server starts
+func checkCommand(cfg Config, args []string) error {
+	year := strconv.Itoa(time.Now().Year())
+	if len(args) > 0 {
+		year = args[0]
+	}
+
+	failed := 0
+	report := func(name string, err error, note string) {
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL  %-12s %v\n", name, err)
+		case note != "":
+			fmt.Printf("ok    %-12s %s\n", name, note)
+		default:
+			fmt.Printf("ok    %s\n", name)
+		}
+	}
+
+	report("config", errors.Join(validateConfig(cfg)...), "")
+
+	_, err := NewMessageTemplates(cfg.TemplateDir)
+	report("templates", err, "")
+
+	if cfg.Store == "memory" {
+		report("database", nil, "not used by the memory store")
+	} else {
+		db, note, err := checkDatabase(cfg.DBPath)
+		report("database", err, note)
+		if db != nil {
+			pending, err := pendingMigrations(db, cfg.Store)
+			note := "up to date"
+			if len(pending) > 0 {
+				note = "pending, run on start: " + strings.Join(pending, "; ")
+			}
+			report("migrations", err, note)
+			db.Close()
+		}
+	}
+
+	if cfg.RedisURL != "" {
+		client, err := newRedisClient(cfg.RedisURL)
+		if err == nil {
+			client.Close()
+		}
+		report("redis", err, "")
+	}
+
+	server := NewServer(nil)
+	server.cfg = cfg
+	report("holiday API", server.checkHolidayAPI(context.Background(), year), server.holidayAPIURL())
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// Everything wrong with the config, not just the first thing
+func validateConfig(cfg Config) []error {
+	var errs []error
+	if !slices.Contains([]string{"sqlite", "events", "memory"}, cfg.Store) {
+		errs = append(errs, fmt.Errorf("CITYNEXT_STORE %q should be sqlite, events or memory", cfg.Store))
+	}
+	backups, replication := cfg.scheduled("backup", cfg.BackupInterval), cfg.scheduled("replication", cfg.ReplicaInterval)
+	if cfg.Store == "memory" && (backups || replication || len(cfg.MonthlyReportTo) > 0 || cfg.ReminderDays > 0) {
+		errs = append(errs, errors.New("backups, replication, reminders and monthly reports need the sqlite store"))
+	}
+	if replication && newReplicator(cfg) == nil {
+		errs = append(errs, errors.New("replication is switched on but there's nowhere to replicate to"))
+	}
+	if _, err := time.LoadLocation(cfg.JobTimezone); err != nil {
+		errs = append(errs, fmt.Errorf("CITYNEXT_JOB_TIMEZONE %q isn't a time zone", cfg.JobTimezone))
+	} else {
+		for _, name := range slices.Sorted(maps.Keys(cfg.JobSchedules)) {
+			if _, err := cfg.jobSchedule(name, 0); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if _, ok := nameCharacters[cfg.NameCharacters]; !ok {
+		errs = append(errs, fmt.Errorf("CITYNEXT_NAME_CHARACTERS %q should be %s", cfg.NameCharacters, nameCharacterSets()))
+	}
+	if _, ok := rebalanceRules[cfg.RebalanceRule]; !ok {
+		errs = append(errs, fmt.Errorf("CITYNEXT_REBALANCE_RULE %q should be %s", cfg.RebalanceRule, strings.Join(slices.Sorted(maps.Keys(rebalanceRules)), ", ")))
+	}
+	if _, _, _, err := newNotifiers(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newPostcodeLookup(cfg.PostcodeLookup); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newAnalytics(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if len(cfg.ResidencyAreas) > 0 && cfg.PostcodeLookup.Provider == "" {
+		errs = append(errs, errors.New("CITYNEXT_RESIDENCY_AREAS needs a CITYNEXT_POSTCODE_LOOKUP to tell where addresses are"))
+	}
+	for _, service := range cfg.AddressRequired {
+		if !slices.Contains(cfg.QueueServices, service) {
+			errs = append(errs, fmt.Errorf("CITYNEXT_ADDRESS_REQUIRED has %q, but it isn't in CITYNEXT_QUEUE_SERVICES", service))
+		}
+	}
+	if cfg.DailyCapacity < 1 {
+		errs = append(errs, fmt.Errorf("CITYNEXT_DAILY_CAPACITY %d should be at least 1", cfg.DailyCapacity))
+	}
+	if len(cfg.Countries) == 0 {
+		errs = append(errs, errors.New("CITYNEXT_COUNTRIES needs at least one country"))
+	}
+	if cfg.HolidayAction != "" && cfg.HolidayAction != ClosureCancel && cfg.HolidayAction != ClosureFlag {
+		errs = append(errs, fmt.Errorf("CITYNEXT_HOLIDAY_ACTION %q should be cancel, flag or empty", cfg.HolidayAction))
+	}
+	if u, err := url.Parse(cfg.HolidayAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, fmt.Errorf("CITYNEXT_HOLIDAY_API_URL %q isn't an http(s) URL", cfg.HolidayAPIURL))
+	}
+	for name, d := range map[string]time.Duration{
+		"CITYNEXT_DB_TIMEOUT": cfg.DBTimeout, "CITYNEXT_HOLIDAY_API_TIMEOUT": cfg.HolidayAPITimeout, "CITYNEXT_NOTIFY_TIMEOUT": cfg.NotifyTimeout,
+		"CITYNEXT_READ_TIMEOUT": cfg.ReadTimeout, "CITYNEXT_WRITE_TIMEOUT": cfg.WriteTimeout, "CITYNEXT_HANDLER_TIMEOUT": cfg.HandlerTimeout,
+		"CITYNEXT_SHUTDOWN_TIMEOUT": cfg.ShutdownTimeout, "CITYNEXT_SESSION_TTL": cfg.SessionTTL,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s can't be negative", name))
+		}
+	}
+	for location, services := range cfg.QueueLocations {
+		for _, service := range services {
+			if !slices.Contains(cfg.QueueServices, service) {
+				errs = append(errs, fmt.Errorf("CITYNEXT_QUEUE_LOCATIONS puts %q in %s, but it isn't in CITYNEXT_QUEUE_SERVICES", service, location))
+			}
+		}
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errs
+}
+
+// Opened read-write but never created, a database that isn't there yet
+// is fine as long as the server will be able to make it
+func checkDatabase(path string) (*sql.DB, string, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		dir := filepath.Dir(path)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, "", fmt.Errorf("%s doesn't exist and neither does %s to create it in", path, dir)
+		}
+		return nil, "will be created at " + path, nil
+	}
+
+	db, err := sql.Open(sqliteDriver, sqliteDSN(path, "rw"))
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, "", err
+	}
+	return db, path, nil
+}
+
+// What Init would do to this database, without doing it
+func pendingMigrations(db *sql.DB, store string) ([]string, error) {
+	exists := func(table string) (bool, error) {
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+		return n > 0, err
+	}
+
+	var pending []string
+	for _, table := range []string{"persons", "appointments", "appointment_attendees", "appointment_revisions"} {
+		ok, err := exists(table)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			pending = append(pending, "create "+table)
+		}
+	}
+	if store == "events" {
+		if ok, err := exists("appointment_events"); err != nil || !ok {
+			pending = append(pending, "create appointment_events")
+		}
+	}
+	if ok, _ := exists("appointments"); !ok {
+		return pending, nil
+	}
+
+	legacy, err := hasColumn(db, "appointments", "first_name")
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		pending = append(pending, "move appointment details into persons")
+	}
+	var ddl string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'appointments'").Scan(&ddl); err != nil {
+		return nil, err
+	}
+	if strings.Contains(strings.ToUpper(ddl), "UNIQUE") {
+		pending = append(pending, "allow more than one booking a day")
+	}
+	for _, ix := range indexes {
+		if ok, _ := exists(ix.table); !ok {
+			continue
+		}
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", ix.name).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			pending = append(pending, "create index "+ix.name)
+		}
+	}
+	for _, c := range addedColumns {
+		if ok, _ := exists(c.table); !ok {
+			continue
+		}
+		has, err := hasColumn(db, c.table, c.column)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			pending = append(pending, "add "+c.table+"."+c.column)
+		}
+	}
+	return pending, nil
+}
+
+// Reachable, and knows every country we follow
+func (s *Server) checkHolidayAPI(ctx context.Context, year string) error {
+	available, err := s.availableCountries(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, code := range s.cfg.Countries {
+		code = strings.ToUpper(code)
+		if available[code] == "" {
+			errs = append(errs, fmt.Errorf("unknown country %q", code))
+			continue
+		}
+		var holidays []PublicHoliday
+		if err := s.nagerGet(ctx, "/PublicHolidays/"+year+"/"+code, &holidays); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", code, err))
+		}
+	}
+	return errors.Join(errs...)
+}
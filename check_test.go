@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"appointment-service/testsupport"
+)
+
+func checkConfig(t *testing.T) Config {
+	api := testsupport.NewHolidayProvider(t).AddHoliday("GB", "2075-12-25", "Christmas Day")
+	cfg := loadConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "appointments.db")
+	cfg.HolidayAPIURL = api.URL
+	return cfg
+}
+
+func TestCheckCommand(t *testing.T) {
+	cfg := checkConfig(t)
+	if err := checkCommand(cfg, []string{"2075"}); err != nil {
+		t.Fatalf("Expected a fresh install to pass, got %v", err)
+	}
+
+	db, err := openDB(cfg.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewServer(db).initDB(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := checkCommand(cfg, []string{"2075"}); err != nil {
+		t.Errorf("Expected a migrated database to pass, got %v", err)
+	}
+
+	bad := cfg
+	bad.Store = "postgres"
+	bad.Countries = []string{"GB", "XX"}
+	if err := checkCommand(bad, []string{"2075"}); err == nil || !strings.Contains(err.Error(), "2 checks failed") {
+		t.Errorf("Expected the store and country to fail, got %v", err)
+	}
+
+	bad = cfg
+	bad.DBPath = filepath.Join(t.TempDir(), "missing", "appointments.db")
+	if err := checkCommand(bad, nil); err == nil {
+		t.Error("Expected a database in a missing directory to fail")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if errs := validateConfig(loadConfig()); len(errs) != 0 {
+		t.Errorf("Expected the defaults to be valid, got %v", errs)
+	}
+
+	cfg := loadConfig()
+	cfg.Store = "memory"
+	cfg.BackupInterval = 1
+	cfg.DailyCapacity = 0
+	cfg.HolidayAPIURL = "date.nager.at"
+	cfg.QueueLocations = map[string][]string{"annex": {"passports"}}
+	cfg.HolidayAction = "delete"
+	cfg.JobSchedules = map[string]string{"backup": "0 2 * *", "monthly-report": "0 8 1 * *"}
+	if errs := validateConfig(cfg); len(errs) != 6 {
+		t.Errorf("Expected 6 problems, got %v", errs)
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	db, err := sql.Open(sqliteDriver, sqliteDSN(":memory:", "rwc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// How the very first release left it
+	if _, err := db.Exec(`CREATE TABLE appointments (id INTEGER PRIMARY KEY, first_name TEXT, last_name TEXT, email TEXT, preferred_language TEXT, visit_date TEXT UNIQUE, created_at DATETIME)`); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := pendingMigrations(db, "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"create persons", "create appointment_events", "move appointment details into persons", "allow more than one booking a day", "add appointments.channel"} {
+		if !slices.Contains(pending, want) {
+			t.Errorf("Expected %q in %v", want, pending)
+		}
+	}
+
+	server := NewServer(db)
+	server.store = newEventStore(db)
+	if err := server.initDB(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := pendingMigrations(db, "events"); len(pending) != 0 {
+		t.Errorf("Expected nothing pending after Init, got %v", pending)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// POST /appointments/{id}/clone?visitDate=2075-02-01 books the same
+// person in again for a follow-up, as staff. It's a new booking with the
+// person, service, custom fields, address and consent of the old one,
+// checked like any other, so a date that's full, closed or too soon is
+// turned down the same way. Anyone else on the old booking isn't copied,
+// and the new one is a follow-up of it
+func (s *Server) cloneAppointment(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+	visitDate := r.URL.Query().Get("visitDate")
+	if visitDate == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "visitDate is required")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	was, err := s.store.Get(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+		return
+	}
+
+	s.book(w, r, AppointmentRequest{
+		FirstName:         was.FirstName,
+		LastName:          was.LastName,
+		Email:             was.Email,
+		VisitDate:         visitDate,
+		PreferredLanguage: was.PreferredLanguage,
+		Service:           was.Service,
+		CustomFields:      was.CustomFields,
+		Address:           was.Address,
+		Consent:           was.Consent,
+		Channel:           bookingChannel(r.Context()),
+		PersonID:          was.PersonID,
+		FollowUpOf:        was.ID,
+	}, today)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCloneAppointment(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, _ := closureServer(t, store)
+			server.cfg.QueueServices = []string{"general", "parking-permits"}
+			server.cfg.CustomFields = map[string]*fieldSchema{}
+			json.Unmarshal([]byte(parkingSchema), &server.cfg.CustomFields)
+			router := server.routes()
+
+			w := postAppointment(t, router, AppointmentRequest{FirstName: "Fion", LastName: "Follow", VisitDate: "2075-01-09", Service: "parking-permits",
+				PreferredLanguage: "cy", CustomFields: CustomFields{"vehicleReg": "AB12 CDE"}, Attendees: []Attendee{{FirstName: "Plus", LastName: "One"}}})
+			var was CreatedAppointment
+			if json.Unmarshal(w.Body.Bytes(), &was); w.Code != http.StatusCreated {
+				t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+			}
+
+			clone := func(path string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest("POST", path, nil))
+				return w
+			}
+			w = clone("/appointments/1/clone?visitDate=2075-01-16")
+			var cloned CreatedAppointment
+			json.Unmarshal(w.Body.Bytes(), &cloned)
+			if w.Code != http.StatusCreated || cloned.ID == was.ID || cloned.PersonID != was.PersonID || cloned.VisitDate != "2075-01-16" {
+				t.Fatalf("Expected the same person booked again, got %d: %s", w.Code, w.Body.String())
+			}
+			if cloned.Service != "parking-permits" || cloned.CustomFields["vehicleReg"] != "AB12 CDE" || cloned.PreferredLanguage != "cy" || cloned.Channel != ChannelStaff || len(cloned.Attendees) != 0 {
+				t.Errorf("Expected the service, fields and language copied by staff, got %+v", cloned.Appointment)
+			}
+
+			// The new date's checked like any other
+			for path, want := range map[string]int{
+				"/appointments/1/clone":                       http.StatusBadRequest,
+				"/appointments/1/clone?visitDate=2075-02-30":  http.StatusBadRequest,
+				"/appointments/1/clone?visitDate=2074-12-31":  http.StatusBadRequest,
+				"/appointments/99/clone?visitDate=2075-01-16": http.StatusNotFound,
+			} {
+				if w := clone(path); w.Code != want {
+					t.Errorf("Expected %d for %s, got %d: %s", want, path, w.Code, w.Body.String())
+				}
+			}
+
+			// Staff only
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/appointments/1/clone?visitDate=2075-01-16", nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected the public turned away, got %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Days the office shuts that aren't public holidays, snow days say.
+// POST /admin/closures blacks out a range and, in the same transaction,
+// either cancels every booking on those days or, with "action": "flag",
+// leaves them for staff to move by hand. Everyone affected is emailed
+// with a signed link to rebook ahead of everyone else: into the places
+// held back for priority bookings and without the service's notice
+type Closure struct {
+	XMLName      xml.Name  `json:"-" xml:"closure"`
+	ID           int       `json:"id" xml:"id"`
+	From         string    `json:"from" xml:"from"` // YYYY-MM-DD, inclusive
+	To           string    `json:"to" xml:"to"`
+	Reason       string    `json:"reason" xml:"reason"`
+	Action       string    `json:"action" xml:"action"`                // cancel or flag
+	Appointments []int     `json:"appointments" xml:"appointments>id"` // the bookings it affected
+	CreatedBy    string    `json:"createdBy" xml:"createdBy"`
+	CreatedAt    time.Time `json:"createdAt" xml:"createdAt"`
+}
+
+type ClosureList struct {
+	XMLName  xml.Name  `json:"-" xml:"closures"`
+	Closures []Closure `json:"closures" xml:"closure"`
+}
+
+const (
+	ClosureCancel = "cancel"
+	ClosureFlag   = "flag"
+)
+
+var (
+	ErrDayClosed       = errors.New("closed on this date")
+	ErrAlreadyRebooked = errors.New("already rebooked")
+)
+
+// When a closure cancels bookings, everyone gets a place held for them
+// on the first day after it with room, in the order they first booked,
+// for CITYNEXT_REBOOK_HOLD. Held places count as taken for everyone
+// else. One click on the link in the message takes it
+type RebookProposal struct {
+	XMLName       xml.Name  `json:"-" xml:"proposal"`
+	AppointmentID int       `json:"appointmentId" xml:"appointmentId"`
+	VisitDate     string    `json:"visitDate" xml:"visitDate"`
+	HeldUntil     time.Time `json:"heldUntil" xml:"heldUntil"`
+}
+
+// What the closure message is rendered with
+type ClosureNotice struct {
+	Appointment
+	Reason    string
+	Cancelled bool
+	RebookURL string // empty if links can't be signed
+
+	ProposedDate string // empty if there wasn't one
+	HeldUntil    string
+	AcceptURL    string
+}
+
+func (s *Server) sendDayClosed(w http.ResponseWriter, r *http.Request) {
+	s.sendErrorResponse(w, r, http.StatusBadRequest, CodeDayClosed, "The office is closed on that date")
+}
+
+// Closed days from to inclusive, keyed YYYY-MM-DD
+func (s *Server) closedDays(ctx context.Context, from, to time.Time) (map[string]bool, error) {
+	closures, err := s.store.Closures(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	closed := map[string]bool{}
+	for _, c := range closures {
+		first, _ := time.Parse("2006-01-02", c.From)
+		last, _ := time.Parse("2006-01-02", c.To)
+		for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+			closed[d.Format("2006-01-02")] = true
+		}
+	}
+	return closed, nil
+}
+
+// POST /admin/closures with {"from": "2075-01-09", "to": "2075-01-10",
+// "reason": "Snow", "action": "cancel"}
+func (s *Server) createClosure(w http.ResponseWriter, r *http.Request) {
+	var req Closure
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if req.From == "" || req.Reason == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "From and reason are required")
+		return
+	}
+	if req.To == "" {
+		req.To = req.From
+	}
+	from, errFrom := time.Parse("2006-01-02", req.From)
+	to, errTo := time.Parse("2006-01-02", req.To)
+	if errFrom != nil || errTo != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidDate, "Dates must be in YYYY-MM-DD format")
+		return
+	}
+	if to.Before(from) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidRange, "To can't be before from")
+		return
+	}
+	if req.Action == "" {
+		req.Action = ClosureCancel
+	}
+	if req.Action != ClosureCancel && req.Action != ClosureFlag {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidAction, "Action must be 'cancel' or 'flag'")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	closure, err := s.closeDays(ctx, Closure{From: req.From, To: req.To, Reason: req.Reason, Action: req.Action})
+	if err != nil {
+		log.Printf("Error closing %s to %s: %v", req.From, req.To, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to close those dates")
+		return
+	}
+	s.respond(w, r, http.StatusCreated, closure)
+}
+
+// Closes the days and sees to everyone booked on them, for a closure
+// staff make or a holiday that's landed on bookings
+func (s *Server) closeDays(ctx context.Context, req Closure) (Closure, error) {
+	closure, affected, err := s.store.Close(ctx, req)
+	if err != nil {
+		return Closure{}, err
+	}
+	log.Printf("Closed %s to %s (%s), %d bookings to %s", closure.From, closure.To, closure.Reason, len(affected), closure.Action)
+	s.invalidateAvailability(ctx)
+
+	// Could be hundreds, so not holding anything up. Everyone's place
+	// is held before anyone's told, so nobody's is taken by someone who
+	// read their email first. Any messages that fail are retried
+	go func() {
+		ctx := context.WithoutCancel(ctx)
+		proposals := map[int]RebookProposal{}
+		if closure.Action == ClosureCancel {
+			proposals = s.proposeRebookings(ctx, closure, affected)
+		}
+		for _, appointment := range affected {
+			s.notifyClosure(ctx, closure, appointment, proposals[appointment.ID])
+		}
+	}()
+	return closure, nil
+}
+
+// By when they booked, so the first to book gets the first day back.
+// Nobody gets one if the rest of the year is full
+func (s *Server) proposeRebookings(ctx context.Context, closure Closure, affected []Appointment) map[int]RebookProposal {
+	ordered := slices.Clone(affected)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].CreatedAt.Before(ordered[j].CreatedAt) })
+
+	start, _ := time.Parse("2006-01-02", closure.To)
+	start = start.AddDate(0, 0, 1)
+	if today, err := s.today(); err == nil && start.Before(today) {
+		start = today
+	}
+	end := time.Date(start.Year(), time.December, 31, 0, 0, 0, 0, time.UTC)
+	until := time.Now().Add(s.cfg.RebookHold).Truncate(time.Second).UTC()
+
+	holidays := s.holidaySet(ctx)
+	proposals := map[int]RebookProposal{}
+	for _, appointment := range ordered {
+		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+			if holidays.closed(d) {
+				continue
+			}
+			err := s.hold(ctx, appointment.ID, d, until)
+			if errors.Is(err, ErrDuplicateAppointment) || errors.Is(err, ErrDayClosed) {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error holding a place for appointment %d: %v", appointment.ID, err)
+			} else {
+				proposals[appointment.ID] = RebookProposal{AppointmentID: appointment.ID, VisitDate: d.Format("2006-01-02"), HeldUntil: until}
+			}
+			break
+		}
+	}
+	log.Printf("Held places for %d of the %d bookings closed on %s to %s", len(proposals), len(affected), closure.From, closure.To)
+	s.invalidateAvailability(ctx)
+	return proposals
+}
+
+// Into the places held back, as a rebooking would be
+func (s *Server) hold(ctx context.Context, id int, visitDate, until time.Time) error {
+	ctx, cancel := withTimeout(ctx, s.cfg.DBTimeout)
+	defer cancel()
+	return s.store.Hold(ctx, id, visitDate, until, s.capacityOn(visitDate))
+}
+
+func (s *Server) notifyClosure(ctx context.Context, closure Closure, appointment Appointment, proposal RebookProposal) {
+	ctx, cancel := withTimeout(ctx, s.cfg.NotifyTimeout)
+	defer cancel()
+
+	notice := ClosureNotice{Appointment: appointment, Reason: closure.Reason, Cancelled: closure.Action == ClosureCancel}
+	if s.signingEnabled(ctx) {
+		path := "/rebook/" + strconv.Itoa(appointment.ID)
+		notice.RebookURL = s.singleUseURL(ctx, path, time.Now().Add(s.cfg.RebookLinkTTL).Truncate(time.Second).UTC())
+		if proposal.VisitDate != "" {
+			notice.ProposedDate, notice.HeldUntil = proposal.VisitDate, proposal.HeldUntil.Format("2006-01-02 15:04 MST")
+			notice.AcceptURL = s.singleUseURL(ctx, path+"/accept", proposal.HeldUntil)
+		}
+	}
+	s.notifyWith(ctx, MessageClosure, appointment, notice)
+}
+
+// GET /admin/closures, the ones still to come or going on now unless ?all=true
+func (s *Server) listClosures(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+	from := today
+	if r.URL.Query().Get("all") == "true" {
+		from = time.Time{}
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	closures, err := s.store.Closures(ctx, from, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		log.Printf("Error listing closures: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list closures")
+		return
+	}
+	s.respond(w, r, http.StatusOK, ClosureList{Closures: closures})
+}
+
+// GET /rebook/{id} from the link in the closure message says which
+// booking it's for, as it was before the closure
+func (s *Server) getRebooking(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	revisions, err := s.store.History(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) || (err == nil && len(revisions) == 0) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d to rebook: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load the appointment")
+		return
+	}
+	s.respond(w, r, http.StatusOK, revisions[len(revisions)-1].Appointment)
+}
+
+// POST /rebook/{id} with {"visitDate": "2075-01-16"} books them in again
+// on a day of their choosing. Each link rebooks once, and takes the place
+// of any held for them
+func (s *Server) rebook(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	var req struct {
+		VisitDate string `json:"visitDate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	visitDate, ok := s.validateVisitDate(w, r, req.VisitDate, today)
+	if !ok {
+		return
+	}
+	s.rebookOn(w, r, id, visitDate)
+}
+
+// GET /rebook/{id}/accept from the link in the closure message says
+// which day's held for them and until when
+func (s *Server) getProposal(w http.ResponseWriter, r *http.Request) {
+	if proposal, ok := s.heldProposal(w, r); ok {
+		s.respond(w, r, http.StatusOK, proposal)
+	}
+}
+
+// POST /rebook/{id}/accept takes it, no body needed
+func (s *Server) acceptProposal(w http.ResponseWriter, r *http.Request) {
+	proposal, ok := s.heldProposal(w, r)
+	if !ok {
+		return
+	}
+	visitDate, _ := time.Parse("2006-01-02", proposal.VisitDate)
+	s.rebookOn(w, r, proposal.AppointmentID, visitDate)
+}
+
+func (s *Server) heldProposal(w http.ResponseWriter, r *http.Request) (RebookProposal, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	proposal, err := s.store.Proposal(ctx, id)
+	switch {
+	case errors.Is(err, ErrAppointmentNotFound):
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No place held for that appointment")
+		return RebookProposal{}, false
+	case errors.Is(err, ErrAlreadyRebooked):
+		s.sendErrorResponse(w, r, http.StatusConflict, CodeAlreadyRebooked, "That appointment has already been rebooked")
+		return RebookProposal{}, false
+	case err != nil:
+		log.Printf("Error loading the place held for appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load the place held")
+		return RebookProposal{}, false
+	}
+	if time.Now().After(proposal.HeldUntil) {
+		s.sendErrorResponse(w, r, http.StatusGone, CodeProposalExpired, "That place is no longer held, pick another day")
+		return RebookProposal{}, false
+	}
+	return proposal, true
+}
+
+// A flagged booking is moved, a cancelled one comes back with a new ID
+func (s *Server) rebookOn(w http.ResponseWriter, r *http.Request, id int, visitDate time.Time) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	// The held back places count, as they would for a priority booking
+	appointment, err := s.store.Rebook(ctx, id, visitDate, s.capacityOn(visitDate))
+	switch {
+	case errors.Is(err, ErrAppointmentNotFound):
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No closed appointment with that ID")
+		return
+	case errors.Is(err, ErrAlreadyRebooked):
+		s.sendErrorResponse(w, r, http.StatusConflict, CodeAlreadyRebooked, "That appointment has already been rebooked")
+		return
+	case errors.Is(err, ErrDayClosed):
+		s.sendDayClosed(w, r)
+		return
+	case errors.Is(err, ErrDuplicateAppointment):
+		s.sendFullyBooked(w, r)
+		return
+	case err != nil:
+		log.Printf("Error rebooking appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to rebook the appointment")
+		return
+	}
+	log.Printf("Appointment %d rebooked after a closure as %d on %s", id, appointment.ID, appointment.VisitDate)
+
+	s.invalidateAvailability(ctx)
+	s.noteOverbooking(ctx, appointment, visitDate, RevisionRescheduled)
+	s.respond(w, r, http.StatusOK, appointment)
+
+	go func() {
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+		defer cancel()
+		s.notifyAppointment(ctx, MessageConfirmation, appointment)
+	}()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Messages handed over as they're sent, from whichever goroutine sends them
+type channelNotifier chan Message
+
+func (c channelNotifier) Send(ctx context.Context, msg Message) error {
+	c <- msg
+	return nil
+}
+
+func (c channelNotifier) next(t *testing.T) Message {
+	t.Helper()
+	select {
+	case msg := <-c:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message")
+		return Message{}
+	}
+}
+
+// The links in a closure message, by what they're for
+func linksIn(msg Message, publicURL string) map[string]string {
+	links := map[string]string{}
+	for _, line := range strings.Split(msg.Text, "\n") {
+		path, ok := strings.CutPrefix(line, publicURL)
+		switch {
+		case !ok:
+		case strings.Contains(path, "/accept?"):
+			links["accept"] = path
+		default:
+			links["rebook"] = path
+		}
+	}
+	return links
+}
+
+func closureServer(t *testing.T, store string) (*Server, channelNotifier) {
+	var server *Server
+	switch store {
+	case "events":
+		server = setupEventServer(t)
+	default:
+		server = setupTestServer(t)
+		server.db.SetMaxOpenConns(1) // one :memory: database, not one per connection
+	}
+	if store == "memory" {
+		server.store = newMemoryStore()
+	}
+	server.cfg.AdminToken = "secret"
+	server.cfg.DownloadSecret = "download-secret"
+	server.cfg.RebookLinkTTL = time.Hour
+	server.cfg.PublicURL = "https://book.example.gov"
+	server.cfg.DailyCapacity = 3
+	sent := make(channelNotifier, 10)
+	server.notifier = sent
+	return server, sent
+}
+
+func TestClosureCancels(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, sent := closureServer(t, store)
+			router := server.routes()
+
+			for _, req := range []AppointmentRequest{
+				{FirstName: "Snowed", LastName: "In", Email: "a@example.com", VisitDate: "2075-01-09"},
+				{FirstName: "Also", LastName: "Snowed", Email: "b@example.com", VisitDate: "2075-01-10", PreferredLanguage: "cy"},
+				{FirstName: "Group", LastName: "Booking", Email: "c@example.com", VisitDate: "2075-01-10", Attendees: []Attendee{{FirstName: "Plus", LastName: "One"}}},
+				{FirstName: "Not", LastName: "Affected", Email: "d@example.com", VisitDate: "2075-01-15"},
+			} {
+				if w := postAppointment(t, router, req); w.Code != http.StatusCreated {
+					t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+				}
+				sent.next(t) // the confirmation
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/closures", []byte(`{"from": "2075-01-09", "to": "2075-01-10", "reason": "Snow"}`)))
+			var closure Closure
+			json.Unmarshal(w.Body.Bytes(), &closure)
+			if w.Code != http.StatusCreated || closure.Action != ClosureCancel || !slices.Equal(closure.Appointments, []int{1, 2, 3}) {
+				t.Fatalf("Expected the three on those days cancelled, got %d: %s", w.Code, w.Body.String())
+			}
+
+			links := map[string]string{}
+			for range 3 {
+				msg := sent.next(t)
+				links[msg.To] = linksIn(msg, server.cfg.PublicURL)["rebook"]
+				if !strings.Contains(msg.Text, "Snow") || !strings.Contains(msg.HTML, "href=") {
+					t.Errorf("Expected the reason and a link, got %+v", msg)
+				}
+			}
+			if !strings.HasPrefix(links["c@example.com"], "/rebook/3?") {
+				t.Fatalf("Expected a rebooking link, got %v", links)
+			}
+
+			// Nothing left on those days, nor can there be
+			for _, id := range []string{"1", "2", "3"} {
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest("GET", "/appointments/"+id+"/history", nil))
+				var history History
+				json.Unmarshal(w.Body.Bytes(), &history)
+				if n := len(history.Revisions); n == 0 || history.Revisions[n-1].Change != RevisionCancelled {
+					t.Errorf("Expected %s cancelled, got %s", id, w.Body.String())
+				}
+			}
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Too", LastName: "Late", VisitDate: "2075-01-09"}); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "day_closed") {
+				t.Errorf("Expected a closed day turned down, got %d: %s", w.Code, w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/4/reschedule", []byte(`{"visitDate": "2075-01-10"}`)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected no moving onto a closed day, got %d: %s", w.Code, w.Body.String())
+			}
+			w, availability := getAvailability(t, router, "/availability?month=2075-01", "")
+			if slices.Contains(availability.Dates, "2075-01-09") || slices.Contains(availability.Dates, "2075-01-10") || !slices.Contains(availability.Dates, "2075-01-11") {
+				t.Errorf("Expected the closed days gone from availability, got %v", availability.Dates)
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/admin/closures", nil))
+			var list ClosureList
+			json.Unmarshal(w.Body.Bytes(), &list)
+			if len(list.Closures) != 1 || list.Closures[0].Reason != "Snow" || list.Closures[0].CreatedBy == "" {
+				t.Errorf("Expected the closure listed, got %s", w.Body.String())
+			}
+
+			// The link says what it's for, and books them in again
+			link := links["c@example.com"]
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", link, nil))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"firstName":"Group"`) {
+				t.Errorf("Expected the booking it's for, got %d: %s", w.Code, w.Body.String())
+			}
+			rebook := func(link, date string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("POST", link, strings.NewReader(`{"visitDate": "`+date+`"}`)))
+				return w
+			}
+			if w := rebook(link, "2075-01-10"); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected no rebooking onto a closed day, got %d", w.Code)
+			}
+			w = rebook(link, "2075-01-16")
+			var rebooked Appointment
+			json.Unmarshal(w.Body.Bytes(), &rebooked)
+			if w.Code != http.StatusOK || rebooked.ID != 5 || rebooked.VisitDate != "2075-01-16" || rebooked.PersonID != 3 || len(rebooked.Attendees) != 1 {
+				t.Errorf("Expected them booked in again as they were, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := rebook(link, "2075-01-17"); w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "link_already_used") {
+				t.Errorf("Expected a link to rebook once, got %d: %s", w.Code, w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", link, nil))
+			if w.Code != http.StatusGone {
+				t.Errorf("Expected a used link to say so, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := rebook(strings.Replace(link, "jti=", "jti=0", 1), "2075-01-17"); w.Code != http.StatusForbidden {
+				t.Errorf("Expected a link with a new jti refused, got %d", w.Code)
+			}
+			if w := rebook(strings.Replace(link, "/rebook/3", "/rebook/4", 1), "2075-01-17"); w.Code != http.StatusForbidden {
+				t.Errorf("Expected a made up link refused, got %d", w.Code)
+			}
+
+			// Ahead of the queue, into the places held back
+			server.cfg.ReservedCapacity = 3
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Ordinary", LastName: "Booking", VisitDate: "2075-01-17"}); w.Code != http.StatusConflict {
+				t.Errorf("Expected a public booking kept out of the held back places, got %d", w.Code)
+			}
+			if w := rebook(links["a@example.com"], "2075-01-17"); w.Code != http.StatusOK {
+				t.Errorf("Expected a rebooking let into them, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestClosureFlags(t *testing.T) {
+	server, sent := closureServer(t, "sqlite")
+	router := server.routes()
+	postAppointment(t, router, AppointmentRequest{FirstName: "Stays", LastName: "Put", Email: "a@example.com", VisitDate: "2075-02-04"})
+	sent.next(t)
+
+	for _, bad := range []string{
+		`{"from": "2075-02-04"}`,
+		`{"from": "04/02/2075", "reason": "Flood"}`,
+		`{"from": "2075-02-05", "to": "2075-02-04", "reason": "Flood"}`,
+		`{"from": "2075-02-04", "reason": "Flood", "action": "ignore"}`,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/closures", []byte(bad)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", bad, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/closures", []byte(`{"from": "2075-02-04", "reason": "Flood", "action": "flag"}`)))
+	var closure Closure
+	json.Unmarshal(w.Body.Bytes(), &closure)
+	if w.Code != http.StatusCreated || closure.To != "2075-02-04" || !slices.Equal(closure.Appointments, []int{1}) {
+		t.Fatalf("Expected the booking flagged, got %d: %s", w.Code, w.Body.String())
+	}
+	msg := sent.next(t)
+	if !strings.Contains(msg.Subject, "needs to move") {
+		t.Errorf("Expected them told it needs to move, got %q", msg.Subject)
+	}
+
+	// Still there until it's moved, the same booking
+	if _, err := server.store.Get(context.Background(), 1); err != nil {
+		t.Errorf("Expected a flagged booking kept, got %v", err)
+	}
+	link := linksIn(msg, server.cfg.PublicURL)["rebook"]
+	if linksIn(msg, server.cfg.PublicURL)["accept"] != "" {
+		t.Errorf("Expected no place held for a booking that's still there")
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", link, strings.NewReader(`{"visitDate": "2075-02-06"}`)))
+	var moved Appointment
+	json.Unmarshal(w.Body.Bytes(), &moved)
+	if w.Code != http.StatusOK || moved.ID != 1 || moved.VisitDate != "2075-02-06" {
+		t.Errorf("Expected it moved, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRebookingProposals(t *testing.T) {
+	for _, store := range []string{"sqlite", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, sent := closureServer(t, store)
+			server.cfg.DailyCapacity = 2
+			server.cfg.RebookHold = 48 * time.Hour
+			router := server.routes()
+
+			// Booked first, so gets first pick even though their day's later
+			for _, req := range []AppointmentRequest{
+				{FirstName: "First", LastName: "Booked", Email: "c@example.com", VisitDate: "2075-01-10"},
+				{FirstName: "Second", LastName: "Booked", Email: "a@example.com", VisitDate: "2075-01-09"},
+				{FirstName: "Third", LastName: "Booked", Email: "b@example.com", VisitDate: "2075-01-09"},
+				{FirstName: "Already", LastName: "There", Email: "d@example.com", VisitDate: "2075-01-11"},
+			} {
+				if w := postAppointment(t, router, req); w.Code != http.StatusCreated {
+					t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+				}
+				sent.next(t)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/admin/closures", []byte(`{"from": "2075-01-09", "to": "2075-01-10", "reason": "Snow"}`)))
+
+			accept, rebookLinks := map[string]string{}, map[string]string{}
+			for range 3 {
+				msg := sent.next(t)
+				accept[msg.To] = linksIn(msg, server.cfg.PublicURL)["accept"]
+				rebookLinks[msg.To] = linksIn(msg, server.cfg.PublicURL)["rebook"]
+				if !strings.Contains(msg.Text, "held a place for you") {
+					t.Errorf("Expected a place offered, got %s", msg.Text)
+				}
+			}
+			for to, want := range map[string]string{"c@example.com": "2075-01-11", "a@example.com": "2075-01-12", "b@example.com": "2075-01-12"} {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("GET", accept[to], nil))
+				var proposal RebookProposal
+				json.Unmarshal(w.Body.Bytes(), &proposal)
+				if w.Code != http.StatusOK || proposal.VisitDate != want || time.Until(proposal.HeldUntil) < 47*time.Hour {
+					t.Errorf("Expected %s held %s for two days, got %d: %s", to, want, w.Code, w.Body.String())
+				}
+			}
+
+			// Held is taken, for everyone else
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Public", LastName: "Booking", VisitDate: "2075-01-12"}); w.Code != http.StatusConflict {
+				t.Errorf("Expected a held day full, got %d", w.Code)
+			}
+			_, availability := getAvailability(t, router, "/availability?month=2075-01", "")
+			if slices.Contains(availability.Dates, "2075-01-11") || slices.Contains(availability.Dates, "2075-01-12") || !slices.Contains(availability.Dates, "2075-01-13") {
+				t.Errorf("Expected the held days gone from availability, got %v", availability.Dates)
+			}
+
+			// One click takes it
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", accept["c@example.com"], nil))
+			var rebooked Appointment
+			json.Unmarshal(w.Body.Bytes(), &rebooked)
+			if w.Code != http.StatusOK || rebooked.VisitDate != "2075-01-11" || rebooked.FirstName != "First" {
+				t.Errorf("Expected the held place taken, got %d: %s", w.Code, w.Body.String())
+			}
+			if booked, _ := server.store.Booked(context.Background(), time.Date(2075, 1, 11, 0, 0, 0, 0, time.UTC)); booked != 2 {
+				t.Errorf("Expected the hold to become the booking, not as well as, got %d", booked)
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", accept["c@example.com"], nil))
+			if w.Code != http.StatusGone {
+				t.Errorf("Expected a second click turned away, got %d", w.Code)
+			}
+			// A link of their own for each, but it's the one booking
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", rebookLinks["c@example.com"], strings.NewReader(`{"visitDate": "2075-01-16"}`)))
+			if w.Code != http.StatusConflict {
+				t.Errorf("Expected the rebooking link turned away once they've accepted, got %d", w.Code)
+			}
+
+			// Once a hold's run out the place is anyone's
+			server.store.Hold(context.Background(), 2, time.Date(2075, 1, 12, 0, 0, 0, 0, time.UTC), time.Now().Add(-time.Minute), 2)
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Public", LastName: "Booking", VisitDate: "2075-01-12"}); w.Code != http.StatusCreated {
+				t.Errorf("Expected the place back once the hold ran out, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
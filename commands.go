@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Things you can run instead of the server, e.g. "go run . backup out.db"
+var commands = map[string]func(cfg Config, args []string) error{
+	"backup":   backupCommand,
+	"restore":  restoreCommand,
+	"recover":  recoverCommand,
+	"seed":     seedCommand,
+	"loadtest": loadtestCommand,
+	"check":    checkCommand,
+
+	"refresh-holidays": refreshHolidaysCommand,
+	"purge-documents":  purgeDocumentsCommand,
+	"send-reminders":   sendRemindersCommand,
+	"rebalance":        rebalanceCommand,
+
+	"rebuild-projection": rebuildProjectionCommand,
+	"migrate-postgres":   migratePostgresCommand,
+}
+
+// backup [file] - snapshot the database, into the backup dir if no file given
+func backupCommand(cfg Config, args []string) error {
+	db, err := openDB(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(args) > 0 {
+		if err := backupDatabase(context.Background(), db, args[0]); err != nil {
+			return err
+		}
+		log.Printf("Backed up %s to %s", cfg.DBPath, args[0])
+		return nil
+	}
+
+	server := NewServer(db)
+	server.cfg = cfg
+	_, err = server.runBackup(context.Background())
+	return err
+}
+
+// restore <file> - replace the database with a snapshot, server stopped first
+func restoreCommand(cfg Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: restore <snapshot file>")
+	}
+	if err := restoreDatabase(args[0], cfg.DBPath); err != nil {
+		return err
+	}
+	log.Printf("Restored %s from %s", cfg.DBPath, args[0])
+	return nil
+}
+
+// recover - rebuild the database from the latest replica
+func recoverCommand(cfg Config, args []string) error {
+	replicator := newReplicator(cfg)
+	if replicator == nil {
+		return errors.New("no CITYNEXT_REPLICA_DIR or S3 bucket configured")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "citynext-recover")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshot := filepath.Join(tmpDir, "replica.db")
+	if err := replicator.Fetch(context.Background(), snapshot); err != nil {
+		return err
+	}
+	if err := restoreDatabase(snapshot, cfg.DBPath); err != nil {
+		return err
+	}
+	log.Printf("Recovered %s from the latest replica", cfg.DBPath)
+	return nil
+}
+
+// seed <year> [count] - fill the database with fake appointments
+func seedCommand(cfg Config, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: seed <year> [count]")
+	}
+	year, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New("year must be a number")
+	}
+	count := 150
+	if len(args) > 1 {
+		if count, err = strconv.Atoi(args[1]); err != nil {
+			return errors.New("count must be a number")
+		}
+	}
+
+	db, err := openDB(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	server := NewServer(db)
+	server.cfg = cfg
+	if cfg.Store == "events" {
+		server.store = newEventStore(db)
+	}
+	if err := server.initDB(); err != nil {
+		return err
+	}
+	if err := server.loadHolidays(context.Background(), args[0], cfg.Countries); err != nil {
+		return err
+	}
+
+	seed := uint64(time.Now().UnixNano())
+	added, err := server.seedAppointments(context.Background(), year, count, rand.New(rand.NewPCG(seed, seed)))
+	if err != nil {
+		return err
+	}
+	log.Printf("Seeded %d appointments for %d", added, year)
+	return nil
+}
+
+// rebuild-projection - replay the event log into the appointments table,
+// for CITYNEXT_STORE=events. Stop the server first
+func rebuildProjectionCommand(cfg Config, args []string) error {
+	db, err := openDB(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	store := newEventStore(db)
+	if err := store.Init(); err != nil {
+		return err
+	}
+	replayed, err := store.Rebuild(context.Background())
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilt appointments from %d events", replayed)
+	return nil
+}
+
+// refresh-holidays [url] - have the running server fetch its holidays
+// again now, default http://localhost:8080, with CITYNEXT_ADMIN_TOKEN
+func refreshHolidaysCommand(cfg Config, args []string) error {
+	url := "http://localhost:8080"
+	if len(args) > 0 {
+		url = strings.TrimSuffix(args[0], "/")
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/admin/holidays/refresh", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("server said %d %s: %s", resp.StatusCode, e.Error, e.Message)
+	}
+	var refresh HolidayRefresh
+	if err := json.NewDecoder(resp.Body).Decode(&refresh); err != nil {
+		return err
+	}
+
+	log.Printf("Refreshed %d holidays for %s in %s", refresh.Holidays, refresh.Year, strings.Join(refresh.Countries, ", "))
+	for _, c := range refresh.Changes {
+		if c.Was != "" {
+			log.Printf("  %s %s: %s, was %s, now %s", c.Change, c.CountryCode, c.Name, c.Was, c.Date)
+		} else {
+			log.Printf("  %s %s: %s on %s", c.Change, c.CountryCode, c.Name, c.Date)
+		}
+	}
+	if len(refresh.Changes) == 0 {
+		log.Printf("  nothing changed")
+	}
+	return nil
+}
+
+// Takes --dry-run out of the args, wherever it is
+func dryRunFlag(args []string) ([]string, bool) {
+	rest := slices.DeleteFunc(slices.Clone(args), func(arg string) bool { return arg == "--dry-run" })
+	return rest, len(rest) < len(args)
+}
+
+// purge-documents [--dry-run] - delete the documents past
+// CITYNEXT_DOCUMENT_RETENTION_DAYS now rather than on the server's next
+// hourly run. With --dry-run each one that would go is logged and
+// nothing is touched, not even the schema, to try a retention rule out
+// on the real database before turning it on
+func purgeDocumentsCommand(cfg Config, args []string) error {
+	args, dryRun := dryRunFlag(args)
+	if len(args) > 0 {
+		return errors.New("usage: purge-documents [--dry-run]")
+	}
+	if cfg.DocumentRetentionDays <= 0 {
+		return errors.New("CITYNEXT_DOCUMENT_RETENTION_DAYS isn't set, documents are kept for ever")
+	}
+
+	if _, err := os.Stat(cfg.DBPath); dryRun && err != nil {
+		return err // rather than make an empty one
+	}
+	db, err := openDB(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	server := NewServer(db)
+	server.cfg = cfg
+	server.yearStr = strconv.Itoa(time.Now().Year())
+	if server.blobs = newBlobStore(cfg); server.blobs == nil && !dryRun {
+		return errors.New("there's no blob store to delete documents from")
+	}
+	if !dryRun {
+		if err := server.initDB(); err != nil {
+			return err
+		}
+	}
+	today, err := server.today()
+	if err != nil {
+		return err
+	}
+	n, err := server.deleteExpiredDocuments(withActor(context.Background(), ActorRetention), today, dryRun)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		log.Printf("Deleted %d documents", n)
+	}
+	return nil
+}
+
+// send-reminders [--dry-run] - send the reminders due under
+// CITYNEXT_REMINDER_DAYS now rather than on the server's next run. With
+// --dry-run each booking that would be reminded is logged and nothing
+// is sent or changed, to check a reminder rule against the real bookings
+func sendRemindersCommand(cfg Config, args []string) error {
+	args, dryRun := dryRunFlag(args)
+	if len(args) > 0 {
+		return errors.New("usage: send-reminders [--dry-run]")
+	}
+	if cfg.ReminderDays <= 0 {
+		return errors.New("CITYNEXT_REMINDER_DAYS isn't set, no reminders are sent")
+	}
+
+	if _, err := os.Stat(cfg.DBPath); dryRun && err != nil {
+		return err // rather than make an empty one
+	}
+	db, err := openDB(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	server := NewServer(db)
+	server.cfg = cfg
+	server.yearStr = strconv.Itoa(time.Now().Year())
+	if !dryRun {
+		if server.notifier, server.texts, server.letters, err = newNotifiers(cfg); err != nil {
+			return err
+		}
+		if err := server.initDB(); err != nil {
+			return err
+		}
+	}
+	today, err := server.today()
+	if err != nil {
+		return err
+	}
+	n, err := server.sendReminders(context.Background(), today, dryRun)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		log.Printf("Sent %d reminders", n)
+	}
+	return nil
+}
+
+// rebalance [--dry-run] <date> <capacity> [url] - have the running server
+// cut a day to fewer places and move whoever doesn't fit, default
+// http://localhost:8080, with CITYNEXT_ADMIN_TOKEN. With --dry-run it
+// only logs the plan, which is all POST /admin/rebalance does anyway
+func rebalanceCommand(cfg Config, args []string) error {
+	args, dryRun := dryRunFlag(args)
+	if len(args) < 2 {
+		return errors.New("usage: rebalance [--dry-run] <date> <capacity> [url]")
+	}
+	capacity, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errors.New("capacity must be a number")
+	}
+	url := "http://localhost:8080"
+	if len(args) > 2 {
+		url = strings.TrimSuffix(args[2], "/")
+	}
+
+	var plan RebalancePlan
+	if err := postAdmin(cfg, url+"/admin/rebalance", map[string]any{"visitDate": args[0], "capacity": capacity}, &plan); err != nil {
+		return err
+	}
+	verb := "Moving"
+	if dryRun {
+		verb = "Dry run: would move"
+	}
+	log.Printf("%s %d bookings off %s, %d people booked, cut to %d (%s)", verb, len(plan.Moves), plan.VisitDate, plan.Booked, plan.Capacity, plan.Rule)
+	for _, move := range plan.Moves {
+		log.Printf("  appointment %d, %d people, to %s", move.AppointmentID, move.PartySize, cmp.Or(move.ToDate, "nowhere, there's no room"))
+	}
+	if dryRun {
+		return nil
+	}
+	if err := postAdmin(cfg, url+"/admin/rebalance/apply", plan, &plan); err != nil {
+		return err
+	}
+	log.Printf("Rebalanced %s at %s", plan.VisitDate, plan.AppliedAt.Format(time.RFC3339))
+	return nil
+}
+
+// POSTs body as JSON with the admin token and decodes the 200 into v
+func postAdmin(cfg Config, url string, body, v any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("server said %d %s: %s", resp.StatusCode, e.Error, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressLargeResponses(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.CompressMinBytes = 100
+
+	body := `{"appointments":"` + strings.Repeat("x", 500) + `"}`
+	handler := server.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, r.URL.Query().Get("prefix"))
+		if r.URL.Query().Get("big") != "" {
+			io.WriteString(w, body)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/?big=1", nil)
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := io.ReadAll(gz)
+	if string(decoded) != body {
+		t.Errorf("Expected body to survive compression")
+	}
+
+	// Under the threshold it goes out as is
+	r = httptest.NewRequest("GET", "/?prefix=small", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "small" {
+		t.Errorf("Expected small response uncompressed, got %q", w.Body.String())
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                   "",
+		"gzip, deflate, br":  "gzip",
+		"deflate":            "deflate",
+		"gzip;q=0, deflate":  "deflate",
+		"br":                 "",
+		"GZIP;q=0.5":         "gzip",
+		"identity, gzip;q=0": "",
+	}
+	for header, want := range cases {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everything other than the year comes from the environment, or the
+// CITYNEXT_CONFIG_FILE if there is one, so the command line doesn't
+// keep growing
+type Config struct {
+	Store         string   // sqlite, events (sqlite plus an event log) or memory
+	Countries     []string // whose public holidays close the office, e.g. GB,IE for one on the border
+	HolidayAPIURL string   // Nager.Date or something that answers like it
+
+	HolidayRefresh  time.Duration // how old holidays get before they're fetched again, 0 is never
+	HolidayMaxStale time.Duration // how old before bookings stop, 0 is never
+	HolidayImpactTo []string      // who's emailed when a new holiday lands on bookings
+	HolidayAction   string        // what's done with those bookings: nothing, cancel or flag
+	DBPath          string
+	DBPool          DBPoolConfig
+	PostgresURL     string // where migrate-postgres copies the database to
+	TemplateDir     string // overrides for the embedded message templates
+	Notifier        string // log or govuk-notify, what sends messages
+	Notify          NotifyConfig
+	AdminToken      string // bearer token for /admin, admin is off without one
+	PhoneToken      string // bearer token for the call centre's /channel/phone, off without one
+	KioskToken      string // bearer token for the lobby kiosk's /kiosk, off without one
+	IVRToken        string // bearer token for the phone line's /channel/ivr, off without one
+
+	MailgunSigningKey string // checks replies Mailgun forwards, off without one
+	SESInboundToken   string // in the URL SNS posts replies from SES to, off without one
+
+	BackupDir      string
+	BackupInterval time.Duration // 0 means no scheduled backups
+	S3             S3Config      // the bucket for blobs and replicas, if set
+	BlobDir        string        // where blobs go instead of the bucket, see blobstore.go
+
+	IntegrityCheckInterval time.Duration // how often the database is checked for corruption, 0 is never
+
+	ReplicaInterval time.Duration // how often to ship changes, 0 is off
+	ReplicaDir      string        // replicate to a directory instead of S3
+
+	JobSchedules map[string]string // cron expressions by job name, in place of the job's interval, see cron.go
+	JobTimezone  string            // what the schedules' wall clock is, the server's local time if blank
+
+	RedisURL           string // shared cache and locks across replicas, e.g. redis://host:6379/0
+	RateLimitPerMinute int    // bookings per client IP, 0 is unlimited
+
+	LockoutThreshold int           // wrong tokens from an IP before it's locked out, 0 is never
+	LockoutDuration  time.Duration // how long a lockout lasts, and how long failures are counted for
+	SessionTTL       time.Duration // how long an admin login in a browser lasts
+
+	// How long each kind of outside call gets before we give up on it
+	DBTimeout         time.Duration
+	HolidayAPITimeout time.Duration
+	NotifyTimeout     time.Duration
+
+	// And for the HTTP server itself
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	HandlerTimeout    time.Duration // per request, answered with a 503
+	ShutdownTimeout   time.Duration // for requests in flight to finish on SIGTERM
+
+	Listen string // ":8080", or "unix:/path/to.sock", unless systemd hands us a socket
+
+	CompressMinBytes int // smallest response worth compressing, -1 turns it off
+
+	DailyCapacity int                  // people who can be seen a day, everyone on a group booking counts
+	Overbooking   map[time.Weekday]int // percent over capacity that can be booked, by weekday
+
+	Features map[string]bool // feature flags switched on or off for this environment
+
+	Experiments map[string][]experimentVariant // booking flow experiments and their variants
+
+	BookingOpens map[string]time.Time // when booking starts for a service, open all along if it's not here
+
+	ChannelQuotas map[string]int // percent of each day held for a channel, e.g. phone
+
+	CustomFields map[string]*fieldSchema // what each service's booking form asks for
+
+	EligibilityRules map[string][]*eligibilityRule // who can book each service
+
+	PrivacyNoticeVersion string // the one bookings have to accept, consent isn't asked for without one
+	PrivacyNoticeURL     string // where it's published
+
+	AddressRequired []string       // services that won't book without an address, for proof of residency
+	PostcodeLookup  PostcodeConfig // what addresses are checked against, nothing if no provider
+	ResidencyAreas  []string       // councils those addresses have to be in, anywhere if empty
+
+	DocumentMaxBytes      int64         // biggest upload allowed
+	DocumentTypes         []string      // what uploads can be, by what's in them
+	ClamdAddr             string        // ClamAV to scan uploads with, none if empty
+	DocumentRetentionDays int           // how long after the visit documents are kept, 0 for ever
+	ExportTTL             time.Duration // how long stored exports are kept, 0 for ever
+
+	DownloadSecret  string        // signs download links, they're off without one
+	DownloadLinkTTL time.Duration // the longest a download link lasts
+	PublicURL       string        // where the public reach us, for links in emails
+	RebookLinkTTL   time.Duration // how long the link to rebook after a closure lasts
+	ProfileLinkTTL  time.Duration // how long the link to a returning citizen's details lasts
+	RebookHold      time.Duration // how long the place proposed after a closure is held
+	RebalanceRule   string        // who moves first when a day is cut, see rebalanceRules
+
+	PriorityClasses  map[string][]string // the services each priority class gets priority for
+	PriorityVerified []string            // classes only staff can book with
+	ReservedCapacity int                 // places a day only priority bookings can have
+	LeadDays         map[string]int      // days' notice each service needs, priority bookings excepted
+	NameMaxLength    int                 // characters in a first or last name, 0 for no limit
+	NameCharacters   string              // what's allowed in names, see nameCharacters
+	FollowUpGaps     map[string]int      // days a follow-up for each service has to be after the visit before
+
+	AdmissionRate   int           // bookings let in from the waiting room a second
+	AdmissionWindow time.Duration // how long someone let in has to book
+
+	CORSOrigins []string // sites whose pages can call the API, "*" for any
+	LogLevel    string   // info, or debug for the chatty lines too
+
+	SlowQueryThreshold time.Duration // queries taking this long or longer are logged, 0 logs none
+
+	AnalyticsSink  string // file:<path> or a URL for funnel events, none if empty
+	AnalyticsKey   string // what identifiers in them are hashed with
+	AnalyticsToken string // bearer token for an http(s) sink
+
+	MonthlyReportTo []string // who gets last month's report by email, nobody if empty
+	ReminderDays    int      // how many days ahead people are reminded of their visit, 0 sends no reminders
+
+	QueueServices  []string            // what people can queue for when they check in, the first is the default
+	QueueLocations map[string][]string // which services each waiting room's display shows
+}
+
+// SQLite only has one writer at a time anyway, so there's no point in
+// lots of connections, but readers shouldn't queue behind each other
+type DBPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func loadConfig() Config {
+	return Config{
+		Store:         envString("CITYNEXT_STORE", "sqlite"),
+		Countries:     envList("CITYNEXT_COUNTRIES", []string{"GB"}),
+		HolidayAPIURL: envString("CITYNEXT_HOLIDAY_API_URL", defaultHolidayAPIURL),
+
+		HolidayRefresh:  envDuration("CITYNEXT_HOLIDAY_REFRESH", 24*time.Hour),
+		HolidayMaxStale: envDuration("CITYNEXT_HOLIDAY_MAX_STALE", 7*24*time.Hour),
+		HolidayImpactTo: envList("CITYNEXT_HOLIDAY_IMPACT_TO", nil),
+		HolidayAction:   envString("CITYNEXT_HOLIDAY_ACTION", ""),
+		DBPath:          envString("CITYNEXT_DB_PATH", "./appointments.db"),
+		DBPool: DBPoolConfig{
+			MaxOpenConns:    envInt("CITYNEXT_DB_MAX_OPEN_CONNS", 10),
+			MaxIdleConns:    envInt("CITYNEXT_DB_MAX_IDLE_CONNS", 5),
+			ConnMaxLifetime: envDuration("CITYNEXT_DB_CONN_MAX_LIFETIME", time.Hour),
+		},
+		PostgresURL: envSecret("CITYNEXT_POSTGRES_URL"),
+		TemplateDir: envString("CITYNEXT_TEMPLATE_DIR", ""),
+		Notifier:    envString("CITYNEXT_NOTIFIER", "log"),
+		Notify: NotifyConfig{
+			APIKey:         envSecret("CITYNEXT_NOTIFY_API_KEY"),
+			URL:            envString("CITYNEXT_NOTIFY_URL", defaultNotifyURL),
+			EmailTemplate:  envString("CITYNEXT_NOTIFY_EMAIL_TEMPLATE", ""),
+			SMSTemplate:    envString("CITYNEXT_NOTIFY_SMS_TEMPLATE", ""),
+			LetterTemplate: envString("CITYNEXT_NOTIFY_LETTER_TEMPLATE", ""),
+			EmailReplyTo:   envString("CITYNEXT_NOTIFY_EMAIL_REPLY_TO", ""),
+		},
+		AdminToken: envSecret("CITYNEXT_ADMIN_TOKEN"),
+		PhoneToken: envSecret("CITYNEXT_PHONE_TOKEN"),
+		KioskToken: envSecret("CITYNEXT_KIOSK_TOKEN"),
+		IVRToken:   envSecret("CITYNEXT_IVR_TOKEN"),
+
+		MailgunSigningKey: envSecret("CITYNEXT_MAILGUN_SIGNING_KEY"),
+		SESInboundToken:   envSecret("CITYNEXT_SES_INBOUND_TOKEN"),
+
+		BackupDir:      envString("CITYNEXT_BACKUP_DIR", "./backups"),
+		BackupInterval: envDuration("CITYNEXT_BACKUP_INTERVAL", 0),
+		S3: S3Config{
+			Endpoint:  envString("CITYNEXT_S3_ENDPOINT", ""),
+			Region:    envString("CITYNEXT_S3_REGION", "us-east-1"),
+			Bucket:    envString("CITYNEXT_S3_BUCKET", ""),
+			AccessKey: envSecret("CITYNEXT_S3_ACCESS_KEY"),
+			SecretKey: envSecret("CITYNEXT_S3_SECRET_KEY"),
+		},
+		BlobDir: envString("CITYNEXT_BLOB_DIR", envString("CITYNEXT_DOCUMENT_DIR", "")),
+
+		IntegrityCheckInterval: envDuration("CITYNEXT_INTEGRITY_CHECK_INTERVAL", 24*time.Hour),
+
+		ReplicaInterval: envDuration("CITYNEXT_REPLICA_INTERVAL", 0),
+		ReplicaDir:      envString("CITYNEXT_REPLICA_DIR", ""),
+
+		JobSchedules: envJobSchedules(),
+		JobTimezone:  envString("CITYNEXT_JOB_TIMEZONE", ""),
+
+		RedisURL:           envSecret("CITYNEXT_REDIS_URL"),
+		RateLimitPerMinute: envInt("CITYNEXT_RATE_LIMIT_PER_MINUTE", 0),
+
+		LockoutThreshold: envInt("CITYNEXT_LOCKOUT_THRESHOLD", 0), // off, behind a TCP proxy every client has its IP
+		LockoutDuration:  envDuration("CITYNEXT_LOCKOUT_DURATION", 15*time.Minute),
+		SessionTTL:       envDuration("CITYNEXT_SESSION_TTL", 8*time.Hour),
+
+		DBTimeout:         envDuration("CITYNEXT_DB_TIMEOUT", 5*time.Second),
+		HolidayAPITimeout: envDuration("CITYNEXT_HOLIDAY_API_TIMEOUT", 10*time.Second),
+		NotifyTimeout:     envDuration("CITYNEXT_NOTIFY_TIMEOUT", 30*time.Second),
+
+		ReadHeaderTimeout: envDuration("CITYNEXT_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("CITYNEXT_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      envDuration("CITYNEXT_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("CITYNEXT_IDLE_TIMEOUT", 2*time.Minute),
+		HandlerTimeout:    envDuration("CITYNEXT_HANDLER_TIMEOUT", 20*time.Second),
+		ShutdownTimeout:   envDuration("CITYNEXT_SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		Listen: envString("CITYNEXT_LISTEN", ":8080"),
+
+		CompressMinBytes: envInt("CITYNEXT_COMPRESS_MIN_BYTES", 1024),
+
+		DailyCapacity: envInt("CITYNEXT_DAILY_CAPACITY", 1),
+		Overbooking:   envOverbooking("CITYNEXT_OVERBOOKING"),
+
+		Features: envFeatures("CITYNEXT_FEATURES"),
+
+		Experiments: envExperiments("CITYNEXT_EXPERIMENTS"),
+
+		BookingOpens: envBookingOpens("CITYNEXT_BOOKING_OPENS"),
+
+		ChannelQuotas: envChannelQuotas("CITYNEXT_CHANNEL_QUOTAS"),
+
+		CustomFields: envCustomFields("CITYNEXT_CUSTOM_FIELDS"),
+
+		EligibilityRules: envEligibilityRules("CITYNEXT_ELIGIBILITY_RULES"),
+
+		PrivacyNoticeVersion: envString("CITYNEXT_PRIVACY_NOTICE_VERSION", ""),
+		PrivacyNoticeURL:     envString("CITYNEXT_PRIVACY_NOTICE_URL", ""),
+
+		AddressRequired: envList("CITYNEXT_ADDRESS_REQUIRED", nil),
+		PostcodeLookup: PostcodeConfig{
+			Provider: envString("CITYNEXT_POSTCODE_LOOKUP", ""),
+			APIKey:   envSecret("CITYNEXT_POSTCODE_LOOKUP_KEY"),
+			URL:      envString("CITYNEXT_POSTCODE_LOOKUP_URL", ""),
+		},
+		ResidencyAreas: envList("CITYNEXT_RESIDENCY_AREAS", nil),
+
+		DocumentMaxBytes:      int64(envInt("CITYNEXT_DOCUMENT_MAX_BYTES", 10<<20)),
+		DocumentTypes:         envList("CITYNEXT_DOCUMENT_TYPES", []string{"application/pdf", "image/jpeg", "image/png"}),
+		ClamdAddr:             envString("CITYNEXT_CLAMD_ADDR", ""),
+		DocumentRetentionDays: envInt("CITYNEXT_DOCUMENT_RETENTION_DAYS", 0),
+		ExportTTL:             envDuration("CITYNEXT_EXPORT_TTL", 7*24*time.Hour),
+
+		DownloadSecret:  envSecret("CITYNEXT_DOWNLOAD_SECRET"),
+		DownloadLinkTTL: envDuration("CITYNEXT_DOWNLOAD_LINK_TTL", 24*time.Hour),
+		PublicURL:       strings.TrimSuffix(envString("CITYNEXT_PUBLIC_URL", ""), "/"),
+		RebookLinkTTL:   envDuration("CITYNEXT_REBOOK_LINK_TTL", 30*24*time.Hour),
+		ProfileLinkTTL:  envDuration("CITYNEXT_PROFILE_LINK_TTL", time.Hour),
+		RebookHold:      envDuration("CITYNEXT_REBOOK_HOLD", 48*time.Hour),
+		RebalanceRule:   envString("CITYNEXT_REBALANCE_RULE", RebalanceLatestBooked),
+
+		PriorityClasses:  envMap("CITYNEXT_PRIORITY_CLASSES"),
+		PriorityVerified: envList("CITYNEXT_PRIORITY_VERIFIED", nil),
+		ReservedCapacity: envInt("CITYNEXT_RESERVED_CAPACITY", 0),
+		LeadDays:         envLeadDays("CITYNEXT_LEAD_DAYS"),
+		NameMaxLength:    envInt("CITYNEXT_NAME_MAX_LENGTH", 100),
+		NameCharacters:   envString("CITYNEXT_NAME_CHARACTERS", NameCharactersLetters),
+		FollowUpGaps:     envLeadDays("CITYNEXT_FOLLOW_UP_GAP_DAYS"),
+
+		AdmissionRate:   envInt("CITYNEXT_ADMISSION_RATE", 5),
+		AdmissionWindow: envDuration("CITYNEXT_ADMISSION_WINDOW", 10*time.Minute),
+
+		CORSOrigins: envList("CITYNEXT_CORS_ORIGINS", []string{"*"}),
+		LogLevel:    envString("CITYNEXT_LOG_LEVEL", "info"),
+
+		SlowQueryThreshold: envDuration("CITYNEXT_SLOW_QUERY_THRESHOLD", 250*time.Millisecond),
+
+		AnalyticsSink:  envString("CITYNEXT_ANALYTICS_SINK", ""),
+		AnalyticsKey:   envSecret("CITYNEXT_ANALYTICS_KEY"),
+		AnalyticsToken: envSecret("CITYNEXT_ANALYTICS_TOKEN"),
+
+		MonthlyReportTo: envList("CITYNEXT_MONTHLY_REPORT_TO", nil),
+		ReminderDays:    envInt("CITYNEXT_REMINDER_DAYS", 0),
+
+		QueueServices:  envList("CITYNEXT_QUEUE_SERVICES", []string{"general"}),
+		QueueLocations: envMap("CITYNEXT_QUEUE_LOCATIONS"),
+	}
+}
+
+func envString(key, def string) string {
+	configFile.RLock()
+	v, ok := configFile.values[key]
+	configFile.RUnlock()
+	if !ok {
+		v, ok = os.LookupEnv(key)
+	}
+	if ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// KEY=value lines, as for systemd's EnvironmentFile, read on start and
+// again on every reload. What's in the file wins over the environment,
+// since the environment can't be changed under a running server
+var configFile struct {
+	sync.RWMutex
+	values map[string]string
+}
+
+func readConfigFile(path string) error {
+	values := map[string]string{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return fmt.Errorf("%s line %d: expected KEY=value", path, i+1)
+			}
+			values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+
+	configFile.Lock()
+	configFile.values = values
+	configFile.Unlock()
+	return nil
+}
+
+func envInt(key string, def int) int {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return n
+}
+
+// Comma separated, blanks dropped
+func envList(key string, def []string) []string {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Durations in Go syntax, e.g. "24h" or "90s"
+func envDuration(key string, def time.Duration) time.Duration {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return d
+}
+
+// CITYNEXT_<JOB>_SCHEDULE for each job that has one. A variable each,
+// since cron lists have commas in
+func envJobSchedules() map[string]string {
+	schedules := map[string]string{}
+	for _, name := range jobNames {
+		if expr := envString(jobScheduleEnv(name), ""); expr != "" {
+			schedules[name] = expr
+		}
+	}
+	return schedules
+}
+
+// Comma separated name=value pairs, several values split by "|", e.g.
+// "lobby=general|passports,annex=council-tax"
+func envMap(key string) map[string][]string {
+	m := map[string][]string{}
+	for _, item := range envList(key, nil) {
+		name, values, ok := strings.Cut(item, "=")
+		if !ok {
+			log.Printf("Ignoring %s entry %q, expected name=value", key, item)
+			continue
+		}
+		name = strings.TrimSpace(name)
+		for _, v := range strings.Split(values, "|") {
+			if v = strings.TrimSpace(v); v != "" {
+				m[name] = append(m[name], v)
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"time"
+)
+
+// With CITYNEXT_PRIVACY_NOTICE_VERSION set, every booking has to say
+// they've accepted that version of the privacy notice, and which version
+// it was is kept with the booking and in its history, as the evidence
+// for processing their details. Bump the version with the notice and
+// bookings made against the old one are turned away until the form
+// catches up
+type Consent struct {
+	XMLName    xml.Name  `json:"-" xml:"consent"`
+	Accepted   bool      `json:"accepted" xml:"accepted"`
+	Version    string    `json:"version" xml:"version"`
+	AcceptedAt time.Time `json:"acceptedAt,omitzero" xml:"acceptedAt,omitempty"` // set when it's booked, not by the client
+}
+
+type PrivacyNotice struct {
+	XMLName  xml.Name `json:"-" xml:"privacyNotice"`
+	Version  string   `json:"version" xml:"version"`
+	URL      string   `json:"url,omitempty" xml:"url,omitempty"`
+	Required bool     `json:"required" xml:"required"` // whether bookings need consent to it
+}
+
+type ConsentRequired struct {
+	XMLName xml.Name `json:"-" xml:"errorResponse"`
+	Error   string   `json:"error" xml:"error"`
+	Message string   `json:"message" xml:"message"`
+	Version string   `json:"version" xml:"version"` // the one to accept
+	URL     string   `json:"url,omitempty" xml:"url,omitempty"`
+}
+
+func encodeConsent(consent *Consent) sql.NullString {
+	if consent == nil {
+		return sql.NullString{}
+	}
+	data, _ := json.Marshal(consent)
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func decodeConsent(data sql.NullString) (*Consent, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var consent Consent
+	if err := json.Unmarshal([]byte(data.String), &consent); err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+// Sends consent_required or consent_outdated, and stamps the time on
+// consent that's good
+func (s *Server) checkConsent(w http.ResponseWriter, r *http.Request, req *AppointmentRequest) bool {
+	cfg := s.live()
+	if req.Consent != nil && !req.Consent.Accepted {
+		req.Consent = nil
+	}
+	if cfg.PrivacyNoticeVersion != "" {
+		var code, message string
+		switch {
+		case req.Consent == nil:
+			code, message = CodeConsentRequired, "They need to accept the privacy notice to book"
+		case req.Consent.Version != cfg.PrivacyNoticeVersion:
+			code, message = CodeConsentOutdated, "The privacy notice has changed since they accepted it"
+		}
+		if code != "" {
+			s.countRejection(r, http.StatusBadRequest, code)
+			s.respond(w, r, http.StatusBadRequest, ConsentRequired{Error: code, Message: message, Version: cfg.PrivacyNoticeVersion, URL: cfg.PrivacyNoticeURL})
+			return false
+		}
+	}
+	if req.Consent != nil {
+		req.Consent = &Consent{Accepted: true, Version: req.Consent.Version, AcceptedAt: time.Now().UTC()}
+	}
+	return true
+}
+
+// GET /privacy-notice, for the form to link to and send back the version of
+func (s *Server) getPrivacyNotice(w http.ResponseWriter, r *http.Request) {
+	cfg := s.live()
+	s.respond(w, r, http.StatusOK, PrivacyNotice{Version: cfg.PrivacyNoticeVersion, URL: cfg.PrivacyNoticeURL, Required: cfg.PrivacyNoticeVersion != ""})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConsent(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, _ := closureServer(t, store)
+			router := server.routes()
+			book := func(consent *Consent) *httptest.ResponseRecorder {
+				return postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Agreed", VisitDate: "2075-01-09", Consent: consent})
+			}
+
+			// Nothing's asked until there's a notice
+			if w := book(nil); w.Code != http.StatusCreated {
+				t.Fatalf("Expected a booking without consent, got %d: %s", w.Code, w.Body.String())
+			}
+
+			server.cfg.PrivacyNoticeVersion = "2075-01"
+			server.cfg.PrivacyNoticeURL = "https://council.example.gov/privacy"
+			for consent, code := range map[*Consent]string{nil: "consent_required", {Accepted: false, Version: "2075-01"}: "consent_required", {Accepted: true, Version: "2074-06"}: "consent_outdated"} {
+				w := book(consent)
+				var res ConsentRequired
+				json.Unmarshal(w.Body.Bytes(), &res)
+				if w.Code != http.StatusBadRequest || res.Error != code || res.Version != "2075-01" || res.URL == "" {
+					t.Errorf("Expected %+v to be %s, got %d: %s", consent, code, w.Code, w.Body.String())
+				}
+			}
+
+			w := book(&Consent{Accepted: true, Version: "2075-01"})
+			var booked Appointment
+			json.Unmarshal(w.Body.Bytes(), &booked)
+			if w.Code != http.StatusCreated || booked.Consent == nil || booked.Consent.Version != "2075-01" || booked.Consent.AcceptedAt.IsZero() {
+				t.Fatalf("Expected the consent kept, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// It's still there once the booking's gone
+			router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/admin/appointments/2/cancel", nil))
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/2/history", nil))
+			var history History
+			json.Unmarshal(w.Body.Bytes(), &history)
+			if n := len(history.Revisions); n != 2 || history.Revisions[n-1].Change != RevisionCancelled || history.Revisions[n-1].Consent == nil || history.Revisions[n-1].Consent.Version != "2075-01" {
+				t.Errorf("Expected the consent in the history, got %s", w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/privacy-notice", nil))
+			var notice PrivacyNotice
+			json.Unmarshal(w.Body.Bytes(), &notice)
+			if notice.Version != "2075-01" || !notice.Required || notice.URL != "https://council.example.gov/privacy" {
+				t.Errorf("Expected the current notice, got %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // so CITYNEXT_JOB_TIMEZONE works on a host without zoneinfo
+)
+
+// When a background job is next due after a given time
+type jobSchedule interface {
+	next(after time.Time) time.Time
+	String() string
+}
+
+// Every so long from the last run, from whenever the server started.
+// What every job has unless it's given a cron schedule
+type intervalSchedule time.Duration
+
+func (d intervalSchedule) next(after time.Time) time.Time { return after.Add(time.Duration(d)) }
+
+func (d intervalSchedule) String() string { return "every " + time.Duration(d).String() }
+
+// How long from the next run to the one after, which is what the locks
+// on a run last
+func scheduleGap(schedule jobSchedule, from time.Time) time.Duration {
+	next := schedule.next(from)
+	return schedule.next(next).Sub(next)
+}
+
+// A five field cron expression, minute hour day month weekday, on the
+// wall clock in loc. Fields take *, numbers, a-b ranges, /steps and lists
+// of them, months and weekdays their three letter names too, and
+// weekday 7 is Sunday like 0. As in cron, when both the day and the
+// weekday are given it's either one, "0 8 1 * mon" is the 1st and every
+// Monday. @hourly, @daily, @weekly, @monthly and @yearly work as well
+type cronSchedule struct {
+	expr string
+	loc  *time.Location
+
+	minute, hour, day, month, weekday uint64 // a bit for each value that matches
+	anyDay, anyWeekday                bool   // the field started with *
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		macro, ok := cronMacros[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("%q isn't one of @hourly, @daily, @weekly, @monthly or @yearly", fields[0])
+		}
+		fields = strings.Fields(macro)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q should be five fields, minute hour day month weekday", expr)
+	}
+
+	c := &cronSchedule{expr: strings.Join(strings.Fields(expr), " "), loc: loc}
+	var err error
+	if c.minute, err = cronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = cronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.day, err = cronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day: %w", err)
+	}
+	if c.month, err = cronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.weekday, err = cronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("weekday: %w", err)
+	}
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	c.anyDay, c.anyWeekday = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+
+	// 0 0 30 2 * is a valid expression that never comes round
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never comes round", expr)
+	}
+	return c, nil
+}
+
+func cronField(field string, lo, hi int, names []string) (uint64, error) {
+	value := func(v string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(v, name) {
+				return i, nil
+			}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("%q should be %d to %d", v, lo, hi)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		item, stepStr, stepped := strings.Cut(item, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("step %q should be a number above 0", stepStr)
+			}
+			step = n
+		}
+
+		from, to := lo, hi
+		if item != "*" {
+			first, last, isRange := strings.Cut(item, "-")
+			var err error
+			if from, err = value(first); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = value(last); err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				to = hi // 5/15 is 5, 20, 35 and 50
+			}
+			if to < from {
+				return 0, fmt.Errorf("%q runs backwards", item)
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// The first minute after after that matches, or the zero time if there
+// isn't one in the next five years. A time the clocks go forward over
+// doesn't happen that day, and one they go back over runs the first time
+// round, not both
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.In(c.loc)
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+
+	for limit := after.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case c.minute&(1<<t.Minute()) == 0, secondTimeRound(t):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	day, weekday := c.day&(1<<t.Day()) != 0, c.weekday&(1<<int(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// The wall clock read the same an hour ago, so the clocks have gone back
+func secondTimeRound(t time.Time) bool {
+	earlier := t.Add(-time.Hour)
+	return earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute() && earlier.Day() == t.Day()
+}
+
+func (c *cronSchedule) String() string { return c.expr + " " + c.loc.String() }
+
+// CITYNEXT_BACKUP_SCHEDULE and the like, from the job's name
+func jobScheduleEnv(name string) string {
+	return "CITYNEXT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_SCHEDULE"
+}
+
+// The job's cron schedule if it has one, otherwise every interval
+func (cfg Config) jobSchedule(name string, interval time.Duration) (jobSchedule, error) {
+	expr := cfg.JobSchedules[name]
+	if expr == "" {
+		return intervalSchedule(interval), nil
+	}
+	loc := time.Local
+	if cfg.JobTimezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.JobTimezone); err != nil {
+			return nil, fmt.Errorf("CITYNEXT_JOB_TIMEZONE %q isn't a time zone", cfg.JobTimezone)
+		}
+	}
+	schedule, err := parseCron(expr, loc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", jobScheduleEnv(name), err)
+	}
+	return schedule, nil
+}
+
+// Whether the job's switched on, by an interval or a schedule
+func (cfg Config) scheduled(name string, interval time.Duration) bool {
+	return interval > 0 || cfg.JobSchedules[name] != ""
+}
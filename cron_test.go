@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, london)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	for _, tc := range []struct{ expr, after, want string }{
+		{"0 2 * * *", "2075-03-14 09:30", "2075-03-15 02:00"},
+		{"0 8 * * mon-fri", "2075-03-15 09:00", "2075-03-18 08:00"}, // a Friday, so Monday
+		{"*/15 * * * *", "2075-03-14 09:31", "2075-03-14 09:45"},
+		{"5/20 9 * * *", "2075-03-14 09:26", "2075-03-14 09:45"},
+		{"0 8 1 * mon", "2075-03-05 12:00", "2075-03-11 08:00"}, // the 1st or a Monday
+		{"0 0 29 feb *", "2075-03-01 00:00", "2076-02-29 00:00"},
+		{"@monthly", "2075-03-14 09:30", "2075-04-01 00:00"},
+		{"0 12 * * 7", "2075-03-14 09:30", "2075-03-17 12:00"}, // 7 is Sunday
+		{"59 23 31 dec *", "2075-12-31 23:59", "2076-12-31 23:59"},
+	} {
+		schedule, err := parseCron(tc.expr, london)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := schedule.next(at(tc.after)); !got.Equal(at(tc.want)) {
+			t.Errorf("%s after %s: expected %s, got %s", tc.expr, tc.after, tc.want, got.In(london).Format("2006-01-02 15:04"))
+		}
+	}
+
+	// On the local wall clock, whatever the offset
+	daily, _ := parseCron("0 8 * * *", london)
+	if got := daily.next(at("2075-06-01 09:00")); got.UTC().Hour() != 7 {
+		t.Errorf("Expected 08:00 in summer to be 07:00 UTC, got %s", got.UTC())
+	}
+	if got := daily.next(at("2075-12-01 09:00")); got.UTC().Hour() != 8 {
+		t.Errorf("Expected 08:00 in winter to be 08:00 UTC, got %s", got.UTC())
+	}
+	// The clocks go back at 02:00 on 27 October 2075, 01:30 comes round once
+	early, _ := parseCron("30 1 * * *", london)
+	first := early.next(time.Date(2075, 10, 27, 0, 0, 0, 0, time.UTC))
+	if second := early.next(first); second.Sub(first) != 25*time.Hour {
+		t.Errorf("Expected 01:30 once on the day the clocks go back, got %s then %s", first.UTC(), second.UTC())
+	}
+	// And forward at 01:00 on 31 March 2075, so there's no 01:30 that day
+	if got := early.next(time.Date(2075, 3, 30, 12, 0, 0, 0, time.UTC)); got.In(london).Day() != 1 {
+		t.Errorf("Expected 01:30 skipped when the clocks go forward, got %s", got.In(london))
+	}
+
+	for expr, want := range map[string]string{
+		"0 2 * *":       "five fields",
+		"61 * * * *":    "minute",
+		"0 2 * * fun":   "weekday",
+		"0 0 30 feb *":  "never",
+		"@fortnightly":  "isn't one of",
+		"*/0 * * * *":   "step",
+		"0 9-5 * * *":   "backwards",
+		"0 2 * 13 *":    "month",
+		"0 2 0 * *":     "day",
+		"0 24 * * *":    "hour",
+		"0 2 * * 1,fri": "",
+	} {
+		_, err := parseCron(expr, london)
+		if want == "" && err != nil {
+			t.Errorf("Expected %q to parse, got %v", expr, err)
+		}
+		if want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("Expected %q to be turned down for its %s, got %v", expr, want, err)
+		}
+	}
+}
+
+func TestJobSchedules(t *testing.T) {
+	cfg := loadConfig()
+	cfg.JobSchedules = map[string]string{"holiday-refresh": "0 2 * * *"}
+	cfg.JobTimezone = "Europe/London"
+
+	schedule, err := cfg.jobSchedule("holiday-refresh", 0)
+	if err != nil || schedule.String() != "0 2 * * * Europe/London" {
+		t.Fatalf("Expected the cron schedule, got %v, %v", schedule, err)
+	}
+	if schedule, _ := cfg.jobSchedule("backup", time.Hour); schedule.String() != "every 1h0m0s" || !cfg.scheduled("holiday-refresh", 0) || cfg.scheduled("replication", 0) {
+		t.Errorf("Expected the interval without a schedule, got %v", schedule)
+	}
+
+	cfg.JobTimezone = "Europe/Atlantis"
+	if _, err := cfg.jobSchedule("holiday-refresh", 0); err == nil {
+		t.Error("Expected an unknown time zone turned down")
+	}
+	if errs := validateConfig(cfg); len(errs) != 1 || !strings.Contains(errs[0].Error(), "CITYNEXT_JOB_TIMEZONE") {
+		t.Errorf("Expected the time zone reported once, got %v", errs)
+	}
+
+	// Shown with when it's next due
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	daily, _ := parseCron("0 2 * * *", time.UTC)
+	stop := make(chan struct{})
+	defer close(stop)
+	go server.every("holiday-refresh", daily, stop, func(ctx context.Context) (int, error) { return 0, nil })
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if job, ok := server.jobs.get("holiday-refresh"); ok && !job.due.IsZero() {
+			if job.due.Hour() != 2 || job.due.Minute() != 0 || !job.due.After(time.Now()) {
+				t.Errorf("Expected it due at the next 02:00, got %s", job.due)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the job registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
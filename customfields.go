@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Services that need more out of people than a name, a vehicle
+// registration or a planning reference, say what in
+// CITYNEXT_CUSTOM_FIELDS, a JSON file of a JSON Schema for each service:
+//
+//	{"parking-permits": {"type": "object", "required": ["vehicleReg"],
+//	  "properties": {"vehicleReg": {"type": "string", "pattern": "^[A-Z0-9 ]{2,8}$"}}}}
+//
+// Only the parts of JSON Schema that forms need are understood: type,
+// properties, required, additionalProperties, enum, pattern, minLength,
+// maxLength, minimum and maximum. The answers are kept with the booking
+type CustomFields map[string]any
+
+type fieldSchema struct {
+	Title                string                  `json:"title,omitempty"`
+	Description          string                  `json:"description,omitempty"`
+	Type                 string                  `json:"type,omitempty"`
+	Properties           map[string]*fieldSchema `json:"properties,omitempty"`
+	Required             []string                `json:"required,omitempty"`
+	AdditionalProperties *bool                   `json:"additionalProperties,omitempty"`
+	Enum                 []any                   `json:"enum,omitempty"`
+	Pattern              string                  `json:"pattern,omitempty"`
+	MinLength            *int                    `json:"minLength,omitempty"`
+	MaxLength            *int                    `json:"maxLength,omitempty"`
+	Minimum              *float64                `json:"minimum,omitempty"`
+	Maximum              *float64                `json:"maximum,omitempty"`
+	Format               string                  `json:"format,omitempty"` // one of identifierFormats, checksum and all
+
+	pattern *regexp.Regexp
+}
+
+// As XML there's one <field name="..."> each, in name order
+func (f CustomFields) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := xml.StartElement{Name: xml.Name{Local: "field"}, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}}}
+		if err := e.EncodeElement(fmt.Sprint(f[name]), field); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func encodeCustomFields(f CustomFields) string {
+	if len(f) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(f)
+	return string(data)
+}
+
+func decodeCustomFields(data string) (CustomFields, error) {
+	var f CustomFields
+	if data == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(data), &f); err != nil {
+		return nil, err
+	}
+	if len(f) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// Read on start and on reload. A service whose schema won't compile is
+// left without one, and logged, rather than stopping everything
+func envCustomFields(key string) map[string]*fieldSchema {
+	schemas := map[string]*fieldSchema{}
+	path := envString(key, "")
+	if path == "" {
+		return schemas
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &schemas)
+	}
+	if err != nil {
+		log.Printf("Ignoring %s=%s: %v", key, path, err)
+		return map[string]*fieldSchema{}
+	}
+	for service, schema := range schemas {
+		if err := schema.compile(); err != nil {
+			log.Printf("Ignoring %s schema for %s: %v", key, service, err)
+			delete(schemas, service)
+		}
+	}
+	return schemas
+}
+
+func (schema *fieldSchema) compile() error {
+	if _, ok := identifierFormats[schema.Format]; schema.Format != "" && !ok {
+		return fmt.Errorf("unknown format %q", schema.Format)
+	}
+	if schema.Pattern != "" {
+		re, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return err
+		}
+		schema.pattern = re
+	}
+	for _, p := range schema.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// One thing wrong with one field, by its path, e.g. vehicleReg
+type FieldProblem struct {
+	XMLName xml.Name `json:"-" xml:"field"`
+	Field   string   `json:"field" xml:"name,attr"`
+	Problem string   `json:"problem" xml:",chardata"` // said to follow the field's name
+}
+
+func (p FieldProblem) String() string {
+	return p.Field + " " + p.Problem
+}
+
+// Every problem with v against the schema, each said with where it is
+func (schema *fieldSchema) validate(path string, v any) []FieldProblem {
+	var problems []FieldProblem
+	if schema.Type != "" && !hasType(v, schema.Type) {
+		return []FieldProblem{{Field: path, Problem: "must be " + withArticle(schema.Type)}}
+	}
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(e any) bool { return fmt.Sprint(e) == fmt.Sprint(v) }) {
+		problems = append(problems, FieldProblem{Field: path, Problem: fmt.Sprintf("must be one of %v", schema.Enum)})
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := len([]rune(v))
+		if schema.MinLength != nil && n < *schema.MinLength {
+			problems = append(problems, FieldProblem{Field: path, Problem: fmt.Sprintf("must be at least %d characters", *schema.MinLength)})
+		}
+		if schema.MaxLength != nil && n > *schema.MaxLength {
+			problems = append(problems, FieldProblem{Field: path, Problem: fmt.Sprintf("must be at most %d characters", *schema.MaxLength)})
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(v) {
+			problems = append(problems, FieldProblem{Field: path, Problem: "isn't in the right format"})
+		}
+		if schema.Format != "" && !identifierFormats[schema.Format].valid(v) {
+			problems = append(problems, FieldProblem{Field: path, Problem: "isn't a valid " + identifierFormats[schema.Format].name})
+		}
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			problems = append(problems, FieldProblem{Field: path, Problem: fmt.Sprintf("must be at least %v", *schema.Minimum)})
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			problems = append(problems, FieldProblem{Field: path, Problem: fmt.Sprintf("must be at most %v", *schema.Maximum)})
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				problems = append(problems, FieldProblem{Field: childPath(path, name), Problem: "is required"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if p, ok := schema.Properties[name]; ok {
+				problems = append(problems, p.validate(childPath(path, name), v[name])...)
+			} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				problems = append(problems, FieldProblem{Field: childPath(path, name), Problem: "isn't asked for"})
+			}
+		}
+	}
+	return problems
+}
+
+func hasType(v any, want string) bool {
+	switch v := v.(type) {
+	case string:
+		return want == "string"
+	case bool:
+		return want == "boolean"
+	case float64:
+		return want == "number" || want == "integer" && v == math.Trunc(v)
+	case map[string]any:
+		return want == "object"
+	case []any:
+		return want == "array"
+	case nil:
+		return want == "null"
+	}
+	return false
+}
+
+func withArticle(t string) string {
+	if t == "object" || t == "array" || t == "integer" {
+		return "an " + t
+	}
+	return "a " + t
+}
+
+func childPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Services without a schema take no custom fields at all
+func (s *Server) validateCustomFields(w http.ResponseWriter, r *http.Request, req AppointmentRequest) bool {
+	schema, ok := s.live().CustomFields[req.Service]
+	if !ok {
+		if len(req.CustomFields) > 0 {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidCustomFields, req.Service+" doesn't take custom fields")
+			return false
+		}
+		return true
+	}
+	fields := map[string]any(req.CustomFields)
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	if problems := schema.validate("", fields); len(problems) > 0 {
+		said := make([]string, len(problems))
+		for i, p := range problems {
+			said[i] = p.String()
+		}
+		s.countRejection(r, http.StatusBadRequest, CodeInvalidCustomFields)
+		s.respond(w, r, http.StatusBadRequest, CustomFieldErrors{Error: CodeInvalidCustomFields, Message: "Some of the custom fields aren't right", Problems: said, Fields: problems})
+		return false
+	}
+	// Identifiers are kept the one way they're written, for whatever
+	// they're passed on to
+	schema.normalise(fields)
+	return true
+}
+
+type CustomFieldErrors struct {
+	XMLName  xml.Name       `json:"-" xml:"errorResponse"`
+	Error    string         `json:"error" xml:"error"`
+	Message  string         `json:"message" xml:"message"`
+	Problems []string       `json:"problems" xml:"problems>problem"`
+	Fields   []FieldProblem `json:"fields" xml:"fields>field"` // the same, by field
+}
+
+// GET /services/{service}/fields, the schema for the booking form to
+// build itself from. A service without one gets an object with nothing in it
+func (s *Server) getCustomFieldSchema(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	if !slices.Contains(s.queueServices(), service) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownService, "No such service")
+		return
+	}
+	schema, ok := s.live().CustomFields[service]
+	if !ok {
+		no := false
+		schema = &fieldSchema{Type: "object", AdditionalProperties: &no}
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(schema)
+}
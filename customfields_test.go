@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const parkingSchema = `{"parking-permits": {"type": "object", "required": ["vehicleReg"], "additionalProperties": false,
+	"properties": {"vehicleReg": {"type": "string", "pattern": "^[A-Z0-9 ]{2,8}$"}, "vehicles": {"type": "integer", "minimum": 1, "maximum": 3}}}}`
+
+func TestCustomFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fields.json")
+	if err := os.WriteFile(path, []byte(parkingSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CITYNEXT_CUSTOM_FIELDS", path)
+
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 10
+	server.cfg.QueueServices = []string{"general", "parking-permits"}
+	server.cfg.CustomFields = envCustomFields("CITYNEXT_CUSTOM_FIELDS")
+	router := server.routes()
+
+	w := postAppointment(t, router, AppointmentRequest{FirstName: "Dai", LastName: "Car", VisitDate: "2075-06-17", Service: "parking-permits",
+		CustomFields: CustomFields{"vehicleReg": "not a reg!", "vehicles": 1.5, "colour": "red"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for bad fields, got %d: %s", w.Code, w.Body.String())
+	}
+	var errs CustomFieldErrors
+	json.Unmarshal(w.Body.Bytes(), &errs)
+	want := []string{"colour isn't asked for", "vehicleReg isn't in the right format", "vehicles must be an integer"}
+	if strings.Join(errs.Problems, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Expected %v, got %v", want, errs.Problems)
+	}
+
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dai", LastName: "Car", VisitDate: "2075-06-17", Service: "parking-permits"}); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "vehicleReg is required") {
+		t.Errorf("Expected vehicleReg to be required, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dai", LastName: "Car", VisitDate: "2075-06-17", CustomFields: CustomFields{"vehicleReg": "AB12 CDE"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for fields on a service without any, got %d", w.Code)
+	}
+
+	w = postAppointment(t, router, AppointmentRequest{FirstName: "Dai", LastName: "Car", VisitDate: "2075-06-17", Service: "parking-permits",
+		CustomFields: CustomFields{"vehicleReg": "AB12 CDE", "vehicles": 2}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for good fields, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// And back on the schedule, in JSON and XML
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/appointments", nil))
+	var list AppointmentList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Expected the schedule, got %d: %s", w.Code, w.Body.String())
+	}
+	schedule := list.Appointments
+	if len(schedule) != 1 || schedule[0].CustomFields["vehicleReg"] != "AB12 CDE" || schedule[0].CustomFields["vehicles"] != 2.0 {
+		t.Errorf("Expected the fields on the schedule, got %+v", schedule)
+	}
+	out, err := xml.Marshal(schedule[0])
+	if err != nil || !strings.Contains(string(out), `<customFields><field name="vehicleReg">AB12 CDE</field><field name="vehicles">2</field></customFields>`) {
+		t.Errorf("Expected the fields in XML, got %s (%v)", out, err)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/services/parking-permits/fields", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"vehicleReg"`) {
+		t.Errorf("Expected the schema, got %d: %s", w.Code, w.Body.String())
+	}
+}
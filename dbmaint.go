@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Indexes for what's looked up often beyond the primary keys, made on
+// start if they're missing. The store makes its own on appointments
+// (person_id, visit_date) and persons (last name, email). Add to the
+// list as features need them
+var indexes = []struct{ name, table, columns string }{
+	{"documents_by_appointment", "documents", "appointment_id"},
+	{"deliveries_due", "deliveries", "status, next_attempt_at"}, // the retry loop
+}
+
+func (s *Server) createIndexes() error {
+	for _, ix := range indexes {
+		if _, err := s.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", ix.name, ix.table, ix.columns)); err != nil {
+			return fmt.Errorf("failed to create index %s: %w", ix.name, err)
+		}
+	}
+	return nil
+}
+
+// A corrupt SQLite file can go unnoticed until the page that's bad is
+// read, maybe weeks later. So every CITYNEXT_INTEGRITY_CHECK_INTERVAL
+// one replica runs PRAGMA integrity_check over the whole file, then
+// ANALYZE so the query planner's statistics keep up with the data. The
+// last result is kept in the shared cache for /readyz on every replica
+type IntegrityCheck struct {
+	XMLName   xml.Name  `json:"-" xml:"integrity"`
+	Status    string    `json:"status" xml:"status"`                                 // ok, corrupt or error
+	Problems  []string  `json:"problems,omitempty" xml:"problems>problem,omitempty"` // the first few SQLite found
+	CheckedAt time.Time `json:"checkedAt" xml:"checkedAt"`
+	Seconds   float64   `json:"seconds" xml:"seconds"`
+}
+
+const (
+	integrityCacheKey    = "integrity:last"
+	integrityMaxProblems = 10
+)
+
+func (s *Server) checkIntegrityEvery(schedule jobSchedule, stop <-chan struct{}) {
+	s.every("integrity-check", schedule, stop, func(ctx context.Context) (int, error) {
+		return len(s.runIntegrityCheck(ctx, scheduleGap(schedule, time.Now())).Problems), nil
+	})
+}
+
+func (s *Server) runIntegrityCheck(ctx context.Context, interval time.Duration) IntegrityCheck {
+	start := time.Now()
+	check := IntegrityCheck{Status: "ok", Problems: []string{}, CheckedAt: start.UTC()}
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("PRAGMA integrity_check(%d)", integrityMaxProblems))
+	if err == nil {
+		for rows.Next() {
+			var line string
+			if err = rows.Scan(&line); err != nil {
+				break
+			}
+			if line != "ok" {
+				check.Problems = append(check.Problems, line)
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+	}
+	switch {
+	case err != nil:
+		// Badly enough corrupt that it can't be checked is corrupt too
+		check.Status, check.Problems = "error", []string{err.Error()}
+	case len(check.Problems) > 0:
+		check.Status = "corrupt"
+	default:
+		if _, err := s.db.ExecContext(ctx, "ANALYZE"); err != nil {
+			log.Printf("Error analyzing the database: %v", err)
+		}
+	}
+	check.Seconds = time.Since(start).Seconds()
+
+	s.metrics.inc("citynext_db_integrity_checks_total", check.Status)
+	s.metrics.set("citynext_db_integrity_ok", map[bool]float64{true: 1, false: 0}[check.Status == "ok"])
+	s.metrics.set("citynext_db_integrity_checked_timestamp_seconds", float64(check.CheckedAt.Unix()))
+	if check.Status == "ok" {
+		log.Printf("Database integrity check passed in %.1fs", check.Seconds)
+	} else {
+		log.Printf("Database failed its integrity check (%s), restore it from a backup: %v", check.Status, check.Problems)
+	}
+
+	// Kept for a few runs' worth, so a missed run or two still shows
+	b, _ := json.Marshal(check)
+	if err := s.cache.Set(ctx, integrityCacheKey, b, 3*interval); err != nil {
+		log.Printf("Error storing the integrity check: %v", err)
+	}
+	return check
+}
+
+// Nil if there hasn't been one lately
+func (s *Server) lastIntegrityCheck(ctx context.Context) *IntegrityCheck {
+	b, ok, err := s.cache.Get(ctx, integrityCacheKey)
+	if err != nil || !ok {
+		return nil
+	}
+	var check IntegrityCheck
+	if err := json.Unmarshal(b, &check); err != nil {
+		return nil
+	}
+	return &check
+}
+
+// POST /admin/integrity-check runs one now, e.g. after restoring a backup
+func (s *Server) forceIntegrityCheck(w http.ResponseWriter, r *http.Request) {
+	interval := s.cfg.IntegrityCheckInterval
+	if job, ok := s.jobs.get("integrity-check"); ok {
+		interval = scheduleGap(job.schedule, time.Now())
+	}
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	s.respond(w, r, http.StatusOK, s.runIntegrityCheck(r.Context(), interval))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexesAreMade(t *testing.T) {
+	server := setupTestServer(t)
+	for _, ix := range indexes {
+		var n int
+		server.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", ix.name).Scan(&n)
+		if n != 1 {
+			t.Errorf("Expected index %s", ix.name)
+		}
+	}
+	pending, err := pendingMigrations(server.db, "sqlite")
+	if err != nil || len(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %v %v", pending, err)
+	}
+
+	server.db.Exec("DROP INDEX deliveries_due")
+	if pending, _ := pendingMigrations(server.db, "sqlite"); len(pending) != 1 || pending[0] != "create index deliveries_due" {
+		t.Errorf("Expected the index pending, got %v", pending)
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	router := server.routes()
+
+	readyz := func() Readiness {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		var readiness Readiness
+		json.Unmarshal(w.Body.Bytes(), &readiness)
+		return readiness
+	}
+	if readyz().Integrity != nil {
+		t.Errorf("Expected no integrity check before one's run")
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/integrity-check", nil))
+	var check IntegrityCheck
+	json.Unmarshal(w.Body.Bytes(), &check)
+	if w.Code != http.StatusOK || check.Status != "ok" {
+		t.Fatalf("Expected ok, got %d: %s", w.Code, w.Body.String())
+	}
+	if r := readyz(); r.Status != "ready" || r.Integrity == nil || r.Integrity.Status != "ok" {
+		t.Errorf("Expected the check in /readyz, got %+v", r)
+	}
+
+	// ANALYZE ran
+	var stats int
+	server.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'sqlite_stat1'").Scan(&stats)
+	if stats != 1 {
+		t.Errorf("Expected the database analyzed")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`citynext_db_integrity_checks_total{result="ok"} 1`, "citynext_db_integrity_ok 1"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics", want)
+		}
+	}
+}
+
+func TestIntegrityCheckFindsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appointments.db")
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT)")
+	db.Exec("CREATE INDEX t_by_v ON t (v)")
+	db.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 2000) INSERT INTO t (v) SELECT hex(randomblob(16)) FROM n")
+	db.Close()
+
+	// Scribble over a page in the middle, leaving the header alone
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	f.WriteAt([]byte(strings.Repeat("\xff", 4096)), info.Size()/2/4096*4096)
+	f.Close()
+
+	db, err = openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server := NewServer(db)
+	router := server.routes()
+
+	check := server.runIntegrityCheck(context.Background(), time.Hour)
+	if check.Status == "ok" || len(check.Problems) == 0 {
+		t.Fatalf("Expected the corruption found, got %+v", check)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	var readiness Readiness
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	if w.Code != http.StatusOK || readiness.Status != "degraded" {
+		t.Errorf("Expected degraded, got %d: %s", w.Code, w.Body.String())
+	}
+}
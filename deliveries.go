@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Anything we fail to send gets written down and retried with backoff,
+// and after enough attempts it's parked as dead for someone to look at.
+// No citizen should silently miss a confirmation
+const (
+	ChannelEmail  = "email"
+	ChannelSMS    = "sms"    // To is a phone number
+	ChannelLetter = "letter" // To is the postal address, a line at a time
+
+	DeliveryFailed    = "failed"    // waiting for its next attempt
+	DeliveryDead      = "dead"      // given up, needs a human
+	DeliveryDelivered = "delivered" // made it on a retry
+
+	maxDeliveryAttempts = 6
+)
+
+type Delivery struct {
+	ID            int        `json:"id"`
+	Channel       string     `json:"channel"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"lastError"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+	TraceID       string     `json:"traceId,omitempty"` // of the request that first sent it
+
+	text string
+	html string
+}
+
+func (s *Server) initDeliveriesTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		channel TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body_text TEXT NOT NULL,
+		body_html TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at DATETIME,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		traceparent TEXT NOT NULL DEFAULT ''
+	)`
+
+	if _, err := s.db.Exec(query); err != nil {
+		return err
+	}
+	return addColumnIfMissing(s.db, "deliveries", "traceparent", "TEXT NOT NULL DEFAULT ''")
+}
+
+// 1m, 2m, 4m ... capped at an hour
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := time.Minute << (attempts - 1)
+	if attempts > 7 || backoff > time.Hour {
+		return time.Hour
+	}
+	return backoff
+}
+
+// Each attempt is its own span, on the trace the message was first sent on
+func (s *Server) send(ctx context.Context, channel string, msg Message) error {
+	msg.TraceParent = childTrace(ctx).String()
+	notifier, dependency := s.notifier, DependencyEmail
+	switch channel {
+	case ChannelEmail:
+	case ChannelSMS:
+		notifier, dependency = s.texts, DependencySMS
+	case ChannelLetter:
+		notifier, dependency = s.letters, DependencyLetters
+	default:
+		notifier = nil
+	}
+	if notifier == nil {
+		return fmt.Errorf("no notifier for channel %q", channel)
+	}
+	start := time.Now()
+	err := notifier.Send(ctx, msg)
+	s.observeDependency(dependency, start, err)
+	return err
+}
+
+// Try once now, and if that fails hand it over to the retry loop
+func (s *Server) deliver(ctx context.Context, channel string, msg Message) {
+	err := s.send(ctx, channel, msg)
+	if err == nil {
+		return
+	}
+	if s.db == nil {
+		log.Printf("Error sending %s to %s, no database to retry from: %v", channel, msg.To, err)
+		return
+	}
+	log.Printf("Error sending %s to %s, will retry: %v", channel, msg.To, err)
+
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO deliveries (channel, recipient, subject, body_text, body_html, status, attempts, last_error, next_attempt_at, created_at, updated_at, traceparent)
+		VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?, ?, ?, ?)`
+	var traceparent string
+	if tc, ok := traceFrom(ctx); ok {
+		traceparent = tc.String()
+	}
+	_, err = s.db.ExecContext(ctx, query, channel, msg.To, msg.Subject, msg.Text, msg.HTML,
+		DeliveryFailed, err.Error(), now.Add(deliveryBackoff(1)), now, now, traceparent)
+	if err != nil {
+		log.Printf("Error recording failed delivery to %s: %v", msg.To, err)
+	}
+}
+
+// Work through whatever is due
+func (s *Server) retryDueDeliveries(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, channel, recipient, subject, body_text, body_html, attempts, traceparent
+		FROM deliveries WHERE status = ? AND next_attempt_at <= ?`,
+		DeliveryFailed, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to load due deliveries: %w", err)
+	}
+
+	var due []Delivery
+	var traces []string
+	for rows.Next() {
+		var d Delivery
+		var traceparent string
+		if err := rows.Scan(&d.ID, &d.Channel, &d.Recipient, &d.Subject, &d.text, &d.html, &d.Attempts, &traceparent); err != nil {
+			log.Printf("Error reading due delivery: %v", err)
+			continue
+		}
+		due = append(due, d)
+		traces = append(traces, traceparent)
+	}
+	rows.Close()
+
+	for i, d := range due {
+		sendCtx, cancel := withTimeout(ctx, s.cfg.NotifyTimeout)
+		if tc, ok := parseTraceparent(traces[i]); ok {
+			sendCtx = withTrace(sendCtx, tc)
+		}
+		err := s.send(sendCtx, d.Channel, Message{To: d.Recipient, Subject: d.Subject, Text: d.text, HTML: d.html})
+		cancel()
+		now := time.Now().UTC()
+		attempts := d.Attempts + 1
+
+		if err == nil {
+			_, err = s.db.ExecContext(ctx, `UPDATE deliveries SET status = ?, attempts = ?, next_attempt_at = NULL, updated_at = ? WHERE id = ?`,
+				DeliveryDelivered, attempts, now, d.ID)
+			if err != nil {
+				log.Printf("Error updating delivery %d: %v", d.ID, err)
+			}
+			continue
+		}
+
+		status := DeliveryFailed
+		var next *time.Time
+		if attempts >= maxDeliveryAttempts {
+			status = DeliveryDead
+			log.Printf("Giving up on delivery %d to %s after %d attempts (trace %s): %v", d.ID, d.Recipient, attempts, traces[i], err)
+		} else {
+			n := now.Add(deliveryBackoff(attempts))
+			next = &n
+		}
+
+		_, dbErr := s.db.ExecContext(ctx, `UPDATE deliveries SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?`,
+			status, attempts, err.Error(), next, now, d.ID)
+		if dbErr != nil {
+			log.Printf("Error updating delivery %d: %v", d.ID, dbErr)
+		}
+	}
+	return len(due), nil
+}
+
+func (s *Server) retryDeliveries(schedule jobSchedule, stop <-chan struct{}) {
+	s.every("delivery-retries", schedule, stop, s.retryDueDeliveries)
+}
+
+// GET /admin/deliveries, optionally ?status=dead
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT id, channel, recipient, subject, status, attempts, last_error, next_attempt_at, created_at, updated_at, traceparent
+		FROM deliveries`
+	var args []any
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := s.db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		log.Printf("Error listing deliveries: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list deliveries")
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		var next sql.NullTime
+		var traceparent string
+		if err := rows.Scan(&d.ID, &d.Channel, &d.Recipient, &d.Subject, &d.Status, &d.Attempts, &d.LastError, &next, &d.CreatedAt, &d.UpdatedAt, &traceparent); err != nil {
+			log.Printf("Error reading delivery: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list deliveries")
+			return
+		}
+		if next.Valid {
+			d.NextAttemptAt = &next.Time
+		}
+		if tc, ok := parseTraceparent(traceparent); ok {
+			d.TraceID = tc.TraceID
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// POST /admin/deliveries/{id}/requeue puts a failed or dead delivery
+// back at the front of the queue with a fresh set of attempts
+func (s *Server) requeueDelivery(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(r.Context(), `UPDATE deliveries SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ? WHERE id = ? AND status != ?`,
+		DeliveryFailed, now, now, id, DeliveryDelivered)
+	if err != nil {
+		log.Printf("Error requeueing delivery %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to requeue delivery")
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No undelivered delivery with that ID")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type failingNotifier struct{ err error }
+
+func (f failingNotifier) Send(ctx context.Context, msg Message) error { return f.err }
+
+func TestFailedDeliveryIsRetried(t *testing.T) {
+	server := setupTestServer(t)
+	server.notifier = failingNotifier{err: errors.New("smtp down")}
+
+	server.deliver(context.Background(), ChannelEmail, Message{To: "dana@example.com", Subject: "Hi"})
+
+	var status, lastError string
+	if err := server.db.QueryRow("SELECT status, last_error FROM deliveries").Scan(&status, &lastError); err != nil {
+		t.Fatalf("Expected failed delivery to be recorded: %v", err)
+	}
+	if status != DeliveryFailed || lastError != "smtp down" {
+		t.Errorf("Expected failed/smtp down, got %s/%s", status, lastError)
+	}
+
+	// Mail is back, and the retry is due
+	server.notifier = LogNotifier{}
+	server.db.Exec("UPDATE deliveries SET next_attempt_at = ?", time.Now().UTC().Add(-time.Second))
+	server.retryDueDeliveries(context.Background())
+
+	server.db.QueryRow("SELECT status FROM deliveries").Scan(&status)
+	if status != DeliveryDelivered {
+		t.Errorf("Expected delivery to succeed on retry, got %s", status)
+	}
+}
+
+func TestAdminDeliveries(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.notifier = failingNotifier{err: errors.New("smtp down")}
+	server.deliver(context.Background(), ChannelEmail, Message{To: "dana@example.com", Subject: "Hi"})
+	server.db.Exec("UPDATE deliveries SET status = ?", DeliveryDead)
+	router := server.routes()
+
+	// No token, no entry
+	r := httptest.NewRequest("GET", "/admin/deliveries", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin token, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/deliveries?status=dead", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	var deliveries []Delivery
+	json.NewDecoder(w.Body).Decode(&deliveries)
+	if w.Code != http.StatusOK || len(deliveries) != 1 {
+		t.Fatalf("Expected one dead delivery, got %d with %d", w.Code, len(deliveries))
+	}
+
+	r = httptest.NewRequest("POST", "/admin/deliveries/1/requeue", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 for requeue, got %d", w.Code)
+	}
+
+	var status string
+	var attempts int
+	server.db.QueryRow("SELECT status, attempts FROM deliveries WHERE id = 1").Scan(&status, &attempts)
+	if status != DeliveryFailed || attempts != 0 {
+		t.Errorf("Expected requeued delivery to be failed with 0 attempts, got %s/%d", status, attempts)
+	}
+}
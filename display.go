@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The screen in each waiting room shows who's being seen at which desk,
+// for the services queued for in that room. It's on the wall for anyone
+// to read, so there's no token and nothing about the person, just
+// numbers and desks. CITYNEXT_QUEUE_LOCATIONS says which services are in
+// which room, otherwise everything is in "main"
+type DisplayTicket struct {
+	XMLName  xml.Name  `json:"-" xml:"ticket"`
+	Service  string    `json:"service" xml:"service"`
+	Number   int       `json:"number" xml:"number"`
+	Desk     string    `json:"desk" xml:"desk"`
+	CalledAt time.Time `json:"calledAt" xml:"calledAt"`
+}
+
+type Display struct {
+	XMLName  xml.Name        `json:"-" xml:"display"`
+	Location string          `json:"location" xml:"location,attr"`
+	Date     string          `json:"date" xml:"date,attr"`
+	Serving  []DisplayTicket `json:"serving" xml:"ticket"` // latest call at each desk, newest first
+}
+
+func displayTicket(t Ticket) DisplayTicket {
+	return DisplayTicket{Service: t.Service, Number: t.Number, Desk: t.Desk, CalledAt: *t.CalledAt}
+}
+
+func (s *Server) queueLocations() map[string][]string {
+	if len(s.cfg.QueueLocations) == 0 {
+		return map[string][]string{"main": s.queueServices()}
+	}
+	return s.cfg.QueueLocations
+}
+
+// The location's services, or a 404 if there's no such room
+func (s *Server) displayServices(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	services, ok := s.queueLocations()[mux.Vars(r)["location"]]
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownLocation, "No display for that location")
+	}
+	return services, ok
+}
+
+// GET /display/{location}, today's numbers being seen
+func (s *Server) getDisplay(w http.ResponseWriter, r *http.Request) {
+	services, ok := s.displayServices(w, r)
+	if !ok {
+		return
+	}
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	queue, err := s.queueFor(ctx, today.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Error loading queue: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load queue")
+		return
+	}
+
+	// A desk is only seeing whoever it called last
+	latest := map[string]Ticket{}
+	for _, t := range queue.Tickets {
+		if t.CalledAt == nil || !slices.Contains(services, t.Service) {
+			continue
+		}
+		if prev, ok := latest[t.Desk]; !ok || t.CalledAt.After(*prev.CalledAt) {
+			latest[t.Desk] = t
+		}
+	}
+
+	display := Display{Location: mux.Vars(r)["location"], Date: queue.Date, Serving: []DisplayTicket{}}
+	for _, t := range latest {
+		display.Serving = append(display.Serving, displayTicket(t))
+	}
+	sort.Slice(display.Serving, func(i, j int) bool { return display.Serving[i].CalledAt.After(display.Serving[j].CalledAt) })
+
+	w.Header().Set("Cache-Control", "no-cache")
+	s.respond(w, r, http.StatusOK, display)
+}
+
+// GET /display/{location}/events, a "called" event for each number
+// called today in that room, and nothing from the others
+func (s *Server) displayEvents(w http.ResponseWriter, r *http.Request) {
+	services, ok := s.displayServices(w, r)
+	if !ok {
+		return
+	}
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	s.streamCalls(w, r, today.Format("2006-01-02"), func(ticket Ticket) (any, bool) {
+		return displayTicket(ticket), slices.Contains(services, ticket.Service)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDisplay(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.KioskToken = "kiosk-secret"
+	server.cfg.DailyCapacity = 4
+	server.cfg.QueueServices = []string{"general", "passports"}
+	server.cfg.QueueLocations = map[string][]string{"lobby": {"general"}, "annex": {"passports"}}
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	router := server.routes()
+
+	for i, service := range []string{"general", "general", "passports", "passports"} {
+		postAppointment(t, router, AppointmentRequest{FirstName: "Q", LastName: "Person", VisitDate: "2075-06-16"})
+		body := fmt.Sprintf(`{"appointmentId":%d,"lastName":"Person","service":%q}`, i+1, service)
+		router.ServeHTTP(httptest.NewRecorder(), kioskRequest("POST", "/kiosk/checkin", []byte(body)))
+	}
+	callNext := func(service, desk string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/queue/2075-06-16/"+service+"/next", []byte(`{"desk":"`+desk+`"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 calling the next number, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// The annex screen only hears about the annex
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/display/annex/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	callNext("general", "1")
+	callNext("general", "1")
+	callNext("passports", "2")
+
+	lines := bufio.NewScanner(resp.Body)
+	var data string
+	for lines.Scan() && lines.Text() != "" {
+		if v, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			data = v
+		}
+	}
+	if !strings.Contains(data, `"service":"passports"`) || strings.Contains(data, "appointmentId") {
+		t.Errorf("Expected only the passports call without the appointment, got %s", data)
+	}
+
+	// No token needed, and only the last call at each desk
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/display/lobby", nil))
+	var display Display
+	if err := json.Unmarshal(w.Body.Bytes(), &display); err != nil {
+		t.Fatalf("Expected a display, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(display.Serving) != 1 || display.Serving[0].Number != 2 || display.Serving[0].Desk != "1" {
+		t.Errorf("Expected general 2 at desk 1 in the lobby, got %+v", display.Serving)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/display/nowhere", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown location, got %d", w.Code)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Supporting documents aren't kept forever. With
+// CITYNEXT_DOCUMENT_RETENTION_DAYS set, each goes that many days after
+// the visit it was for, unless staff have put a hold on it, a complaint
+// or an appeal say. Every document deleted leaves a line in
+// document_deletions saying what it was and why it went
+type DocumentDeletion struct {
+	XMLName       xml.Name  `json:"-" xml:"deletion"`
+	DocumentID    int       `json:"documentId" xml:"documentId"`
+	AppointmentID int       `json:"appointmentId" xml:"appointmentId"`
+	Name          string    `json:"name" xml:"name"`
+	VisitDate     string    `json:"visitDate" xml:"visitDate"`
+	Reason        string    `json:"reason" xml:"reason"`
+	DeletedBy     string    `json:"deletedBy" xml:"deletedBy"`
+	DeletedAt     time.Time `json:"deletedAt" xml:"deletedAt"`
+}
+
+type DocumentDeletionList struct {
+	XMLName   xml.Name           `json:"-" xml:"deletions"`
+	Deletions []DocumentDeletion `json:"deletions" xml:"deletion"`
+}
+
+func (s *Server) initDocumentDeletionsTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS document_deletions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		document_id INTEGER NOT NULL,
+		appointment_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		visit_date TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		deleted_by TEXT NOT NULL,
+		deleted_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// Stored exports go in the same run, see deleteExpiredExports
+func (s *Server) expireDocuments(schedule jobSchedule, stop <-chan struct{}) {
+	s.every("document-retention", schedule, stop, func(ctx context.Context) (int, error) {
+		deleted := 0
+		if s.cfg.DocumentRetentionDays > 0 {
+			today, err := s.today()
+			if err != nil {
+				return 0, err
+			}
+			if deleted, err = s.deleteExpiredDocuments(withActor(ctx, ActorRetention), today, false); err != nil {
+				return deleted, err
+			}
+		}
+		if s.cfg.ExportTTL > 0 {
+			n, err := s.deleteExpiredExports(ctx, time.Now())
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+		return deleted, nil
+	})
+}
+
+// Deletes every document past its time on today, and says how many went.
+// The visit date is the booking's as it is now, or the one it had at
+// upload if it's been cancelled since. A file that won't delete is left
+// listed for the next run. A dry run logs each one that would go instead,
+// see purge-documents in commands.go
+func (s *Server) deleteExpiredDocuments(ctx context.Context, today time.Time, dryRun bool) (int, error) {
+	cutoff := today.AddDate(0, 0, -s.cfg.DocumentRetentionDays).Format("2006-01-02")
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT d.id, d.appointment_id, d.name, d.storage_key, COALESCE(a.visit_date, d.visit_date)
+		FROM documents d LEFT JOIN appointments a ON a.id = d.appointment_id
+		WHERE d.held = 0 AND COALESCE(a.visit_date, d.visit_date) != '' AND COALESCE(a.visit_date, d.visit_date) <= ?
+		ORDER BY d.id`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	type expired struct {
+		deletion DocumentDeletion
+		key      string
+	}
+	var due []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.deletion.DocumentID, &e.deletion.AppointmentID, &e.deletion.Name, &e.key, &e.deletion.VisitDate); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		for _, e := range due {
+			log.Printf("Dry run: would delete document %d, %q for appointment %d on %s", e.deletion.DocumentID, e.deletion.Name, e.deletion.AppointmentID, e.deletion.VisitDate)
+		}
+		log.Printf("Dry run: %d documents past %d days after the visit would be deleted", len(due), s.cfg.DocumentRetentionDays)
+		return len(due), nil
+	}
+
+	deleted := 0
+	for _, e := range due {
+		if err := s.blobs.Delete(ctx, e.key); err != nil {
+			log.Printf("Error deleting document %d, will try again next time: %v", e.deletion.DocumentID, err)
+			continue
+		}
+		d := e.deletion
+		d.Reason = "retention"
+		d.DeletedBy = actorFrom(ctx)
+		d.DeletedAt = time.Now().UTC()
+		if err := s.recordDocumentDeletion(ctx, d); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d documents past %d days after the visit", deleted, s.cfg.DocumentRetentionDays)
+	}
+	return deleted, nil
+}
+
+// The row goes and the audit line arrives together
+func (s *Server) recordDocumentDeletion(ctx context.Context, d DocumentDeletion) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM documents WHERE id = ?", d.DocumentID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO document_deletions (document_id, appointment_id, name, visit_date, reason, deleted_by, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		d.DocumentID, d.AppointmentID, d.Name, d.VisitDate, d.Reason, d.DeletedBy, d.DeletedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PUT /admin/documents/{id}/hold with {"held": true} keeps a document
+// past retention until it's set back to false
+func (s *Server) holdDocument(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Held *bool `json:"held"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if req.Held == nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "Held is required")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	doc, err := scanDocument(s.db.QueryRowContext(ctx, "UPDATE documents SET held = ? WHERE id = ? RETURNING id, appointment_id, name, content_type, size, uploaded_at, held",
+		*req.Held, mux.Vars(r)["id"]))
+	if errors.Is(err, sql.ErrNoRows) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No such document")
+		return
+	}
+	if err != nil {
+		log.Printf("Error holding document: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to update the document")
+		return
+	}
+	log.Printf("Document %d is now %s (by %s)", doc.ID, map[bool]string{true: "held", false: "not held"}[doc.Held], actorFrom(r.Context()))
+	s.respond(w, r, http.StatusOK, doc)
+}
+
+// GET /admin/document-deletions, newest first
+func (s *Server) listDocumentDeletions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT document_id, appointment_id, name, visit_date, reason, deleted_by, deleted_at
+		FROM document_deletions ORDER BY id DESC`)
+	if err != nil {
+		log.Printf("Error listing document deletions: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list document deletions")
+		return
+	}
+	defer rows.Close()
+
+	list := DocumentDeletionList{Deletions: []DocumentDeletion{}}
+	for rows.Next() {
+		var d DocumentDeletion
+		if err := rows.Scan(&d.DocumentID, &d.AppointmentID, &d.Name, &d.VisitDate, &d.Reason, &d.DeletedBy, &d.DeletedAt); err != nil {
+			log.Printf("Error listing document deletions: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list document deletions")
+			return
+		}
+		list.Deletions = append(list.Deletions, d)
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDocumentRetention(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DocumentRetentionDays = 30
+	dir := t.TempDir()
+	server.blobs = dirBlobs{dir: dir}
+	router := server.routes()
+
+	for i, booking := range []AppointmentRequest{
+		{FirstName: "Gwen", LastName: "Jones", VisitDate: "2075-06-17"},
+		{FirstName: "Rhys", LastName: "Smith", VisitDate: "2075-06-18"},
+		{FirstName: "Owen", LastName: "Evans", VisitDate: "2075-06-10"},
+	} {
+		if w := postAppointment(t, router, booking); w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 booking, got %d: %s", w.Code, w.Body.String())
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, uploadRequest(t, strconv.Itoa(i+1), booking.LastName, "proof.pdf", testPDF))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 uploading, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	// Evans cancelled, the upload's visit date still counts
+	if _, err := server.db.Exec("DELETE FROM appointments WHERE id = 3"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withActor(context.Background(), ActorRetention)
+	// A dry run finds the same ones and leaves them
+	due, err := server.deleteExpiredDocuments(ctx, time.Date(2075, 7, 17, 0, 0, 0, 0, time.UTC), true)
+	if files, _ := filepath.Glob(filepath.Join(dir, "documents", "*", "*")); err != nil || due != 2 || len(files) != 3 {
+		t.Fatalf("Expected two due and all three files left, got %d due, %v (%v)", due, files, err)
+	}
+	var rows int
+	if server.db.QueryRow("SELECT COUNT(*) FROM documents").Scan(&rows); rows != 3 {
+		t.Errorf("Expected the dry run to delete nothing, %d documents left", rows)
+	}
+
+	deleted, err := server.deleteExpiredDocuments(ctx, time.Date(2075, 7, 17, 0, 0, 0, 0, time.UTC), false)
+	if err != nil || deleted != 2 {
+		t.Fatalf("Expected Jones' and Evans' documents to go, got %d (%v)", deleted, err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "documents", "*", "*"))
+	if len(files) != 1 || filepath.Base(filepath.Dir(files[0])) != "2" {
+		t.Errorf("Expected only Smith's file left, got %v", files)
+	}
+
+	// Held, Smith's stays past its time
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("PUT", "/admin/documents/2/hold", []byte(`{"held": true}`)))
+	var doc Document
+	if json.Unmarshal(w.Body.Bytes(), &doc); w.Code != http.StatusOK || !doc.Held {
+		t.Fatalf("Expected the document held, got %d: %s", w.Code, w.Body.String())
+	}
+	if deleted, err := server.deleteExpiredDocuments(ctx, time.Date(2075, 12, 1, 0, 0, 0, 0, time.UTC), false); err != nil || deleted != 0 {
+		t.Errorf("Expected the held document kept, got %d deleted (%v)", deleted, err)
+	}
+	if _, err := os.Stat(files[0]); err != nil {
+		t.Errorf("Expected the held file still there: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("PUT", "/admin/documents/9/hold", []byte(`{"held": true}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 holding nothing, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/document-deletions", nil))
+	var list DocumentDeletionList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Deletions) != 2 {
+		t.Fatalf("Expected 2 deletions recorded, got %d: %s", w.Code, w.Body.String())
+	}
+	if d := list.Deletions[0]; d.DocumentID != 3 || d.VisitDate != "2075-06-10" || d.Reason != "retention" || d.DeletedBy != ActorRetention {
+		t.Errorf("Unexpected deletion record %+v", d)
+	}
+}
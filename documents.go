@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Citizens can send supporting documents for their appointment, proof of
+// address and the like, to POST /appointments/{id}/documents as a
+// multipart form with the file and the lastName on the booking, same as
+// the kiosk asks. What's allowed in is checked from the file itself, not
+// what the browser says it is, and it goes past the virus scanner before
+// it's kept. Where it's kept is up to the BlobStore
+type Document struct {
+	XMLName       xml.Name  `json:"-" xml:"document"`
+	ID            int       `json:"id" xml:"id"`
+	AppointmentID int       `json:"appointmentId" xml:"appointmentId"`
+	Name          string    `json:"name" xml:"name"`
+	ContentType   string    `json:"contentType" xml:"contentType"`
+	Size          int64     `json:"size" xml:"size"`
+	UploadedAt    time.Time `json:"uploadedAt" xml:"uploadedAt"`
+	Held          bool      `json:"held" xml:"held"` // kept past retention, see documentretention.go
+}
+
+type DocumentList struct {
+	XMLName   xml.Name   `json:"-" xml:"documents"`
+	Documents []Document `json:"documents" xml:"document"`
+}
+
+func (s *Server) documentMaxBytes() int64 {
+	if s.cfg.DocumentMaxBytes > 0 {
+		return s.cfg.DocumentMaxBytes
+	}
+	return 10 << 20
+}
+
+func (s *Server) documentTypes() []string {
+	if len(s.cfg.DocumentTypes) == 0 {
+		return []string{"application/pdf", "image/jpeg", "image/png"}
+	}
+	return s.cfg.DocumentTypes
+}
+
+func (s *Server) initDocumentsTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS documents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		appointment_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		storage_key TEXT NOT NULL,
+		uploaded_at DATETIME NOT NULL,
+		visit_date TEXT NOT NULL DEFAULT '',
+		held INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct{ column, definition string }{
+		{"visit_date", "TEXT NOT NULL DEFAULT ''"},
+		{"held", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumnIfMissing(s.db, "documents", c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	return s.initDocumentDeletionsTable()
+}
+
+const documentSelect = "SELECT id, appointment_id, name, content_type, size, uploaded_at, held FROM documents"
+
+func scanDocument(row rowScanner) (Document, error) {
+	var d Document
+	err := row.Scan(&d.ID, &d.AppointmentID, &d.Name, &d.ContentType, &d.Size, &d.UploadedAt, &d.Held)
+	return d, err
+}
+
+// POST /appointments/{id}/documents
+func (s *Server) uploadDocument(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	maxBytes := s.documentMaxBytes()
+
+	// A little over for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.sendErrorResponse(w, r, http.StatusRequestEntityTooLarge, CodeDocumentTooLarge, fmt.Sprintf("Documents can be up to %d MB", maxBytes>>20))
+			return
+		}
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidForm, "Expected a multipart form with the file and lastName")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	lastName := r.FormValue("lastName")
+	if err != nil || lastName == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "A file and the last name on the booking are required")
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidForm, "Failed to read the file")
+		return
+	}
+	if int64(len(data)) > maxBytes {
+		s.sendErrorResponse(w, r, http.StatusRequestEntityTooLarge, CodeDocumentTooLarge, fmt.Sprintf("Documents can be up to %d MB", maxBytes>>20))
+		return
+	}
+
+	contentType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	if !slices.Contains(s.documentTypes(), contentType) {
+		s.sendErrorResponse(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedDocumentType, "Documents can be "+strings.Join(s.documentTypes(), ", "))
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	// Wrong name or wrong ID, it's the same answer
+	appointment, err := s.store.Get(ctx, id)
+	if err == nil && !strings.EqualFold(cleanName(lastName), appointment.LastName) {
+		err = ErrAppointmentNotFound
+	}
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment matches those details")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to check the appointment")
+		return
+	}
+
+	// Nothing's kept that the scanner couldn't vouch for
+	if s.scanner != nil {
+		err := s.scanner.Scan(r.Context(), data)
+		var infected *InfectedError
+		if errors.As(err, &infected) {
+			log.Printf("Turned away an infected document for appointment %d: %s", id, infected.Signature)
+			s.sendErrorResponse(w, r, http.StatusUnprocessableEntity, CodeDocumentInfected, "That file didn't pass the virus scan")
+			return
+		}
+		if err != nil {
+			log.Printf("Error scanning document for appointment %d: %v", id, err)
+			s.sendErrorResponse(w, r, http.StatusServiceUnavailable, CodeScanUnavailable, "Documents can't be checked right now, please try again later")
+			return
+		}
+	}
+
+	key := fmt.Sprintf("documents/%d/%s", appointment.ID, randomHex(16))
+	if err := s.blobs.Put(r.Context(), key, bytes.NewReader(data), contentType); err != nil {
+		log.Printf("Error storing document for appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeStorageError, "Failed to store the document")
+		return
+	}
+
+	doc := Document{AppointmentID: appointment.ID, Name: filepath.Base(header.Filename), ContentType: contentType, Size: int64(len(data)), UploadedAt: time.Now().UTC()}
+	// The visit date is kept too, for retention once a cancelled booking's gone
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO documents (appointment_id, name, content_type, size, storage_key, uploaded_at, visit_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		doc.AppointmentID, doc.Name, doc.ContentType, doc.Size, key, doc.UploadedAt, appointment.VisitDate).Scan(&doc.ID)
+	if err != nil {
+		log.Printf("Error recording document for appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to store the document")
+		return
+	}
+	s.respond(w, r, http.StatusCreated, doc)
+}
+
+// GET /admin/appointments/{id}/documents
+func (s *Server) listDocuments(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, documentSelect+" WHERE appointment_id = ? ORDER BY id", mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error listing documents: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list documents")
+		return
+	}
+	defer rows.Close()
+
+	list := DocumentList{Documents: []Document{}}
+	for rows.Next() {
+		d, err := scanDocument(rows)
+		if err != nil {
+			log.Printf("Error listing documents: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list documents")
+			return
+		}
+		list.Documents = append(list.Documents, d)
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
+
+// GET /admin/documents/{id}, the file itself. Always as a download, so a
+// document can't run as a page on our origin
+func (s *Server) downloadDocument(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	var d Document
+	var key string
+	err := s.db.QueryRowContext(ctx, "SELECT name, content_type, storage_key FROM documents WHERE id = ?", mux.Vars(r)["id"]).Scan(&d.Name, &d.ContentType, &key)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No such document")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading document: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load the document")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := s.blobs.Get(r.Context(), key, &buf); err != nil {
+		log.Printf("Error fetching document %s: %v", key, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeStorageError, "Failed to fetch the document")
+		return
+	}
+	w.Header().Set("Content-Type", d.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.Name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(buf.Bytes())
+}
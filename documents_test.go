@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeScanner struct {
+	err error
+}
+
+func (f fakeScanner) Scan(ctx context.Context, data []byte) error {
+	return f.err
+}
+
+func uploadRequest(t *testing.T, id, lastName, filename string, data []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("lastName", lastName)
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write(data)
+	form.Close()
+	r := httptest.NewRequest("POST", "/appointments/"+id+"/documents", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+var testPDF = []byte("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\n%%EOF\n")
+
+func TestUploadDocument(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DocumentMaxBytes = 1024
+	server.blobs = dirBlobs{dir: t.TempDir()}
+	router := server.routes()
+
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Gwen", LastName: "Jones", VisitDate: "2075-06-17"}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 booking, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, tc := range []struct {
+		name     string
+		req      *http.Request
+		code     int
+		scanner  VirusScanner
+		errorStr string
+	}{
+		{"wrong name", uploadRequest(t, "1", "Smith", "proof.pdf", testPDF), http.StatusNotFound, nil, "not_found"},
+		{"not a PDF", uploadRequest(t, "1", "Jones", "proof.pdf", []byte("#!/bin/sh\nrm -rf /\n")), http.StatusUnsupportedMediaType, nil, "unsupported_document_type"},
+		{"too big", uploadRequest(t, "1", "Jones", "proof.pdf", append(testPDF, make([]byte, 2048)...)), http.StatusRequestEntityTooLarge, nil, "document_too_large"},
+		{"infected", uploadRequest(t, "1", "Jones", "proof.pdf", testPDF), http.StatusUnprocessableEntity, fakeScanner{&InfectedError{"Eicar-Test-Signature"}}, "document_infected"},
+		{"scanner down", uploadRequest(t, "1", "Jones", "proof.pdf", testPDF), http.StatusServiceUnavailable, fakeScanner{errors.New("connection refused")}, "scan_unavailable"},
+	} {
+		server.scanner = tc.scanner
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, tc.req)
+		if w.Code != tc.code || !strings.Contains(w.Body.String(), tc.errorStr) {
+			t.Errorf("%s: expected %d %s, got %d: %s", tc.name, tc.code, tc.errorStr, w.Code, w.Body.String())
+		}
+	}
+
+	server.scanner = fakeScanner{}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, "1", "jones", "../../proof.pdf", testPDF))
+	var doc Document
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &doc) != nil {
+		t.Fatalf("Expected 201 uploading, got %d: %s", w.Code, w.Body.String())
+	}
+	if doc.Name != "proof.pdf" || doc.ContentType != "application/pdf" || doc.Size != int64(len(testPDF)) {
+		t.Errorf("Expected proof.pdf as a PDF, got %+v", doc)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/appointments/1/documents", nil))
+	var list DocumentList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Documents) != 1 || list.Documents[0].ID != doc.ID {
+		t.Errorf("Expected the one document listed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/documents/1", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testPDF) {
+		t.Errorf("Expected the file back, got %d: %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="proof.pdf"` {
+		t.Errorf("Expected it as a download, got %q", got)
+	}
+}
+
+// Speaks just enough clamd to answer one INSTREAM
+func fakeClamd(t *testing.T, reply func(data []byte) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			r.ReadString(0)
+			var data []byte
+			for {
+				var n uint32
+				if binary.Read(r, binary.BigEndian, &n) != nil || n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				io.ReadFull(r, chunk)
+				data = append(data, chunk...)
+			}
+			io.WriteString(conn, "stream: "+reply(data)+"\x00")
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	addr := fakeClamd(t, func(data []byte) string {
+		if bytes.Contains(data, []byte("EICAR")) {
+			return "Eicar-Test-Signature FOUND"
+		}
+		return "OK"
+	})
+	scanner := clamdScanner{addr: addr}
+
+	if err := scanner.Scan(context.Background(), testPDF); err != nil {
+		t.Errorf("Expected a clean file to pass, got %v", err)
+	}
+	var infected *InfectedError
+	if err := scanner.Scan(context.Background(), []byte("X5O!P%@AP EICAR")); !errors.As(err, &infected) || infected.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Expected the EICAR signature, got %v", err)
+	}
+	if err := (clamdScanner{addr: "127.0.0.1:1"}).Scan(context.Background(), testPDF); err == nil || errors.As(err, &infected) {
+		t.Errorf("Expected an error with clamd down, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Links to a document or a stored export that work without the admin
+// token, for putting in an email. Each is signed and stops working when
+// it expires, so a forwarded one is only good for so long. Links are off
+// without CITYNEXT_DOWNLOAD_SECRET, every replica needs the same one
+type DownloadLink struct {
+	XMLName   xml.Name  `json:"-" xml:"link"`
+	URL       string    `json:"url" xml:"url"`
+	ExpiresAt time.Time `json:"expiresAt" xml:"expiresAt"`
+}
+
+// A single use link's jti is signed along with the rest, so it can't be
+// swapped for a fresh one
+func downloadMessage(path string, expires int64, jti string) string {
+	if jti != "" {
+		return fmt.Sprintf("%s\n%d\n%s", path, expires, jti)
+	}
+	return fmt.Sprintf("%s\n%d", path, expires)
+}
+
+// CITYNEXT_PUBLIC_URL in front if it's set, which an email needs. kid
+// says which signing key it was, see signing.go
+func (s *Server) signedURL(ctx context.Context, path string, expiresAt time.Time) string {
+	return s.signURL(ctx, path, expiresAt, "")
+}
+
+// The same, with a jti of its own for singleUse to tell it apart from
+// every other link to the same place
+func (s *Server) singleUseURL(ctx context.Context, path string, expiresAt time.Time) string {
+	return s.signURL(ctx, path, expiresAt, lockToken())
+}
+
+func (s *Server) signURL(ctx context.Context, path string, expiresAt time.Time, jti string) string {
+	kid, sig := s.signMessage(ctx, downloadMessage(path, expiresAt.Unix(), jti))
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	if jti != "" {
+		q.Set("jti", jti)
+	}
+	q.Set("kid", kid)
+	q.Set("sig", sig)
+	return s.cfg.PublicURL + path + "?" + q.Encode()
+}
+
+// How long the link's for, CITYNEXT_DOWNLOAD_LINK_TTL or less with ?ttl=
+func (s *Server) linkExpiry(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	ttl := s.cfg.DownloadLinkTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > s.cfg.DownloadLinkTTL {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidTTL, "ttl must be a duration up to "+s.cfg.DownloadLinkTTL.String())
+			return time.Time{}, false
+		}
+		ttl = d
+	}
+	return time.Now().Add(ttl).Truncate(time.Second).UTC(), true
+}
+
+// POST /admin/documents/{id}/link
+func (s *Server) linkDocument(w http.ResponseWriter, r *http.Request) {
+	expiresAt, ok := s.linkExpiry(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	id := mux.Vars(r)["id"]
+	var found int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM documents WHERE id = ?", id).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No such document")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading document: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load the document")
+		return
+	}
+	s.respond(w, r, http.StatusCreated, DownloadLink{URL: s.signedURL(ctx, "/downloads/documents/"+id, expiresAt), ExpiresAt: expiresAt})
+}
+
+// POST /admin/exports/{name}/link. It isn't checked the export's there,
+// that would mean fetching it, so a link to one that isn't is a 404 later
+func (s *Server) linkExport(w http.ResponseWriter, r *http.Request) {
+	expiresAt, ok := s.linkExpiry(w, r)
+	if !ok {
+		return
+	}
+	s.respond(w, r, http.StatusCreated, DownloadLink{URL: s.signedURL(r.Context(), "/downloads/exports/"+mux.Vars(r)["name"], expiresAt), ExpiresAt: expiresAt})
+}
+
+// Lets the request through if it's signed for this path and hasn't
+// expired. A tampered link and a made up one are the same 403
+func (s *Server) signedLink(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		// Links from before keys had IDs were all signed with the environment's
+		kid := q.Get("kid")
+		if kid == "" {
+			kid = envKeyID
+		}
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		if err != nil || !s.verifySignature(r.Context(), kid, downloadMessage(r.URL.Path, expires, q.Get("jti")), q.Get("sig")) {
+			s.sendErrorResponse(w, r, http.StatusForbidden, CodeInvalidLink, "That link isn't valid")
+			return
+		}
+		if time.Now().Unix() > expires {
+			s.sendErrorResponse(w, r, http.StatusGone, CodeLinkExpired, "That link has expired, ask for a new one")
+			return
+		}
+		// Nowhere to keep a copy, and the link isn't passed on from the page
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next(w, r)
+	}
+}
+
+// Inside signedLink, for the links that do something. The first POST that
+// works uses the link up, and after that it's a 410 link_already_used,
+// looking at it included, until it would have expired anyway. One that
+// doesn't work, a full day say, leaves it to try again. Links from before
+// they had a jti go by what the handler allows
+func (s *Server) singleUse(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		jti := q.Get("jti")
+		if jti == "" {
+			next(w, r)
+			return
+		}
+		key := "used-link:" + jti
+		if r.Method == http.MethodGet {
+			if _, used, err := s.cache.Get(r.Context(), key); err != nil {
+				log.Printf("Error checking link %s: %v", jti, err)
+			} else if used {
+				s.sendErrorResponse(w, r, http.StatusGone, CodeLinkAlreadyUsed, "That link has been used already")
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		// Claimed before it's used, so two clicks at once can't both get in
+		expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+		n, err := s.cache.Incr(r.Context(), key, time.Until(time.Unix(expires, 0))+time.Minute)
+		if err != nil {
+			log.Printf("Error claiming link %s: %v", jti, err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed checking the link")
+			return
+		}
+		if n > 1 {
+			s.sendErrorResponse(w, r, http.StatusGone, CodeLinkAlreadyUsed, "That link has been used already")
+			return
+		}
+		capture := &capturingWriter{ResponseWriter: w}
+		next(capture, r)
+		if capture.status < 200 || capture.status >= 300 {
+			if err := s.cache.Delete(context.WithoutCancel(r.Context()), key); err != nil {
+				log.Printf("Error releasing link %s: %v", jti, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadLinks(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DownloadSecret = "download-secret"
+	server.cfg.DownloadLinkTTL = time.Hour
+	server.cfg.PublicURL = "https://book.example.gov"
+	server.blobs = dirBlobs{dir: t.TempDir()}
+	router := server.routes()
+
+	postAppointment(t, router, AppointmentRequest{FirstName: "Gwen", LastName: "Jones", VisitDate: "2075-06-17"})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, "1", "Jones", "proof.pdf", testPDF))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 uploading, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/documents/1/link?ttl=10m", nil))
+	var link DownloadLink
+	json.Unmarshal(w.Body.Bytes(), &link)
+	if w.Code != http.StatusCreated || !strings.HasPrefix(link.URL, "https://book.example.gov/downloads/documents/1?") {
+		t.Fatalf("Expected a link, got %d: %s", w.Code, w.Body.String())
+	}
+	if until := time.Until(link.ExpiresAt); until > 10*time.Minute || until < 9*time.Minute {
+		t.Errorf("Expected it to last 10 minutes, got %v", until)
+	}
+	path := strings.TrimPrefix(link.URL, server.cfg.PublicURL)
+
+	// No admin token needed
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testPDF) || w.Header().Get("Cache-Control") != "private, no-store" {
+		t.Errorf("Expected the file, got %d %v", w.Code, w.Header())
+	}
+
+	for _, bad := range []string{
+		strings.Replace(path, "/documents/1", "/documents/2", 1),
+		strings.Replace(path, "expires=", "expires=9", 1),
+		path[:len(path)-2],
+		"/downloads/documents/1",
+	} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", bad, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for %s, got %d", bad, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", server.signedURL(context.Background(), "/downloads/documents/1", time.Now().Add(-time.Minute))[len(server.cfg.PublicURL):], nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected 410 for an expired link, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/documents/1/link?ttl=48h", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a ttl past the limit, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/documents/9/link", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 linking to nothing, got %d", w.Code)
+	}
+
+	// And the same for a stored export
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/exports", nil))
+	var stored StoredExport
+	json.Unmarshal(w.Body.Bytes(), &stored)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/exports/"+stored.Name+"/link", nil))
+	json.Unmarshal(w.Body.Bytes(), &link)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", strings.TrimPrefix(link.URL, server.cfg.PublicURL), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"lastName":"Jones"`) {
+		t.Errorf("Expected the export, got %d: %s", w.Code, w.Body.String())
+	}
+}
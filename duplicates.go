@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// People book as "Jon Smith" one month and "Jonathan Smith" the next.
+// Same email, or near enough the same name, is probably the same person:
+// new bookings say so, and staff can merge them
+var nicknames = map[string]string{
+	"bill": "william", "will": "william", "liam": "william",
+	"bob": "robert", "rob": "robert", "bobby": "robert",
+	"dick": "richard", "rick": "richard",
+	"peggy": "margaret", "maggie": "margaret", "meg": "margaret",
+	"liz": "elizabeth", "beth": "elizabeth", "betty": "elizabeth", "lisa": "elizabeth",
+	"kate": "katherine", "katie": "katherine", "cathy": "catherine",
+	"jim": "james", "jamie": "james",
+	"jack": "john", "johnny": "john",
+	"ted": "edward", "ned": "edward", "eddie": "edward",
+	"sue": "susan", "mike": "michael", "dave": "david", "steve": "stephen",
+	"tom": "thomas", "tony": "anthony", "sandy": "alexander", "alex": "alexander",
+}
+
+// Lower case letters only, with the commonest accents folded away
+func normalizeName(name string) string {
+	name = cleanName(name) // so a decomposed é folds too
+	fold := strings.NewReplacer(
+		"á", "a", "à", "a", "â", "a", "ä", "a", "ã", "a",
+		"é", "e", "è", "e", "ê", "e", "ë", "e",
+		"í", "i", "ì", "i", "î", "i", "ï", "i",
+		"ó", "o", "ò", "o", "ô", "o", "ö", "o", "õ", "o",
+		"ú", "u", "ù", "u", "û", "u", "ü", "u",
+		"ŵ", "w", "ŷ", "y", "ñ", "n", "ç", "c",
+	)
+	var b strings.Builder
+	for _, r := range fold.Replace(strings.ToLower(name)) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func firstNamesMatch(a, b string) bool {
+	a, b = normalizeName(a), normalizeName(b)
+	if a == "" || b == "" {
+		return false
+	}
+	if full, ok := nicknames[a]; ok {
+		a = full
+	}
+	if full, ok := nicknames[b]; ok {
+		b = full
+	}
+	// Jon and Jonathan, Chris and Christopher
+	if len(a) >= 3 && len(b) >= 3 && (strings.HasPrefix(a, b) || strings.HasPrefix(b, a)) {
+		return true
+	}
+	return editDistance(a, b) <= 1
+}
+
+// A typo is allowed in longer surnames, Thomson for Thompson
+func lastNamesMatch(a, b string) bool {
+	a, b = normalizeName(a), normalizeName(b)
+	if a == "" || b == "" {
+		return false
+	}
+	if len(a) > 4 && len(b) > 4 {
+		return editDistance(a, b) <= 1
+	}
+	return a == b
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Why two bookings look like the same person, or "" if they don't.
+// Once they've been merged they are the same person, so that's not news
+func duplicateReason(a, b Appointment) string {
+	if a.PersonID != 0 && a.PersonID == b.PersonID {
+		return ""
+	}
+	if email := normalizeEmail(a.Email); email != "" && email == normalizeEmail(b.Email) {
+		return "same_email"
+	}
+	if lastNamesMatch(a.LastName, b.LastName) && firstNamesMatch(a.FirstName, b.FirstName) {
+		return "similar_name"
+	}
+	return ""
+}
+
+// Levenshtein, on runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// What POST /appointments answers with, the booking plus any warnings
+type CreatedAppointment struct {
+	Appointment
+	PossibleDuplicates []int     `json:"possibleDuplicates,omitempty" xml:"possibleDuplicate,omitempty"` // staff bookings only
+	Warnings           []Warning `json:"warnings,omitempty" xml:"warnings>warning,omitempty"`            // worth saying, but it's booked
+}
+
+// Who's told about possible duplicates. Online, it would be telling
+// anyone who else has booked
+var staffBookingRoutes = map[string]bool{
+	"book-phone": true,
+	"book-staff": true,
+}
+
+// Other current bookings that look like the same person, from those with
+// the same surname or email. A surname typo only shows in
+// /admin/duplicates. Only a warning, so a failure here is logged rather
+// than failing the booking
+func (s *Server) possibleDuplicates(ctx context.Context, r *http.Request, appointment Appointment) []int {
+	if route := mux.CurrentRoute(r); route == nil || !staffBookingRoutes[route.GetName()] {
+		return nil
+	}
+	candidates, err := s.store.AppointmentsLike(ctx, appointment.LastName, normalizeEmail(appointment.Email))
+	if err != nil {
+		log.Printf("Error checking for duplicate people: %v", err)
+		return nil
+	}
+
+	var ids []int
+	for _, other := range candidates {
+		if other.ID != appointment.ID && duplicateReason(appointment, other) != "" {
+			ids = append(ids, other.ID)
+		}
+	}
+	return ids
+}
+
+type DuplicatePair struct {
+	XMLName xml.Name    `json:"-" xml:"duplicate"`
+	Reason  string      `json:"reason" xml:"reason,attr"`
+	First   Appointment `json:"first" xml:"first"`
+	Second  Appointment `json:"second" xml:"second"`
+}
+
+type DuplicateList struct {
+	XMLName    xml.Name        `json:"-" xml:"duplicates"`
+	Duplicates []DuplicatePair `json:"duplicates" xml:"duplicate"`
+}
+
+// GET /admin/duplicates, every pair of current bookings that look like one person
+func (s *Server) listDuplicates(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	appointments, err := s.store.List(ctx, time.Time{})
+	if err != nil {
+		log.Printf("Error listing appointments: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list appointments")
+		return
+	}
+
+	list := DuplicateList{Duplicates: []DuplicatePair{}}
+	for i, a := range appointments {
+		for _, b := range appointments[i+1:] {
+			if reason := duplicateReason(a, b); reason != "" {
+				list.Duplicates = append(list.Duplicates, DuplicatePair{Reason: reason, First: a, Second: b})
+			}
+		}
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
+
+// POST /admin/duplicates/merge with {"keep": 1, "merge": [4, 9]} moves
+// the merged bookings over to the kept one's person, each recorded as a
+// "merged" revision in their history
+func (s *Server) mergeDuplicates(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Keep  int   `json:"keep"`
+		Merge []int `json:"merge"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if req.Keep == 0 || len(req.Merge) == 0 {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "keep and merge are required")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	list := AppointmentList{Appointments: []Appointment{}}
+	for _, id := range req.Merge {
+		if id == req.Keep {
+			continue
+		}
+		merged, err := s.store.Merge(ctx, req.Keep, id)
+		if errors.Is(err, ErrAppointmentNotFound) {
+			s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+			return
+		}
+		if err != nil {
+			log.Printf("Error merging appointment %d into %d: %v", id, req.Keep, err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to merge appointments")
+			return
+		}
+		list.Appointments = append(list.Appointments, merged)
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
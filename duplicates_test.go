@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDuplicateReason(t *testing.T) {
+	cases := []struct {
+		a, b Appointment
+		want string
+	}{
+		{Appointment{FirstName: "Jon", LastName: "Smith"}, Appointment{FirstName: "Jonathan", LastName: "Smith"}, "similar_name"},
+		{Appointment{FirstName: "Bill", LastName: "Jones"}, Appointment{FirstName: "William", LastName: "JONES"}, "similar_name"},
+		{Appointment{FirstName: "Siân", LastName: "O'Brien"}, Appointment{FirstName: "Sian", LastName: "OBrien"}, "similar_name"},
+		{Appointment{FirstName: "Anna", LastName: "Thompson"}, Appointment{FirstName: "Anna", LastName: "Thomson"}, "similar_name"},
+		{Appointment{FirstName: "A", LastName: "B", Email: "Same@Example.com"}, Appointment{FirstName: "C", LastName: "D", Email: "same@example.com "}, "same_email"},
+		{Appointment{FirstName: "Jon", LastName: "Smith"}, Appointment{FirstName: "Jon", LastName: "Smart"}, ""},
+		{Appointment{FirstName: "Jo", LastName: "Smith"}, Appointment{FirstName: "Joanna", LastName: "Smith"}, ""},
+		{Appointment{FirstName: "Mark", LastName: "Smith"}, Appointment{FirstName: "Mary", LastName: "Jones"}, ""},
+	}
+	for _, c := range cases {
+		if got := duplicateReason(c.a, c.b); got != c.want {
+			t.Errorf("duplicateReason(%s %s, %s %s) = %q, want %q", c.a.FirstName, c.a.LastName, c.b.FirstName, c.b.LastName, got, c.want)
+		}
+	}
+}
+
+func TestDuplicateWarningAndMerge(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	router := server.routes()
+
+	postAppointment(t, router, AppointmentRequest{FirstName: "Jonathan", LastName: "SMITH", Email: "jon@example.com", VisitDate: "2075-06-16"})
+	body, _ := json.Marshal(AppointmentRequest{FirstName: "Jon", LastName: "Smith", VisitDate: "2075-06-17"})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments", body))
+
+	var created CreatedAppointment
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Code != http.StatusCreated || len(created.PossibleDuplicates) != 1 || created.PossibleDuplicates[0] != 1 {
+		t.Fatalf("Expected a 201 warning about appointment 1, got %d %+v", w.Code, created)
+	}
+	// Booking online doesn't say who else has
+	w = postAppointment(t, router, AppointmentRequest{FirstName: "Jon", LastName: "Smith", Email: "jon@example.com", VisitDate: "2075-06-18"})
+	created = CreatedAppointment{}
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Code != http.StatusCreated || created.PossibleDuplicates != nil {
+		t.Fatalf("Expected no duplicates online, got %d %+v", w.Code, created)
+	}
+	if _, err := server.store.Cancel(t.Context(), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/duplicates", nil))
+	var list DuplicateList
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Duplicates) != 1 || list.Duplicates[0].Reason != "similar_name" {
+		t.Fatalf("Expected one duplicate pair, got %+v", list)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/duplicates/merge", []byte(`{"keep":1,"merge":[2]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 merging, got %d: %s", w.Code, w.Body.String())
+	}
+
+	history, _ := server.store.History(t.Context(), 2)
+	last := history[len(history)-1]
+	if last.Change != RevisionMerged || last.FirstName != "Jonathan" || last.Email != "jon@example.com" || last.VisitDate != "2075-06-17" {
+		t.Errorf("Expected appointment 2 to take on Jonathan's details, got %+v", last)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/duplicates/merge", []byte(`{"keep":1,"merge":[99]}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 merging an unknown appointment, got %d", w.Code)
+	}
+}
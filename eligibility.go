@@ -0,0 +1,213 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Who can book a service at all, in CITYNEXT_ELIGIBILITY_RULES, a JSON
+// file of the rules for each service:
+//
+//	{"parking-permits": [
+//	  {"name": "lives_in_ward", "field": "address.ward", "in": ["Cathays", "Plasnewydd"]},
+//	  {"name": "adult", "field": "customFields.dateOfBirth", "minAge": 18}]}
+//
+// The field is a path into the booking as it's sent, walked by the JSON
+// names, plus "people" for how many are on it and "channel" for how it
+// came in, and the ones in ruleFields. A rule holds when the field is
+// there and is everything the rule says it should be. They're all
+// checked, in order, and the first that doesn't hold is the answer.
+// A rule with "severity": "warning" never turns anyone away, see
+// warnings.go
+type eligibilityRule struct {
+	Name     string   `json:"name" xml:"name"` // what the booking's told didn't hold
+	Field    string   `json:"field" xml:"field"`
+	Message  string   `json:"message,omitempty" xml:"message,omitempty"`
+	Severity string   `json:"severity,omitempty" xml:"severity,omitempty"` // error, the default, or warning
+	In       []string `json:"in,omitempty" xml:"in,omitempty"`             // without minding case
+	NotIn    []string `json:"notIn,omitempty" xml:"notIn,omitempty"`
+	Pattern  string   `json:"pattern,omitempty" xml:"pattern,omitempty"`
+	Min      *float64 `json:"min,omitempty" xml:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty" xml:"max,omitempty"`
+	MinAge   *int     `json:"minAge,omitempty" xml:"minAge,omitempty"` // years old on the visit date, for a YYYY-MM-DD field
+	MaxAge   *int     `json:"maxAge,omitempty" xml:"maxAge,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+type NotEligible struct {
+	XMLName xml.Name `json:"-" xml:"errorResponse"`
+	Error   string   `json:"error" xml:"error"`
+	Message string   `json:"message" xml:"message"`
+	Service string   `json:"service" xml:"service"`
+	Rule    string   `json:"rule" xml:"rule"`
+}
+
+type EligibilityRules struct {
+	XMLName xml.Name          `json:"-" xml:"eligibility"`
+	Service string            `json:"service" xml:"service"`
+	Rules   []eligibilityRule `json:"rules" xml:"rule"`
+}
+
+// Read on start and on reload. A service with a rule that doesn't make
+// sense is left out, and logged, like a schema that won't compile
+func envEligibilityRules(key string) map[string][]*eligibilityRule {
+	rules := map[string][]*eligibilityRule{}
+	path := envString(key, "")
+	if path == "" {
+		return rules
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		log.Printf("Ignoring %s=%s: %v", key, path, err)
+		return map[string][]*eligibilityRule{}
+	}
+	for service, serviceRules := range rules {
+		for _, rule := range serviceRules {
+			if err := rule.compile(); err != nil {
+				log.Printf("Ignoring %s rules for %s: %v", key, service, err)
+				delete(rules, service)
+				break
+			}
+		}
+	}
+	return rules
+}
+
+func (rule *eligibilityRule) compile() error {
+	if rule.Name == "" || rule.Field == "" {
+		return errors.New("every rule needs a name and a field")
+	}
+	if rule.Severity != "" && rule.Severity != SeverityError && rule.Severity != SeverityWarning {
+		return fmt.Errorf("%s: severity should be %s or %s", rule.Name, SeverityError, SeverityWarning)
+	}
+	if rule.Pattern != "" {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		rule.pattern = re
+	}
+	return nil
+}
+
+// The booking as the rules see it
+func eligibilityFields(req AppointmentRequest) map[string]any {
+	var fields map[string]any
+	data, _ := json.Marshal(req)
+	json.Unmarshal(data, &fields)
+	fields["people"] = float64(req.PartySize())
+	fields["channel"] = channelOrOnline(req.Channel)
+	return fields
+}
+
+func fieldAt(fields map[string]any, path string) (any, bool) {
+	var v any = fields
+	for name := range strings.SplitSeq(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok || v == nil {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (rule *eligibilityRule) holds(fields map[string]any, visitDate time.Time) bool {
+	v, ok := fieldAt(fields, rule.Field)
+	if !ok {
+		return false
+	}
+	text := fmt.Sprint(v)
+	matches := func(values []string) bool {
+		return slices.ContainsFunc(values, func(want string) bool { return strings.EqualFold(want, text) })
+	}
+	if len(rule.In) > 0 && !matches(rule.In) || len(rule.NotIn) > 0 && matches(rule.NotIn) {
+		return false
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(text) {
+		return false
+	}
+	if rule.Min != nil || rule.Max != nil {
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil || rule.Min != nil && n < *rule.Min || rule.Max != nil && n > *rule.Max {
+			return false
+		}
+	}
+	if rule.MinAge != nil || rule.MaxAge != nil {
+		born, err := time.Parse("2006-01-02", text)
+		if err != nil {
+			return false
+		}
+		age := ageOn(born, visitDate)
+		if rule.MinAge != nil && age < *rule.MinAge || rule.MaxAge != nil && age > *rule.MaxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// Whole years, a birthday counting from the day itself
+func ageOn(born, day time.Time) int {
+	age := day.Year() - born.Year()
+	if day.Month() < born.Month() || day.Month() == born.Month() && day.Day() < born.Day() {
+		age--
+	}
+	return age
+}
+
+// Sends not_eligible with the first of the service's rules that doesn't hold
+func (s *Server) checkEligibility(w http.ResponseWriter, r *http.Request, req AppointmentRequest, visitDate time.Time) bool {
+	rules := s.live().EligibilityRules[req.Service]
+	if len(rules) == 0 {
+		return true
+	}
+	fields := s.ruleFields(r.Context(), req, visitDate)
+	for _, rule := range rules {
+		if rule.Severity == SeverityWarning || rule.holds(fields, visitDate) {
+			continue
+		}
+		s.countRejection(r, http.StatusForbidden, CodeNotEligible)
+		s.respond(w, r, http.StatusForbidden, NotEligible{
+			Error:   CodeNotEligible,
+			Message: cmp.Or(rule.Message, "They aren't eligible for "+req.Service),
+			Service: req.Service,
+			Rule:    rule.Name,
+		})
+		return false
+	}
+	return true
+}
+
+// GET /services/{service}/eligibility, so the form can say who can book
+// before they fill it in. No rules is anyone
+func (s *Server) getEligibilityRules(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	if !slices.Contains(s.queueServices(), service) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownService, "No such service")
+		return
+	}
+	res := EligibilityRules{Service: service, Rules: []eligibilityRule{}}
+	for _, rule := range s.live().EligibilityRules[service] {
+		res.Rules = append(res.Rules, *rule)
+	}
+	s.respond(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const parkingRules = `{"parking-permits": [
+	{"name": "lives_in_ward", "field": "address.ward", "in": ["cathays", "Plasnewydd"], "message": "Permits are only for Cathays and Plasnewydd"},
+	{"name": "adult", "field": "customFields.dateOfBirth", "minAge": 18},
+	{"name": "one_household", "field": "people", "max": 2}],
+	"general": [{"name": "broken", "field": "firstName", "pattern": "("}]}`
+
+func TestAgeOn(t *testing.T) {
+	day := time.Date(2075, 1, 9, 0, 0, 0, 0, time.UTC)
+	for born, want := range map[string]int{"2057-01-09": 18, "2057-01-10": 17, "2056-12-31": 18, "2075-01-09": 0} {
+		b, _ := time.Parse("2006-01-02", born)
+		if got := ageOn(b, day); got != want {
+			t.Errorf("Expected someone born %s to be %d, got %d", born, want, got)
+		}
+	}
+}
+
+func TestEligibility(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(parkingRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CITYNEXT_ELIGIBILITY_RULES", path)
+
+	var calls int
+	_, getaddress := fakePostcodeLookups(t, &calls)
+	server, _ := closureServer(t, "sqlite")
+	server.cfg.QueueServices = []string{"general", "parking-permits"}
+	server.cfg.CustomFields = map[string]*fieldSchema{}
+	json.Unmarshal([]byte(`{"parking-permits": {"type": "object", "properties": {"dateOfBirth": {"type": "string"}}}}`), &server.cfg.CustomFields)
+	server.cfg.EligibilityRules = envEligibilityRules("CITYNEXT_ELIGIBILITY_RULES")
+	server.postcodes = getaddress
+	router := server.routes()
+
+	// The broken rule takes its service's rules with it
+	if _, ok := server.cfg.EligibilityRules["general"]; ok {
+		t.Errorf("Expected the rules with a bad pattern left out")
+	}
+
+	book := func(line1, born string, attendees ...Attendee) *httptest.ResponseRecorder {
+		return postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Driver", VisitDate: "2075-01-09", Service: "parking-permits",
+			Address: &Address{Line1: line1, Postcode: "CF10 1AA"}, CustomFields: CustomFields{"dateOfBirth": born}, Attendees: attendees})
+	}
+	for _, c := range []struct {
+		line1, born string
+		attendees   []Attendee
+		rule        string
+	}{
+		{"Flat 2", "1980-05-01", nil, "lives_in_ward"},
+		{"1 High Street", "2057-01-10", nil, "adult"},
+		{"1 High Street", "not a date", nil, "adult"},
+		{"1 High Street", "1980-05-01", []Attendee{{FirstName: "A", LastName: "Driver"}, {FirstName: "B", LastName: "Driver"}}, "one_household"},
+	} {
+		w := book(c.line1, c.born, c.attendees...)
+		var res NotEligible
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if w.Code != http.StatusForbidden || res.Error != "not_eligible" || res.Rule != c.rule || res.Service != "parking-permits" {
+			t.Errorf("Expected %s to fail, got %d: %s", c.rule, w.Code, w.Body.String())
+		}
+		if c.rule == "lives_in_ward" && res.Message != "Permits are only for Cathays and Plasnewydd" {
+			t.Errorf("Expected the rule's own message, got %q", res.Message)
+		}
+	}
+	if w := book("1 High Street", "2057-01-09"); w.Code != http.StatusCreated {
+		t.Fatalf("Expected someone eligible booked, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Nor can anyone be moved onto it who couldn't book it
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dai", LastName: "Walker", VisitDate: "2075-01-09"}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected a general booking, got %d: %s", w.Code, w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/2/transfer", []byte(`{"service": "parking-permits"}`)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected the transfer refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/services/parking-permits/eligibility", nil))
+	var rules EligibilityRules
+	json.Unmarshal(w.Body.Bytes(), &rules)
+	if w.Code != http.StatusOK || len(rules.Rules) != 3 || rules.Rules[1].Name != "adult" || *rules.Rules[1].MinAge != 18 {
+		t.Errorf("Expected the rules for the form, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/services/general/eligibility", nil))
+	if json.Unmarshal(w.Body.Bytes(), &rules); w.Code != http.StatusOK || len(rules.Rules) != 0 {
+		t.Errorf("Expected no rules for general, got %d: %s", w.Code, w.Body.String())
+	}
+}
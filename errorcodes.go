@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+)
+
+// Every error the API answers with, the "error" in the body. Handlers
+// send these rather than spelling the code out, and each is in
+// errorCatalog with the statuses it comes with, so GET /errors can list
+// them all for clients to handle
+const (
+	CodeAddressRequired           = "address_required"
+	CodeAdminDisabled             = "admin_disabled"
+	CodeAlreadyCheckedIn          = "already_checked_in"
+	CodeAlreadyRebooked           = "already_rebooked"
+	CodeAlreadyReviewed           = "already_reviewed"
+	CodeBackupFailed              = "backup_failed"
+	CodeBookingNotOpen            = "booking_not_open"
+	CodeCacheError                = "cache_error"
+	CodeChannelDisabled           = "channel_disabled"
+	CodeConsentOutdated           = "consent_outdated"
+	CodeConsentRequired           = "consent_required"
+	CodeCSRFFailed                = "csrf_failed"
+	CodeDatabaseError             = "database_error"
+	CodeDayClosed                 = "day_closed"
+	CodeDocumentInfected          = "document_infected"
+	CodeDocumentTooLarge          = "document_too_large"
+	CodeDuplicateAppointment      = "duplicate_appointment"
+	CodeEncodingError             = "encoding_error"
+	CodeEnvironmentKey            = "environment_key"
+	CodeExportFailed              = "export_failed"
+	CodeFeatureDisabled           = "feature_disabled"
+	CodeFollowUpStaffOnly         = "follow_up_staff_only"
+	CodeFollowUpTooSoon           = "follow_up_too_soon"
+	CodeHolidayAPIError           = "holiday_api_error"
+	CodeHolidaysStale             = "holidays_stale"
+	CodeIdempotencyKeyReused      = "idempotency_key_reused"
+	CodeInboundDisabled           = "inbound_disabled"
+	CodeInsufficientScope         = "insufficient_scope"
+	CodeInvalidAction             = "invalid_action"
+	CodeInvalidAddress            = "invalid_address"
+	CodeInvalidAsOf               = "invalid_as_of"
+	CodeInvalidBookedBy           = "invalid_booked_by"
+	CodeInvalidCapacity           = "invalid_capacity"
+	CodeInvalidCustomFields       = "invalid_custom_fields"
+	CodeInvalidDate               = "invalid_date"
+	CodeInvalidEmail              = "invalid_email"
+	CodeInvalidForm               = "invalid_form"
+	CodeInvalidFormat             = "invalid_format"
+	CodeInvalidJSON               = "invalid_json"
+	CodeInvalidKind               = "invalid_kind"
+	CodeInvalidLanguage           = "invalid_language"
+	CodeInvalidLink               = "invalid_link"
+	CodeInvalidMonth              = "invalid_month"
+	CodeInvalidName               = "invalid_name"
+	CodeInvalidNotification       = "invalid_notification"
+	CodeInvalidPeople             = "invalid_people"
+	CodeInvalidPlan               = "invalid_plan"
+	CodeInvalidPostcode           = "invalid_postcode"
+	CodeInvalidRange              = "invalid_range"
+	CodeInvalidScope              = "invalid_scope"
+	CodeInvalidSignature          = "invalid_signature"
+	CodeInvalidToken              = "invalid_token"
+	CodeInvalidTTL                = "invalid_ttl"
+	CodeInvalidWorkingDays        = "invalid_working_days"
+	CodeInvalidYear               = "invalid_year"
+	CodeJobRunning                = "job_running"
+	CodeKioskDisabled             = "kiosk_disabled"
+	CodeLinkAlreadyUsed           = "link_already_used"
+	CodeLinkExpired               = "link_expired"
+	CodeLockedOut                 = "locked_out"
+	CodeMethodNotAllowed          = "method_not_allowed"
+	CodeMissingClientID           = "missing_client_id"
+	CodeMissingFields             = "missing_fields"
+	CodeNoProfile                 = "no_profile"
+	CodeNotEligible               = "not_eligible"
+	CodeNotFound                  = "not_found"
+	CodeNotSupported              = "not_supported"
+	CodeNotToday                  = "not_today"
+	CodeNotYourTurn               = "not_your_turn"
+	CodeNothingToTransfer         = "nothing_to_transfer"
+	CodeOutOfScope                = "out_of_scope"
+	CodeOutsideArea               = "outside_area"
+	CodeOutsideYear               = "outside_year"
+	CodePastDate                  = "past_date"
+	CodePlanIncomplete            = "plan_incomplete"
+	CodePlanOutOfDate             = "plan_out_of_date"
+	CodePostcodeLookupUnavailable = "postcode_lookup_unavailable"
+	CodePriorityNeedsStaff        = "priority_needs_staff"
+	CodePriorityNotForService     = "priority_not_for_service"
+	CodeProfileUnavailable        = "profile_unavailable"
+	CodeProposalExpired           = "proposal_expired"
+	CodePublicHoliday             = "public_holiday"
+	CodeQueueEmpty                = "queue_empty"
+	CodeQueueRequired             = "queue_required"
+	CodeRateLimited               = "rate_limited"
+	CodeReloadFailed              = "reload_failed"
+	CodeRequestInProgress         = "request_in_progress"
+	CodeScanUnavailable           = "scan_unavailable"
+	CodeServiceRequired           = "service_required"
+	CodeStaffOnly                 = "staff_only"
+	CodeStorageError              = "storage_error"
+	CodeTimeout                   = "timeout"
+	CodeTooManyAttendees          = "too_many_attendees"
+	CodeTooSoon                   = "too_soon"
+	CodeUnauthorized              = "unauthorized"
+	CodeUnknownAccount            = "unknown_account"
+	CodeUnknownAddress            = "unknown_address"
+	CodeUnknownCountry            = "unknown_country"
+	CodeUnknownFeature            = "unknown_feature"
+	CodeUnknownFollowUp           = "unknown_follow_up"
+	CodeUnknownJob                = "unknown_job"
+	CodeUnknownLocation           = "unknown_location"
+	CodeUnknownPostcode           = "unknown_postcode"
+	CodeUnknownPriority           = "unknown_priority"
+	CodeUnknownRule               = "unknown_rule"
+	CodeUnknownService            = "unknown_service"
+	CodeUnknownToken              = "unknown_token"
+	CodeUnsupportedDocumentType   = "unsupported_document_type"
+	CodeWrongDay                  = "wrong_day"
+)
+
+type ErrorCode struct {
+	XMLName     xml.Name `json:"-" xml:"error"`
+	Code        string   `json:"code" xml:"code,attr"`
+	Statuses    []int    `json:"statuses" xml:"status"`
+	Description string   `json:"description" xml:"description"`
+}
+
+type ErrorCatalog struct {
+	XMLName xml.Name    `json:"-" xml:"errors"`
+	Errors  []ErrorCode `json:"errors" xml:"error"`
+}
+
+// By code. Add to it with the constant, errorcodes_test.go checks
+// nothing's sent that isn't here
+var errorCatalog = []ErrorCode{
+	{Code: CodeAddressRequired, Statuses: []int{http.StatusBadRequest}, Description: "The service needs the address they live at and there isn't one"},
+	{Code: CodeAdminDisabled, Statuses: []int{http.StatusForbidden}, Description: "There's no CITYNEXT_ADMIN_TOKEN, so admin endpoints are switched off"},
+	{Code: CodeAlreadyCheckedIn, Statuses: []int{http.StatusConflict}, Description: "They've checked in, so the booking can't be moved"},
+	{Code: CodeAlreadyRebooked, Statuses: []int{http.StatusConflict}, Description: "The rebooking link has been used already"},
+	{Code: CodeAlreadyReviewed, Statuses: []int{http.StatusConflict}, Description: "Someone else has reviewed the document already"},
+	{Code: CodeBackupFailed, Statuses: []int{http.StatusInternalServerError}, Description: "The backup couldn't be made"},
+	{Code: CodeBookingNotOpen, Statuses: []int{http.StatusForbidden}, Description: "Booking for the service doesn't open until later, see opensAt"},
+	{Code: CodeCacheError, Statuses: []int{http.StatusInternalServerError}, Description: "The shared cache couldn't be reached"},
+	{Code: CodeChannelDisabled, Statuses: []int{http.StatusForbidden}, Description: "The phone channel or IVR isn't switched on"},
+	{Code: CodeConsentOutdated, Statuses: []int{http.StatusBadRequest}, Description: "The privacy notice has changed since they accepted it, see version and url"},
+	{Code: CodeConsentRequired, Statuses: []int{http.StatusBadRequest}, Description: "They need to accept the privacy notice to book, see version and url"},
+	{Code: CodeCSRFFailed, Statuses: []int{http.StatusForbidden}, Description: "A change from a logged in browser without the session's X-CSRF-Token"},
+	{Code: CodeDatabaseError, Statuses: []int{http.StatusInternalServerError}, Description: "The database couldn't be read or written, try again"},
+	{Code: CodeDayClosed, Statuses: []int{http.StatusBadRequest}, Description: "The office is closed that day"},
+	{Code: CodeDocumentInfected, Statuses: []int{http.StatusUnprocessableEntity}, Description: "The file didn't pass the virus scan"},
+	{Code: CodeDocumentTooLarge, Statuses: []int{http.StatusRequestEntityTooLarge}, Description: "The file is bigger than documents can be"},
+	{Code: CodeDuplicateAppointment, Statuses: []int{http.StatusConflict}, Description: "There aren't enough places left that day"},
+	{Code: CodeEncodingError, Statuses: []int{http.StatusInternalServerError}, Description: "The response couldn't be encoded in the format asked for"},
+	{Code: CodeEnvironmentKey, Statuses: []int{http.StatusConflict}, Description: "The signing key is CITYNEXT_DOWNLOAD_SECRET, which can only be unset"},
+	{Code: CodeExportFailed, Statuses: []int{http.StatusInternalServerError}, Description: "The export couldn't be made"},
+	{Code: CodeFeatureDisabled, Statuses: []int{http.StatusNotFound}, Description: "The feature flag for it is off"},
+	{Code: CodeFollowUpStaffOnly, Statuses: []int{http.StatusForbidden}, Description: "Only staff can book a follow-up"},
+	{Code: CodeFollowUpTooSoon, Statuses: []int{http.StatusBadRequest}, Description: "A follow-up is too close to the visit it follows, see earliestDate"},
+	{Code: CodeHolidayAPIError, Statuses: []int{http.StatusBadGateway}, Description: "The public holiday API couldn't be reached, the old holidays are still in use"},
+	{Code: CodeHolidaysStale, Statuses: []int{http.StatusServiceUnavailable}, Description: "The public holidays are too old to trust and can't be refreshed, try again later"},
+	{Code: CodeIdempotencyKeyReused, Statuses: []int{http.StatusUnprocessableEntity}, Description: "The Idempotency-Key was used before with a different request"},
+	{Code: CodeInboundDisabled, Statuses: []int{http.StatusForbidden}, Description: "Inbound email isn't set up for that provider"},
+	{Code: CodeInsufficientScope, Statuses: []int{http.StatusForbidden}, Description: "The API key doesn't have the scope for that route"},
+	{Code: CodeInvalidAction, Statuses: []int{http.StatusBadRequest}, Description: "A closure's action isn't cancel or flag"},
+	{Code: CodeInvalidAddress, Statuses: []int{http.StatusBadRequest}, Description: "The address is missing its first line"},
+	{Code: CodeInvalidAsOf, Statuses: []int{http.StatusBadRequest}, Description: "asOf isn't an RFC 3339 timestamp or a YYYY-MM-DD date"},
+	{Code: CodeInvalidBookedBy, Statuses: []int{http.StatusBadRequest}, Description: "bookedBy's role isn't staff or carer"},
+	{Code: CodeInvalidCapacity, Statuses: []int{http.StatusBadRequest}, Description: "A capacity is negative"},
+	{Code: CodeInvalidCustomFields, Statuses: []int{http.StatusBadRequest}, Description: "The custom fields don't fit the service's schema, see problems"},
+	{Code: CodeInvalidDate, Statuses: []int{http.StatusBadRequest}, Description: "A date isn't YYYY-MM-DD"},
+	{Code: CodeInvalidEmail, Statuses: []int{http.StatusBadRequest}, Description: "The email address isn't one"},
+	{Code: CodeInvalidForm, Statuses: []int{http.StatusBadRequest}, Description: "The upload isn't a multipart form with the file and lastName"},
+	{Code: CodeInvalidFormat, Statuses: []int{http.StatusBadRequest}, Description: "The format asked for isn't one the endpoint has"},
+	{Code: CodeInvalidJSON, Statuses: []int{http.StatusBadRequest}, Description: "The body isn't valid JSON"},
+	{Code: CodeInvalidKind, Statuses: []int{http.StatusBadRequest}, Description: "A status notice's kind isn't maintenance, closure or info"},
+	{Code: CodeInvalidLanguage, Statuses: []int{http.StatusBadRequest}, Description: "The preferred language isn't en or cy"},
+	{Code: CodeInvalidLink, Statuses: []int{http.StatusForbidden}, Description: "The signed link has been tampered with, or its key is gone"},
+	{Code: CodeInvalidMonth, Statuses: []int{http.StatusBadRequest}, Description: "The month isn't YYYY-MM in the current year"},
+	{Code: CodeInvalidName, Statuses: []int{http.StatusBadRequest}, Description: "A name is too long or has characters CITYNEXT_NAME_CHARACTERS doesn't allow"},
+	{Code: CodeInvalidNotification, Statuses: []int{http.StatusBadRequest}, Description: "The inbound email notification isn't one"},
+	{Code: CodeInvalidPeople, Statuses: []int{http.StatusBadRequest}, Description: "people isn't a whole number of at least 1"},
+	{Code: CodeInvalidPlan, Statuses: []int{http.StatusBadRequest}, Description: "A rebalancing plan moves a booking onto the day it's on"},
+	{Code: CodeInvalidPostcode, Statuses: []int{http.StatusBadRequest}, Description: "The postcode isn't a UK one"},
+	{Code: CodeInvalidRange, Statuses: []int{http.StatusBadRequest}, Description: "The end of a range is before its start"},
+	{Code: CodeInvalidScope, Statuses: []int{http.StatusBadRequest}, Description: "An API key scope isn't one there is"},
+	{Code: CodeInvalidSignature, Statuses: []int{http.StatusUnauthorized}, Description: "The inbound email's signature doesn't match"},
+	{Code: CodeInvalidToken, Statuses: []int{http.StatusForbidden}, Description: "The profile link's token isn't valid"},
+	{Code: CodeInvalidTTL, Statuses: []int{http.StatusBadRequest}, Description: "The download link's ttl isn't a duration or is too long"},
+	{Code: CodeInvalidWorkingDays, Statuses: []int{http.StatusBadRequest}, Description: "The number of working days is out of range"},
+	{Code: CodeInvalidYear, Statuses: []int{http.StatusBadRequest, http.StatusInternalServerError}, Description: "The date isn't in the booking year, or the server's year isn't configured (500)"},
+	{Code: CodeJobRunning, Statuses: []int{http.StatusConflict}, Description: "The job's running already, here or on another replica"},
+	{Code: CodeKioskDisabled, Statuses: []int{http.StatusForbidden}, Description: "There's no CITYNEXT_KIOSK_TOKEN, so the kiosk is switched off"},
+	{Code: CodeLinkAlreadyUsed, Statuses: []int{http.StatusGone}, Description: "The link does something once, and it's been done"},
+	{Code: CodeLinkExpired, Statuses: []int{http.StatusGone}, Description: "The link has expired, ask for a new one"},
+	{Code: CodeLockedOut, Statuses: []int{http.StatusTooManyRequests}, Description: "Too many wrong tokens from this IP, see Retry-After"},
+	{Code: CodeMethodNotAllowed, Statuses: []int{http.StatusMethodNotAllowed}, Description: "The endpoint doesn't take that method"},
+	{Code: CodeMissingClientID, Statuses: []int{http.StatusBadRequest}, Description: "There's no X-Client-Id, or it's too long"},
+	{Code: CodeMissingFields, Statuses: []int{http.StatusBadRequest}, Description: "A required field is missing, the message says which"},
+	{Code: CodeNoProfile, Statuses: []int{http.StatusNotFound}, Description: "There are no bookings with that email any more"},
+	{Code: CodeNotEligible, Statuses: []int{http.StatusForbidden}, Description: "They aren't eligible for the service, see rule"},
+	{Code: CodeNotFound, Statuses: []int{http.StatusNotFound}, Description: "There's nothing with that ID"},
+	{Code: CodeNotSupported, Statuses: []int{http.StatusNotImplemented}, Description: "The store in use can't do that"},
+	{Code: CodeNotToday, Statuses: []int{http.StatusBadRequest}, Description: "Walk-ins are only for today"},
+	{Code: CodeNotYourTurn, Statuses: []int{http.StatusTooManyRequests}, Description: "Still in the waiting room, see the position"},
+	{Code: CodeNothingToTransfer, Statuses: []int{http.StatusBadRequest}, Description: "The booking is already for that service on that day"},
+	{Code: CodeOutOfScope, Statuses: []int{http.StatusForbidden}, Description: "The kiosk token can't be used for that route"},
+	{Code: CodeOutsideArea, Statuses: []int{http.StatusBadRequest}, Description: "The address is outside the areas the service covers"},
+	{Code: CodeOutsideYear, Statuses: []int{http.StatusBadRequest}, Description: "The date is outside the current year"},
+	{Code: CodePastDate, Statuses: []int{http.StatusBadRequest}, Description: "The visit date is in the past"},
+	{Code: CodePlanIncomplete, Statuses: []int{http.StatusConflict}, Description: "The rebalancing plan couldn't find everyone a day"},
+	{Code: CodePlanOutOfDate, Statuses: []int{http.StatusConflict}, Description: "Bookings have changed since the rebalancing plan was made"},
+	{Code: CodePostcodeLookupUnavailable, Statuses: []int{http.StatusServiceUnavailable}, Description: "Addresses can't be checked right now, try again later"},
+	{Code: CodePriorityNeedsStaff, Statuses: []int{http.StatusForbidden}, Description: "The priority class has to be booked by staff"},
+	{Code: CodePriorityNotForService, Statuses: []int{http.StatusForbidden}, Description: "The priority class doesn't apply to the service"},
+	{Code: CodeProfileUnavailable, Statuses: []int{http.StatusNotFound}, Description: "Returning citizen profiles aren't available without a signing key"},
+	{Code: CodeProposalExpired, Statuses: []int{http.StatusGone}, Description: "The place held after a closure is no longer held"},
+	{Code: CodePublicHoliday, Statuses: []int{http.StatusBadRequest}, Description: "The visit date is a public holiday"},
+	{Code: CodeQueueEmpty, Statuses: []int{http.StatusNotFound}, Description: "Nobody is waiting for that service"},
+	{Code: CodeQueueRequired, Statuses: []int{http.StatusTooManyRequests}, Description: "Bookings are going through the waiting room, join it first"},
+	{Code: CodeRateLimited, Statuses: []int{http.StatusTooManyRequests}, Description: "Too many requests from this client, try again shortly"},
+	{Code: CodeReloadFailed, Statuses: []int{http.StatusInternalServerError}, Description: "The config file couldn't be read, the old config is still in use"},
+	{Code: CodeRequestInProgress, Statuses: []int{http.StatusConflict}, Description: "A request with the same Idempotency-Key is still being handled"},
+	{Code: CodeScanUnavailable, Statuses: []int{http.StatusServiceUnavailable}, Description: "The virus scanner can't be reached, try again later"},
+	{Code: CodeServiceRequired, Statuses: []int{http.StatusBadRequest}, Description: "A transfer needs a service or location to move to"},
+	{Code: CodeStaffOnly, Statuses: []int{http.StatusForbidden}, Description: "Only staff can say a booking was booked by staff"},
+	{Code: CodeStorageError, Statuses: []int{http.StatusInternalServerError}, Description: "A document or export couldn't be stored or fetched"},
+	{Code: CodeTimeout, Statuses: []int{http.StatusServiceUnavailable}, Description: "The request took too long, try again"},
+	{Code: CodeTooManyAttendees, Statuses: []int{http.StatusBadRequest}, Description: "The party is bigger than a whole day"},
+	{Code: CodeTooSoon, Statuses: []int{http.StatusBadRequest}, Description: "The service needs more days' notice than that"},
+	{Code: CodeUnauthorized, Statuses: []int{http.StatusUnauthorized}, Description: "The token is missing or wrong, or the session has ended"},
+	{Code: CodeUnknownAccount, Statuses: []int{http.StatusNotFound}, Description: "The lockout account isn't admin, phone or kiosk"},
+	{Code: CodeUnknownAddress, Statuses: []int{http.StatusBadRequest}, Description: "There's no such address at the postcode"},
+	{Code: CodeUnknownCountry, Statuses: []int{http.StatusBadRequest}, Description: "No holidays are loaded for that country"},
+	{Code: CodeUnknownFeature, Statuses: []int{http.StatusNotFound}, Description: "There's no feature flag by that name"},
+	{Code: CodeUnknownFollowUp, Statuses: []int{http.StatusBadRequest}, Description: "There's no current booking to follow up"},
+	{Code: CodeUnknownJob, Statuses: []int{http.StatusNotFound}, Description: "No background job by that name is scheduled on this replica"},
+	{Code: CodeUnknownLocation, Statuses: []int{http.StatusBadRequest, http.StatusNotFound}, Description: "There's no such location"},
+	{Code: CodeUnknownPostcode, Statuses: []int{http.StatusNotFound}, Description: "There are no addresses at the postcode"},
+	{Code: CodeUnknownPriority, Statuses: []int{http.StatusBadRequest}, Description: "There's no such priority class"},
+	{Code: CodeUnknownRule, Statuses: []int{http.StatusBadRequest}, Description: "There's no such rebalancing rule"},
+	{Code: CodeUnknownService, Statuses: []int{http.StatusBadRequest, http.StatusNotFound}, Description: "There's no such service"},
+	{Code: CodeUnknownToken, Statuses: []int{http.StatusNotFound}, Description: "The waiting room token has expired or was never issued"},
+	{Code: CodeUnsupportedDocumentType, Statuses: []int{http.StatusUnsupportedMediaType}, Description: "The file isn't one of the document types taken"},
+	{Code: CodeWrongDay, Statuses: []int{http.StatusConflict}, Description: "The appointment is for another day"},
+}
+
+// GET /errors, the same for everyone until a deploy changes it
+func (s *Server) listErrorCodes(w http.ResponseWriter, r *http.Request) {
+	writeCacheable(w, r, ErrorCatalog{Errors: errorCatalog}, time.Hour)
+}
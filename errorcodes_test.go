@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Every error sent is a Code constant, in the catalogue with the status
+// it's sent with, so GET /errors is the whole list
+func TestErrorCodesCatalogued(t *testing.T) {
+	statuses := map[string]int{}
+	for code := 100; code < 600; code++ {
+		if text := http.StatusText(code); text != "" {
+			statuses["Status"+strings.NewReplacer(" ", "", "-", "").Replace(text)] = code
+		}
+	}
+	catalogued := map[string][]int{}
+	for _, e := range errorCatalog {
+		if _, ok := catalogued[e.Code]; ok {
+			t.Errorf("Expected %s in the catalogue once", e.Code)
+		}
+		catalogued[e.Code] = e.Statuses
+	}
+
+	fset := token.NewFileSet()
+	files, _ := filepath.Glob("*.go")
+	consts, used := map[string]string{}, map[string]bool{}
+	var parsed []*ast.File
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, f)
+		for _, decl := range f.Decls {
+			if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.CONST {
+				for _, spec := range gen.Specs {
+					v := spec.(*ast.ValueSpec)
+					if lit, ok := v.Values[0].(*ast.BasicLit); ok && strings.HasPrefix(v.Names[0].Name, "Code") {
+						consts[v.Names[0].Name], _ = strconv.Unquote(lit.Value)
+					}
+				}
+			}
+		}
+	}
+	for _, f := range parsed {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok || (sel.Sel.Name != "sendErrorResponse" && sel.Sel.Name != "countRejection") {
+					return true
+				}
+				status, code := n.Args[1], n.Args[2] // countRejection(r, status, code)
+				if sel.Sel.Name == "sendErrorResponse" {
+					status, code = n.Args[2], n.Args[3]
+				}
+				ident, ok := code.(*ast.Ident)
+				if !ok {
+					if _, literal := code.(*ast.BasicLit); literal {
+						t.Errorf("%s: expected a Code constant, not a string", fset.Position(code.Pos()))
+					}
+					return true
+				}
+				value, ok := consts[ident.Name]
+				if !ok {
+					return true // passed along, checked where it's set
+				}
+				used[ident.Name] = true
+				if s, ok := status.(*ast.SelectorExpr); ok && !slices.Contains(catalogued[value], statuses[s.Sel.Name]) {
+					t.Errorf("%s: %s is sent as %s, which the catalogue doesn't say", fset.Position(code.Pos()), value, s.Sel.Name)
+				}
+			case *ast.KeyValueExpr:
+				if key, ok := n.Key.(*ast.Ident); ok && key.Name == "Error" {
+					switch v := n.Value.(type) {
+					case *ast.BasicLit:
+						t.Errorf("%s: expected a Code constant, not a string", fset.Position(v.Pos()))
+					case *ast.Ident:
+						used[v.Name] = true
+					}
+				}
+			case *ast.Ident:
+				if _, ok := consts[n.Name]; ok && n.Obj == nil {
+					used[n.Name] = true
+				}
+			}
+			return true
+		})
+	}
+	for name, value := range consts {
+		if _, ok := catalogued[value]; !ok {
+			t.Errorf("Expected %s in the catalogue", value)
+		}
+		if !used[name] {
+			t.Errorf("Expected %s to be sent somewhere, or taken out", value)
+		}
+	}
+}
+
+func TestListErrorCodes(t *testing.T) {
+	server := setupTestServer(t)
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, httptest.NewRequest("GET", "/errors", nil))
+	var catalog ErrorCatalog
+	if err := json.Unmarshal(w.Body.Bytes(), &catalog); err != nil || w.Code != http.StatusOK || len(catalog.Errors) != len(errorCatalog) {
+		t.Fatalf("Expected the catalogue, got %d: %s", w.Code, w.Body.String())
+	}
+	i := slices.IndexFunc(catalog.Errors, func(e ErrorCode) bool { return e.Code == "duplicate_appointment" })
+	if i < 0 || !slices.Equal(catalog.Errors[i].Statuses, []int{http.StatusConflict}) || catalog.Errors[i].Description == "" {
+		t.Errorf("Expected duplicate_appointment as a 409, got %+v", catalog.Errors)
+	}
+	if !slices.IsSortedFunc(catalog.Errors, func(a, b ErrorCode) int { return strings.Compare(a.Code, b.Code) }) {
+		t.Errorf("Expected the codes in order")
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Errorf("Expected the catalogue to be cacheable")
+	}
+}
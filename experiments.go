@@ -0,0 +1,277 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UX experiments on the booking flow, in CITYNEXT_EXPERIMENTS, e.g.
+// "slot-picker=list|calendar,confirm-copy=short:90|long:10" for an even
+// split and a 90/10 one. The form sends its own ID for the browser in
+// X-Client-Id, and gets the same variant of each for it every time, a
+// hash rather than anything kept, so every replica agrees. Bookings made
+// with one are tagged with their variants and reported on at
+// /admin/reports/experiments
+const clientIDHeader = "X-Client-Id"
+
+type experimentVariant struct {
+	name   string
+	weight int
+}
+
+// The variant of each experiment, by experiment
+type Experiments map[string]string
+
+type ExperimentAssignment struct {
+	XMLName    xml.Name `json:"-" xml:"experiment"`
+	Experiment string   `json:"experiment" xml:"name,attr"`
+	Variant    string   `json:"variant" xml:"variant"`
+	Variants   []string `json:"variants" xml:"variants>variant"` // all of them
+}
+
+type ExperimentAssignments struct {
+	XMLName     xml.Name               `json:"-" xml:"experiments"`
+	ClientID    string                 `json:"clientId" xml:"clientId"`
+	Assignments []ExperimentAssignment `json:"assignments" xml:"experiment"`
+}
+
+type VariantReport struct {
+	XMLName       xml.Name `json:"-" xml:"variant"`
+	Variant       string   `json:"variant" xml:"name,attr"`
+	Bookings      int      `json:"bookings" xml:"bookings"`
+	Cancellations int      `json:"cancellations" xml:"cancellations"`
+	CheckedIn     int      `json:"checkedIn" xml:"checkedIn"`
+}
+
+type ExperimentReport struct {
+	XMLName    xml.Name        `json:"-" xml:"experiment"`
+	Experiment string          `json:"experiment" xml:"name,attr"`
+	Running    bool            `json:"running" xml:"running"` // still in CITYNEXT_EXPERIMENTS
+	Variants   []VariantReport `json:"variants" xml:"variant"`
+}
+
+type ExperimentsReport struct {
+	XMLName     xml.Name           `json:"-" xml:"experimentsReport"`
+	Experiments []ExperimentReport `json:"experiments" xml:"experiment"`
+}
+
+// As XML there's one <experiment name="..."> each, in name order
+func (e Experiments) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, name := range e.names() {
+		experiment := xml.StartElement{Name: xml.Name{Local: "experiment"}, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}}}
+		if err := enc.EncodeElement(e[name], experiment); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func (e Experiments) names() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// For X-Experiments, "confirm-copy=long, slot-picker=list"
+func (e Experiments) String() string {
+	var parts []string
+	for _, name := range e.names() {
+		parts = append(parts, name+"="+e[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func encodeExperiments(e Experiments) sql.NullString {
+	if len(e) == 0 {
+		return sql.NullString{}
+	}
+	data, _ := json.Marshal(e)
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func decodeExperiments(data sql.NullString) (Experiments, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var e Experiments
+	if err := json.Unmarshal([]byte(data.String), &e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// An experiment with a variant that doesn't make sense is left out, and
+// logged, like a feature that doesn't exist
+func envExperiments(key string) map[string][]experimentVariant {
+	experiments := map[string][]experimentVariant{}
+	for name, values := range envMap(key) {
+		var variants []experimentVariant
+		for _, v := range values {
+			variant, weight, weighted := strings.Cut(v, ":")
+			n, err := strconv.Atoi(weight)
+			if !weighted {
+				n, err = 1, nil
+			}
+			if err != nil || n < 1 || variant == "" || slices.ContainsFunc(variants, func(o experimentVariant) bool { return o.name == variant }) {
+				variants = nil
+				break
+			}
+			variants = append(variants, experimentVariant{name: variant, weight: n})
+		}
+		if len(variants) < 2 {
+			log.Printf("Ignoring %s entry %s, expected two or more different variants, e.g. %s=list|calendar:3", key, name, name)
+			continue
+		}
+		experiments[name] = variants
+	}
+	return experiments
+}
+
+// Where the client's hash falls among the variants' weights
+func assignVariant(experiment, clientID string, variants []experimentVariant) string {
+	total := 0
+	for _, v := range variants {
+		total += v.weight
+	}
+	sum := sha256.Sum256([]byte(experiment + "\x00" + clientID))
+	n := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, v := range variants {
+		if n -= v.weight; n < 0 {
+			return v.name
+		}
+	}
+	return variants[len(variants)-1].name
+}
+
+func clientIDFrom(r *http.Request) string {
+	return validClientID(r.Header.Get(clientIDHeader))
+}
+
+// Anything up to 128 printable characters, the form's own choice
+func validClientID(id string) string {
+	id = strings.TrimSpace(id)
+	if len(id) > 128 || strings.ContainsFunc(id, func(c rune) bool { return c < ' ' || c > '~' }) {
+		return ""
+	}
+	return id
+}
+
+// Nil without a client ID or anything running
+func (s *Server) experimentsFor(clientID string) Experiments {
+	running := s.live().Experiments
+	if clientID == "" || len(running) == 0 {
+		return nil
+	}
+	assigned := Experiments{}
+	for name, variants := range running {
+		assigned[name] = assignVariant(name, clientID, variants)
+	}
+	return assigned
+}
+
+// X-Experiments on every response to a client that says who it is, so
+// the form can pick its variant from whatever it called first
+func (s *Server) experimentHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if assigned := s.experimentsFor(clientIDFrom(r)); len(assigned) > 0 {
+			w.Header().Set("X-Experiments", assigned.String())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET /experiments with X-Client-Id (or ?clientId=)
+func (s *Server) getExperiments(w http.ResponseWriter, r *http.Request) {
+	clientID := cmp.Or(clientIDFrom(r), validClientID(r.URL.Query().Get("clientId")))
+	if clientID == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingClientID, "An X-Client-Id of up to 128 characters is required")
+		return
+	}
+	res := ExperimentAssignments{ClientID: clientID, Assignments: []ExperimentAssignment{}}
+	running := s.live().Experiments
+	assigned := s.experimentsFor(clientID)
+	for _, name := range assigned.names() {
+		var variants []string
+		for _, v := range running[name] {
+			variants = append(variants, v.name)
+		}
+		res.Assignments = append(res.Assignments, ExperimentAssignment{Experiment: name, Variant: assigned[name], Variants: variants})
+	}
+	s.respond(w, r, http.StatusOK, res)
+}
+
+// From every booking's latest revision, so cancelled ones still count
+func experimentsReport(revisions []Revision, running map[string][]experimentVariant) ExperimentsReport {
+	last := map[int]Revision{}
+	for _, rev := range revisions {
+		last[rev.ID] = rev
+	}
+	counts := map[string]map[string]*VariantReport{}
+	count := func(experiment, variant string) *VariantReport {
+		if counts[experiment] == nil {
+			counts[experiment] = map[string]*VariantReport{}
+		}
+		if counts[experiment][variant] == nil {
+			counts[experiment][variant] = &VariantReport{Variant: variant}
+		}
+		return counts[experiment][variant]
+	}
+	for name, variants := range running {
+		for _, v := range variants {
+			count(name, v.name)
+		}
+	}
+	for _, rev := range last {
+		for name, variant := range rev.Experiments {
+			c := count(name, variant)
+			c.Bookings++
+			if rev.Change == RevisionCancelled {
+				c.Cancellations++
+			} else if rev.CheckedInAt != nil {
+				c.CheckedIn++
+			}
+		}
+	}
+
+	report := ExperimentsReport{Experiments: []ExperimentReport{}}
+	for name, variants := range counts {
+		experiment := ExperimentReport{Experiment: name, Variants: []VariantReport{}}
+		_, experiment.Running = running[name]
+		for _, c := range variants {
+			experiment.Variants = append(experiment.Variants, *c)
+		}
+		sort.Slice(experiment.Variants, func(i, j int) bool { return experiment.Variants[i].Variant < experiment.Variants[j].Variant })
+		report.Experiments = append(report.Experiments, experiment)
+	}
+	sort.Slice(report.Experiments, func(i, j int) bool { return report.Experiments[i].Experiment < report.Experiments[j].Experiment })
+	return report
+}
+
+// GET /admin/reports/experiments, bookings made in each variant
+func (s *Server) getExperimentsReport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+	revisions, err := s.store.Revisions(ctx)
+	if err != nil {
+		log.Printf("Error building experiments report: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to build the report")
+		return
+	}
+	s.respond(w, r, http.StatusOK, experimentsReport(revisions, s.live().Experiments))
+}
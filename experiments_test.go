@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnvExperiments(t *testing.T) {
+	t.Setenv("CITYNEXT_EXPERIMENTS", "slot-picker=list|calendar,confirm-copy=short:90|long:10,solo=only,broken=a:0|b,twice=a|a")
+	experiments := envExperiments("CITYNEXT_EXPERIMENTS")
+	if len(experiments) != 2 || len(experiments["slot-picker"]) != 2 || experiments["confirm-copy"][0] != (experimentVariant{"short", 90}) {
+		t.Errorf("Expected just slot-picker and confirm-copy, got %v", experiments)
+	}
+}
+
+func TestAssignVariant(t *testing.T) {
+	variants := []experimentVariant{{"short", 90}, {"long", 10}}
+	long := 0
+	for i := range 2000 {
+		id := fmt.Sprintf("client-%d", i)
+		v := assignVariant("confirm-copy", id, variants)
+		if v != assignVariant("confirm-copy", id, variants) {
+			t.Fatalf("Expected %s to get the same variant every time", id)
+		}
+		if v == "long" {
+			long++
+		}
+	}
+	if long < 140 || long > 260 {
+		t.Errorf("Expected about 10%% in long, got %d of 2000", long)
+	}
+}
+
+func TestExperiments(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, _ := closureServer(t, store)
+			server.cfg.Experiments = map[string][]experimentVariant{
+				"slot-picker":  {{"list", 1}, {"calendar", 1}},
+				"confirm-copy": {{"short", 1}, {"long", 1}},
+			}
+			router := server.routes()
+			want := server.experimentsFor("browser-1")
+
+			r := httptest.NewRequest("GET", "/experiments", nil)
+			r.Header.Set(clientIDHeader, "browser-1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			var assignments ExperimentAssignments
+			json.Unmarshal(w.Body.Bytes(), &assignments)
+			if w.Code != http.StatusOK || len(assignments.Assignments) != 2 || assignments.Assignments[0].Experiment != "confirm-copy" ||
+				assignments.Assignments[0].Variant != want["confirm-copy"] || len(assignments.Assignments[0].Variants) != 2 {
+				t.Errorf("Expected both assignments, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("X-Experiments"); got != want.String() {
+				t.Errorf("Expected X-Experiments %q, got %q", want.String(), got)
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/experiments", nil))
+			if w.Code != http.StatusBadRequest || w.Header().Get("X-Experiments") != "" {
+				t.Errorf("Expected a client ID needed, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// The booking's tagged with the variants, whatever the client says
+			body := []byte(`{"firstName": "Ab", "lastName": "Tester", "visitDate": "2075-01-09", "experiments": {"slot-picker": "made-up"}}`)
+			r = httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set(clientIDHeader, "browser-1")
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			var created CreatedAppointment
+			json.Unmarshal(w.Body.Bytes(), &created)
+			if w.Code != http.StatusCreated || created.Experiments.String() != want.String() {
+				t.Fatalf("Expected the booking tagged %v, got %d: %s", want, w.Code, w.Body.String())
+			}
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "No", LastName: "Client", VisitDate: "2075-01-09"}); w.Code != http.StatusCreated || strings.Contains(w.Body.String(), "experiments") {
+				t.Errorf("Expected a booking without a client ID untagged, got %d: %s", w.Code, w.Body.String())
+			}
+
+			r = adminRequest("GET", "/appointments/1/history", nil)
+			r.Header.Set("Accept", "application/xml")
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if !strings.Contains(w.Body.String(), `<experiment name="slot-picker">`+want["slot-picker"]+`</experiment>`) {
+				t.Errorf("Expected the variants in the history, got %s", w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/1/cancel", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected the booking cancelled, got %d: %s", w.Code, w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/admin/reports/experiments", nil))
+			var report ExperimentsReport
+			json.Unmarshal(w.Body.Bytes(), &report)
+			if w.Code != http.StatusOK || len(report.Experiments) != 2 || !report.Experiments[1].Running {
+				t.Fatalf("Expected both experiments reported, got %d: %s", w.Code, w.Body.String())
+			}
+			for _, v := range report.Experiments[1].Variants {
+				if booked := v.Variant == want["slot-picker"]; booked != (v.Bookings == 1 && v.Cancellations == 1) {
+					t.Errorf("Expected the one cancelled booking in %s, got %+v", want["slot-picker"], v)
+				}
+			}
+		})
+	}
+}
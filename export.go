@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /appointments/export streams every appointment, for the nightly
+// warehouse sync (?format=ndjson, the default) or for managers (?format=xlsx).
+// It's everyone's personal details, so it's admin only
+var exportFormats = map[string]struct {
+	contentType string
+	write       func(w io.Writer, flush func() error, rows func(func(Appointment) error) error) error
+}{
+	"ndjson": {"application/x-ndjson", writeNDJSON},
+	"xlsx":   {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", writeXLSX},
+}
+
+func (s *Server) exportAppointments(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	export, ok := exportFormats[format]
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidFormat, "Export format must be 'ndjson' or 'xlsx'")
+		return
+	}
+
+	w.Header().Set("Content-Type", export.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="appointments.`+format+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// No handler timeout here, and the write timeout is moved on with every
+	// row, so only a client that stops reading gets cut off
+	rc := http.NewResponseController(w)
+	flush := func() error {
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+	count := 0
+	rows := func(fn func(Appointment) error) error {
+		return s.store.ForEach(r.Context(), func(appointment Appointment) error {
+			s.extendWriteDeadline(rc)
+			count++
+			return fn(appointment)
+		})
+	}
+
+	if err := export.write(w, flush, rows); err != nil {
+		// Too late for an error status, the client sees a short export
+		log.Printf("%s export stopped after %d appointments: %v", format, count, err)
+		return
+	}
+	log.Printf("Exported %d appointments as %s", count, format)
+}
+
+// One object per line, flushed after each
+func writeNDJSON(w io.Writer, flush func() error, rows func(func(Appointment) error) error) error {
+	enc := json.NewEncoder(w)
+	return rows(func(appointment Appointment) error {
+		if err := enc.Encode(appointment); err != nil {
+			return err
+		}
+		return flush()
+	})
+}
+
+// An export kept in the blob store under exports/, for handing on
+// rather than downloading there and then. It's everyone's details, so
+// it goes after CITYNEXT_EXPORT_TTL
+type StoredExport struct {
+	XMLName   xml.Name   `json:"-" xml:"export"`
+	Name      string     `json:"name" xml:"name"`
+	Format    string     `json:"format" xml:"format"`
+	Count     int        `json:"count" xml:"count"`
+	Size      int64      `json:"size" xml:"size"`
+	CreatedAt time.Time  `json:"createdAt" xml:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" xml:"expiresAt,omitempty"` // none if kept for ever
+}
+
+// What's been stored, so the retention job knows what to delete. Blob
+// stores can't be listed
+func (s *Server) initStoredExportsTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS stored_exports (
+		name TEXT PRIMARY KEY,
+		created_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// Deletes every stored export older than CITYNEXT_EXPORT_TTL, and says
+// how many went. One that won't delete is left listed for the next run
+func (s *Server) deleteExpiredExports(ctx context.Context, now time.Time) (int, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name FROM stored_exports WHERE created_at <= ? ORDER BY created_at", now.Add(-s.cfg.ExportTTL).UTC())
+	if err != nil {
+		return 0, err
+	}
+	var due []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, name := range due {
+		if err := s.blobs.Delete(ctx, "exports/"+name); err != nil {
+			log.Printf("Error deleting export %s, will try again next time: %v", name, err)
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM stored_exports WHERE name = ?", name); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d stored exports older than %s", deleted, s.cfg.ExportTTL)
+	}
+	return deleted, nil
+}
+
+// POST /admin/exports?format=xlsx writes the export to the blob store
+// and says what it's called. It's built in a temp file first, the blob
+// store wants to know the size before it starts
+func (s *Server) storeExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	export, ok := exportFormats[format]
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidFormat, "Export format must be 'ndjson' or 'xlsx'")
+		return
+	}
+
+	f, err := os.CreateTemp("", "citynext-export")
+	if err != nil {
+		log.Printf("Error creating export file: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeExportFailed, "Failed to create the export")
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stored := StoredExport{Format: format, CreatedAt: time.Now().UTC()}
+	stored.Name = fmt.Sprintf("appointments-%s.%s", stored.CreatedAt.Format("20060102T150405Z"), format)
+	rows := func(fn func(Appointment) error) error {
+		return s.store.ForEach(r.Context(), func(appointment Appointment) error {
+			stored.Count++
+			return fn(appointment)
+		})
+	}
+	err = export.write(f, func() error { return nil }, rows)
+	if err == nil {
+		stored.Size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = s.blobs.Put(r.Context(), "exports/"+stored.Name, f, export.contentType)
+	}
+	// Without a database there's nothing to go by, so it's kept
+	if err == nil && s.db != nil {
+		if _, err = s.db.ExecContext(r.Context(), "INSERT INTO stored_exports (name, created_at) VALUES (?, ?)", stored.Name, stored.CreatedAt); err != nil {
+			s.blobs.Delete(context.WithoutCancel(r.Context()), "exports/"+stored.Name)
+		} else if s.cfg.ExportTTL > 0 {
+			expires := stored.CreatedAt.Add(s.cfg.ExportTTL)
+			stored.ExpiresAt = &expires
+		}
+	}
+	if err != nil {
+		log.Printf("Error storing %s export: %v", format, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeExportFailed, "Failed to create the export")
+		return
+	}
+	log.Printf("Stored %d appointments as exports/%s", stored.Count, stored.Name)
+	s.respond(w, r, http.StatusCreated, stored)
+}
+
+// GET /admin/exports/{name}
+func (s *Server) downloadExport(w http.ResponseWriter, r *http.Request) {
+	// The routes only let through names ending in one of exportFormats
+	name := mux.Vars(r)["name"]
+	export := exportFormats[strings.TrimPrefix(filepath.Ext(name), ".")]
+
+	f, err := os.CreateTemp("", "citynext-export")
+	if err != nil {
+		log.Printf("Error creating export file: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeStorageError, "Failed to fetch the export")
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Fetched whole before anything's sent, so a missing one is still a 404
+	if err := s.blobs.Get(r.Context(), "exports/"+name, f); err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No such export")
+			return
+		}
+		log.Printf("Error fetching export %s: %v", name, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeStorageError, "Failed to fetch the export")
+		return
+	}
+	f.Seek(0, io.SeekStart)
+	w.Header().Set("Content-Type", export.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	io.Copy(w, f)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportNDJSON(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.HandlerTimeout = time.Second
+	router := server.routes()
+
+	dates := []string{"2075-02-03", "2075-02-04", "2075-02-05"}
+	for _, date := range dates {
+		postAppointment(t, router, AppointmentRequest{FirstName: "Eli", LastName: "Export", VisitDate: date})
+	}
+
+	r := httptest.NewRequest("GET", "/appointments/export?format=ndjson", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected an NDJSON 200, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	// Only true if it went out row by row rather than from the timeout buffer
+	if !w.Flushed {
+		t.Error("Expected the export to be flushed as it streamed")
+	}
+
+	scanner := bufio.NewScanner(w.Body)
+	var got []string
+	for scanner.Scan() {
+		var appointment Appointment
+		if err := json.Unmarshal(scanner.Bytes(), &appointment); err != nil {
+			t.Fatalf("Bad NDJSON line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, appointment.VisitDate)
+	}
+	if len(got) != len(dates) || got[0] != dates[0] {
+		t.Errorf("Expected %v in ID order, got %v", dates, got)
+	}
+}
+
+func TestExportNeedsAdmin(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, httptest.NewRequest("GET", "/appointments/export", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+}
+
+func TestExportXLSX(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.NameCharacters = NameCharactersAny // for names that need escaping
+	router := server.routes()
+	postAppointment(t, router, AppointmentRequest{FirstName: "Mo & Jo", LastName: "<Sheet>", VisitDate: "2075-02-03"})
+
+	r := httptest.NewRequest("GET", "/appointments/export?format=xlsx", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Expected a zip, got %v", err)
+	}
+	parts := map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(b)
+
+		// Every part has to be well formed or Excel refuses the lot
+		dec := xml.NewDecoder(bytes.NewReader(b))
+		for {
+			if _, err := dec.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s is not valid XML: %v", f.Name, err)
+			}
+		}
+	}
+
+	sheet, ok := parts["xl/worksheets/sheet1.xml"]
+	if !ok || parts["[Content_Types].xml"] == "" || parts["xl/styles.xml"] == "" {
+		t.Fatalf("Missing parts, got %d", len(parts))
+	}
+	for _, want := range []string{`state="frozen"`, "Mo &amp; Jo", "&lt;Sheet&gt;", `<c s="2"><v>63953</v></c>`} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("Expected sheet to contain %s", want)
+		}
+	}
+}
+
+func TestStoredExport(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	dir := t.TempDir()
+	server.blobs = dirBlobs{dir: dir}
+	server.cfg.ExportTTL = 7 * 24 * time.Hour
+	router := server.routes()
+
+	for _, date := range []string{"2075-02-03", "2075-02-04"} {
+		postAppointment(t, router, AppointmentRequest{FirstName: "Eli", LastName: "Export", VisitDate: date})
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/exports?format=ndjson", nil))
+	var stored StoredExport
+	if json.Unmarshal(w.Body.Bytes(), &stored); w.Code != http.StatusCreated || stored.Count != 2 {
+		t.Fatalf("Expected a stored export of 2, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/exports/"+stored.Name, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" || int64(w.Body.Len()) != stored.Size {
+		t.Fatalf("Expected the export back, got %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 2 {
+		t.Errorf("Expected 2 lines, got %d", lines)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/exports/appointments-20750101T000000Z.xlsx", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an export that isn't there, got %d", w.Code)
+	}
+
+	// And it goes once its week is up
+	if stored.ExpiresAt == nil || !stored.ExpiresAt.Equal(stored.CreatedAt.Add(server.cfg.ExportTTL)) {
+		t.Errorf("Expected it to expire in a week, got %v", stored.ExpiresAt)
+	}
+	if n, err := server.deleteExpiredExports(context.Background(), time.Now()); err != nil || n != 0 {
+		t.Errorf("Expected nothing deleted yet, got %d (%v)", n, err)
+	}
+	if n, err := server.deleteExpiredExports(context.Background(), time.Now().Add(8*24*time.Hour)); err != nil || n != 1 {
+		t.Errorf("Expected the export deleted after a week, got %d (%v)", n, err)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/exports/"+stored.Name, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 once it's expired, got %d", w.Code)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Newer, riskier behaviour that each environment can switch on or off
+// without a redeploy. Kept in name order. CITYNEXT_FEATURES sets the starting point, e.g.
+// "overbooking=off,walk-ins=on", and PUT /admin/features/{name} flips
+// one while running. Flips are kept in the database so they survive a
+// restart, and win over the environment until they're reset. Each
+// replica reads them again every featureFlagsRefresh, so a flip on one
+// reaches the rest within that
+const featureFlagsRefresh = 10 * time.Second
+
+var featureDefaults = []struct {
+	name, description string
+	enabled           bool
+}{
+	{"overbooking", "Take bookings past capacity on the days in CITYNEXT_OVERBOOKING", true},
+	{"waiting-room", "Public bookings queue at /waiting-room and are let in CITYNEXT_ADMISSION_RATE a second", false},
+	{"walk-ins", "Staff book people in for today at /admin/walk-ins", true},
+}
+
+type Feature struct {
+	XMLName     xml.Name   `json:"-" xml:"feature"`
+	Name        string     `json:"name" xml:"name,attr"`
+	Description string     `json:"description" xml:"description"`
+	Enabled     bool       `json:"enabled" xml:"enabled"`
+	Source      string     `json:"source" xml:"source"` // default, environment or admin
+	ChangedBy   string     `json:"changedBy,omitempty" xml:"changedBy,omitempty"`
+	ChangedAt   *time.Time `json:"changedAt,omitempty" xml:"changedAt,omitempty"`
+}
+
+type FeatureList struct {
+	XMLName  xml.Name  `json:"-" xml:"features"`
+	Features []Feature `json:"features" xml:"feature"`
+}
+
+// What admins have flipped, over what the environment says
+type featureFlags struct {
+	mu        sync.RWMutex
+	overrides map[string]Feature
+	checkedAt time.Time // when they were last read, see due
+}
+
+func newFeatureFlags() *featureFlags {
+	return &featureFlags{overrides: make(map[string]Feature)}
+}
+
+// Whether it's time to read the flips again. Only the first to ask each
+// featureFlagsRefresh gets a yes, so it's one query however busy it is
+func (f *featureFlags) due() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checkedAt) < featureFlagsRefresh {
+		return false
+	}
+	f.checkedAt = time.Now()
+	return true
+}
+
+func isFeature(name string) bool {
+	for _, f := range featureDefaults {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// "overbooking=off,walk-ins=on" into on or off by feature
+func envFeatures(key string) map[string]bool {
+	enabled := map[string]bool{}
+	for name, values := range envMap(key) {
+		name = strings.ToLower(name)
+		on, ok := map[string]bool{"on": true, "true": true, "off": false, "false": false}[strings.ToLower(values[0])]
+		if !isFeature(name) || !ok {
+			log.Printf("Ignoring %s entry %s=%s, expected e.g. overbooking=off", key, name, values[0])
+			continue
+		}
+		enabled[name] = on
+	}
+	return enabled
+}
+
+func (s *Server) feature(name string) Feature {
+	// What another replica flipped. If the database can't say, what's
+	// already loaded will do
+	if s.db != nil && s.features.due() {
+		ctx, cancel := withTimeout(context.Background(), s.cfg.DBTimeout)
+		if err := s.loadFeatureFlags(ctx); err != nil {
+			log.Printf("Error loading feature flags: %v", err)
+		}
+		cancel()
+	}
+
+	s.features.mu.RLock()
+	override, ok := s.features.overrides[name]
+	s.features.mu.RUnlock()
+
+	for _, f := range featureDefaults {
+		if f.name != name {
+			continue
+		}
+		if ok {
+			override.Description = f.description
+			return override
+		}
+		if on, ok := s.live().Features[name]; ok {
+			return Feature{Name: name, Description: f.description, Enabled: on, Source: "environment"}
+		}
+		return Feature{Name: name, Description: f.description, Enabled: f.enabled, Source: "default"}
+	}
+	return Feature{Name: name}
+}
+
+func (s *Server) featureEnabled(name string) bool {
+	return s.feature(name).Enabled
+}
+
+// Send a 404 and return false when the feature is off, so switched off
+// looks the same as never having been there
+func (s *Server) requireFeature(w http.ResponseWriter, r *http.Request, name string) bool {
+	if s.featureEnabled(name) {
+		return true
+	}
+	s.sendErrorResponse(w, r, http.StatusNotFound, CodeFeatureDisabled, "That isn't available here")
+	return false
+}
+
+func (s *Server) initFeatureFlags() error {
+	if _, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT PRIMARY KEY,
+		enabled BOOLEAN NOT NULL,
+		changed_by TEXT NOT NULL,
+		changed_at DATETIME NOT NULL
+	)`); err != nil {
+		return err
+	}
+	s.features.due()
+	return s.loadFeatureFlags(context.Background())
+}
+
+// All of them at once, so one reset elsewhere goes here too
+func (s *Server) loadFeatureFlags(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, enabled, changed_by, changed_at FROM feature_flags")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]Feature)
+	for rows.Next() {
+		f := Feature{Source: "admin"}
+		var changedAt time.Time
+		if err := rows.Scan(&f.Name, &f.Enabled, &f.ChangedBy, &changedAt); err != nil {
+			return err
+		}
+		if !isFeature(f.Name) {
+			continue // one that's since been taken out
+		}
+		f.ChangedAt = &changedAt
+		overrides[f.Name] = f
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.features.mu.Lock()
+	s.features.overrides = overrides
+	s.features.mu.Unlock()
+	return nil
+}
+
+// GET /admin/features
+func (s *Server) listFeatures(w http.ResponseWriter, r *http.Request) {
+	list := FeatureList{Features: []Feature{}}
+	for _, f := range featureDefaults {
+		list.Features = append(list.Features, s.feature(f.name))
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
+
+// PUT /admin/features/{name} with {"enabled": false}, or DELETE to go
+// back to what the environment says
+func (s *Server) setFeature(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !isFeature(name) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownFeature, "No feature by that name")
+		return
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+			return
+		}
+		if req.Enabled == nil {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "Enabled is required")
+			return
+		}
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	var err error
+	if s.db != nil && req.Enabled == nil {
+		_, err = s.db.ExecContext(ctx, "DELETE FROM feature_flags WHERE name = ?", name)
+	} else if s.db != nil {
+		_, err = s.db.ExecContext(ctx, `
+			INSERT INTO feature_flags (name, enabled, changed_by, changed_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET enabled = excluded.enabled, changed_by = excluded.changed_by, changed_at = excluded.changed_at`,
+			name, *req.Enabled, actorFrom(r.Context()), now)
+	}
+	if err != nil {
+		log.Printf("Error saving feature %s: %v", name, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to save the feature")
+		return
+	}
+
+	s.features.mu.Lock()
+	if req.Enabled == nil {
+		delete(s.features.overrides, name)
+	} else {
+		s.features.overrides[name] = Feature{Name: name, Enabled: *req.Enabled, Source: "admin", ChangedBy: actorFrom(r.Context()), ChangedAt: &now}
+	}
+	s.features.mu.Unlock()
+
+	feature := s.feature(name)
+	log.Printf("Feature %s is now %s (%s, by %s)", name, map[bool]string{true: "on", false: "off"}[feature.Enabled], feature.Source, actorFrom(r.Context()))
+	s.respond(w, r, http.StatusOK, feature)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 10
+	server.cfg.Overbooking = map[time.Weekday]int{time.Monday: 10}
+	server.cfg.Features = map[string]bool{"walk-ins": false}
+	router := server.routes()
+	monday, _ := time.Parse("2006-01-02", "2075-06-17")
+
+	if server.capacityOn(monday) != 11 || server.featureEnabled("walk-ins") {
+		t.Fatal("Expected overbooking on by default and walk-ins off from the environment")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/walk-ins", []byte(`{"firstName":"Walk","lastName":"In"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with walk-ins off, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("PUT", "/admin/features/overbooking", []byte(`{"enabled":false}`)))
+	var feature Feature
+	json.Unmarshal(w.Body.Bytes(), &feature)
+	if w.Code != http.StatusOK || feature.Enabled || feature.Source != "admin" || feature.ChangedBy != ActorAdmin {
+		t.Fatalf("Expected overbooking switched off, got %d: %s", w.Code, w.Body.String())
+	}
+	if server.capacityOn(monday) != 10 {
+		t.Error("Expected no overbooking once it's off")
+	}
+
+	// Survives a restart on the same database
+	restarted := NewServer(server.db)
+	if err := restarted.initDB(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.featureEnabled("overbooking") {
+		t.Error("Expected the flip to be kept in the database")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/admin/features/overbooking", nil))
+	if w.Code != http.StatusOK || !server.featureEnabled("overbooking") {
+		t.Errorf("Expected overbooking back to its default, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The other replica has it too, once it's read them again
+	if restarted.featureEnabled("overbooking") {
+		t.Error("Expected the other replica to go by what it read until it's due")
+	}
+	restarted.features.checkedAt = time.Now().Add(-featureFlagsRefresh)
+	if !restarted.featureEnabled("overbooking") {
+		t.Error("Expected the reset to reach the other replica")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/features", nil))
+	if !strings.Contains(w.Body.String(), `"name":"walk-ins","description":"Staff book people in for today at /admin/walk-ins","enabled":false,"source":"environment"`) {
+		t.Errorf("Expected walk-ins listed as off from the environment, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("PUT", "/admin/features/time-slots", []byte(`{"enabled":true}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown feature, got %d", w.Code)
+	}
+}
+
+func TestEnvFeatures(t *testing.T) {
+	t.Setenv("CITYNEXT_FEATURES", "overbooking=off,Walk-Ins=on,waitlist=on")
+	got := envFeatures("CITYNEXT_FEATURES")
+	if len(got) != 2 || got["overbooking"] || !got["walk-ins"] {
+		t.Errorf("Expected overbooking off and walk-ins on, got %v", got)
+	}
+}
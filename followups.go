@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Staff can book a visit as a follow-up of an earlier one with
+// "followUpOf", and a clone is one of the booking it was cloned from.
+// CITYNEXT_FOLLOW_UP_GAP_DAYS says how long after the earlier visit a
+// follow-up for each service can be, e.g. "passports=28", and every
+// other service's has to be on a later day. The gap's kept to when
+// either of them is moved, and the whole chain comes back with
+// GET /appointments/{id}
+type FollowUpTooSoon struct {
+	XMLName      xml.Name `json:"-" xml:"errorResponse"`
+	Error        string   `json:"error" xml:"error"`
+	Message      string   `json:"message" xml:"message"`
+	FollowUpOf   int      `json:"followUpOf" xml:"followUpOf"`
+	EarliestDate string   `json:"earliestDate" xml:"earliestDate"` // for the follow-up
+}
+
+type ChainVisit struct {
+	XMLName    xml.Name `json:"-" xml:"visit"`
+	ID         int      `json:"id" xml:"id,attr"`
+	VisitDate  string   `json:"visitDate" xml:"visitDate"`
+	Service    string   `json:"service,omitempty" xml:"service,omitempty"`
+	FollowUpOf int      `json:"followUpOf,omitempty" xml:"followUpOf,omitempty"`
+	Status     string   `json:"status" xml:"status"` // booked, checked_in or cancelled
+}
+
+type AppointmentWithChain struct {
+	Appointment
+	Chain []ChainVisit `json:"chain" xml:"chain>visit"` // every visit it's linked to, itself included, by visit date
+}
+
+func encodeFollowUpOf(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// The earliest a follow-up for service can be after a visit on day
+func (s *Server) earliestFollowUp(day time.Time, service string) time.Time {
+	gap, ok := s.live().FollowUpGaps[service]
+	if !ok {
+		gap = 1
+	}
+	return day.AddDate(0, 0, gap)
+}
+
+func (s *Server) sendFollowUpTooSoon(w http.ResponseWriter, r *http.Request, followUpOf int, earliest time.Time, message string) {
+	s.countRejection(r, http.StatusBadRequest, CodeFollowUpTooSoon)
+	s.respond(w, r, http.StatusBadRequest, FollowUpTooSoon{
+		Error:        CodeFollowUpTooSoon,
+		Message:      message,
+		FollowUpOf:   followUpOf,
+		EarliestDate: earliest.Format("2006-01-02"),
+	})
+}
+
+// For a booking with followUpOf: staff only, onto a current booking,
+// and far enough after it
+func (s *Server) validateFollowUp(w http.ResponseWriter, r *http.Request, req AppointmentRequest, visitDate time.Time) bool {
+	if req.FollowUpOf == 0 {
+		return true
+	}
+	if channelOrOnline(req.Channel) == ChannelOnline {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodeFollowUpStaffOnly, "Only staff can book a follow-up")
+		return false
+	}
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+	parent, err := s.store.Get(ctx, req.FollowUpOf)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownFollowUp, fmt.Sprintf("There's no current appointment %d to follow up", req.FollowUpOf))
+		return false
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d to follow up: %v", req.FollowUpOf, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+		return false
+	}
+	return s.checkFollowUpGap(w, r, parent, req.Service, visitDate)
+}
+
+func (s *Server) checkFollowUpGap(w http.ResponseWriter, r *http.Request, parent Appointment, service string, visitDate time.Time) bool {
+	parentDate, err := time.Parse("2006-01-02", parent.VisitDate)
+	if err != nil {
+		return true
+	}
+	if earliest := s.earliestFollowUp(parentDate, service); visitDate.Before(earliest) {
+		s.sendFollowUpTooSoon(w, r, parent.ID, earliest, fmt.Sprintf("A follow-up to %d can't be before %s", parent.ID, earliest.Format("2006-01-02")))
+		return false
+	}
+	return true
+}
+
+// Before moving a booking to visitDate, or onto service: it still has to
+// be far enough after the visit it follows, and the ones following it
+// far enough after it. A visit that's been cancelled doesn't hold
+// anything up
+func (s *Server) checkChainGaps(ctx context.Context, w http.ResponseWriter, r *http.Request, appointment Appointment, service string, visitDate time.Time) bool {
+	if appointment.FollowUpOf != 0 {
+		parent, err := s.store.Get(ctx, appointment.FollowUpOf)
+		if err == nil && !s.checkFollowUpGap(w, r, parent, service, visitDate) {
+			return false
+		}
+		if err != nil && !errors.Is(err, ErrAppointmentNotFound) {
+			log.Printf("Error loading appointment %d it follows: %v", appointment.FollowUpOf, err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+			return false
+		}
+	}
+	current, err := s.store.List(ctx, time.Time{})
+	if err != nil {
+		log.Printf("Error loading follow-ups of %d: %v", appointment.ID, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+		return false
+	}
+	for _, next := range current {
+		if next.FollowUpOf != appointment.ID {
+			continue
+		}
+		if earliest := s.earliestFollowUp(visitDate, next.Service); next.VisitDate < earliest.Format("2006-01-02") {
+			s.sendFollowUpTooSoon(w, r, appointment.ID, earliest, fmt.Sprintf("Appointment %d follows this one on %s, it can't be moved that close", next.ID, next.VisitDate))
+			return false
+		}
+	}
+	return true
+}
+
+// Everything linked to id both ways, from the latest version of every
+// booking there's been, so cancelled visits are still in the story
+func followUpChain(revisions []Revision, id int) []ChainVisit {
+	latest := map[int]Revision{}
+	for _, rev := range revisions {
+		latest[rev.ID] = rev
+	}
+	root := id
+	for seen := map[int]bool{}; latest[root].FollowUpOf != 0 && !seen[root]; {
+		seen[root] = true
+		root = latest[root].FollowUpOf
+	}
+	children := map[int][]int{}
+	for _, rev := range latest {
+		if rev.FollowUpOf != 0 {
+			children[rev.FollowUpOf] = append(children[rev.FollowUpOf], rev.ID)
+		}
+	}
+
+	chain := []ChainVisit{}
+	seen := map[int]bool{}
+	for queue := []int{root}; len(queue) > 0; queue = queue[1:] {
+		rev, ok := latest[queue[0]]
+		if !ok || seen[rev.ID] {
+			continue
+		}
+		seen[rev.ID] = true
+		visit := ChainVisit{ID: rev.ID, VisitDate: rev.VisitDate, Service: rev.Service, FollowUpOf: rev.FollowUpOf, Status: "booked"}
+		switch {
+		case rev.Change == RevisionCancelled:
+			visit.Status = "cancelled"
+		case rev.CheckedInAt != nil:
+			visit.Status = "checked_in"
+		}
+		chain = append(chain, visit)
+		queue = append(queue, children[rev.ID]...)
+	}
+	sort.Slice(chain, func(i, j int) bool {
+		if chain[i].VisitDate != chain[j].VisitDate {
+			return chain[i].VisitDate < chain[j].VisitDate
+		}
+		return chain[i].ID < chain[j].ID
+	})
+	return chain
+}
+
+// GET /appointments/{id} (admin), with the visits before and after it
+func (s *Server) getAppointment(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	appointment, err := s.store.Get(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+		return
+	}
+	revisions, err := s.store.Revisions(ctx)
+	if err != nil {
+		log.Printf("Error loading the follow-ups of %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+		return
+	}
+	s.respond(w, r, http.StatusOK, AppointmentWithChain{Appointment: appointment, Chain: followUpChain(revisions, id)})
+}
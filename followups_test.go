@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFollowUps(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, _ := closureServer(t, store)
+			server.cfg.FollowUpGaps = map[string]int{"general": 7}
+			router := server.routes()
+
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Ffion", LastName: "First", VisitDate: "2075-01-09"}); w.Code != http.StatusCreated {
+				t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+			}
+			staff := func(method, path, body string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest(method, path, []byte(body)))
+				return w
+			}
+			followUp := func(of int, visitDate string) *httptest.ResponseRecorder {
+				return staff("POST", "/admin/appointments", fmt.Sprintf(`{"firstName": "Ffion", "lastName": "First", "visitDate": %q, "followUpOf": %d}`, visitDate, of))
+			}
+
+			// A week after, for general
+			w := followUp(1, "2075-01-15")
+			var tooSoon FollowUpTooSoon
+			json.Unmarshal(w.Body.Bytes(), &tooSoon)
+			if w.Code != http.StatusBadRequest || tooSoon.Error != "follow_up_too_soon" || tooSoon.EarliestDate != "2075-01-16" {
+				t.Errorf("Expected a follow-up six days later refused, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := followUp(99, "2075-01-16"); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected a follow-up to nothing refused, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Ffion", LastName: "First", VisitDate: "2075-01-16", FollowUpOf: 1}); w.Code != http.StatusForbidden {
+				t.Errorf("Expected the public turned away from follow-ups, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := followUp(1, "2075-01-16"); w.Code != http.StatusCreated {
+				t.Fatalf("Expected a follow-up, got %d: %s", w.Code, w.Body.String())
+			}
+			// A clone follows on from the one it's cloned from
+			if w := staff("POST", "/appointments/2/clone?visitDate=2075-01-23", ""); w.Code != http.StatusCreated {
+				t.Fatalf("Expected a clone, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// Moving either end can't close the gap
+			if w := staff("POST", "/admin/appointments/1/reschedule", `{"visitDate": "2075-01-10"}`); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected the first visit kept a week before the next, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := staff("POST", "/admin/appointments/3/reschedule", `{"visitDate": "2075-01-20"}`); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected the clone kept a week after, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := staff("POST", "/admin/appointments/1/reschedule", `{"visitDate": "2075-01-08"}`); w.Code != http.StatusOK {
+				t.Errorf("Expected the first visit moved earlier, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := staff("POST", "/admin/appointments/3/cancel", ""); w.Code != http.StatusOK {
+				t.Fatalf("Expected the clone cancelled, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// The whole chain from the middle, in order, cancelled one included
+			w = staff("GET", "/appointments/2", "")
+			var got AppointmentWithChain
+			json.Unmarshal(w.Body.Bytes(), &got)
+			if w.Code != http.StatusOK || got.ID != 2 || got.FollowUpOf != 1 || len(got.Chain) != 3 {
+				t.Fatalf("Expected the follow-up with its chain, got %d: %s", w.Code, w.Body.String())
+			}
+			for i, want := range []ChainVisit{{ID: 1, VisitDate: "2075-01-08", Status: "booked"}, {ID: 2, VisitDate: "2075-01-16", FollowUpOf: 1, Status: "booked"}, {ID: 3, VisitDate: "2075-01-23", FollowUpOf: 2, Status: "cancelled"}} {
+				if c := got.Chain[i]; c.ID != want.ID || c.VisitDate != want.VisitDate || c.FollowUpOf != want.FollowUpOf || c.Status != want.Status {
+					t.Errorf("Expected %+v at %d in the chain, got %+v", want, i, c)
+				}
+			}
+			if w := staff("GET", "/appointments/3", ""); w.Code != http.StatusNotFound {
+				t.Errorf("Expected a cancelled one not found, got %d", w.Code)
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/appointments/2", nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected the public turned away, got %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GOV.UK Notify, which councils are being moved on to, for email, texts
+// and letters. Notify sends from its own templates, so each one we use
+// just has ((subject)) and ((body)) in it and we fill them in with what
+// we've rendered from templates/ as usual
+const defaultNotifyURL = "https://api.notifications.service.gov.uk"
+
+type NotifyConfig struct {
+	APIKey         string // from the Notify dashboard, <name>-<service ID>-<secret>
+	URL            string
+	EmailTemplate  string // template IDs, one for each way of sending
+	SMSTemplate    string
+	LetterTemplate string
+	EmailReplyTo   string // the reply-to address's ID in Notify, its default if empty
+}
+
+type NotifyClient struct {
+	cfg       NotifyConfig
+	serviceID string
+	secret    string
+	http      *http.Client
+}
+
+// The key ends with two UUIDs, the service's and the secret, and the
+// name in front of them can have dashes in it too
+func NewNotifyClient(cfg NotifyConfig) (*NotifyClient, error) {
+	const uuidLen = 36
+	key := cfg.APIKey
+	if len(key) < 2*uuidLen+2 || key[len(key)-uuidLen-1] != '-' || key[len(key)-2*uuidLen-2] != '-' {
+		return nil, errors.New("the Notify API key should be <name>-<service ID>-<secret>")
+	}
+	return &NotifyClient{
+		cfg:       cfg,
+		serviceID: key[len(key)-2*uuidLen-1 : len(key)-uuidLen-1],
+		secret:    key[len(key)-uuidLen:],
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Notify wants a fresh HS256 JWT on every request, from the service ID
+// and signed with the secret. It's only good for 30 seconds either way
+func (c *NotifyClient) token(now time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + c.serviceID + `","iat":` + strconv.FormatInt(now.Unix(), 10) + `}`))
+	mac := hmac.New(sha256.New, []byte(c.secret))
+	mac.Write([]byte(header + "." + claims))
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// What Notify says when it won't
+type notifyErrors struct {
+	StatusCode int `json:"status_code"`
+	Errors     []struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// POST /v2/notifications/email, sms or letter
+func (c *NotifyClient) send(ctx context.Context, kind string, body map[string]any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(cmp.Or(c.cfg.URL, defaultNotifyURL), "/") + "/v2/notifications/" + kind
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token(time.Now()))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach Notify: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var failed notifyErrors
+	json.NewDecoder(resp.Body).Decode(&failed)
+	var messages []string
+	for _, e := range failed.Errors {
+		messages = append(messages, e.Error+": "+e.Message)
+	}
+	return fmt.Errorf("Notify refused the %s with %d: %s", kind, resp.StatusCode, strings.Join(messages, "; "))
+}
+
+// Our reference on it in Notify is the trace it went out on, so a
+// message in their dashboard can be found in our logs
+func withReference(body map[string]any, msg Message) map[string]any {
+	if tc, ok := parseTraceparent(msg.TraceParent); ok {
+		body["reference"] = tc.TraceID
+	}
+	return body
+}
+
+type notifyEmail struct{ client *NotifyClient }
+
+func (n notifyEmail) Send(ctx context.Context, msg Message) error {
+	body := map[string]any{
+		"email_address":   msg.To,
+		"template_id":     n.client.cfg.EmailTemplate,
+		"personalisation": map[string]string{"subject": msg.Subject, "body": msg.Text},
+	}
+	if n.client.cfg.EmailReplyTo != "" {
+		body["email_reply_to_id"] = n.client.cfg.EmailReplyTo
+	}
+	return n.client.send(ctx, "email", withReference(body, msg))
+}
+
+// To is the phone number
+type notifySMS struct{ client *NotifyClient }
+
+func (n notifySMS) Send(ctx context.Context, msg Message) error {
+	return n.client.send(ctx, "sms", withReference(map[string]any{
+		"phone_number":    msg.To,
+		"template_id":     n.client.cfg.SMSTemplate,
+		"personalisation": map[string]string{"body": msg.Text},
+	}, msg))
+}
+
+// To is the postal address, a line at a time with the postcode last.
+// Notify wants three to seven lines
+type notifyLetter struct{ client *NotifyClient }
+
+func (n notifyLetter) Send(ctx context.Context, msg Message) error {
+	var lines []string
+	for line := range strings.SplitSeq(msg.To, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 3 || len(lines) > 7 {
+		return fmt.Errorf("a letter needs an address of 3 to 7 lines, not %d", len(lines))
+	}
+	personalisation := map[string]string{"subject": msg.Subject, "body": msg.Text}
+	for i, line := range lines {
+		personalisation["address_line_"+strconv.Itoa(i+1)] = line
+	}
+	return n.client.send(ctx, "letter", withReference(map[string]any{
+		"template_id":     n.client.cfg.LetterTemplate,
+		"personalisation": personalisation,
+	}, msg))
+}
+
+// What sends each way of reaching someone, by CITYNEXT_NOTIFIER. Texts
+// and letters are nil unless Notify has a template for them
+func newNotifiers(cfg Config) (email, texts, letters Notifier, err error) {
+	switch cfg.Notifier {
+	case "", "log":
+		return LogNotifier{}, nil, nil, nil
+	case "govuk-notify":
+		client, err := NewNotifyClient(cfg.Notify)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if cfg.Notify.EmailTemplate == "" {
+			return nil, nil, nil, errors.New("GOV.UK Notify needs CITYNEXT_NOTIFY_EMAIL_TEMPLATE")
+		}
+		email = notifyEmail{client}
+		if cfg.Notify.SMSTemplate != "" {
+			texts = notifySMS{client}
+		}
+		if cfg.Notify.LetterTemplate != "" {
+			letters = notifyLetter{client}
+		}
+		return email, texts, letters, nil
+	}
+	return nil, nil, nil, fmt.Errorf("CITYNEXT_NOTIFIER %q should be log or govuk-notify", cfg.Notifier)
+}
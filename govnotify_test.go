@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testNotifyService = "26785a09-ab16-4eb0-8407-a37497a57506"
+	testNotifySecret  = "3d844edf-8d35-48ac-975b-e847b4f122b0"
+)
+
+// Checks the token the way Notify does and keeps what was sent
+func fakeNotify(t *testing.T, sent map[string]map[string]any) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(token, ".")
+		mac := hmac.New(sha256.New, []byte(testNotifySecret))
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var c struct{ Iss string }
+		json.Unmarshal(claims, &c)
+		if len(parts) != 3 || base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != parts[2] || c.Iss != testNotifyService {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"status_code": 403, "errors": [{"error": "AuthError", "message": "Invalid token: signature, api token not found"}]}`))
+			return
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["template_id"] == "missing" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status_code": 400, "errors": [{"error": "BadRequestError", "message": "Template not found"}]}`))
+			return
+		}
+		sent[strings.TrimPrefix(r.URL.Path, "/v2/notifications/")] = body
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "740e5834-3a29-46b4-9a6f-16142fde533a"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGovNotify(t *testing.T) {
+	sent := map[string]map[string]any{}
+	notify := fakeNotify(t, sent)
+
+	server := setupTestServer(t)
+	server.cfg.Notifier = "govuk-notify"
+	server.cfg.Notify = NotifyConfig{
+		APIKey:         "city-next-" + testNotifyService + "-" + testNotifySecret,
+		URL:            notify.URL,
+		EmailTemplate:  "email-template",
+		SMSTemplate:    "sms-template",
+		LetterTemplate: "letter-template",
+	}
+	var err error
+	if server.notifier, server.texts, server.letters, err = newNotifiers(server.cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withTrace(context.Background(), newTrace())
+	for channel, to := range map[string]string{ChannelEmail: "dana@example.com", ChannelSMS: "07700900123", ChannelLetter: "Dana Jones\n1 High Street\nCardiff\nCF10 1AA"} {
+		if err := server.send(ctx, channel, Message{To: to, Subject: "Your appointment", Text: "See you on the 9th"}); err != nil {
+			t.Errorf("Expected the %s sent, got %v", channel, err)
+		}
+	}
+	email, sms, letter := sent["email"], sent["sms"], sent["letter"]
+	if email["email_address"] != "dana@example.com" || email["template_id"] != "email-template" || email["personalisation"].(map[string]any)["subject"] != "Your appointment" {
+		t.Errorf("Expected the email filled in, got %+v", email)
+	}
+	if tc, _ := traceFrom(ctx); email["reference"] != tc.TraceID {
+		t.Errorf("Expected the trace as the reference, got %+v", email)
+	}
+	if sms["phone_number"] != "07700900123" || sms["personalisation"].(map[string]any)["body"] != "See you on the 9th" {
+		t.Errorf("Expected the text filled in, got %+v", sms)
+	}
+	if p := letter["personalisation"].(map[string]any); p["address_line_1"] != "Dana Jones" || p["address_line_4"] != "CF10 1AA" {
+		t.Errorf("Expected the address a line at a time, got %+v", letter)
+	}
+
+	if err := server.send(ctx, ChannelLetter, Message{To: "Nowhere", Text: "x"}); err == nil {
+		t.Errorf("Expected a one line address refused")
+	}
+	server.notifier = notifyEmail{&NotifyClient{cfg: NotifyConfig{URL: notify.URL, EmailTemplate: "missing"}, serviceID: testNotifyService, secret: testNotifySecret, http: http.DefaultClient}}
+	if err := server.send(ctx, ChannelEmail, Message{To: "dana@example.com"}); err == nil || !strings.Contains(err.Error(), "Template not found") {
+		t.Errorf("Expected Notify's reason in the error, got %v", err)
+	}
+	server.notifier = notifyEmail{&NotifyClient{cfg: NotifyConfig{URL: notify.URL}, serviceID: testNotifyService, secret: "wrong", http: http.DefaultClient}}
+	if err := server.send(ctx, ChannelEmail, Message{To: "dana@example.com"}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected a bad key refused, got %v", err)
+	}
+
+	// Without a template there's nothing to send texts with
+	server.cfg.Notify.SMSTemplate = ""
+	_, server.texts, _, _ = newNotifiers(server.cfg)
+	if err := server.send(ctx, ChannelSMS, Message{To: "07700900123"}); err == nil {
+		t.Errorf("Expected no texts without a template")
+	}
+}
+
+func TestNotifierConfig(t *testing.T) {
+	key := "citynext-" + testNotifyService + "-" + testNotifySecret
+	for _, c := range []struct {
+		notifier string
+		notify   NotifyConfig
+		ok       bool
+	}{
+		{"log", NotifyConfig{}, true},
+		{"govuk-notify", NotifyConfig{APIKey: key, EmailTemplate: "t"}, true},
+		{"govuk-notify", NotifyConfig{APIKey: key}, false},
+		{"govuk-notify", NotifyConfig{APIKey: "not-a-key", EmailTemplate: "t"}, false},
+		{"smtp", NotifyConfig{}, false},
+	} {
+		if _, _, _, err := newNotifiers(Config{Notifier: c.notifier, Notify: c.notify}); (err == nil) != c.ok {
+			t.Errorf("Expected %s with %+v to be ok %v, got %v", c.notifier, c.notify, c.ok, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outside services, as labelled in metrics and /readyz
+const (
+	DependencyHolidayAPI = "holiday_api"
+	DependencyEmail      = "email"
+	DependencySMS        = "sms"
+	DependencyLetters    = "letters"
+	DependencyPostcodes  = "postcode_lookup"
+	DependencyAnalytics  = "analytics"
+)
+
+// How many of the latest calls to a dependency decide whether it's
+// degraded, and how many of those can fail before it is
+const (
+	healthWindow     = 20
+	degradedFailures = 5
+)
+
+type DependencyStatus struct {
+	XMLName     xml.Name   `json:"-" xml:"dependency"`
+	Name        string     `json:"name" xml:"name,attr"`
+	Status      string     `json:"status" xml:"status"`     // ok or degraded
+	Failures    int        `json:"failures" xml:"failures"` // of the last Calls
+	Calls       int        `json:"calls" xml:"calls"`       // up to healthWindow
+	LastError   string     `json:"lastError,omitempty" xml:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty" xml:"lastErrorAt,omitempty"`
+}
+
+type Readiness struct {
+	XMLName      xml.Name           `json:"-" xml:"readiness"`
+	Status       string             `json:"status" xml:"status"` // ready, degraded or unavailable
+	Database     string             `json:"database" xml:"database"`
+	Dependencies []DependencyStatus `json:"dependencies" xml:"dependencies>dependency"`
+	Integrity    *IntegrityCheck    `json:"integrity,omitempty" xml:"integrity,omitempty"`
+}
+
+type dependencyHealth struct {
+	mu   sync.Mutex
+	deps map[string]*dependencyCalls
+}
+
+type dependencyCalls struct {
+	outcomes    []bool // true for a failure, the latest last
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func newDependencyHealth() *dependencyHealth {
+	return &dependencyHealth{deps: make(map[string]*dependencyCalls)}
+}
+
+// Call with when the call started and how it went, for the metrics and
+// /readyz
+func (s *Server) observeDependency(name string, start time.Time, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	s.metrics.inc("citynext_dependency_requests_total", name, outcome)
+	s.metrics.observe("citynext_dependency_duration_seconds", time.Since(start).Seconds(), name)
+
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	calls, ok := s.health.deps[name]
+	if !ok {
+		calls = &dependencyCalls{}
+		s.health.deps[name] = calls
+	}
+	calls.outcomes = append(calls.outcomes, err != nil)
+	if len(calls.outcomes) > healthWindow {
+		calls.outcomes = calls.outcomes[1:]
+	}
+	if err != nil {
+		calls.lastError, calls.lastErrorAt = err.Error(), time.Now().UTC()
+	}
+}
+
+func (s *Server) dependencyStatuses() []DependencyStatus {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+
+	statuses := []DependencyStatus{}
+	for name, calls := range s.health.deps {
+		status := DependencyStatus{Name: name, Status: "ok", Calls: len(calls.outcomes)}
+		for _, failed := range calls.outcomes {
+			if failed {
+				status.Failures++
+			}
+		}
+		if status.Failures >= min(degradedFailures, status.Calls) && status.Failures > 0 {
+			status.Status = "degraded"
+		}
+		if calls.lastError != "" {
+			at := calls.lastErrorAt
+			status.LastError, status.LastErrorAt = calls.lastError, &at
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// GET /readyz. Without the database nothing can be booked, so that's a
+// 503 and the load balancer should send people elsewhere. A third party
+// failing only makes it degraded, still a 200 since every replica would
+// be in the same boat, but it shows on the dashboards
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	readiness := s.readiness(r.Context())
+	status := http.StatusOK
+	if readiness.Status == "unavailable" {
+		status = http.StatusServiceUnavailable
+	}
+	s.respond(w, r, status, readiness)
+}
+
+func (s *Server) readiness(ctx context.Context) Readiness {
+	readiness := Readiness{Status: "ready", Database: "ok", Dependencies: s.dependencyStatuses()}
+	if s.db == nil {
+		readiness.Database = "memory"
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if err := s.db.PingContext(ctx); err != nil {
+			readiness.Database = err.Error()
+			readiness.Status = "unavailable"
+		}
+		// A bad integrity check is only degraded, with one file between the
+		// replicas taking them all out would leave nowhere to go
+		readiness.Integrity = s.lastIntegrityCheck(ctx)
+		if readiness.Integrity != nil && readiness.Integrity.Status != "ok" && readiness.Status == "ready" {
+			readiness.Status = "degraded"
+		}
+	}
+	for _, dep := range readiness.Dependencies {
+		if dep.Status != "ok" && readiness.Status == "ready" {
+			readiness.Status = "degraded"
+		}
+	}
+	return readiness
+}
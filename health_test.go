@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyzAndDependencyMetrics(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	var readiness Readiness
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	if w.Code != http.StatusOK || readiness.Status != "ready" {
+		t.Fatalf("Expected ready, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The holiday API falls over
+	start := time.Now().Add(-300 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		server.observeDependency(DependencyHolidayAPI, start, nil)
+	}
+	for i := 0; i < degradedFailures; i++ {
+		server.observeDependency(DependencyHolidayAPI, start, errors.New("public holiday API returned status: 503"))
+	}
+	server.observeDependency(DependencyEmail, start, nil)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	if w.Code != http.StatusOK || readiness.Status != "degraded" || len(readiness.Dependencies) != 2 {
+		t.Fatalf("Expected degraded but still serving, got %d: %s", w.Code, w.Body.String())
+	}
+	if api := readiness.Dependencies[1]; api.Name != DependencyHolidayAPI || api.Status != "degraded" || api.Failures != 5 || api.Calls != 15 || api.LastError == "" {
+		t.Errorf("Expected the holiday API degraded with 5 of 15 failing, got %+v", api)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`citynext_dependency_requests_total{dependency="holiday_api",outcome="error"} 5`,
+		`citynext_dependency_requests_total{dependency="holiday_api",outcome="ok"} 10`,
+		`citynext_dependency_duration_seconds_bucket{dependency="holiday_api",le="0.25"} 0`,
+		`citynext_dependency_duration_seconds_bucket{dependency="holiday_api",le="0.5"} 15`,
+		`citynext_dependency_duration_seconds_count{dependency="email"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in:\n%s", want, w.Body.String())
+		}
+	}
+
+	server.db.Close()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without the database, got %d", w.Code)
+	}
+}
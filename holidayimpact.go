@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A holiday added, or moved, onto a day people have already booked.
+// New bookings are turned away from it as soon as it's in, but the ones
+// already there stay until someone does something. Found on the refresh
+// that spots the change, which emails CITYNEXT_HOLIDAY_IMPACT_TO and,
+// with CITYNEXT_HOLIDAY_ACTION, closes the day as POST /admin/closures
+// would, cancelling with a rebooking offer or flagging them for staff
+type HolidayImpact struct {
+	XMLName      xml.Name `json:"-" xml:"collision"`
+	Change       string   `json:"change" xml:"change"` // added or moved
+	CountryCode  string   `json:"countryCode" xml:"countryCode"`
+	Date         string   `json:"date" xml:"date"`
+	Name         string   `json:"name" xml:"name"`
+	Was          string   `json:"was,omitempty" xml:"was,omitempty"`
+	Appointments []int    `json:"appointments" xml:"appointments>id"`        // booked on the day
+	Closure      int      `json:"closure,omitempty" xml:"closure,omitempty"` // the closure made for it, if one was
+}
+
+// The changes that land on bookings from today on, after seeing to them
+func (s *Server) holidayImpact(ctx context.Context, changes []HolidayChange) []HolidayImpact {
+	impact := []HolidayImpact{}
+	today, err := s.today()
+	if err != nil {
+		return impact
+	}
+	lands := func(c HolidayChange) bool { return c.Change != "removed" && c.Date >= today.Format("2006-01-02") }
+	if !slices.ContainsFunc(changes, lands) {
+		return impact
+	}
+
+	lctx, cancel := withTimeout(ctx, s.cfg.DBTimeout)
+	appointments, err := s.store.List(lctx, time.Time{})
+	cancel()
+	if err != nil {
+		log.Printf("Error checking the bookings on new public holidays: %v", err)
+		return impact
+	}
+	booked := map[string][]int{}
+	for _, a := range appointments {
+		booked[a.VisitDate] = append(booked[a.VisitDate], a.ID)
+	}
+
+	closed := map[string]int{} // one closure a day, a holiday on both sides of a border is one day off
+	for _, c := range changes {
+		ids := booked[c.Date]
+		if !lands(c) || len(ids) == 0 {
+			continue
+		}
+		hit := HolidayImpact{Change: c.Change, CountryCode: c.CountryCode, Date: c.Date, Name: c.Name, Was: c.Was, Appointments: ids}
+		if action := s.cfg.HolidayAction; action != "" {
+			if id, ok := closed[c.Date]; ok {
+				hit.Closure = id
+			} else if closure, err := s.closeHoliday(ctx, c, action); err != nil {
+				log.Printf("Error closing %s for %s, its bookings need moving by hand: %v", c.Date, c.Name, err)
+			} else {
+				hit.Closure, closed[c.Date] = closure.ID, closure.ID
+			}
+		}
+		log.Printf("Public holiday %s on %s lands on %d bookings", c.Name, c.Date, len(ids))
+		impact = append(impact, hit)
+	}
+	if len(impact) > 0 {
+		s.sendHolidayImpact(ctx, impact)
+	}
+	return impact
+}
+
+func (s *Server) closeHoliday(ctx context.Context, c HolidayChange, action string) (Closure, error) {
+	ctx, cancel := withTimeout(withActor(ctx, ActorHolidays), s.cfg.DBTimeout)
+	defer cancel()
+	return s.closeDays(ctx, Closure{From: c.Date, To: c.Date, Reason: c.Name + " (public holiday)", Action: action})
+}
+
+func (s *Server) sendHolidayImpact(ctx context.Context, impact []HolidayImpact) {
+	if len(s.cfg.HolidayImpactTo) == 0 {
+		return
+	}
+	var b strings.Builder
+	for _, hit := range impact {
+		fmt.Fprintf(&b, "%s (%s) on %s", hit.Name, hit.CountryCode, hit.Date)
+		if hit.Was != "" {
+			fmt.Fprintf(&b, ", moved from %s", hit.Was)
+		}
+		ids := make([]string, len(hit.Appointments))
+		for i, id := range hit.Appointments {
+			ids[i] = strconv.Itoa(id)
+		}
+		fmt.Fprintf(&b, "\n%d bookings: %s\n", len(ids), strings.Join(ids, ", "))
+		switch {
+		case hit.Closure == 0:
+			b.WriteString("Not changed, close the day or move them by hand\n\n")
+		case s.cfg.HolidayAction == ClosureCancel:
+			fmt.Fprintf(&b, "Cancelled by closure %d, and offered another day\n\n", hit.Closure)
+		default:
+			fmt.Fprintf(&b, "Flagged by closure %d, for staff to move\n\n", hit.Closure)
+		}
+	}
+	text := b.String()
+	for _, to := range s.cfg.HolidayImpactTo {
+		s.deliver(ctx, ChannelEmail, Message{
+			To:      to,
+			Subject: "New public holidays on booked days",
+			Text:    text,
+			HTML:    "<pre>" + html.EscapeString(text) + "</pre>",
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"appointment-service/testsupport"
+)
+
+func TestHolidayImpact(t *testing.T) {
+	api := testsupport.NewHolidayProvider(t).
+		AddHoliday("GB", "2075-12-25", "Christmas Day").
+		AddHoliday("IE", "2075-12-25", "Christmas Day")
+	server, sent := closureServer(t, "sqlite")
+	server.cfg.HolidayAPIURL = api.URL
+	server.cfg.Countries = []string{"GB", "IE"}
+	server.cfg.HolidayImpactTo = []string{"duty@example.gov"}
+	if err := server.loadHolidays(context.Background(), "2075", server.cfg.Countries); err != nil {
+		t.Fatal(err)
+	}
+	router := server.routes()
+
+	for _, req := range []AppointmentRequest{
+		{FirstName: "Ann", LastName: "One", Email: "a@example.com", VisitDate: "2075-01-09"},
+		{FirstName: "Bea", LastName: "Two", Email: "b@example.com", VisitDate: "2075-01-09"},
+		{FirstName: "Cai", LastName: "Three", Email: "c@example.com", VisitDate: "2075-01-10"},
+		{FirstName: "Dee", LastName: "Four", Email: "d@example.com", VisitDate: "2075-01-15"},
+	} {
+		if w := postAppointment(t, router, req); w.Code != http.StatusCreated {
+			t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+		}
+		sent.next(t) // the confirmation
+	}
+	refresh := func() HolidayRefresh {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/holidays/refresh", nil))
+		var refresh HolidayRefresh
+		if json.Unmarshal(w.Body.Bytes(), &refresh); w.Code != http.StatusOK {
+			t.Fatalf("Expected a refresh, got %d: %s", w.Code, w.Body.String())
+		}
+		return refresh
+	}
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", path, nil))
+		return w.Code
+	}
+
+	// Reported, on both sides of the border, and left alone
+	api.AddHoliday("GB", "2075-01-09", "Snow Day").AddHoliday("IE", "2075-01-09", "Snow Day").
+		AddHoliday("GB", "2075-01-20", "Quiet Day")
+	got := refresh()
+	if len(got.Changes) != 3 || len(got.Impact) != 2 {
+		t.Fatalf("Expected three changes, two on bookings, got %+v", got)
+	}
+	if hit := got.Impact[0]; hit.Change != "added" || hit.Date != "2075-01-09" || len(hit.Appointments) != 2 || hit.Closure != 0 {
+		t.Errorf("Expected both bookings on the snow day reported, got %+v", hit)
+	}
+	msg := sent.next(t)
+	if msg.To != "duty@example.gov" || !strings.Contains(msg.Text, "Snow Day (GB) on 2075-01-09\n2 bookings: 1, 2\nNot changed") || !strings.Contains(msg.Text, "Snow Day (IE)") {
+		t.Errorf("Expected staff told, got %+v", msg)
+	}
+	if code := status("/appointments/1"); code != http.StatusOK {
+		t.Errorf("Expected the booking left alone, got %d", code)
+	}
+	// Seen once, not on every refresh after
+	if got := refresh(); len(got.Impact) != 0 {
+		t.Errorf("Expected nothing new, got %+v", got.Impact)
+	}
+
+	// Moved onto a booked day, and cancelled with an offer of another
+	server.cfg.HolidayAction = ClosureCancel
+	api.RemoveHoliday("GB", "2075-01-20").AddHoliday("GB", "2075-01-10", "Quiet Day")
+	got = refresh()
+	if len(got.Impact) != 1 || got.Impact[0].Change != "moved" || got.Impact[0].Was != "2075-01-20" || got.Impact[0].Closure == 0 {
+		t.Fatalf("Expected the move closed, got %+v", got.Impact)
+	}
+	var staff, citizen Message
+	for range 2 {
+		if msg := sent.next(t); msg.To == "duty@example.gov" {
+			staff = msg
+		} else {
+			citizen = msg
+		}
+	}
+	if !strings.Contains(staff.Text, "moved from 2075-01-20") || !strings.Contains(staff.Text, "Cancelled by closure") {
+		t.Errorf("Expected staff told it's cancelled, got %s", staff.Text)
+	}
+	if citizen.To != "c@example.com" {
+		t.Errorf("Expected the closure message to the one booked, got %+v", citizen)
+	}
+	if code := status("/appointments/3"); code != http.StatusNotFound {
+		t.Errorf("Expected the booking cancelled, got %d", code)
+	}
+	var closures ClosureList
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/closures", nil))
+	json.Unmarshal(w.Body.Bytes(), &closures)
+	if len(closures.Closures) != 1 || closures.Closures[0].CreatedBy != ActorHolidays || closures.Closures[0].Reason != "Quiet Day (public holiday)" {
+		t.Errorf("Expected a closure by the holidays, got %+v", closures.Closures)
+	}
+}
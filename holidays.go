@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Where the holidays come from, unless CITYNEXT_HOLIDAY_API_URL points
+// somewhere else, like a mirror for air-gapped installs or a test double
+// from testsupport
+const defaultHolidayAPIURL = "https://date.nager.at/api/v3"
+
+// The countries Nager knows hardly ever change, so they're only asked
+// for once a day, and shared between replicas when there's redis
+const (
+	countriesCacheKey = "holidays:countries"
+	countriesTTL      = 24 * time.Hour
+)
+
+type Country struct {
+	CountryCode string `json:"countryCode"`
+	Name        string `json:"name"`
+}
+
+type HolidayChange struct {
+	XMLName     xml.Name `json:"-" xml:"change"`
+	Change      string   `json:"change" xml:"type,attr"` // added, removed or moved
+	CountryCode string   `json:"countryCode" xml:"countryCode"`
+	Date        string   `json:"date" xml:"date"`
+	Name        string   `json:"name" xml:"name"`
+	Was         string   `json:"was,omitempty" xml:"was,omitempty"` // the date it moved from
+}
+
+type HolidayRefresh struct {
+	XMLName   xml.Name        `json:"-" xml:"holidayRefresh"`
+	Year      string          `json:"year" xml:"year"`
+	Countries []string        `json:"countries" xml:"countries>country"`
+	Holidays  int             `json:"holidays" xml:"holidays"`
+	Changes   []HolidayChange `json:"changes" xml:"changes>change"`
+	Impact    []HolidayImpact `json:"impact" xml:"impact>collision"` // changes that land on bookings, see holidayimpact.go
+}
+
+func (s *Server) holidayAPIURL() string {
+	if s.cfg.HolidayAPIURL == "" {
+		return defaultHolidayAPIURL
+	}
+	return strings.TrimSuffix(s.cfg.HolidayAPIURL, "/")
+}
+
+func (s *Server) nagerGet(ctx context.Context, path string, v any) (err error) {
+	defer func(start time.Time) { s.observeDependency(DependencyHolidayAPI, start, err) }(time.Now())
+
+	ctx, cancel := withTimeout(ctx, s.cfg.HolidayAPITimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.holidayAPIURL()+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("public holiday API returned status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// Country names by code
+func (s *Server) availableCountries(ctx context.Context) (map[string]string, error) {
+	var countries []Country
+	if body, ok, err := s.cache.Get(ctx, countriesCacheKey); err == nil && ok && json.Unmarshal(body, &countries) == nil {
+		return countryNames(countries), nil
+	}
+
+	if err := s.nagerGet(ctx, "/AvailableCountries", &countries); err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(countries)
+	if err := s.cache.Set(ctx, countriesCacheKey, body, countriesTTL); err != nil {
+		log.Printf("Error caching available countries: %v", err)
+	}
+	return countryNames(countries), nil
+}
+
+func countryNames(countries []Country) map[string]string {
+	names := make(map[string]string, len(countries))
+	for _, c := range countries {
+		names[c.CountryCode] = c.Name
+	}
+	return names
+}
+
+// The holidays every replica goes by. They're kept in the shared cache,
+// so a refresh on one replica is what all of them see on their next
+// request, rather than each having its own copy that can disagree. Each
+// also keeps the last one it read, for when the cache can't be reached
+type holidaySet struct {
+	Year       string          `json:"year"`
+	Configured []string        `json:"configured"` // the country codes asked for
+	Countries  []string        `json:"countries"`  // the ones that were real
+	Holidays   []PublicHoliday `json:"holidays"`
+	FetchedAt  time.Time       `json:"fetchedAt"` // zero if they were set rather than fetched
+
+	byCountry map[string]map[string]bool // dates, made when it's read
+}
+
+const (
+	holidaysTTL        = 400 * 24 * time.Hour // longer than the year they're for
+	holidayRefreshLock = "holidays:refresh"
+)
+
+func holidaysCacheKey(year string) string {
+	return "holidays:" + year
+}
+
+func newHolidaySet(year string, countries []string, holidays []PublicHoliday, fetchedAt time.Time) *holidaySet {
+	set := &holidaySet{Year: year, Configured: countries, Countries: countries, Holidays: holidays, FetchedAt: fetchedAt}
+	set.index()
+	return set
+}
+
+func (h *holidaySet) index() {
+	h.byCountry = make(map[string]map[string]bool, len(h.Countries))
+	for _, code := range h.Countries {
+		h.byCountry[code] = make(map[string]bool)
+	}
+	for _, holiday := range h.Holidays {
+		if dates := h.byCountry[holiday.CountryCode]; dates != nil {
+			dates[holiday.Date] = true
+		}
+	}
+}
+
+// A holiday in any of the countries. An office across a border shuts for both
+func (h *holidaySet) closed(date time.Time) bool {
+	if h == nil {
+		return false
+	}
+	d := date.Format("2006-01-02")
+	for _, dates := range h.byCountry {
+		if dates[d] {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *holidaySet) has(country string) bool {
+	return h != nil && h.byCountry[country] != nil
+}
+
+func (h *holidaySet) list() []PublicHoliday {
+	if h == nil {
+		return nil
+	}
+	return h.Holidays
+}
+
+func (h *holidaySet) fresh(refresh time.Duration) bool {
+	return h != nil && !h.FetchedAt.IsZero() && (refresh <= 0 || time.Since(h.FetchedAt) < refresh)
+}
+
+func (h *holidaySet) tooStale(maxStale time.Duration) bool {
+	return h != nil && !h.FetchedAt.IsZero() && maxStale > 0 && time.Since(h.FetchedAt) > maxStale
+}
+
+// The holidays for this request. It's a cache round trip, so a handler
+// reads them once and keeps them for the rest of the request, asking
+// for each day in a loop would be one a day. A refresh is started if
+// they're getting old
+func (s *Server) holidaySet(ctx context.Context) *holidaySet {
+	set, shared := s.sharedHolidays(ctx)
+	s.revalidateHolidays(set, shared)
+	return set
+}
+
+// The shared copy if there is one, this replica's last if not, and
+// whether it was the shared one
+func (s *Server) sharedHolidays(ctx context.Context) (*holidaySet, bool) {
+	raw, ok, err := s.cache.Get(ctx, holidaysCacheKey(s.yearStr))
+	if err != nil {
+		log.Printf("Error reading the shared public holidays, using this replica's copy: %v", err)
+	}
+
+	s.holidayMu.Lock()
+	defer s.holidayMu.Unlock()
+	if err != nil || !ok {
+		return s.holidays, false
+	}
+	if bytes.Equal(raw, s.holidaysRaw) {
+		return s.holidays, true
+	}
+	var set holidaySet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		log.Printf("Error reading the shared public holidays, using this replica's copy: %v", err)
+		return s.holidays, false
+	}
+	set.index()
+	s.holidays, s.holidaysRaw = &set, raw
+	return &set, true
+}
+
+// Share them with every replica, and start using them here
+func (s *Server) storeHolidays(ctx context.Context, set *holidaySet) {
+	raw, _ := json.Marshal(set)
+	if err := s.cache.Set(ctx, holidaysCacheKey(set.Year), raw, holidaysTTL); err != nil {
+		log.Printf("Error sharing the public holidays, only this replica has them: %v", err)
+	}
+	s.holidayMu.Lock()
+	s.holidays, s.holidaysRaw = set, raw
+	s.holidayMu.Unlock()
+	s.invalidateAvailability(ctx)
+}
+
+// Every country's holidays for the year. A code Nager doesn't know is
+// left out rather than failing the whole start up, as long as there's
+// at least one real one. If the list of countries can't be had, the
+// codes are tried as they are. A replica starting up alongside others
+// uses what they fetched if it's fresh and for the same countries
+func (s *Server) loadHolidays(ctx context.Context, yearStr string, codes []string) error {
+	// Remember the year for future appointment validation
+	s.yearStr = yearStr
+	if set, ok := s.sharedHolidays(ctx); ok && set.fresh(s.cfg.HolidayRefresh) && slices.Equal(set.Configured, countryCodes(codes)) {
+		log.Printf("Using the %d public holidays for %s fetched at %s", len(set.Holidays), yearStr, set.FetchedAt.Format(time.RFC3339))
+		return nil
+	}
+	_, err := s.refreshHolidays(ctx, yearStr, codes)
+	return err
+}
+
+func countryCodes(codes []string) []string {
+	upper := make([]string, 0, len(codes))
+	for _, code := range codes {
+		if code = strings.ToUpper(code); !slices.Contains(upper, code) {
+			upper = append(upper, code)
+		}
+	}
+	return upper
+}
+
+// Fetch everything again, and only swap it in once it's all arrived.
+// If any country fails the old holidays stay. Returns how they differ
+// from the ones before, and which bookings that hits
+func (s *Server) refreshHolidays(ctx context.Context, yearStr string, codes []string) (HolidayRefresh, error) {
+	available, err := s.availableCountries(ctx)
+	if err != nil {
+		log.Printf("Couldn't check the country codes, trying them anyway: %v", err)
+	}
+
+	configured := countryCodes(codes)
+	var countries []string
+	var all []PublicHoliday
+	for _, code := range configured {
+		if available != nil && available[code] == "" {
+			log.Printf("Ignoring unknown country code %q", code)
+			continue
+		}
+		holidays, err := s.fetchPublicHolidays(ctx, yearStr, code)
+		if err != nil {
+			return HolidayRefresh{}, fmt.Errorf("%s: %w", code, err)
+		}
+		countries = append(countries, code)
+		all = append(all, holidays...)
+	}
+	if len(countries) == 0 {
+		return HolidayRefresh{}, fmt.Errorf("none of the country codes %v are ones the holiday API knows", codes)
+	}
+	sort.Strings(countries)
+
+	set := newHolidaySet(yearStr, countries, all, time.Now())
+	set.Configured = configured
+	before, _ := s.sharedHolidays(ctx)
+	changes := diffHolidays(before.list(), all)
+	s.storeHolidays(ctx, set)
+
+	for _, c := range changes {
+		log.Printf("Public holiday %s in %s: %s on %s", c.Change, c.CountryCode, c.Name, c.Date)
+	}
+	refresh := HolidayRefresh{Year: yearStr, Countries: set.Countries, Holidays: len(set.Holidays), Changes: changes, Impact: []HolidayImpact{}}
+	// The first holidays there are aren't changes to anything
+	if before != nil {
+		refresh.Impact = s.holidayImpact(ctx, changes)
+	}
+	return refresh, nil
+}
+
+// Added, removed, or moved when the same holiday is on a different date
+func diffHolidays(before, after []PublicHoliday) []HolidayChange {
+	key := func(h PublicHoliday) string { return h.CountryCode + " " + h.Date + " " + h.Name }
+	was, now := map[string]PublicHoliday{}, map[string]PublicHoliday{}
+	for _, h := range before {
+		was[key(h)] = h
+	}
+	for _, h := range after {
+		now[key(h)] = h
+	}
+
+	changes := []HolidayChange{}
+	removed := map[string]PublicHoliday{} // by country and name, to spot moves
+	for k, h := range was {
+		if _, ok := now[k]; !ok {
+			removed[h.CountryCode+" "+h.Name] = h
+		}
+	}
+	for k, h := range now {
+		if _, ok := was[k]; ok {
+			continue
+		}
+		if old, ok := removed[h.CountryCode+" "+h.Name]; ok {
+			delete(removed, h.CountryCode+" "+h.Name)
+			changes = append(changes, HolidayChange{Change: "moved", CountryCode: h.CountryCode, Date: h.Date, Name: h.Name, Was: old.Date})
+			continue
+		}
+		changes = append(changes, HolidayChange{Change: "added", CountryCode: h.CountryCode, Date: h.Date, Name: h.Name})
+	}
+	for _, h := range removed {
+		changes = append(changes, HolidayChange{Change: "removed", CountryCode: h.CountryCode, Date: h.Date, Name: h.Name})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].CountryCode != changes[j].CountryCode {
+			return changes[i].CountryCode < changes[j].CountryCode
+		}
+		return changes[i].Date < changes[j].Date
+	})
+	return changes
+}
+
+// Holidays hardly ever change once published, but now and then one is
+// added at short notice. Once they're older than CITYNEXT_HOLIDAY_REFRESH
+// the next read starts a refresh in the background and carries on with
+// what it has. Only one replica fetches, under the lock, and the rest
+// pick up what it stores. If the shared copy's gone, say Redis was
+// restarted, it's fetched again the same way. If refreshes keep failing
+// for CITYNEXT_HOLIDAY_MAX_STALE, new bookings are turned away rather
+// than risk one on a new holiday
+func (s *Server) revalidateHolidays(set *holidaySet, shared bool) {
+	refresh := s.cfg.HolidayRefresh
+	if set == nil || set.FetchedAt.IsZero() || refresh <= 0 || (shared && set.fresh(refresh)) {
+		return
+	}
+	if !s.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.refreshing.Store(false)
+		ctx := context.Background()
+		unlock, err := s.locker.Lock(ctx, holidayRefreshLock, time.Minute)
+		if err != nil {
+			if !errors.Is(err, ErrLockHeld) {
+				log.Printf("Error taking the lock to refresh public holidays: %v", err)
+			}
+			return
+		}
+		defer unlock()
+
+		// Someone else may have just done it
+		if current, ok := s.sharedHolidays(ctx); ok && current.fresh(refresh) {
+			return
+		}
+		if _, err := s.refreshHolidays(ctx, s.yearStr, s.cfg.Countries); err != nil {
+			log.Printf("Error refreshing public holidays, still using the ones from %s: %v", set.FetchedAt.Format(time.RFC3339), err)
+		}
+	}()
+}
+
+// With CITYNEXT_HOLIDAY_REFRESH_SCHEDULE they're fetched at set times as
+// well, say overnight, so a holiday announced in the day is in before
+// the morning's bookings rather than whenever the next read finds them
+// stale. The count is the changes. Skipped if a stale read's refreshing
+// them already
+func (s *Server) scheduleHolidayRefresh(schedule jobSchedule, stop <-chan struct{}) {
+	s.every("holiday-refresh", schedule, stop, func(ctx context.Context) (int, error) {
+		unlock, err := s.locker.Lock(ctx, holidayRefreshLock, time.Minute)
+		if errors.Is(err, ErrLockHeld) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+		refresh, err := s.refreshHolidays(ctx, s.yearStr, s.cfg.Countries)
+		return len(refresh.Changes), err
+	})
+}
+
+// POST /admin/holidays/refresh fetches them all again now, rather than
+// waiting for them to go stale, and says what changed
+func (s *Server) forceHolidayRefresh(w http.ResponseWriter, r *http.Request) {
+	refresh, err := s.refreshHolidays(r.Context(), s.yearStr, s.cfg.Countries)
+	if err != nil {
+		log.Printf("Error refreshing public holidays: %v", err)
+		s.sendErrorResponse(w, r, http.StatusBadGateway, CodeHolidayAPIError, "Couldn't fetch the public holidays, the old ones are still in use")
+		return
+	}
+	s.respond(w, r, http.StatusOK, refresh)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"appointment-service/testsupport"
+)
+
+func holidayServer(api *testsupport.HolidayProvider) *Server {
+	server := NewServer(nil)
+	server.cfg.HolidayAPIURL = api.URL
+	return server
+}
+
+// As if they were fetched that long ago
+func ageHolidays(server *Server, age time.Duration) {
+	set := *server.holidaySet(context.Background())
+	set.FetchedAt = time.Now().Add(-age)
+	server.storeHolidays(context.Background(), &set)
+}
+
+func TestLoadHolidaysForSeveralCountries(t *testing.T) {
+	api := testsupport.NewHolidayProvider(t).
+		AddHoliday("GB", "2075-12-25", "Christmas Day").
+		AddHoliday("IE", "2075-03-17", "Lá Fhéile Pádraig")
+	server := holidayServer(api)
+
+	if err := server.loadHolidays(context.Background(), "2075", []string{"gb", "XX", "IE"}); err != nil {
+		t.Fatalf("Expected the bogus code to be skipped, got %v", err)
+	}
+	for _, date := range []string{"2075-12-25", "2075-03-17"} {
+		d, _ := time.Parse("2006-01-02", date)
+		if !server.holidaySet(context.Background()).closed(d) {
+			t.Errorf("Expected %s to be a holiday", date)
+		}
+	}
+	if got := server.holidaySet(context.Background()).Countries; len(got) != 2 || api.Requests("/PublicHolidays/2075/XX") != 0 {
+		t.Errorf("Expected holidays for GB and IE only, got %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, httptest.NewRequest("GET", "/holidays?country=ie", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Christmas") || !strings.Contains(w.Body.String(), "2075-03-17") {
+		t.Errorf("Expected only Ireland's holidays, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	server.routes().ServeHTTP(w, httptest.NewRequest("GET", "/holidays?country=FR", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a country that isn't loaded, got %d", w.Code)
+	}
+
+	if err := holidayServer(api).loadHolidays(context.Background(), "2075", []string{"XX"}); err == nil {
+		t.Error("Expected an error with no real country codes")
+	}
+
+	// The country list comes from the cache the second time
+	other := holidayServer(api)
+	other.cache = server.cache
+	other.loadHolidays(context.Background(), "2075", []string{"GB"})
+	if n := api.Requests("/AvailableCountries"); n != 2 {
+		t.Errorf("Expected the shared cache to save a lookup, got %d", n)
+	}
+}
+
+func TestHolidayAPIURL(t *testing.T) {
+	if got := NewServer(nil).holidayAPIURL(); got != defaultHolidayAPIURL {
+		t.Errorf("Expected Nager by default, got %s", got)
+	}
+
+	t.Setenv("CITYNEXT_HOLIDAY_API_URL", "http://holidays.internal/api/v3/")
+	server := NewServer(nil)
+	server.cfg = loadConfig()
+	if got := server.holidayAPIURL(); got != "http://holidays.internal/api/v3" {
+		t.Errorf("Expected the configured mirror, got %s", got)
+	}
+}
+
+func TestStaleHolidaysRevalidate(t *testing.T) {
+	api := testsupport.NewHolidayProvider(t).AddHoliday("GB", "2075-12-25", "Christmas Day")
+	server := holidayServer(api)
+	server.cfg.Countries = []string{"GB"}
+	server.cfg.HolidayRefresh = time.Hour
+	server.cfg.HolidayMaxStale = 24 * time.Hour
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	if err := server.loadHolidays(context.Background(), "2075", server.cfg.Countries); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new one's announced, and what we have is two hours old
+	api.AddHoliday("GB", "2075-09-19", "State Funeral")
+	ageHolidays(server, 2*time.Hour)
+	funeral, _ := time.Parse("2006-01-02", "2075-09-19")
+	isHoliday := func(d time.Time) bool { return server.holidaySet(context.Background()).closed(d) }
+	if isHoliday(funeral) {
+		t.Error("Expected the stale holidays to be served while refreshing")
+	}
+	for deadline := time.Now().Add(time.Second); !isHoliday(funeral); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the background refresh to pick up the new holiday")
+		}
+	}
+
+	for server.refreshing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The API goes away for longer than we're prepared to guess for
+	server.cfg.HolidayAPIURL = "http://127.0.0.1:1"
+	ageHolidays(server, 48*time.Hour)
+	router := server.routes()
+	for date, want := range map[string]int{"2075-06-17": http.StatusServiceUnavailable, "2075-06-16": http.StatusCreated} {
+		w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Scully", VisitDate: date})
+		if w.Code != want {
+			t.Errorf("Expected %d booking %s on stale holidays, got %d: %s", want, date, w.Code, w.Body.String())
+		}
+	}
+	for deadline := time.Now().Add(time.Second); server.refreshing.Load(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the failing refresh to give up")
+		}
+	}
+}
+
+func TestForceHolidayRefresh(t *testing.T) {
+	api := testsupport.NewHolidayProvider(t).
+		AddHoliday("GB", "2075-05-06", "Early May Bank Holiday").
+		AddHoliday("GB", "2075-12-25", "Christmas Day").
+		AddHoliday("GB", "2075-12-26", "Boxing Day")
+	server := holidayServer(api)
+	server.cfg.AdminToken = "secret"
+	server.cfg.Countries = []string{"GB"}
+	if err := server.loadHolidays(context.Background(), "2075", server.cfg.Countries); err != nil {
+		t.Fatal(err)
+	}
+
+	api.RemoveHoliday("GB", "2075-05-06").AddHoliday("GB", "2075-05-08", "Early May Bank Holiday").
+		RemoveHoliday("GB", "2075-12-26").
+		AddHoliday("GB", "2075-09-19", "State Funeral")
+
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, adminRequest("POST", "/admin/holidays/refresh", nil))
+	var refresh HolidayRefresh
+	json.Unmarshal(w.Body.Bytes(), &refresh)
+	if w.Code != http.StatusOK || refresh.Holidays != 3 || len(refresh.Changes) != 3 {
+		t.Fatalf("Expected three changes to three holidays, got %d: %s", w.Code, w.Body.String())
+	}
+	want := []HolidayChange{
+		{Change: "moved", CountryCode: "GB", Date: "2075-05-08", Name: "Early May Bank Holiday", Was: "2075-05-06"},
+		{Change: "added", CountryCode: "GB", Date: "2075-09-19", Name: "State Funeral"},
+		{Change: "removed", CountryCode: "GB", Date: "2075-12-26", Name: "Boxing Day"},
+	}
+	for i, c := range refresh.Changes {
+		if c != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], c)
+		}
+	}
+
+	// The CLI asks the running server to do the same
+	srv := httptest.NewServer(server.routes())
+	defer srv.Close()
+	if err := refreshHolidaysCommand(Config{AdminToken: "secret"}, []string{srv.URL}); err != nil {
+		t.Errorf("Expected the command to refresh, got %v", err)
+	}
+	if err := refreshHolidaysCommand(Config{AdminToken: "wrong"}, []string{srv.URL}); err == nil {
+		t.Error("Expected the command to fail without the admin token")
+	}
+}
+
+func TestReplicasShareHolidays(t *testing.T) {
+	ctx := context.Background()
+	api := testsupport.NewHolidayProvider(t).AddHoliday("GB", "2075-12-25", "Christmas Day")
+	first := holidayServer(api)
+	first.cfg.AdminToken = "secret"
+	first.cfg.Countries = []string{"GB"}
+	first.cfg.HolidayRefresh = time.Hour
+	if err := first.loadHolidays(ctx, "2075", first.cfg.Countries); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another replica on the same Redis
+	second := holidayServer(api)
+	second.cfg = first.cfg
+	second.cache, second.locker = first.cache, first.locker
+	if err := second.loadHolidays(ctx, "2075", second.cfg.Countries); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.Requests("/PublicHolidays/2075/GB"); n != 1 {
+		t.Errorf("Expected the second replica to use what the first fetched, got %d fetches", n)
+	}
+
+	// A refresh on one is what the other goes by
+	api.AddHoliday("GB", "2075-09-19", "State Funeral")
+	w := httptest.NewRecorder()
+	first.routes().ServeHTTP(w, adminRequest("POST", "/admin/holidays/refresh", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a refresh, got %d", w.Code)
+	}
+	funeral, _ := time.Parse("2006-01-02", "2075-09-19")
+	if !second.holidaySet(ctx).closed(funeral) {
+		t.Error("Expected the other replica to see the new holiday")
+	}
+	w = httptest.NewRecorder()
+	second.routes().ServeHTTP(w, httptest.NewRequest("GET", "/holidays", nil))
+	if !strings.Contains(w.Body.String(), "State Funeral") {
+		t.Errorf("Expected the other replica to list it, got %s", w.Body.String())
+	}
+
+	// Redis loses them, the replica carries on with its copy and fetches them again
+	first.cache.Delete(ctx, holidaysCacheKey("2075"))
+	if !second.holidaySet(ctx).closed(funeral) {
+		t.Error("Expected the replica's own copy while the shared one's gone")
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, ok := first.sharedHolidays(ctx); ok && !second.refreshing.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the shared holidays fetched again")
+		}
+	}
+}
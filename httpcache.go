@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Public, cacheable GETs. The ETag is a hash of the body, so every
+// replica hands out the same one for the same data, and a browser
+// revalidating after max-age gets a 304 instead of the whole thing again
+func writeCacheable(w http.ResponseWriter, r *http.Request, v any, maxAge time.Duration) {
+	format := negotiateFormat(r.Header.Get("Accept"))
+	body, err := encodeAs(format, v)
+	if err != nil {
+		log.Printf("Error encoding %s response: %v", format, err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	writeCacheableBody(w, r, format, body, maxAge)
+}
+
+// For bodies that are already encoded, in a format fixed by the URL
+func writeCacheableBody(w http.ResponseWriter, r *http.Request, contentType string, body []byte, maxAge time.Duration) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Clients (and flaky mobile networks) retry POSTs. With an Idempotency-Key
+// header the first successful response is remembered for a day and replayed,
+// so a retry never books twice. Keys are the caller's own, by who they're
+// signed in as or by IP if they aren't, and only a retry of the same
+// request gets the response back, anything else with the key is a 422
+const idempotencyTTL = 24 * time.Hour
+
+type storedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+	Request     string `json:"request"` // SHA-256 of the method and body
+	KeyID       string `json:"kid,omitempty"`
+	Sig         string `json:"sig,omitempty"`
+}
+
+// Signed with the cache key, so whoever can write to Redis can't make up
+// a response, or move one to another key
+func (stored storedResponse) message(cacheKey string) string {
+	return fmt.Sprintf("%s\n%d\n%s\n%s\n%s", cacheKey, stored.Status, stored.ContentType, stored.Request, stored.Body)
+}
+
+func requestFingerprint(method string, body []byte) string {
+	sum := sha256.Sum256(append([]byte(method+"\n"), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whoever's asking, so one caller's key can't get another's response
+func idempotencyCaller(r *http.Request) string {
+	if actor := actorFrom(r.Context()); actor != ActorPublic {
+		return actor
+	}
+	return "ip:" + clientIP(r)
+}
+
+// Captures what the handler writes so it can be stored
+type capturingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturingWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *capturingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		cacheKey := "idempotency:" + idempotencyCaller(r) + ":" + r.URL.Path + ":" + key
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Couldn't read the request")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		request := requestFingerprint(r.Method, body)
+
+		if replayed := s.replayResponse(w, r, cacheKey, request); replayed {
+			return
+		}
+
+		// One request per key at a time, a concurrent retry waits its turn by trying again
+		unlock, err := s.locker.Lock(r.Context(), "lock:"+cacheKey, 30*time.Second)
+		if errors.Is(err, ErrLockHeld) {
+			s.sendErrorResponse(w, r, http.StatusConflict, CodeRequestInProgress, "A request with this Idempotency-Key is still being processed")
+			return
+		}
+		if err != nil {
+			log.Printf("Error locking idempotency key: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed checking idempotency key")
+			return
+		}
+		defer unlock()
+
+		// It may have finished while we were getting the lock
+		if replayed := s.replayResponse(w, r, cacheKey, request); replayed {
+			return
+		}
+
+		capture := &capturingWriter{ResponseWriter: w}
+		next(capture, r)
+
+		// Only successes are remembered, anything else can be retried for real
+		if capture.status < 200 || capture.status >= 300 {
+			return
+		}
+		stored := storedResponse{Status: capture.status, ContentType: w.Header().Get("Content-Type"), Body: capture.body.Bytes(), Request: request}
+		stored.KeyID, stored.Sig = s.signMessage(r.Context(), stored.message(cacheKey))
+		b, _ := json.Marshal(stored)
+		if err := s.cache.Set(r.Context(), cacheKey, b, idempotencyTTL); err != nil {
+			log.Printf("Error storing idempotent response: %v", err)
+		}
+	}
+}
+
+// Whether it's been answered, with the response from before or a 422 if
+// request isn't the one the key was used for
+func (s *Server) replayResponse(w http.ResponseWriter, r *http.Request, cacheKey, request string) bool {
+	b, ok, err := s.cache.Get(r.Context(), cacheKey)
+	if err != nil {
+		log.Printf("Error reading idempotency key: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	var stored storedResponse
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return false
+	}
+	// With signing keys an unsigned one won't do either. One signed with a
+	// key that's since been retired doesn't, so it's run again for real
+	if stored.KeyID != "" || s.signingEnabled(r.Context()) {
+		if !s.verifySignature(r.Context(), stored.KeyID, stored.message(cacheKey), stored.Sig) {
+			log.Printf("Ignoring idempotency record for %s, its signature doesn't check out", cacheKey)
+			return false
+		}
+	}
+	if stored.Request != request {
+		s.sendErrorResponse(w, r, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, "This Idempotency-Key was used for a different request")
+		return true
+	}
+	if stored.ContentType == "" {
+		stored.ContentType = formatJSON
+	}
+	w.Header().Set("Content-Type", stored.ContentType)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Custom fields with "format" set to one of these have to be a real
+// identifier, not just look like one, since what they're passed on to
+// only says so days later. They can be given with spaces or dashes, and
+// are kept without them
+type identifierFormat struct {
+	name  string // for "isn't a valid ..."
+	valid func(id string) bool
+}
+
+var identifierFormats = map[string]identifierFormat{
+	"nhs-number": {"NHS number", func(id string) bool { return modulus11(digitsOf(id)) }},
+	// Scotland's, the date of birth then four more digits
+	"chi-number": {"CHI number", func(id string) bool {
+		digits := digitsOf(id)
+		_, err := time.Parse("020106", digits[:min(6, len(digits))])
+		return err == nil && modulus11(digits)
+	}},
+	// Northern Ireland's Health and Care Number, from its own range
+	"hcn": {"Health and Care Number", func(id string) bool {
+		digits := digitsOf(id)
+		return digits >= "3200000000" && digits <= "3999999999" && modulus11(digits)
+	}},
+	"ni-number": {"National Insurance number", func(id string) bool { return nationalInsurance(normaliseIdentifier(id)) }},
+	"luhn":      {"number", func(id string) bool { return luhn(digitsOf(id)) }},
+}
+
+// Without the spaces and dashes, in capitals
+func normaliseIdentifier(id string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(id))
+}
+
+// Only the digits, or "" if there's anything else
+func digitsOf(id string) string {
+	id = normaliseIdentifier(id)
+	if strings.Trim(id, "0123456789") != "" {
+		return ""
+	}
+	return id
+}
+
+// Ten digits, the first nine weighted 10 down to 2, and the last is 11
+// less what they add up to mod 11. A check digit that works out as 10
+// means the number was never issued
+func modulus11(digits string) bool {
+	if len(digits) != 10 {
+		return false
+	}
+	sum := 0
+	for i := range 9 {
+		sum += int(digits[i]-'0') * (10 - i)
+	}
+	check := (11 - sum%11) % 11
+	return check != 10 && int(digits[9]-'0') == check
+}
+
+func luhn(digits string) bool {
+	if len(digits) < 2 {
+		return false
+	}
+	sum := 0
+	for i := range len(digits) {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// Two letters, six digits and A to D. Neither letter is D, F, I, Q, U
+// or V, the second isn't O, and some pairs are never given out
+func nationalInsurance(id string) bool {
+	if len(id) != 9 || strings.Trim(id[2:8], "0123456789") != "" || !strings.Contains("ABCD", id[8:]) {
+		return false
+	}
+	if strings.ContainsAny(id[:2], "DFIQUV0123456789") || id[1] == 'O' || id[0] < 'A' || id[0] > 'Z' || id[1] < 'A' || id[1] > 'Z' {
+		return false
+	}
+	switch id[:2] {
+	case "BG", "GB", "KN", "NK", "NT", "TN", "ZZ":
+		return false
+	}
+	return true
+}
+
+// Identifiers in fields written the one way, after they've been checked
+func (schema *fieldSchema) normalise(v any) {
+	fields, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	for name, p := range schema.Properties {
+		if id, ok := fields[name].(string); ok && p.Format != "" {
+			fields[name] = normaliseIdentifier(id)
+		}
+		p.normalise(fields[name])
+	}
+}
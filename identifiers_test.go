@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestIdentifierFormats(t *testing.T) {
+	for _, c := range []struct {
+		format, id string
+		ok         bool
+	}{
+		{"nhs-number", "943 476 5919", true},
+		{"nhs-number", "943-476-5919", true},
+		{"nhs-number", "9434765918", false},
+		{"nhs-number", "943476591", false},
+		{"nhs-number", "0000000060", false}, // a check digit of 10
+		{"chi-number", "0101011237", true},
+		{"chi-number", "3201011237", false}, // no 32nd of January
+		{"hcn", "320 000 0007", true},
+		{"hcn", "9434765919", false},
+		{"ni-number", "ab 12 34 56 c", true},
+		{"ni-number", "QQ123456C", false},
+		{"ni-number", "GB123456A", false},
+		{"ni-number", "AO123456A", false},
+		{"ni-number", "AB123456E", false},
+		{"luhn", "79927398713", true},
+		{"luhn", "79927398710", false},
+	} {
+		if got := identifierFormats[c.format].valid(c.id); got != c.ok {
+			t.Errorf("Expected %s %q to be valid %v, got %v", c.format, c.id, c.ok, got)
+		}
+	}
+}
+
+func TestIdentifierFields(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 10
+	server.cfg.QueueServices = []string{"general", "health-visits"}
+	server.cfg.CustomFields = map[string]*fieldSchema{}
+	json.Unmarshal([]byte(`{"health-visits": {"type": "object", "required": ["nhsNumber"],
+		"properties": {"nhsNumber": {"type": "string", "format": "nhs-number"}}}}`), &server.cfg.CustomFields)
+	server.cfg.CustomFields["health-visits"].compile()
+	router := server.routes()
+
+	w := postAppointment(t, router, AppointmentRequest{FirstName: "Ffion", LastName: "Claf", VisitDate: "2075-06-17", Service: "health-visits", CustomFields: CustomFields{"nhsNumber": "943 476 5918"}})
+	var errs CustomFieldErrors
+	json.Unmarshal(w.Body.Bytes(), &errs)
+	if w.Code != http.StatusBadRequest || len(errs.Fields) != 1 || errs.Fields[0].Field != "nhsNumber" || errs.Fields[0].Problem != "isn't a valid NHS number" {
+		t.Errorf("Expected the NHS number refused by field, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = postAppointment(t, router, AppointmentRequest{FirstName: "Ffion", LastName: "Claf", VisitDate: "2075-06-17", Service: "health-visits", CustomFields: CustomFields{"nhsNumber": "943 476 5919"}})
+	var booked Appointment
+	json.Unmarshal(w.Body.Bytes(), &booked)
+	if w.Code != http.StatusCreated || booked.CustomFields["nhsNumber"] != "9434765919" {
+		t.Errorf("Expected it kept without the spaces, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := (&fieldSchema{Format: "passport"}).compile(); err == nil {
+		t.Errorf("Expected an unknown format refused")
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Some people just reply "please cancel" to their confirmation. Mailgun
+// or SES hands us the reply, and if it's plainly them asking to cancel
+// it's cancelled. Anything else is kept for staff to read, nobody's
+// email gets lost because we couldn't make sense of it
+const (
+	InboundCancelled = "cancelled"
+	InboundFlagged   = "flagged"
+)
+
+const (
+	inboundMaxBytes = 10 << 20        // attachments and all, we only read the text
+	inboundMaxAge   = 5 * time.Minute // how old a Mailgun signature can be
+)
+
+// Our emails say "Your reference is 12", "(reference 12)" or "Eich
+// cyfeirnod yw 12", and replies quote them
+var inboundReference = regexp.MustCompile(`(?i)\b(?:reference|ref|cyfeirnod)(?:\s+(?:is|yw|no\.?|number|rhif))?\s*[:#]?\s*(\d+)\b`)
+
+// Only in what they wrote themselves, not the quoted email. Anything
+// that sounds like they want another day instead is for staff
+var (
+	inboundCancel = regexp.MustCompile(`(?i)\b(?:cancel|canslo|canslwch|ganslo)`)
+	inboundDoubt  = regexp.MustCompile(`(?i)\b(?:don'?t|do not|peidiwch|instead|rather|change|move|rebook|reschedule|newid|symud)\b`)
+	inboundQuoted = regexp.MustCompile(`(?i)^(?:>|on .+ wrote:$|ar .+ ysgrifennodd.*:$|-+ ?original message ?-+$|from: )`)
+)
+
+type InboundEmail struct {
+	XMLName       xml.Name   `json:"-" xml:"inboundEmail"`
+	ID            int        `json:"id" xml:"id,attr"`
+	ReceivedAt    time.Time  `json:"receivedAt" xml:"receivedAt"`
+	From          string     `json:"from" xml:"from"`
+	Subject       string     `json:"subject" xml:"subject"`
+	AppointmentID int        `json:"appointmentId,omitempty" xml:"appointmentId,omitempty"`
+	Action        string     `json:"action" xml:"action"`                     // cancelled or flagged
+	Reason        string     `json:"reason,omitempty" xml:"reason,omitempty"` // why it wasn't cancelled
+	Text          string     `json:"text" xml:"text"`                         // what they wrote, without the email they replied to
+	ReviewedBy    string     `json:"reviewedBy,omitempty" xml:"reviewedBy,omitempty"`
+	ReviewedAt    *time.Time `json:"reviewedAt,omitempty" xml:"reviewedAt,omitempty"`
+}
+
+type InboundEmailList struct {
+	XMLName xml.Name       `json:"-" xml:"inboundEmails"`
+	Emails  []InboundEmail `json:"emails" xml:"inboundEmail"`
+}
+
+// A reply as the provider handed it over
+type inboundMessage struct {
+	MessageID string
+	From      string // the From header
+	Subject   string
+	Body      string // the text part, quoted thread and all
+	Own       string // without the quoted thread, if the provider already took it off
+	Verified  bool   // the provider checked it came from the From address's domain
+}
+
+func (s *Server) initInboundEmails() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS inbound_emails (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT UNIQUE,
+		received_at DATETIME NOT NULL,
+		sender TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		appointment_id INTEGER,
+		action TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		text TEXT NOT NULL,
+		reviewed_by TEXT,
+		reviewed_at DATETIME
+	)`)
+	return err
+}
+
+func (s *Server) inboundEmails(ctx context.Context, where string, args ...any) ([]InboundEmail, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, received_at, sender, subject, appointment_id, action, reason, text, reviewed_by, reviewed_at FROM inbound_emails "+where+" ORDER BY received_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := []InboundEmail{}
+	for rows.Next() {
+		var e InboundEmail
+		var appointmentID sql.NullInt64
+		var reviewedBy sql.NullString
+		var reviewedAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.ReceivedAt, &e.From, &e.Subject, &appointmentID, &e.Action, &e.Reason, &e.Text, &reviewedBy, &reviewedAt); err != nil {
+			return nil, err
+		}
+		e.AppointmentID, e.ReviewedBy = int(appointmentID.Int64), reviewedBy.String
+		if reviewedAt.Valid {
+			e.ReviewedAt = &reviewedAt.Time
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// Whatever's quoted from the email they replied to, and everything
+// after, goes
+func ownText(body string) string {
+	var own []string
+	for line := range strings.SplitSeq(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		if inboundQuoted.MatchString(strings.TrimSpace(line)) {
+			break
+		}
+		own = append(own, line)
+	}
+	return strings.TrimSpace(strings.Join(own, "\n"))
+}
+
+// The different references anywhere in it, a reply quotes the one it's
+// a reply to
+func inboundReferences(texts ...string) []int {
+	var ids []int
+	for _, text := range texts {
+		for _, m := range inboundReference.FindAllStringSubmatch(text, -1) {
+			id, err := strconv.Atoi(m[1])
+			if err == nil && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// Cancels if it's safe to, otherwise says why not. A reference alone
+// isn't enough, it has to be from the address the booking has, checked
+// by the provider, and plainly asking to cancel
+func (s *Server) receiveInboundEmail(ctx context.Context, msg inboundMessage) (InboundEmail, error) {
+	// Providers send again if they don't hear back in time
+	if msg.MessageID != "" {
+		seen, err := s.inboundEmails(ctx, "WHERE message_id = ?", msg.MessageID)
+		if err != nil {
+			return InboundEmail{}, err
+		}
+		if len(seen) > 0 {
+			return seen[0], nil
+		}
+	}
+
+	email := InboundEmail{ReceivedAt: time.Now().UTC(), From: msg.From, Subject: msg.Subject, Action: InboundFlagged}
+	if addr, err := mail.ParseAddress(msg.From); err == nil {
+		email.From = strings.ToLower(addr.Address)
+	}
+	if msg.Own == "" {
+		msg.Own = ownText(msg.Body)
+	}
+	email.Text = msg.Own
+
+	var cancelled *Appointment
+	ids := inboundReferences(msg.Subject, msg.Body)
+	switch {
+	case len(ids) == 0:
+		email.Reason = "no_reference"
+	case len(ids) > 1:
+		email.Reason = "several_references"
+	default:
+		email.AppointmentID = ids[0]
+		appointment, err := s.store.Get(ctx, ids[0])
+		today, _ := s.today()
+		switch {
+		case errors.Is(err, ErrAppointmentNotFound):
+			email.Reason = "unknown_reference"
+		case err != nil:
+			return InboundEmail{}, err
+		case appointment.Email == "" || !strings.EqualFold(appointment.Email, email.From):
+			email.Reason = "sender_mismatch"
+		case !msg.Verified:
+			email.Reason = "unverified_sender"
+		case !inboundCancel.MatchString(msg.Own) || inboundDoubt.MatchString(msg.Own):
+			email.Reason = "unclear"
+		case appointment.CheckedInAt != nil:
+			email.Reason = "checked_in"
+		case appointment.VisitDate < today.Format("2006-01-02"):
+			email.Reason = "past_date"
+		default:
+			appointment, err = s.store.Cancel(withActor(ctx, ActorEmail), ids[0])
+			if errors.Is(err, ErrAppointmentNotFound) {
+				email.Reason = "unknown_reference"
+				break
+			}
+			if err != nil {
+				return InboundEmail{}, err
+			}
+			email.Action, cancelled = InboundCancelled, &appointment
+		}
+	}
+	if email.Reason == "unknown_reference" {
+		email.AppointmentID = 0
+	}
+
+	var messageID, appointmentID any
+	if msg.MessageID != "" {
+		messageID = msg.MessageID
+	}
+	if email.AppointmentID != 0 {
+		appointmentID = email.AppointmentID
+	}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO inbound_emails (message_id, received_at, sender, subject, appointment_id, action, reason, text) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		messageID, email.ReceivedAt, email.From, email.Subject, appointmentID, email.Action, email.Reason, email.Text).Scan(&email.ID)
+	if err != nil {
+		// Cancelled all the same, it just isn't on the list
+		log.Printf("Error saving inbound email from %s: %v", email.From, err)
+	}
+
+	if cancelled != nil {
+		log.Printf("Appointment %d cancelled by a reply from %s", cancelled.ID, email.From)
+		s.invalidateAvailability(ctx)
+		go func() {
+			ctx, cancel := withTimeout(context.WithoutCancel(ctx), s.cfg.NotifyTimeout)
+			defer cancel()
+			s.notifyAppointment(ctx, MessageCancellation, *cancelled)
+		}()
+	} else {
+		log.Printf("Inbound email %d from %s flagged for review: %s", email.ID, email.From, email.Reason)
+	}
+	return email, err
+}
+
+func (s *Server) answerInboundEmail(w http.ResponseWriter, r *http.Request, msg inboundMessage) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	// Once it's cancelled it's answered, sending it again wouldn't help
+	email, err := s.receiveInboundEmail(ctx, msg)
+	if err != nil && email.Action != InboundCancelled {
+		log.Printf("Error handling inbound email from %s: %v", msg.From, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to handle the email")
+		return
+	}
+	s.respond(w, r, http.StatusOK, email)
+}
+
+// POST /inbound/email/mailgun, where a Mailgun route forwards replies.
+// It's signed with the webhook signing key
+func (s *Server) mailgunInboundEmail(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.MailgunSigningKey == "" {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodeInboundDisabled, "Inbound email from Mailgun is not enabled")
+		return
+	}
+	ip := clientIP(r)
+	if s.lockedOut(w, r, "mailgun", ip) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, inboundMaxBytes)
+	if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidForm, "Couldn't read the form")
+		return
+	}
+	if !mailgunSigned(s.cfg.MailgunSigningKey, r.FormValue("timestamp"), r.FormValue("token"), r.FormValue("signature"), time.Now()) {
+		s.tokenFailed(r.Context(), "mailgun", ip)
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeInvalidSignature, "The Mailgun signature doesn't match")
+		return
+	}
+	// The signature's only over the timestamp and token, not the email,
+	// so each token goes once. It's kept for as long as the timestamp
+	// would pass, inboundMaxAge either side of now
+	key := "mailgun-token:" + r.FormValue("token")
+	n, err := s.cache.Incr(r.Context(), key, 2*inboundMaxAge)
+	if err != nil {
+		log.Printf("Error claiming Mailgun token: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed checking the signature")
+		return
+	}
+	if n > 1 {
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeInvalidSignature, "That Mailgun signature has been used already")
+		return
+	}
+	// One that fails on our side can come again
+	capture := &capturingWriter{ResponseWriter: w}
+	defer func() {
+		if capture.status < 200 || capture.status >= 300 {
+			if err := s.cache.Delete(context.WithoutCancel(r.Context()), key); err != nil {
+				log.Printf("Error releasing Mailgun token: %v", err)
+			}
+		}
+	}()
+	w = capture
+
+	// Mailgun passes on the headers as [[name, value], ...]
+	var pairs [][2]string
+	json.Unmarshal([]byte(r.FormValue("message-headers")), &pairs)
+	headers := textproto.MIMEHeader{}
+	for _, p := range pairs {
+		headers.Add(p[0], p[1])
+	}
+
+	msg := inboundMessage{
+		MessageID: headers.Get("Message-Id"),
+		From:      r.FormValue("from"),
+		Subject:   r.FormValue("subject"),
+		Body:      r.FormValue("body-plain"),
+		Own:       strings.TrimSpace(r.FormValue("stripped-text")),
+	}
+	// Mailgun's DKIM check only says a signature passed, not whose, so
+	// every signature has to be for the From domain. SPF only checks the
+	// envelope sender, so that has to be the From address too
+	sender, _ := mail.ParseAddress(r.FormValue("sender"))
+	from, _ := mail.ParseAddress(msg.From)
+	dkim := strings.EqualFold(headers.Get("X-Mailgun-Dkim-Check-Result"), "Pass") && from != nil && dkimAligned(headers.Values("Dkim-Signature"), from.Address)
+	spf := strings.EqualFold(headers.Get("X-Mailgun-Spf"), "Pass") && sender != nil && from != nil && strings.EqualFold(sender.Address, from.Address)
+	msg.Verified = dkim || spf
+	s.answerInboundEmail(w, r, msg)
+}
+
+// Whether there are DKIM signatures and they're all by the address's
+// domain or one it's under, d=example.com for dana@mail.example.com
+func dkimAligned(signatures []string, address string) bool {
+	_, domain, _ := strings.Cut(strings.ToLower(address), "@")
+	for _, signature := range signatures {
+		var d string
+		for tag := range strings.SplitSeq(signature, ";") {
+			if name, value, ok := strings.Cut(tag, "="); ok && strings.TrimSpace(name) == "d" {
+				d = strings.ToLower(strings.Join(strings.Fields(value), ""))
+			}
+		}
+		if d == "" || (domain != d && !strings.HasSuffix(domain, "."+d)) {
+			return false
+		}
+	}
+	return domain != "" && len(signatures) > 0
+}
+
+func mailgunSigned(key, timestamp, token, signature string, now time.Time) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || now.Sub(time.Unix(sec, 0)).Abs() > inboundMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	want := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(signature))
+}
+
+// What SNS posts, and the SES notification in its Message
+type snsEnvelope struct {
+	Type         string
+	MessageId    string
+	TopicArn     string
+	Message      string
+	SubscribeURL string
+}
+
+type sesVerdict struct {
+	Status string `json:"status"`
+}
+
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Mail             struct {
+		MessageID     string `json:"messageId"`
+		Source        string `json:"source"`
+		CommonHeaders struct {
+			From      []string `json:"from"`
+			Subject   string   `json:"subject"`
+			MessageID string   `json:"messageId"`
+		} `json:"commonHeaders"`
+	} `json:"mail"`
+	Receipt struct {
+		SPFVerdict   sesVerdict `json:"spfVerdict"`
+		DKIMVerdict  sesVerdict `json:"dkimVerdict"`
+		DMARCVerdict sesVerdict `json:"dmarcVerdict"`
+		Action       struct {
+			Type     string `json:"type"`
+			Encoding string `json:"encoding"` // UTF8 or BASE64
+		} `json:"action"`
+	} `json:"receipt"`
+	Content string `json:"content"` // the whole email, with an SNS action
+}
+
+// POST /inbound/email/ses?token=..., the HTTPS endpoint subscribed to
+// the SNS topic an SES receipt rule publishes to. SNS can't send a
+// bearer token, so it's in the URL
+func (s *Server) sesInboundEmail(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.SESInboundToken == "" {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodeInboundDisabled, "Inbound email from SES is not enabled")
+		return
+	}
+	ip := clientIP(r)
+	if s.lockedOut(w, r, "ses", ip) {
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(s.cfg.SESInboundToken)) != 1 {
+		s.tokenFailed(r.Context(), "ses", ip)
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeUnauthorized, "A valid inbound email token is required")
+		return
+	}
+
+	var envelope snsEnvelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, inboundMaxBytes)).Decode(&envelope); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	switch envelope.Type {
+	case "SubscriptionConfirmation":
+		// Someone confirms it by hand, we don't go fetching URLs we're sent
+		log.Printf("SNS subscription to %s waiting to be confirmed, visit %s", envelope.TopicArn, envelope.SubscribeURL)
+		w.WriteHeader(http.StatusOK)
+		return
+	case "Notification":
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var notification sesNotification
+	if err := json.Unmarshal([]byte(envelope.Message), &notification); err != nil || notification.NotificationType != "Received" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidNotification, "Not an SES received email notification")
+		return
+	}
+	headers := notification.Mail.CommonHeaders
+	msg := inboundMessage{
+		MessageID: cmp.Or(headers.MessageID, notification.Mail.MessageID),
+		Subject:   headers.Subject,
+	}
+	if len(headers.From) > 0 {
+		msg.From = headers.From[0]
+	}
+
+	raw := notification.Content
+	if strings.EqualFold(notification.Receipt.Action.Encoding, "BASE64") {
+		decoded, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidNotification, "The email content isn't base64")
+			return
+		}
+		raw = string(decoded)
+	}
+	// Without the content, e.g. from an S3 action, there's only the
+	// subject to go on, so it'll be flagged
+	if raw != "" {
+		body, err := emailText(raw)
+		if err != nil {
+			log.Printf("Error reading inbound email %s: %v", msg.MessageID, err)
+		}
+		msg.Body = body
+	}
+
+	// DMARC is DKIM or SPF lined up with the From domain. SES's own DKIM
+	// and SPF verdicts are for whoever signed or sent it, which needn't be
+	// the From domain at all
+	msg.Verified = notification.Receipt.DMARCVerdict.Status == "PASS"
+	s.answerInboundEmail(w, r, msg)
+}
+
+// The plain text of a whole email, whichever part of it that's in
+func emailText(raw string) (string, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	return textPart(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+func textPart(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(cmp.Or(header.Get("Content-Type"), "text/plain"))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			if text, err := textPart(part.Header, part); err != nil || text != "" {
+				return text, err
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	text, err := io.ReadAll(io.LimitReader(body, inboundMaxBytes))
+	return string(text), err
+}
+
+// GET /admin/inbound-emails, the flagged ones nobody's looked at yet, or
+// with ?all=true everything that's come in
+func (s *Server) listInboundEmails(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	where := "WHERE action = 'flagged' AND reviewed_at IS NULL"
+	if r.URL.Query().Get("all") == "true" {
+		where = ""
+	}
+	emails, err := s.inboundEmails(ctx, where)
+	if err != nil {
+		log.Printf("Error listing inbound emails: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list inbound emails")
+		return
+	}
+	s.respond(w, r, http.StatusOK, InboundEmailList{Emails: emails})
+}
+
+// POST /admin/inbound-emails/{id}/review, once staff have dealt with it
+func (s *Server) reviewInboundEmail(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	emails, err := s.inboundEmails(ctx, "WHERE id = ?", id)
+	if err != nil {
+		log.Printf("Error loading inbound email %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load the email")
+		return
+	}
+	if len(emails) == 0 {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No inbound email with that ID")
+		return
+	}
+	email := emails[0]
+	if email.ReviewedAt != nil {
+		s.sendErrorResponse(w, r, http.StatusConflict, CodeAlreadyReviewed, "Someone has already reviewed it")
+		return
+	}
+
+	now := time.Now().UTC()
+	email.ReviewedBy, email.ReviewedAt = actorFrom(r.Context()), &now
+	if _, err := s.db.ExecContext(ctx, "UPDATE inbound_emails SET reviewed_by = ?, reviewed_at = ? WHERE id = ?", email.ReviewedBy, now, id); err != nil {
+		log.Printf("Error reviewing inbound email %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to save the review")
+		return
+	}
+	s.respond(w, r, http.StatusOK, email)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mailgunForm(key, from, body, messageID string, headers [][2]string) url.Values {
+	timestamp, token := strconv.FormatInt(time.Now().Unix(), 10), "token-"+strconv.FormatInt(time.Now().UnixNano(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + token))
+	headersJSON, _ := json.Marshal(append(headers, [2]string{"Message-Id", messageID}))
+	return url.Values{
+		"timestamp":       {timestamp},
+		"token":           {token},
+		"signature":       {hex.EncodeToString(mac.Sum(nil))},
+		"sender":          {from},
+		"from":            {"Dana <" + from + ">"},
+		"subject":         {"Re: Your appointment"},
+		"body-plain":      {body},
+		"message-headers": {string(headersJSON)},
+	}
+}
+
+func TestInboundEmail(t *testing.T) {
+	server, sent := closureServer(t, "sqlite")
+	server.cfg.MailgunSigningKey = "mailgun-key"
+	server.cfg.SESInboundToken = "ses-token"
+	router := server.routes()
+
+	for range 2 {
+		if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Reply", Email: "dana@example.com", VisitDate: "2075-01-09"}); w.Code != http.StatusCreated {
+			t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+		}
+		sent.next(t)
+	}
+	mailgun := func(form url.Values) (*httptest.ResponseRecorder, InboundEmail) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/inbound/email/mailgun", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		router.ServeHTTP(w, req)
+		var email InboundEmail
+		json.Unmarshal(w.Body.Bytes(), &email)
+		return w, email
+	}
+	dkim := [][2]string{{"X-Mailgun-Dkim-Check-Result", "Pass"}, {"DKIM-Signature", "v=1; a=rsa-sha256; d=example.com; s=mail; bh=x; b=y"}}
+	reply := "Please cancel, I can't make it.\n\nOn Tue, 1 Jan 2075 at 09:00, CityNext wrote:\n> Your appointment on 2075-01-09 is confirmed. Your reference is 1.\n"
+
+	w, email := mailgun(mailgunForm("mailgun-key", "Dana@Example.com", reply, "<a@mail>", dkim))
+	if w.Code != http.StatusOK || email.Action != InboundCancelled || email.AppointmentID != 1 || email.Text != "Please cancel, I can't make it." {
+		t.Fatalf("Expected the appointment cancelled, got %d: %s", w.Code, w.Body.String())
+	}
+	if msg := sent.next(t); !strings.Contains(msg.Text, "cancelled") {
+		t.Errorf("Expected the cancellation sent, got %+v", msg)
+	}
+	// Mailgun sending it again changes nothing
+	if _, again := mailgun(mailgunForm("mailgun-key", "dana@example.com", reply, "<a@mail>", dkim)); again.ID != email.ID || again.Action != InboundCancelled {
+		t.Errorf("Expected the same answer again, got %+v", again)
+	}
+
+	for i, c := range []struct {
+		from, body string
+		headers    [][2]string
+		reason     string
+	}{
+		{"dana@example.com", "Please cancel", dkim, "no_reference"},
+		{"mallory@example.com", "Cancel reference 2 please", dkim, "sender_mismatch"},
+		{"dana@example.com", "Cancel reference 2 please", [][2]string{{"X-Mailgun-Spf", "Fail"}}, "unverified_sender"},
+		// Signed, but by someone else's domain
+		{"dana@example.com", "Cancel reference 2 please", [][2]string{{"X-Mailgun-Dkim-Check-Result", "Pass"}, {"DKIM-Signature", "v=1; d=mallory.example; s=mail"}}, "unverified_sender"},
+		{"dana@example.com", "Cancel reference 2 please", append([][2]string{{"DKIM-Signature", "v=1; d=mallory.example; s=mail"}}, dkim...), "unverified_sender"},
+		{"dana@example.com", "Cancel reference 2 please", [][2]string{{"X-Mailgun-Dkim-Check-Result", "Pass"}}, "unverified_sender"},
+		{"dana@example.com", "Can I move it to next week instead of cancelling?\n> Your reference is 2.", dkim, "unclear"},
+		{"dana@example.com", "Thanks!\n> Your reference is 2.", dkim, "unclear"},
+		{"dana@example.com", "Cancel both please, reference 1 and reference 2", dkim, "several_references"},
+		{"dana@example.com", "Cancel reference 99", dkim, "unknown_reference"},
+	} {
+		w, email := mailgun(mailgunForm("mailgun-key", c.from, c.body, "<"+strconv.Itoa(i)+"@mail>", c.headers))
+		if w.Code != http.StatusOK || email.Action != InboundFlagged || email.Reason != c.reason {
+			t.Errorf("Expected %q flagged as %s, got %d: %s", c.body, c.reason, w.Code, w.Body.String())
+		}
+	}
+	if w, _ := mailgun(mailgunForm("wrong-key", "dana@example.com", reply, "<b@mail>", dkim)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a bad signature refused, got %d: %s", w.Code, w.Body.String())
+	}
+	// A signature seen once can't be put on another email
+	replayed := mailgunForm("mailgun-key", "dana@example.com", "Thanks!", "<c@mail>", dkim)
+	if w, _ := mailgun(replayed); w.Code != http.StatusOK {
+		t.Fatalf("Expected the email taken, got %d: %s", w.Code, w.Body.String())
+	}
+	replayed.Set("body-plain", "Cancel reference 2 please")
+	replayed.Set("message-headers", `[["Message-Id", "<d@mail>"]]`)
+	if w, _ := mailgun(replayed); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a replayed signature refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// SES through SNS, a multipart reply in Welsh
+	raw := "From: Dana <dana@example.com>\r\nSubject: Re: Eich apwyntiad\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=b1\r\n\r\n" +
+		"--b1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nCanslwch os gwelwch yn dda=\r\n, diolch\r\n\r\n> Eich cyfeirnod yw 2.\r\n" +
+		"--b1\r\nContent-Type: text/html\r\n\r\n<p>Canslwch</p>\r\n--b1--\r\n"
+	notification, _ := json.Marshal(map[string]any{
+		"notificationType": "Received",
+		"mail":             map[string]any{"messageId": "ses-1", "source": "bounce@example.net", "commonHeaders": map[string]any{"from": []string{"Dana <dana@example.com>"}, "subject": "Re: Eich apwyntiad"}},
+		"receipt":          map[string]any{"spfVerdict": map[string]string{"status": "PASS"}, "dmarcVerdict": map[string]string{"status": "PASS"}, "action": map[string]string{"type": "SNS", "encoding": "BASE64"}},
+		"content":          base64.StdEncoding.EncodeToString([]byte(raw)),
+	})
+	ses := func(token, kind string, message []byte) (*httptest.ResponseRecorder, InboundEmail) {
+		body, _ := json.Marshal(map[string]string{"Type": kind, "TopicArn": "arn:aws:sns:eu-west-2:1:replies", "Message": string(message), "SubscribeURL": "https://sns.example/confirm"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/inbound/email/ses?token="+token, strings.NewReader(string(body))))
+		var email InboundEmail
+		json.Unmarshal(w.Body.Bytes(), &email)
+		return w, email
+	}
+	if w, _ := ses("ses-token", "SubscriptionConfirmation", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the subscription logged, got %d: %s", w.Code, w.Body.String())
+	}
+	if w, _ := ses("wrong", "Notification", notification); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token refused, got %d", w.Code)
+	}
+	// DKIM and SPF passing for some other domain isn't DMARC
+	undmarced, _ := json.Marshal(map[string]any{
+		"notificationType": "Received",
+		"mail":             map[string]any{"messageId": "ses-0", "source": "dana@example.com", "commonHeaders": map[string]any{"from": []string{"Dana <dana@example.com>"}, "subject": "Cancel reference 2"}},
+		"receipt":          map[string]any{"spfVerdict": map[string]string{"status": "PASS"}, "dkimVerdict": map[string]string{"status": "PASS"}, "dmarcVerdict": map[string]string{"status": "FAIL"}},
+	})
+	if w, email := ses("ses-token", "Notification", undmarced); w.Code != http.StatusOK || email.Reason != "unverified_sender" {
+		t.Errorf("Expected it flagged as unverified, got %d: %s", w.Code, w.Body.String())
+	}
+	w, email = ses("ses-token", "Notification", notification)
+	if w.Code != http.StatusOK || email.Action != InboundCancelled || email.AppointmentID != 2 || email.Text != "Canslwch os gwelwch yn dda, diolch" {
+		t.Fatalf("Expected the Welsh reply to cancel, got %d: %s", w.Code, w.Body.String())
+	}
+	sent.next(t)
+
+	// The flagged ones wait for staff
+	list := func() []InboundEmail {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", "/admin/inbound-emails", nil))
+		var list InboundEmailList
+		json.Unmarshal(w.Body.Bytes(), &list)
+		return list.Emails
+	}
+	flagged := list()
+	if len(flagged) != 12 || flagged[0].Reason != "no_reference" {
+		t.Fatalf("Expected the twelve flagged, got %+v", flagged)
+	}
+	review := "/admin/inbound-emails/" + strconv.Itoa(flagged[0].ID) + "/review"
+	for _, code := range []int{http.StatusOK, http.StatusConflict} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", review, nil))
+		if w.Code != code {
+			t.Errorf("Expected %d reviewing it, got %d: %s", code, w.Code, w.Body.String())
+		}
+	}
+	if n := len(list()); n != 11 {
+		t.Errorf("Expected the reviewed one off the list, got %d", n)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The council's IVR answers the phone line with "say or key in your
+// reference". It's on /channel/ivr with its own token, and gets back
+// one flat answer it can branch on by result. Someone's waiting on the
+// line, so it's never kept long, and anything going wrong on our side
+// is try_later rather than an error the IVR would hang up on
+const ivrTimeout = 3 * time.Second
+
+const (
+	IVRFound        = "found"
+	IVRNotFound     = "not_found"
+	IVRInvalid      = "invalid_reference" // nothing we could make a number of
+	IVRConfirmed    = "confirmed"
+	IVRCancelled    = "cancelled"
+	IVRCheckedIn    = "checked_in" // too late to change anything
+	IVRPast         = "past"
+	IVRDateMismatch = "date_mismatch"
+	IVRTryLater     = "try_later"
+)
+
+type IVRResponse struct {
+	XMLName    xml.Name `json:"-" xml:"ivr"`
+	Result     string   `json:"result" xml:"result"`
+	Reference  string   `json:"reference,omitempty" xml:"reference,omitempty"` // digits, to read back
+	VisitDate  string   `json:"visitDate,omitempty" xml:"visitDate,omitempty"`
+	Weekday    string   `json:"weekday,omitempty" xml:"weekday,omitempty"`
+	Service    string   `json:"service,omitempty" xml:"service,omitempty"`
+	People     int      `json:"people,omitempty" xml:"people,omitempty"`
+	Confirmed  bool     `json:"confirmed" xml:"confirmed"` // they've said they're coming on this day
+	RetryAfter int      `json:"retryAfter,omitempty" xml:"retryAfter,omitempty"`
+}
+
+// What speech recognition makes of someone reading out "one two oh",
+// in English or Welsh
+var spokenDigits = map[string]string{
+	"zero": "0", "oh": "0", "o": "0", "one": "1", "two": "2", "three": "3", "four": "4",
+	"five": "5", "six": "6", "seven": "7", "eight": "8", "nine": "9",
+	"dim": "0", "un": "1", "dau": "2", "dwy": "2", "tri": "3", "tair": "3", "pedwar": "4", "pedair": "4",
+	"pump": "5", "chwech": "6", "saith": "7", "wyth": "8", "naw": "9",
+}
+
+// The digits in "1 2 3", "one two three", "123#" and "12-3", or false
+// if there's anything else in it
+func spokenDigitString(said string) (string, bool) {
+	var digits strings.Builder
+	for _, word := range strings.FieldsFunc(strings.ToLower(said), func(r rune) bool {
+		return r == ' ' || r == '-' || r == ',' || r == '.' || r == '#' || r == '*'
+	}) {
+		if d, ok := spokenDigits[word]; ok {
+			digits.WriteString(d)
+			continue
+		}
+		for _, r := range word {
+			if r < '0' || r > '9' {
+				return "", false
+			}
+		}
+		digits.WriteString(word)
+	}
+	return digits.String(), digits.Len() > 0
+}
+
+// "1 2 3", "one two three", "123#" and "12-3" are all 123
+func spokenReference(said string) (int, bool) {
+	digits, ok := spokenDigitString(said)
+	if !ok || len(digits) > 9 {
+		return 0, false
+	}
+	id, err := strconv.Atoi(digits)
+	return id, err == nil && id > 0
+}
+
+// Whether what they said is the day they're booked for, as 2075-01-09
+// or keyed in day and month, 0901, or with the year, 09012075. The
+// reference is only a number, so it's this that says it's their booking
+func spokenVisitDate(said, visitDate string) bool {
+	if said == visitDate {
+		return true
+	}
+	d, err := time.Parse("2006-01-02", visitDate)
+	digits, ok := spokenDigitString(said)
+	if err != nil || !ok {
+		return false
+	}
+	return digits == d.Format("0201") || digits == d.Format("02012006")
+}
+
+func (s *Server) requireIVR(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.IVRToken == "" {
+			s.sendErrorResponse(w, r, http.StatusForbidden, CodeChannelDisabled, "The IVR channel is not enabled")
+			return
+		}
+		if !s.checkToken(w, r, ActorIVR, s.cfg.IVRToken, "A valid IVR token is required") {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withActor(r.Context(), ivrActor(r.Header.Get(headerCallReference)))))
+	})
+}
+
+// Changes are by "ivr:<call reference>" in the history when the IVR
+// sends one, so staff can find the call
+func ivrActor(callReference string) string {
+	if callReference == "" {
+		return ActorIVR
+	}
+	return ActorIVR + ":" + callReference
+}
+
+// Always a 200, the IVR only has to look at result
+func (s *Server) ivrRespond(w http.ResponseWriter, r *http.Request, res IVRResponse) {
+	if res.Result == IVRTryLater {
+		res.RetryAfter = 60
+		w.Header().Set("Retry-After", strconv.Itoa(res.RetryAfter))
+	}
+	s.respond(w, r, http.StatusOK, res)
+}
+
+// The booking they read out, if the visitDate they gave with it is its
+// day, or the answer to give if not
+func (s *Server) ivrAppointment(ctx context.Context, r *http.Request) (Appointment, IVRResponse) {
+	id, ok := spokenReference(mux.Vars(r)["reference"])
+	if !ok {
+		return Appointment{}, IVRResponse{Result: IVRInvalid}
+	}
+	res := IVRResponse{Reference: strconv.Itoa(id)}
+	appointment, err := s.store.Get(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		res.Result = IVRNotFound
+		return Appointment{}, res
+	}
+	// Nothing about it, not even that the date's wrong rather than missing
+	if err == nil && !spokenVisitDate(r.FormValue("visitDate"), appointment.VisitDate) {
+		res.Result = IVRDateMismatch
+		return Appointment{}, res
+	}
+	if err == nil {
+		res, err = s.ivrDescribe(ctx, appointment, IVRFound)
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d for the IVR: %v", id, err)
+		return Appointment{}, IVRResponse{Result: IVRTryLater, Reference: res.Reference}
+	}
+	return appointment, res
+}
+
+func (s *Server) ivrDescribe(ctx context.Context, appointment Appointment, result string) (IVRResponse, error) {
+	res := IVRResponse{
+		Result:    result,
+		Reference: strconv.Itoa(appointment.ID),
+		VisitDate: appointment.VisitDate,
+		Service:   appointment.Service,
+		People:    appointment.PartySize(),
+	}
+	if d, err := time.Parse("2006-01-02", appointment.VisitDate); err == nil {
+		res.Weekday = d.Weekday().String()
+	}
+	history, err := s.store.History(ctx, appointment.ID)
+	if err != nil {
+		return res, err
+	}
+	// Confirming one day doesn't confirm the day it's moved to
+	for _, rev := range history {
+		if rev.Change == RevisionConfirmed {
+			res.Confirmed = rev.VisitDate == appointment.VisitDate
+		}
+	}
+	return res, nil
+}
+
+// Ones they've checked in for, or whose day has gone, are left alone
+func (s *Server) ivrChangeable(appointment Appointment) string {
+	if appointment.CheckedInAt != nil {
+		return IVRCheckedIn
+	}
+	if today, err := s.today(); err == nil && appointment.VisitDate < today.Format("2006-01-02") {
+		return IVRPast
+	}
+	return ""
+}
+
+// GET /channel/ivr/appointments/{reference}?visitDate=, each as it was
+// said or keyed in
+func (s *Server) ivrLookup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), min(s.cfg.DBTimeout, ivrTimeout))
+	defer cancel()
+
+	_, res := s.ivrAppointment(ctx, r)
+	s.ivrRespond(w, r, res)
+}
+
+// POST /channel/ivr/appointments/{reference}/confirm, when they press 1
+// to say they're coming
+func (s *Server) ivrConfirm(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), min(s.cfg.DBTimeout, ivrTimeout))
+	defer cancel()
+
+	appointment, res := s.ivrAppointment(ctx, r)
+	if res.Result != IVRFound {
+		s.ivrRespond(w, r, res)
+		return
+	}
+	if result := s.ivrChangeable(appointment); result != "" {
+		res.Result = result
+		s.ivrRespond(w, r, res)
+		return
+	}
+	if !res.Confirmed {
+		if _, err := s.store.Confirm(ctx, appointment.ID); err != nil {
+			log.Printf("Error confirming appointment %d from the IVR: %v", appointment.ID, err)
+			s.ivrRespond(w, r, IVRResponse{Result: IVRTryLater, Reference: res.Reference})
+			return
+		}
+	}
+	res.Result, res.Confirmed = IVRConfirmed, true
+	s.ivrRespond(w, r, res)
+}
+
+// POST /channel/ivr/appointments/{reference}/cancel, when they press 2
+func (s *Server) ivrCancel(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), min(s.cfg.DBTimeout, ivrTimeout))
+	defer cancel()
+
+	appointment, res := s.ivrAppointment(ctx, r)
+	if res.Result != IVRFound {
+		s.ivrRespond(w, r, res)
+		return
+	}
+	if result := s.ivrChangeable(appointment); result != "" {
+		res.Result = result
+		s.ivrRespond(w, r, res)
+		return
+	}
+
+	cancelled, err := s.store.Cancel(ctx, appointment.ID)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.ivrRespond(w, r, IVRResponse{Result: IVRNotFound, Reference: res.Reference})
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling appointment %d from the IVR: %v", appointment.ID, err)
+		s.ivrRespond(w, r, IVRResponse{Result: IVRTryLater, Reference: res.Reference})
+		return
+	}
+
+	s.invalidateAvailability(ctx)
+	res.Result = IVRCancelled
+	s.ivrRespond(w, r, res)
+
+	go func() {
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+		defer cancel()
+		s.notifyAppointment(ctx, MessageCancellation, cancelled)
+	}()
+}
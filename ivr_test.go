@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSpokenReference(t *testing.T) {
+	for said, want := range map[string]int{"12": 12, "1 2": 12, "one two": 12, "Un Dau Tri": 123, "4-oh-2#": 402, "": 0, "twelve": 0, "0": 0, "1234567890": 0} {
+		if got, _ := spokenReference(said); got != want {
+			t.Errorf("Expected %q to be %d, got %d", said, want, got)
+		}
+	}
+}
+
+func TestIVR(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, sent := closureServer(t, store)
+			server.cfg.IVRToken = "ivr-secret"
+			router := server.routes()
+
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Caller", Email: "dana@example.com", VisitDate: "2075-01-09"}); w.Code != http.StatusCreated {
+				t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+			}
+			sent.next(t)
+			ivr := func(method, reference, action, visitDate string) IVRResponse {
+				t.Helper()
+				target := "/channel/ivr/appointments/" + url.PathEscape(reference) + action + "?visitDate=" + url.QueryEscape(visitDate)
+				req := httptest.NewRequest(method, target, nil)
+				req.Header.Set("Authorization", "Bearer ivr-secret")
+				req.Header.Set(headerCallReference, "call-7")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				var res IVRResponse
+				if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &res) != nil {
+					t.Fatalf("Expected an answer for %s %s, got %d: %s", method, target, w.Code, w.Body.String())
+				}
+				return res
+			}
+
+			if res := ivr("GET", "one", "", "0901"); res.Result != IVRFound || res.Reference != "1" || res.VisitDate != "2075-01-09" || res.Weekday != "Wednesday" || res.People != 1 || res.Confirmed {
+				t.Errorf("Expected the booking read back, got %+v", res)
+			}
+			for reference, result := range map[string]string{"9 9": IVRNotFound, "hello": IVRInvalid} {
+				if res := ivr("GET", reference, "", "0901"); res.Result != result || res.VisitDate != "" {
+					t.Errorf("Expected %q to be %s, got %+v", reference, result, res)
+				}
+			}
+
+			// The reference alone is only a number, the day has to go with it
+			for action, method := range map[string]string{"": "GET", "/confirm": "POST", "/cancel": "POST"} {
+				for _, visitDate := range []string{"", "1001", "2075-01-10", "one"} {
+					if res := ivr(method, "1", action, visitDate); res.Result != IVRDateMismatch || res.VisitDate != "" || res.Service != "" {
+						t.Errorf("Expected %s with %q turned down, got %+v", action, visitDate, res)
+					}
+				}
+			}
+			if appointment, err := server.store.Get(t.Context(), 1); err != nil || appointment.VisitDate != "2075-01-09" {
+				t.Fatalf("Expected nothing cancelled, got %+v, %v", appointment, err)
+			}
+
+			// Confirming twice is one confirmation
+			for range 2 {
+				if res := ivr("POST", "1", "/confirm", "2075-01-09"); res.Result != IVRConfirmed || !res.Confirmed {
+					t.Errorf("Expected it confirmed, got %+v", res)
+				}
+			}
+			if res := ivr("GET", "1", "", "oh nine oh one two oh seven five"); !res.Confirmed {
+				t.Errorf("Expected it to stay confirmed, got %+v", res)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/1/history", nil))
+			var history History
+			json.Unmarshal(w.Body.Bytes(), &history)
+			if n := len(history.Revisions); n != 2 || history.Revisions[1].Change != RevisionConfirmed || history.Revisions[1].ChangedBy != "ivr:call-7" {
+				t.Errorf("Expected one confirmation in the history, got %s", w.Body.String())
+			}
+
+			// Moving it needs confirming again
+			router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/admin/appointments/1/reschedule", []byte(`{"visitDate": "2075-01-10"}`)))
+			sent.next(t)
+			if res := ivr("GET", "1", "", "1001"); res.Confirmed || res.VisitDate != "2075-01-10" {
+				t.Errorf("Expected the new day unconfirmed, got %+v", res)
+			}
+
+			if res := ivr("POST", "1", "/cancel", "1001"); res.Result != IVRCancelled {
+				t.Fatalf("Expected it cancelled, got %+v", res)
+			}
+			if msg := sent.next(t); !strings.Contains(msg.Text, "cancelled") {
+				t.Errorf("Expected the cancellation sent, got %+v", msg)
+			}
+			if res := ivr("POST", "1", "/cancel", "1001"); res.Result != IVRNotFound {
+				t.Errorf("Expected nothing left to cancel, got %+v", res)
+			}
+
+			// XML for VoiceXML platforms, and the token's required
+			req := httptest.NewRequest("GET", "/channel/ivr/appointments/1", nil)
+			req.Header.Set("Authorization", "Bearer ivr-secret")
+			req.Header.Set("Accept", "application/xml")
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			var res IVRResponse
+			if err := xml.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Result != IVRNotFound {
+				t.Errorf("Expected an XML answer, got %s", w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/channel/ivr/appointments/1", nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected the token required, got %d", w.Code)
+			}
+		})
+	}
+}
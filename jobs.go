@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every run of a background job, scheduled or by hand, leaves a row in
+// job_runs saying when, how it went and how much it got through: the
+// documents deleted, the messages retried. Kept for jobHistory
+type JobRun struct {
+	XMLName    xml.Name   `json:"-" xml:"run"`
+	ID         int64      `json:"id" xml:"id,attr"`
+	Job        string     `json:"job" xml:"job"`
+	Trigger    string     `json:"trigger" xml:"trigger"` // schedule, or who ran it by hand
+	StartedAt  time.Time  `json:"startedAt" xml:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty" xml:"finishedAt,omitempty"`
+	Outcome    string     `json:"outcome" xml:"outcome"` // running, ok or failed
+	Items      int        `json:"items" xml:"items"`
+	Error      string     `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// A job this replica has on a schedule
+type Job struct {
+	XMLName     xml.Name   `json:"-" xml:"job"`
+	Name        string     `json:"name" xml:"name,attr"`
+	Schedule    string     `json:"schedule" xml:"schedule"` // "every 1h0m0s", or the cron expression and its time zone
+	NextRunAt   *time.Time `json:"nextRunAt,omitempty" xml:"nextRunAt,omitempty"`
+	LastOutcome string     `json:"lastOutcome,omitempty" xml:"lastOutcome,omitempty"` // of the latest run on any replica
+}
+
+type JobList struct {
+	XMLName xml.Name `json:"-" xml:"jobs"`
+	Jobs    []Job    `json:"jobs" xml:"job"`
+	Runs    []JobRun `json:"runs" xml:"runs>run"` // newest first
+}
+
+const (
+	JobScheduled = "schedule"
+
+	JobRunning = "running"
+	JobOK      = "ok"
+	JobFailed  = "failed"
+)
+
+const (
+	jobHistory   = 30 * 24 * time.Hour
+	jobRunsShown = 100
+)
+
+// Every job there is, for their CITYNEXT_<JOB>_SCHEDULE settings
+var jobNames = []string{"backup", "delivery-retries", "document-retention", "holiday-refresh", "integrity-check", "monthly-report", "reminders", "replication"}
+
+// A job returns how many things it did
+type jobFunc func(ctx context.Context) (int, error)
+
+type scheduledJob struct {
+	schedule jobSchedule
+	run      jobFunc
+	due      time.Time // the next tick
+}
+
+// The jobs started here, by name, so they can be run by hand too
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]scheduledJob
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]scheduledJob)}
+}
+
+func (r *jobRegistry) add(name string, schedule jobSchedule, job jobFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[name] = scheduledJob{schedule: schedule, run: job}
+}
+
+func (r *jobRegistry) setDue(name string, due time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job, ok := r.jobs[name]; ok {
+		job.due = due
+		r.jobs[name] = job
+	}
+}
+
+func (r *jobRegistry) get(name string) (scheduledJob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[name]
+	return job, ok
+}
+
+func (r *jobRegistry) all() map[string]scheduledJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.jobs)
+}
+
+func (s *Server) initJobRunsTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS job_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job TEXT NOT NULL,
+		trigger TEXT NOT NULL,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME,
+		outcome TEXT NOT NULL,
+		items INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS job_runs_job ON job_runs (job, id);
+	CREATE INDEX IF NOT EXISTS job_runs_started_at ON job_runs (started_at)`)
+	return err
+}
+
+// Run job on its schedule until stop is closed, but only once across all
+// the replicas rather than once on each. Whoever takes the job's lock
+// first on a tick runs it, and keeps the lock until just before the tick
+// after, so the others' ticks in between find it taken. Nobody releases
+// it early, that would let a replica whose clock is a few seconds behind
+// run it again. With the memory locker there's only this instance anyway
+func (s *Server) every(name string, schedule jobSchedule, stop <-chan struct{}, job jobFunc) {
+	s.jobs.add(name, schedule, job)
+	for {
+		due := schedule.next(time.Now())
+		s.jobs.setDue(name, due)
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.runJob(name, schedule.next(due).Sub(due), job)
+		}
+	}
+}
+
+// Whether it ran here, the next tick being interval away. If the lock
+// can't be had because Redis is down it doesn't run anywhere, better late
+// than everything sent twice
+func (s *Server) runJob(name string, interval time.Duration, job jobFunc) bool {
+	ctx := context.Background()
+	if _, err := s.locker.Lock(ctx, "job:"+name, interval*9/10); err != nil {
+		if !errors.Is(err, ErrLockHeld) {
+			log.Printf("Error taking the lock for %s, skipping it this time: %v", name, err)
+		}
+		return false
+	}
+	_, finish, err := s.startJob(ctx, name, interval, JobScheduled)
+	if errors.Is(err, ErrLockHeld) {
+		log.Printf("Skipping %s, the last run's still going", name)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error taking the lock for %s, skipping it this time: %v", name, err)
+		return false
+	}
+	run := finish(job(ctx))
+	if run.Error != "" {
+		log.Printf("Error running %s: %s", name, run.Error)
+	}
+	return true
+}
+
+// Records the run as started and hands back what to call when it's done.
+// A second lock, held for as long as it runs, stops a run by hand and a
+// scheduled one going at once anywhere. ErrLockHeld if one is
+func (s *Server) startJob(ctx context.Context, name string, interval time.Duration, trigger string) (JobRun, func(int, error) JobRun, error) {
+	unlock, err := s.locker.Lock(ctx, "job-running:"+name, interval)
+	if err != nil {
+		return JobRun{}, nil, err
+	}
+	run := JobRun{Job: name, Trigger: trigger, StartedAt: time.Now().UTC(), Outcome: JobRunning}
+	s.recordJobRun(ctx, &run)
+
+	finish := func(items int, err error) JobRun {
+		defer unlock()
+		finished := time.Now().UTC()
+		run.FinishedAt, run.Items, run.Outcome = &finished, items, JobOK
+		if err != nil {
+			run.Outcome, run.Error = JobFailed, err.Error()
+		}
+		s.recordJobRun(ctx, &run)
+		return run
+	}
+	return run, finish, nil
+}
+
+// Inserts the run if it's new and updates it if not. The history is only
+// kept with a database, the job runs either way
+func (s *Server) recordJobRun(ctx context.Context, run *JobRun) {
+	if s.db == nil {
+		return
+	}
+	ctx, cancel := withTimeout(context.WithoutCancel(ctx), s.cfg.DBTimeout)
+	defer cancel()
+
+	if run.ID == 0 {
+		err := s.db.QueryRowContext(ctx, "INSERT INTO job_runs (job, trigger, started_at, outcome) VALUES (?, ?, ?, ?) RETURNING id",
+			run.Job, run.Trigger, run.StartedAt, run.Outcome).Scan(&run.ID)
+		if err != nil {
+			log.Printf("Error recording the start of %s: %v", run.Job, err)
+		}
+		return
+	}
+	_, err := s.db.ExecContext(ctx, "UPDATE job_runs SET finished_at = ?, outcome = ?, items = ?, error = ? WHERE id = ?",
+		run.FinishedAt, run.Outcome, run.Items, run.Error, run.ID)
+	if err == nil {
+		_, err = s.db.ExecContext(ctx, "DELETE FROM job_runs WHERE started_at < ?", time.Now().UTC().Add(-jobHistory))
+	}
+	if err != nil {
+		log.Printf("Error recording how %s went: %v", run.Job, err)
+	}
+}
+
+// GET /admin/jobs, the jobs on a schedule here and the latest runs on
+// any replica, or just one job's with ?job=
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	list := JobList{Jobs: []Job{}, Runs: []JobRun{}}
+	registered := s.jobs.all()
+	for _, name := range slices.Sorted(maps.Keys(registered)) {
+		job := registered[name]
+		entry := Job{Name: name, Schedule: job.schedule.String()}
+		if !job.due.IsZero() {
+			due := job.due.UTC()
+			entry.NextRunAt = &due
+		}
+		list.Jobs = append(list.Jobs, entry)
+	}
+	if s.db == nil {
+		s.respond(w, r, http.StatusOK, list)
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	query, args := "SELECT id, job, trigger, started_at, finished_at, outcome, items, error FROM job_runs", []any{}
+	if job := r.URL.Query().Get("job"); job != "" {
+		query, args = query+" WHERE job = ?", append(args, job)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY id DESC LIMIT ?", append(args, jobRunsShown)...)
+	if err != nil {
+		log.Printf("Error listing job runs: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list job runs")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var run JobRun
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&run.ID, &run.Job, &run.Trigger, &run.StartedAt, &finishedAt, &run.Outcome, &run.Items, &run.Error); err != nil {
+			log.Printf("Error listing job runs: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list job runs")
+			return
+		}
+		if finishedAt.Valid {
+			run.FinishedAt = &finishedAt.Time
+		}
+		list.Runs = append(list.Runs, run)
+	}
+
+	for i, job := range list.Jobs {
+		var outcome string
+		err := s.db.QueryRowContext(ctx, "SELECT outcome FROM job_runs WHERE job = ? ORDER BY id DESC LIMIT 1", job.Name).Scan(&outcome)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error loading the last run of %s: %v", job.Name, err)
+		}
+		list.Jobs[i].LastOutcome = outcome
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
+
+// POST /admin/jobs/{name}/run starts one of this replica's jobs now,
+// whether or not it's due, and answers 202 with the run as it starts.
+// Find out how it went from GET /admin/jobs
+func (s *Server) runJobNow(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	job, ok := s.jobs.get(name)
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownJob, "No job by that name is scheduled here")
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	run, finish, err := s.startJob(ctx, name, scheduleGap(job.schedule, time.Now()), actorFrom(ctx))
+	if errors.Is(err, ErrLockHeld) {
+		s.sendErrorResponse(w, r, http.StatusConflict, CodeJobRunning, "That job is running already")
+		return
+	}
+	if err != nil {
+		log.Printf("Error taking the lock for %s: %v", name, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Couldn't check whether the job's running already")
+		return
+	}
+	log.Printf("Running %s by hand (by %s)", name, run.Trigger)
+	s.respond(w, r, http.StatusAccepted, run)
+
+	go func() {
+		if run := finish(job.run(ctx)); run.Error != "" {
+			log.Printf("Error running %s: %s", name, run.Error)
+		}
+	}()
+}
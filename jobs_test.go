@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type brokenLocker struct{}
+
+func (brokenLocker) Lock(ctx context.Context, key string, ttl time.Duration) (func(), error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestJobsRunOnceAcrossReplicas(t *testing.T) {
+	shared := newMemoryLocker() // as Redis would be
+	a, b := NewServer(nil), NewServer(nil)
+	a.locker, b.locker = shared, shared
+
+	var runs atomic.Int32
+	job := func(ctx context.Context) (int, error) {
+		runs.Add(1)
+		return 0, nil
+	}
+	interval := 50 * time.Millisecond
+
+	if !a.runJob("reminders", interval, job) || b.runJob("reminders", interval, job) {
+		t.Fatal("Expected the first replica to run it and the second to skip")
+	}
+	if !b.runJob("purge", interval, job) {
+		t.Error("Expected a different job to have its own lock")
+	}
+	time.Sleep(interval)
+	if !b.runJob("reminders", interval, job) {
+		t.Error("Expected the next tick to run it again")
+	}
+	if runs.Load() != 3 {
+		t.Errorf("Expected 3 runs, got %d", runs.Load())
+	}
+
+	b.locker = brokenLocker{}
+	if b.runJob("purge", interval, job) {
+		t.Error("Expected nothing to run without the lock")
+	}
+
+	// Both tickers going at once still comes to about one run a tick
+	runs.Store(0)
+	stop := make(chan struct{})
+	b.locker = shared
+	go a.every("refresh", intervalSchedule(interval), stop, job)
+	go b.every("refresh", intervalSchedule(interval), stop, job)
+	time.Sleep(interval*4 + interval/2)
+	close(stop)
+	if n := runs.Load(); n < 3 || n > 5 {
+		t.Errorf("Expected about 4 runs from two replicas, got %d", n)
+	}
+}
+
+func TestJobHistory(t *testing.T) {
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1) // one :memory: database, not one per connection
+	server.cfg.AdminToken = "secret"
+	router := server.routes()
+	interval := time.Hour
+
+	release := make(chan struct{})
+	server.jobs.add("export", intervalSchedule(interval), func(ctx context.Context) (int, error) {
+		<-release
+		return 12, nil
+	})
+	server.jobs.add("purge", intervalSchedule(interval), func(ctx context.Context) (int, error) {
+		return 3, errors.New("disk full")
+	})
+	list := func(path string) JobList {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", path, nil))
+		var list JobList
+		if json.Unmarshal(w.Body.Bytes(), &list); w.Code != http.StatusOK {
+			t.Fatalf("Expected the jobs, got %d: %s", w.Code, w.Body.String())
+		}
+		return list
+	}
+
+	// Run by hand, and not again while it is
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/jobs/export/run", nil))
+	var run JobRun
+	if json.Unmarshal(w.Body.Bytes(), &run); w.Code != http.StatusAccepted || run.Outcome != JobRunning || run.Trigger != ActorAdmin {
+		t.Fatalf("Expected the run started, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/jobs/export/run", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while it's running, got %d", w.Code)
+	}
+	if server.runJob("export", interval, func(ctx context.Context) (int, error) { return 0, nil }) {
+		t.Error("Expected the schedule to skip it while it's running")
+	}
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if runs := list("/admin/jobs?job=export").Runs; len(runs) > 0 && runs[0].Outcome != JobRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the run by hand to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !server.runJob("purge", interval, func(ctx context.Context) (int, error) { return 3, errors.New("disk full") }) {
+		t.Fatal("Expected the scheduled run")
+	}
+	got := list("/admin/jobs")
+	if len(got.Jobs) != 2 || got.Jobs[0].Name != "export" || got.Jobs[0].LastOutcome != JobOK || got.Jobs[1].LastOutcome != JobFailed {
+		t.Errorf("Expected both jobs and how they last went, got %+v", got.Jobs)
+	}
+	if len(got.Runs) != 2 {
+		t.Fatalf("Expected two runs, got %+v", got.Runs)
+	}
+	if failed := got.Runs[0]; failed.Job != "purge" || failed.Trigger != JobScheduled || failed.Items != 3 || failed.Error != "disk full" || failed.FinishedAt == nil {
+		t.Errorf("Expected the failed scheduled run, got %+v", failed)
+	}
+	if done := got.Runs[1]; done.ID != run.ID || done.Outcome != JobOK || done.Items != 12 || done.FinishedAt == nil {
+		t.Errorf("Expected the run by hand finished, got %+v", done)
+	}
+	if runs := list("/admin/jobs?job=export").Runs; len(runs) != 1 {
+		t.Errorf("Expected one run of export, got %+v", runs)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/jobs/nothing/run", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a job that isn't scheduled, got %d", w.Code)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// What the kiosk is told on check in. Just enough to greet them,
+// nothing that would be worth reading off a stolen kiosk
+type CheckIn struct {
+	XMLName       xml.Name  `json:"-" xml:"checkIn"`
+	AppointmentID int       `json:"appointmentId" xml:"appointmentId"`
+	FirstName     string    `json:"firstName" xml:"firstName"`
+	VisitDate     string    `json:"visitDate" xml:"visitDate"`
+	CheckedInAt   time.Time `json:"checkedInAt" xml:"checkedInAt"`
+
+	// Their place in the queue, when there's a database to keep one in
+	Service     string `json:"service,omitempty" xml:"service,omitempty"`
+	QueueNumber int    `json:"queueNumber,omitempty" xml:"queueNumber,omitempty"`
+}
+
+// GET /kiosk/availability, free days this week only, for anyone who
+// turns up without a booking
+func (s *Server) kioskAvailability(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	availability, err := s.availability(ctx, today, today.AddDate(0, 0, 6), 1)
+	if err != nil {
+		log.Printf("Error loading booked dates: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load availability")
+		return
+	}
+	s.respond(w, r, http.StatusOK, s.withNotices(ctx, availability))
+}
+
+// POST /kiosk/checkin with {"appointmentId": 12, "lastName": "Jones"}
+// from their confirmation, and "service" if there's more than one to
+// queue for. Only works on the day, and a wrong name looks the same as
+// a wrong ID so the kiosk can't be used to go fishing
+func (s *Server) kioskCheckIn(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	var req struct {
+		AppointmentID int    `json:"appointmentId"`
+		LastName      string `json:"lastName"`
+		Service       string `json:"service"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if req.AppointmentID == 0 || req.LastName == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "Appointment ID and last name are required")
+		return
+	}
+	if req.Service == "" {
+		req.Service = s.queueServices()[0]
+	}
+	if !slices.Contains(s.queueServices(), req.Service) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownService, "No queue for that service")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	appointment, err := s.store.Get(ctx, req.AppointmentID)
+	if err == nil && !strings.EqualFold(cleanName(req.LastName), appointment.LastName) {
+		err = ErrAppointmentNotFound
+	}
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment matches those details")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d: %v", req.AppointmentID, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to check in")
+		return
+	}
+	if appointment.VisitDate != today.Format("2006-01-02") {
+		s.sendErrorResponse(w, r, http.StatusConflict, CodeWrongDay, "This appointment is for "+appointment.VisitDate)
+		return
+	}
+
+	appointment, err = s.store.CheckIn(ctx, appointment.ID)
+	if err != nil {
+		log.Printf("Error checking in appointment %d: %v", req.AppointmentID, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to check in")
+		return
+	}
+	checkIn := CheckIn{
+		AppointmentID: appointment.ID,
+		FirstName:     appointment.FirstName,
+		VisitDate:     appointment.VisitDate,
+		CheckedInAt:   *appointment.CheckedInAt,
+	}
+
+	if s.db != nil {
+		ticket, err := s.issueTicket(ctx, appointment, req.Service)
+		if err != nil {
+			// They're checked in either way, staff can still see them on the schedule
+			log.Printf("Error issuing ticket for appointment %d: %v", appointment.ID, err)
+		} else {
+			checkIn.Service, checkIn.QueueNumber = ticket.Service, ticket.Number
+		}
+	}
+	s.respond(w, r, http.StatusOK, checkIn)
+}
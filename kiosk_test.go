@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func kioskRequest(method, url string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, url, bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer kiosk-secret")
+	return r
+}
+
+func TestKioskCheckIn(t *testing.T) {
+	for name, server := range map[string]*Server{"sqlite": setupTestServer(t), "events": setupEventServer(t), "memory": setupTestServer(t)} {
+		t.Run(name, func(t *testing.T) {
+			if name == "memory" {
+				server.db, server.store = nil, newMemoryStore()
+			}
+			server.cfg.AdminToken = "secret"
+			server.cfg.KioskToken = "kiosk-secret"
+			today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+			server.todayOverride = &today
+			router := server.routes()
+
+			postAppointment(t, router, AppointmentRequest{FirstName: "Kit", LastName: "Jones", VisitDate: "2075-06-16"})
+			postAppointment(t, router, AppointmentRequest{FirstName: "Early", LastName: "Bird", VisitDate: "2075-06-18"})
+
+			checkIn := func(body string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, kioskRequest("POST", "/kiosk/checkin", []byte(body)))
+				return w
+			}
+
+			if w := checkIn(`{"appointmentId":1,"lastName":"Smith"}`); w.Code != http.StatusNotFound {
+				t.Errorf("Expected 404 for the wrong name, got %d", w.Code)
+			}
+			if w := checkIn(`{"appointmentId":2,"lastName":"Bird"}`); w.Code != http.StatusConflict {
+				t.Errorf("Expected 409 on the wrong day, got %d", w.Code)
+			}
+
+			w := checkIn(`{"appointmentId":1,"lastName":"jones"}`)
+			var first CheckIn
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &first) != nil || first.FirstName != "Kit" {
+				t.Fatalf("Expected 200 checking in, got %d: %s", w.Code, w.Body.String())
+			}
+			if bytes.Contains(w.Body.Bytes(), []byte("Jones")) {
+				t.Errorf("Expected no last name back on the kiosk, got %s", w.Body.String())
+			}
+
+			// Tapping again is harmless
+			var again CheckIn
+			json.Unmarshal(checkIn(`{"appointmentId":1,"lastName":"Jones"}`).Body.Bytes(), &again)
+			if !again.CheckedInAt.Equal(first.CheckedInAt) {
+				t.Errorf("Expected the first check in time to stick, got %v then %v", first.CheckedInAt, again.CheckedInAt)
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/1/history", nil))
+			var history History
+			if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history.Revisions) != 2 || history.Revisions[1].Change != RevisionCheckedIn || history.Revisions[1].ChangedBy != ActorKiosk {
+				t.Errorf("Expected one checked_in revision by the kiosk, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestKioskScope(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.KioskToken = "kiosk-secret"
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	router := server.routes()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, kioskRequest("GET", "/kiosk/availability", nil))
+	var availability Availability
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &availability) != nil || availability.From != "2075-06-16" || availability.To != "2075-06-22" {
+		t.Errorf("Expected this week's availability, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Nothing else, not even the read-only admin endpoints
+	for _, target := range []string{"/appointments", "/appointments/export", "/admin/persons/1", "/appointments/1/history"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, kioskRequest("GET", target, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for the kiosk token on %s, got %d", target, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/kiosk/availability", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the kiosk routes to want the kiosk token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+)
+
+type AppointmentList struct {
+	XMLName      xml.Name      `json:"-" xml:"appointments"`
+	AsOf         *time.Time    `json:"asOf,omitempty" xml:"asOf,attr,omitempty"`
+	Appointments []Appointment `json:"appointments" xml:"appointment"`
+}
+
+// GET /appointments lists the bookings by visit date, for staff. With
+// ?asOf=2075-03-01T09:00:00Z it's the bookings as they stood then, put
+// back together from the revisions, for settling "I definitely booked the 12th"
+func (s *Server) listAppointments(w http.ResponseWriter, r *http.Request) {
+	var asOf time.Time
+	if v := r.URL.Query().Get("asOf"); v != "" {
+		var err error
+		if asOf, err = parseAsOf(v); err != nil {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidAsOf, "asOf must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+			return
+		}
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	appointments, err := s.store.List(ctx, asOf)
+	if err != nil {
+		log.Printf("Error listing appointments: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list appointments")
+		return
+	}
+
+	list := AppointmentList{Appointments: appointments}
+	if !asOf.IsZero() {
+		list.AsOf = &asOf
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
+
+// A bare date means the start of that day, UTC
+func parseAsOf(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", v)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestListAsOf(t *testing.T) {
+	stores := map[string]func() *Server{
+		"sqlite": func() *Server { return setupTestServer(t) },
+		"events": func() *Server { return setupEventServer(t) },
+		"memory": func() *Server {
+			server := setupTestServer(t)
+			server.db, server.store = nil, newMemoryStore()
+			return server
+		},
+	}
+
+	for name, setup := range stores {
+		t.Run(name, func(t *testing.T) {
+			server := setup()
+			server.cfg.AdminToken = "secret"
+			router := server.routes()
+
+			postAppointment(t, router, AppointmentRequest{FirstName: "Ida", LastName: "Disputed", VisitDate: "2075-03-12"})
+			postAppointment(t, router, AppointmentRequest{FirstName: "Cy", LastName: "Cancelled", VisitDate: "2075-03-13"})
+			time.Sleep(5 * time.Millisecond)
+			before := time.Now().UTC()
+			time.Sleep(5 * time.Millisecond)
+
+			router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/admin/appointments/1/reschedule", []byte(`{"visitDate":"2075-03-19"}`)))
+			router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/admin/appointments/2/cancel", nil))
+
+			list := func(query string) []string {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest("GET", "/appointments"+query, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected 200 listing, got %d: %s", w.Code, w.Body.String())
+				}
+				var resp AppointmentList
+				json.NewDecoder(w.Body).Decode(&resp)
+				var dates []string
+				for _, a := range resp.Appointments {
+					dates = append(dates, a.VisitDate)
+				}
+				return dates
+			}
+
+			if now := list(""); len(now) != 1 || now[0] != "2075-03-19" {
+				t.Errorf("Expected just the moved booking now, got %v", now)
+			}
+			// Yes, they did have the 12th
+			if then := list("?asOf=" + before.Format(time.RFC3339Nano)); len(then) != 2 || then[0] != "2075-03-12" || then[1] != "2075-03-13" {
+				t.Errorf("Expected both original bookings as of before the changes, got %v", then)
+			}
+			if never := list("?asOf=2000-01-01"); len(never) != 0 {
+				t.Errorf("Expected nothing booked in 2000, got %v", never)
+			}
+		})
+	}
+}
+
+func TestListInvalidAsOf(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, adminRequest("GET", "/appointments?asOf=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad asOf, got %d", w.Code)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// First descriptor systemd passes, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// Where to take connections from. A socket handed over by systemd (a
+// citynext.socket unit) comes first, so a restart never refuses anyone,
+// they queue in the kernel until the new process picks the socket up.
+// Otherwise addr is "unix:/run/citynext/citynext.sock" for nginx on the
+// same box, or a TCP address like ":8080"
+func listen(addr string) (net.Listener, error) {
+	if l, err := systemdListener(); l != nil || err != nil {
+		return l, err
+	}
+
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by the last run would stop us binding
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// nginx runs as its own user, in our group
+	if err := os.Chmod(path, 0o660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// The LISTEN_FDS protocol, see sd_listen_fds(3). Only one socket is
+// used, and the variables are cleared so nothing we start inherits them
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds > 1 {
+		log.Printf("systemd passed %d sockets, only using the first", fds)
+	}
+
+	f := os.NewFile(listenFDsStart, "systemd-socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket from systemd: %w", err)
+	}
+	return l, nil
+}
+
+// --listen after the year, or CITYNEXT_LISTEN
+func listenAddr(args []string, def string) string {
+	for i, arg := range args {
+		if v, ok := strings.CutPrefix(arg, "--listen="); ok {
+			return v
+		}
+		if arg == "--listen" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return def
+}
+
+// Serve until SIGTERM or SIGINT arrives on stop, then let the requests
+// already going finish, so a deploy doesn't cut anyone off mid-booking
+func serve(srv *http.Server, l net.Listener, stop <-chan os.Signal, grace time.Duration) error {
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(l) }()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Printf("Got %s, finishing requests in flight", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Printf("Shut down cleanly")
+	return nil
+}
+
+// Streams run until the client goes, so on shutdown they'd hold it up
+// for the whole grace period and then be cut off, leaving reception's
+// screens frozen until the browser noticed. Instead each one is told to
+// reconnect, which behind the load balancer means to another replica,
+// and ends. The retries are spread over a few seconds so they don't all
+// land at once
+type streamDrain struct {
+	closing chan struct{}
+	once    sync.Once
+	open    atomic.Int64
+}
+
+const (
+	reconnectAfter  = time.Second
+	reconnectSpread = 4 * time.Second
+)
+
+func newStreamDrain() *streamDrain {
+	return &streamDrain{closing: make(chan struct{})}
+}
+
+// For http.Server.RegisterOnShutdown
+func (d *streamDrain) drain() {
+	d.once.Do(func() {
+		log.Printf("Telling %d streaming clients to reconnect", d.open.Load())
+		close(d.closing)
+	})
+}
+
+// Closed when it's time to go. Call done when the stream ends
+func (d *streamDrain) start() (closing <-chan struct{}, done func()) {
+	d.open.Add(1)
+	return d.closing, func() { d.open.Add(-1) }
+}
+
+// The last thing a stream sends. EventSource reconnects by itself after
+// the retry, anything else listening can go by the event
+func (s *Server) sendReconnect(w io.Writer, rc *http.ResponseController) {
+	retry := reconnectAfter + rand.N(reconnectSpread)
+	s.extendWriteDeadline(rc)
+	fmt.Fprintf(w, "retry: %d\nevent: reconnect\ndata: {}\n\n", retry.Milliseconds())
+	rc.Flush()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "citynext.sock")
+	os.WriteFile(path, []byte("not a socket"), 0o644)
+	if _, err := listen("unix:" + path); err == nil {
+		t.Fatal("Expected an ordinary file in the way to be left alone")
+	}
+	os.Remove(path)
+
+	// A socket left over from last time is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("Expected to take over the stale socket, got %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o660 {
+		t.Errorf("Expected the socket to be group writable, got %v", info.Mode().Perm())
+	}
+
+	var seenIP string
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenIP = clientIP(r)
+		io.WriteString(w, "ok")
+	})}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- serve(srv, l, stop, time.Second) }()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	req, _ := http.NewRequest("GET", "http://citynext/holidays", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.4")
+	req.Header.Set("X-Real-Ip", "192.0.2.66") // made up by the client, nginx passes it on unless told otherwise
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seenIP != "198.51.100.4" {
+		t.Errorf("Expected the address nginx added, got %q", seenIP)
+	}
+
+	stop <- os.Interrupt
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ":8080"},
+		{[]string{"--listen", "unix:/run/citynext.sock"}, "unix:/run/citynext.sock"},
+		{[]string{"--listen=127.0.0.1:9000"}, "127.0.0.1:9000"},
+	} {
+		if got := listenAddr(tc.args, ":8080"); got != tc.want {
+			t.Errorf("listenAddr(%v) = %q, expected %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestSystemdListenerForAnotherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if l, err := systemdListener(); l != nil || err != nil {
+		t.Errorf("Expected sockets meant for another process to be ignored, got %v, %v", l, err)
+	}
+}
+
+func TestShutdownTellsStreamsToReconnect(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.QueueServices = []string{"general"}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer("", server.routes(), server.cfg)
+	srv.RegisterOnShutdown(server.streams.drain)
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- serve(srv, l, stop, 10*time.Second) }()
+
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/queue/2075-06-16/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	stop <- os.Interrupt
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "event: reconnect") || !strings.Contains(string(body), "retry: ") {
+		t.Errorf("Expected a reconnect hint before the stream ended, got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Expected the stream not to hold up shutdown, took %s", took)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// loadtest - hammer a running server with concurrent bookings and report latencies.
+// Most requests will collide on dates and get 409s, that's the point,
+// the duplicate and holiday checks are the hot path under load
+func loadtestCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	url := flags.String("url", "http://localhost:8080", "server to test")
+	year := flags.Int("year", 2075, "year the server was started for")
+	concurrency := flags.Int("c", 20, "concurrent clients")
+	total := flags.Int("n", 1000, "total requests")
+	p99Target := flags.Duration("p99", 250*time.Millisecond, "fail if p99 latency is above this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	result := runLoadtest(*url+"/appointments", *year, *concurrency, *total)
+	result.print()
+
+	if p99 := result.percentile(99); p99 > *p99Target {
+		return fmt.Errorf("p99 latency %s is above the %s target", p99, *p99Target)
+	}
+	if result.statuses[0] > 0 || result.statuses[http.StatusInternalServerError] > 0 {
+		return fmt.Errorf("%d transport errors and %d server errors", result.statuses[0], result.statuses[http.StatusInternalServerError])
+	}
+	return nil
+}
+
+type loadtestResult struct {
+	elapsed   time.Duration
+	latencies []time.Duration
+	statuses  map[int]int // 0 is a transport error
+}
+
+func runLoadtest(url string, year, concurrency, total int) loadtestResult {
+	client := &http.Client{Timeout: 10 * time.Second}
+	jobs := make(chan int)
+
+	var mu sync.Mutex
+	result := loadtestResult{statuses: map[int]int{}}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				visitDate := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, rand.IntN(365))
+				body, _ := json.Marshal(AppointmentRequest{
+					FirstName: "Load",
+					LastName:  fmt.Sprintf("Test%d", i),
+					VisitDate: visitDate.Format("2006-01-02"),
+				})
+
+				t := time.Now()
+				status := 0
+				resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+				if err == nil {
+					status = resp.StatusCode
+					resp.Body.Close()
+				}
+				latency := time.Since(t)
+
+				mu.Lock()
+				result.latencies = append(result.latencies, latency)
+				result.statuses[status]++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range total {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	result.elapsed = time.Since(start)
+	slices.Sort(result.latencies)
+	return result
+}
+
+func (r loadtestResult) percentile(p int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := (len(r.latencies)*p + 99) / 100
+	return r.latencies[min(i, len(r.latencies))-1]
+}
+
+func (r loadtestResult) print() {
+	fmt.Printf("%d requests in %s (%.0f req/s)\n", len(r.latencies), r.elapsed.Round(time.Millisecond),
+		float64(len(r.latencies))/r.elapsed.Seconds())
+	fmt.Printf("p50 %s  p90 %s  p99 %s  max %s\n", r.percentile(50), r.percentile(90), r.percentile(99), r.percentile(100))
+
+	statuses := make([]int, 0, len(r.statuses))
+	for status := range r.statuses {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	for _, status := range statuses {
+		label := http.StatusText(status)
+		if status == 0 {
+			label = "transport error"
+		}
+		fmt.Printf("  %d %s: %d\n", status, label, r.statuses[status])
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Guessing a token gets a client shut out. There are no staff accounts
+// yet, so each token is the account: admin, phone or kiosk, named the
+// same as their actors. A client IP that gets one wrong
+// CITYNEXT_LOCKOUT_THRESHOLD times within CITYNEXT_LOCKOUT_DURATION is
+// locked out of that account for CITYNEXT_LOCKOUT_DURATION, even with the
+// right token. It's counted in the shared cache, so a lockout holds on
+// every replica. It's off unless the threshold's set: behind a load
+// balancer or proxy over TCP the client IP is the proxy's, and five wrong
+// tokens from anyone would lock everyone out
+var lockoutAccounts = map[string]bool{ActorAdmin: true, ActorPhone: true, ActorKiosk: true}
+
+type Lockout struct {
+	XMLName     xml.Name   `json:"-" xml:"lockout"`
+	Account     string     `json:"account" xml:"account"`
+	IP          string     `json:"ip" xml:"ip"`
+	Failures    int64      `json:"failures" xml:"failures"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty" xml:"lockedUntil,omitempty"`
+}
+
+func failuresKey(account, ip string) string { return "authfail:" + account + ":" + ip }
+func lockoutKey(account, ip string) string  { return "lockout:" + account + ":" + ip }
+
+// Whether the request has the account's token, sending the error if not
+func (s *Server) checkToken(w http.ResponseWriter, r *http.Request, account, want, message string) bool {
+	ip := clientIP(r)
+	if s.lockedOut(w, r, account, ip) {
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+		return true
+	}
+	s.tokenFailed(r.Context(), account, ip)
+	s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeUnauthorized, message)
+	return false
+}
+
+// Sends the 429 if it is
+func (s *Server) lockedOut(w http.ResponseWriter, r *http.Request, account, ip string) bool {
+	until := s.lockedUntil(r.Context(), account, ip)
+	if until == nil {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(*until).Seconds())+1))
+	s.sendErrorResponse(w, r, http.StatusTooManyRequests, CodeLockedOut, "Too many wrong tokens, try again later")
+	return true
+}
+
+// Nil if it isn't locked out. If the cache can't say, it isn't, better
+// than locking everyone out with the cache
+func (s *Server) lockedUntil(ctx context.Context, account, ip string) *time.Time {
+	if s.cfg.LockoutThreshold <= 0 {
+		return nil
+	}
+	v, ok, err := s.cache.Get(ctx, lockoutKey(account, ip))
+	if err != nil {
+		log.Printf("Error checking lockout for %s from %s: %v", account, ip, err)
+		return nil
+	}
+	unix, _ := strconv.ParseInt(string(v), 10, 64)
+	if !ok || unix <= time.Now().Unix() {
+		return nil
+	}
+	until := time.Unix(unix, 0).UTC()
+	return &until
+}
+
+func (s *Server) tokenFailed(ctx context.Context, account, ip string) {
+	s.metrics.inc("citynext_auth_failures_total", account)
+	if s.cfg.LockoutThreshold <= 0 {
+		return
+	}
+	failures, err := s.cache.Incr(ctx, failuresKey(account, ip), s.cfg.LockoutDuration)
+	if err != nil {
+		log.Printf("Error counting failed %s token from %s: %v", account, ip, err)
+		return
+	}
+	if failures < int64(s.cfg.LockoutThreshold) {
+		return
+	}
+
+	until := time.Now().Add(s.cfg.LockoutDuration)
+	if err := s.cache.Set(ctx, lockoutKey(account, ip), []byte(strconv.FormatInt(until.Unix(), 10)), s.cfg.LockoutDuration); err != nil {
+		log.Printf("Error locking out %s from %s: %v", account, ip, err)
+		return
+	}
+	// Starts from nothing again once the lockout's over
+	s.cache.Delete(ctx, failuresKey(account, ip))
+	s.metrics.inc("citynext_auth_lockouts_total", account)
+	log.Printf("Locked %s out of %s until %s after %d wrong tokens", ip, account, until.UTC().Format(time.RFC3339), failures)
+}
+
+// GET /admin/lockouts/{account}/{ip} says where a client stands, DELETE
+// lets it straight back in. Someone locked out of admin needs another IP,
+// or to wait
+func (s *Server) handleLockout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	account, ip := vars["account"], vars["ip"]
+	if !lockoutAccounts[account] {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownAccount, "Accounts are admin, phone or kiosk")
+		return
+	}
+
+	ctx := r.Context()
+	if r.Method == http.MethodDelete {
+		err := s.cache.Delete(ctx, lockoutKey(account, ip))
+		if err == nil {
+			err = s.cache.Delete(ctx, failuresKey(account, ip))
+		}
+		if err != nil {
+			log.Printf("Error clearing lockout for %s from %s: %v", account, ip, err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed to clear the lockout")
+			return
+		}
+		log.Printf("Lockout for %s from %s cleared (by %s)", account, ip, actorFrom(ctx))
+	}
+
+	lockout := Lockout{Account: account, IP: ip, LockedUntil: s.lockedUntil(ctx, account, ip)}
+	if v, ok, err := s.cache.Get(ctx, failuresKey(account, ip)); err == nil && ok {
+		lockout.Failures, _ = strconv.ParseInt(string(v), 10, 64)
+	}
+	s.respond(w, r, http.StatusOK, lockout)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.LockoutThreshold = 3
+	server.cfg.LockoutDuration = time.Minute
+	router := server.routes()
+
+	request := func(token, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/admin/features", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.RemoteAddr = ip + ":4321"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := request("guess", "203.0.113.9"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for a wrong token, got %d", w.Code)
+		}
+	}
+	// Locked out now, the right token doesn't help
+	w := request("secret", "203.0.113.9")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "locked_out") || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 locked_out, got %d: %s", w.Code, w.Body.String())
+	}
+	// Anyone else is fine
+	if w := request("secret", "198.51.100.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected another IP let in, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`citynext_auth_failures_total{account="admin"} 3`, `citynext_auth_lockouts_total{account="admin"} 1`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics", want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/lockouts/admin/203.0.113.9", nil))
+	var lockout Lockout
+	if json.Unmarshal(w.Body.Bytes(), &lockout); w.Code != http.StatusOK || lockout.LockedUntil == nil {
+		t.Errorf("Expected it shown locked, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/admin/lockouts/admin/203.0.113.9", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "lockedUntil") {
+		t.Errorf("Expected the lockout cleared, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("secret", "203.0.113.9"); w.Code != http.StatusOK {
+		t.Errorf("Expected to be let back in, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/admin/lockouts/root/203.0.113.9", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an account that isn't one, got %d", w.Code)
+	}
+}
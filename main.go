@@ -4,15 +4,21 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/sync/singleflight"
 )
 
 // For convienience
@@ -22,133 +28,242 @@ func init() {
 
 // We need public holidays from the Nager date API
 type PublicHoliday struct {
-	Date        string   `json:"date"`
-	LocalName   string   `json:"localName"`
-	Name        string   `json:"name"`
-	CountryCode string   `json:"countryCode"`
-	Fixed       bool     `json:"fixed"`
-	Global      bool     `json:"global"`
-	Counties    []string `json:"counties"`
-	LaunchYear  int      `json:"launchYear"`
-	Types       []string `json:"types"`
+	Date        string   `json:"date" xml:"date"`
+	LocalName   string   `json:"localName" xml:"localName"`
+	Name        string   `json:"name" xml:"name"`
+	CountryCode string   `json:"countryCode" xml:"countryCode"`
+	Fixed       bool     `json:"fixed" xml:"fixed"`
+	Global      bool     `json:"global" xml:"global"`
+	Counties    []string `json:"counties" xml:"counties>county"`
+	LaunchYear  int      `json:"launchYear" xml:"launchYear"`
+	Types       []string `json:"types" xml:"types>type"`
 }
 
 // Since the Nager data used camelCase ... stick with that
 
 // Now we need the appointment on the db
 type Appointment struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"firstName"`
-	LastName  string    `json:"lastName"`
-	VisitDate string    `json:"visitDate"`
-	CreatedAt time.Time `json:"createdAt"`
+	XMLName   xml.Name  `json:"-" xml:"appointment"`
+	ID        int       `json:"id" xml:"id"`
+	PersonID  int       `json:"personId" xml:"personId"`
+	FirstName string    `json:"firstName" xml:"firstName"`
+	LastName  string    `json:"lastName" xml:"lastName"`
+	Email     string    `json:"email,omitempty" xml:"email,omitempty"`
+	VisitDate string    `json:"visitDate" xml:"visitDate"`
+	CreatedAt time.Time `json:"createdAt" xml:"createdAt"`
+
+	PreferredLanguage string `json:"preferredLanguage" xml:"preferredLanguage"`
+	Title             string `json:"title,omitempty" xml:"title,omitempty"`                 // Mr, Ms, Mx, Dr, however they'd like to be addressed
+	PreferredName     string `json:"preferredName,omitempty" xml:"preferredName,omitempty"` // the name they go by, if it isn't their first
+
+	Attendees []Attendee `json:"attendees,omitempty" xml:"attendees>attendee,omitempty"` // anyone else on the booking
+	BookedBy  *BookedBy  `json:"bookedBy,omitempty" xml:"bookedBy,omitempty"`            // if someone booked for them
+
+	CheckedInAt *time.Time `json:"checkedInAt,omitempty" xml:"checkedInAt,omitempty"` // when they arrived, at the kiosk
+	Channel     string     `json:"channel" xml:"channel"`                             // online, phone, staff or walk-in
+	Service     string     `json:"service,omitempty" xml:"service,omitempty"`         // what they're coming in for, one of CITYNEXT_QUEUE_SERVICES
+
+	CustomFields CustomFields `json:"customFields,omitempty" xml:"customFields,omitempty"` // what the service's form asked for
+	Address      *Address     `json:"address,omitempty" xml:"address,omitempty"`           // where they live, if they said
+	Consent      *Consent     `json:"consent,omitempty" xml:"consent,omitempty"`           // to the privacy notice, when they booked
+	Experiments  Experiments  `json:"experiments,omitempty" xml:"experiments,omitempty"`   // the variant of each one they were booking in
+	FollowUpOf   int          `json:"followUpOf,omitempty" xml:"followUpOf,omitempty"`     // the earlier visit this one follows on from
 }
 
 // And we need the appointment request that might no make it onto the db
 type AppointmentRequest struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
+	Email     string `json:"email,omitempty"` // optional, only needed for confirmations
 	VisitDate string `json:"visitDate"`
+
+	PreferredLanguage string `json:"preferredLanguage,omitempty"` // defaults to English
+	Title             string `json:"title,omitempty"`
+	PreferredName     string `json:"preferredName,omitempty"`
+
+	Attendees []Attendee `json:"attendees,omitempty"` // for booking a whole household at once
+	BookedBy  *BookedBy  `json:"bookedBy,omitempty"`  // a carer, or staff taking it over the phone
+	Service   string     `json:"service,omitempty"`   // defaults to the first of CITYNEXT_QUEUE_SERVICES
+	Priority  string     `json:"priority,omitempty"`  // one of CITYNEXT_PRIORITY_CLASSES, for reserved places and short notice
+
+	CustomFields CustomFields `json:"customFields,omitempty"` // checked against the service's schema
+	Address      *Address     `json:"address,omitempty"`      // needed for CITYNEXT_ADDRESS_REQUIRED services
+	Consent      *Consent     `json:"consent,omitempty"`      // needed once there's a CITYNEXT_PRIVACY_NOTICE_VERSION
+	Experiments  Experiments  `json:"-"`                      // assigned from X-Client-Id, never what the client says
+	FollowUpOf   int          `json:"followUpOf,omitempty"`   // staff only, the ID of the visit it follows on from
+
+	Channel  string `json:"-"` // set by the handler, not the client
+	PersonID int    `json:"-"` // someone already booked in, rather than a new person from the details
 }
 
 // Errors
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Message string `json:"message"`
+	XMLName xml.Name `json:"-" xml:"errorResponse"`
+	Error   string   `json:"error" xml:"error"`
+	Message string   `json:"message" xml:"message"`
 }
 
 // Since it is 2075 and thus a single year we should have the server
 // fetch all the public holidays for the year on start.
 // Still, lets not hardcode the year, rather pass in on on start
-// The country (GB) we will hardcode
+// The countries come from CITYNEXT_COUNTRIES, GB unless it says otherwise
 // So we just need a server with a db of appointments, and a map of public holidays
 type Server struct {
-	db             *sql.DB
-	publicHolidays map[string]bool
-	yearStr        string
-	todayOverride  *time.Time // just for testing
+	db            *sql.DB // nil when running on the memory store
+	store         AppointmentStore
+	holidays      *holidaySet // this replica's copy of the shared ones, nil until they're loaded
+	holidaysRaw   []byte      // what it was read from, to tell when the shared ones change
+	holidayMu     sync.Mutex  // for both
+	refreshing    atomic.Bool // a background refresh is under way
+	yearStr       string
+	todayOverride *time.Time // just for testing
+	templates     *MessageTemplates
+	notifier      Notifier
+	texts         Notifier // nil when there's nothing to send texts with
+	letters       Notifier // or letters
+	cfg           Config
+	cfgMu         sync.RWMutex // for the reloadable settings, see live()
+	cache         Cache
+	locker        Locker
+	queue         *queueBroker
+	jobs          *jobRegistry // the background jobs started here, see every
+	features      *featureFlags
+	signing       *signingKeys
+	metrics       *metrics
+	health        *dependencyHealth
+	waitingRoom   *waitingRoom
+	streams       *streamDrain     // told to reconnect elsewhere on shutdown
+	rejections    *rejectionCounts // booking rejections not yet written, see flushRejections
+	blobs         BlobStore        // nil turns off document uploads and stored exports
+	scanner       VirusScanner     // nil if uploads aren't scanned
+	postcodes     PostcodeLookup   // nil if addresses aren't looked up
+	analytics     *analyticsStream
+
+	availabilityFlight singleflight.Group // identical availability lookups in flight, see getAvailability
 }
 
+// No database means keep everything in memory
 func NewServer(db *sql.DB) *Server {
-	return &Server{
-		db:             db,
-		publicHolidays: make(map[string]bool),
+	var store AppointmentStore = newMemoryStore()
+	if db != nil {
+		store = newSQLiteStore(db)
+	}
+
+	s := &Server{
+		db:          db,
+		store:       store,
+		templates:   mustEmbeddedTemplates(),
+		notifier:    LogNotifier{},
+		cache:       newMemoryCache(),
+		locker:      newMemoryLocker(),
+		queue:       newQueueBroker(),
+		jobs:        newJobRegistry(),
+		features:    newFeatureFlags(),
+		signing:     newSigningKeys(),
+		metrics:     newMetrics(),
+		health:      newDependencyHealth(),
+		waitingRoom: newWaitingRoom(),
+		streams:     newStreamDrain(),
+		rejections:  newRejectionCounts(),
 	}
+	// Opened with openDB, its queries are timed
+	if db != nil {
+		if t, ok := db.Driver().(*timedDB); ok {
+			observe := queryObserver(s.observeQuery)
+			t.observer.Store(&observe)
+		}
+	}
+	return s
+}
+
+// The embedded templates are part of the build, so failing to parse them is a bug
+func mustEmbeddedTemplates() *MessageTemplates {
+	t, err := NewMessageTemplates("")
+	if err != nil {
+		panic(err)
+	}
+	return t
 }
 
-// Setup table for above appoiuntment
+// Setup the tables, the appointments themselves are up to the store
 func (s *Server) initDB() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS appointments (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		first_name TEXT NOT NULL,
-		last_name TEXT NOT NULL,
-		visit_date TEXT NOT NULL UNIQUE,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	)`
-
-	_, err := s.db.Exec(query)
-	return err
+	if err := s.store.Init(); err != nil {
+		return err
+	}
+
+	// Everything else needs a real database
+	if s.db == nil {
+		return nil
+	}
+	if err := s.initDeliveriesTable(); err != nil {
+		return err
+	}
+	if err := s.initOverbookingsTable(); err != nil {
+		return err
+	}
+	if err := s.initReportTables(); err != nil {
+		return err
+	}
+	if err := s.initFeatureFlags(); err != nil {
+		return err
+	}
+	if err := s.initQueueTable(); err != nil {
+		return err
+	}
+	if err := s.initPriorityTable(); err != nil {
+		return err
+	}
+	if err := s.initSigningKeysTable(); err != nil {
+		return err
+	}
+	if err := s.initAPIKeysTable(); err != nil {
+		return err
+	}
+	if err := s.initDocumentsTable(); err != nil {
+		return err
+	}
+	if err := s.initStoredExportsTable(); err != nil {
+		return err
+	}
+	if err := s.initStatusNotices(); err != nil {
+		return err
+	}
+	if err := s.initInboundEmails(); err != nil {
+		return err
+	}
+	if err := s.initJobRunsTable(); err != nil {
+		return err
+	}
+	if err := s.initRemindersTable(); err != nil {
+		return err
+	}
+	return s.createIndexes()
 }
 
 // Send error ... there's gonna be a lot of options
-func (s *Server) sendErrorResponse(w http.ResponseWriter, statusCode int, errorType, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{
+// in whichever format the client asked for
+func (s *Server) sendErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, errorType, message string) {
+	s.countRejection(r, statusCode, errorType)
+	s.respond(w, r, statusCode, ErrorResponse{
 		Error:   errorType,
 		Message: message,
 	})
 }
 
-// Load UK public holidays for 2075 or whatever year we pick into memory
-func (s *Server) loadPublicHolidays(yearStr string, countryCode string) error {
-	url := fmt.Sprintf("https://date.nager.at/api/v3/PublicHolidays/%s/%s", yearStr, countryCode)
+// Fetch one country's public holidays for 2075 or whatever year we pick
+func (s *Server) fetchPublicHolidays(ctx context.Context, yearStr string, countryCode string) ([]PublicHoliday, error) {
 	log.Printf("Loading public holidays for %s in %s...", yearStr, countryCode)
 
-	// Remember the year for future appointment validation
-	s.yearStr = yearStr
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to fetch public holidays: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("public holiday API returned status: %d", resp.StatusCode)
-	}
-
 	var holidays []PublicHoliday
-	if err := json.NewDecoder(resp.Body).Decode(&holidays); err != nil {
-		return fmt.Errorf("failed to decode public holidays: %w", err)
+	if err := s.nagerGet(ctx, "/PublicHolidays/"+yearStr+"/"+countryCode, &holidays); err != nil {
+		return nil, fmt.Errorf("failed to fetch public holidays: %w", err)
 	}
-
-	// Cache public holidays in map
 	for _, holiday := range holidays {
-		s.publicHolidays[holiday.Date] = true
-		log.Printf("Loaded holiday: %s - %s", holiday.Date, holiday.LocalName)
+		s.debugf("Loaded holiday: %s - %s", holiday.Date, holiday.LocalName)
 	}
 
-	log.Printf("Successfully loaded %d public holidays for 2075", len(holidays))
-	return nil
-}
-
-// Check if a new date is one of the public holidays
-func (s *Server) isPublicHoliday(visitDate time.Time) bool {
-	visitDateStr := visitDate.Format("2006-01-02")
-	return s.publicHolidays[visitDateStr]
-}
-
-// Check if a new date is already exists on db as an appointment
-func (s *Server) appointmentExists(visitDate time.Time) (bool, error) {
-	var count int
-	query := "SELECT COUNT(*) FROM appointments WHERE visit_date = ?"
-	err := s.db.QueryRow(query, visitDate.Format("2006-01-02")).Scan(&count)
-	if err != nil {
-		return false, err
-	}
-	return count > 0, nil
+	log.Printf("Successfully loaded %d public holidays for %s in %s", len(holidays), yearStr, countryCode)
+	return holidays, nil
 }
 
 // The appointment handler,
@@ -158,142 +273,476 @@ func (s *Server) appointmentExists(visitDate time.Time) (bool, error) {
 // A 'real' system would always have a page/endpoint to list all current appointments etc.
 func (s *Server) createAppointment(w http.ResponseWriter, r *http.Request) {
 
-	// Construct a fake "today" using Now() and the server year
-	year, err := strconv.Atoi(s.yearStr)
+	today, err := s.today()
 	if err != nil {
 		fmt.Printf("Invalid year: %v\n", err)
 		return
 	}
 
-	var today time.Time
-	if s.todayOverride != nil { // Just for testing
-		today = *s.todayOverride
-	} else {
-		now := time.Now().UTC()
-		today = time.Date(year, now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-	}
-	// fmt.Printf("Constructed date: %s\n", today.Format("2006-01-02"))
-
 	if r.Method != http.MethodPost {
-		s.sendErrorResponse(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST method is allowed")
+		s.sendErrorResponse(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Only POST method is allowed")
 		return
 	}
 
 	var req AppointmentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.sendErrorResponse(w, http.StatusBadRequest, "invalid_json", "Invalid JSON format")
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
 		return
 	}
+	req.Channel = bookingChannel(r.Context())
+	s.book(w, r, req, today)
+}
+
+// Everything after decoding, for any channel
+func (s *Server) book(w http.ResponseWriter, r *http.Request, req AppointmentRequest, today time.Time) {
+	s.trackSubmitted(r, req)
+	r = withRequestedDate(r, req.VisitDate)
 
-	// Validate required fields
+	// Validate required fields, once the names are tidied
+	if !s.validateNames(w, r, &req) {
+		return
+	}
 	if req.FirstName == "" || req.LastName == "" || req.VisitDate == "" {
-		s.sendErrorResponse(w, http.StatusBadRequest, "missing_fields", "First name, last name, and visit date are required")
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "First name, last name, and visit date are required")
 		return
 	}
 
-	// Parse and validate visit date
-	visitDate, err := time.Parse("2006-01-02", req.VisitDate)
-	if err != nil {
-		s.sendErrorResponse(w, http.StatusBadRequest, "invalid_date", "Visit date must be in YYYY-MM-DD format")
+	// Communications come in English or Welsh
+	if req.PreferredLanguage == "" {
+		req.PreferredLanguage = DefaultLanguage
+	}
+	if !supportedLanguages[req.PreferredLanguage] {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidLanguage, "Preferred language must be 'en' or 'cy'")
 		return
 	}
 
-	// Validate year is 2075
-	if visitDate.Year() != today.Year() {
-		s.sendErrorResponse(w, http.StatusBadRequest, "invalid_year", "Appointments can only be scheduled for year 2075")
+	// Over the phone it's always the agent on the call who booked
+	if agent, ok := agentFrom(r.Context()); ok {
+		req.BookedBy = &BookedBy{Role: BookedByStaff, Name: agent.Name, StaffID: agent.ID}
+	}
+
+	if !s.validateAttendees(w, r, req) || !s.validateBookedBy(w, r, req.BookedBy) || !s.checkConsent(w, r, &req) {
 		return
 	}
 
-	// Check if date is earlier this year
-	if visitDate.Before(today) {
-		s.sendErrorResponse(w, http.StatusBadRequest, "past_date", "Visit date cannot be in the past")
+	// Some services only open for booking from a set time
+	service, ok := s.resolveService(w, r, req.Service)
+	if !ok || !s.checkBookingOpen(w, r, service, today) {
+		return
+	}
+	req.Service = service
+	if !s.validatePriority(w, r, req) || !s.validateCustomFields(w, r, req) || !s.validateAddress(w, r, &req) {
 		return
 	}
 
-	// Check if date is a public holiday
-	if s.isPublicHoliday(visitDate) {
-		s.sendErrorResponse(w, http.StatusBadRequest, "public_holiday", "Appointments cannot be scheduled on public holidays")
+	visitDate, ok := s.validateVisitDate(w, r, req.VisitDate, today)
+	if !ok || !s.checkLeadTime(w, r, req, visitDate, today) || !s.checkEligibility(w, r, req, visitDate) || !s.validateFollowUp(w, r, req, visitDate) {
 		return
 	}
 
-	// Check for duplicate appointment
-	exists, err := s.appointmentExists(visitDate)
+	req.Experiments = s.experimentsFor(clientIDFrom(r))
+
+	// Check there's room for everyone
+	// The DB gets a deadline of its own, and gives up if the client goes away
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	booked, err := s.store.Booked(ctx, visitDate)
 	if err != nil {
 		log.Printf("Error checking existing appointments: %v", err)
-		s.sendErrorResponse(w, http.StatusInternalServerError, "database_error", "Failed checking existing appointments")
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed checking existing appointments")
 		return
 	}
 
-	if exists {
-		s.sendErrorResponse(w, http.StatusConflict, "duplicate_appointment", "An appointment is already Scheduled for this date")
+	capacity, err := s.capacityOnChannel(ctx, visitDate, s.capacityFor(visitDate, req.Priority), channelOrOnline(req.Channel))
+	if err != nil {
+		log.Printf("Error checking channel quotas: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed checking existing appointments")
+		return
+	}
+	if booked+req.PartySize() > capacity {
+		s.sendFullyBooked(w, r)
 		return
 	}
 
-	// Create the appointment
-	var appointment Appointment
-	query := `
-		INSERT INTO appointments (first_name, last_name, visit_date) 
-		VALUES (?, ?, ?) 
-		RETURNING id, first_name, last_name, visit_date, created_at`
-
-	err = s.db.QueryRow(query, req.FirstName, req.LastName, visitDate.Format("2006-01-02")).Scan(
-		&appointment.ID,
-		&appointment.FirstName,
-		&appointment.LastName,
-		&appointment.VisitDate,
-		&appointment.CreatedAt,
-	)
-
+	// Create the appointment, which can still lose a race for the last places
+	appointment, err := s.store.Create(ctx, req, visitDate, capacity)
+	if errors.Is(err, ErrDuplicateAppointment) {
+		s.sendFullyBooked(w, r)
+		return
+	}
+	if errors.Is(err, ErrDayClosed) {
+		s.sendDayClosed(w, r)
+		return
+	}
 	if err != nil {
 		log.Printf("Error creating appointment: %v", err)
-		s.sendErrorResponse(w, http.StatusInternalServerError, "database_error", "Failed to create appointment")
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to create appointment")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(appointment)
+	// That day is gone from the date picker
+	s.invalidateAvailability(ctx)
+	s.noteOverbooking(ctx, appointment, visitDate, RevisionCreated)
+	s.notePriority(ctx, appointment, req, visitDate, today)
+
+	// Booked either way, but staff may want to know it's someone we've seen
+	s.respond(w, r, http.StatusCreated, CreatedAppointment{
+		Appointment:        appointment,
+		PossibleDuplicates: s.possibleDuplicates(ctx, r, appointment),
+		Warnings:           s.bookingWarnings(ctx, req, visitDate),
+	})
+	s.trackCreated(r, appointment, visitDate, today)
+
+	// Don't hold up the response for the confirmation, which
+	// has to outlive the request but not hang around forever
+	go func() {
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+		defer cancel()
+		s.notifyAppointment(ctx, MessageConfirmation, appointment)
+	}()
+}
+
+// Construct a fake "today" using Now() and the server year
+func (s *Server) today() (time.Time, error) {
+	year, err := strconv.Atoi(s.yearStr)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if s.todayOverride != nil { // Just for testing
+		return *s.todayOverride, nil
+	}
+	now := time.Now().UTC()
+	return time.Date(year, now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// Parse and validate visit date, sending the error if there is one.
+// The same rules apply to new bookings and to moving one
+func (s *Server) validateVisitDate(w http.ResponseWriter, r *http.Request, date string, today time.Time) (time.Time, bool) {
+	visitDate, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidDate, "Visit date must be in YYYY-MM-DD format")
+		return time.Time{}, false
+	}
+
+	// Validate year is 2075
+	if visitDate.Year() != today.Year() {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidYear, "Appointments can only be scheduled for year 2075")
+		return time.Time{}, false
+	}
+
+	// Check if date is earlier this year
+	if visitDate.Before(today) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodePastDate, "Visit date cannot be in the past")
+		return time.Time{}, false
+	}
+
+	// Check if date is a public holiday
+	holidays := s.holidaySet(r.Context())
+	if holidays.closed(visitDate) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodePublicHoliday, "Appointments cannot be scheduled on public holidays")
+		return time.Time{}, false
+	}
+
+	// Or might have become one since we last heard. Today's fine, we're open
+	if !visitDate.Equal(today) && holidays.tooStale(s.cfg.HolidayMaxStale) {
+		s.sendErrorResponse(w, r, http.StatusServiceUnavailable, CodeHolidaysStale, "Public holidays can't be checked right now, please try again later")
+		return time.Time{}, false
+	}
+
+	return visitDate, true
+}
+
+// A zero timeout means none, which is what the tests get
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// The driver specific bits come from sqlite_*.go depending on build tags
+func sqliteDSN(path, mode string) string {
+	dsn := "file:" + path + "?mode=" + mode
+	if sqliteParams != "" {
+		dsn += "&" + sqliteParams
+	}
+	return dsn
+}
+
+func configurePool(db *sql.DB, pool DBPoolConfig) {
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+}
+
+func openDB(dbPath string) (*sql.DB, error) {
+	if !sqliteAvailable {
+		return nil, errors.New("this build has no SQLite support (built without cgo), use CITYNEXT_STORE=memory")
+	}
+
+	// No shared cache, its table locks fail immediately and ignore the busy timeout
+	db, err := openTimed(sqliteDriver, sqliteDSN(dbPath, "rwc"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// Check it's live
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	return db, nil
 }
+
+// The routing ... /appointments is the public endpoint, /admin is for staff
+func (s *Server) routes() *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/appointments", s.rateLimit(s.idempotent(s.admitted(s.createAppointment)))).Methods("POST").Name("book")
+	r.Handle("/waiting-room", s.rateLimit(http.HandlerFunc(s.joinWaitingRoom))).Methods("POST")
+	r.HandleFunc("/waiting-room/{token}", s.getWaitingRoomTicket).Methods("GET")
+	r.HandleFunc("/waiting-room/{token}/events", s.waitingRoomEvents).Methods("GET").Name("waiting-room-events")
+	// The CRM is one client for every caller, so no per-IP rate limit
+	r.Handle("/channel/phone/appointments", s.requirePhoneChannel(s.idempotent(s.createAppointment))).Methods("POST").Name("book-phone")
+	r.HandleFunc("/holidays", s.getHolidays).Methods("GET")
+	r.HandleFunc("/version", s.getVersion).Methods("GET")
+	r.HandleFunc("/errors", s.listErrorCodes).Methods("GET")
+	r.HandleFunc("/session", s.login).Methods("POST")
+	r.HandleFunc("/session", s.logout).Methods("DELETE")
+	r.HandleFunc("/readyz", s.readyz).Methods("GET")
+	r.HandleFunc("/status", s.getStatus).Methods("GET")
+	r.HandleFunc("/metrics", s.getMetrics).Methods("GET")
+
+	r.HandleFunc("/availability", s.getAvailability).Methods("GET")
+	r.HandleFunc("/services/{service}/fields", s.getCustomFieldSchema).Methods("GET")
+	r.HandleFunc("/services/{service}/eligibility", s.getEligibilityRules).Methods("GET")
+	r.HandleFunc("/privacy-notice", s.getPrivacyNotice).Methods("GET")
+	r.HandleFunc("/experiments", s.getExperiments).Methods("GET")
+	r.Handle("/me/verify", s.rateLimit(http.HandlerFunc(s.verifyProfileEmail))).Methods("POST")
+	r.Handle("/me/profile", s.rateLimit(http.HandlerFunc(s.getProfile))).Methods("GET")
+	if s.postcodes != nil {
+		r.Handle("/postcodes/{postcode}/addresses", s.rateLimit(http.HandlerFunc(s.getPostcodeAddresses))).Methods("GET")
+	}
+	r.HandleFunc("/opendata/bookings.json", s.getOpenData).Methods("GET")
+	r.HandleFunc("/opendata/bookings.csv", s.getOpenData).Methods("GET")
+	r.HandleFunc("/sla/deadline", s.slaDeadline).Methods("POST")
+	r.Handle("/appointments", s.requireAdmin(http.HandlerFunc(s.listAppointments))).Methods("GET")
+	r.Handle("/schedule/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}/printable", s.requireAdmin(http.HandlerFunc(s.getRunSheet))).Methods("GET")
+	r.Handle("/appointments/export", s.requireAdmin(http.HandlerFunc(s.exportAppointments))).Methods("GET").Name("export")
+	r.Handle("/appointments/{id:[0-9]+}", s.requireAdmin(http.HandlerFunc(s.getAppointment))).Methods("GET")
+	r.Handle("/appointments/{id:[0-9]+}/history", s.requireAdmin(http.HandlerFunc(s.appointmentHistory))).Methods("GET")
+	r.Handle("/appointments/{id:[0-9]+}/badge", s.requireAdmin(http.HandlerFunc(s.getBadge))).Methods("GET")
+	r.Handle("/appointments/{id:[0-9]+}/clone", s.requireAdmin(s.idempotent(s.cloneAppointment))).Methods("POST").Name("clone")
+
+	ivr := r.PathPrefix("/channel/ivr").Subrouter()
+	ivr.Use(s.requireIVR)
+	ivr.HandleFunc("/appointments/{reference}", s.ivrLookup).Methods("GET")
+	ivr.HandleFunc("/appointments/{reference}/confirm", s.ivrConfirm).Methods("POST")
+	ivr.HandleFunc("/appointments/{reference}/cancel", s.ivrCancel).Methods("POST")
+
+	kiosk := r.PathPrefix("/kiosk").Subrouter()
+	kiosk.Use(s.requireKiosk)
+	kiosk.HandleFunc("/availability", s.kioskAvailability).Methods("GET").Name("kiosk-availability")
+	kiosk.HandleFunc("/checkin", s.kioskCheckIn).Methods("POST").Name("kiosk-checkin")
+
+	// The admin pages come first, so they load without a token
+	r.Handle("/admin", http.RedirectHandler("/admin/ui/", http.StatusFound)).Methods("GET")
+	r.Handle("/admin/ui", http.RedirectHandler("/admin/ui/", http.StatusFound)).Methods("GET")
+	r.PathPrefix("/admin/ui/").Handler(s.adminUI()).Methods("GET", "HEAD")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(s.requireAdmin)
+	admin.HandleFunc("/appointments", s.idempotent(s.createAppointment)).Methods("POST").Name("book-staff") // on someone's behalf
+	admin.HandleFunc("/walk-ins", s.idempotent(s.createWalkIn)).Methods("POST").Name("walk-in")
+	admin.HandleFunc("/appointments/{id:[0-9]+}/reschedule", s.rescheduleAppointment).Methods("POST")
+	admin.HandleFunc("/appointments/{id:[0-9]+}/transfer", s.transferAppointment).Methods("POST")
+	admin.HandleFunc("/appointments/{id:[0-9]+}/cancel", s.cancelAppointment).Methods("POST")
+	admin.HandleFunc("/rebalance", s.planRebalance).Methods("POST")
+	admin.HandleFunc("/rebalance/apply", s.applyRebalance).Methods("POST")
+	admin.HandleFunc("/status/notices", s.listStatusNotices).Methods("GET")
+	admin.HandleFunc("/status/notices", s.createStatusNotice).Methods("POST")
+	admin.HandleFunc("/status/notices/{id:[0-9]+}", s.getStatusNotice).Methods("GET")
+	admin.HandleFunc("/status/notices/{id:[0-9]+}", s.updateStatusNotice).Methods("PUT")
+	admin.HandleFunc("/status/notices/{id:[0-9]+}", s.deleteStatusNotice).Methods("DELETE")
+	admin.HandleFunc("/persons", s.createPerson).Methods("POST")
+	admin.HandleFunc("/persons/{id:[0-9]+}", s.getPerson).Methods("GET")
+	admin.HandleFunc("/persons/{id:[0-9]+}", s.updatePerson).Methods("PUT")
+	admin.HandleFunc("/persons/{id:[0-9]+}/appointments", s.personAppointments).Methods("GET")
+	admin.HandleFunc("/duplicates", s.listDuplicates).Methods("GET")
+	admin.HandleFunc("/duplicates/merge", s.mergeDuplicates).Methods("POST")
+	admin.HandleFunc("/overbooking", s.getOverbooking).Methods("GET")
+	admin.HandleFunc("/features", s.listFeatures).Methods("GET")
+	admin.HandleFunc("/features/{name}", s.setFeature).Methods("PUT", "DELETE")
+	admin.HandleFunc("/config/reload", s.handleConfigReload).Methods("POST")
+	admin.HandleFunc("/lockouts/{account}/{ip}", s.handleLockout).Methods("GET", "DELETE")
+	admin.HandleFunc("/holidays/refresh", s.forceHolidayRefresh).Methods("POST")
+	admin.HandleFunc("/jobs", s.listJobs).Methods("GET")
+	admin.HandleFunc("/jobs/{name}/run", s.runJobNow).Methods("POST")
+	admin.HandleFunc("/reports/capacity", s.getCapacityReport).Methods("GET")
+	admin.HandleFunc("/reports/monthly", s.getMonthlyReport).Methods("GET")
+	admin.HandleFunc("/reports/experiments", s.getExperimentsReport).Methods("GET")
+	admin.HandleFunc("/latency", s.getLatency).Methods("GET")
+	admin.HandleFunc("/closures", s.listClosures).Methods("GET")
+	admin.HandleFunc("/closures", s.createClosure).Methods("POST")
+	// From the closure message, so signed rather than behind a token
+	r.HandleFunc("/rebook/{id:[0-9]+}", s.signedLink(s.singleUse(s.getRebooking))).Methods("GET")
+	r.Handle("/rebook/{id:[0-9]+}", s.rateLimit(s.signedLink(s.singleUse(s.rebook)))).Methods("POST")
+	r.HandleFunc("/rebook/{id:[0-9]+}/accept", s.signedLink(s.singleUse(s.getProposal))).Methods("GET")
+	r.Handle("/rebook/{id:[0-9]+}/accept", s.rateLimit(s.signedLink(s.singleUse(s.acceptProposal)))).Methods("POST")
+
+	// These all need a real database
+	if s.db != nil {
+		admin.HandleFunc("/deliveries", s.listDeliveries).Methods("GET")
+		admin.HandleFunc("/deliveries/{id:[0-9]+}/requeue", s.requeueDelivery).Methods("POST")
+		admin.HandleFunc("/backups", s.createBackup).Methods("POST")
+		admin.HandleFunc("/integrity-check", s.forceIntegrityCheck).Methods("POST")
+		admin.HandleFunc("/priority-bookings", s.listPriorityBookings).Methods("GET")
+		admin.HandleFunc("/api-keys", s.listAPIKeys).Methods("GET")
+		admin.HandleFunc("/api-keys", s.createAPIKey).Methods("POST")
+		admin.HandleFunc("/api-keys/{id:[0-9]+}", s.revokeAPIKey).Methods("DELETE")
+		admin.HandleFunc("/signing-keys", s.listSigningKeys).Methods("GET")
+		admin.HandleFunc("/signing-keys", s.addSigningKey).Methods("POST")
+		admin.HandleFunc("/signing-keys/{id}", s.retireSigningKey).Methods("DELETE")
+		admin.HandleFunc("/queue/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}/{service}/next", s.callNext).Methods("POST")
+		r.Handle("/queue/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}", s.requireAdmin(http.HandlerFunc(s.getQueue))).Methods("GET")
+		r.Handle("/queue/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}/events", s.requireAdmin(http.HandlerFunc(s.queueEvents))).Methods("GET").Name("queue-events")
+		r.HandleFunc("/display/{location}", s.getDisplay).Methods("GET") // public, for the waiting room screens
+		r.HandleFunc("/display/{location}/events", s.displayEvents).Methods("GET").Name("display-events")
+		// Signed by the provider rather than behind a token
+		r.HandleFunc("/inbound/email/mailgun", s.mailgunInboundEmail).Methods("POST")
+		r.HandleFunc("/inbound/email/ses", s.sesInboundEmail).Methods("POST")
+		admin.HandleFunc("/inbound-emails", s.listInboundEmails).Methods("GET")
+		admin.HandleFunc("/inbound-emails/{id:[0-9]+}/review", s.reviewInboundEmail).Methods("POST")
+	}
+	if s.blobs != nil {
+		admin.HandleFunc("/exports", s.storeExport).Methods("POST")
+		admin.HandleFunc(`/exports/{name:appointments-[0-9]{8}T[0-9]{6}Z\.(?:ndjson|xlsx)}`, s.downloadExport).Methods("GET")
+		if s.cfg.DownloadSecret != "" {
+			admin.HandleFunc(`/exports/{name:appointments-[0-9]{8}T[0-9]{6}Z\.(?:ndjson|xlsx)}/link`, s.linkExport).Methods("POST")
+			r.HandleFunc(`/downloads/exports/{name:appointments-[0-9]{8}T[0-9]{6}Z\.(?:ndjson|xlsx)}`, s.signedLink(s.downloadExport)).Methods("GET")
+		}
+	}
+	if s.db != nil && s.blobs != nil {
+		r.Handle("/appointments/{id:[0-9]+}/documents", s.rateLimit(http.HandlerFunc(s.uploadDocument))).Methods("POST").Name("upload-document")
+		admin.HandleFunc("/appointments/{id:[0-9]+}/documents", s.listDocuments).Methods("GET")
+		admin.HandleFunc("/documents/{id:[0-9]+}", s.downloadDocument).Methods("GET")
+		admin.HandleFunc("/documents/{id:[0-9]+}/hold", s.holdDocument).Methods("PUT")
+		admin.HandleFunc("/document-deletions", s.listDocumentDeletions).Methods("GET")
+		if s.cfg.DownloadSecret != "" {
+			admin.HandleFunc("/documents/{id:[0-9]+}/link", s.linkDocument).Methods("POST")
+			r.HandleFunc("/downloads/documents/{id:[0-9]+}", s.signedLink(s.downloadDocument)).Methods("GET")
+		}
+	}
+
+	r.Use(s.timeRoutes)
+	r.Use(s.trace)
+	r.Use(s.compress)
+	r.Use(s.handlerTimeout)
+	r.Use(s.cors)
+	r.Use(s.experimentHeader)
+
+	return r
+}
+
 func main() {
 	//Santiy check
 	fmt.Println("Starting server...")
 
-	// Set defaults for country and year
-	// We assume country is always GB, but lets keep it near the yearStr
-	countryCode := "GB"
+	// Set defaults for year, the countries are in the config
 	yearStr := "2075"
 
 	// Take the year from the commandline and build a fake "now" date
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <year>")
+		fmt.Println("Usage: go run . <year>")
+		fmt.Println("   or: go run . <command> [args...]")
 		return
 	}
 
-	yearStr = os.Args[1]
+	if err := readConfigFile(os.Getenv("CITYNEXT_CONFIG_FILE")); err != nil {
+		log.Fatal("Failed to read the config file:", err)
+	}
+	if err := readVaultSecrets(context.Background()); err != nil {
+		log.Fatal("Failed to read secrets from Vault:", err)
+	}
+	cfg := loadConfig()
 
-	dbPath := "./appointments.db"
-	db, err := sql.Open("sqlite3", "file:"+dbPath+"?cache=shared&mode=rwc")
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+	// Maintenance commands rather than the server
+	if command, ok := commands[os.Args[1]]; ok {
+		if err := command(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
 	}
-	defer db.Close()
 
-	// Check it's live
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	yearStr = os.Args[1]
+	info := buildInfo()
+	log.Printf("CityNext %s (commit %s, built %s, %s)", info.Version, info.Commit, info.BuildDate, info.GoVersion)
+
+	var db *sql.DB
+	var err error
+	switch cfg.Store {
+	case "sqlite", "events":
+		if db, err = openDB(cfg.DBPath); err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		configurePool(db, cfg.DBPool)
+		log.Printf("Connected to SQLite database: %s\n", cfg.DBPath)
+	case "memory":
+		log.Printf("Using the in-memory store, appointments will be lost on restart")
+	default:
+		log.Fatalf("Unknown CITYNEXT_STORE %q, expected sqlite, events or memory", cfg.Store)
+	}
 
-	if err := db.PingContext(ctx); err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+	server := NewServer(db)
+	server.cfg = cfg
+	if cfg.Store == "events" {
+		server.store = newEventStore(db)
+		log.Printf("Keeping an event log of every change to appointments")
 	}
 
-	log.Printf("Connected to SQLite database: %s\n", dbPath)
+	// Somewhere to keep documents and exports
+	server.blobs = newBlobStore(cfg)
+	server.scanner = newVirusScanner(cfg)
+	if server.notifier, server.texts, server.letters, err = newNotifiers(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if server.postcodes, err = newPostcodeLookup(cfg.PostcodeLookup); err != nil {
+		log.Fatal(err)
+	}
+	if server.analytics, err = newAnalytics(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if server.blobs != nil && server.scanner == nil {
+		log.Printf("Document uploads won't be virus scanned, there's no CITYNEXT_CLAMD_ADDR")
+	}
 
-	server := NewServer(db)
+	// Shared state for running more than one instance
+	if cfg.RedisURL != "" {
+		client, err := newRedisClient(cfg.RedisURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		server.cache = redisCache{client: client}
+		server.locker = redisLocker{client: client}
+		log.Printf("Using redis for caching and locks")
+	}
+
+	// Message templates, with any local overrides watched for edits
+	if server.templates, err = NewMessageTemplates(cfg.TemplateDir); err != nil {
+		log.Fatal("Failed to load message templates:", err)
+	}
+	go server.templates.Watch(5*time.Second, nil)
 
 	// fmt.Printf("%+v\n", server)
 
 	// Now we need those public holidays
-	if err := server.loadPublicHolidays(yearStr, countryCode); err != nil {
+	if err := server.loadHolidays(context.Background(), yearStr, cfg.Countries); err != nil {
 		log.Fatal("Failed to load public holidays:", err)
 	}
 
@@ -304,27 +753,119 @@ func main() {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
-	// The routing ... to /appointments ... our only endpoint and just for POST
-	r := mux.NewRouter()
-	r.HandleFunc("/appointments", server.createAppointment).Methods("POST")
+	// Let people in from the waiting room, when it's on
+	go server.admitWaiting(time.Second, nil)
 
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	// The jobs below run every so long, or on a CITYNEXT_<JOB>_SCHEDULE
+	schedule := func(name string, interval time.Duration) jobSchedule {
+		sched, err := cfg.jobSchedule(name, interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return sched
+	}
 
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
+	// Retry any messages that didn't make it first time
+	if db != nil {
+		go server.retryDeliveries(schedule("delivery-retries", 30*time.Second), nil)
+	}
 
-			next.ServeHTTP(w, r)
-		})
-	})
+	// Documents and stored exports past their time
+	if db != nil && server.blobs != nil && (cfg.DocumentRetentionDays > 0 || cfg.ExportTTL > 0) {
+		go server.expireDocuments(schedule("document-retention", time.Hour), nil)
+	}
 
-	port := ":8080"
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(port, r))
+	// Last month's figures to the managers, if anyone wants them
+	if len(cfg.MonthlyReportTo) > 0 {
+		if db == nil {
+			log.Fatal("Monthly reports need the sqlite store")
+		}
+		go server.scheduleMonthlyReports(schedule("monthly-report", time.Hour), nil)
+	}
+
+	// Reminders of the visit, a few days before
+	if cfg.ReminderDays > 0 {
+		if db == nil {
+			log.Fatal("Reminders need the sqlite store")
+		}
+		go server.scheduleReminders(schedule("reminders", time.Hour), nil)
+	}
+
+	// Fresh holidays at a set time, as well as when they go stale
+	if cfg.scheduled("holiday-refresh", 0) {
+		go server.scheduleHolidayRefresh(schedule("holiday-refresh", 0), nil)
+	}
+
+	// Regular snapshots, if asked for
+	backups, replication := cfg.scheduled("backup", cfg.BackupInterval), cfg.scheduled("replication", cfg.ReplicaInterval)
+	if db == nil && (backups || replication) {
+		log.Fatal("Backups and replication need the sqlite store")
+	}
+	if backups {
+		go server.scheduleBackups(schedule("backup", cfg.BackupInterval), nil)
+	}
+
+	// Catch a corrupt database file before someone stumbles on it
+	if db != nil && cfg.scheduled("integrity-check", cfg.IntegrityCheckInterval) {
+		go server.checkIntegrityEvery(schedule("integrity-check", cfg.IntegrityCheckInterval), nil)
+	}
+
+	// And continuous replication to somewhere off the box
+	if replication {
+		replicator := newReplicator(cfg)
+		if replicator == nil {
+			log.Fatal("Replication is switched on but there is no CITYNEXT_REPLICA_DIR or S3 bucket to replicate to")
+		}
+		go server.replicate(replicator, schedule("replication", cfg.ReplicaInterval), nil)
+	}
+
+	// Rejected bookings for the monthly report, written out before exiting
+	rejectionsStop, rejectionsDone := make(chan struct{}), make(chan struct{})
+	if db != nil {
+		go func() {
+			server.writeRejections(rejectionFlushInterval, rejectionsStop)
+			close(rejectionsDone)
+		}()
+	} else {
+		close(rejectionsDone)
+	}
+
+	// The funnel for the digital team, sent on before exiting
+	analyticsStop, analyticsDone := make(chan struct{}), make(chan struct{})
+	if server.analytics != nil {
+		go func() {
+			server.shipAnalytics(analyticsInterval, analyticsStop)
+			close(analyticsDone)
+		}()
+	} else {
+		close(analyticsDone)
+	}
+
+	// Pick up config changes without dropping anyone's booking
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go server.reloadOnSignal(hup)
+
+	r := server.routes()
+
+	addr := listenAddr(os.Args[2:], cfg.Listen)
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	log.Printf("Server starting on %s", l.Addr())
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	srv := newHTTPServer(addr, r, cfg)
+	srv.RegisterOnShutdown(server.streams.drain)
+	err = serve(srv, l, stop, cfg.ShutdownTimeout)
+	close(analyticsStop)
+	close(rejectionsStop)
+	<-analyticsDone
+	<-rejectionsDone
+	if err != nil {
+		log.Fatal(err)
+	}
 
 }
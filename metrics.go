@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Just enough of Prometheus' text format to be scraped, counters, gauges
+// and histograms with labels, without pulling in the client library
+type metrics struct {
+	mu   sync.Mutex
+	defs map[string]*metricDef
+}
+
+type metricDef struct {
+	name, help, kind string // kind is counter, gauge or histogram
+	labels           []string
+	buckets          []float64 // upper bounds, histograms only
+	series           map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // the counter or gauge, or a histogram's sum
+	count       uint64   // histogram observations
+	buckets     []uint64 // per bound, not cumulative
+}
+
+// Seconds, from a fast cache hit to a slow third party
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newMetrics() *metrics {
+	m := &metrics{defs: make(map[string]*metricDef)}
+	m.define("citynext_dependency_requests_total", "counter", "Calls to outside services, by outcome", nil, "dependency", "outcome")
+	m.define("citynext_dependency_duration_seconds", "histogram", "How long calls to outside services took", latencyBuckets, "dependency")
+	m.define("citynext_auth_failures_total", "counter", "Requests turned away for a wrong token, by which token", nil, "account")
+	m.define("citynext_auth_lockouts_total", "counter", "Clients locked out for too many wrong tokens", nil, "account")
+	m.define("citynext_http_request_duration_seconds", "histogram", "How long requests took, by the route they matched", latencyBuckets, "method", "route")
+	m.define("citynext_db_query_duration_seconds", "histogram", "How long database queries took, by the route they were for", latencyBuckets, "route")
+	m.define("citynext_db_slow_queries_total", "counter", "Queries over CITYNEXT_SLOW_QUERY_THRESHOLD, by the route they were for", nil, "route")
+	m.define("citynext_db_integrity_checks_total", "counter", "Database integrity checks, by result", nil, "result")
+	m.define("citynext_db_integrity_ok", "gauge", "Whether the last integrity check passed", nil)
+	m.define("citynext_db_integrity_checked_timestamp_seconds", "gauge", "When the last integrity check ran", nil)
+	m.define("citynext_booking_rejections_total", "counter", "Bookings turned away, by the error code and the channel", nil, "reason", "channel")
+	m.define("citynext_availability_lookups_total", "counter", "Availability asked for, by whether it was cached, worked out, or shared with a request already working it out", nil, "result")
+	return m
+}
+
+func (m *metrics) define(name, kind, help string, buckets []float64, labels ...string) {
+	m.defs[name] = &metricDef{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+// Caller holds the mutex
+func (m *metrics) seriesFor(name string, labelValues []string) *metricSeries {
+	def, ok := m.defs[name]
+	if !ok || len(labelValues) != len(def.labels) {
+		panic("metrics: unknown metric or wrong labels for " + name)
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := def.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues, buckets: make([]uint64, len(def.buckets))}
+		def.series[key] = s
+	}
+	return s
+}
+
+func (m *metrics) inc(name string, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesFor(name, labelValues).value++
+}
+
+func (m *metrics) set(name string, v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesFor(name, labelValues).value = v
+}
+
+func (m *metrics) observe(name string, v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.seriesFor(name, labelValues)
+	s.value += v
+	s.count++
+	for i, bound := range m.defs[name].buckets {
+		if v <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+type seriesQuantiles struct {
+	labelValues []string
+	count       uint64
+	values      []float64 // one per quantile asked for
+}
+
+// Estimated from a histogram's buckets, going linearly through the bucket
+// each falls in as histogram_quantile does. Past the last bound is the
+// last bound
+func (m *metrics) quantiles(name string, qs ...float64) []seriesQuantiles {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	def := m.defs[name]
+	var all []seriesQuantiles
+	for _, s := range def.series {
+		sq := seriesQuantiles{labelValues: s.labelValues, count: s.count, values: make([]float64, len(qs))}
+		for i, q := range qs {
+			rank := q * float64(s.count)
+			var cumulative uint64
+			sq.values[i] = def.buckets[len(def.buckets)-1]
+			for b, bound := range def.buckets {
+				if float64(cumulative+s.buckets[b]) < rank || s.buckets[b] == 0 {
+					cumulative += s.buckets[b]
+					continue
+				}
+				lower := 0.0
+				if b > 0 {
+					lower = def.buckets[b-1]
+				}
+				sq.values[i] = lower + (bound-lower)*(rank-float64(cumulative))/float64(s.buckets[b])
+				break
+			}
+		}
+		all = append(all, sq)
+	}
+	return all
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.defs))
+	for name := range m.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		def := m.defs[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, def.help, name, def.kind)
+
+		keys := make([]string, 0, len(def.series))
+		for key := range def.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := def.series[key]
+			if def.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(def.labels, s.labelValues), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range def.buckets {
+				cumulative += s.buckets[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(slices.Concat(def.labels, []string{"le"}), slices.Concat(s.labelValues, []string{formatFloat(bound)})), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(slices.Concat(def.labels, []string{"le"}), slices.Concat(s.labelValues, []string{"+Inf"})), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(def.labels, s.labelValues), formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(def.labels, s.labelValues), s.count)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// GET /metrics, for Prometheus
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.writeTo(w)
+}
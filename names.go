@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	NameCharactersLetters = "letters" // letters, accents and vowel signs in any script, spaces, apostrophes, hyphens and full stops
+	NameCharactersLatin   = "latin"   // the same, Latin letters only, for systems further on that can't take anything else
+	NameCharactersAny     = "any"     // anything printable
+)
+
+// What CITYNEXT_NAME_CHARACTERS allows in a name
+var nameCharacters = map[string]func(r rune) bool{
+	NameCharactersLetters: func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.Is(unicode.M, r) || namePunctuation(r)
+	},
+	NameCharactersLatin: func(r rune) bool {
+		return unicode.Is(unicode.Latin, r) || unicode.Is(unicode.M, r) || namePunctuation(r)
+	},
+	NameCharactersAny: unicode.IsPrint,
+}
+
+// O'Brien, O’Brien, Smith-Jones, St. John, Mary Ann
+func namePunctuation(r rune) bool {
+	return r == ' ' || r == '\'' || r == '’' || r == '-' || r == '‐' || r == '.'
+}
+
+// NFC so a name typed with combining accents is the same as one typed
+// without, spaces of any kind trimmed and runs of them made one, and
+// control and zero-width characters dropped
+func cleanName(name string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range norm.NFC.String(name) {
+		switch {
+		case unicode.IsSpace(r):
+			space = b.Len() > 0
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+		default:
+			if space {
+				b.WriteRune(' ')
+				space = false
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// A 400 invalid_name for a name that's too long or has characters
+// CITYNEXT_NAME_CHARACTERS doesn't allow. It's been cleaned already
+func (s *Server) checkName(w http.ResponseWriter, r *http.Request, field, name string) bool {
+	live := s.live()
+	if n := utf8.RuneCountInString(name); live.NameMaxLength > 0 && n > live.NameMaxLength {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidName, fmt.Sprintf("%s can be at most %d characters", field, live.NameMaxLength))
+		return false
+	}
+	allowed, ok := nameCharacters[live.NameCharacters]
+	if !ok {
+		allowed = nameCharacters[NameCharactersLetters]
+	}
+	if i := strings.IndexFunc(name, func(r rune) bool { return !allowed(r) }); i >= 0 {
+		bad, _ := utf8.DecodeRuneInString(name[i:])
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidName, fmt.Sprintf("%s can't have %q in it", field, bad))
+		return false
+	}
+	return true
+}
+
+// Titles are short, Mrs, Parch, Lady
+const maxTitleLength = 20
+
+// A title and preferred name are optional, but checked like the rest
+// when they're given. Both have been cleaned already
+func (s *Server) checkAddressedAs(w http.ResponseWriter, r *http.Request, title, preferredName string) bool {
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidName, fmt.Sprintf("Title can be at most %d characters", maxTitleLength))
+		return false
+	}
+	if title != "" && !s.checkName(w, r, "Title", title) {
+		return false
+	}
+	return preferredName == "" || s.checkName(w, r, "Preferred name", preferredName)
+}
+
+// How messages address them, "Dr Jones" if they've a title and by the
+// name they go by if not
+func (a Appointment) Salutation() string {
+	if a.Title != "" {
+		return a.Title + " " + a.LastName
+	}
+	return cmp.Or(a.PreferredName, a.FirstName) + " " + a.LastName
+}
+
+// Tidies the names on a booking, the people with them included, and
+// checks them. Call before anything else looks at them
+func (s *Server) validateNames(w http.ResponseWriter, r *http.Request, req *AppointmentRequest) bool {
+	req.FirstName, req.LastName = cleanName(req.FirstName), cleanName(req.LastName)
+	req.Title, req.PreferredName = cleanName(req.Title), cleanName(req.PreferredName)
+	for i := range req.Attendees {
+		req.Attendees[i].FirstName, req.Attendees[i].LastName = cleanName(req.Attendees[i].FirstName), cleanName(req.Attendees[i].LastName)
+	}
+	if req.FirstName == "" || req.LastName == "" {
+		return true // missing, which book says
+	}
+	if !s.checkName(w, r, "First name", req.FirstName) || !s.checkName(w, r, "Last name", req.LastName) || !s.checkAddressedAs(w, r, req.Title, req.PreferredName) {
+		return false
+	}
+	for _, attendee := range req.Attendees {
+		if attendee.FirstName == "" || attendee.LastName == "" {
+			continue // validateAttendees says
+		}
+		if !s.checkName(w, r, "An attendee's first name", attendee.FirstName) || !s.checkName(w, r, "An attendee's last name", attendee.LastName) {
+			return false
+		}
+	}
+	return true
+}
+
+func nameCharacterSets() string {
+	return strings.Join(slices.Sorted(maps.Keys(nameCharacters)), ", ")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	for in, want := range map[string]string{
+		"  O'Brien ":              "O'Brien",
+		"Mari\u0301a":             "Mar\u00eda", // a combining accent
+		"Mary \t  Ann":            "Mary Ann",
+		"\u00a0Smith-Jones\u3000": "Smith-Jones",
+		"Zo\u200be\u0000":         "Zoe",
+		"   ":                     "",
+	} {
+		if got := cleanName(in); got != want {
+			t.Errorf("Expected %q cleaned to %q, got %q", in, want, got)
+		}
+	}
+	if !firstNamesMatch("Jose\u0301", "Jos\u00e9") || !lastNamesMatch("Nu\u0301n\u0303ez", "N\u00fa\u00f1ez") {
+		t.Errorf("Expected the same name typed two ways to match")
+	}
+}
+
+func TestNameValidation(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.NameMaxLength = 100
+	router := server.routes()
+
+	book := func(first, last string) *http.Response {
+		w := postAppointment(t, router, AppointmentRequest{FirstName: first, LastName: last, VisitDate: "2075-02-03"})
+		return w.Result()
+	}
+	for _, name := range [][2]string{{" María ", "O'Brien"}, {"Siân", "Smith-Jones"}, {"Mary Ann", "St. John"}, {"Åsa", "O’Neill"}, {"José", "Núñez"}, {"Алексей", "Иванов"}, {"美咲", "佐藤"}, {"मोहन", "शर्मा"}, {"முருகன்", "செல்வம்"}} {
+		w := postAppointment(t, router, AppointmentRequest{FirstName: name[0], LastName: name[1], VisitDate: "2075-02-04"})
+		var got CreatedAppointment
+		json.Unmarshal(w.Body.Bytes(), &got)
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected %s %s booked, got %d: %s", name[0], name[1], w.Code, w.Body.String())
+		} else if got.FirstName != cleanName(name[0]) || got.FirstName != strings.TrimSpace(got.FirstName) {
+			t.Errorf("Expected the name stored tidied, got %q", got.FirstName)
+		}
+		server.db.Exec("DELETE FROM appointments")
+	}
+
+	for _, name := range [][2]string{{"Robert');", "Tables"}, {"Ann", "<script>"}, {"R2", "D2"}, {strings.Repeat("a", 101), "Long"}} {
+		if res := book(name[0], name[1]); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %q %q refused, got %d", name[0], name[1], res.StatusCode)
+		}
+	}
+	if res := book(" \u200b ", "Empty"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a blank name missing, got %d", res.StatusCode)
+	}
+
+	server.cfg.NameCharacters = NameCharactersLatin
+	if res := book("Алексей", "Иванов"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected Cyrillic refused when only Latin is, got %d", res.StatusCode)
+	}
+	server.cfg.NameCharacters, server.cfg.NameMaxLength = NameCharactersAny, 0
+	if res := book("R2", strings.Repeat("D", 200)); res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected anything printable allowed, got %d", res.StatusCode)
+	}
+}
+
+func TestAddressedAs(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, sent := closureServer(t, store)
+			router := server.routes()
+
+			w := postAppointment(t, router, AppointmentRequest{FirstName: "Samantha", LastName: "Jones", Title: " Dr ", PreferredName: "Sam", Email: "sam@example.com", VisitDate: "2075-01-09"})
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+			}
+			if msg := sent.next(t); !strings.Contains(msg.Text, "Dear Dr Jones,") {
+				t.Errorf("Expected the confirmation to use their title, got %s", msg.Text)
+			}
+
+			staff := func(method, path, body string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest(method, path, []byte(body)))
+				return w
+			}
+			var list AppointmentList
+			json.Unmarshal(staff("GET", "/appointments", "").Body.Bytes(), &list)
+			if len(list.Appointments) != 1 || list.Appointments[0].Title != "Dr" || list.Appointments[0].PreferredName != "Sam" {
+				t.Fatalf("Expected the title and preferred name on the schedule, got %+v", list.Appointments)
+			}
+
+			// Without a title it's the name they go by
+			if w := staff("PUT", "/admin/persons/1", `{"firstName": "Samantha", "lastName": "Jones", "email": "sam@example.com", "preferredName": "Sam"}`); w.Code != http.StatusOK {
+				t.Fatalf("Expected the person updated, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := staff("POST", "/admin/appointments/1/reschedule", `{"visitDate": "2075-01-10"}`); w.Code != http.StatusOK {
+				t.Fatalf("Expected a reschedule, got %d: %s", w.Code, w.Body.String())
+			}
+			if msg := sent.next(t); !strings.Contains(msg.Text, "Dear Sam Jones,") {
+				t.Errorf("Expected the confirmation to use their preferred name, got %s", msg.Text)
+			}
+			var history History
+			json.Unmarshal(staff("GET", "/appointments/1/history", "").Body.Bytes(), &history)
+			if n := len(history.Revisions); n != 3 || history.Revisions[0].Title != "Dr" || history.Revisions[1].Change != RevisionPersonUpdated || history.Revisions[2].Title != "" || history.Revisions[2].PreferredName != "Sam" {
+				t.Errorf("Expected each revision to keep how they were addressed then, got %+v", history.Revisions)
+			}
+
+			for _, body := range []string{
+				`{"firstName": "Ann", "lastName": "Long", "visitDate": "2075-01-16", "title": "` + strings.Repeat("Very ", 5) + `Reverend"}`,
+				`{"firstName": "Ann", "lastName": "Odd", "visitDate": "2075-01-16", "preferredName": "<Annie>"}`,
+			} {
+				if w := staff("POST", "/admin/appointments", body); w.Code != http.StatusBadRequest {
+					t.Errorf("Expected %s refused, got %d: %s", body, w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
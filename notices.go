@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Banners staff put up, "phone lines busy", "office closed 24 Dec", for
+// a set time. They go out on /status and with availability, so the
+// front-ends show them without anyone redeploying anything
+const (
+	NoticeMaintenance = "maintenance"
+	NoticeClosure     = "closure"
+	NoticeInfo        = "info"
+)
+
+// Every availability lookup wants the notices, so the ones showing are
+// cached this long, and dropped straight away when staff change one
+const (
+	noticesCacheKey = "status:notices"
+	noticesTTL      = 30 * time.Second
+)
+
+type StatusNotice struct {
+	XMLName   xml.Name   `json:"-" xml:"notice"`
+	ID        int        `json:"id,omitempty" xml:"id,attr,omitempty"` // none for ones from closures
+	Kind      string     `json:"kind" xml:"kind"`
+	Message   string     `json:"message" xml:"message"`
+	StartsAt  time.Time  `json:"startsAt" xml:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty" xml:"endsAt,omitempty"` // none for until it's taken down
+	CreatedBy string     `json:"createdBy,omitempty" xml:"createdBy,omitempty"`
+	UpdatedBy string     `json:"updatedBy,omitempty" xml:"updatedBy,omitempty"`
+}
+
+type StatusNoticeList struct {
+	XMLName xml.Name       `json:"-" xml:"notices"`
+	Notices []StatusNotice `json:"notices" xml:"notice"`
+}
+
+func (s *Server) initStatusNotices() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS status_notices (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		message TEXT NOT NULL,
+		starts_at DATETIME NOT NULL,
+		ends_at DATETIME,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(s.db, "status_notices", "updated_by", "TEXT NOT NULL DEFAULT ''")
+}
+
+func (s *Server) statusNotices(ctx context.Context, where string, args ...any) ([]StatusNotice, error) {
+	notices := []StatusNotice{}
+	if s.db == nil {
+		return notices, nil
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT id, kind, message, starts_at, ends_at, created_by, updated_by FROM status_notices "+where+" ORDER BY starts_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n StatusNotice
+		var endsAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Message, &n.StartsAt, &endsAt, &n.CreatedBy, &n.UpdatedBy); err != nil {
+			return nil, err
+		}
+		if endsAt.Valid {
+			n.EndsAt = &endsAt.Time
+		}
+		notices = append(notices, n)
+	}
+	return notices, rows.Err()
+}
+
+// The ones showing at now, without who put them up. One starting or
+// ending shows or goes within noticesTTL
+func (s *Server) currentNotices(ctx context.Context, now time.Time) ([]StatusNotice, error) {
+	if body, ok, err := s.cache.Get(ctx, noticesCacheKey); err == nil && ok {
+		var notices []StatusNotice
+		if json.Unmarshal(body, &notices) == nil {
+			return notices, nil
+		}
+	}
+	notices, err := s.statusNotices(ctx, "WHERE starts_at <= ?1 AND (ends_at IS NULL OR ends_at > ?1)", now)
+	if err != nil {
+		return nil, err
+	}
+	for i := range notices {
+		notices[i].CreatedBy, notices[i].UpdatedBy = "", ""
+	}
+	body, _ := json.Marshal(notices)
+	if err := s.cache.Set(ctx, noticesCacheKey, body, noticesTTL); err != nil {
+		log.Printf("Error caching notices: %v", err)
+	}
+	return notices, nil
+}
+
+func (s *Server) invalidateNotices(ctx context.Context) {
+	if err := s.cache.Delete(ctx, noticesCacheKey); err != nil {
+		log.Printf("Error invalidating cached notices: %v", err)
+	}
+}
+
+// Availability goes out without them rather than not at all
+func (s *Server) withNotices(ctx context.Context, availability Availability) Availability {
+	notices, err := s.currentNotices(ctx, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error loading notices: %v", err)
+		return availability
+	}
+	availability.Notices = notices
+	return availability
+}
+
+// Sends a 400 and returns false if it won't do. A notice with no start
+// starts now
+func (s *Server) validateNotice(w http.ResponseWriter, r *http.Request, n *StatusNotice) bool {
+	if n.Message == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "Message is required")
+		return false
+	}
+	if n.Kind == "" {
+		n.Kind = NoticeInfo
+	}
+	if !slices.Contains([]string{NoticeMaintenance, NoticeClosure, NoticeInfo}, n.Kind) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidKind, "Kind should be maintenance, closure or info")
+		return false
+	}
+	if n.StartsAt.IsZero() {
+		n.StartsAt = time.Now().UTC().Truncate(time.Second)
+	}
+	n.StartsAt = n.StartsAt.UTC()
+	if n.EndsAt != nil {
+		endsAt := n.EndsAt.UTC()
+		if !endsAt.After(n.StartsAt) {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidRange, "It has to end after it starts")
+			return false
+		}
+		n.EndsAt = &endsAt
+	}
+	return true
+}
+
+// GET /admin/status/notices, the ones showing and still to come, or
+// with ?all=true the ones that have ended too
+func (s *Server) listStatusNotices(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	var notices []StatusNotice
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		notices, err = s.statusNotices(ctx, "")
+	} else {
+		notices, err = s.statusNotices(ctx, "WHERE ends_at IS NULL OR ends_at > ?", time.Now().UTC())
+	}
+	if err != nil {
+		log.Printf("Error listing status notices: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list notices")
+		return
+	}
+	s.respond(w, r, http.StatusOK, StatusNoticeList{Notices: notices})
+}
+
+// GET /admin/status/notices/{id}
+func (s *Server) getStatusNotice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	notices, err := s.statusNotices(ctx, "WHERE id = ?", id)
+	if err != nil {
+		log.Printf("Error loading status notice %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load the notice")
+		return
+	}
+	if len(notices) == 0 {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No notice with that ID")
+		return
+	}
+	s.respond(w, r, http.StatusOK, notices[0])
+}
+
+// POST /admin/status/notices with {"kind": "maintenance", "message": "...",
+// "startsAt": ..., "endsAt": ...}. It shows from startsAt, now if there
+// isn't one, until endsAt or until it's taken down
+func (s *Server) createStatusNotice(w http.ResponseWriter, r *http.Request) {
+	if s.db == nil {
+		s.sendErrorResponse(w, r, http.StatusNotImplemented, CodeNotSupported, "Notices need the SQLite store")
+		return
+	}
+
+	var req StatusNotice
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if !s.validateNotice(w, r, &req) {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	req.CreatedBy, req.UpdatedBy = actorFrom(r.Context()), ""
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO status_notices (kind, message, starts_at, ends_at, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+		req.Kind, req.Message, req.StartsAt, req.EndsAt, req.CreatedBy, time.Now().UTC()).Scan(&req.ID)
+	if err != nil {
+		log.Printf("Error saving status notice: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to save the notice")
+		return
+	}
+	log.Printf("Status notice %d (%s) put up by %s", req.ID, req.Kind, req.CreatedBy)
+	s.invalidateNotices(ctx)
+	s.respond(w, r, http.StatusCreated, req)
+}
+
+// PUT /admin/status/notices/{id} with the whole notice again, to reword
+// it or change when it shows
+func (s *Server) updateStatusNotice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var req StatusNotice
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if !s.validateNotice(w, r, &req) {
+		return
+	}
+	if s.db == nil {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No notice with that ID")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	req.ID, req.UpdatedBy = id, actorFrom(r.Context())
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE status_notices SET kind = ?, message = ?, starts_at = ?, ends_at = ?, updated_by = ? WHERE id = ? RETURNING created_by`,
+		req.Kind, req.Message, req.StartsAt, req.EndsAt, req.UpdatedBy, id).Scan(&req.CreatedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No notice with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating status notice %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to save the notice")
+		return
+	}
+	s.invalidateNotices(ctx)
+	s.respond(w, r, http.StatusOK, req)
+}
+
+// DELETE /admin/status/notices/{id} takes one down
+func (s *Server) deleteStatusNotice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if s.db == nil {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No notice with that ID")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM status_notices WHERE id = ?", id)
+	if err != nil {
+		log.Printf("Error deleting status notice %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to delete the notice")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No notice with that ID")
+		return
+	}
+	s.invalidateNotices(ctx)
+	w.WriteHeader(http.StatusNoContent)
+}
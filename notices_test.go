@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotices(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	router := server.routes()
+
+	admin := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest(method, url, []byte(body)))
+		return w
+	}
+	notices := func() []StatusNotice {
+		t.Helper()
+		w, availability := getAvailability(t, router, "/availability?month=2075-01", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected availability, got %d: %s", w.Code, w.Body.String())
+		}
+		return availability.Notices
+	}
+	if n := notices(); len(n) != 0 {
+		t.Fatalf("Expected no notices yet, got %+v", n)
+	}
+
+	now := time.Now().UTC()
+	w := admin("POST", "/admin/status/notices", `{"kind": "info", "message": "Phone lines busy"}`)
+	var notice StatusNotice
+	json.Unmarshal(w.Body.Bytes(), &notice)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the notice put up, got %d: %s", w.Code, w.Body.String())
+	}
+	url := "/admin/status/notices/" + strconv.Itoa(notice.ID)
+	if n := notices(); len(n) != 1 || n[0].Message != "Phone lines busy" || n[0].CreatedBy != "" {
+		t.Errorf("Expected the notice with availability, got %+v", n)
+	}
+	// Served from the cache this time, the same
+	if n := notices(); len(n) != 1 {
+		t.Errorf("Expected the notice again, got %+v", n)
+	}
+
+	// A change shows straight away
+	w = admin("PUT", url, `{"kind": "closure", "message": "Office closed 24 Dec", "endsAt": "`+now.Add(time.Hour).Format(time.RFC3339)+`"}`)
+	json.Unmarshal(w.Body.Bytes(), &notice)
+	if w.Code != http.StatusOK || notice.UpdatedBy != "admin" || notice.CreatedBy != "admin" || notice.EndsAt == nil {
+		t.Fatalf("Expected the notice changed, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := notices(); len(n) != 1 || n[0].Message != "Office closed 24 Dec" || n[0].Kind != NoticeClosure {
+		t.Errorf("Expected the reworded notice, got %+v", n)
+	}
+	w = admin("GET", url, "")
+	if w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("Expected the notice, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// One that's over is only in the full list
+	admin("POST", "/admin/status/notices", `{"message": "Was slow", "startsAt": "`+now.Add(-2*time.Hour).Format(time.RFC3339)+`", "endsAt": "`+now.Add(-time.Hour).Format(time.RFC3339)+`"}`)
+	for query, want := range map[string]int{"": 1, "?all=true": 2} {
+		var list StatusNoticeList
+		json.Unmarshal(admin("GET", "/admin/status/notices"+query, "").Body.Bytes(), &list)
+		if len(list.Notices) != want {
+			t.Errorf("Expected %d listed for %q, got %+v", want, query, list.Notices)
+		}
+	}
+	if n := notices(); len(n) != 1 {
+		t.Errorf("Expected the ended one left off, got %+v", n)
+	}
+
+	for _, c := range []struct {
+		method, url, body string
+		code              int
+	}{
+		{"PUT", url, `{"message": ""}`, http.StatusBadRequest},
+		{"PUT", "/admin/status/notices/99", `{"message": "x"}`, http.StatusNotFound},
+		{"GET", "/admin/status/notices/99", "", http.StatusNotFound},
+		{"DELETE", url, "", http.StatusNoContent},
+		{"DELETE", url, "", http.StatusNotFound},
+	} {
+		if w := admin(c.method, c.url, c.body); w.Code != c.code {
+			t.Errorf("Expected %d for %s %s, got %d: %s", c.code, c.method, c.url, w.Code, w.Body.String())
+		}
+	}
+	if n := notices(); len(n) != 0 {
+		t.Errorf("Expected it gone once taken down, got %+v", n)
+	}
+}
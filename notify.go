@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// Something that can get a message to a citizen
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+
+	// The span of the trace this is sent on, for a mail header or a log line
+	TraceParent string
+}
+
+type Notifier interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Until there's a real mail server to talk to, just log what we would send
+type LogNotifier struct{}
+
+func (LogNotifier) Send(ctx context.Context, msg Message) error {
+	log.Printf("Sending %q to %s (trace %s)", msg.Subject, msg.To, msg.TraceParent)
+	return nil
+}
+
+// Render one of the message templates for an appointment and send it.
+// Citizens who didn't leave an email address don't get one
+func (s *Server) notifyAppointment(ctx context.Context, name string, appointment Appointment) {
+	s.notifyWith(ctx, name, appointment, appointment)
+}
+
+// The same, for messages that need more than the appointment to render
+func (s *Server) notifyWith(ctx context.Context, name string, appointment Appointment, data any) {
+	if appointment.Email == "" {
+		return
+	}
+
+	rendered, err := s.templates.RenderLocalized(name, appointment.PreferredLanguage, data)
+	if err != nil {
+		log.Printf("Error rendering %s message: %v", name, err)
+		return
+	}
+
+	s.deliver(ctx, ChannelEmail, Message{
+		To:      appointment.Email,
+		Subject: rendered.Subject,
+		Text:    rendered.Text,
+		HTML:    rendered.HTML,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// For the council's open data portal, how busy each day of the year so
+// far was. It's built from the places booked per day and nothing else,
+// Attendance never sees a name, so there's no personal data in it to
+// leak. Days that are over don't change, so it's cached for an hour
+const openDataMaxAge = time.Hour
+
+type OpenDataDay struct {
+	Date        string  `json:"date"`
+	Booked      int     `json:"booked"` // people, everyone on a group booking counts
+	Capacity    int     `json:"capacity"`
+	Utilization float64 `json:"utilization"` // percent
+}
+
+type OpenData struct {
+	From string        `json:"from"`
+	To   string        `json:"to"`
+	Days []OpenDataDay `json:"days"` // public holidays left out, nobody's seen on them
+}
+
+// January 1st to yesterday
+func (s *Server) openData(ctx context.Context) (OpenData, error) {
+	today, err := s.today()
+	if err != nil {
+		return OpenData{}, err
+	}
+	from := time.Date(today.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	to := today.AddDate(0, 0, -1)
+
+	key := "opendata:" + today.Format("2006-01-02")
+	if body, ok, err := s.cache.Get(ctx, key); err == nil && ok {
+		var cached OpenData
+		if json.Unmarshal(body, &cached) == nil {
+			return cached, nil
+		}
+	}
+
+	attendance, err := s.store.Attendance(ctx, from, to)
+	if err != nil {
+		return OpenData{}, err
+	}
+	holidays := s.holidaySet(ctx)
+	data := OpenData{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Days: []OpenDataDay{}}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if holidays.closed(d) {
+			continue
+		}
+		date := d.Format("2006-01-02")
+		capacity := s.capacityOn(d)
+		data.Days = append(data.Days, OpenDataDay{Date: date, Booked: attendance[date], Capacity: capacity, Utilization: percentOf(attendance[date], capacity)})
+	}
+
+	body, _ := json.Marshal(data)
+	if err := s.cache.Set(ctx, key, body, openDataMaxAge); err != nil {
+		log.Printf("Error caching open data: %v", err)
+	}
+	return data, nil
+}
+
+// GET /opendata/bookings.json and GET /opendata/bookings.csv
+func (s *Server) getOpenData(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	data, err := s.openData(ctx)
+	if err != nil {
+		log.Printf("Error building open data: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load bookings")
+		return
+	}
+
+	if r.URL.Path == "/opendata/bookings.csv" {
+		var b bytes.Buffer
+		cw := csv.NewWriter(&b)
+		cw.Write([]string{"date", "booked", "capacity", "utilization"})
+		for _, day := range data.Days {
+			cw.Write([]string{day.Date, strconv.Itoa(day.Booked), strconv.Itoa(day.Capacity), strconv.FormatFloat(day.Utilization, 'f', 1, 64)})
+		}
+		cw.Flush()
+		writeCacheableBody(w, r, "text/csv; charset=utf-8", b.Bytes(), openDataMaxAge)
+		return
+	}
+
+	body, _ := json.Marshal(data)
+	writeCacheableBody(w, r, "application/json", body, openDataMaxAge)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenData(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.DailyCapacity = 4
+	today := time.Date(2075, 1, 6, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	router := server.routes()
+
+	for _, date := range []string{"2075-01-03", "2075-01-03", "2075-01-06"} {
+		d, _ := time.Parse("2006-01-02", date)
+		req := AppointmentRequest{FirstName: "Secret", LastName: "Citizen", Email: "secret@example.com", Attendees: []Attendee{{FirstName: "Hidden", LastName: "Child"}}}
+		if _, err := server.store.Create(context.Background(), req, d, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/opendata/bookings.json", nil))
+	var data OpenData
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("Expected JSON, got %d: %s", w.Code, w.Body.String())
+	}
+	published := w.Body.String()
+
+	// The 1st and 2nd are holidays, today isn't over yet
+	if data.From != "2075-01-01" || data.To != "2075-01-05" || len(data.Days) != 3 {
+		t.Fatalf("Expected the 3rd to the 5th, got %+v", data)
+	}
+	if day := data.Days[0]; day.Date != "2075-01-03" || day.Booked != 4 || day.Utilization != 100 {
+		t.Errorf("Expected the 3rd full, got %+v", day)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/opendata/bookings.csv", nil))
+	if !strings.HasPrefix(w.Body.String(), "date,booked,capacity,utilization\n2075-01-03,4,4,100.0\n") {
+		t.Errorf("Expected CSV, got %s", w.Body.String())
+	}
+	published += w.Body.String()
+
+	for _, pii := range []string{"Secret", "Citizen", "secret@example.com", "Hidden"} {
+		if strings.Contains(published, pii) {
+			t.Errorf("Open data mentions %q", pii)
+		}
+	}
+
+	etag := w.Header().Get("ETag")
+	req := httptest.NewRequest("GET", "/opendata/bookings.csv", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", w.Code)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Some days enough people don't turn up that it's worth taking more
+// bookings than there are places. CITYNEXT_OVERBOOKING gives a percentage
+// over CITYNEXT_DAILY_CAPACITY for each weekday it applies to, e.g.
+// "mon=10,fri=5". It's rounded down, so it does nothing until 10% of the
+// capacity is at least one person. Any booking that lands in the extra
+// places is written down, so it's clear when it was used and on whom
+type Overbooking struct {
+	XMLName       xml.Name  `json:"-" xml:"overbooking"`
+	AppointmentID int       `json:"appointmentId" xml:"appointmentId"`
+	VisitDate     string    `json:"visitDate" xml:"visitDate"`
+	Booked        int       `json:"booked" xml:"booked"`     // places taken once it was in
+	Capacity      int       `json:"capacity" xml:"capacity"` // before overbooking
+	Change        string    `json:"change" xml:"change"`     // created, rescheduled or transferred
+	ChangedBy     string    `json:"changedBy" xml:"changedBy"`
+	ChangedAt     time.Time `json:"changedAt" xml:"changedAt"`
+}
+
+type OverbookingDay struct {
+	XMLName xml.Name `json:"-" xml:"day"`
+	Weekday string   `json:"weekday" xml:"weekday,attr"`
+	Percent int      `json:"percent" xml:"percent,attr"`
+}
+
+type OverbookingPolicy struct {
+	XMLName xml.Name         `json:"-" xml:"overbookingPolicy"`
+	Enabled bool             `json:"enabled" xml:"enabled,attr"` // the overbooking feature flag
+	Days    []OverbookingDay `json:"days" xml:"days>day"`        // Sunday first, only the days it applies to
+	Used    []Overbooking    `json:"used" xml:"used>overbooking"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// "mon=10,fri=5" into percentages by weekday
+func envOverbooking(key string) map[time.Weekday]int {
+	percent := map[time.Weekday]int{}
+	for day, values := range envMap(key) {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		n, err := strconv.Atoi(values[0])
+		if !ok || err != nil || n < 0 {
+			log.Printf("Ignoring %s entry %s=%s, expected e.g. mon=10", key, day, values[0])
+			continue
+		}
+		percent[weekday] = n
+	}
+	return percent
+}
+
+// Places that can be booked on the day, overbooking included
+func (s *Server) capacityOn(visitDate time.Time) int {
+	capacity := s.dailyCapacity()
+	if !s.featureEnabled("overbooking") {
+		return capacity
+	}
+	return capacity + capacity*s.live().Overbooking[visitDate.Weekday()]/100
+}
+
+func (s *Server) initOverbookingsTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS overbookings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		appointment_id INTEGER NOT NULL,
+		visit_date TEXT NOT NULL,
+		booked INTEGER NOT NULL,
+		capacity INTEGER NOT NULL,
+		change TEXT NOT NULL,
+		changed_by TEXT NOT NULL,
+		changed_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// After a booking's gone in, checks whether it's in the extra places.
+// Only worth asking on days that have any
+func (s *Server) noteOverbooking(ctx context.Context, appointment Appointment, visitDate time.Time, change string) {
+	if s.capacityOn(visitDate) == s.dailyCapacity() {
+		return
+	}
+	booked, err := s.store.Booked(ctx, visitDate)
+	if err != nil {
+		log.Printf("Error checking overbooking for appointment %d: %v", appointment.ID, err)
+		return
+	}
+	if booked <= s.dailyCapacity() {
+		return
+	}
+
+	log.Printf("Overbooked %s: appointment %d makes %d of %d", appointment.VisitDate, appointment.ID, booked, s.dailyCapacity())
+	if s.db == nil {
+		return
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO overbookings (appointment_id, visit_date, booked, capacity, change, changed_by, changed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		appointment.ID, appointment.VisitDate, booked, s.dailyCapacity(), change, actorFrom(ctx), time.Now().UTC())
+	if err != nil {
+		log.Printf("Error recording overbooking for appointment %d: %v", appointment.ID, err)
+	}
+}
+
+// GET /admin/overbooking, the policy and every booking that used it, newest first
+func (s *Server) getOverbooking(w http.ResponseWriter, r *http.Request) {
+	policy := OverbookingPolicy{Enabled: s.featureEnabled("overbooking"), Days: []OverbookingDay{}, Used: []Overbooking{}}
+	overbooking := s.live().Overbooking
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if percent := overbooking[weekday]; percent > 0 {
+			policy.Days = append(policy.Days, OverbookingDay{Weekday: strings.ToLower(weekday.String()), Percent: percent})
+		}
+	}
+
+	if s.db != nil {
+		ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+		defer cancel()
+
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT appointment_id, visit_date, booked, capacity, change, changed_by, changed_at
+			FROM overbookings ORDER BY id DESC`)
+		if err != nil {
+			log.Printf("Error listing overbookings: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list overbookings")
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var o Overbooking
+			if err := rows.Scan(&o.AppointmentID, &o.VisitDate, &o.Booked, &o.Capacity, &o.Change, &o.ChangedBy, &o.ChangedAt); err != nil {
+				log.Printf("Error listing overbookings: %v", err)
+				s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list overbookings")
+				return
+			}
+			policy.Used = append(policy.Used, o)
+		}
+	}
+	s.respond(w, r, http.StatusOK, policy)
+}
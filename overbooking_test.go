@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOverbooking(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 10
+	server.cfg.Overbooking = map[time.Weekday]int{time.Monday: 10}
+	router := server.routes()
+
+	party := make([]Attendee, 9)
+	for i := range party {
+		party[i] = Attendee{FirstName: "Big", LastName: "Family"}
+	}
+	for _, date := range []string{"2075-06-17", "2075-06-18"} { // a Monday and a Tuesday
+		if w := postAppointment(t, router, AppointmentRequest{FirstName: "Big", LastName: "Family", VisitDate: date, Attendees: party}); w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 filling %s, got %d: %s", date, w.Code, w.Body.String())
+		}
+	}
+
+	// One over on Mondays, none on Tuesdays
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Extra", LastName: "One", VisitDate: "2075-06-17"}); w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for the overbooked place, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Extra", LastName: "Two", VisitDate: "2075-06-17"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 past the overbooking, got %d", w.Code)
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Extra", LastName: "Three", VisitDate: "2075-06-18"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 on a day without overbooking, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/overbooking", nil))
+	var policy OverbookingPolicy
+	if err := json.Unmarshal(w.Body.Bytes(), &policy); err != nil {
+		t.Fatalf("Expected the policy, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(policy.Days) != 1 || policy.Days[0].Weekday != "monday" || policy.Days[0].Percent != 10 {
+		t.Errorf("Expected 10%% on Mondays, got %+v", policy.Days)
+	}
+	if len(policy.Used) != 1 {
+		t.Fatalf("Expected one overbooking, got %+v", policy.Used)
+	}
+	if used := policy.Used[0]; used.AppointmentID != 3 || used.Booked != 11 || used.Capacity != 10 || used.ChangedBy != ActorPublic {
+		t.Errorf("Expected appointment 3 as the 11th of 10, got %+v", used)
+	}
+}
+
+func TestEnvOverbooking(t *testing.T) {
+	t.Setenv("CITYNEXT_OVERBOOKING", "mon=10, Fri=5,someday=3,tue=lots")
+	got := envOverbooking("CITYNEXT_OVERBOOKING")
+	if len(got) != 2 || got[time.Monday] != 10 || got[time.Friday] != 5 {
+		t.Errorf("Expected Monday and Friday only, got %v", got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Just enough PDF for the run sheet: A4 pages of text in the standard
+// fonts, which every reader has, and lines. Like xlsx.go it needs no
+// library. The standard fonts only have Western European letters, so
+// anything else prints as ?, the HTML has everyone's name as it is
+const (
+	pdfWidth  = 595.28 // A4, in points
+	pdfHeight = 841.89
+	pdfMargin = 40.0
+
+	pdfHeading = "F1" // Helvetica-Bold
+	pdfBody    = "F2" // Courier, every character 0.6 of the size wide
+	pdfBold    = "F3" // Courier-Bold
+)
+
+type pdfWriter struct {
+	pages []*bytes.Buffer
+	y     float64 // where the next line's baseline goes, from the bottom
+}
+
+func (p *pdfWriter) newPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+	p.y = pdfHeight - pdfMargin
+}
+
+// Starts a new page if there isn't room for height more
+func (p *pdfWriter) need(height float64) bool {
+	if len(p.pages) == 0 || p.y-height < pdfMargin+20 {
+		p.newPage()
+		return true
+	}
+	return false
+}
+
+func (p *pdfWriter) page() *bytes.Buffer { return p.pages[len(p.pages)-1] }
+
+func (p *pdfWriter) text(font string, size, x, y float64, s string) {
+	fmt.Fprintf(p.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfString(s))
+}
+
+func (p *pdfWriter) line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(p.page(), "%.1f w %.2f %.2f m %.2f %.2f l S\n", width, x1, y1, x2, y2)
+}
+
+func (p *pdfWriter) box(x, y, size float64, ticked bool) {
+	fmt.Fprintf(p.page(), "1 w %.2f %.2f %.2f %.2f re S\n", x, y, size, size)
+	if ticked {
+		fmt.Fprintf(p.page(), "1.5 w %.2f %.2f m %.2f %.2f l %.2f %.2f l S\n", x+2, y+size/2, x+size*0.4, y+2, x+size-2, y+size-2)
+	}
+}
+
+// Cut to fit n characters of Courier, with … on the end if it's cut
+func fitCourier(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// In the fonts' WinAnsiEncoding, escaped for a PDF string
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		c, ok := charmap.Windows1252.EncodeRune(r)
+		if !ok {
+			c = '?'
+		}
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Objects 1 to 5 are the catalogue, the page tree and the fonts, then a
+// page and its contents for every page
+func (p *pdfWriter) writeTo(w io.Writer) {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(p.pages))
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	for _, font := range []string{"Helvetica-Bold", "Courier", "Courier-Bold"} {
+		object("<< /Type /Font /Subtype /Type1 /BaseFont /" + font + " /Encoding /WinAnsiEncoding >>")
+	}
+	for i, content := range p.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R /F3 5 0 R >> >> /Contents %d 0 R >>", pdfWidth, pdfHeight, 7+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	w.Write(out.Bytes())
+}
+
+// The run sheet laid out like the HTML: a heading for each service, and
+// a row for each booking with its tick box. A service that runs over a
+// page has its heading again on the next
+func runSheetPDF(w io.Writer, sheet RunSheet) {
+	const (
+		size     = 10.0
+		nameX    = pdfMargin + 20
+		idX      = nameX + 312 // 52 characters of name
+		channelX = idX + 54
+		langX    = channelX + 66
+	)
+	p := &pdfWriter{}
+	p.need(0)
+	p.text(pdfHeading, 16, pdfMargin, p.y, "Run sheet for "+sheet.Date.Format("Monday 2 January 2006"))
+	p.y -= 18
+	p.text(pdfBody, 9, pdfMargin, p.y, fmt.Sprintf("%d booked. Printed %s", sheet.People, sheet.GeneratedAt.Format("2 Jan 2006 15:04")))
+	p.y -= 16
+	if sheet.Closed != "" {
+		p.text(pdfHeading, 12, pdfMargin, p.y, sheet.Closed)
+		p.y -= 18
+	}
+	if len(sheet.Services) == 0 {
+		p.text(pdfBody, size, pdfMargin, p.y, "Nobody is booked.")
+	}
+
+	heading := func(service RunSheetService, continued bool) {
+		p.y -= 10
+		title := fmt.Sprintf("%s, %d", service.Service, service.People)
+		if continued {
+			title += " (continued)"
+		}
+		p.text(pdfHeading, 12, pdfMargin, p.y, title)
+		p.y -= 4
+		p.line(pdfMargin, p.y, pdfWidth-pdfMargin, p.y, 1.5)
+		p.y -= 13
+		for _, column := range []struct {
+			x     float64
+			title string
+		}{{nameX, "Name"}, {idX, "Booking"}, {channelX, "Channel"}, {langX, "Language"}} {
+			p.text(pdfBold, 9, column.x, p.y, column.title)
+		}
+		p.y -= 6
+	}
+	for _, service := range sheet.Services {
+		p.need(60)
+		heading(service, false)
+		for _, row := range service.Rows {
+			height := 18.0
+			if len(row.With) > 0 {
+				height += 11
+			}
+			if p.need(height) {
+				heading(service, true)
+			}
+			p.y -= 13
+			p.box(pdfMargin, p.y-1.5, 10, row.CheckedIn)
+			p.text(pdfBody, size, nameX, p.y, fitCourier(row.Name, 52))
+			p.text(pdfBody, size, idX, p.y, fmt.Sprint(row.ID))
+			p.text(pdfBody, size, channelX, p.y, row.Channel)
+			p.text(pdfBody, size, langX, p.y, row.Language)
+			if len(row.With) > 0 {
+				p.y -= 11
+				p.text(pdfBody, 8.5, nameX, p.y, fitCourier("With "+strings.Join(row.With, ", "), 90))
+			}
+			p.y -= 5
+			p.line(pdfMargin, p.y, pdfWidth-pdfMargin, p.y, 0.3)
+		}
+	}
+
+	for i := range p.pages {
+		p.pages[i].WriteString(fmt.Sprintf("BT /%s 8 Tf %.2f %.2f Td (%s) Tj ET\n", pdfBody, pdfMargin, pdfMargin/2,
+			pdfString(fmt.Sprintf("%s  Page %d of %d", sheet.Date.Format("2006-01-02"), i+1, len(p.pages)))))
+	}
+	p.writeTo(w)
+}
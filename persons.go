@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A citizen, kept once however many times they book. Public bookings
+// make a new person each time, staff merge the ones that turn out to be
+// the same (see duplicates.go) and keep their details up to date here
+type Person struct {
+	XMLName           xml.Name  `json:"-" xml:"person"`
+	ID                int       `json:"id" xml:"id"`
+	FirstName         string    `json:"firstName" xml:"firstName"`
+	LastName          string    `json:"lastName" xml:"lastName"`
+	Email             string    `json:"email,omitempty" xml:"email,omitempty"`
+	PreferredLanguage string    `json:"preferredLanguage" xml:"preferredLanguage"`
+	Title             string    `json:"title,omitempty" xml:"title,omitempty"`
+	PreferredName     string    `json:"preferredName,omitempty" xml:"preferredName,omitempty"`
+	CreatedAt         time.Time `json:"createdAt" xml:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt" xml:"updatedAt"`
+}
+
+// Same rules as the details on a booking
+func (s *Server) decodePerson(w http.ResponseWriter, r *http.Request) (Person, bool) {
+	var p Person
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return Person{}, false
+	}
+	p.FirstName, p.LastName = cleanName(p.FirstName), cleanName(p.LastName)
+	p.Title, p.PreferredName = cleanName(p.Title), cleanName(p.PreferredName)
+	if p.FirstName == "" || p.LastName == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeMissingFields, "First name and last name are required")
+		return Person{}, false
+	}
+	if !s.checkName(w, r, "First name", p.FirstName) || !s.checkName(w, r, "Last name", p.LastName) || !s.checkAddressedAs(w, r, p.Title, p.PreferredName) {
+		return Person{}, false
+	}
+	if p.PreferredLanguage == "" {
+		p.PreferredLanguage = DefaultLanguage
+	}
+	if !supportedLanguages[p.PreferredLanguage] {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidLanguage, "Preferred language must be 'en' or 'cy'")
+		return Person{}, false
+	}
+	return p, true
+}
+
+func (s *Server) personError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	if errors.Is(err, ErrPersonNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No person with that ID")
+		return
+	}
+	log.Printf("Error %s: %v", action, err)
+	s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed "+action)
+}
+
+// POST /admin/persons
+func (s *Server) createPerson(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.decodePerson(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	p, err := s.store.CreatePerson(ctx, p)
+	if err != nil {
+		s.personError(w, r, err, "creating person")
+		return
+	}
+	s.respond(w, r, http.StatusCreated, p)
+}
+
+// GET /admin/persons/{id}
+func (s *Server) getPerson(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	p, err := s.store.GetPerson(ctx, id)
+	if err != nil {
+		s.personError(w, r, err, "loading person")
+		return
+	}
+	s.respond(w, r, http.StatusOK, p)
+}
+
+// PUT /admin/persons/{id} replaces their details, which every one of
+// their bookings then shows
+func (s *Server) updatePerson(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.decodePerson(w, r)
+	if !ok {
+		return
+	}
+	p.ID, _ = strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	p, err := s.store.UpdatePerson(ctx, p)
+	if err != nil {
+		s.personError(w, r, err, "updating person")
+		return
+	}
+	s.respond(w, r, http.StatusOK, p)
+}
+
+// GET /admin/persons/{id}/appointments
+func (s *Server) personAppointments(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	appointments, err := s.store.PersonAppointments(ctx, id)
+	if err != nil {
+		s.personError(w, r, err, "listing appointments")
+		return
+	}
+	s.respond(w, r, http.StatusOK, AppointmentList{Appointments: appointments})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPersons(t *testing.T) {
+	for name, server := range map[string]*Server{"sqlite": setupTestServer(t), "events": setupEventServer(t), "memory": setupTestServer(t)} {
+		t.Run(name, func(t *testing.T) {
+			if name == "memory" {
+				server.db, server.store = nil, newMemoryStore()
+			}
+			server.cfg.AdminToken = "secret"
+			router := server.routes()
+
+			postAppointment(t, router, AppointmentRequest{FirstName: "Pat", LastName: "Person", VisitDate: "2075-06-16"})
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/admin/persons/1", nil))
+			var p Person
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &p) != nil || p.FirstName != "Pat" {
+				t.Fatalf("Expected the booking's person, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// A change of name shows on their bookings
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("PUT", "/admin/persons/1", []byte(`{"firstName":"Patricia","lastName":"Person","preferredLanguage":"cy"}`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200 updating, got %d: %s", w.Code, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/admin/persons/1/appointments", nil))
+			var list AppointmentList
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Appointments) != 1 {
+				t.Fatalf("Expected one appointment, got %d: %s", w.Code, w.Body.String())
+			}
+			if a := list.Appointments[0]; a.FirstName != "Patricia" || a.PreferredLanguage != "cy" || a.PersonID != 1 {
+				t.Errorf("Expected the updated details on the booking, got %+v", a)
+			}
+
+			// And in its history, saying who changed them
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/1/history", nil))
+			var history History
+			json.Unmarshal(w.Body.Bytes(), &history)
+			if n := len(history.Revisions); n != 2 || history.Revisions[1].Change != RevisionPersonUpdated || history.Revisions[1].FirstName != "Patricia" || history.Revisions[1].ChangedBy != ActorAdmin {
+				t.Errorf("Expected a person_updated revision, got %d: %s", w.Code, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/persons", []byte(`{"firstName":"New","lastName":"Comer"}`)))
+			if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &p) != nil || p.ID != 2 || p.PreferredLanguage != DefaultLanguage {
+				t.Errorf("Expected 201 with person 2, got %d: %s", w.Code, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/persons", []byte(`{"firstName":"No"}`)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 without a last name, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/admin/persons/99/appointments", nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected 404 for an unknown person, got %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// migrate-postgres [url] - copy everything in the SQLite database into an
+// empty Postgres one, CITYNEXT_POSTGRES_URL if no url's given. Stop the
+// server first. Every table goes, whatever features made it, with the
+// same columns. Each one's rows are counted on both sides before any of
+// it is committed, so it's all copied or none of it is
+func migratePostgresCommand(cfg Config, args []string) error {
+	url := cfg.PostgresURL
+	if len(args) > 0 {
+		url = args[0]
+	}
+	if url == "" {
+		return errors.New("usage: migrate-postgres <postgres url>, or set CITYNEXT_POSTGRES_URL")
+	}
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Old layouts are moved on when the server starts, copy the new one
+	pending, err := pendingMigrations(db, cfg.Store)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%s isn't up to date, start the server on it once first (%s)", cfg.DBPath, strings.Join(pending, "; "))
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Postgres: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	counts, err := copyToPostgres(ctx, db, conn)
+	if err != nil {
+		return err
+	}
+	for _, c := range counts {
+		fmt.Printf("ok    %-24s %d rows\n", c.table, c.rows)
+	}
+	log.Printf("Copied %d tables from %s to Postgres", len(counts), cfg.DBPath)
+	return nil
+}
+
+type tableCount struct {
+	table string
+	rows  int64
+}
+
+// One read transaction on SQLite, so it's a consistent snapshot, and one
+// write transaction on Postgres, so a failure part way leaves it empty
+func copyToPostgres(ctx context.Context, db *sql.DB, conn *pgx.Conn) ([]tableCount, error) {
+	src, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Rollback()
+
+	tables, err := sqliteSchema(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Rollback(ctx)
+
+	var counts []tableCount
+	for _, t := range tables {
+		for _, stmt := range t.ddl() {
+			if _, err := dst.Exec(ctx, stmt); err != nil {
+				return nil, fmt.Errorf("failed to create %s: %w", t.name, err)
+			}
+		}
+		var existing bool
+		if err := dst.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM "+quoteIdent(t.name)+")").Scan(&existing); err != nil {
+			return nil, err
+		}
+		if existing {
+			return nil, fmt.Errorf("%s already has rows in Postgres, migrate into an empty database", t.name)
+		}
+
+		copied, err := copyTable(ctx, src, dst, t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", t.name, err)
+		}
+
+		var want, got int64
+		if err := src.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoteIdent(t.name)).Scan(&want); err != nil {
+			return nil, err
+		}
+		if err := dst.QueryRow(ctx, "SELECT COUNT(*) FROM "+quoteIdent(t.name)).Scan(&got); err != nil {
+			return nil, err
+		}
+		if copied != want || got != want {
+			return nil, fmt.Errorf("%s has %d rows in SQLite but %d were copied and Postgres has %d, nothing was committed", t.name, want, copied, got)
+		}
+
+		if t.identity != "" {
+			if err := carryOnNumbering(ctx, src, dst, t); err != nil {
+				return nil, fmt.Errorf("failed to number %s: %w", t.name, err)
+			}
+		}
+		counts = append(counts, tableCount{t.name, got})
+	}
+	return counts, dst.Commit(ctx)
+}
+
+func copyTable(ctx context.Context, src *sql.Tx, dst pgx.Tx, t pgTable) (int64, error) {
+	names := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		names[i] = quoteIdent(c.name)
+	}
+	rows, err := src.QueryContext(ctx, "SELECT "+strings.Join(names, ", ")+" FROM "+quoteIdent(t.name))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for i, c := range t.columns {
+		names[i] = c.name
+	}
+	return dst.CopyFrom(ctx, pgx.Identifier{t.name}, names, &sqliteRows{rows: rows, table: t})
+}
+
+// So the next booking in Postgres gets the number SQLite would have given
+// it. AUTOINCREMENT never reuses one, even the last after it's deleted,
+// which sqlite_sequence remembers
+func carryOnNumbering(ctx context.Context, src *sql.Tx, dst pgx.Tx, t pgTable) error {
+	var last sql.NullInt64
+	err := src.QueryRowContext(ctx, "SELECT MAX(n) FROM (SELECT MAX("+quoteIdent(t.identity)+") AS n FROM "+quoteIdent(t.name)+" UNION ALL SELECT seq FROM sqlite_sequence WHERE name = ?)", t.name).Scan(&last)
+	if err != nil || !last.Valid || last.Int64 == 0 {
+		return err
+	}
+	_, err = dst.Exec(ctx, "SELECT setval(pg_get_serial_sequence($1, $2), $3)", quoteIdent(t.name), t.identity, last.Int64)
+	return err
+}
+
+// A SQLite table as Postgres will have it. Foreign keys are left out,
+// SQLite never enforced them here (there's no PRAGMA foreign_keys), so
+// old rows needn't satisfy them
+type pgTable struct {
+	name     string
+	columns  []pgColumn
+	primary  []string // the primary key's columns, in order
+	identity string   // an INTEGER PRIMARY KEY, numbered by Postgres from here on
+	indexes  []string
+}
+
+type pgColumn struct {
+	name, pgType, def string
+	notNull           bool
+}
+
+func (t pgTable) ddl() []string {
+	defs := make([]string, 0, len(t.columns)+1)
+	for _, c := range t.columns {
+		def := quoteIdent(c.name) + " " + c.pgType
+		if c.name == t.identity {
+			def += " GENERATED BY DEFAULT AS IDENTITY"
+		}
+		if c.notNull {
+			def += " NOT NULL"
+		}
+		if c.def != "" {
+			def += " DEFAULT " + c.def
+		}
+		defs = append(defs, def)
+	}
+	if len(t.primary) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+quoteIdents(t.primary)+")")
+	}
+	create := "CREATE TABLE IF NOT EXISTS " + quoteIdent(t.name) + " (\n\t" + strings.Join(defs, ",\n\t") + "\n)"
+	return append([]string{create}, t.indexes...)
+}
+
+// Every table bar SQLite's own, read from the database rather than a
+// list, so a feature's table can't be forgotten
+func sqliteSchema(ctx context.Context, tx *sql.Tx) ([]pgTable, error) {
+	names, err := queryStrings(ctx, tx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []pgTable
+	for _, name := range names {
+		t := pgTable{name: name}
+		rows, err := tx.QueryContext(ctx, `SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?) ORDER BY cid`, name)
+		if err != nil {
+			return nil, err
+		}
+		pk := map[int]string{}
+		var integerKey bool
+		for rows.Next() {
+			var c pgColumn
+			var declared string
+			var def sql.NullString
+			var position int
+			if err := rows.Scan(&c.name, &declared, &c.notNull, &def, &position); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			c.pgType = postgresType(declared)
+			c.def = postgresDefault(def.String, c.pgType)
+			if position > 0 {
+				pk[position] = c.name
+				integerKey = strings.EqualFold(declared, "INTEGER")
+			}
+			t.columns = append(t.columns, c)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i <= len(pk); i++ {
+			t.primary = append(t.primary, pk[i])
+		}
+		if len(t.primary) == 1 && integerKey {
+			t.identity = t.primary[0]
+		}
+
+		if t.indexes, err = sqliteIndexes(ctx, tx, name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// Indexes made with CREATE INDEX are made the same way, the SQL's the
+// same. UNIQUE columns get a unique index named the way Postgres would
+// name the constraint
+func sqliteIndexes(ctx context.Context, tx *sql.Tx, table string) ([]string, error) {
+	type index struct{ name, origin string }
+	rows, err := tx.QueryContext(ctx, "SELECT name, origin FROM pragma_index_list(?) WHERE origin IN ('c', 'u') ORDER BY name", table)
+	if err != nil {
+		return nil, err
+	}
+	var found []index
+	for rows.Next() {
+		var ix index
+		if err := rows.Scan(&ix.name, &ix.origin); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found = append(found, ix)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var stmts []string
+	for _, ix := range found {
+		if ix.origin == "c" {
+			var ddl string
+			if err := tx.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'index' AND name = ?", ix.name).Scan(&ddl); err != nil {
+				return nil, err
+			}
+			if !strings.Contains(strings.ToUpper(ddl), "IF NOT EXISTS") {
+				ddl = strings.Replace(ddl, "INDEX ", "INDEX IF NOT EXISTS ", 1)
+			}
+			stmts = append(stmts, ddl)
+			continue
+		}
+		columns, err := queryStrings(ctx, tx, "SELECT name FROM pragma_index_info(?) ORDER BY seqno", ix.name)
+		if err != nil {
+			return nil, err
+		}
+		name := table + "_" + strings.Join(columns, "_") + "_key"
+		stmts = append(stmts, fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)", quoteIdent(name), quoteIdent(table), quoteIdents(columns)))
+	}
+	return stmts, nil
+}
+
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// By SQLite's own rules for what a declared type means, see "Determination
+// Of Column Affinity" in its docs, with booleans and times given the
+// Postgres types they are here
+func postgresType(declared string) string {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "BOOL"):
+		return "BOOLEAN"
+	case strings.Contains(t, "INT"):
+		return "BIGINT"
+	case strings.Contains(t, "DATE"), strings.Contains(t, "TIME"):
+		return "TIMESTAMPTZ"
+	case t == "", strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return "TEXT"
+	case strings.Contains(t, "BLOB"):
+		return "BYTEA"
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "DOUBLE PRECISION"
+	default:
+		return "NUMERIC"
+	}
+}
+
+// Defaults are SQL in both, only booleans are written differently
+func postgresDefault(def, pgType string) string {
+	if pgType == "BOOLEAN" {
+		switch def {
+		case "0":
+			return "FALSE"
+		case "1":
+			return "TRUE"
+		}
+	}
+	return def
+}
+
+// What pgx copies from, the SQLite rows as they're read, in the types
+// their Postgres columns want
+type sqliteRows struct {
+	rows   *sql.Rows
+	table  pgTable
+	values []any
+	err    error
+}
+
+func (s *sqliteRows) Next() bool {
+	if s.err != nil || !s.rows.Next() {
+		return false
+	}
+	values := make([]any, len(s.table.columns))
+	ptrs := make([]any, len(values))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := s.rows.Scan(ptrs...); err != nil {
+		s.err = err
+		return false
+	}
+	for i, c := range s.table.columns {
+		v, err := postgresValue(values[i], c.pgType)
+		if err != nil {
+			s.err = fmt.Errorf("%s: %w", c.name, err)
+			return false
+		}
+		values[i] = v
+	}
+	s.values = values
+	return true
+}
+
+func (s *sqliteRows) Values() ([]any, error) { return s.values, nil }
+
+func (s *sqliteRows) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.rows.Err()
+}
+
+// SQLite keeps what it's given whatever the column's declared as, and
+// the drivers only turn some of it into Go types, so the rest is done here
+func postgresValue(v any, pgType string) (any, error) {
+	switch pgType {
+	case "BOOLEAN":
+		if n, ok := v.(int64); ok {
+			return n != 0, nil
+		}
+	case "TIMESTAMPTZ":
+		switch t := v.(type) {
+		case []byte:
+			return parseSQLiteTime(string(t))
+		case string:
+			return parseSQLiteTime(t)
+		case int64:
+			return time.Unix(t, 0).UTC(), nil
+		}
+	case "TEXT":
+		switch t := v.(type) {
+		case []byte:
+			return string(t), nil
+		case int64:
+			return strconv.FormatInt(t, 10), nil
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64), nil
+		}
+	}
+	return v, nil
+}
+
+// The layouts the SQLite drivers write and read, and CURRENT_TIMESTAMP's,
+// which is UTC without saying so. A Z for UTC is the same as no zone
+var sqliteTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseSQLiteTime(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	for _, layout := range sqliteTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q isn't a time", s)
+}
+
+// The same quoting works in SQLite
+func quoteIdent(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+func quoteIdents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quoteIdent(n)
+	}
+	return strings.Join(quoted, ", ")
+}
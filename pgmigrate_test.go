@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestPostgresSchema(t *testing.T) {
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1) // one :memory: database, not one per connection
+
+	tx, err := server.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	tables, err := sqliteSchema(context.Background(), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ddl := map[string]string{}
+	for _, tbl := range tables {
+		ddl[tbl.name] = strings.Join(tbl.ddl(), ";\n")
+	}
+	if _, ok := ddl["sqlite_sequence"]; ok {
+		t.Errorf("Expected SQLite's own tables left out")
+	}
+
+	for table, wants := range map[string][]string{
+		"persons":               {`"id" BIGINT GENERATED BY DEFAULT AS IDENTITY,`, `"preferred_language" TEXT NOT NULL DEFAULT 'en'`, `PRIMARY KEY ("id")`},
+		"appointments":          {`"created_at" TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP`, "CREATE INDEX IF NOT EXISTS appointments_by_person ON appointments (person_id)"},
+		"queue_tickets":         {`PRIMARY KEY ("visit_date", "service", "number")`, `CREATE UNIQUE INDEX IF NOT EXISTS "queue_tickets_appointment_id_key" ON "queue_tickets" ("appointment_id")`},
+		"feature_flags":         {`"enabled" BOOLEAN NOT NULL`, `PRIMARY KEY ("name")`},
+		"signing_keys":          {`"secret" BYTEA NOT NULL`},
+		"deliveries":            {"CREATE INDEX IF NOT EXISTS deliveries_due ON deliveries (status, next_attempt_at)"},
+		"appointment_revisions": {`PRIMARY KEY ("appointment_id", "version")`},
+	} {
+		for _, want := range wants {
+			if !strings.Contains(ddl[table], want) {
+				t.Errorf("Expected %s in %s's DDL, got\n%s", want, table, ddl[table])
+			}
+		}
+	}
+	if strings.Contains(ddl["queue_tickets"], "IDENTITY") || strings.Contains(ddl["feature_flags"], "IDENTITY") {
+		t.Errorf("Expected only INTEGER keys numbered")
+	}
+}
+
+// What Postgres would be sent, from rows the server wrote
+func TestSQLiteRowsForPostgres(t *testing.T) {
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1)
+	server.cfg.AdminToken = "secret"
+	router := server.routes()
+	postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-16"})
+	router.ServeHTTP(httptest.NewRecorder(), adminRequest("PUT", "/admin/features/walk-ins", []byte(`{"enabled": false}`)))
+
+	ctx := context.Background()
+	tx, err := server.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	tables, err := sqliteSchema(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, tbl := range tables {
+		if tbl.name != "appointments" && tbl.name != "persons" && tbl.name != "feature_flags" {
+			continue
+		}
+		names := make([]string, len(tbl.columns))
+		for i, c := range tbl.columns {
+			names[i] = quoteIdent(c.name)
+		}
+		rows, err := tx.Query("SELECT " + strings.Join(names, ", ") + " FROM " + quoteIdent(tbl.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := &sqliteRows{rows: rows, table: tbl}
+		for src.Next() {
+			values, _ := src.Values()
+			for i, c := range tbl.columns {
+				ok := values[i] == nil
+				switch c.pgType {
+				case "TIMESTAMPTZ":
+					_, is := values[i].(time.Time)
+					ok = ok || is
+				case "BOOLEAN":
+					_, is := values[i].(bool)
+					ok = ok || is
+				default:
+					ok = true
+				}
+				if !ok {
+					t.Errorf("Expected %s.%s as %s, got %T", tbl.name, c.name, c.pgType, values[i])
+				}
+			}
+			seen[tbl.name] = true
+		}
+		rows.Close()
+		if err := src.Err(); err != nil {
+			t.Errorf("Expected %s read, got %v", tbl.name, err)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected rows in all three, got %v", seen)
+	}
+}
+
+func TestPostgresValue(t *testing.T) {
+	when := time.Date(2075, 6, 16, 9, 30, 0, 0, time.UTC)
+	for _, c := range []struct {
+		v      any
+		pgType string
+		want   any
+	}{
+		{int64(1), "BOOLEAN", true},
+		{int64(0), "BOOLEAN", false},
+		{"2075-06-16 09:30:00", "TIMESTAMPTZ", when},
+		{"2075-06-16 10:30:00+01:00", "TIMESTAMPTZ", when},
+		{"2075-06-16T09:30:00Z", "TIMESTAMPTZ", when},
+		{[]byte("Dana"), "TEXT", "Dana"},
+		{int64(3), "TEXT", "3"},
+		{nil, "TIMESTAMPTZ", nil},
+	} {
+		got, err := postgresValue(c.v, c.pgType)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("Expected %v for %v as %s, got %v %v", c.want, c.v, c.pgType, got, err)
+		}
+	}
+	if _, err := postgresValue("next tuesday", "TIMESTAMPTZ"); err == nil {
+		t.Errorf("Expected a time that isn't one refused")
+	}
+}
+
+// Needs a Postgres to copy into, e.g.
+// CITYNEXT_TEST_POSTGRES_URL=postgres://postgres@localhost/postgres
+func TestMigratePostgres(t *testing.T) {
+	url := os.Getenv("CITYNEXT_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("no CITYNEXT_TEST_POSTGRES_URL")
+	}
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1)
+	router := server.routes()
+	for _, date := range []string{"2075-06-16", "2075-06-17"} {
+		if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: date}); w.Code != 201 {
+			t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	// A schema of its own, so it starts empty
+	schema := fmt.Sprintf("citynext_test_%d", time.Now().UnixNano())
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema+"; SET search_path TO "+schema); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+
+	counts, err := copyToPostgres(ctx, server.db, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := map[string]int64{}
+	for _, c := range counts {
+		copied[c.table] = c.rows
+	}
+	if copied["appointments"] != 2 || copied["persons"] == 0 {
+		t.Errorf("Expected both bookings and their people, got %v", copied)
+	}
+
+	// Numbering carries on
+	var id int64
+	if err := conn.QueryRow(ctx, "INSERT INTO appointments (person_id, visit_date) VALUES (1, '2075-06-18') RETURNING id").Scan(&id); err != nil || id != 3 {
+		t.Errorf("Expected the next id to be 3, got %d %v", id, err)
+	}
+
+	// Not into one that has rows
+	if _, err := copyToPostgres(ctx, server.db, conn); err == nil || !strings.Contains(err.Error(), "already has rows") {
+		t.Errorf("Expected a second copy refused, got %v", err)
+	}
+}
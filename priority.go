@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Some people get to book where others can't: into the places held back
+// each day by CITYNEXT_RESERVED_CAPACITY, and inside a service's notice
+// period from CITYNEXT_LEAD_DAYS. CITYNEXT_PRIORITY_CLASSES says which
+// classes count for which services, e.g.
+// "disabled=general|passports,urgent=passports", and the classes in
+// CITYNEXT_PRIORITY_VERIFIED only count when staff book them. Every
+// priority booking is written down, with what it got to skip
+type PriorityBooking struct {
+	XMLName        xml.Name  `json:"-" xml:"priorityBooking"`
+	AppointmentID  int       `json:"appointmentId" xml:"appointmentId"`
+	VisitDate      string    `json:"visitDate" xml:"visitDate"`
+	Service        string    `json:"service" xml:"service"`
+	Class          string    `json:"class" xml:"class"`
+	Reserved       bool      `json:"reserved" xml:"reserved"`             // went into the held back places
+	InsideLeadTime bool      `json:"insideLeadTime" xml:"insideLeadTime"` // sooner than the service's notice
+	ChangedBy      string    `json:"changedBy" xml:"changedBy"`
+	ChangedAt      time.Time `json:"changedAt" xml:"changedAt"`
+}
+
+type PriorityBookingList struct {
+	XMLName  xml.Name          `json:"-" xml:"priorityBookings"`
+	Bookings []PriorityBooking `json:"bookings" xml:"priorityBooking"`
+}
+
+// "passports=3" into days' notice by service
+func envLeadDays(key string) map[string]int {
+	days := map[string]int{}
+	for service, values := range envMap(key) {
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n < 0 {
+			log.Printf("Ignoring %s entry %s=%s, expected e.g. passports=3", key, service, values[0])
+			continue
+		}
+		days[service] = n
+	}
+	return days
+}
+
+// Turned away if the class doesn't exist, isn't for this service, or
+// needs staff to have checked it
+func (s *Server) validatePriority(w http.ResponseWriter, r *http.Request, req AppointmentRequest) bool {
+	if req.Priority == "" {
+		return true
+	}
+	cfg := s.live()
+	services, ok := cfg.PriorityClasses[req.Priority]
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownPriority, "No such priority class")
+		return false
+	}
+	if !slices.Contains(services, req.Service) {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodePriorityNotForService, "That priority class doesn't apply to "+req.Service)
+		return false
+	}
+	if slices.Contains(cfg.PriorityVerified, req.Priority) && channelOrOnline(req.Channel) == ChannelOnline {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodePriorityNeedsStaff, "That priority class has to be booked by staff")
+		return false
+	}
+	return true
+}
+
+// Everyone but priority bookings and walk-ins needs the service's notice
+func (s *Server) checkLeadTime(w http.ResponseWriter, r *http.Request, req AppointmentRequest, visitDate, today time.Time) bool {
+	days := s.live().LeadDays[req.Service]
+	if req.Priority != "" || req.Channel == ChannelWalkIn || !visitDate.Before(today.AddDate(0, 0, days)) {
+		return true
+	}
+	s.sendErrorResponse(w, r, http.StatusBadRequest, CodeTooSoon, req.Service+" needs "+strconv.Itoa(days)+" days' notice")
+	return false
+}
+
+// What's left for a booking once the reserved places are taken out,
+// unless it's one they're reserved for
+func (s *Server) capacityFor(visitDate time.Time, priority string) int {
+	capacity := s.capacityOn(visitDate)
+	if priority == "" {
+		capacity -= s.live().ReservedCapacity
+	}
+	return capacity
+}
+
+// The class a booking was made under, "" if it wasn't a priority. The
+// classes are only kept in the database, so in memory every booking
+// moves as a public one
+func (s *Server) appointmentPriority(ctx context.Context, id int) (string, error) {
+	if s.db == nil {
+		return "", nil
+	}
+	var class string
+	err := s.db.QueryRowContext(ctx, "SELECT class FROM priority_bookings WHERE appointment_id = ? ORDER BY id DESC LIMIT 1", id).Scan(&class)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return class, err
+}
+
+func (s *Server) initPriorityTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS priority_bookings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		appointment_id INTEGER NOT NULL,
+		visit_date TEXT NOT NULL,
+		service TEXT NOT NULL,
+		class TEXT NOT NULL,
+		reserved BOOLEAN NOT NULL,
+		inside_lead_time BOOLEAN NOT NULL,
+		changed_by TEXT NOT NULL,
+		changed_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+func (s *Server) notePriority(ctx context.Context, appointment Appointment, req AppointmentRequest, visitDate, today time.Time) {
+	if req.Priority == "" {
+		return
+	}
+	booked, err := s.store.Booked(ctx, visitDate)
+	if err != nil {
+		log.Printf("Error checking priority booking %d: %v", appointment.ID, err)
+	}
+	p := PriorityBooking{
+		AppointmentID:  appointment.ID,
+		VisitDate:      appointment.VisitDate,
+		Service:        req.Service,
+		Class:          req.Priority,
+		Reserved:       err == nil && booked > s.capacityFor(visitDate, ""),
+		InsideLeadTime: visitDate.Before(today.AddDate(0, 0, s.live().LeadDays[req.Service])),
+		ChangedBy:      actorFrom(ctx),
+	}
+	log.Printf("Priority booking %d for %s on %s as %s, reserved places %t, inside notice %t", p.AppointmentID, p.Service, p.VisitDate, p.Class, p.Reserved, p.InsideLeadTime)
+	if s.db == nil {
+		return
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO priority_bookings (appointment_id, visit_date, service, class, reserved, inside_lead_time, changed_by, changed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.AppointmentID, p.VisitDate, p.Service, p.Class, p.Reserved, p.InsideLeadTime, p.ChangedBy, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error recording priority booking %d: %v", appointment.ID, err)
+	}
+}
+
+// GET /admin/priority-bookings, newest first
+func (s *Server) listPriorityBookings(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT appointment_id, visit_date, service, class, reserved, inside_lead_time, changed_by, changed_at
+		FROM priority_bookings ORDER BY id DESC`)
+	if err != nil {
+		log.Printf("Error listing priority bookings: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list priority bookings")
+		return
+	}
+	defer rows.Close()
+
+	list := PriorityBookingList{Bookings: []PriorityBooking{}}
+	for rows.Next() {
+		var p PriorityBooking
+		if err := rows.Scan(&p.AppointmentID, &p.VisitDate, &p.Service, &p.Class, &p.Reserved, &p.InsideLeadTime, &p.ChangedBy, &p.ChangedAt); err != nil {
+			log.Printf("Error listing priority bookings: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list priority bookings")
+			return
+		}
+		list.Bookings = append(list.Bookings, p)
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPriorityBookings(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 2
+	server.cfg.ReservedCapacity = 1
+	server.cfg.QueueServices = []string{"general", "passports"}
+	server.cfg.PriorityClasses = map[string][]string{"disabled": {"general", "passports"}, "urgent": {"passports"}}
+	server.cfg.PriorityVerified = []string{"urgent"}
+	server.cfg.LeadDays = map[string]int{"passports": 3}
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	router := server.routes()
+
+	// One place is public, the other's held back
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "First", LastName: "In", VisitDate: "2075-06-24"}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for the public place, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Second", LastName: "In", VisitDate: "2075-06-24"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 once only the reserved place is left, got %d", w.Code)
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Second", LastName: "In", VisitDate: "2075-06-24", Priority: "disabled"}); w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 into the reserved place, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Passports need notice, unless it's a priority
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Last", LastName: "Minute", VisitDate: "2075-06-17", Service: "passports"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 inside the notice, got %d", w.Code)
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Last", LastName: "Minute", VisitDate: "2075-06-17", Service: "passports", Priority: "urgent"}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for urgent booked online, got %d", w.Code)
+	}
+	body, _ := json.Marshal(AppointmentRequest{
+		FirstName: "Last", LastName: "Minute", VisitDate: "2075-06-17", Service: "passports", Priority: "urgent",
+		BookedBy: &BookedBy{Role: BookedByStaff, Name: "Sam Agent", StaffID: "CC042"},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments", body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for urgent booked by staff, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "No", LastName: "Such", VisitDate: "2075-06-24", Priority: "vip"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown class, got %d", w.Code)
+	}
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Wrong", LastName: "Service", VisitDate: "2075-06-25", Priority: "urgent"}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a class that isn't for the service, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/priority-bookings", nil))
+	var list PriorityBookingList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Expected the list, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(list.Bookings) != 2 {
+		t.Fatalf("Expected two priority bookings, got %+v", list.Bookings)
+	}
+	if urgent := list.Bookings[0]; urgent.Class != "urgent" || !urgent.InsideLeadTime || urgent.Reserved || urgent.ChangedBy != ActorAdmin {
+		t.Errorf("Expected urgent inside the notice by admin, got %+v", urgent)
+	}
+	if disabled := list.Bookings[1]; disabled.Class != "disabled" || !disabled.Reserved || disabled.InsideLeadTime {
+		t.Errorf("Expected disabled in the reserved place, got %+v", disabled)
+	}
+}
+
+// Moving a booking can't take a reserved place any more than booking can
+func TestPriorityPlacesOnMove(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 2
+	server.cfg.ReservedCapacity = 1
+	server.cfg.QueueServices = []string{"general", "passports"}
+	server.cfg.PriorityClasses = map[string][]string{"disabled": {"general", "passports"}}
+	router := server.routes()
+
+	for _, req := range []AppointmentRequest{
+		{FirstName: "First", LastName: "In", VisitDate: "2075-06-24"},
+		{FirstName: "Moving", LastName: "Along", VisitDate: "2075-06-25"},
+		{FirstName: "Moving", LastName: "Priority", VisitDate: "2075-06-26", Priority: "disabled"},
+	} {
+		if w := postAppointment(t, router, req); w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	move := func(path, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", path, []byte(body)))
+		return w.Code
+	}
+
+	if code := move("/admin/appointments/2/reschedule", `{"visitDate":"2075-06-24"}`); code != http.StatusConflict {
+		t.Errorf("Expected 409 rescheduling into the reserved place, got %d", code)
+	}
+	if code := move("/admin/appointments/2/transfer", `{"service":"passports","visitDate":"2075-06-24"}`); code != http.StatusConflict {
+		t.Errorf("Expected 409 transferring into the reserved place, got %d", code)
+	}
+	if code := move("/admin/appointments/3/reschedule", `{"visitDate":"2075-06-24"}`); code != http.StatusOK {
+		t.Errorf("Expected the priority booking to move into it, got %d", code)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Someone who's booked before can have the form filled in with the
+// details they gave last time. There's no citizen sign in, so they prove
+// it's their email: POST /me/verify emails a link with a signed token,
+// and GET /me/profile with that token gives back what their latest
+// booking said. Nothing's kept, the token is signed like download links
+// and lasts CITYNEXT_PROFILE_LINK_TTL
+type Profile struct {
+	XMLName           xml.Name `json:"-" xml:"profile"`
+	FirstName         string   `json:"firstName" xml:"firstName"`
+	LastName          string   `json:"lastName" xml:"lastName"`
+	Title             string   `json:"title,omitempty" xml:"title,omitempty"`
+	PreferredName     string   `json:"preferredName,omitempty" xml:"preferredName,omitempty"`
+	Email             string   `json:"email" xml:"email"`
+	PreferredLanguage string   `json:"preferredLanguage" xml:"preferredLanguage"`
+	Address           *Address `json:"address,omitempty" xml:"address,omitempty"`
+	LastVisitDate     string   `json:"lastVisitDate" xml:"lastVisitDate"` // of the booking it's from
+}
+
+type ProfileLinkSent struct {
+	XMLName xml.Name `json:"-" xml:"profileLink"`
+	Message string   `json:"message" xml:"message"`
+}
+
+// What the profile link email renders with
+type ProfileLink struct {
+	Appointment
+	URL       string
+	ExpiresAt string
+}
+
+func profileMessage(email string, expires int64) string {
+	return fmt.Sprintf("profile\n%s\n%d", email, expires)
+}
+
+// The email and its signature in one opaque string for the link
+func (s *Server) profileToken(ctx context.Context, email string, expiresAt time.Time) string {
+	kid, sig := s.signMessage(ctx, profileMessage(email, expiresAt.Unix()))
+	q := url.Values{}
+	q.Set("email", email)
+	q.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	q.Set("kid", kid)
+	q.Set("sig", sig)
+	return base64.RawURLEncoding.EncodeToString([]byte(q.Encode()))
+}
+
+// The email a token is for, or a 403 invalid_token or 410 link_expired
+func (s *Server) profileEmail(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	q, _ := url.ParseQuery(string(data))
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || !s.verifySignature(r.Context(), q.Get("kid"), profileMessage(q.Get("email"), expires), q.Get("sig")) {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodeInvalidToken, "That link isn't valid")
+		return "", false
+	}
+	if time.Now().Unix() > expires {
+		s.sendErrorResponse(w, r, http.StatusGone, CodeLinkExpired, "That link has expired, ask for a new one")
+		return "", false
+	}
+	return q.Get("email"), true
+}
+
+// Their most recent booking, cancelled or not
+func (s *Server) latestBookingBy(ctx context.Context, email string) (Revision, bool, error) {
+	revisions, err := s.store.Revisions(ctx)
+	if err != nil {
+		return Revision{}, false, err
+	}
+	var latest Revision
+	found := false
+	for _, rev := range revisions {
+		if strings.EqualFold(rev.Email, email) && (!found || !rev.ChangedAt.Before(latest.ChangedAt)) {
+			latest, found = rev, true
+		}
+	}
+	return latest, found, nil
+}
+
+// POST /me/verify with {"email": "..."}. It's a 202 whether or not
+// anyone's booked with it, so it can't be used to find out who has
+func (s *Server) verifyProfileEmail(w http.ResponseWriter, r *http.Request) {
+	if !s.signingEnabled(r.Context()) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeProfileUnavailable, "That isn't available here")
+		return
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !strings.Contains(email, "@") {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidEmail, "A valid email address is required")
+		return
+	}
+
+	// Looked up and sent after answering, so how long it takes doesn't
+	// give away whether there was anything to send
+	go func() {
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+		defer cancel()
+		latest, found, err := s.latestBookingBy(ctx, email)
+		if err != nil {
+			log.Printf("Error looking up a profile to verify: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+		expiresAt := time.Now().Add(s.cfg.ProfileLinkTTL).Truncate(time.Second).UTC()
+		link := ProfileLink{
+			Appointment: latest.Appointment,
+			URL:         s.cfg.PublicURL + "/me/profile?token=" + s.profileToken(ctx, email, expiresAt),
+			ExpiresAt:   expiresAt.Format("2006-01-02 15:04 MST"),
+		}
+		link.Email = email
+		s.notifyWith(ctx, MessageProfileLink, link.Appointment, link)
+	}()
+	s.respond(w, r, http.StatusAccepted, ProfileLinkSent{Message: "If anyone's booked with that email, a link to fill in their details is on its way"})
+}
+
+// GET /me/profile with the token from the email, as a bearer token or ?token=
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request) {
+	email, ok := s.profileEmail(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+	latest, found, err := s.latestBookingBy(ctx, email)
+	if err != nil {
+		log.Printf("Error looking up a profile: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to look up the profile")
+		return
+	}
+	if !found {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNoProfile, "There are no bookings with that email any more")
+		return
+	}
+
+	// Someone's details, so not for a shared cache
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	s.respond(w, r, http.StatusOK, Profile{
+		FirstName:         latest.FirstName,
+		LastName:          latest.LastName,
+		Title:             latest.Title,
+		PreferredName:     latest.PreferredName,
+		Email:             latest.Email,
+		PreferredLanguage: latest.PreferredLanguage,
+		Address:           latest.Address,
+		LastVisitDate:     latest.VisitDate,
+	})
+}
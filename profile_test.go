@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+	for _, store := range []string{"sqlite", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, sent := closureServer(t, store)
+			router := server.routes()
+
+			for _, req := range []AppointmentRequest{
+				{FirstName: "Rhian", LastName: "Old", Email: "rhian@example.com", VisitDate: "2075-01-08"},
+				{FirstName: "Rhian", LastName: "Returning", Email: "Rhian@Example.com", VisitDate: "2075-01-09", PreferredLanguage: "cy", Address: &Address{Line1: "1 High Street", Postcode: "CF10 1AA"}},
+			} {
+				if w := postAppointment(t, router, req); w.Code != http.StatusCreated {
+					t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+				}
+				sent.next(t) // the confirmation
+			}
+
+			verify := func(email string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("POST", "/me/verify", bytes.NewReader([]byte(`{"email": "`+email+`"}`))))
+				return w
+			}
+			if w := verify("nobody@example.com"); w.Code != http.StatusAccepted {
+				t.Errorf("Expected the same 202 for an unknown email, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := verify("not an email"); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected a bad email refused, got %d", w.Code)
+			}
+			if w := verify(" RHIAN@example.com"); w.Code != http.StatusAccepted {
+				t.Fatalf("Expected a link sent, got %d: %s", w.Code, w.Body.String())
+			}
+			msg := sent.next(t)
+			if msg.To != "rhian@example.com" || !strings.Contains(msg.Subject, "manylion") {
+				t.Errorf("Expected the link in Welsh to the email they gave, got %q to %s", msg.Subject, msg.To)
+			}
+			_, after, ok := strings.Cut(msg.Text, "https://book.example.gov/me/profile?token=")
+			if !ok {
+				t.Fatalf("Expected a profile link, got %s", msg.Text)
+			}
+			token, _, _ := strings.Cut(after, "\n")
+
+			get := func(token string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("GET", "/me/profile", nil)
+				r.Header.Set("Authorization", "Bearer "+token)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				return w
+			}
+			w := get(token)
+			var profile Profile
+			json.Unmarshal(w.Body.Bytes(), &profile)
+			if w.Code != http.StatusOK || profile.LastName != "Returning" || profile.PreferredLanguage != "cy" || profile.Address == nil || profile.LastVisitDate != "2075-01-09" {
+				t.Errorf("Expected the latest booking's details, got %d: %s", w.Code, w.Body.String())
+			}
+			if w.Header().Get("Cache-Control") != "private, no-store" {
+				t.Errorf("Expected the profile kept out of caches")
+			}
+
+			if w := get(token[:len(token)-2]); w.Code != http.StatusForbidden {
+				t.Errorf("Expected a tampered token refused, got %d", w.Code)
+			}
+			expired := server.profileToken(context.Background(), "rhian@example.com", time.Now().Add(-time.Minute))
+			if w := get(expired); w.Code != http.StatusGone {
+				t.Errorf("Expected an expired token refused, got %d", w.Code)
+			}
+			// Nor is a signed download link one
+			download := server.signedURL(context.Background(), "/me/profile", time.Now().Add(time.Hour))
+			_, query, _ := strings.Cut(download, "?")
+			if w := get(base64.RawURLEncoding.EncodeToString([]byte(query + "&email=rhian@example.com"))); w.Code != http.StatusForbidden {
+				t.Errorf("Expected a download link's signature refused, got %d", w.Code)
+			}
+			if w := get(""); w.Code != http.StatusForbidden {
+				t.Errorf("Expected no token refused, got %d", w.Code)
+			}
+			select {
+			case msg := <-sent:
+				t.Errorf("Expected nothing sent for an unknown email, got %q to %s", msg.Subject, msg.To)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every query the database runs is timed, by wrapping the SQLite driver,
+// so the store and everything else that uses s.db is covered without
+// going through anything new. Queries that take CITYNEXT_SLOW_QUERY_THRESHOLD
+// or longer are logged with the route they were for. Their arguments are
+// logged as types only, they're people's names and dates of birth
+type queryObserver func(ctx context.Context, query string, args []driver.NamedValue, took time.Duration)
+
+type timedDB struct {
+	drv      driver.Driver
+	dsn      string
+	observer atomic.Pointer[queryObserver] // set by NewServer
+}
+
+// The same as sql.Open, with the timing
+func openTimed(driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+	return sql.OpenDB(&timedDB{drv: drv, dsn: dsn}), nil
+}
+
+func (t *timedDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return t.Open(t.dsn)
+}
+
+func (t *timedDB) Driver() driver.Driver { return t }
+
+func (t *timedDB) Open(name string) (driver.Conn, error) {
+	conn, err := t.drv.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn, db: t}, nil
+}
+
+func (t *timedDB) observe(ctx context.Context, query string, args []driver.NamedValue, start time.Time) {
+	if observer := t.observer.Load(); observer != nil {
+		(*observer)(ctx, query, args, time.Since(start))
+	}
+}
+
+// Passes everything on, timing queries and statements. What the SQLite
+// driver doesn't do is an ErrSkip, so database/sql falls back as it would
+type timedConn struct {
+	driver.Conn
+	db *timedDB
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{Stmt: stmt, db: c.db, query: query}, nil
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := e.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.db.observe(ctx, query, args, start)
+	}
+	return result, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != nil {
+		if err != driver.ErrSkip {
+			c.db.observe(ctx, query, args, start)
+		}
+		return nil, err
+	}
+	return &timedRows{Rows: rows, done: func() { c.db.observe(ctx, query, args, start) }}, nil
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *timedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type timedStmt struct {
+	driver.Stmt
+	db    *timedDB
+	query string
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer s.db.observe(ctx, s.query, args, start)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedValues(args))
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(args))
+	}
+	if err != nil {
+		s.db.observe(ctx, s.query, args, start)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, done: func() { s.db.observe(ctx, s.query, args, start) }}, nil
+}
+
+func (s *timedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	return values
+}
+
+// SQLite does most of the work as the rows are read, so a query's time
+// runs until they're closed
+type timedRows struct {
+	driver.Rows
+	done   func()
+	closed bool
+}
+
+func (r *timedRows) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.done()
+	}
+	return r.Rows.Close()
+}
+
+// Which route a request matched, "GET /availability", for the slow query
+// log. Queries outside a request are "background"
+type routeKey struct{}
+
+func routeFrom(ctx context.Context) string {
+	if route, ok := ctx.Value(routeKey{}).(string); ok {
+		return route
+	}
+	return "background"
+}
+
+// Times each request by the route it matched, for
+// citynext_http_request_duration_seconds. Streams are left out, they're
+// open for as long as the client stays
+func (s *Server) timeRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || streamingRoutes[route.GetName()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tpl, _ := route.GetPathTemplate()
+
+		start := time.Now()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, r.Method+" "+tpl)))
+		s.metrics.observe("citynext_http_request_duration_seconds", time.Since(start).Seconds(), r.Method, tpl)
+	})
+}
+
+func (s *Server) observeQuery(ctx context.Context, query string, args []driver.NamedValue, took time.Duration) {
+	route := routeFrom(ctx)
+	s.metrics.observe("citynext_db_query_duration_seconds", took.Seconds(), route)
+
+	threshold := s.live().SlowQueryThreshold
+	if threshold <= 0 || took < threshold {
+		return
+	}
+	s.metrics.inc("citynext_db_slow_queries_total", route)
+	log.Printf("Slow query for %s took %s: %s %s", route, took.Round(time.Millisecond), strings.Join(strings.Fields(query), " "), redactedArgs(args))
+}
+
+// The types and not the values, enough to see which form of a query it was
+func redactedArgs(args []driver.NamedValue) string {
+	types := make([]string, len(args))
+	for i, a := range args {
+		switch a.Value.(type) {
+		case nil:
+			types[i] = "null"
+		case string:
+			types[i] = "text"
+		case []byte:
+			types[i] = "blob"
+		case int64:
+			types[i] = "int"
+		case float64:
+			types[i] = "real"
+		case bool:
+			types[i] = "bool"
+		case time.Time:
+			types[i] = "time"
+		default:
+			types[i] = fmt.Sprintf("%T", a.Value)
+		}
+	}
+	return "[" + strings.Join(types, " ") + "]"
+}
+
+type RouteLatency struct {
+	XMLName xml.Name `json:"-" xml:"route"`
+	Method  string   `json:"method" xml:"method,attr"`
+	Route   string   `json:"route" xml:"route,attr"`
+	Count   uint64   `json:"count" xml:"count"`
+	// Seconds, estimated from the histogram's buckets the way
+	// Prometheus' histogram_quantile does
+	P50 float64 `json:"p50" xml:"p50"`
+	P95 float64 `json:"p95" xml:"p95"`
+	P99 float64 `json:"p99" xml:"p99"`
+}
+
+type RouteLatencyList struct {
+	XMLName xml.Name       `json:"-" xml:"latency"`
+	Routes  []RouteLatency `json:"routes" xml:"route"`
+}
+
+// GET /admin/latency, by route since this instance started, slowest p95
+// first. Prometheus has the same over any window it likes
+func (s *Server) getLatency(w http.ResponseWriter, r *http.Request) {
+	list := RouteLatencyList{Routes: []RouteLatency{}}
+	for _, q := range s.metrics.quantiles("citynext_http_request_duration_seconds", 0.5, 0.95, 0.99) {
+		list.Routes = append(list.Routes, RouteLatency{Method: q.labelValues[0], Route: q.labelValues[1], Count: q.count, P50: q.values[0], P95: q.values[1], P99: q.values[2]})
+	}
+	sort.SliceStable(list.Routes, func(i, j int) bool { return list.Routes[i].P95 > list.Routes[j].P95 })
+	s.respond(w, r, http.StatusOK, list)
+}
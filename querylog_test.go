@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowQueriesAndRouteLatency(t *testing.T) {
+	db, err := openDB(filepath.Join(t.TempDir(), "appointments.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server := NewServer(db)
+	if err := server.initDB(); err != nil {
+		t.Fatal(err)
+	}
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 5
+	server.cfg.SlowQueryThreshold = time.Nanosecond // everything's slow
+	server.yearStr = "2075"
+	router := server.routes()
+
+	for range 3 {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/availability?month=2075-06", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`citynext_http_request_duration_seconds_count{method="GET",route="/availability"} 3`,
+		`citynext_db_slow_queries_total{route="GET /availability"}`,
+		`citynext_db_query_duration_seconds_count{route="background"}`, // the tables being made
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics", want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/latency", nil))
+	var latency RouteLatencyList
+	json.Unmarshal(w.Body.Bytes(), &latency)
+	found := false
+	for _, r := range latency.Routes {
+		if r.Route == "/availability" {
+			found = r.Count == 3 && r.P50 > 0 && r.P50 <= r.P95 && r.P95 <= r.P99
+		}
+	}
+	if !found {
+		t.Errorf("Expected /availability's percentiles, got %s", w.Body.String())
+	}
+}
+
+func TestRedactedArgs(t *testing.T) {
+	got := redactedArgs([]driver.NamedValue{{Value: "Dana"}, {Value: int64(3)}, {Value: time.Now()}, {Value: nil}})
+	if got != "[text int time null]" {
+		t.Errorf("Expected only the types, got %s", got)
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	m := newMetrics()
+	for range 90 {
+		m.observe("citynext_dependency_duration_seconds", 0.003, "x") // under 0.005
+	}
+	for range 10 {
+		m.observe("citynext_dependency_duration_seconds", 0.7, "x") // 0.5 to 1
+	}
+	q := m.quantiles("citynext_dependency_duration_seconds", 0.5, 0.95, 1)[0]
+	if q.count != 100 || q.values[0] >= 0.005 || q.values[1] <= 0.5 || q.values[1] > 1 || q.values[2] != 1 {
+		t.Errorf("Expected p50 in the first bucket and p95 in 0.5-1, got %v", q.values)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Checking in takes a ticket for the service they've come for, numbered
+// from 1 each day for each service. Staff call the next number from
+// their desk, and anything listening on GET /queue/{date}/events hears
+// about it straight away
+const (
+	TicketWaiting = "waiting"
+	TicketCalled  = "called"
+)
+
+// SSE connections go quiet between calls, a comment every so often
+// keeps proxies from deciding they're dead
+var queueHeartbeat = 15 * time.Second
+
+var errQueueEmpty = errors.New("nobody waiting")
+
+type Ticket struct {
+	XMLName       xml.Name   `json:"-" xml:"ticket"`
+	Date          string     `json:"date" xml:"date"`
+	Service       string     `json:"service" xml:"service"`
+	Number        int        `json:"number" xml:"number"`
+	AppointmentID int        `json:"appointmentId" xml:"appointmentId"`
+	Status        string     `json:"status" xml:"status"`
+	IssuedAt      time.Time  `json:"issuedAt" xml:"issuedAt"`
+	CalledAt      *time.Time `json:"calledAt,omitempty" xml:"calledAt,omitempty"`
+	Desk          string     `json:"desk,omitempty" xml:"desk,omitempty"`
+}
+
+type Queue struct {
+	XMLName xml.Name `json:"-" xml:"queue"`
+	Date    string   `json:"date" xml:"date,attr"`
+	Tickets []Ticket `json:"tickets" xml:"ticket"` // by service, then number
+}
+
+func (s *Server) initQueueTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS queue_tickets (
+		visit_date TEXT NOT NULL,
+		service TEXT NOT NULL,
+		number INTEGER NOT NULL,
+		appointment_id INTEGER NOT NULL UNIQUE,
+		issued_at DATETIME NOT NULL,
+		called_at DATETIME,
+		desk TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (visit_date, service, number)
+	)`)
+	return err
+}
+
+// The first service is where people go if the kiosk doesn't say
+func (s *Server) queueServices() []string {
+	if len(s.cfg.QueueServices) == 0 {
+		return []string{"general"}
+	}
+	return s.cfg.QueueServices
+}
+
+const ticketSelect = "SELECT visit_date, service, number, appointment_id, issued_at, called_at, desk FROM queue_tickets"
+
+func scanTicket(row rowScanner) (Ticket, error) {
+	var t Ticket
+	var calledAt sql.NullTime
+	if err := row.Scan(&t.Date, &t.Service, &t.Number, &t.AppointmentID, &t.IssuedAt, &calledAt, &t.Desk); err != nil {
+		return Ticket{}, err
+	}
+	t.Status = TicketWaiting
+	if calledAt.Valid {
+		t.CalledAt = &calledAt.Time
+		t.Status = TicketCalled
+	}
+	return t, nil
+}
+
+// One ticket per appointment, so checking in twice gets the same number.
+// The number is worked out in the insert itself, which SQLite runs
+// one at a time, so two people checking in together can't share one
+func (s *Server) issueTicket(ctx context.Context, appointment Appointment, service string) (Ticket, error) {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO queue_tickets (visit_date, service, number, appointment_id, issued_at)
+		SELECT ?, ?, COALESCE(MAX(number), 0) + 1, ?, ? FROM queue_tickets WHERE visit_date = ? AND service = ?
+		ON CONFLICT (appointment_id) DO NOTHING`,
+		appointment.VisitDate, service, appointment.ID, time.Now().UTC(), appointment.VisitDate, service)
+	if err != nil {
+		return Ticket{}, fmt.Errorf("failed to issue ticket: %w", err)
+	}
+	return s.ticketFor(ctx, appointment.ID)
+}
+
+// Their ticket, or sql.ErrNoRows if they haven't checked in for one
+func (s *Server) ticketFor(ctx context.Context, appointmentID int) (Ticket, error) {
+	return scanTicket(s.db.QueryRowContext(ctx, ticketSelect+" WHERE appointment_id = ?", appointmentID))
+}
+
+// Lowest waiting number first, taken in one statement so two desks
+// calling at once get different people
+func (s *Server) callNextTicket(ctx context.Context, date, service, desk string) (Ticket, error) {
+	t, err := scanTicket(s.db.QueryRowContext(ctx, `
+		UPDATE queue_tickets SET called_at = ?, desk = ?
+		WHERE visit_date = ? AND service = ? AND number = (
+			SELECT MIN(number) FROM queue_tickets WHERE visit_date = ? AND service = ? AND called_at IS NULL)
+		RETURNING visit_date, service, number, appointment_id, issued_at, called_at, desk`,
+		time.Now().UTC(), desk, date, service, date, service))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Ticket{}, errQueueEmpty
+	}
+	return t, err
+}
+
+func (s *Server) queueFor(ctx context.Context, date string) (Queue, error) {
+	rows, err := s.db.QueryContext(ctx, ticketSelect+" WHERE visit_date = ? ORDER BY service, number", date)
+	if err != nil {
+		return Queue{}, err
+	}
+	defer rows.Close()
+
+	queue := Queue{Date: date, Tickets: []Ticket{}}
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil {
+			return Queue{}, err
+		}
+		queue.Tickets = append(queue.Tickets, t)
+	}
+	return queue, rows.Err()
+}
+
+// GET /queue/{date}, everyone who's checked in that day and whether they've been called
+func (s *Server) getQueue(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	queue, err := s.queueFor(ctx, mux.Vars(r)["date"])
+	if err != nil {
+		log.Printf("Error loading queue: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load queue")
+		return
+	}
+	s.respond(w, r, http.StatusOK, queue)
+}
+
+// POST /admin/queue/{date}/{service}/next with {"desk": "3"}
+func (s *Server) callNext(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !slices.Contains(s.queueServices(), vars["service"]) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownService, "No queue for that service")
+		return
+	}
+
+	var req struct {
+		Desk string `json:"desk"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	ticket, err := s.callNextTicket(ctx, vars["date"], vars["service"], req.Desk)
+	if errors.Is(err, errQueueEmpty) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeQueueEmpty, "Nobody is waiting for that service")
+		return
+	}
+	if err != nil {
+		log.Printf("Error calling next ticket: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to call the next number")
+		return
+	}
+
+	s.queue.publish(ticket)
+	s.respond(w, r, http.StatusOK, ticket)
+}
+
+// GET /queue/{date}/events, a "called" event with the ticket each time
+// a number is called
+func (s *Server) queueEvents(w http.ResponseWriter, r *http.Request) {
+	s.streamCalls(w, r, mux.Vars(r)["date"], func(ticket Ticket) (any, bool) {
+		return ticket, true
+	})
+}
+
+// Sends what event makes of each ticket called on that day, skipping the
+// ones it says no to. Runs until the client goes, so it's for streaming
+// routes only and moves the write deadline on as it goes, like the export
+func (s *Server) streamCalls(w http.ResponseWriter, r *http.Request, date string, event func(Ticket) (any, bool)) {
+	events, unsubscribe := s.queue.subscribe(date)
+	defer unsubscribe()
+	closing, done := s.streams.start()
+	defer done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	heartbeat := time.NewTicker(queueHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-closing:
+			s.sendReconnect(w, rc)
+			return
+		case ticket := <-events:
+			v, ok := event(ticket)
+			if !ok {
+				continue
+			}
+			data, _ := json.Marshal(v)
+			s.extendWriteDeadline(rc)
+			fmt.Fprintf(w, "event: called\nid: %s-%d\ndata: %s\n\n", ticket.Service, ticket.Number, data)
+		case <-heartbeat.C:
+			s.extendWriteDeadline(rc)
+			io.WriteString(w, ": ping\n\n")
+		}
+	}
+}
+
+func (s *Server) extendWriteDeadline(rc *http.ResponseController) {
+	if s.cfg.WriteTimeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+	}
+}
+
+// Hands called tickets to everyone listening on that day. Only within
+// this instance, behind a load balancer listeners hear their own
+// instance's desks
+type queueBroker struct {
+	mu   sync.Mutex
+	subs map[chan Ticket]string
+}
+
+func newQueueBroker() *queueBroker {
+	return &queueBroker{subs: make(map[chan Ticket]string)}
+}
+
+func (b *queueBroker) subscribe(date string) (<-chan Ticket, func()) {
+	ch := make(chan Ticket, 16)
+	b.mu.Lock()
+	b.subs[ch] = date
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// A listener that's fallen that far behind misses the event rather
+// than holding up the desk
+func (b *queueBroker) publish(ticket Ticket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, date := range b.subs {
+		if date != ticket.Date {
+			continue
+		}
+		select {
+		case ch <- ticket:
+		default:
+			log.Printf("Dropped queue event %s-%d for a slow listener", ticket.Service, ticket.Number)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.KioskToken = "kiosk-secret"
+	server.cfg.DailyCapacity = 3
+	server.cfg.QueueServices = []string{"general", "passports"}
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	router := server.routes()
+
+	for _, last := range []string{"One", "Two", "Three"} {
+		postAppointment(t, router, AppointmentRequest{FirstName: "Q", LastName: last, VisitDate: "2075-06-16"})
+	}
+	checkIn := func(body string) CheckIn {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, kioskRequest("POST", "/kiosk/checkin", []byte(body)))
+		var c CheckIn
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &c) != nil {
+			t.Fatalf("Expected 200 checking in, got %d: %s", w.Code, w.Body.String())
+		}
+		return c
+	}
+
+	// Numbered per service
+	if c := checkIn(`{"appointmentId":1,"lastName":"One"}`); c.Service != "general" || c.QueueNumber != 1 {
+		t.Errorf("Expected general 1, got %+v", c)
+	}
+	if c := checkIn(`{"appointmentId":2,"lastName":"Two","service":"passports"}`); c.QueueNumber != 1 {
+		t.Errorf("Expected passports 1, got %+v", c)
+	}
+	if c := checkIn(`{"appointmentId":3,"lastName":"Three"}`); c.QueueNumber != 2 {
+		t.Errorf("Expected general 2, got %+v", c)
+	}
+	if c := checkIn(`{"appointmentId":1,"lastName":"One"}`); c.QueueNumber != 1 {
+		t.Errorf("Expected the same ticket checking in again, got %+v", c)
+	}
+
+	// Listen for calls from a real connection
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL+"/queue/2075-06-16/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", ct)
+	}
+
+	callNext := func(service string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/queue/2075-06-16/"+service+"/next", []byte(`{"desk":"3"}`)))
+		return w
+	}
+	if w := callNext("general"); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 calling the next number, got %d: %s", w.Code, w.Body.String())
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	var event, data string
+	for lines.Scan() && lines.Text() != "" {
+		if v, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+			event = v
+		}
+		if v, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			data = v
+		}
+	}
+	var called Ticket
+	if event != "called" || json.Unmarshal([]byte(data), &called) != nil || called.Number != 1 || called.Desk != "3" {
+		t.Errorf("Expected an event for general 1 at desk 3, got %q %s", event, data)
+	}
+
+	callNext("general")
+	if w := callNext("general"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with nobody left waiting, got %d", w.Code)
+	}
+	if w := callNext("parking"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown service, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/queue/2075-06-16", nil))
+	var queue Queue
+	if err := json.Unmarshal(w.Body.Bytes(), &queue); err != nil || len(queue.Tickets) != 3 {
+		t.Fatalf("Expected three tickets, got %s", w.Body.String())
+	}
+	waiting := 0
+	for _, ticket := range queue.Tickets {
+		if ticket.Status == TicketWaiting {
+			waiting++
+		}
+	}
+	if waiting != 1 {
+		t.Errorf("Expected only the passports ticket still waiting, got %d", waiting)
+	}
+}
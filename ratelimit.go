@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fixed one minute windows per client IP, counted in the shared cache so
+// every replica sees the same totals. Off when the limit is 0
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.live().RateLimitPerMinute
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		window := time.Now().Unix() / 60
+		key := "ratelimit:" + clientIP(r) + ":" + strconv.FormatInt(window, 10)
+
+		count, err := s.cache.Incr(r.Context(), key, time.Minute)
+		if err != nil {
+			// Better to let bookings through than to fall over with the cache
+			log.Printf("Error counting request for rate limit: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if count > int64(limit) {
+			w.Header().Set("Retry-After", strconv.FormatInt(60-time.Now().Unix()%60, 10))
+			s.sendErrorResponse(w, r, http.StatusTooManyRequests, CodeRateLimited, "Too many requests, please try again shortly")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		return host
+	}
+	// Over a Unix socket the only one connecting is the proxy in front,
+	// so the hop it added to X-Forwarded-For is who the client is. Not
+	// X-Real-Ip, or anything further back, a proxy that doesn't set them
+	// passes on whatever the client sent
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// When a day has fewer staff than it was booked for, someone has to
+// move. A rule picks who, latest booked first unless CITYNEXT_REBALANCE_RULE
+// or the plan says otherwise, and each goes to the first day after with
+// room for them. Nothing moves until the plan's been looked over and sent back
+const (
+	RebalanceLatestBooked   = "latest-booked"
+	RebalanceEarliestBooked = "earliest-booked"
+	RebalanceLargestParty   = "largest-party" // fewest bookings moved
+)
+
+// Who goes first. IDs settle bookings made in the same second
+var rebalanceRules = map[string]func(a, b Appointment) int{
+	RebalanceLatestBooked:   func(a, b Appointment) int { return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), b.ID-a.ID) },
+	RebalanceEarliestBooked: func(a, b Appointment) int { return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), a.ID-b.ID) },
+	RebalanceLargestParty: func(a, b Appointment) int {
+		return cmp.Or(b.PartySize()-a.PartySize(), b.CreatedAt.Compare(a.CreatedAt), b.ID-a.ID)
+	},
+}
+
+var ErrPlanStale = errors.New("bookings have changed since the plan was made")
+
+type RebalanceMove struct {
+	XMLName       xml.Name  `json:"-" xml:"move"`
+	AppointmentID int       `json:"appointmentId" xml:"appointmentId"`
+	PartySize     int       `json:"partySize" xml:"partySize"`
+	BookedAt      time.Time `json:"bookedAt" xml:"bookedAt"`
+	ToDate        string    `json:"toDate" xml:"toDate"` // empty if there's nowhere this year with room
+}
+
+type RebalancePlan struct {
+	XMLName   xml.Name        `json:"-" xml:"rebalancePlan"`
+	VisitDate string          `json:"visitDate" xml:"visitDate"`
+	Capacity  int             `json:"capacity" xml:"capacity"` // what the day's cut to
+	Rule      string          `json:"rule" xml:"rule"`
+	Booked    int             `json:"booked" xml:"booked"` // people on the day when the plan was made
+	Moves     []RebalanceMove `json:"moves" xml:"moves>move"`
+	AppliedAt *time.Time      `json:"appliedAt,omitempty" xml:"appliedAt,omitempty"`
+}
+
+// POST /admin/rebalance with {"visitDate": "2075-06-16", "capacity": 4}
+// and optionally a "rule", says who would move where. It changes nothing
+func (s *Server) planRebalance(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	var req RebalancePlan
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	day, ok := s.validateVisitDate(w, r, req.VisitDate, today)
+	if !ok {
+		return
+	}
+	if req.Capacity < 0 {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidCapacity, "Capacity can't be negative")
+		return
+	}
+	if req.Rule == "" {
+		req.Rule = cmp.Or(s.cfg.RebalanceRule, RebalanceLatestBooked)
+	}
+	if _, ok := rebalanceRules[req.Rule]; !ok {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownRule, "Rule should be "+strings.Join(slices.Sorted(maps.Keys(rebalanceRules)), ", "))
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	plan, err := s.rebalancePlan(ctx, day, req.Capacity, req.Rule)
+	if err != nil {
+		log.Printf("Error planning a rebalance of %s: %v", req.VisitDate, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to plan the rebalance")
+		return
+	}
+	s.respond(w, r, http.StatusOK, plan)
+}
+
+func (s *Server) rebalancePlan(ctx context.Context, day time.Time, capacity int, rule string) (RebalancePlan, error) {
+	date := day.Format("2006-01-02")
+	plan := RebalancePlan{VisitDate: date, Capacity: capacity, Rule: rule, Moves: []RebalanceMove{}}
+
+	booked, err := s.store.Booked(ctx, day)
+	if err != nil {
+		return RebalancePlan{}, err
+	}
+	plan.Booked = booked
+
+	// Anyone who's already arrived stays
+	var candidates []Appointment
+	err = s.store.ForEach(ctx, func(a Appointment) error {
+		if a.VisitDate == date && a.CheckedInAt == nil {
+			candidates = append(candidates, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return RebalancePlan{}, err
+	}
+	slices.SortStableFunc(candidates, rebalanceRules[rule])
+
+	from := day.AddDate(0, 0, 1)
+	to := time.Date(day.Year(), time.December, 31, 0, 0, 0, 0, time.UTC)
+	attendance, err := s.store.Attendance(ctx, from, to)
+	if err != nil {
+		return RebalancePlan{}, err
+	}
+	cuts, err := s.store.CapacityCuts(ctx, from, to)
+	if err != nil {
+		return RebalancePlan{}, err
+	}
+	closed, err := s.closedDays(ctx, from, to)
+	if err != nil {
+		return RebalancePlan{}, err
+	}
+	holidays := s.holidaySet(ctx)
+
+	for _, a := range candidates {
+		if booked <= capacity {
+			break
+		}
+		move := RebalanceMove{AppointmentID: a.ID, PartySize: a.PartySize(), BookedAt: a.CreatedAt}
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			next := d.Format("2006-01-02")
+			if holidays.closed(d) || closed[next] {
+				continue
+			}
+			room := s.capacityOn(d)
+			if cut, ok := cuts[next]; ok {
+				room = min(room, cut)
+			}
+			// Counting the ones this plan has already put there
+			if attendance[next]+a.PartySize() <= room {
+				attendance[next] += a.PartySize()
+				move.ToDate = next
+				break
+			}
+		}
+		plan.Moves = append(plan.Moves, move)
+		booked -= a.PartySize()
+	}
+	return plan, nil
+}
+
+// POST /admin/rebalance/apply with a plan as it came back, cuts the day
+// and makes every move in it or, if anything's changed since, none of them
+func (s *Server) applyRebalance(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	var plan RebalancePlan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if _, ok := s.validateVisitDate(w, r, plan.VisitDate, today); !ok {
+		return
+	}
+	if plan.Capacity < 0 {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidCapacity, "Capacity can't be negative")
+		return
+	}
+	capacities := map[string]int{}
+	for _, move := range plan.Moves {
+		if move.ToDate == "" {
+			s.sendErrorResponse(w, r, http.StatusConflict, CodePlanIncomplete, "There's nowhere to move everyone to, move or cancel the rest by hand first")
+			return
+		}
+		if move.ToDate == plan.VisitDate {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidPlan, "A move has to go to another day")
+			return
+		}
+		to, ok := s.validateVisitDate(w, r, move.ToDate, today)
+		if !ok {
+			return
+		}
+		capacities[move.ToDate] = s.capacityOn(to)
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	moved, err := s.store.Rebalance(ctx, plan, capacities)
+	switch {
+	case errors.Is(err, ErrPlanStale):
+		s.sendErrorResponse(w, r, http.StatusConflict, CodePlanOutOfDate, "Bookings have changed since the plan was made, make a new one")
+		return
+	case errors.Is(err, ErrDuplicateAppointment):
+		s.sendFullyBooked(w, r)
+		return
+	case errors.Is(err, ErrDayClosed):
+		s.sendDayClosed(w, r)
+		return
+	case err != nil:
+		log.Printf("Error rebalancing %s: %v", plan.VisitDate, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to apply the rebalance")
+		return
+	}
+
+	log.Printf("Rebalanced %s to %d, moving %d bookings", plan.VisitDate, plan.Capacity, len(moved))
+	s.invalidateAvailability(ctx)
+	for _, appointment := range moved {
+		to, _ := time.Parse("2006-01-02", appointment.VisitDate)
+		s.noteOverbooking(ctx, appointment, to, RevisionRescheduled)
+	}
+	now := time.Now().UTC()
+	plan.AppliedAt = &now
+	s.respond(w, r, http.StatusOK, plan)
+
+	// A fresh confirmation with the new date, as a reschedule sends
+	go func() {
+		for _, appointment := range moved {
+			ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+			s.notifyAppointment(ctx, MessageConfirmation, appointment)
+			cancel()
+		}
+	}()
+}
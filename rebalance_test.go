@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRebalance(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, sent := closureServer(t, store)
+			router := server.routes()
+
+			// Three on the day that's short staffed and the next day full
+			for _, date := range []string{"2075-01-09", "2075-01-09", "2075-01-09", "2075-01-10", "2075-01-10", "2075-01-10"} {
+				if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Short", Email: "dana@example.com", VisitDate: date}); w.Code != http.StatusCreated {
+					t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+				}
+				sent.next(t)
+			}
+			post := func(url string, body string) (*httptest.ResponseRecorder, RebalancePlan) {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest("POST", url, []byte(body)))
+				var plan RebalancePlan
+				json.Unmarshal(w.Body.Bytes(), &plan)
+				return w, plan
+			}
+			moves := func(plan RebalancePlan) []string {
+				var got []string
+				for _, m := range plan.Moves {
+					got = append(got, strconv.Itoa(m.AppointmentID)+">"+m.ToDate)
+				}
+				return got
+			}
+
+			w, plan := post("/admin/rebalance", `{"visitDate": "2075-01-09", "capacity": 1}`)
+			if w.Code != http.StatusOK || plan.Booked != 3 || plan.Rule != RebalanceLatestBooked || !slices.Equal(moves(plan), []string{"3>2075-01-11", "2>2075-01-11"}) {
+				t.Fatalf("Expected the last two booked moved past the full day, got %d: %s", w.Code, w.Body.String())
+			}
+			if _, other := post("/admin/rebalance", `{"visitDate": "2075-01-09", "capacity": 2, "rule": "earliest-booked"}`); !slices.Equal(moves(other), []string{"1>2075-01-11"}) {
+				t.Errorf("Expected the first booked moved, got %+v", other)
+			}
+			if w, _ := post("/admin/rebalance", `{"visitDate": "2075-01-09", "capacity": 1, "rule": "random"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown_rule") {
+				t.Errorf("Expected an unknown rule refused, got %d: %s", w.Code, w.Body.String())
+			}
+
+			// A cancellation since makes it out of date, and nothing moves
+			router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/admin/appointments/2/cancel", nil))
+			sent.next(t)
+			body, _ := json.Marshal(plan)
+			if w, _ := post("/admin/rebalance/apply", string(body)); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "plan_out_of_date") {
+				t.Fatalf("Expected a stale plan refused, got %d: %s", w.Code, w.Body.String())
+			}
+			if w, _ := getAvailability(t, router, "/availability?month=2075-01", ""); w.Code != http.StatusOK {
+				t.Fatal(w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/3/history", nil))
+			if strings.Contains(w.Body.String(), "2075-01-11") {
+				t.Errorf("Expected nothing moved, got %s", w.Body.String())
+			}
+
+			_, plan = post("/admin/rebalance", `{"visitDate": "2075-01-09", "capacity": 1}`)
+			body, _ = json.Marshal(plan)
+			w, applied := post("/admin/rebalance/apply", string(body))
+			if w.Code != http.StatusOK || applied.AppliedAt == nil || !slices.Equal(moves(applied), []string{"3>2075-01-11"}) {
+				t.Fatalf("Expected the plan applied, got %d: %s", w.Code, w.Body.String())
+			}
+			if msg := sent.next(t); !strings.Contains(msg.Subject, "2075-01-11") {
+				t.Errorf("Expected a fresh confirmation, got %+v", msg)
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/3/history", nil))
+			var history History
+			json.Unmarshal(w.Body.Bytes(), &history)
+			if n := len(history.Revisions); n != 2 || history.Revisions[1].Change != RevisionRescheduled || history.Revisions[1].VisitDate != "2075-01-11" {
+				t.Errorf("Expected the move in the history, got %s", w.Body.String())
+			}
+
+			// The cut stays, there's no filling the day back up
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Too", LastName: "Many", VisitDate: "2075-01-09"}); w.Code != http.StatusConflict {
+				t.Errorf("Expected the cut day full, got %d: %s", w.Code, w.Body.String())
+			}
+			if _, availability := getAvailability(t, router, "/availability?month=2075-01", ""); slices.Contains(availability.Dates, "2075-01-09") {
+				t.Errorf("Expected the cut day gone from availability, got %v", availability.Dates)
+			}
+
+			// Until it's put back up
+			_, plan = post("/admin/rebalance", `{"visitDate": "2075-01-09", "capacity": 3}`)
+			body, _ = json.Marshal(plan)
+			if w, _ := post("/admin/rebalance/apply", string(body)); w.Code != http.StatusOK || len(plan.Moves) != 0 {
+				t.Fatalf("Expected the cut lifted, got %d: %s", w.Code, w.Body.String())
+			}
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Room", LastName: "Again", VisitDate: "2075-01-09"}); w.Code != http.StatusCreated {
+				t.Errorf("Expected a booking once the cut's lifted, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if w, _ := post("/admin/rebalance/apply", `{"visitDate": "2075-01-09", "capacity": 0, "moves": [{"appointmentId": 1}]}`); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "plan_incomplete") {
+				t.Errorf("Expected a plan with someone left over refused, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRebalanceCommand(t *testing.T) {
+	server, sent := closureServer(t, "sqlite")
+	router := server.routes()
+	for range 3 {
+		if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Short", Email: "dana@example.com", VisitDate: "2075-01-09"}); w.Code != http.StatusCreated {
+			t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+		}
+		sent.next(t)
+	}
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	onDay := func() int {
+		var n int
+		server.db.QueryRow("SELECT COUNT(*) FROM appointments WHERE visit_date = '2075-01-09'").Scan(&n)
+		return n
+	}
+
+	cfg := Config{AdminToken: "secret"}
+	if err := rebalanceCommand(cfg, []string{"2075-01-09", "1", srv.URL, "--dry-run"}); err != nil || onDay() != 3 {
+		t.Fatalf("Expected a dry run to move nobody, got %d on the day (%v)", onDay(), err)
+	}
+	if err := rebalanceCommand(cfg, []string{"2075-01-09", "1", srv.URL}); err != nil || onDay() != 1 {
+		t.Errorf("Expected two moved, got %d on the day (%v)", onDay(), err)
+	}
+	if err := rebalanceCommand(Config{AdminToken: "wrong"}, []string{"--dry-run", "2075-01-09", "1", srv.URL}); err == nil {
+		t.Error("Expected the command to fail without the admin token")
+	}
+}
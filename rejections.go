@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Each booking turned away is logged as a line of JSON after "Booking
+// rejected", for the log search to pick apart, and counted in
+// citynext_booking_rejections_total. There's no name or full IP in it,
+// the client is the network they're on
+type RejectionLog struct {
+	Reason    string `json:"reason"` // the error code they got
+	Status    int    `json:"status"`
+	Route     string `json:"route"`
+	VisitDate string `json:"visitDate,omitempty"` // the day they asked for, as they sent it
+	Channel   string `json:"channel"`
+	Client    string `json:"client"` // 203.0.113.0/24, or a /48 for IPv6
+}
+
+// Long enough for any date, a visit date longer than this is cut short
+const maxLoggedVisitDate = 32
+
+type requestedDateKey struct{}
+
+// What the form asked for, so a rejection anywhere after can say
+func withRequestedDate(r *http.Request, visitDate string) *http.Request {
+	if len(visitDate) > maxLoggedVisitDate {
+		visitDate = visitDate[:maxLoggedVisitDate]
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestedDateKey{}, visitDate))
+}
+
+func requestedDate(ctx context.Context) string {
+	visitDate, _ := ctx.Value(requestedDateKey{}).(string)
+	return visitDate
+}
+
+// Keeps the network and not who on it
+func anonymizedClient(r *http.Request) string {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return "unknown"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+func (s *Server) logRejection(r *http.Request, statusCode int, reason string) {
+	channel := bookingChannel(r.Context())
+	route := mux.CurrentRoute(r)
+	if route.GetName() == "walk-in" {
+		channel = ChannelWalkIn
+	}
+	s.metrics.inc("citynext_booking_rejections_total", reason, channel)
+	tpl, _ := route.GetPathTemplate()
+	line, _ := json.Marshal(RejectionLog{
+		Reason:    reason,
+		Status:    statusCode,
+		Route:     r.Method + " " + tpl,
+		VisitDate: requestedDate(r.Context()),
+		Channel:   channel,
+		Client:    anonymizedClient(r),
+	})
+	log.Printf("Booking rejected %s", line)
+}
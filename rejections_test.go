@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizedClient(t *testing.T) {
+	for addr, want := range map[string]string{
+		"203.0.113.77:5000":          "203.0.113.0/24",
+		"[2001:db8:1:2::9]:5000":     "2001:db8:1::/48",
+		"@":                          "unknown",
+		"[::ffff:198.51.100.9]:5000": "198.51.100.0/24",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		if got := anonymizedClient(r); got != want {
+			t.Errorf("Expected %s as %s, got %s", addr, want, got)
+		}
+	}
+}
+
+func TestRejectionLogged(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	server, _ := closureServer(t, "sqlite")
+	router := server.routes()
+	// 2075-01-01 is a holiday in the test server
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "New", LastName: "Year", VisitDate: "2075-01-01"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a holiday turned away, got %d: %s", w.Code, w.Body.String())
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments", []byte(`{"firstName": "No", "visitDate": "2075-01-09"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a booking without a last name turned away, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var got []RejectionLog
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, event, ok := strings.Cut(line, "Booking rejected "); ok {
+			var rejection RejectionLog
+			if err := json.Unmarshal([]byte(event), &rejection); err != nil {
+				t.Fatalf("Expected JSON after the message, got %s", line)
+			}
+			got = append(got, rejection)
+		}
+	}
+	want := []RejectionLog{
+		{Reason: "public_holiday", Status: 400, Route: "POST /appointments", VisitDate: "2075-01-01", Channel: "online", Client: "192.0.2.0/24"},
+		{Reason: "missing_fields", Status: 400, Route: "POST /admin/appointments", VisitDate: "2075-01-09", Channel: "staff", Client: "192.0.2.0/24"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d rejections logged, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %+v logged, got %+v", want[i], got[i])
+		}
+	}
+	if strings.Contains(logs.String(), "Year") {
+		t.Errorf("Expected no names in the log, got %s", logs.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`citynext_booking_rejections_total{reason="public_holiday",channel="online"} 1`, `citynext_booking_rejections_total{reason="missing_fields",channel="staff"} 1`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s, got %s", want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Settings that can be changed without a restart, by editing the
+// CITYNEXT_CONFIG_FILE and sending SIGHUP, or POST /admin/config/reload.
+// Bookings in flight carry on, the next request sees the new values.
+// Anything else that's changed is reported as needing a restart
+var reloadable = []string{"AdmissionRate", "BookingOpens", "CORSOrigins", "ChannelQuotas", "CustomFields", "DailyCapacity", "EligibilityRules", "Experiments", "Features", "FollowUpGaps", "LeadDays", "LogLevel", "NameCharacters", "NameMaxLength", "Overbooking", "PriorityClasses", "PrivacyNoticeURL", "PrivacyNoticeVersion", "PriorityVerified", "RateLimitPerMinute", "ReservedCapacity", "SlowQueryThreshold"}
+
+type ConfigReload struct {
+	XMLName      xml.Name `json:"-" xml:"configReload"`
+	Changed      []string `json:"changed" xml:"changed>setting"`
+	NeedsRestart []string `json:"needsRestart" xml:"needsRestart>setting"`
+}
+
+// The config as it stands, for anything reading a reloadable setting.
+// The maps and slices in it are replaced on reload, never changed
+func (s *Server) live() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
+
+func (s *Server) reloadConfig(ctx context.Context) (ConfigReload, error) {
+	if err := readConfigFile(os.Getenv("CITYNEXT_CONFIG_FILE")); err != nil {
+		return ConfigReload{}, err
+	}
+	if err := readVaultSecrets(ctx); err != nil {
+		return ConfigReload{}, err
+	}
+	next := loadConfig()
+	reload := ConfigReload{Changed: []string{}, NeedsRestart: []string{}}
+
+	s.cfgMu.Lock()
+	current, updated := reflect.ValueOf(&s.cfg).Elem(), reflect.ValueOf(next)
+	for i := range current.NumField() {
+		name := current.Type().Field(i).Name
+		if reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			continue
+		}
+		if slices.Contains(reloadable, name) {
+			current.Field(i).Set(updated.Field(i))
+			reload.Changed = append(reload.Changed, name)
+		} else {
+			reload.NeedsRestart = append(reload.NeedsRestart, name)
+		}
+	}
+	s.cfgMu.Unlock()
+
+	if slices.Contains(reload.Changed, "DailyCapacity") || slices.Contains(reload.Changed, "Overbooking") || slices.Contains(reload.Changed, "ReservedCapacity") || slices.Contains(reload.Changed, "ChannelQuotas") {
+		s.invalidateAvailability(ctx)
+	}
+	log.Printf("Reloaded config, changed: %s; needs a restart: %s", listOrNone(reload.Changed), listOrNone(reload.NeedsRestart))
+	return reload, nil
+}
+
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// Reload on every SIGHUP until the channel's closed
+func (s *Server) reloadOnSignal(signals <-chan os.Signal) {
+	for range signals {
+		if _, err := s.reloadConfig(context.Background()); err != nil {
+			log.Printf("Error reloading config, keeping the old one: %v", err)
+		}
+	}
+}
+
+// POST /admin/config/reload, the same as a SIGHUP
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	reload, err := s.reloadConfig(r.Context())
+	if err != nil {
+		log.Printf("Error reloading config: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeReloadFailed, "Failed to read the config file, the old config is still in use")
+		return
+	}
+	s.respond(w, r, http.StatusOK, reload)
+}
+
+// Only when CITYNEXT_LOG_LEVEL=debug
+func (s *Server) debugf(format string, args ...any) {
+	if s.live().LogLevel == "debug" {
+		log.Printf(format, args...)
+	}
+}
+
+// Any origin by default, or just the listed ones
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origins := s.live().CORSOrigins
+		if len(origins) == 0 || slices.Contains(origins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			if origin := r.Header.Get("Origin"); slices.Contains(origins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Client-Id")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Experiments")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "citynext.env")
+	os.WriteFile(path, []byte("# staging\nCITYNEXT_DAILY_CAPACITY=4\nCITYNEXT_ADMIN_TOKEN=secret\n"), 0o644)
+	t.Setenv("CITYNEXT_CONFIG_FILE", path)
+	t.Setenv("CITYNEXT_DAILY_CAPACITY", "2") // the file wins
+	t.Cleanup(func() { readConfigFile("") })
+
+	if err := readConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	server := setupTestServer(t)
+	server.cfg = loadConfig()
+	router := server.routes()
+	if server.dailyCapacity() != 4 {
+		t.Fatalf("Expected the file's capacity, got %d", server.dailyCapacity())
+	}
+
+	os.WriteFile(path, []byte("CITYNEXT_DAILY_CAPACITY=8\nCITYNEXT_ADMIN_TOKEN=secret\nCITYNEXT_CORS_ORIGINS=https://book.citynext.example\nCITYNEXT_DB_PATH=/elsewhere.db\n"), 0o644)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/config/reload", nil))
+	var reload ConfigReload
+	json.Unmarshal(w.Body.Bytes(), &reload)
+	if w.Code != http.StatusOK || !slices.Equal(reload.Changed, []string{"DailyCapacity", "CORSOrigins"}) || !slices.Equal(reload.NeedsRestart, []string{"DBPath"}) {
+		t.Fatalf("Expected capacity and CORS reloaded and the database left, got %d: %s", w.Code, w.Body.String())
+	}
+	if server.dailyCapacity() != 8 || server.cfg.DBPath == "/elsewhere.db" {
+		t.Errorf("Expected capacity 8 on the old database, got %d on %s", server.dailyCapacity(), server.cfg.DBPath)
+	}
+
+	req := httptest.NewRequest("GET", "/holidays", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected no CORS header for another site, got %q", got)
+	}
+	req.Header.Set("Origin", "https://book.citynext.example")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://book.citynext.example" {
+		t.Errorf("Expected the booking site allowed, got %q", got)
+	}
+
+	// A broken file leaves everything as it was
+	os.WriteFile(path, []byte("CITYNEXT_DAILY_CAPACITY\n"), 0o644)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/config/reload", nil))
+	if w.Code != http.StatusInternalServerError || server.dailyCapacity() != 8 {
+		t.Errorf("Expected a 500 and the old capacity, got %d with %d", w.Code, server.dailyCapacity())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// With CITYNEXT_REMINDER_DAYS set, everyone booked from tomorrow to that
+// many days ahead gets the reminder message, once for each visit date.
+// Checked hourly, or on CITYNEXT_REMINDERS_SCHEDULE, "0 8 * * *" say. The
+// reminders table remembers who's had one, so a rescheduled booking is
+// reminded again for its new date and the other replicas don't send it
+// twice
+func (s *Server) initRemindersTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS reminders (
+		appointment_id INTEGER NOT NULL,
+		visit_date TEXT NOT NULL,
+		sent_at DATETIME NOT NULL,
+		PRIMARY KEY (appointment_id, visit_date)
+	)`)
+	return err
+}
+
+func (s *Server) scheduleReminders(schedule jobSchedule, stop <-chan struct{}) {
+	s.every("reminders", schedule, stop, func(ctx context.Context) (int, error) {
+		today, err := s.today()
+		if err != nil {
+			return 0, err
+		}
+		return s.sendReminders(ctx, today, false)
+	})
+}
+
+// Reminds everyone due who hasn't been, and says how many. Nobody who's
+// checked in already, and nobody without an email address. A dry run logs
+// each one that would go instead, see send-reminders in commands.go. That
+// doesn't make the table, so before the first run everyone due counts
+func (s *Server) sendReminders(ctx context.Context, today time.Time, dryRun bool) (int, error) {
+	from, to := today.AddDate(0, 0, 1).Format("2006-01-02"), today.AddDate(0, 0, s.cfg.ReminderDays).Format("2006-01-02")
+	appointments, err := s.store.List(ctx, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	tableMade := true
+	if dryRun {
+		var n int
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'reminders'").Scan(&n); err != nil {
+			return 0, err
+		}
+		tableMade = n > 0
+	}
+
+	sent := 0
+	for _, a := range appointments {
+		if a.VisitDate < from || a.VisitDate > to || a.CheckedInAt != nil || a.Email == "" {
+			continue
+		}
+		if dryRun {
+			var n int
+			if tableMade {
+				if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reminders WHERE appointment_id = ? AND visit_date = ?", a.ID, a.VisitDate).Scan(&n); err != nil {
+					return sent, err
+				}
+			}
+			if n == 0 {
+				log.Printf("Dry run: would remind appointment %d of their visit on %s", a.ID, a.VisitDate)
+				sent++
+			}
+			continue
+		}
+
+		claimed, err := s.db.ExecContext(ctx, "INSERT INTO reminders (appointment_id, visit_date, sent_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+			a.ID, a.VisitDate, time.Now().UTC())
+		if err != nil {
+			return sent, err
+		}
+		if n, _ := claimed.RowsAffected(); n == 0 {
+			continue
+		}
+		s.notifyAppointment(ctx, MessageReminder, a)
+		sent++
+	}
+	if dryRun {
+		log.Printf("Dry run: %d reminders for visits up to %s would be sent", sent, to)
+	} else if sent > 0 {
+		log.Printf("Sent %d reminders for visits up to %s", sent, to)
+	}
+	return sent, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReminders(t *testing.T) {
+	server, sent := closureServer(t, "sqlite")
+	server.cfg.ReminderDays = 2
+	router := server.routes()
+
+	for _, req := range []AppointmentRequest{
+		{FirstName: "Ann", LastName: "Soon", Email: "a@example.com", VisitDate: "2075-01-03"},
+		{FirstName: "Bea", LastName: "Later", Email: "b@example.com", VisitDate: "2075-01-09"},
+		{FirstName: "Cai", LastName: "Posted", VisitDate: "2075-01-03"}, // no email to remind
+	} {
+		if w := postAppointment(t, router, req); w.Code != http.StatusCreated {
+			t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	for range 2 {
+		sent.next(t) // the confirmations
+	}
+	today := time.Date(2075, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	// Counted but not sent
+	if n, err := server.sendReminders(ctx, today, true); err != nil || n != 1 {
+		t.Fatalf("Expected one reminder in the dry run, got %d, %v", n, err)
+	}
+	select {
+	case msg := <-sent:
+		t.Fatalf("Expected nothing sent on a dry run, got %+v", msg)
+	default:
+	}
+
+	if n, err := server.sendReminders(ctx, today, false); err != nil || n != 1 {
+		t.Fatalf("Expected one reminder, got %d, %v", n, err)
+	}
+	if msg := sent.next(t); msg.To != "a@example.com" || msg.Subject != "Reminder: your appointment on 2075-01-03" {
+		t.Errorf("Expected Ann reminded, got %+v", msg)
+	}
+	// Once, however many times it runs
+	if n, _ := server.sendReminders(ctx, today, false); n != 0 {
+		t.Errorf("Expected nobody reminded twice, got %d", n)
+	}
+	if n, _ := server.sendReminders(ctx, today, true); n != 0 {
+		t.Errorf("Expected the dry run to leave out who's been reminded, got %d", n)
+	}
+
+	// And again for a new date
+	if n, _ := server.sendReminders(ctx, today.AddDate(0, 0, 7), false); n != 1 {
+		t.Errorf("Expected Bea reminded a week on, got %d", n)
+	}
+	if msg := sent.next(t); msg.To != "b@example.com" {
+		t.Errorf("Expected Bea reminded, got %+v", msg)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSON unless the client would rather have XML. One of the council's
+// older systems only reads XML, everyone else gets what they always did
+const (
+	formatJSON = "application/json"
+	formatXML  = "application/xml"
+)
+
+// Picks from the Accept header by q value, JSON wins ties and anything unknown
+func negotiateFormat(accept string) string {
+	var jsonQ, xmlQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		case "application/xml", "text/xml":
+			xmlQ = max(xmlQ, q)
+		}
+	}
+
+	if xmlQ > jsonQ {
+		return formatXML
+	}
+	return formatJSON
+}
+
+func encodeAs(format string, v any) ([]byte, error) {
+	if format == formatXML {
+		b, err := xml.Marshal(v)
+		return append([]byte(xml.Header), b...), err
+	}
+	b, err := json.Marshal(v)
+	return append(b, '\n'), err
+}
+
+// Every response body goes through here
+func (s *Server) respond(w http.ResponseWriter, r *http.Request, status int, v any) {
+	format := negotiateFormat(r.Header.Get("Accept"))
+	body, err := encodeAs(format, v)
+	if err != nil {
+		log.Printf("Error encoding %s response: %v", format, err)
+		format, status = formatJSON, http.StatusInternalServerError
+		body, _ = encodeAs(format, ErrorResponse{Error: CodeEncodingError, Message: "Failed to encode response"})
+	}
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", format)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := map[string]string{
+		"":                                  formatJSON,
+		"*/*":                               formatJSON,
+		"application/xml":                   formatXML,
+		"text/xml":                          formatXML,
+		"application/json, application/xml": formatJSON,
+		"application/json;q=0.5, text/xml":  formatXML,
+		"text/html":                         formatJSON,
+	}
+	for accept, want := range cases {
+		if got := negotiateFormat(accept); got != want {
+			t.Errorf("negotiateFormat(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestXMLResponses(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+
+	post := func(req AppointmentRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r := httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+		r.Header.Set("Accept", "application/xml")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post(AppointmentRequest{FirstName: "Lena", LastName: "Legacy", VisitDate: "2075-06-16"})
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != formatXML {
+		t.Fatalf("Expected a 201 in XML, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var appointment Appointment
+	if err := xml.Unmarshal(w.Body.Bytes(), &appointment); err != nil || appointment.LastName != "Legacy" {
+		t.Errorf("Expected the appointment as XML, got %q (%v)", w.Body.String(), err)
+	}
+
+	// Errors too
+	w = post(AppointmentRequest{FirstName: "Lena", LastName: "Legacy", VisitDate: "2075-06-16"})
+	var errResp ErrorResponse
+	if err := xml.Unmarshal(w.Body.Bytes(), &errResp); err != nil || errResp.Error != "duplicate_appointment" {
+		t.Errorf("Expected the error as XML, got %q (%v)", w.Body.String(), err)
+	}
+
+	// And availability
+	r := httptest.NewRequest("GET", "/availability?month=2075-12", nil)
+	r.Header.Set("Accept", "text/xml")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "<date>2075-12-24</date>") {
+		t.Errorf("Expected availability as XML, got %q", w.Body.String())
+	}
+}
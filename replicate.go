@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Continuous replication, Litestream-ish. Rather than shipping individual
+// WAL frames we ship a fresh snapshot a few seconds after every change,
+// which for a database this size is cheap and means a rebuilt host loses
+// at most one interval of bookings. Where it goes is up to the Replicator
+type Replicator interface {
+	// Store the snapshot file as the latest replica
+	Replicate(ctx context.Context, snapshot string) error
+	// Write the latest replica to dest
+	Fetch(ctx context.Context, dest string) error
+}
+
+// Replica kept in a directory, typically a mounted volume on another host
+type dirReplicator struct {
+	dir string
+}
+
+func (d dirReplicator) latest() string {
+	return filepath.Join(d.dir, "appointments.db")
+}
+
+func (d dirReplicator) Replicate(ctx context.Context, snapshot string) error {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return err
+	}
+	// Rename into place so a reader never sees half a file
+	tmp := d.latest() + ".tmp"
+	if err := copyFile(snapshot, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.latest())
+}
+
+func (d dirReplicator) Fetch(ctx context.Context, dest string) error {
+	return copyFile(d.latest(), dest)
+}
+
+// Replica kept in the S3 bucket
+type s3Replicator struct {
+	client *S3Client
+	key    string
+}
+
+func (r s3Replicator) Replicate(ctx context.Context, snapshot string) error {
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.client.PutObject(ctx, r.key, f, "application/vnd.sqlite3")
+}
+
+func (r s3Replicator) Fetch(ctx context.Context, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if err := r.client.GetObject(ctx, r.key, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// A directory wins over the bucket, nil if neither is configured
+func newReplicator(cfg Config) Replicator {
+	if cfg.ReplicaDir != "" {
+		return dirReplicator{dir: cfg.ReplicaDir}
+	}
+	if cfg.S3.Enabled() {
+		return s3Replicator{client: NewS3Client(cfg.S3), key: "replica/appointments.db"}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Size and modification time of the db and its journal, which is all
+// we need to notice that something was written since the last run
+type dbFileState struct {
+	size    int64
+	modTime time.Time
+	walSize int64
+	walMod  time.Time
+}
+
+func statDBFiles(dbPath string) dbFileState {
+	var st dbFileState
+	if info, err := os.Stat(dbPath); err == nil {
+		st.size, st.modTime = info.Size(), info.ModTime()
+	}
+	if info, err := os.Stat(dbPath + "-wal"); err == nil {
+		st.walSize, st.walMod = info.Size(), info.ModTime()
+	}
+	return st
+}
+
+// Snapshot and ship if the db changed since last time
+func (s *Server) replicateIfChanged(ctx context.Context, replicator Replicator, last *dbFileState) error {
+	current := statDBFiles(s.cfg.DBPath)
+	if current == *last {
+		return nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "citynext-replica")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshot := filepath.Join(tmpDir, "snapshot.db")
+	if err := backupDatabase(ctx, s.db, snapshot); err != nil {
+		return err
+	}
+	if err := replicator.Replicate(ctx, snapshot); err != nil {
+		return fmt.Errorf("failed to ship replica: %w", err)
+	}
+
+	*last = current
+	return nil
+}
+
+func (s *Server) replicate(replicator Replicator, schedule jobSchedule, stop <-chan struct{}) {
+	var last dbFileState
+	s.every("replication", schedule, stop, func(ctx context.Context) (int, error) {
+		before := last
+		if err := s.replicateIfChanged(ctx, replicator, &last); err != nil || last == before {
+			return 0, err
+		}
+		return 1, nil
+	})
+}
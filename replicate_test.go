@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicateOnlyWhenChanged(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "appointments.db")
+	db, err := openDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	server := NewServer(db)
+	server.cfg.DBPath = dbPath
+	if err := server.initDB(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.store.Create(context.Background(), AppointmentRequest{FirstName: "Dana", LastName: "Valid", PreferredLanguage: DefaultLanguage}, time.Date(2075, 6, 15, 0, 0, 0, 0, time.UTC), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	replicator := dirReplicator{dir: filepath.Join(dir, "replica")}
+	var last dbFileState
+	if err := server.replicateIfChanged(context.Background(), replicator, &last); err != nil {
+		t.Fatalf("Failed to replicate: %v", err)
+	}
+
+	// Rebuild from the replica and check the booking survived
+	recovered := filepath.Join(dir, "recovered.db")
+	if err := replicator.Fetch(context.Background(), recovered); err != nil {
+		t.Fatalf("Failed to fetch replica: %v", err)
+	}
+	check, _ := sql.Open(sqliteDriver, sqliteDSN(recovered, "ro"))
+	defer check.Close()
+	var count int
+	check.QueryRow("SELECT COUNT(*) FROM appointments").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 appointment in replica, got %d", count)
+	}
+
+	// Nothing written since, so nothing should be shipped
+	os.Remove(replicator.latest())
+	if err := server.replicateIfChanged(context.Background(), replicator, &last); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(replicator.latest()); !os.IsNotExist(err) {
+		t.Error("Expected no replication without changes")
+	}
+}
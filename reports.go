@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How many weeks back the forecast looks, at the same weekday
+const forecastWeeks = 4
+
+type CapacityDay struct {
+	XMLName     xml.Name `json:"-" xml:"day"`
+	Date        string   `json:"date" xml:"date,attr"`
+	Closed      bool     `json:"closed,omitempty" xml:"closed,attr,omitempty"` // a public holiday
+	Capacity    int      `json:"capacity" xml:"capacity"`                      // overbooking included
+	Booked      int      `json:"booked" xml:"booked"`
+	Utilization float64  `json:"utilization" xml:"utilization"`               // percent of capacity booked
+	Forecast    float64  `json:"forecast,omitempty" xml:"forecast,omitempty"` // people expected, from today on
+	SellsOut    bool     `json:"sellsOut,omitempty" xml:"sellsOut,omitempty"` // full already, or forecast to be
+}
+
+type CapacityWeek struct {
+	XMLName     xml.Name `json:"-" xml:"week"`
+	Week        string   `json:"week" xml:"week,attr"` // ISO week, e.g. 2075-W25
+	Capacity    int      `json:"capacity" xml:"capacity"`
+	Booked      int      `json:"booked" xml:"booked"`
+	Utilization float64  `json:"utilization" xml:"utilization"`
+}
+
+type CapacityReport struct {
+	XMLName  xml.Name       `json:"-" xml:"capacityReport"`
+	From     string         `json:"from" xml:"from,attr"`
+	To       string         `json:"to" xml:"to,attr"`
+	Days     []CapacityDay  `json:"days" xml:"days>day"`
+	Weeks    []CapacityWeek `json:"weeks" xml:"weeks>week"`
+	SellOuts []string       `json:"sellOuts" xml:"sellOuts>date"` // days to staff up for
+}
+
+// One decimal place is plenty for a percentage
+func percentOf(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return math.Round(float64(n)*1000/float64(of)) / 10
+}
+
+// GET /admin/reports/capacity, how full each day and week is from ?from
+// to ?to (today and four weeks on by default), and which days look like
+// they'll sell out. A day's forecast is the average booked on the same
+// weekday over the four weeks before today, or what's booked already if
+// that's more. Holidays are left out of both
+func (s *Server) getCapacityReport(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	from, to := today, today.AddDate(0, 0, 27)
+	for param, date := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(param); v != "" {
+			d, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidDate, param+" must be in YYYY-MM-DD format")
+				return
+			}
+			*date = d
+		}
+	}
+	if to.Before(from) || to.Sub(from) > 366*24*time.Hour {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidRange, "to must be after from, and no more than a year on")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	history := today.AddDate(0, 0, -7*forecastWeeks)
+	start := from
+	if history.Before(start) {
+		start = history
+	}
+	attendance, err := s.store.Attendance(ctx, start, to)
+	if err != nil {
+		log.Printf("Error loading attendance: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load attendance")
+		return
+	}
+
+	// Trailing averages by weekday, over the days that were open
+	holidays := s.holidaySet(ctx)
+	var trailing [7]struct{ booked, days int }
+	for d := history; d.Before(today); d = d.AddDate(0, 0, 1) {
+		if !holidays.closed(d) {
+			trailing[d.Weekday()].booked += attendance[d.Format("2006-01-02")]
+			trailing[d.Weekday()].days++
+		}
+	}
+
+	report := CapacityReport{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Days: []CapacityDay{}, Weeks: []CapacityWeek{}, SellOuts: []string{}}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		day := CapacityDay{Date: d.Format("2006-01-02"), Booked: attendance[d.Format("2006-01-02")]}
+		if holidays.closed(d) {
+			day.Closed = true
+			report.Days = append(report.Days, day)
+			continue
+		}
+		day.Capacity = s.capacityOn(d)
+		day.Utilization = percentOf(day.Booked, day.Capacity)
+		if !d.Before(today) {
+			if t := trailing[d.Weekday()]; t.days > 0 {
+				day.Forecast = math.Round(float64(t.booked)*10/float64(t.days)) / 10
+			}
+			day.Forecast = max(day.Forecast, float64(day.Booked))
+			if day.SellsOut = day.Forecast >= float64(day.Capacity); day.SellsOut {
+				report.SellOuts = append(report.SellOuts, day.Date)
+			}
+		}
+		report.Days = append(report.Days, day)
+
+		year, week := d.ISOWeek()
+		label := fmt.Sprintf("%d-W%02d", year, week)
+		if n := len(report.Weeks); n == 0 || report.Weeks[n-1].Week != label {
+			report.Weeks = append(report.Weeks, CapacityWeek{Week: label})
+		}
+		current := &report.Weeks[len(report.Weeks)-1]
+		current.Capacity += day.Capacity
+		current.Booked += day.Booked
+		current.Utilization = percentOf(current.Booked, current.Capacity)
+	}
+	s.respond(w, r, http.StatusOK, report)
+}
+
+// Turned-down bookings are counted by reason, whatever the reason was,
+// for the monthly report. These are the routes that book
+var bookingRoutes = map[string]bool{
+	"book":       true,
+	"book-phone": true,
+	"book-staff": true,
+	"clone":      true,
+	"walk-in":    true,
+}
+
+const topRejections = 5
+
+type RejectionCount struct {
+	XMLName xml.Name `json:"-" xml:"rejection"`
+	Reason  string   `json:"reason" xml:"reason,attr"` // the error code the client got
+	Count   int      `json:"count" xml:"count,attr"`
+}
+
+// Everything is by visit date, so a month's report is about the people
+// who were due in that month, however long ago they booked
+type MonthlyReport struct {
+	XMLName         xml.Name         `json:"-" xml:"monthlyReport"`
+	Month           string           `json:"month" xml:"month,attr"`
+	Bookings        int              `json:"bookings" xml:"bookings"`           // cancelled ones included
+	Cancellations   int              `json:"cancellations" xml:"cancellations"` // the ones that were then cancelled
+	NoShows         int              `json:"noShows" xml:"noShows"`             // days gone by without a check in
+	AverageLeadDays float64          `json:"averageLeadDays" xml:"averageLeadDays"`
+	TopRejections   []RejectionCount `json:"topRejections" xml:"topRejections>rejection"` // most common first
+}
+
+func (s *Server) initReportTables() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS booking_rejections (
+		day TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (day, reason)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Which months have been sent, so only one instance sends each. A
+	// month is claimed with sent 0 and only marked sent once it's gone,
+	// rows from before that were all sent
+	_, err = s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS monthly_reports (
+		month TEXT PRIMARY KEY,
+		sent_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(s.db, "monthly_reports", "sent", "INTEGER NOT NULL DEFAULT 1")
+}
+
+// Rejections are added up here and written every few seconds, so a flood
+// of 429s isn't a flood of writes too
+const rejectionFlushInterval = 5 * time.Second
+
+type rejectionCounts struct {
+	mu     sync.Mutex
+	counts map[[2]string]int // by day and reason
+}
+
+func newRejectionCounts() *rejectionCounts {
+	return &rejectionCounts{counts: map[[2]string]int{}}
+}
+
+func (c *rejectionCounts) add(day, reason string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[[2]string{day, reason}] += n
+}
+
+func (c *rejectionCounts) take() map[[2]string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.counts
+	c.counts = map[[2]string]int{}
+	return counts
+}
+
+// Writes out what's been counted since last time, in one transaction.
+// If it fails they're kept for the next go
+func (s *Server) flushRejections(ctx context.Context) error {
+	counts := s.rejections.take()
+	if len(counts) == 0 {
+		return nil
+	}
+	err := func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for key, n := range counts {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO booking_rejections (day, reason, count) VALUES (?, ?, ?)
+				ON CONFLICT (day, reason) DO UPDATE SET count = count + excluded.count`,
+				key[0], key[1], n)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		for key, n := range counts {
+			s.rejections.add(key[0], key[1], n)
+		}
+	}
+	return err
+}
+
+// Flushes the counts every interval, and once more when stopped
+func (s *Server) writeRejections(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			if err := s.flushRejections(context.Background()); err != nil {
+				log.Printf("Error counting rejections: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.flushRejections(context.Background()); err != nil {
+				log.Printf("Error counting rejections, will try again: %v", err)
+			}
+		}
+	}
+}
+
+// Called for every error response, counts the 4xx ones on booking routes
+func (s *Server) countRejection(r *http.Request, statusCode int, reason string) {
+	if statusCode < 400 || statusCode >= 500 {
+		return
+	}
+	if route := mux.CurrentRoute(r); route == nil || !bookingRoutes[route.GetName()] {
+		return
+	}
+	s.trackRejected(r, statusCode, reason)
+	s.logRejection(r, statusCode, reason)
+	if s.db == nil {
+		return
+	}
+	today, err := s.today()
+	if err != nil {
+		return
+	}
+	s.rejections.add(today.Format("2006-01-02"), reason, 1)
+}
+
+func (s *Server) rejectionsIn(ctx context.Context, month time.Time) ([]RejectionCount, error) {
+	counts := []RejectionCount{}
+	if s.db == nil {
+		return counts, nil
+	}
+	// Up to date here at least, other replicas write theirs on their tick
+	if err := s.flushRejections(ctx); err != nil {
+		log.Printf("Error counting rejections: %v", err)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT reason, SUM(count) FROM booking_rejections WHERE day BETWEEN ? AND ?
+		GROUP BY reason ORDER BY SUM(count) DESC, reason LIMIT ?`,
+		month.Format("2006-01-02"), month.AddDate(0, 1, -1).Format("2006-01-02"), topRejections)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c RejectionCount
+		if err := rows.Scan(&c.Reason, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// From every revision there's been. Only the server's year is real, so
+// when they booked is taken as that day of the month in the server year,
+// the same as today is
+func monthlyReport(month, today time.Time, revisions []Revision) MonthlyReport {
+	report := MonthlyReport{Month: month.Format("2006-01"), TopRejections: []RejectionCount{}}
+
+	first := map[int]Revision{}
+	last := map[int]Revision{}
+	for _, rev := range revisions {
+		if _, ok := first[rev.ID]; !ok {
+			first[rev.ID] = rev
+		}
+		last[rev.ID] = rev
+	}
+
+	var leadDays int
+	for id, rev := range last {
+		visitDate, err := time.Parse("2006-01-02", rev.VisitDate)
+		if err != nil || visitDate.Year() != month.Year() || visitDate.Month() != month.Month() {
+			continue
+		}
+		report.Bookings++
+		switch {
+		case rev.Change == RevisionCancelled:
+			report.Cancellations++
+		case visitDate.Before(today) && rev.CheckedInAt == nil:
+			report.NoShows++
+		}
+
+		created := first[id].ChangedAt
+		booked := time.Date(visitDate.Year(), created.Month(), created.Day(), 0, 0, 0, 0, time.UTC)
+		if firstVisit, err := time.Parse("2006-01-02", first[id].VisitDate); err == nil && booked.Before(firstVisit) {
+			leadDays += int(firstVisit.Sub(booked).Hours() / 24)
+		}
+	}
+	if report.Bookings > 0 {
+		report.AverageLeadDays = math.Round(float64(leadDays)*10/float64(report.Bookings)) / 10
+	}
+	return report
+}
+
+func (s *Server) buildMonthlyReport(ctx context.Context, month time.Time) (MonthlyReport, error) {
+	today, err := s.today()
+	if err != nil {
+		return MonthlyReport{}, err
+	}
+	revisions, err := s.store.Revisions(ctx)
+	if err != nil {
+		return MonthlyReport{}, fmt.Errorf("failed to load revisions: %w", err)
+	}
+	report := monthlyReport(month, today, revisions)
+	if report.TopRejections, err = s.rejectionsIn(ctx, month); err != nil {
+		return MonthlyReport{}, fmt.Errorf("failed to load rejections: %w", err)
+	}
+	return report, nil
+}
+
+// Two columns, a figure on each row and then the rejections
+func (report MonthlyReport) CSV() string {
+	var b strings.Builder
+	cw := csv.NewWriter(&b)
+	cw.Write([]string{"metric", "value"})
+	cw.Write([]string{"month", report.Month})
+	cw.Write([]string{"bookings", strconv.Itoa(report.Bookings)})
+	cw.Write([]string{"cancellations", strconv.Itoa(report.Cancellations)})
+	cw.Write([]string{"no_shows", strconv.Itoa(report.NoShows)})
+	cw.Write([]string{"average_lead_days", strconv.FormatFloat(report.AverageLeadDays, 'f', 1, 64)})
+	for _, c := range report.TopRejections {
+		cw.Write([]string{"rejected:" + c.Reason, strconv.Itoa(c.Count)})
+	}
+	cw.Flush()
+	return b.String()
+}
+
+// GET /admin/reports/monthly?month=2075-05, last month by default.
+// Add ?format=csv for a spreadsheet
+func (s *Server) getMonthlyReport(w http.ResponseWriter, r *http.Request) {
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+	month := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	if v := r.URL.Query().Get("month"); v != "" {
+		if month, err = time.Parse("2006-01", v); err != nil {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidMonth, "Month must be in YYYY-MM format")
+			return
+		}
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidFormat, "Report format must be 'json' or 'csv'")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	report, err := s.buildMonthlyReport(ctx, month)
+	if err != nil {
+		log.Printf("Error building monthly report: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to build the report")
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="report-`+report.Month+`.csv"`)
+		io.WriteString(w, report.CSV())
+		return
+	}
+	s.respond(w, r, http.StatusOK, report)
+}
+
+// Once a month has gone, its report goes to CITYNEXT_MONTHLY_REPORT_TO.
+// Checked on the schedule, and the first instance to claim the month in
+// the database sends it
+func (s *Server) scheduleMonthlyReports(schedule jobSchedule, stop <-chan struct{}) {
+	s.every("monthly-report", schedule, stop, s.sendMonthlyReport)
+}
+
+// A claim that's been sitting this long without being marked sent is
+// from an instance that died sending it, and the month is up for grabs
+const monthlyReportClaimTTL = time.Hour
+
+// How many it went to, none if another instance or an earlier run has
+// sent it already. The month's only marked sent once the report's gone,
+// and if it can't be built the claim's let go for the next run. Anyone
+// it couldn't be sent to is retried with the other deliveries
+func (s *Server) sendMonthlyReport(ctx context.Context) (int, error) {
+	today, err := s.today()
+	if err != nil {
+		return 0, err
+	}
+	month := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	key := month.Format("2006-01")
+
+	now := time.Now().UTC()
+	claimed, err := s.db.ExecContext(ctx, `
+		INSERT INTO monthly_reports (month, sent_at, sent) VALUES (?, ?, 0)
+		ON CONFLICT (month) DO UPDATE SET sent_at = excluded.sent_at
+		WHERE monthly_reports.sent = 0 AND monthly_reports.sent_at < ?`,
+		key, now, now.Add(-monthlyReportClaimTTL))
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := claimed.RowsAffected(); n == 0 {
+		return 0, nil
+	}
+
+	report, err := s.buildMonthlyReport(ctx, month)
+	if err != nil {
+		if _, err := s.db.ExecContext(context.WithoutCancel(ctx), "DELETE FROM monthly_reports WHERE month = ? AND sent = 0", key); err != nil {
+			log.Printf("Error letting go of the %s report: %v", key, err)
+		}
+		return 0, err
+	}
+	text := report.CSV()
+	for _, to := range s.cfg.MonthlyReportTo {
+		s.deliver(ctx, ChannelEmail, Message{
+			To:      to,
+			Subject: "Appointments report for " + report.Month,
+			Text:    text,
+			HTML:    "<pre>" + html.EscapeString(text) + "</pre>",
+		})
+	}
+	if _, err := s.db.ExecContext(context.WithoutCancel(ctx), "UPDATE monthly_reports SET sent = 1, sent_at = ? WHERE month = ?", time.Now().UTC(), key); err != nil {
+		return len(s.cfg.MonthlyReportTo), err
+	}
+	log.Printf("Sent the %s report to %d recipients", report.Month, len(s.cfg.MonthlyReportTo))
+	return len(s.cfg.MonthlyReportTo), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapacityReport(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 2
+	today := time.Date(2075, 6, 17, 0, 0, 0, 0, time.UTC) // a Monday
+	server.todayOverride = &today
+	router := server.routes()
+
+	// The last four Mondays were full, bar the bank holiday
+	for date, people := range map[string]int{"2075-05-20": 2, "2075-06-03": 2, "2075-06-10": 2, "2075-06-18": 1} {
+		d, _ := time.Parse("2006-01-02", date)
+		for i := 0; i < people; i++ {
+			if _, err := server.store.Create(context.Background(), AppointmentRequest{FirstName: "Past", LastName: "Visitor"}, d, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/reports/capacity?to=2075-06-24", nil))
+	var report CapacityReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Expected a report, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(report.Days) != 8 {
+		t.Fatalf("Expected eight days, got %d", len(report.Days))
+	}
+
+	if tuesday := report.Days[1]; tuesday.Booked != 1 || tuesday.Utilization != 50 || tuesday.Forecast != 1 || tuesday.SellsOut {
+		t.Errorf("Expected Tuesday half full, got %+v", tuesday)
+	}
+	if len(report.SellOuts) != 2 || report.SellOuts[0] != "2075-06-17" || report.SellOuts[1] != "2075-06-24" {
+		t.Errorf("Expected both Mondays to sell out, got %v", report.SellOuts)
+	}
+	if len(report.Weeks) != 2 || report.Weeks[0].Week != "2075-W25" || report.Weeks[0].Capacity != 14 || report.Weeks[0].Utilization != 7.1 {
+		t.Errorf("Expected a week at 1 of 14, got %+v", report.Weeks)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/reports/capacity?from=2075-07-01&to=2075-06-01", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a backwards range, got %d", w.Code)
+	}
+}
+
+func TestMonthlyReportFigures(t *testing.T) {
+	at := func(date string) time.Time {
+		d, _ := time.Parse("2006-01-02", date)
+		return d.Add(10 * time.Hour)
+	}
+	checkedIn := at("2075-05-11")
+	revisions := []Revision{
+		{Change: RevisionCreated, ChangedAt: at("2026-05-01"), Appointment: Appointment{ID: 1, VisitDate: "2075-05-11"}},
+		{Change: RevisionCheckedIn, ChangedAt: at("2026-05-11"), Appointment: Appointment{ID: 1, VisitDate: "2075-05-11", CheckedInAt: &checkedIn}},
+		{Change: RevisionCreated, ChangedAt: at("2026-05-02"), Appointment: Appointment{ID: 2, VisitDate: "2075-05-12"}},
+		{Change: RevisionCancelled, ChangedAt: at("2026-05-03"), Appointment: Appointment{ID: 2, VisitDate: "2075-05-12"}},
+		{Change: RevisionCreated, ChangedAt: at("2026-05-05"), Appointment: Appointment{ID: 3, VisitDate: "2075-05-15"}},
+		{Change: RevisionCreated, ChangedAt: at("2026-05-05"), Appointment: Appointment{ID: 4, VisitDate: "2075-05-20"}},
+		{Change: RevisionRescheduled, ChangedAt: at("2026-05-06"), Appointment: Appointment{ID: 4, VisitDate: "2075-06-20"}},
+	}
+
+	month, _ := time.Parse("2006-01", "2075-05")
+	report := monthlyReport(month, at("2075-06-01"), revisions)
+	if report.Bookings != 3 || report.Cancellations != 1 || report.NoShows != 1 || report.AverageLeadDays != 10 {
+		t.Errorf("Expected 3 bookings, 1 cancelled, 1 no-show and 10 days' notice, got %+v", report)
+	}
+}
+
+type capturingNotifier struct{ sent *[]Message }
+
+func (c capturingNotifier) Send(ctx context.Context, msg Message) error {
+	*c.sent = append(*c.sent, msg)
+	return nil
+}
+
+func TestMonthlyReport(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	router := server.routes()
+
+	postAppointment(t, router, AppointmentRequest{FirstName: "Bad", LastName: "Date", VisitDate: "16/06/2075"})
+	postAppointment(t, router, AppointmentRequest{FirstName: "Bad", LastName: "Date", VisitDate: "17/06/2075"})
+	postAppointment(t, router, AppointmentRequest{FirstName: "No", LastName: "Date"})
+	// Not a booking, so not a rejection
+	router.ServeHTTP(httptest.NewRecorder(), adminRequest("GET", "/admin/reports/monthly?month=June", nil))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/reports/monthly?month=2075-06", nil))
+	var report MonthlyReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Expected a report, got %d: %s", w.Code, w.Body.String())
+	}
+	want := []RejectionCount{{Reason: "invalid_date", Count: 2}, {Reason: "missing_fields", Count: 1}}
+	if len(report.TopRejections) != 2 || report.TopRejections[0] != want[0] || report.TopRejections[1] != want[1] {
+		t.Errorf("Expected %v, got %v", want, report.TopRejections)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/reports/monthly?month=2075-06&format=csv", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") || !strings.Contains(w.Body.String(), "rejected:invalid_date,2\n") {
+		t.Errorf("Expected CSV with the rejections, got %q: %s", ct, w.Body.String())
+	}
+
+	// Sent once for last month, however many times it's asked
+	var sent []Message
+	server.notifier = capturingNotifier{sent: &sent}
+	server.cfg.MonthlyReportTo = []string{"manager@example.gov", "deputy@example.gov"}
+	for i := 0; i < 2; i++ {
+		if _, err := server.sendMonthlyReport(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 2 || sent[0].Subject != "Appointments report for 2075-05" || !strings.Contains(sent[0].Text, "bookings,0") {
+		t.Errorf("Expected May's report to both managers once, got %+v", sent)
+	}
+}
+
+// A report that can't be built is tried again on the next run rather
+// than lost, and so is a month claimed by an instance that died
+func TestMonthlyReportRetried(t *testing.T) {
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1)
+	today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	var sent []Message
+	server.notifier = capturingNotifier{sent: &sent}
+	server.cfg.MonthlyReportTo = []string{"manager@example.gov"}
+	ctx := context.Background()
+
+	if _, err := server.db.Exec("ALTER TABLE booking_rejections RENAME TO booking_rejections_away"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.sendMonthlyReport(ctx); err == nil {
+		t.Fatal("Expected building the report to fail")
+	}
+	server.db.Exec("ALTER TABLE booking_rejections_away RENAME TO booking_rejections")
+	if n, err := server.sendMonthlyReport(ctx); err != nil || n != 1 || len(sent) != 1 {
+		t.Fatalf("Expected it sent on the next run, got %d to %d (%v)", n, len(sent), err)
+	}
+
+	server.db.Exec("INSERT INTO monthly_reports (month, sent_at, sent) VALUES ('2075-04', ?, 0)", time.Now().Add(-2*monthlyReportClaimTTL).UTC())
+	server.db.Exec("DELETE FROM monthly_reports WHERE month = '2075-05'")
+	server.db.Exec("INSERT INTO monthly_reports (month, sent_at, sent) VALUES ('2075-05', ?, 0)", time.Now().UTC())
+	if n, _ := server.sendMonthlyReport(ctx); n != 0 {
+		t.Errorf("Expected a month being sent elsewhere left alone, got %d", n)
+	}
+	server.db.Exec("UPDATE monthly_reports SET sent_at = ? WHERE month = '2075-05'", time.Now().Add(-2*monthlyReportClaimTTL).UTC())
+	if n, _ := server.sendMonthlyReport(ctx); n != 1 || len(sent) != 2 {
+		t.Errorf("Expected a stale claim taken over, got %d", n)
+	}
+}
+
+func TestRejectionsBatched(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+	for range 3 {
+		postAppointment(t, router, AppointmentRequest{FirstName: "No", LastName: "Date"})
+	}
+
+	var rows, count int
+	server.db.QueryRow("SELECT COUNT(*) FROM booking_rejections").Scan(&rows)
+	if rows != 0 {
+		t.Errorf("Expected nothing written before the flush, got %d rows", rows)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		server.writeRejections(time.Hour, stop)
+		close(done)
+	}()
+	close(stop)
+	<-done
+	server.db.QueryRow("SELECT SUM(count) FROM booking_rejections WHERE reason = 'missing_fields'").Scan(&count)
+	if count != 3 {
+		t.Errorf("Expected the three written together when stopped, got %d", count)
+	}
+}
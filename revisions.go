@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every change to an appointment keeps a full copy of how it looked
+// afterwards, so staff can see when a booking was moved and who did it
+const (
+	RevisionCreated       = "created"
+	RevisionRescheduled   = "rescheduled"
+	RevisionCancelled     = "cancelled"
+	RevisionMerged        = "merged"
+	RevisionCheckedIn     = "checked_in"
+	RevisionTransferred   = "transferred"
+	RevisionConfirmed     = "confirmed"      // they said they're coming, nothing else changes
+	RevisionPersonUpdated = "person_updated" // their details changed, on every booking they have
+)
+
+type Revision struct {
+	XMLName   xml.Name  `json:"-" xml:"revision"`
+	Version   int       `json:"version" xml:"version"`
+	Change    string    `json:"change" xml:"change"`
+	ChangedBy string    `json:"changedBy" xml:"changedBy"`
+	ChangedAt time.Time `json:"changedAt" xml:"changedAt"`
+	Appointment
+}
+
+type History struct {
+	XMLName   xml.Name   `json:"-" xml:"history"`
+	ID        int        `json:"id" xml:"id"`
+	Revisions []Revision `json:"revisions" xml:"revision"`
+}
+
+// GET /appointments/{id}/history, for staff
+func (s *Server) appointmentHistory(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	revisions, err := s.store.History(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading history for appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment history")
+		return
+	}
+
+	s.respond(w, r, http.StatusOK, History{ID: id, Revisions: revisions})
+}
+
+// POST /admin/appointments/{id}/reschedule with {"visitDate": "2075-06-20"}
+// moves a booking, under the same rules as booking it in the first place
+func (s *Server) rescheduleAppointment(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	var req struct {
+		VisitDate string `json:"visitDate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	visitDate, ok := s.validateVisitDate(w, r, req.VisitDate, today)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	// Still in step with the visits it follows and that follow it
+	before, err := s.store.Get(ctx, id)
+	if err == nil && !s.checkChainGaps(ctx, w, r, before, before.Service, visitDate) {
+		return
+	}
+
+	priority, err := s.appointmentPriority(ctx, id)
+	if err != nil {
+		log.Printf("Error checking appointment %d's priority: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to reschedule appointment")
+		return
+	}
+
+	capacity, err := s.capacityOnChannel(ctx, visitDate, s.capacityFor(visitDate, priority), channelOrOnline(before.Channel))
+	if err != nil {
+		log.Printf("Error checking channel quotas: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to reschedule appointment")
+		return
+	}
+
+	appointment, err := s.store.Reschedule(ctx, id, visitDate, capacity)
+	switch {
+	case errors.Is(err, ErrAppointmentNotFound):
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	case errors.Is(err, ErrDuplicateAppointment):
+		s.sendFullyBooked(w, r)
+		return
+	case errors.Is(err, ErrDayClosed):
+		s.sendDayClosed(w, r)
+		return
+	case err != nil:
+		log.Printf("Error rescheduling appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to reschedule appointment")
+		return
+	}
+
+	// Both the old and the new day have changed
+	s.invalidateAvailability(ctx)
+	s.noteOverbooking(ctx, appointment, visitDate, RevisionRescheduled)
+	s.respond(w, r, http.StatusOK, appointment)
+
+	// A fresh confirmation with the new date
+	go func() {
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+		defer cancel()
+		s.notifyAppointment(ctx, MessageConfirmation, appointment)
+	}()
+}
+
+// POST /admin/appointments/{id}/cancel
+func (s *Server) cancelAppointment(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	appointment, err := s.store.Cancel(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to cancel appointment")
+		return
+	}
+
+	s.invalidateAvailability(ctx)
+	s.respond(w, r, http.StatusOK, appointment)
+
+	go func() {
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+		defer cancel()
+		s.notifyAppointment(ctx, MessageCancellation, appointment)
+	}()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func adminRequest(method, url string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, url, bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	return r
+}
+
+func TestRescheduleHistory(t *testing.T) {
+	for name, server := range map[string]*Server{"sqlite": setupTestServer(t), "memory": setupTestServer(t)} {
+		t.Run(name, func(t *testing.T) {
+			if name == "memory" {
+				server.db, server.store = nil, newMemoryStore()
+			}
+			server.cfg.AdminToken = "secret"
+			router := server.routes()
+
+			postAppointment(t, router, AppointmentRequest{FirstName: "Hal", LastName: "History", VisitDate: "2075-06-16"})
+			postAppointment(t, router, AppointmentRequest{FirstName: "Other", LastName: "Person", VisitDate: "2075-06-18"})
+
+			move := func(date string) int {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/1/reschedule", []byte(`{"visitDate":"`+date+`"}`)))
+				return w.Code
+			}
+			if code := move("2075-06-17"); code != http.StatusOK {
+				t.Fatalf("Expected 200 moving the booking, got %d", code)
+			}
+			if code := move("2075-06-18"); code != http.StatusConflict {
+				t.Errorf("Expected 409 moving onto a taken day, got %d", code)
+			}
+			if code := move("2075-12-25"); code != http.StatusBadRequest {
+				t.Errorf("Expected 400 moving onto a holiday, got %d", code)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/1/history", nil))
+			var history History
+			if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+				t.Fatalf("Failed to decode history: %v", err)
+			}
+			if len(history.Revisions) != 2 {
+				t.Fatalf("Expected 2 revisions, got %+v", history.Revisions)
+			}
+			first, second := history.Revisions[0], history.Revisions[1]
+			if first.Change != RevisionCreated || first.ChangedBy != ActorPublic || first.VisitDate != "2075-06-16" {
+				t.Errorf("Unexpected first revision %+v", first)
+			}
+			if second.Change != RevisionRescheduled || second.ChangedBy != ActorAdmin || second.VisitDate != "2075-06-17" || second.Version != 2 {
+				t.Errorf("Unexpected second revision %+v", second)
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/99/history", nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected 404 for an unknown appointment, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestHistoryXML(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	router := server.routes()
+	postAppointment(t, router, AppointmentRequest{FirstName: "Hal", LastName: "History", VisitDate: "2075-06-16"})
+
+	r := adminRequest("GET", "/appointments/1/history", nil)
+	r.Header.Set("Accept", "application/xml")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	var history History
+	if err := xml.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history.Revisions) != 1 || history.Revisions[0].LastName != "History" {
+		t.Errorf("Expected the history as XML, got %q (%v)", w.Body.String(), err)
+	}
+}
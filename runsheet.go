@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"html/template"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The day's list as the front desk prints it every morning: everyone
+// booked, by service and then surname, with a box to tick as they turn
+// up. Bookings aren't given to a member of staff until they're called
+// to a desk, so service is as far as it's split. GET
+// /schedule/{date}/printable is HTML to print from the browser, and
+// ?format=pdf is the same as a PDF
+type RunSheet struct {
+	Date        time.Time
+	Closed      string // why the office is shut that day, if it is
+	People      int
+	Services    []RunSheetService
+	GeneratedAt time.Time
+}
+
+type RunSheetService struct {
+	Service string
+	People  int
+	Rows    []RunSheetRow
+}
+
+type RunSheetRow struct {
+	ID        int
+	Name      string   // Surname, First (Preferred)
+	With      []string // everyone else on the booking
+	Language  string   // only if it isn't English
+	Channel   string
+	CheckedIn bool // at the kiosk already, so ticked
+}
+
+func runSheetName(a Appointment) string {
+	name := a.LastName + ", " + a.FirstName
+	if a.PreferredName != "" && a.PreferredName != a.FirstName {
+		name += " (" + a.PreferredName + ")"
+	}
+	if a.Title != "" {
+		name += ", " + a.Title
+	}
+	return name
+}
+
+func (s *Server) runSheet(r *http.Request, date time.Time) (RunSheet, error) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	sheet := RunSheet{Date: date, GeneratedAt: time.Now()}
+	if s.holidaySet(ctx).closed(date) {
+		sheet.Closed = "Public holiday"
+	}
+	closures, err := s.store.Closures(ctx, date, date)
+	if err != nil {
+		return RunSheet{}, err
+	}
+	for _, c := range closures {
+		sheet.Closed = "Closed: " + c.Reason
+	}
+	appointments, err := s.store.List(ctx, time.Time{})
+	if err != nil {
+		return RunSheet{}, err
+	}
+
+	byService := map[string]*RunSheetService{}
+	day := date.Format("2006-01-02")
+	for _, a := range appointments {
+		if a.VisitDate != day {
+			continue
+		}
+		service := cmp.Or(a.Service, s.queueServices()[0])
+		group, ok := byService[service]
+		if !ok {
+			group = &RunSheetService{Service: service}
+			byService[service] = group
+		}
+		row := RunSheetRow{ID: a.ID, Name: runSheetName(a), Channel: channelOrOnline(a.Channel), CheckedIn: a.CheckedInAt != nil}
+		for _, attendee := range a.Attendees {
+			row.With = append(row.With, attendee.FirstName+" "+attendee.LastName)
+		}
+		if a.PreferredLanguage != DefaultLanguage {
+			row.Language = a.PreferredLanguage
+		}
+		group.Rows = append(group.Rows, row)
+		group.People += a.PartySize()
+		sheet.People += a.PartySize()
+	}
+
+	// The configured services in their order, then anything booked before
+	// a service was taken out
+	order := s.queueServices()
+	for _, service := range slices.Sorted(maps.Keys(byService)) {
+		if !slices.Contains(order, service) {
+			order = append(order, service)
+		}
+	}
+	for _, service := range order {
+		group, ok := byService[service]
+		if !ok {
+			continue
+		}
+		slices.SortFunc(group.Rows, func(a, b RunSheetRow) int {
+			return cmp.Or(strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)), a.ID-b.ID)
+		})
+		sheet.Services = append(sheet.Services, *group)
+	}
+	return sheet, nil
+}
+
+// GET /schedule/{date}/printable
+func (s *Server) getRunSheet(w http.ResponseWriter, r *http.Request) {
+	date, err := time.Parse("2006-01-02", mux.Vars(r)["date"])
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidDate, "Dates must be in YYYY-MM-DD format")
+		return
+	}
+	format := cmp.Or(r.URL.Query().Get("format"), "html")
+	if format != "html" && format != "pdf" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidFormat, "Run sheet format must be 'html' or 'pdf'")
+		return
+	}
+	sheet, err := s.runSheet(r, date)
+	if err != nil {
+		log.Printf("Error loading the run sheet: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load the day's bookings")
+		return
+	}
+
+	var buf bytes.Buffer
+	if format == "pdf" {
+		runSheetPDF(&buf, sheet)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="run-sheet-%s.pdf"`, date.Format("2006-01-02")))
+	} else {
+		if err := runSheetTemplate.Execute(&buf, sheet); err != nil {
+			log.Printf("Error rendering the run sheet: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeEncodingError, "Failed to render the run sheet")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	// People's names, so kept off shared caches and out of the history
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(buf.Bytes())
+}
+
+var runSheetTemplate = template.Must(template.New("runsheet").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Run sheet {{.Date.Format "2006-01-02"}}</title>
+<style>
+body { font-family: system-ui, sans-serif; font-size: 11pt; margin: 1.5cm; color: #000; }
+h1 { font-size: 16pt; margin: 0 0 0.2em; }
+h2 { font-size: 13pt; margin: 1.2em 0 0.3em; border-bottom: 2px solid #000; }
+p.meta { margin: 0; color: #333; }
+p.closed { font-weight: bold; font-size: 13pt; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: 0.25em 0.4em; border-bottom: 1px solid #999; vertical-align: top; }
+td.tick { width: 1.5em; }
+.box { display: inline-block; width: 0.9em; height: 0.9em; border: 1.5px solid #000; text-align: center; line-height: 0.9em; }
+.with { color: #333; font-size: 10pt; }
+td.id { width: 4em; }
+@media print {
+  body { margin: 0; }
+  section { break-inside: avoid-page; }
+  h2 { break-after: avoid-page; }
+  tr { break-inside: avoid; }
+}
+</style>
+</head>
+<body>
+<h1>Run sheet for {{.Date.Format "Monday 2 January 2006"}}</h1>
+<p class="meta">{{.People}} {{if eq .People 1}}person{{else}}people{{end}} booked. Printed {{.GeneratedAt.Format "2 Jan 2006 15:04"}}</p>
+{{with .Closed}}<p class="closed">{{.}}</p>{{end}}
+{{range .Services}}
+<section>
+<h2>{{.Service}}, {{.People}} {{if eq .People 1}}person{{else}}people{{end}}</h2>
+<table>
+<thead><tr><th></th><th>Name</th><th>Booking</th><th>Channel</th><th>Language</th></tr></thead>
+<tbody>
+{{range .Rows}}<tr>
+<td class="tick"><span class="box">{{if .CheckedIn}}&#10003;{{end}}</span></td>
+<td>{{.Name}}{{if .With}}<div class="with">With {{range $i, $name := .With}}{{if $i}}, {{end}}{{$name}}{{end}}</div>{{end}}</td>
+<td class="id">{{.ID}}</td>
+<td>{{.Channel}}</td>
+<td>{{.Language}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+</section>
+{{else}}
+<p>Nobody is booked.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRunSheet(t *testing.T) {
+	for _, store := range []string{"sqlite", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, _ := closureServer(t, store)
+			server.cfg.DailyCapacity = 100
+			server.cfg.QueueServices = []string{"general", "passports"}
+			server.cfg.NameCharacters = NameCharactersAny
+			router := server.routes()
+
+			for _, req := range []AppointmentRequest{
+				{FirstName: "Zed", LastName: "Young", VisitDate: "2075-01-09", Service: "passports"},
+				{FirstName: "Samantha", LastName: "Jones", PreferredName: "Sam", VisitDate: "2075-01-09", PreferredLanguage: "cy", Attendees: []Attendee{{FirstName: "Tom", LastName: "Jones"}}},
+				{FirstName: "Ann", LastName: "<b>Able</b>", VisitDate: "2075-01-09"},
+				{FirstName: "Not", LastName: "Today", VisitDate: "2075-01-10"},
+			} {
+				if w := postAppointment(t, router, req); w.Code != http.StatusCreated {
+					t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+				}
+			}
+			server.store.CheckIn(context.Background(), 2)
+
+			get := func(path string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest("GET", path, nil))
+				return w
+			}
+			w := get("/schedule/2075-01-09/printable")
+			page := w.Body.String()
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || w.Header().Get("Cache-Control") != "private, no-store" {
+				t.Fatalf("Expected the run sheet as HTML, got %d: %s", w.Code, page)
+			}
+			// Services in their configured order, surnames in order in each
+			order := []string{"general, 3 people", "&lt;b&gt;Able&lt;/b&gt;, Ann", "Jones, Samantha (Sam)", "With Tom Jones", "passports, 1 person", "Young, Zed"}
+			last := -1
+			for _, want := range order {
+				i := strings.Index(page, want)
+				if i < last {
+					t.Errorf("Expected %q after what's before it, got %s", want, page)
+				}
+				last = i
+			}
+			if strings.Contains(page, "Today") || strings.Count(page, "&#10003;") != 1 || !strings.Contains(page, "4 people booked") {
+				t.Errorf("Expected just the day's bookings with the one checked in ticked, got %s", page)
+			}
+
+			w = get("/schedule/2075-01-09/printable?format=pdf")
+			pdf := w.Body.String()
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pdf" || !strings.HasPrefix(pdf, "%PDF-1.4") || !strings.HasSuffix(pdf, "%%EOF\n") {
+				t.Fatalf("Expected a PDF, got %d: %s", w.Code, pdf)
+			}
+			checkPDF(t, pdf)
+			for _, want := range []string{"(Jones, Samantha \\(Sam\\))", "(<b>Able</b>, Ann)", "(passports, 1)", "(With Tom Jones)"} {
+				if !strings.Contains(pdf, want) {
+					t.Errorf("Expected %s in the PDF, got %s", want, pdf)
+				}
+			}
+
+			if w := get("/schedule/2075-01-09/printable?format=doc"); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected an unknown format refused, got %d", w.Code)
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/schedule/2075-01-09/printable", nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected the public turned away, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestRunSheetPages(t *testing.T) {
+	server, _ := closureServer(t, "sqlite")
+	server.cfg.DailyCapacity = 100
+	server.cfg.NameCharacters = NameCharactersAny
+	router := server.routes()
+	for i := range 100 {
+		if w := postAppointment(t, router, AppointmentRequest{FirstName: "Person", LastName: "Number " + strconv.Itoa(i), VisitDate: "2075-01-09"}); w.Code != http.StatusCreated {
+			t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/schedule/2075-01-09/printable?format=pdf", nil))
+	pdf := w.Body.String()
+	checkPDF(t, pdf)
+	if !strings.Contains(pdf, "/Count 3") || !strings.Contains(pdf, "(general, 100 \\(continued\\))") || !strings.Contains(pdf, "Page 3 of 3") {
+		t.Errorf("Expected 100 bookings over three pages, the heading on each, got %s", pdf)
+	}
+	if pdfString("Siân Ŵ") != `Si\342n ?` {
+		t.Errorf("Expected what the fonts can't show as ?, got %q", pdfString("Siân Ŵ"))
+	}
+}
+
+// Every object where the cross reference table says it is
+func checkPDF(t *testing.T, pdf string) {
+	t.Helper()
+	xref := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(pdf)
+	if xref == nil {
+		t.Fatalf("Expected a startxref, got %s", pdf)
+	}
+	at, _ := strconv.Atoi(xref[1])
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(pdf[at:], -1)
+	if len(entries) < 7 {
+		t.Fatalf("Expected the catalogue, pages, fonts and a page, got %d objects", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(entry[1])
+		if want := fmt.Sprintf("%d 0 obj", i+1); !strings.HasPrefix(pdf[offset:], want) {
+			t.Errorf("Expected %s at %d, got %.20q", want, offset, pdf[offset:])
+		}
+	}
+	for _, stream := range regexp.MustCompile(`/Length (\d+) >>\nstream\n`).FindAllStringSubmatchIndex(pdf, -1) {
+		length, _ := strconv.Atoi(pdf[stream[2]:stream[3]])
+		if !strings.HasPrefix(pdf[stream[1]+length:], "endstream") {
+			t.Errorf("Expected a stream's length to be right at %d", stream[0])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Uploads go past one of these before they're kept. Nil means there's no
+// scanner, for a development box
+type VirusScanner interface {
+	// An *InfectedError if it found something, any other error if it couldn't tell
+	Scan(ctx context.Context, data []byte) error
+}
+
+type InfectedError struct {
+	Signature string
+}
+
+func (e *InfectedError) Error() string {
+	return "infected: " + e.Signature
+}
+
+// ClamAV's clamd, on CITYNEXT_CLAMD_ADDR, e.g. "clamav:3310" or
+// "unix:/run/clamav/clamd.sock". The file is streamed over with INSTREAM
+type clamdScanner struct {
+	addr string
+}
+
+func newVirusScanner(cfg Config) VirusScanner {
+	if cfg.ClamdAddr == "" {
+		return nil
+	}
+	return clamdScanner{addr: cfg.ClamdAddr}
+}
+
+func (c clamdScanner) Scan(ctx context.Context, data []byte) error {
+	network, addr := "tcp", c.addr
+	if path, ok := strings.CutPrefix(c.addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to reach clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	// Chunks with a 4 byte length in front, and a zero length one to end
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	for chunk := range slices.Chunk(data, 64<<10) {
+		binary.Write(w, binary.BigEndian, uint32(len(chunk)))
+		w.Write(chunk)
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to send to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return fmt.Errorf("failed to read clamd's reply: %w", err)
+	}
+	reply = strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), "\x00")
+	switch {
+	case reply == "OK":
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &InfectedError{Signature: strings.TrimSuffix(reply, " FOUND")}
+	}
+	return fmt.Errorf("clamd said %q", reply)
+}
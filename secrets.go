@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets don't have to sit in the environment in plain text. For each
+// of them KEY_FILE can name a file with it in, the way Docker and
+// Kubernetes mount secrets, or with CITYNEXT_VAULT_ADDR and
+// CITYNEXT_VAULT_PATH set they come from a HashiCorp Vault KV secret,
+// one field per setting, e.g. CITYNEXT_ADMIN_TOKEN. The setting itself
+// still wins, then the file, then Vault
+func envSecret(key string) string {
+	if v := envString(key, ""); v != "" {
+		return v
+	}
+	if path := envString(key+"_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return strings.TrimRight(string(data), "\r\n")
+		}
+		log.Printf("Ignoring %s_FILE=%s: %v", key, path, err)
+	}
+	vaultSecrets.RLock()
+	defer vaultSecrets.RUnlock()
+	return vaultSecrets.values[key]
+}
+
+// Fetched on start and again on every reload, like the config file
+var vaultSecrets struct {
+	sync.RWMutex
+	values map[string]string
+}
+
+func readVaultSecrets(ctx context.Context) error {
+	values := map[string]string{}
+	addr, path := envString("CITYNEXT_VAULT_ADDR", ""), envString("CITYNEXT_VAULT_PATH", "")
+	if addr != "" && path != "" {
+		var err error
+		values, err = fetchVaultSecret(ctx, addr, path, envSecret("CITYNEXT_VAULT_TOKEN"), envString("CITYNEXT_VAULT_NAMESPACE", ""))
+		if err != nil {
+			return err
+		}
+		log.Printf("Read %d secrets from Vault at %s", len(values), path)
+	}
+
+	vaultSecrets.Lock()
+	vaultSecrets.values = values
+	vaultSecrets.Unlock()
+	return nil
+}
+
+// A KV secret, version 2 ("secret/data/citynext") or version 1
+// ("secret/citynext"), read with a token from CITYNEXT_VAULT_TOKEN, the
+// one Vault Agent writes out for instance
+func fetchVaultSecret(ctx context.Context, addr, path, token, namespace string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("vault returned status %d for %s: %s", resp.StatusCode, path, strings.TrimSpace(string(msg)))
+	}
+
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode Vault's answer: %w", err)
+	}
+	// Version 2 has the fields a level down, next to the metadata
+	fields := body.Data
+	if inner, ok := body.Data["data"].(map[string]any); ok {
+		if _, ok := body.Data["metadata"]; ok {
+			fields = inner
+		}
+	}
+
+	values := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if s, ok := v.(string); ok {
+			values[k] = s
+		} else {
+			values[k] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(path, []byte("from-a-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CITYNEXT_ADMIN_TOKEN", "")
+	t.Setenv("CITYNEXT_ADMIN_TOKEN_FILE", path)
+	if got := loadConfig().AdminToken; got != "from-a-file" {
+		t.Errorf("Expected the token from the file, got %q", got)
+	}
+
+	// The setting itself still wins
+	t.Setenv("CITYNEXT_ADMIN_TOKEN", "from-the-environment")
+	if got := loadConfig().AdminToken; got != "from-the-environment" {
+		t.Errorf("Expected the environment to win, got %q", got)
+	}
+}
+
+func TestSecretsFromVault(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/citynext":
+			w.Write([]byte(`{"data": {"data": {"CITYNEXT_KIOSK_TOKEN": "kiosk-from-vault", "CITYNEXT_PHONE_TOKEN": "phone-from-vault"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/citynext":
+			w.Write([]byte(`{"data": {"CITYNEXT_KIOSK_TOKEN": "kiosk-from-v1"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+	t.Cleanup(func() { vaultSecrets.values = nil })
+
+	t.Setenv("CITYNEXT_VAULT_ADDR", vault.URL)
+	t.Setenv("CITYNEXT_VAULT_PATH", "secret/data/citynext")
+	t.Setenv("CITYNEXT_VAULT_TOKEN", "vault-token")
+	t.Setenv("CITYNEXT_KIOSK_TOKEN", "")
+	t.Setenv("CITYNEXT_PHONE_TOKEN", "phone-from-the-environment")
+	if err := readVaultSecrets(context.Background()); err != nil {
+		t.Fatalf("Failed to read from Vault: %v", err)
+	}
+	cfg := loadConfig()
+	if cfg.KioskToken != "kiosk-from-vault" || cfg.PhoneToken != "phone-from-the-environment" {
+		t.Errorf("Expected the kiosk token from Vault and the phone's from the environment, got %q and %q", cfg.KioskToken, cfg.PhoneToken)
+	}
+
+	t.Setenv("CITYNEXT_VAULT_PATH", "kv/citynext")
+	if err := readVaultSecrets(context.Background()); err != nil || loadConfig().KioskToken != "kiosk-from-v1" {
+		t.Errorf("Expected a version 1 secret read too, got %q (%v)", loadConfig().KioskToken, err)
+	}
+
+	t.Setenv("CITYNEXT_VAULT_TOKEN", "wrong")
+	if err := readVaultSecrets(context.Background()); err == nil {
+		t.Error("Expected an error with the wrong Vault token")
+	}
+	if loadConfig().KioskToken != "kiosk-from-v1" {
+		t.Error("Expected the secrets from before kept when Vault can't be read")
+	}
+}
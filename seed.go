@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Fake but plausible bookings for staging and load tests.
+// Same rules as the real endpoint: no public holidays, one appointment on each day nobody has booked yet,
+// plus nobody books the weekend
+var (
+	seedFirstNames = []string{
+		"Olivia", "Amelia", "Isla", "Ava", "Mia", "Ivy", "Lily", "Freya", "Grace", "Sophia",
+		"Noah", "Oliver", "George", "Arthur", "Muhammad", "Leo", "Harry", "Oscar", "Jack", "Rhys",
+		"Siobhan", "Eilidh", "Cerys", "Dylan", "Aoife", "Callum", "María", "Priya", "Tomasz", "Chen",
+	}
+	seedLastNames = []string{
+		"Smith", "Jones", "Williams", "Taylor", "Brown", "Davies", "Evans", "Wilson", "Thomas", "Johnson",
+		"Roberts", "Robinson", "Thompson", "Wright", "Walker", "White", "Edwards", "Hughes", "Green", "Hall",
+		"O'Brien", "MacDonald", "Patel", "Khan", "Nowak", "Singh", "Murphy", "Campbell", "Lewis", "Morgan",
+	}
+)
+
+// Fill up to count free days of the year, returns how many were added
+func (s *Server) seedAppointments(ctx context.Context, year, count int, rng *rand.Rand) (int, error) {
+	holidays := s.holidaySet(ctx)
+	var free []time.Time
+	for d := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC); d.Year() == year; d = d.AddDate(0, 0, 1) {
+		if d.Weekday() == time.Saturday || d.Weekday() == time.Sunday || holidays.closed(d) {
+			continue
+		}
+		booked, err := s.store.Booked(ctx, d)
+		if err != nil {
+			return 0, err
+		}
+		if booked == 0 {
+			free = append(free, d)
+		}
+	}
+
+	rng.Shuffle(len(free), func(i, j int) { free[i], free[j] = free[j], free[i] })
+	if count > len(free) {
+		count = len(free)
+	}
+
+	for _, d := range free[:count] {
+		first := seedFirstNames[rng.IntN(len(seedFirstNames))]
+		last := seedLastNames[rng.IntN(len(seedLastNames))]
+
+		req := AppointmentRequest{
+			FirstName:         first,
+			LastName:          last,
+			Email:             fmt.Sprintf("%s.%s@example.com", strings.ToLower(first), strings.ToLower(strings.ReplaceAll(last, "'", ""))),
+			PreferredLanguage: DefaultLanguage,
+		}
+		if rng.IntN(10) == 0 {
+			req.PreferredLanguage = "cy"
+		}
+
+		if _, err := s.store.Create(withActor(ctx, ActorSeed), req, d, s.dailyCapacity()); err != nil {
+			return 0, fmt.Errorf("failed to seed appointment for %s: %w", d.Format("2006-01-02"), err)
+		}
+	}
+
+	return count, nil
+}
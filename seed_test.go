@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestSeedRespectsRules(t *testing.T) {
+	server := setupTestServer(t)
+
+	added, err := server.seedAppointments(context.Background(), 2075, 100, rand.New(rand.NewPCG(1, 2)))
+	if err != nil {
+		t.Fatalf("Failed to seed: %v", err)
+	}
+	if added != 100 {
+		t.Errorf("Expected 100 seeded appointments, got %d", added)
+	}
+
+	rows, err := server.db.Query("SELECT visit_date FROM appointments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var visitDate string
+		rows.Scan(&visitDate)
+		d, _ := time.Parse("2006-01-02", visitDate)
+		if server.holidaySet(context.Background()).closed(d) || d.Weekday() == time.Saturday || d.Weekday() == time.Sunday {
+			t.Errorf("Seeded appointment on a closed day: %s", visitDate)
+		}
+	}
+
+	// The year only has so many working days, asking for more just fills it
+	more, err := server.seedAppointments(context.Background(), 2075, 1000, rand.New(rand.NewPCG(3, 4)))
+	if err != nil {
+		t.Fatalf("Failed to seed: %v", err)
+	}
+	if total := added + more; total > 261 {
+		t.Errorf("Expected at most one appointment per working day, got %d", total)
+	}
+}
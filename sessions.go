@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+)
+
+// For the admin pages in a browser, which can't keep a bearer token
+// anywhere safe. POST /session with {"token": "<CITYNEXT_ADMIN_TOKEN>"}
+// logs in and sets a cookie that stands in for the token on every admin
+// route. There are no staff accounts yet, so the token is the password.
+// Sessions live in the shared cache, so they hold on every replica and
+// logging out anywhere logs out everywhere
+const (
+	sessionCookie = "citynext_session"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// What's kept for a session. Fingerprint is of the admin token it was
+// logged in with, so changing the token ends every session made with the
+// old one, even ones in Redis from before a restart
+type staffSession struct {
+	CSRF        string    `json:"csrf"`
+	Fingerprint string    `json:"fingerprint"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// The answer to logging in. The CSRF token goes in X-CSRF-Token on
+// everything but a GET, the cookie can't be read by the page
+type Session struct {
+	XMLName   xml.Name  `json:"-" xml:"session"`
+	CSRFToken string    `json:"csrfToken" xml:"csrfToken"`
+	ExpiresAt time.Time `json:"expiresAt" xml:"expiresAt"`
+}
+
+func sessionKey(id string) string { return "session:" + id }
+
+func (s *Server) tokenFingerprint() string {
+	return hmacSignature([]byte(s.cfg.AdminToken), "session")
+}
+
+// POST /session. A wrong token counts towards the admin lockout the same
+// as a wrong bearer token
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.AdminToken == "" {
+		s.sendErrorResponse(w, r, http.StatusForbidden, CodeAdminDisabled, "Admin endpoints are not enabled")
+		return
+	}
+	ip := clientIP(r)
+	if s.lockedOut(w, r, ActorAdmin, ip) {
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.cfg.AdminToken)) != 1 {
+		s.tokenFailed(r.Context(), ActorAdmin, ip)
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeUnauthorized, "A valid admin token is required")
+		return
+	}
+
+	id := lockToken() + lockToken()
+	session := staffSession{CSRF: lockToken(), Fingerprint: s.tokenFingerprint(), ExpiresAt: time.Now().Add(s.cfg.SessionTTL).Truncate(time.Second).UTC()}
+	b, _ := json.Marshal(session)
+	if err := s.cache.Set(r.Context(), sessionKey(id), b, s.cfg.SessionTTL); err != nil {
+		log.Printf("Error storing session: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed to log in")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(s.cfg.SessionTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	log.Printf("Admin logged in from %s", ip)
+	s.respond(w, r, http.StatusCreated, Session{CSRFToken: session.CSRF, ExpiresAt: session.ExpiresAt})
+}
+
+// DELETE /session, with the CSRF token like any other change
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.checkSession(w, r)
+	if !ok {
+		return
+	}
+	if err := s.cache.Delete(r.Context(), sessionKey(id)); err != nil {
+		log.Printf("Error ending session: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed to log out")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The session the cookie's for, sending the error if there isn't one or
+// a change doesn't have its CSRF token. SameSite keeps the cookie off
+// other sites' requests in most browsers, the token covers the rest
+func (s *Server) checkSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeUnauthorized, "Log in first")
+		return "", false
+	}
+	b, ok, err := s.cache.Get(r.Context(), sessionKey(cookie.Value))
+	if err != nil {
+		log.Printf("Error loading session: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed checking the session")
+		return "", false
+	}
+	var session staffSession
+	if !ok || json.Unmarshal(b, &session) != nil || time.Now().After(session.ExpiresAt) {
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeUnauthorized, "The session has ended, log in again")
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(session.Fingerprint), []byte(s.tokenFingerprint())) != 1 {
+		s.cache.Delete(r.Context(), sessionKey(cookie.Value))
+		s.sendErrorResponse(w, r, http.StatusUnauthorized, CodeUnauthorized, "The admin token has changed, log in again")
+		return "", false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(session.CSRF)) != 1 {
+			s.sendErrorResponse(w, r, http.StatusForbidden, CodeCSRFFailed, "A valid "+csrfHeader+" header is required")
+			return "", false
+		}
+	}
+	return cookie.Value, true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	server, _ := closureServer(t, "sqlite")
+	server.cfg.SessionTTL = time.Hour
+	server.cfg.LockoutThreshold, server.cfg.LockoutDuration = 2, time.Minute
+	router := server.routes()
+
+	send := func(method, path, body string, cookie *http.Cookie, csrf string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if csrf != "" {
+			r.Header.Set(csrfHeader, csrf)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	login := func() (*http.Cookie, Session) {
+		t.Helper()
+		w := send("POST", "/session", `{"token": "secret"}`, nil, "")
+		var session Session
+		json.Unmarshal(w.Body.Bytes(), &session)
+		cookies := w.Result().Cookies()
+		if w.Code != http.StatusCreated || len(cookies) != 1 || session.CSRFToken == "" {
+			t.Fatalf("Expected a session, got %d: %s", w.Code, w.Body.String())
+		}
+		return cookies[0], session
+	}
+
+	if w := send("POST", "/session", `{"token": "wrong"}`, nil, ""); w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected a wrong token turned away, got %d", w.Code)
+	}
+	cookie, session := login()
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || cookie.MaxAge != 3600 || cookie.Path != "/" {
+		t.Errorf("Expected a secure, HttpOnly, SameSite cookie for an hour, got %+v", cookie)
+	}
+
+	// Reading needs only the cookie, changing needs the CSRF token too
+	if w := send("GET", "/admin/closures", "", cookie, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the cookie to let them in, got %d: %s", w.Code, w.Body.String())
+	}
+	closure := `{"from": "2075-01-20", "reason": "Training"}`
+	for _, csrf := range []string{"", "not-it"} {
+		if w := send("POST", "/admin/closures", closure, cookie, csrf); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "csrf_failed") {
+			t.Errorf("Expected a change without the CSRF token %q refused, got %d: %s", csrf, w.Code, w.Body.String())
+		}
+	}
+	if w := send("POST", "/admin/closures", closure, cookie, session.CSRFToken); w.Code != http.StatusCreated {
+		t.Errorf("Expected a change with the CSRF token, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("GET", "/admin/closures", "", &http.Cookie{Name: sessionCookie, Value: "made-up"}, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a made up session refused, got %d", w.Code)
+	}
+
+	// Logging out ends it everywhere
+	if w := send("DELETE", "/session", "", cookie, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected logging out to need the CSRF token, got %d", w.Code)
+	}
+	if w := send("DELETE", "/session", "", cookie, session.CSRFToken); w.Code != http.StatusNoContent || len(w.Result().Cookies()) != 1 || w.Result().Cookies()[0].MaxAge >= 0 {
+		t.Errorf("Expected logged out and the cookie cleared, got %d", w.Code)
+	}
+	if w := send("GET", "/admin/closures", "", cookie, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the session gone once logged out, got %d", w.Code)
+	}
+
+	// A new token ends the sessions made with the old one
+	cookie, _ = login()
+	server.cfg.AdminToken = "rotated"
+	if w := send("GET", "/admin/closures", "", cookie, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected sessions ended when the token changes, got %d", w.Code)
+	}
+	server.cfg.AdminToken = "secret"
+	if w := send("GET", "/admin/closures", "", cookie, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the session to stay ended, got %d", w.Code)
+	}
+
+	// Wrong guesses count towards the admin lockout
+	send("POST", "/session", `{"token": "wrong"}`, nil, "")
+	if w := send("POST", "/session", `{"token": "secret"}`, nil, ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the login locked out after two wrong tokens, got %d", w.Code)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// What's signed (download links, idempotency records) says which key it
+// was signed with, so keys can be rotated without breaking what's out
+// there. CITYNEXT_DOWNLOAD_SECRET is the key "env", POST
+// /admin/signing-keys adds a new one that's used from then on, and
+// DELETE retires one, after which what it signed stops checking out. The
+// keys are in the database, so every replica has them, each checks for
+// new ones at least once a minute
+const signingKeysRefresh = time.Minute
+
+const envKeyID = "env"
+
+type SigningKey struct {
+	XMLName   xml.Name   `json:"-" xml:"signingKey"`
+	ID        string     `json:"id" xml:"id,attr"`
+	Active    bool       `json:"active" xml:"active"` // the one new signatures use
+	CreatedBy string     `json:"createdBy,omitempty" xml:"createdBy,omitempty"`
+	CreatedAt *time.Time `json:"createdAt,omitempty" xml:"createdAt,omitempty"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty" xml:"retiredAt,omitempty"`
+}
+
+type SigningKeyList struct {
+	XMLName xml.Name     `json:"-" xml:"signingKeys"`
+	Keys    []SigningKey `json:"keys" xml:"signingKey"`
+}
+
+// The keys that still check out, by ID, and which signs
+type signingKeys struct {
+	mu       sync.RWMutex
+	secrets  map[string][]byte
+	active   string
+	loadedAt time.Time
+	forcedAt time.Time // the last look for a key nobody here had heard of
+}
+
+func newSigningKeys() *signingKeys {
+	return &signingKeys{}
+}
+
+func (s *Server) initSigningKeysTable() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS signing_keys (
+		id TEXT PRIMARY KEY,
+		secret BLOB NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		retired_at DATETIME
+	)`)
+	return err
+}
+
+// The newest key that isn't retired signs, the environment's if there
+// are none
+func (s *Server) loadSigningKeys(ctx context.Context) error {
+	secrets := map[string][]byte{}
+	active := ""
+	if s.cfg.DownloadSecret != "" {
+		secrets[envKeyID] = []byte(s.cfg.DownloadSecret)
+		active = envKeyID
+	}
+	if s.db != nil {
+		rows, err := s.db.QueryContext(ctx, "SELECT id, secret FROM signing_keys WHERE retired_at IS NULL ORDER BY created_at, id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var secret []byte
+			if err := rows.Scan(&id, &secret); err != nil {
+				return err
+			}
+			secrets[id] = secret
+			active = id
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	s.signing.mu.Lock()
+	s.signing.secrets, s.signing.active, s.signing.loadedAt = secrets, active, time.Now()
+	s.signing.mu.Unlock()
+	return nil
+}
+
+// With the keys another replica added or retired, if they may be out of
+// date or force says so. If the database can't say, the ones already
+// loaded will do
+func (s *Server) signingKey(ctx context.Context, id string, force bool) (string, []byte) {
+	s.signing.mu.RLock()
+	stale := s.signing.secrets == nil || time.Since(s.signing.loadedAt) > signingKeysRefresh
+	s.signing.mu.RUnlock()
+	if stale || force {
+		if err := s.loadSigningKeys(ctx); err != nil {
+			log.Printf("Error loading signing keys: %v", err)
+		}
+	}
+
+	s.signing.mu.RLock()
+	defer s.signing.mu.RUnlock()
+	if id == "" {
+		id = s.signing.active
+	}
+	return id, s.signing.secrets[id]
+}
+
+// The active key's ID and its signature, both empty without any keys
+func (s *Server) signMessage(ctx context.Context, msg string) (string, string) {
+	id, secret := s.signingKey(ctx, "", false)
+	if secret == nil {
+		return "", ""
+	}
+	return id, hmacSignature(secret, msg)
+}
+
+// Whether there's a key to sign with
+func (s *Server) signingEnabled(ctx context.Context) bool {
+	_, secret := s.signingKey(ctx, "", false)
+	return secret != nil
+}
+
+// Whether an unknown key's worth a trip to the database. Anyone can make
+// up a kid on a link, so it's once a signingKeysRefresh at most, and
+// the rest wait for the usual refresh like everything else
+func (k *signingKeys) mayReload() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.forcedAt) < signingKeysRefresh {
+		return false
+	}
+	k.forcedAt = time.Now()
+	return true
+}
+
+// Whether sig is msg signed by key id. One this replica hasn't heard of
+// may just have been added elsewhere, so it looks again before saying no
+func (s *Server) verifySignature(ctx context.Context, id, msg, sig string) bool {
+	if id == "" {
+		return false
+	}
+	_, secret := s.signingKey(ctx, id, false)
+	if secret == nil && s.signing.mayReload() {
+		_, secret = s.signingKey(ctx, id, true)
+	}
+	if secret == nil {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(hmacSignature(secret, msg)))
+}
+
+func hmacSignature(secret []byte, msg string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GET /admin/signing-keys, the secrets never leave the database
+func (s *Server) listSigningKeys(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	active, _ := s.signingKey(ctx, "", true)
+	list := SigningKeyList{Keys: []SigningKey{}}
+	if s.cfg.DownloadSecret != "" {
+		list.Keys = append(list.Keys, SigningKey{ID: envKeyID, Active: active == envKeyID})
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT id, created_by, created_at, retired_at FROM signing_keys ORDER BY created_at, id")
+	if err != nil {
+		log.Printf("Error listing signing keys: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list the signing keys")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		k, err := scanSigningKey(rows)
+		if err != nil {
+			log.Printf("Error reading signing key: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to list the signing keys")
+			return
+		}
+		k.Active = k.ID == active
+		list.Keys = append(list.Keys, k)
+	}
+	s.respond(w, r, http.StatusOK, list)
+}
+
+func scanSigningKey(row rowScanner) (SigningKey, error) {
+	var k SigningKey
+	var createdAt time.Time
+	var retiredAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.CreatedBy, &createdAt, &retiredAt); err != nil {
+		return k, err
+	}
+	k.CreatedAt = &createdAt
+	if retiredAt.Valid {
+		k.RetiredAt = &retiredAt.Time
+	}
+	return k, nil
+}
+
+// POST /admin/signing-keys makes a new random key and signs with it from
+// now on. The old ones still check out until they're retired
+func (s *Server) addSigningKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	key := SigningKey{ID: now.Format("20060102T150405Z") + "-" + randomHex(3), Active: true, CreatedBy: actorFrom(ctx), CreatedAt: &now}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO signing_keys (id, secret, created_by, created_at) VALUES (?, ?, ?, ?)",
+		key.ID, secret, key.CreatedBy, now); err != nil {
+		log.Printf("Error adding signing key: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to add the signing key")
+		return
+	}
+	if err := s.loadSigningKeys(ctx); err != nil {
+		log.Printf("Error loading signing keys: %v", err)
+	}
+	log.Printf("Signing key %s added (by %s)", key.ID, key.CreatedBy)
+	s.respond(w, r, http.StatusCreated, key)
+}
+
+// DELETE /admin/signing-keys/{id}. What it signed stops checking out on
+// every replica within a minute. The environment's goes by unsetting
+// CITYNEXT_DOWNLOAD_SECRET
+func (s *Server) retireSigningKey(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == envKeyID {
+		s.sendErrorResponse(w, r, http.StatusConflict, CodeEnvironmentKey, "That key is CITYNEXT_DOWNLOAD_SECRET, unset it instead")
+		return
+	}
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	key, err := scanSigningKey(s.db.QueryRowContext(ctx, `
+		UPDATE signing_keys SET retired_at = COALESCE(retired_at, ?) WHERE id = ?
+		RETURNING id, created_by, created_at, retired_at`, time.Now().UTC(), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No signing key by that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error retiring signing key %s: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to retire the signing key")
+		return
+	}
+	if err := s.loadSigningKeys(ctx); err != nil {
+		log.Printf("Error loading signing keys: %v", err)
+	}
+	log.Printf("Signing key %s retired (by %s)", id, actorFrom(ctx))
+	s.respond(w, r, http.StatusOK, key)
+}
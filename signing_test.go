@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigningKeyRotation(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DownloadSecret = "download-secret"
+	server.cfg.DownloadLinkTTL = time.Hour
+	server.blobs = dirBlobs{dir: t.TempDir()}
+	router := server.routes()
+
+	postAppointment(t, router, AppointmentRequest{FirstName: "Gwen", LastName: "Jones", VisitDate: "2075-06-17"})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, "1", "Jones", "proof.pdf", testPDF))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 uploading, got %d: %s", w.Code, w.Body.String())
+	}
+
+	link := func() string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/documents/1/link", nil))
+		var link DownloadLink
+		json.Unmarshal(w.Body.Bytes(), &link)
+		return link.URL
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	envLink := link()
+	if !strings.Contains(envLink, "kid=env") {
+		t.Fatalf("Expected the environment's key, got %s", envLink)
+	}
+	// One from before links had a kid
+	expires := time.Now().Add(time.Hour).Unix()
+	untagged := "/downloads/documents/1?expires=" + strconv.FormatInt(expires, 10) + "&sig=" + hmacSignature([]byte("download-secret"), downloadMessage("/downloads/documents/1", expires, ""))
+	if code := get(untagged); code != http.StatusOK {
+		t.Errorf("Expected an untagged link to still work, got %d", code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/signing-keys", nil))
+	var key SigningKey
+	json.Unmarshal(w.Body.Bytes(), &key)
+	if w.Code != http.StatusCreated || key.ID == "" || !key.Active || key.CreatedBy != ActorAdmin {
+		t.Fatalf("Expected a new active key, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "secret\"") {
+		t.Errorf("Expected no secret in the answer, got %s", w.Body.String())
+	}
+
+	newLink := link()
+	if !strings.Contains(newLink, "kid="+key.ID) {
+		t.Fatalf("Expected the new key, got %s", newLink)
+	}
+	for _, l := range []string{envLink, newLink} {
+		if code := get(l); code != http.StatusOK {
+			t.Errorf("Expected %s to work, got %d", l, code)
+		}
+	}
+	// The kid is part of what's checked
+	if code := get(strings.Replace(newLink, "kid="+key.ID, "kid=env", 1)); code != http.StatusForbidden {
+		t.Errorf("Expected 403 with the wrong kid, got %d", code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/signing-keys", nil))
+	var list SigningKeyList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Keys) != 2 || list.Keys[0].ID != "env" || list.Keys[0].Active || !list.Keys[1].Active {
+		t.Errorf("Expected env then the new key active, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/admin/signing-keys/"+key.ID, nil))
+	json.Unmarshal(w.Body.Bytes(), &key)
+	if w.Code != http.StatusOK || key.RetiredAt == nil {
+		t.Fatalf("Expected it retired, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := get(newLink); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a retired key's link, got %d", code)
+	}
+	if code := get(envLink); code != http.StatusOK {
+		t.Errorf("Expected the env link still to work, got %d", code)
+	}
+	if l := link(); !strings.Contains(l, "kid=env") {
+		t.Errorf("Expected back to the environment's key, got %s", l)
+	}
+
+	for path, want := range map[string]int{"/admin/signing-keys/env": http.StatusConflict, "/admin/signing-keys/nope": http.StatusNotFound} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("DELETE", path, nil))
+		if w.Code != want {
+			t.Errorf("Expected %d retiring %s, got %d", want, path, w.Code)
+		}
+	}
+}
+
+func TestSignedIdempotencyRecords(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.DownloadSecret = "download-secret"
+	router := server.routes()
+
+	post := func(key string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-15"})
+		r := httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post("abc-123"); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", w.Code)
+	}
+	ctx := context.Background()
+	b, _, _ := server.cache.Get(ctx, "idempotency:ip:192.0.2.1:/appointments:abc-123")
+	var stored storedResponse
+	json.Unmarshal(b, &stored)
+	if stored.KeyID != "env" || stored.Sig == "" {
+		t.Fatalf("Expected a signed record, got %s", b)
+	}
+	if w := post("abc-123"); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected a replay, got %d", w.Code)
+	}
+
+	// Tampered with in the cache, it's run again for real, which is a duplicate
+	stored.Status = http.StatusAccepted
+	b, _ = json.Marshal(stored)
+	server.cache.Set(ctx, "idempotency:ip:192.0.2.1:/appointments:abc-123", b, time.Minute)
+	if w := post("abc-123"); w.Header().Get("Idempotent-Replayed") == "true" || w.Code != http.StatusConflict {
+		t.Errorf("Expected the tampered record ignored, got %d", w.Code)
+	}
+}
+
+func TestUnknownSigningKeys(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.DownloadSecret = "download-secret"
+	ctx := context.Background()
+
+	if server.verifySignature(ctx, "made-up", "msg", "sig") {
+		t.Fatal("Expected a made up key turned down")
+	}
+	// Added by another replica since, but a made up kid has just looked
+	if _, err := server.db.Exec("INSERT INTO signing_keys (id, secret, created_by, created_at) VALUES ('elsewhere', 'other-secret', 'admin', ?)", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	sig := hmacSignature([]byte("other-secret"), "msg")
+	if server.verifySignature(ctx, "elsewhere", "msg", sig) {
+		t.Error("Expected no second look at the database within the minute")
+	}
+	server.signing.forcedAt = time.Now().Add(-signingKeysRefresh)
+	if !server.verifySignature(ctx, "elsewhere", "msg", sig) {
+		t.Error("Expected the new key found once the minute's up")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"time"
+)
+
+// Other council services have deadlines in working days too, and would
+// rather ask us than fetch the holidays themselves. Working days skip
+// weekends, the public holidays we've loaded, and any blackout dates the
+// caller has of their own, e.g. an office closure
+const maxSLAWorkingDays = 260
+
+type SLARequest struct {
+	StartDate   string   `json:"startDate"`
+	WorkingDays int      `json:"workingDays"`
+	Blackouts   []string `json:"blackouts,omitempty"`
+}
+
+type SkippedDay struct {
+	XMLName xml.Name `json:"-" xml:"skipped"`
+	Date    string   `json:"date" xml:"date,attr"`
+	Reason  string   `json:"reason" xml:"reason,attr"` // holiday or blackout, weekends aren't listed
+}
+
+type SLADeadline struct {
+	XMLName     xml.Name     `json:"-" xml:"deadline"`
+	StartDate   string       `json:"startDate" xml:"startDate"`
+	WorkingDays int          `json:"workingDays" xml:"workingDays"`
+	DueDate     string       `json:"dueDate" xml:"dueDate"`
+	Skipped     []SkippedDay `json:"skipped" xml:"skipped"`
+}
+
+// POST /sla/deadline with {"startDate": "2075-03-14", "workingDays": 10}.
+// The start day doesn't count, the due date is the tenth working day after it
+func (s *Server) slaDeadline(w http.ResponseWriter, r *http.Request) {
+	var req SLARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+	start, err := time.Parse("2006-01-02", req.StartDate)
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidDate, "Start date must be in YYYY-MM-DD format")
+		return
+	}
+	if req.WorkingDays < 0 || req.WorkingDays > maxSLAWorkingDays {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidWorkingDays, "Working days must be between 0 and 260")
+		return
+	}
+	blackouts := map[string]bool{}
+	for _, date := range req.Blackouts {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidDate, "Blackout dates must be in YYYY-MM-DD format")
+			return
+		}
+		blackouts[date] = true
+	}
+
+	holidays := s.holidaySet(r.Context())
+	deadline := SLADeadline{StartDate: req.StartDate, WorkingDays: req.WorkingDays, Skipped: []SkippedDay{}}
+	due := start
+	for counted := 0; counted < req.WorkingDays; {
+		due = due.AddDate(0, 0, 1)
+		date := due.Format("2006-01-02")
+		switch {
+		case due.Weekday() == time.Saturday || due.Weekday() == time.Sunday:
+		case holidays.closed(due):
+			deadline.Skipped = append(deadline.Skipped, SkippedDay{Date: date, Reason: "holiday"})
+		case blackouts[date]:
+			deadline.Skipped = append(deadline.Skipped, SkippedDay{Date: date, Reason: "blackout"})
+		default:
+			counted++
+		}
+	}
+
+	// We only know the holidays for the server's year
+	if start.Year() != today.Year() || due.Year() != today.Year() {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeOutsideYear, "Deadlines can only be worked out within the current year")
+		return
+	}
+
+	deadline.DueDate = due.Format("2006-01-02")
+	s.respond(w, r, http.StatusOK, deadline)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSLADeadline(t *testing.T) {
+	server := setupTestServer(t)
+	router := server.routes()
+
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		due     string
+		skipped int
+	}{
+		{"over a bank holiday and a blackout", `{"startDate":"2075-03-14","workingDays":3,"blackouts":["2075-03-19"]}`, http.StatusOK, "2075-03-21", 2},
+		{"no days is the start", `{"startDate":"2075-03-16","workingDays":0}`, http.StatusOK, "2075-03-16", 0},
+		{"up to the end of the year", `{"startDate":"2075-12-24","workingDays":3}`, http.StatusOK, "2075-12-31", 2},
+		{"past the end of the year", `{"startDate":"2075-12-24","workingDays":4}`, http.StatusBadRequest, "", 0},
+		{"negative days", `{"startDate":"2075-03-14","workingDays":-1}`, http.StatusBadRequest, "", 0},
+		{"bad blackout", `{"startDate":"2075-03-14","workingDays":1,"blackouts":["soon"]}`, http.StatusBadRequest, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/sla/deadline", bytes.NewBufferString(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var deadline SLADeadline
+			json.Unmarshal(w.Body.Bytes(), &deadline)
+			if deadline.DueDate != tt.due || len(deadline.Skipped) != tt.skipped {
+				t.Errorf("Expected %s with %d skipped, got %+v", tt.due, tt.skipped, deadline)
+			}
+		})
+	}
+}
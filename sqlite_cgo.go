@@ -0,0 +1,21 @@
+//go:build cgo && !purego
+
+package main
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	sqliteAvailable = true
+	sqliteDriver    = "sqlite3"
+	// Wait on a busy lock rather than failing straight away when bookings overlap
+	sqliteParams = "_busy_timeout=5000"
+)
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
@@ -0,0 +1,15 @@
+//go:build !cgo && !purego
+
+package main
+
+// mattn/go-sqlite3 is only a stub without cgo, so these builds can only
+// run with CITYNEXT_STORE=memory, or use -tags purego for a real database
+const (
+	sqliteAvailable = false
+	sqliteDriver    = "sqlite3"
+	sqliteParams    = ""
+)
+
+func isUniqueViolation(err error) bool {
+	return false
+}
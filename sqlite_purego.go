@@ -0,0 +1,25 @@
+//go:build purego
+
+package main
+
+import (
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// modernc.org/sqlite is SQLite translated to Go, so "go build -tags purego"
+// with CGO_ENABLED=0 still gets a real database, e.g. for the ARM kiosks
+const (
+	sqliteAvailable = true
+	sqliteDriver    = "sqlite"
+	// Same busy wait as the cgo driver, and write times in the same format so
+	// stored timestamps compare the same whichever driver wrote them
+	sqliteParams = "_pragma=busy_timeout(5000)&_time_format=sqlite"
+)
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
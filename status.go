@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The council site embeds /status on its booking page, so it says
+// whether booking works, how busy the next few days are and anything
+// staff want people to know first
+const (
+	statusDays   = 7
+	statusMaxAge = 30 * time.Second
+)
+
+type StatusDay struct {
+	XMLName  xml.Name `json:"-" xml:"day"`
+	Date     string   `json:"date" xml:"date,attr"`
+	Open     bool     `json:"open" xml:"open,attr"`
+	Booked   int      `json:"booked" xml:"booked"`
+	Capacity int      `json:"capacity" xml:"capacity"`
+}
+
+type ServiceStatus struct {
+	XMLName     xml.Name       `json:"-" xml:"status"`
+	Status      string         `json:"status" xml:"status"` // operational, degraded or unavailable
+	WaitingRoom bool           `json:"waitingRoom" xml:"waitingRoom"`
+	Days        []StatusDay    `json:"days" xml:"days>day"` // today and the next few, empty when it's unavailable
+	Notices     []StatusNotice `json:"notices" xml:"notices>notice"`
+	CheckedAt   time.Time      `json:"checkedAt" xml:"checkedAt"`
+}
+
+// GET /status. Only a summary of /readyz, the detail is for staff
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	status := ServiceStatus{Status: "operational", WaitingRoom: s.featureEnabled("waiting-room"), Days: []StatusDay{}, Notices: []StatusNotice{}, CheckedAt: now.Truncate(time.Second)}
+	switch s.readiness(ctx).Status {
+	case "degraded":
+		status.Status = "degraded"
+	case "unavailable":
+		status.Status = "unavailable"
+		writeCacheable(w, r, status, statusMaxAge)
+		return
+	}
+
+	today, err := s.today()
+	if err == nil {
+		status.Days, err = s.statusDays(ctx, today)
+	}
+	if err == nil {
+		status.Notices, err = s.activeNotices(ctx, today, now)
+	}
+	if err != nil {
+		log.Printf("Error loading the status: %v", err)
+		status.Status = "degraded"
+	}
+	writeCacheable(w, r, status, statusMaxAge)
+}
+
+func (s *Server) statusDays(ctx context.Context, today time.Time) ([]StatusDay, error) {
+	last := today.AddDate(0, 0, statusDays-1)
+	attendance, err := s.store.Attendance(ctx, today, last)
+	if err != nil {
+		return nil, err
+	}
+	closed, err := s.closedDays(ctx, today, last)
+	if err != nil {
+		return nil, err
+	}
+	cuts, err := s.store.CapacityCuts(ctx, today, last)
+	if err != nil {
+		return nil, err
+	}
+	holidays := s.holidaySet(ctx)
+
+	days := []StatusDay{}
+	for d := today; !d.After(last); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		day := StatusDay{Date: date, Open: !holidays.closed(d) && !closed[date], Booked: attendance[date]}
+		if day.Open {
+			day.Capacity = s.capacityOn(d)
+			if cut, ok := cuts[date]; ok {
+				day.Capacity = min(day.Capacity, cut)
+			}
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// Staff notices showing now, then the closures from today for the next
+// few days, soonest first
+func (s *Server) activeNotices(ctx context.Context, today, now time.Time) ([]StatusNotice, error) {
+	notices, err := s.currentNotices(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	closures, err := s.store.Closures(ctx, today, today.AddDate(0, 0, statusDays-1))
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range closures {
+		notice := StatusNotice{Kind: NoticeClosure, Message: "Closed " + c.From + ": " + c.Reason}
+		if c.To != c.From {
+			notice.Message = "Closed " + c.From + " to " + c.To + ": " + c.Reason
+		}
+		notice.StartsAt, _ = time.Parse("2006-01-02", c.From)
+		endsAt, _ := time.Parse("2006-01-02", c.To)
+		endsAt = endsAt.AddDate(0, 0, 1)
+		notice.EndsAt = &endsAt
+		notices = append(notices, notice)
+	}
+	return notices, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 3
+	router := server.routes()
+
+	getStatus := func() ServiceStatus {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Cache-Control"), "max-age=30") {
+			t.Fatalf("Expected a cacheable status, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+		}
+		var status ServiceStatus
+		json.Unmarshal(w.Body.Bytes(), &status)
+		return status
+	}
+
+	if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: "2075-01-03"}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+	}
+	status := getStatus()
+	if status.Status != "operational" || len(status.Days) != statusDays || len(status.Notices) != 0 {
+		t.Fatalf("Expected a week and nothing to say, got %+v", status)
+	}
+	if d := status.Days[0]; d.Date != "2075-01-01" || d.Open || d.Capacity != 0 {
+		t.Errorf("Expected new year's day closed, got %+v", d)
+	}
+	if d := status.Days[2]; d.Date != "2075-01-03" || !d.Open || d.Booked != 1 || d.Capacity != 3 {
+		t.Errorf("Expected the booking counted, got %+v", d)
+	}
+
+	now := time.Now().UTC()
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/admin/status/notices", []byte(body)))
+		return w
+	}
+	w := post(`{"kind": "maintenance", "message": "Payments are slow today", "startsAt": "` + now.Add(-time.Hour).Format(time.RFC3339) + `", "endsAt": "` + now.Add(time.Hour).Format(time.RFC3339) + `"}`)
+	var notice StatusNotice
+	json.Unmarshal(w.Body.Bytes(), &notice)
+	if w.Code != http.StatusCreated || notice.ID == 0 || notice.CreatedBy != "admin" {
+		t.Fatalf("Expected the notice put up, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := post(`{"message": "New opening hours from next week", "startsAt": "` + now.Add(24*time.Hour).Format(time.RFC3339) + `"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected a notice for later, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, body := range []string{`{"kind": "panic", "message": "x"}`, `{"kind": "info"}`, `{"message": "x", "startsAt": "2075-01-02T00:00:00Z", "endsAt": "2075-01-01T00:00:00Z"}`} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s refused, got %d", body, w.Code)
+		}
+	}
+	router.ServeHTTP(httptest.NewRecorder(), adminRequest("POST", "/admin/closures", []byte(`{"from": "2075-01-05", "reason": "Staff training"}`)))
+
+	status = getStatus()
+	if len(status.Notices) != 2 || status.Notices[0].Message != "Payments are slow today" || status.Notices[0].CreatedBy != "" ||
+		status.Notices[1].Kind != NoticeClosure || !strings.Contains(status.Notices[1].Message, "Staff training") {
+		t.Errorf("Expected the maintenance notice and the closure, got %+v", status.Notices)
+	}
+	if status.Days[4].Open {
+		t.Errorf("Expected the closed day shut, got %+v", status.Days[4])
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/admin/status/notices", nil))
+	var list StatusNoticeList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Notices) != 2 {
+		t.Errorf("Expected staff to see the one still to come too, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/admin/status/notices/"+strconv.Itoa(notice.ID), nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected it taken down, got %d: %s", w.Code, w.Body.String())
+	}
+	if status = getStatus(); len(status.Notices) != 1 {
+		t.Errorf("Expected only the closure left, got %+v", status.Notices)
+	}
+}
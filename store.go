@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Where appointments live. SQLite normally, or memory for demos,
+// tests and builds without cgo
+type AppointmentStore interface {
+	PersonStore
+
+	Init() error
+	// People booked on the day, counting everyone on a group booking
+	Booked(ctx context.Context, visitDate time.Time) (int, error)
+	// Returns ErrDuplicateAppointment if there aren't enough of capacity places left that day
+	Create(ctx context.Context, req AppointmentRequest, visitDate time.Time, capacity int) (Appointment, error)
+	// People booked on each day between from and to inclusive, keyed YYYY-MM-DD. Days nobody's booked are left out
+	Attendance(ctx context.Context, from, to time.Time) (map[string]int, error)
+	// The same split by channel, keyed YYYY-MM-DD and then channel
+	ChannelAttendance(ctx context.Context, from, to time.Time) (map[string]map[string]int, error)
+	// Calls fn for every appointment in ID order, stopping at the first error
+	ForEach(ctx context.Context, fn func(Appointment) error) error
+
+	// Moves a booking to another day, ErrAppointmentNotFound or ErrDuplicateAppointment if it can't
+	Reschedule(ctx context.Context, id int, visitDate time.Time, capacity int) (Appointment, error)
+	// Moves a booking to another service, with fields to suit it, and
+	// onto visitDate, which can be the day it's on. ErrAlreadyCheckedIn
+	// once they've arrived, otherwise the same errors as Reschedule
+	Transfer(ctx context.Context, id int, service string, fields CustomFields, visitDate time.Time, capacity int) (Appointment, error)
+	// Frees the day up again, returning the appointment as it was
+	Cancel(ctx context.Context, id int) (Appointment, error)
+	// Returns ErrAppointmentNotFound if there's no such booking
+	Get(ctx context.Context, id int) (Appointment, error)
+	// Marks them as arrived. Checking in again keeps the first time
+	CheckIn(ctx context.Context, id int) (Appointment, error)
+	// Notes they've said they're coming, as a confirmed revision
+	Confirm(ctx context.Context, id int) (Appointment, error)
+	// Points appointment merge at the same person as keep
+	Merge(ctx context.Context, keep, merge int) (Appointment, error)
+	// Every version of an appointment, oldest first
+	History(ctx context.Context, id int) ([]Revision, error)
+	// Every version of every appointment there's ever been, by appointment and then version
+	Revisions(ctx context.Context) ([]Revision, error)
+	// The appointments there were at asOf, or now if it's zero, by visit date
+	List(ctx context.Context, asOf time.Time) ([]Appointment, error)
+
+	// Blacks out c.From to c.To and picks out the bookings on those days,
+	// cancelling them too if c.Action is cancel, all in one transaction.
+	// Returns the bookings as they were. Create and Reschedule return
+	// ErrDayClosed for a closed day from then on
+	Close(ctx context.Context, c Closure) (Closure, []Appointment, error)
+	// Closures with any day between from and to inclusive, by start
+	Closures(ctx context.Context, from, to time.Time) ([]Closure, error)
+	// Books someone a closure affected in on visitDate, once: the booking
+	// moved if it was flagged, a new one like it if it was cancelled.
+	// ErrAppointmentNotFound if no closure affected it, ErrAlreadyRebooked the second time
+	Rebook(ctx context.Context, id int, visitDate time.Time, capacity int) (Appointment, error)
+	// Holds a place on visitDate until until for a booking a closure
+	// affected, in place of any it had before. The place counts as taken
+	// until they rebook or it runs out. ErrDuplicateAppointment if there
+	// aren't enough of capacity left, ErrDayClosed or ErrAppointmentNotFound
+	Hold(ctx context.Context, id int, visitDate, until time.Time, capacity int) error
+	// The place held for it, ErrAppointmentNotFound if there isn't one
+	// and ErrAlreadyRebooked if it's been rebooked since
+	Proposal(ctx context.Context, id int) (RebookProposal, error)
+
+	// Cuts plan.VisitDate to plan.Capacity and makes every move in the
+	// plan, under capacities for the days they go to, or none of them.
+	// ErrPlanStale if a booking isn't where the plan found it or the day
+	// still doesn't fit, otherwise ErrDuplicateAppointment or ErrDayClosed.
+	// From then on no write takes the day past its cut
+	Rebalance(ctx context.Context, plan RebalancePlan, capacities map[string]int) ([]Appointment, error)
+	// Days between from and to inclusive that have been cut, keyed YYYY-MM-DD
+	CapacityCuts(ctx context.Context, from, to time.Time) (map[string]int, error)
+}
+
+// Replays revisions, in version order per appointment, up to asOf.
+// Whatever each appointment's last version by then says is how it stood
+func appointmentsAsOf(revisions []Revision, asOf time.Time) []Appointment {
+	latest := map[int]Revision{}
+	for _, rev := range revisions {
+		if !rev.ChangedAt.After(asOf) {
+			latest[rev.ID] = rev
+		}
+	}
+
+	appointments := []Appointment{}
+	for _, rev := range latest {
+		if rev.Change != RevisionCancelled {
+			appointments = append(appointments, rev.Appointment)
+		}
+	}
+	sortByVisitDate(appointments)
+	return appointments
+}
+
+func sortByVisitDate(appointments []Appointment) {
+	sort.Slice(appointments, func(i, j int) bool {
+		if appointments[i].VisitDate != appointments[j].VisitDate {
+			return appointments[i].VisitDate < appointments[j].VisitDate
+		}
+		return appointments[i].ID < appointments[j].ID
+	})
+}
+
+// The people appointments are for, kept once rather than on every booking
+type PersonStore interface {
+	CreatePerson(ctx context.Context, p Person) (Person, error)
+	// Returns ErrPersonNotFound if there's no person with p.ID
+	UpdatePerson(ctx context.Context, p Person) (Person, error)
+	GetPerson(ctx context.Context, id int) (Person, error)
+	// Their appointments by visit date
+	PersonAppointments(ctx context.Context, id int) ([]Appointment, error)
+	// Current appointments of anyone with this last name or email, ignoring
+	// case, by visit date. Looked up by index, for checking a new booking
+	AppointmentsLike(ctx context.Context, lastName, email string) ([]Appointment, error)
+}
+
+var (
+	ErrDuplicateAppointment = errors.New("not enough places left on this date")
+	ErrAppointmentNotFound  = errors.New("no such appointment")
+	ErrPersonNotFound       = errors.New("no such person")
+)
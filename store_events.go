@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// CITYNEXT_STORE=events keeps an append-only log of everything that
+// happened to each appointment. The appointments table becomes a
+// projection of that log: it's updated in the same transaction as each
+// event is appended, so the two never disagree, and it can be thrown
+// away and rebuilt from the events at any time. Reads are the same as
+// the plain SQLite store
+const (
+	EventAppointmentCreated     = "AppointmentCreated"
+	EventAppointmentRescheduled = "AppointmentRescheduled"
+	EventAppointmentCancelled   = "AppointmentCancelled"
+	EventAppointmentMerged      = "AppointmentMerged" // moved over to another booking's person
+	EventAppointmentCheckedIn   = "AppointmentCheckedIn"
+	EventAppointmentTransferred = "AppointmentTransferred" // to another service, maybe another day
+	EventAppointmentConfirmed   = "AppointmentConfirmed"
+	EventPersonUpdated          = "PersonUpdated" // one for each of their bookings
+)
+
+type AppointmentEvent struct {
+	Seq           int
+	AppointmentID int
+	Type          string
+	Actor         string
+	OccurredAt    time.Time
+	Appointment   Appointment // how it looked after the event
+}
+
+type eventStore struct {
+	*sqliteStore
+}
+
+func newEventStore(db *sql.DB) *eventStore {
+	st := &eventStore{sqliteStore: newSQLiteStore(db)}
+	// The writes themselves are the plain store's, they update the
+	// projection first, which is what catches a taken date, and then
+	// the event goes on the log instead of a revision
+	st.record = st.appendEvent
+	return st
+}
+
+func (st *eventStore) Init() error {
+	if err := st.sqliteStore.Init(); err != nil {
+		return err
+	}
+
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS appointment_events (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		appointment_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		occurred_at DATETIME NOT NULL,
+		data TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	if _, err := st.db.Exec("CREATE INDEX IF NOT EXISTS appointment_events_by_appointment ON appointment_events (appointment_id, seq)"); err != nil {
+		return err
+	}
+	// The person each booking from before persons was given, so a rebuild
+	// gives it the same one rather than another
+	_, err = st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS legacy_persons (
+		appointment_id INTEGER PRIMARY KEY,
+		person_id INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Switching over from the plain store, start the log with what's there
+	_, err = st.db.Exec(`
+	INSERT INTO appointment_events (appointment_id, type, actor, occurred_at, data)
+	SELECT a.id, ?, 'unknown', COALESCE(a.created_at, CURRENT_TIMESTAMP),
+		json_object('id', a.id, 'personId', a.person_id, 'firstName', p.first_name, 'lastName', p.last_name, 'email', p.email,
+			'visitDate', a.visit_date, 'createdAt', strftime('%Y-%m-%dT%H:%M:%SZ', a.created_at), 'preferredLanguage', p.preferred_language, 'channel', a.channel, 'service', a.service, 'customFields', json(a.custom_fields), 'address', json(a.address), 'consent', json(a.consent), 'experiments', json(a.experiments), 'followUpOf', a.follow_up_of, 'title', p.title, 'preferredName', p.preferred_name)
+	FROM appointments a JOIN persons p ON p.id = a.person_id
+	WHERE a.id NOT IN (SELECT appointment_id FROM appointment_events)`, EventAppointmentCreated)
+	return err
+}
+
+var eventTypes = map[string]string{
+	RevisionCreated:       EventAppointmentCreated,
+	RevisionRescheduled:   EventAppointmentRescheduled,
+	RevisionCancelled:     EventAppointmentCancelled,
+	RevisionMerged:        EventAppointmentMerged,
+	RevisionCheckedIn:     EventAppointmentCheckedIn,
+	RevisionTransferred:   EventAppointmentTransferred,
+	RevisionConfirmed:     EventAppointmentConfirmed,
+	RevisionPersonUpdated: EventPersonUpdated,
+}
+
+func (st *eventStore) appendEvent(ctx context.Context, tx *sql.Tx, appointment Appointment, change string) error {
+	eventType := eventTypes[change]
+	data, err := json.Marshal(appointment)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO appointment_events (appointment_id, type, actor, occurred_at, data) VALUES (?, ?, ?, ?, ?)`,
+		appointment.ID, eventType, actorFrom(ctx), time.Now().UTC(), string(data))
+	if err != nil {
+		return fmt.Errorf("failed to append %s: %w", eventType, err)
+	}
+	return nil
+}
+
+// Events for one appointment, or all of them with id 0, in the order they happened
+func (st *eventStore) Events(ctx context.Context, id int) ([]AppointmentEvent, error) {
+	query := "SELECT seq, appointment_id, type, actor, occurred_at, data FROM appointment_events"
+	var args []any
+	if id != 0 {
+		query += " WHERE appointment_id = ?"
+		args = append(args, id)
+	}
+	query += " ORDER BY seq"
+
+	rows, err := st.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AppointmentEvent
+	for rows.Next() {
+		var ev AppointmentEvent
+		var data string
+		if err := rows.Scan(&ev.Seq, &ev.AppointmentID, &ev.Type, &ev.Actor, &ev.OccurredAt, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &ev.Appointment); err != nil {
+			return nil, fmt.Errorf("event %d has bad data: %w", ev.Seq, err)
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// The log is the history, one revision per event
+func (st *eventStore) History(ctx context.Context, id int) ([]Revision, error) {
+	events, err := st.Events(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrAppointmentNotFound
+	}
+	return eventRevisions(events), nil
+}
+
+func (st *eventStore) Revisions(ctx context.Context) ([]Revision, error) {
+	events, err := st.Events(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	revisions := eventRevisions(events)
+	sort.SliceStable(revisions, func(i, j int) bool { return revisions[i].ID < revisions[j].ID })
+	return revisions, nil
+}
+
+// Any point in time is a replay of the log up to it
+func (st *eventStore) List(ctx context.Context, asOf time.Time) ([]Appointment, error) {
+	if asOf.IsZero() {
+		return st.sqliteStore.List(ctx, asOf)
+	}
+	events, err := st.Events(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	return appointmentsAsOf(eventRevisions(events), asOf), nil
+}
+
+func eventRevisions(events []AppointmentEvent) []Revision {
+	changes := map[string]string{
+		EventAppointmentCreated:     RevisionCreated,
+		EventAppointmentRescheduled: RevisionRescheduled,
+		EventAppointmentCancelled:   RevisionCancelled,
+		EventAppointmentMerged:      RevisionMerged,
+		EventAppointmentCheckedIn:   RevisionCheckedIn,
+		EventAppointmentTransferred: RevisionTransferred,
+		EventAppointmentConfirmed:   RevisionConfirmed,
+		EventPersonUpdated:          RevisionPersonUpdated,
+	}
+	versions := map[int]int{}
+	revisions := make([]Revision, len(events))
+	for i, ev := range events {
+		versions[ev.AppointmentID]++
+		revisions[i] = Revision{
+			Version:     versions[ev.AppointmentID],
+			Change:      changes[ev.Type],
+			ChangedBy:   ev.Actor,
+			ChangedAt:   ev.OccurredAt,
+			Appointment: ev.Appointment,
+		}
+	}
+	return revisions
+}
+
+// Throws the appointments table away and replays the whole log into it
+func (st *eventStore) Rebuild(ctx context.Context) (int, error) {
+	events, err := st.Events(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Rebuilt before there was a note of them, the projection still knows
+	_, err = tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO legacy_persons (appointment_id, person_id)
+		SELECT a.id, a.person_id FROM appointments a
+		WHERE a.id IN (SELECT appointment_id FROM appointment_events WHERE type = ? AND COALESCE(json_extract(data, '$.personId'), 0) = 0)`,
+		EventAppointmentCreated)
+	if err != nil {
+		return 0, err
+	}
+	for _, table := range []string{"appointments", "appointment_attendees"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			return 0, err
+		}
+	}
+	for _, ev := range events {
+		if err := project(ctx, tx, ev); err != nil {
+			return 0, fmt.Errorf("failed to replay event %d: %w", ev.Seq, err)
+		}
+	}
+	return len(events), tx.Commit()
+}
+
+// What one event does to the appointments table
+func project(ctx context.Context, tx *sql.Tx, ev AppointmentEvent) error {
+	a := ev.Appointment
+	var err error
+	switch ev.Type {
+	case EventAppointmentCreated:
+		// Events from before persons had the details on the booking. The
+		// first replay makes them a person, every one after finds it
+		if a.PersonID == 0 {
+			if a.PersonID, err = legacyPerson(ctx, tx, a); err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO appointments (id, person_id, visit_date, created_at, booked_by, channel, service, custom_fields, address, consent, experiments, follow_up_of) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			a.ID, a.PersonID, a.VisitDate, a.CreatedAt, encodeBookedBy(a.BookedBy), channelOrOnline(a.Channel), a.Service, encodeCustomFields(a.CustomFields), encodeAddress(a.Address), encodeConsent(a.Consent), encodeExperiments(a.Experiments), encodeFollowUpOf(a.FollowUpOf))
+		for i := 0; err == nil && i < len(a.Attendees); i++ {
+			_, err = tx.ExecContext(ctx, "INSERT INTO appointment_attendees (appointment_id, position, first_name, last_name) VALUES (?, ?, ?, ?)",
+				a.ID, i+1, a.Attendees[i].FirstName, a.Attendees[i].LastName)
+		}
+	case EventAppointmentRescheduled:
+		_, err = tx.ExecContext(ctx, "UPDATE appointments SET visit_date = ? WHERE id = ?", a.VisitDate, a.ID)
+	case EventAppointmentTransferred:
+		_, err = tx.ExecContext(ctx, "UPDATE appointments SET service = ?, custom_fields = ?, visit_date = ? WHERE id = ?", a.Service, encodeCustomFields(a.CustomFields), a.VisitDate, a.ID)
+	case EventAppointmentCancelled:
+		if _, err = tx.ExecContext(ctx, "DELETE FROM appointments WHERE id = ?", a.ID); err == nil {
+			_, err = tx.ExecContext(ctx, "DELETE FROM appointment_attendees WHERE appointment_id = ?", a.ID)
+		}
+	case EventAppointmentMerged:
+		if a.PersonID == 0 {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE persons SET first_name = ?, last_name = ?, email = ?, preferred_language = ?
+				WHERE id = (SELECT person_id FROM appointments WHERE id = ?)`,
+				a.FirstName, a.LastName, a.Email, a.PreferredLanguage, a.ID)
+			break
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE appointments SET person_id = ? WHERE id = ?", a.PersonID, a.ID)
+	case EventAppointmentCheckedIn:
+		_, err = tx.ExecContext(ctx, "UPDATE appointments SET checked_in_at = ? WHERE id = ?", a.CheckedInAt, a.ID)
+	case EventPersonUpdated:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE persons SET first_name = ?, last_name = ?, email = ?, preferred_language = ?, updated_at = ?, title = ?, preferred_name = ?
+			WHERE id = ?`,
+			a.FirstName, a.LastName, a.Email, a.PreferredLanguage, ev.OccurredAt, a.Title, a.PreferredName, a.PersonID)
+	case EventAppointmentConfirmed:
+		// Only the event, the booking's the same
+	default:
+		err = fmt.Errorf("unknown event type %q", ev.Type)
+	}
+	return err
+}
+
+func legacyPerson(ctx context.Context, tx *sql.Tx, a Appointment) (int, error) {
+	var id int
+	err := tx.QueryRowContext(ctx, `
+		SELECT l.person_id FROM legacy_persons l JOIN persons p ON p.id = l.person_id
+		WHERE l.appointment_id = ?`, a.ID).Scan(&id)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return id, err
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO persons (first_name, last_name, email, preferred_language, created_at, updated_at, title, preferred_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		a.FirstName, a.LastName, a.Email, a.PreferredLanguage, a.CreatedAt, a.CreatedAt, a.Title, a.PreferredName).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO legacy_persons (appointment_id, person_id) VALUES (?, ?)", a.ID, id)
+	return id, err
+}
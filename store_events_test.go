@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func setupEventServer(t *testing.T) *Server {
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1) // one :memory: database, not one per connection
+	server.store = newEventStore(server.db)
+	if err := server.initDB(); err != nil {
+		t.Fatalf("Failed to init event store: %v", err)
+	}
+	server.cfg.AdminToken = "secret"
+	return server
+}
+
+func TestEventStoreLog(t *testing.T) {
+	server := setupEventServer(t)
+	router := server.routes()
+	ctx := context.Background()
+
+	postAppointment(t, router, AppointmentRequest{FirstName: "Eve", LastName: "Events", VisitDate: "2075-06-16"})
+	postAppointment(t, router, AppointmentRequest{FirstName: "Gone", LastName: "Soon", VisitDate: "2075-06-18"})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/1/reschedule", []byte(`{"visitDate":"2075-06-17"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 rescheduling, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/2/cancel", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 cancelling, got %d", w.Code)
+	}
+
+	events, err := server.store.(*eventStore).Events(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	want := []string{EventAppointmentCreated, EventAppointmentCreated, EventAppointmentRescheduled, EventAppointmentCancelled}
+	if len(types) != len(want) || types[2] != want[2] || types[3] != want[3] {
+		t.Fatalf("Expected events %v, got %v", want, types)
+	}
+
+	// The cancelled day is free again, the new one taken
+	if booked, _ := server.store.Booked(ctx, time.Date(2075, 6, 18, 0, 0, 0, 0, time.UTC)); booked != 0 {
+		t.Error("Expected the cancelled day to be free")
+	}
+
+	history, err := server.store.History(ctx, 1)
+	if err != nil || len(history) != 2 || history[1].Change != RevisionRescheduled || history[1].ChangedBy != ActorAdmin {
+		t.Errorf("Expected history from the log, got %+v (%v)", history, err)
+	}
+}
+
+func TestEventStoreRebuild(t *testing.T) {
+	server := setupEventServer(t)
+	router := server.routes()
+	ctx := context.Background()
+
+	postAppointment(t, router, AppointmentRequest{FirstName: "Rae", LastName: "Replay", VisitDate: "2075-06-16"})
+	postAppointment(t, router, AppointmentRequest{FirstName: "Rae", LastName: "Replay", VisitDate: "2075-06-18"})
+	server.store.Cancel(ctx, 2)
+
+	// Wreck the projection, the log still knows
+	if _, err := server.db.Exec("DELETE FROM appointments"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.store.(*eventStore).Rebuild(ctx); err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+
+	booked, _ := server.store.Attendance(ctx, time.Date(2075, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2075, 12, 31, 0, 0, 0, 0, time.UTC))
+	if len(booked) != 1 || booked["2075-06-16"] != 1 {
+		t.Errorf("Expected only 2075-06-16 after replay, got %v", booked)
+	}
+}
+
+// Bookings logged before persons carry their details and no person. Each
+// is given one on the first rebuild and keeps it after
+func TestEventStoreRebuildLegacyPersons(t *testing.T) {
+	server := setupEventServer(t)
+	ctx := context.Background()
+	store := server.store.(*eventStore)
+	_, err := server.db.Exec(`INSERT INTO appointment_events (appointment_id, type, actor, occurred_at, data) VALUES
+		(1, ?, 'unknown', ?, '{"id":1,"firstName":"Old","lastName":"Timer","visitDate":"2075-06-16","preferredLanguage":"en"}'),
+		(2, ?, 'unknown', ?, '{"id":2,"firstName":"Gone","lastName":"Before","visitDate":"2075-06-17","preferredLanguage":"en"}'),
+		(2, ?, 'unknown', ?, '{"id":2,"firstName":"Gone","lastName":"Before","visitDate":"2075-06-17","preferredLanguage":"en"}')`,
+		EventAppointmentCreated, time.Now(), EventAppointmentCreated, time.Now(), EventAppointmentCancelled, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	persons := func() (n int) {
+		server.db.QueryRow("SELECT COUNT(*) FROM persons").Scan(&n)
+		return n
+	}
+	for i := range 3 {
+		if _, err := store.Rebuild(ctx); err != nil {
+			t.Fatalf("Rebuild %d failed: %v", i+1, err)
+		}
+		if n := persons(); n != 2 {
+			t.Fatalf("Expected a person for each booking after rebuild %d, got %d", i+1, n)
+		}
+	}
+	a, err := store.Get(ctx, 1)
+	if err != nil || a.PersonID == 0 || a.LastName != "Timer" {
+		t.Errorf("Expected the booking on its person, got %+v (%v)", a, err)
+	}
+
+	// An update to that person replays too
+	if _, err := store.UpdatePerson(ctx, Person{ID: a.PersonID, FirstName: "Older", LastName: "Timer", PreferredLanguage: "en"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := store.Get(ctx, 1); a.FirstName != "Older" || persons() != 2 {
+		t.Errorf("Expected the update kept over a rebuild, got %+v with %d persons", a, persons())
+	}
+}
+
+func TestEventStoreAdoptsExistingAppointments(t *testing.T) {
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1)
+	postAppointment(t, server.routes(), AppointmentRequest{FirstName: "Pre", LastName: "Existing", VisitDate: "2075-06-16"})
+
+	store := newEventStore(server.db)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Failed to init event store: %v", err)
+	}
+	events, err := store.Events(context.Background(), 0)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Expected one created event, got %+v (%v)", events, err)
+	}
+	if a := events[0].Appointment; a.LastName != "Existing" || a.VisitDate != "2075-06-16" || a.CreatedAt.IsZero() {
+		t.Errorf("Unexpected adopted appointment %+v", a)
+	}
+}
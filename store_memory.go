@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everything in a map, gone on restart. Needs no cgo, so it's what
+// cross-compiled demo builds use
+type memoryStore struct {
+	mu        sync.Mutex
+	byID      map[int]Appointment // the person's details are filled in from persons on the way out
+	persons   map[int]Person
+	revisions map[int][]Revision
+	nextID    int
+	nextPerID int
+
+	closures  []Closure
+	closedFor map[int]*closedBooking // by the ID of the booking a closure affected
+	cuts      map[string]int         // capacity by day, for days that have been rebalanced
+}
+
+type closedBooking struct {
+	was        Appointment
+	rebookedAs int
+	heldOn     string
+	heldUntil  time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		byID:      make(map[int]Appointment),
+		persons:   make(map[int]Person),
+		revisions: make(map[int][]Revision),
+		closedFor: make(map[int]*closedBooking),
+		cuts:      make(map[string]int),
+		nextID:    1,
+		nextPerID: 1,
+	}
+}
+
+func (st *memoryStore) Init() error {
+	return nil
+}
+
+// Caller holds the mutex. Fills in the person's details, as the join does for SQLite
+func (st *memoryStore) view(appointment Appointment) Appointment {
+	p := st.persons[appointment.PersonID]
+	appointment.FirstName, appointment.LastName = p.FirstName, p.LastName
+	appointment.Email, appointment.PreferredLanguage = p.Email, p.PreferredLanguage
+	appointment.Title, appointment.PreferredName = p.Title, p.PreferredName
+	return appointment
+}
+
+// Caller holds the mutex. Places held after a closure count too
+func (st *memoryStore) booked(date string) int {
+	count := 0
+	for _, appointment := range st.byID {
+		if appointment.VisitDate == date {
+			count += appointment.PartySize()
+		}
+	}
+	for _, held := range st.held() {
+		if held.heldOn == date {
+			count += held.was.PartySize()
+		}
+	}
+	return count
+}
+
+// Caller holds the mutex. Not counting the place c already holds there
+func (st *memoryStore) bookedBesides(c *closedBooking, date string) int {
+	taken := st.booked(date)
+	if c.heldOn == date && c.rebookedAs == 0 && c.heldUntil.After(time.Now()) {
+		taken -= c.was.PartySize()
+	}
+	return taken
+}
+
+// Caller holds the mutex. The capacity, or less if the day's been cut
+func (st *memoryStore) limit(date string, capacity int) int {
+	if cut, ok := st.cuts[date]; ok {
+		return min(capacity, cut)
+	}
+	return capacity
+}
+
+// Caller holds the mutex. The holds that haven't been taken or run out
+func (st *memoryStore) held() []*closedBooking {
+	var held []*closedBooking
+	now := time.Now()
+	for _, c := range st.closedFor {
+		if c.heldOn != "" && c.rebookedAs == 0 && c.heldUntil.After(now) {
+			held = append(held, c)
+		}
+	}
+	return held
+}
+
+// Caller holds the mutex
+func (st *memoryStore) closed(date string) bool {
+	for _, c := range st.closures {
+		if c.From <= date && date <= c.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Caller holds the mutex
+func (st *memoryStore) addRevision(ctx context.Context, appointment Appointment, change string) {
+	st.revisions[appointment.ID] = append(st.revisions[appointment.ID], Revision{
+		Version:     len(st.revisions[appointment.ID]) + 1,
+		Change:      change,
+		ChangedBy:   actorFrom(ctx),
+		ChangedAt:   time.Now().UTC(),
+		Appointment: st.view(appointment),
+	})
+}
+
+func (st *memoryStore) Booked(ctx context.Context, visitDate time.Time) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.booked(visitDate.Format("2006-01-02")), nil
+}
+
+func (st *memoryStore) Create(ctx context.Context, req AppointmentRequest, visitDate time.Time, capacity int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	date := visitDate.Format("2006-01-02")
+	if st.closed(date) {
+		return Appointment{}, ErrDayClosed
+	}
+	if st.booked(date)+req.PartySize() > st.limit(date, capacity) {
+		return Appointment{}, ErrDuplicateAppointment
+	}
+
+	now := time.Now().UTC()
+	person, ok := st.persons[req.PersonID]
+	if !ok {
+		person = Person{
+			ID:                st.nextPerID,
+			FirstName:         req.FirstName,
+			LastName:          req.LastName,
+			Email:             req.Email,
+			PreferredLanguage: req.PreferredLanguage,
+			Title:             req.Title,
+			PreferredName:     req.PreferredName,
+			CreatedAt:         now,
+			UpdatedAt:         now,
+		}
+		st.persons[person.ID] = person
+		st.nextPerID++
+	}
+
+	appointment := Appointment{
+		ID:        st.nextID,
+		PersonID:  person.ID,
+		VisitDate: date,
+		CreatedAt: now,
+		Attendees: append([]Attendee(nil), req.Attendees...),
+		BookedBy:  req.BookedBy,
+		Channel:   channelOrOnline(req.Channel),
+		Service:   req.Service,
+
+		CustomFields: req.CustomFields,
+		Address:      req.Address,
+		Consent:      req.Consent,
+		Experiments:  req.Experiments,
+		FollowUpOf:   req.FollowUpOf,
+	}
+	st.byID[appointment.ID] = appointment
+	st.addRevision(ctx, appointment, RevisionCreated)
+	st.nextID++
+	return st.view(appointment), nil
+}
+
+func (st *memoryStore) Attendance(ctx context.Context, from, to time.Time) (map[string]int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	attendance := map[string]int{}
+	for _, appointment := range st.byID {
+		if appointment.VisitDate >= first && appointment.VisitDate <= last {
+			attendance[appointment.VisitDate] += appointment.PartySize()
+		}
+	}
+	for _, held := range st.held() {
+		if held.heldOn >= first && held.heldOn <= last {
+			attendance[held.heldOn] += held.was.PartySize()
+		}
+	}
+	return attendance, nil
+}
+
+func (st *memoryStore) ChannelAttendance(ctx context.Context, from, to time.Time) (map[string]map[string]int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	attendance := map[string]map[string]int{}
+	for _, appointment := range st.byID {
+		if appointment.VisitDate >= first && appointment.VisitDate <= last {
+			if attendance[appointment.VisitDate] == nil {
+				attendance[appointment.VisitDate] = map[string]int{}
+			}
+			attendance[appointment.VisitDate][appointment.Channel] += appointment.PartySize()
+		}
+	}
+	return attendance, nil
+}
+
+// Copied out first so fn can take its time without holding the lock
+func (st *memoryStore) ForEach(ctx context.Context, fn func(Appointment) error) error {
+	st.mu.Lock()
+	appointments := make([]Appointment, 0, len(st.byID))
+	for _, appointment := range st.byID {
+		appointments = append(appointments, st.view(appointment))
+	}
+	st.mu.Unlock()
+
+	sort.Slice(appointments, func(i, j int) bool { return appointments[i].ID < appointments[j].ID })
+	for _, appointment := range appointments {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(appointment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *memoryStore) Reschedule(ctx context.Context, id int, visitDate time.Time, capacity int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	appointment, ok := st.byID[id]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	date := visitDate.Format("2006-01-02")
+	if st.closed(date) {
+		return Appointment{}, ErrDayClosed
+	}
+	if appointment.VisitDate == date {
+		return st.view(appointment), nil
+	}
+	if st.booked(date)+appointment.PartySize() > st.limit(date, capacity) {
+		return Appointment{}, ErrDuplicateAppointment
+	}
+
+	appointment.VisitDate = date
+	st.byID[id] = appointment
+	st.addRevision(ctx, appointment, RevisionRescheduled)
+	return st.view(appointment), nil
+}
+
+func (st *memoryStore) Transfer(ctx context.Context, id int, service string, fields CustomFields, visitDate time.Time, capacity int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	appointment, ok := st.byID[id]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	if appointment.CheckedInAt != nil {
+		return Appointment{}, ErrAlreadyCheckedIn
+	}
+	date := visitDate.Format("2006-01-02")
+	if st.closed(date) {
+		return Appointment{}, ErrDayClosed
+	}
+	if appointment.VisitDate != date && st.booked(date)+appointment.PartySize() > st.limit(date, capacity) {
+		return Appointment{}, ErrDuplicateAppointment
+	}
+
+	appointment.Service, appointment.CustomFields, appointment.VisitDate = service, fields, date
+	st.byID[id] = appointment
+	st.addRevision(ctx, appointment, RevisionTransferred)
+	return st.view(appointment), nil
+}
+
+func (st *memoryStore) History(ctx context.Context, id int) ([]Revision, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	revisions, ok := st.revisions[id]
+	if !ok {
+		return nil, ErrAppointmentNotFound
+	}
+	return append([]Revision(nil), revisions...), nil
+}
+
+func (st *memoryStore) Revisions(ctx context.Context) ([]Revision, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var revisions []Revision
+	for _, revs := range st.revisions {
+		revisions = append(revisions, revs...)
+	}
+	sort.SliceStable(revisions, func(i, j int) bool { return revisions[i].ID < revisions[j].ID })
+	return revisions, nil
+}
+
+func (st *memoryStore) Cancel(ctx context.Context, id int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	appointment, ok := st.byID[id]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	delete(st.byID, id)
+	st.addRevision(ctx, appointment, RevisionCancelled)
+	return st.view(appointment), nil
+}
+
+func (st *memoryStore) Get(ctx context.Context, id int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	appointment, ok := st.byID[id]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	return st.view(appointment), nil
+}
+
+func (st *memoryStore) CheckIn(ctx context.Context, id int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	appointment, ok := st.byID[id]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	if appointment.CheckedInAt == nil {
+		now := time.Now().UTC()
+		appointment.CheckedInAt = &now
+		st.byID[id] = appointment
+		st.addRevision(ctx, appointment, RevisionCheckedIn)
+	}
+	return st.view(appointment), nil
+}
+
+func (st *memoryStore) Confirm(ctx context.Context, id int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	appointment, ok := st.byID[id]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	st.addRevision(ctx, appointment, RevisionConfirmed)
+	return st.view(appointment), nil
+}
+
+// Points the merged booking at the kept one's person
+func (st *memoryStore) Merge(ctx context.Context, keep, merge int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	kept, ok := st.byID[keep]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	merged, ok := st.byID[merge]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+
+	merged.PersonID = kept.PersonID
+	st.byID[merge] = merged
+	st.addRevision(ctx, merged, RevisionMerged)
+	return st.view(merged), nil
+}
+
+func (st *memoryStore) List(ctx context.Context, asOf time.Time) ([]Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if !asOf.IsZero() {
+		var revisions []Revision
+		for _, revs := range st.revisions {
+			revisions = append(revisions, revs...)
+		}
+		return appointmentsAsOf(revisions, asOf), nil
+	}
+
+	appointments := make([]Appointment, 0, len(st.byID))
+	for _, appointment := range st.byID {
+		appointments = append(appointments, st.view(appointment))
+	}
+	sortByVisitDate(appointments)
+	return appointments, nil
+}
+
+func (st *memoryStore) Close(ctx context.Context, c Closure) (Closure, []Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	c.ID = len(st.closures) + 1
+	c.CreatedBy, c.CreatedAt = actorFrom(ctx), time.Now().UTC()
+	affected := []Appointment{}
+	for _, appointment := range st.byID {
+		if appointment.VisitDate >= c.From && appointment.VisitDate <= c.To {
+			affected = append(affected, st.view(appointment))
+		}
+	}
+	sort.Slice(affected, func(i, j int) bool { return affected[i].ID < affected[j].ID })
+
+	c.Appointments = []int{}
+	for _, appointment := range affected {
+		if _, ok := st.closedFor[appointment.ID]; !ok {
+			st.closedFor[appointment.ID] = &closedBooking{was: appointment}
+		}
+		if c.Action == ClosureCancel {
+			delete(st.byID, appointment.ID)
+			st.addRevision(ctx, appointment, RevisionCancelled)
+		}
+		c.Appointments = append(c.Appointments, appointment.ID)
+	}
+	st.closures = append(st.closures, c)
+	return c, affected, nil
+}
+
+func (st *memoryStore) Closures(ctx context.Context, from, to time.Time) ([]Closure, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	closures := []Closure{}
+	for _, c := range st.closures {
+		if c.From <= last && c.To >= first {
+			closures = append(closures, c)
+		}
+	}
+	sort.SliceStable(closures, func(i, j int) bool { return closures[i].From < closures[j].From })
+	return closures, nil
+}
+
+func (st *memoryStore) Rebook(ctx context.Context, id int, visitDate time.Time, capacity int) (Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	closed, ok := st.closedFor[id]
+	if !ok {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	if closed.rebookedAs != 0 {
+		return Appointment{}, ErrAlreadyRebooked
+	}
+	date := visitDate.Format("2006-01-02")
+	if st.closed(date) {
+		return Appointment{}, ErrDayClosed
+	}
+
+	appointment, flagged := st.byID[id]
+	if !flagged {
+		appointment = closed.was
+		appointment.ID, appointment.CreatedAt, appointment.CheckedInAt = st.nextID, time.Now().UTC(), nil
+	}
+	if appointment.VisitDate != date && st.bookedBesides(closed, date)+appointment.PartySize() > st.limit(date, capacity) {
+		return Appointment{}, ErrDuplicateAppointment
+	}
+
+	appointment.VisitDate = date
+	st.byID[appointment.ID] = appointment
+	if flagged {
+		st.addRevision(ctx, appointment, RevisionRescheduled)
+	} else {
+		st.addRevision(ctx, appointment, RevisionCreated)
+		st.nextID++
+	}
+	closed.rebookedAs = appointment.ID
+	return st.view(appointment), nil
+}
+
+func (st *memoryStore) Hold(ctx context.Context, id int, visitDate, until time.Time, capacity int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	closed, ok := st.closedFor[id]
+	if !ok || closed.rebookedAs != 0 {
+		return ErrAppointmentNotFound
+	}
+	date := visitDate.Format("2006-01-02")
+	if st.closed(date) {
+		return ErrDayClosed
+	}
+	if st.bookedBesides(closed, date)+closed.was.PartySize() > st.limit(date, capacity) {
+		return ErrDuplicateAppointment
+	}
+	closed.heldOn, closed.heldUntil = date, until.UTC()
+	return nil
+}
+
+func (st *memoryStore) Proposal(ctx context.Context, id int) (RebookProposal, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	closed, ok := st.closedFor[id]
+	switch {
+	case !ok || closed.heldOn == "":
+		return RebookProposal{}, ErrAppointmentNotFound
+	case closed.rebookedAs != 0:
+		return RebookProposal{}, ErrAlreadyRebooked
+	}
+	return RebookProposal{AppointmentID: id, VisitDate: closed.heldOn, HeldUntil: closed.heldUntil}, nil
+}
+
+func (st *memoryStore) CreatePerson(ctx context.Context, p Person) (Person, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	p.ID = st.nextPerID
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	st.persons[p.ID] = p
+	st.nextPerID++
+	return p, nil
+}
+
+func (st *memoryStore) UpdatePerson(ctx context.Context, p Person) (Person, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	existing, ok := st.persons[p.ID]
+	if !ok {
+		return Person{}, ErrPersonNotFound
+	}
+	p.CreatedAt = existing.CreatedAt
+	p.UpdatedAt = time.Now().UTC()
+	st.persons[p.ID] = p
+
+	ids := make([]int, 0, len(st.byID))
+	for id, appointment := range st.byID {
+		if appointment.PersonID == p.ID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		st.addRevision(ctx, st.byID[id], RevisionPersonUpdated)
+	}
+	return p, nil
+}
+
+func (st *memoryStore) GetPerson(ctx context.Context, id int) (Person, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	p, ok := st.persons[id]
+	if !ok {
+		return Person{}, ErrPersonNotFound
+	}
+	return p, nil
+}
+
+func (st *memoryStore) PersonAppointments(ctx context.Context, id int) ([]Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.persons[id]; !ok {
+		return nil, ErrPersonNotFound
+	}
+	appointments := []Appointment{}
+	for _, appointment := range st.byID {
+		if appointment.PersonID == id {
+			appointments = append(appointments, st.view(appointment))
+		}
+	}
+	sortByVisitDate(appointments)
+	return appointments, nil
+}
+
+func (st *memoryStore) AppointmentsLike(ctx context.Context, lastName, email string) ([]Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	appointments := []Appointment{}
+	for _, appointment := range st.byID {
+		a := st.view(appointment)
+		if strings.EqualFold(a.LastName, lastName) || (a.Email != "" && strings.EqualFold(a.Email, email)) {
+			appointments = append(appointments, a)
+		}
+	}
+	sortByVisitDate(appointments)
+	return appointments, nil
+}
+
+// Moved first and put back if anything doesn't fit
+func (st *memoryStore) Rebalance(ctx context.Context, plan RebalancePlan, capacities map[string]int) ([]Appointment, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, move := range plan.Moves {
+		appointment, ok := st.byID[move.AppointmentID]
+		if !ok || appointment.VisitDate != plan.VisitDate || appointment.CheckedInAt != nil {
+			return nil, ErrPlanStale
+		}
+		if st.closed(move.ToDate) {
+			return nil, ErrDayClosed
+		}
+	}
+
+	was := map[int]Appointment{}
+	undo := func() {
+		for id, appointment := range was {
+			st.byID[id] = appointment
+		}
+	}
+	for _, move := range plan.Moves {
+		appointment := st.byID[move.AppointmentID]
+		if _, ok := was[appointment.ID]; ok {
+			undo()
+			return nil, ErrPlanStale
+		}
+		was[appointment.ID] = appointment
+		appointment.VisitDate = move.ToDate
+		st.byID[appointment.ID] = appointment
+	}
+	for _, move := range plan.Moves {
+		if st.booked(move.ToDate) > st.limit(move.ToDate, capacities[move.ToDate]) {
+			undo()
+			return nil, ErrDuplicateAppointment
+		}
+	}
+	if st.booked(plan.VisitDate) > plan.Capacity {
+		undo()
+		return nil, ErrPlanStale
+	}
+
+	st.cuts[plan.VisitDate] = plan.Capacity
+	moved := []Appointment{}
+	for _, move := range plan.Moves {
+		appointment := st.byID[move.AppointmentID]
+		st.addRevision(ctx, appointment, RevisionRescheduled)
+		moved = append(moved, st.view(appointment))
+	}
+	return moved, nil
+}
+
+func (st *memoryStore) CapacityCuts(ctx context.Context, from, to time.Time) (map[string]int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	cuts := map[string]int{}
+	for date, capacity := range st.cuts {
+		if date >= first && date <= last {
+			cuts[date] = capacity
+		}
+	}
+	return cuts, nil
+}
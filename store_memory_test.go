@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Same rules as the SQLite store, with no database at all
+func TestMemoryStoreAppointments(t *testing.T) {
+	server := NewServer(nil)
+	if err := server.initDB(); err != nil {
+		t.Fatalf("Failed to init memory store: %v", err)
+	}
+	server.yearStr = "2075"
+	fakeToday, _ := time.Parse("2006-01-02", "2075-01-01")
+	server.todayOverride = &fakeToday
+	router := server.routes()
+
+	req := AppointmentRequest{FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-15"}
+	if resp := postAppointment(t, router, req); resp.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for first appointment, got %d", resp.Code)
+	}
+	if resp := postAppointment(t, router, req); resp.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate appointment, got %d", resp.Code)
+	}
+
+	booked, _ := server.store.Booked(context.Background(), time.Date(2075, 6, 15, 0, 0, 0, 0, time.UTC))
+	if booked != 1 {
+		t.Error("Expected the memory store to have the appointment")
+	}
+}
@@ -0,0 +1,1293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The hot statements are prepared once in Init. database/sql keeps a
+// prepared copy on each pooled connection, so after warm up a booking
+// doesn't pay for parsing its SQL again
+type sqliteStore struct {
+	db *sql.DB
+
+	bookedStmt       *sql.Stmt
+	insertPersonStmt *sql.Stmt
+	insertStmt       *sql.Stmt
+	attendeeStmt     *sql.Stmt
+	attendanceStmt   *sql.Stmt
+	closedStmt       *sql.Stmt
+	cutStmt          *sql.Stmt
+
+	revisionStmt *sql.Stmt
+
+	// Writes down each change, in the same transaction. A revision
+	// normally, the event store swaps in its event log
+	record func(ctx context.Context, tx *sql.Tx, appointment Appointment, change string) error
+}
+
+func newSQLiteStore(db *sql.DB) *sqliteStore {
+	st := &sqliteStore{db: db}
+	st.record = st.addRevision
+	return st
+}
+
+// An appointment is a person on a day, the person's details live in persons.
+// Anyone else coming along comes back as one JSON array, so it's still a row per booking
+const appointmentSelect = `
+	SELECT a.id, a.person_id, p.first_name, p.last_name, p.email, a.visit_date, a.created_at, p.preferred_language,
+		(SELECT json_group_array(json_object('firstName', t.first_name, 'lastName', t.last_name) ORDER BY t.position)
+		FROM appointment_attendees t WHERE t.appointment_id = a.id), a.booked_by, a.checked_in_at, a.channel, a.service, a.custom_fields, a.address, a.consent, a.experiments, a.follow_up_of, p.title, p.preferred_name
+	FROM appointments a JOIN persons p ON p.id = a.person_id`
+
+// Places taken, one for each booking and one for each attendee on it
+const placesTaken = "1 + (SELECT COUNT(*) FROM appointment_attendees t WHERE t.appointment_id = a.id)"
+
+const appointmentsTable = `
+	CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		person_id INTEGER NOT NULL REFERENCES persons (id),
+		visit_date TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		booked_by TEXT,
+		checked_in_at DATETIME,
+		channel TEXT NOT NULL DEFAULT 'online',
+		service TEXT NOT NULL DEFAULT '',
+		custom_fields TEXT NOT NULL DEFAULT '{}',
+		address TEXT,
+		consent TEXT,
+		experiments TEXT,
+		follow_up_of INTEGER
+	)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAppointment(row rowScanner) (Appointment, error) {
+	var a Appointment
+	var attendees, customFields string
+	var bookedBy, address, consent, experiments sql.NullString
+	var followUpOf sql.NullInt64
+	var checkedInAt sql.NullTime
+	err := row.Scan(&a.ID, &a.PersonID, &a.FirstName, &a.LastName, &a.Email, &a.VisitDate, &a.CreatedAt, &a.PreferredLanguage, &attendees, &bookedBy, &checkedInAt, &a.Channel, &a.Service, &customFields, &address, &consent, &experiments, &followUpOf, &a.Title, &a.PreferredName)
+	if err != nil {
+		return a, err
+	}
+	if a.CustomFields, err = decodeCustomFields(customFields); err != nil {
+		return a, err
+	}
+	if a.Address, err = decodeAddress(address); err != nil {
+		return a, err
+	}
+	if a.Consent, err = decodeConsent(consent); err != nil {
+		return a, err
+	}
+	if a.Experiments, err = decodeExperiments(experiments); err != nil {
+		return a, err
+	}
+	a.FollowUpOf = int(followUpOf.Int64)
+	if checkedInAt.Valid {
+		a.CheckedInAt = &checkedInAt.Time
+	}
+	if a.Attendees, err = decodeAttendees(attendees); err != nil {
+		return a, err
+	}
+	a.BookedBy, err = decodeBookedBy(bookedBy)
+	return a, err
+}
+
+// Columns added over time, for databases created before them. New ones
+// go on the end
+var addedColumns = []struct{ table, column, definition string }{
+	{"appointments", "booked_by", "TEXT"},
+	{"appointments", "checked_in_at", "DATETIME"},
+	{"appointments", "channel", "TEXT NOT NULL DEFAULT 'online'"},
+	{"appointment_revisions", "person_id", "INTEGER NOT NULL DEFAULT 0"},
+	{"appointment_revisions", "attendees", "TEXT NOT NULL DEFAULT '[]'"},
+	{"appointment_revisions", "booked_by", "TEXT"},
+	{"appointment_revisions", "checked_in_at", "DATETIME"},
+	{"appointment_revisions", "channel", "TEXT NOT NULL DEFAULT 'online'"},
+	{"appointments", "service", "TEXT NOT NULL DEFAULT ''"},
+	{"appointment_revisions", "service", "TEXT NOT NULL DEFAULT ''"},
+	{"appointments", "custom_fields", "TEXT NOT NULL DEFAULT '{}'"},
+	{"appointment_revisions", "custom_fields", "TEXT NOT NULL DEFAULT '{}'"},
+	{"closure_appointments", "places", "INTEGER NOT NULL DEFAULT 1"},
+	{"closure_appointments", "held_on", "TEXT"},
+	{"closure_appointments", "held_until", "DATETIME"},
+	{"appointments", "address", "TEXT"},
+	{"appointment_revisions", "address", "TEXT"},
+	{"appointments", "consent", "TEXT"},
+	{"appointment_revisions", "consent", "TEXT"},
+	{"appointments", "experiments", "TEXT"},
+	{"appointment_revisions", "experiments", "TEXT"},
+	{"appointments", "follow_up_of", "INTEGER"},
+	{"appointment_revisions", "follow_up_of", "INTEGER"},
+	{"persons", "title", "TEXT NOT NULL DEFAULT ''"},
+	{"persons", "preferred_name", "TEXT NOT NULL DEFAULT ''"},
+	{"appointment_revisions", "title", "TEXT NOT NULL DEFAULT ''"},
+	{"appointment_revisions", "preferred_name", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// Setup table for above appoiuntment
+func (st *sqliteStore) Init() error {
+	if err := st.initPersons(); err != nil {
+		return err
+	}
+
+	if _, err := st.db.Exec(fmt.Sprintf(appointmentsTable, "appointments")); err != nil {
+		return err
+	}
+
+	// Databases from before persons had the details on every booking
+	if err := st.migrateToPersons(); err != nil {
+		return fmt.Errorf("failed to move appointment details into persons: %w", err)
+	}
+	// And only one booking a day
+	if err := st.dropUniqueVisitDate(); err != nil {
+		return fmt.Errorf("failed to allow more than one booking a day: %w", err)
+	}
+	if _, err := st.db.Exec("CREATE INDEX IF NOT EXISTS appointments_by_person ON appointments (person_id)"); err != nil {
+		return err
+	}
+	if _, err := st.db.Exec("CREATE INDEX IF NOT EXISTS appointments_by_date ON appointments (visit_date)"); err != nil {
+		return err
+	}
+	if _, err := st.db.Exec("CREATE INDEX IF NOT EXISTS persons_by_last_name ON persons (lower(last_name))"); err != nil {
+		return err
+	}
+	if _, err := st.db.Exec("CREATE INDEX IF NOT EXISTS persons_by_email ON persons (lower(email))"); err != nil {
+		return err
+	}
+
+	// The rest of a group booking, in the order they were given
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS appointment_attendees (
+		appointment_id INTEGER NOT NULL REFERENCES appointments (id),
+		position INTEGER NOT NULL,
+		first_name TEXT NOT NULL,
+		last_name TEXT NOT NULL,
+		PRIMARY KEY (appointment_id, position)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// A full copy of every version, written in the same transaction as the change
+	_, err = st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS appointment_revisions (
+		appointment_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		change TEXT NOT NULL,
+		changed_by TEXT NOT NULL,
+		changed_at DATETIME NOT NULL,
+		first_name TEXT NOT NULL,
+		last_name TEXT NOT NULL,
+		email TEXT NOT NULL,
+		visit_date TEXT NOT NULL,
+		preferred_language TEXT NOT NULL,
+		PRIMARY KEY (appointment_id, version)
+	)`)
+	if err != nil {
+		return err
+	}
+	if err := st.initClosures(); err != nil {
+		return err
+	}
+	_, err = st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS capacity_cuts (
+		visit_date TEXT PRIMARY KEY,
+		capacity INTEGER NOT NULL,
+		cut_by TEXT NOT NULL,
+		cut_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	for _, c := range addedColumns {
+		if err := addColumnIfMissing(st.db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// Bookings from before there was a history start with what they are now
+	_, err = st.db.Exec(`
+	INSERT INTO appointment_revisions (appointment_id, version, change, changed_by, changed_at, person_id, first_name, last_name, email, visit_date, preferred_language)
+	SELECT a.id, 1, 'created', 'unknown', COALESCE(a.created_at, CURRENT_TIMESTAMP), a.person_id, p.first_name, p.last_name, p.email, a.visit_date, p.preferred_language
+	FROM appointments a JOIN persons p ON p.id = a.person_id
+	WHERE a.id NOT IN (SELECT appointment_id FROM appointment_revisions)`)
+	if err != nil {
+		return err
+	}
+	return st.prepare()
+}
+
+// Each old booking becomes a person of its own, staff can merge the
+// ones that are the same person afterwards
+func (st *sqliteStore) migrateToPersons() error {
+	legacy, err := hasColumn(st.db, "appointments", "first_name")
+	if err != nil || !legacy {
+		return err
+	}
+
+	// Columns added to the original table over time, for databases created before them
+	if err := addColumnIfMissing(st.db, "appointments", "email", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(st.db, "appointments", "preferred_language", "TEXT NOT NULL DEFAULT 'en'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(st.db, "appointments", "person_id", "INTEGER REFERENCES persons (id)"); err != nil {
+		return err
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, first_name, last_name, email, preferred_language, created_at FROM appointments WHERE person_id IS NULL")
+	if err != nil {
+		return err
+	}
+	var people []Person
+	var appointmentIDs []int
+	for rows.Next() {
+		var id int
+		var p Person
+		var createdAt sql.NullTime
+		if err := rows.Scan(&id, &p.FirstName, &p.LastName, &p.Email, &p.PreferredLanguage, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		p.CreatedAt = createdAt.Time
+		if !createdAt.Valid {
+			p.CreatedAt = time.Now().UTC()
+		}
+		people = append(people, p)
+		appointmentIDs = append(appointmentIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, p := range people {
+		var personID int
+		err := tx.QueryRow(`INSERT INTO persons (first_name, last_name, email, preferred_language, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+			p.FirstName, p.LastName, p.Email, p.PreferredLanguage, p.CreatedAt, p.CreatedAt).Scan(&personID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE appointments SET person_id = ? WHERE id = ?", personID, appointmentIDs[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, column := range []string{"first_name", "last_name", "email", "preferred_language"} {
+		if _, err := tx.Exec("ALTER TABLE appointments DROP COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SQLite can't drop a constraint, so the table is copied into one without
+// it. Keeping the AUTOINCREMENT counter too, so cancelled bookings' IDs
+// aren't handed out again
+func (st *sqliteStore) dropUniqueVisitDate() error {
+	var ddl string
+	if err := st.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'appointments'").Scan(&ddl); err != nil {
+		return err
+	}
+	if !strings.Contains(strings.ToUpper(ddl), "UNIQUE") {
+		return nil
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var seq sql.NullInt64
+	if err := tx.QueryRow("SELECT MAX(seq) FROM sqlite_sequence WHERE name = 'appointments'").Scan(&seq); err != nil {
+		return err
+	}
+	statements := []string{
+		fmt.Sprintf(appointmentsTable, "appointments_rebuilt"),
+		"INSERT INTO appointments_rebuilt (id, person_id, visit_date, created_at) SELECT id, person_id, visit_date, created_at FROM appointments",
+		"DROP TABLE appointments",
+		"ALTER TABLE appointments_rebuilt RENAME TO appointments",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if seq.Valid {
+		if _, err := tx.Exec("UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = 'appointments'", seq.Int64); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Only once the table has all its columns
+func (st *sqliteStore) prepare() error {
+	var err error
+
+	// Places held for someone a closure cancelled count as taken, until
+	// they take it or the hold runs out
+	st.bookedStmt, err = st.db.Prepare(`
+		SELECT (SELECT COALESCE(SUM(` + placesTaken + `), 0) FROM appointments a WHERE a.visit_date = ?1)
+			+ (SELECT COALESCE(SUM(places), 0) FROM closure_appointments WHERE held_on = ?1 AND held_until > ?2 AND rebooked_as IS NULL)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare booked: %w", err)
+	}
+
+	st.insertPersonStmt, err = st.db.Prepare(`
+		INSERT INTO persons (first_name, last_name, email, preferred_language, created_at, updated_at, title, preferred_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare person insert: %w", err)
+	}
+
+	st.insertStmt, err = st.db.Prepare(`
+		INSERT INTO appointments (person_id, visit_date, booked_by, channel, service, custom_fields, address, consent, experiments, follow_up_of)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+
+	st.attendeeStmt, err = st.db.Prepare("INSERT INTO appointment_attendees (appointment_id, position, first_name, last_name) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare attendee insert: %w", err)
+	}
+
+	st.attendanceStmt, err = st.db.Prepare(`
+		SELECT visit_date, SUM(places) FROM (
+			SELECT a.visit_date, ` + placesTaken + ` AS places FROM appointments a WHERE a.visit_date BETWEEN ?1 AND ?2
+			UNION ALL
+			SELECT held_on, places FROM closure_appointments WHERE held_on BETWEEN ?1 AND ?2 AND held_until > ?3 AND rebooked_as IS NULL)
+		GROUP BY visit_date`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare attendance: %w", err)
+	}
+
+	st.closedStmt, err = st.db.Prepare("SELECT EXISTS (SELECT 1 FROM closures WHERE ? BETWEEN starts_on AND ends_on)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare closed: %w", err)
+	}
+
+	st.cutStmt, err = st.db.Prepare("SELECT capacity FROM capacity_cuts WHERE visit_date = ?")
+	if err != nil {
+		return fmt.Errorf("failed to prepare capacity cut: %w", err)
+	}
+
+	st.revisionStmt, err = st.db.Prepare(`
+		INSERT INTO appointment_revisions (appointment_id, version, change, changed_by, changed_at, person_id, first_name, last_name, email, visit_date, preferred_language, attendees, booked_by, checked_in_at, channel, service, custom_fields, address, consent, experiments, follow_up_of, title, preferred_name)
+		SELECT ?, COALESCE(MAX(version), 0) + 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		FROM appointment_revisions WHERE appointment_id = ?`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare revision insert: %w", err)
+	}
+
+	return nil
+}
+
+// How full a day is already
+func (st *sqliteStore) Booked(ctx context.Context, visitDate time.Time) (int, error) {
+	var count int
+	err := st.bookedStmt.QueryRowContext(ctx, visitDate.Format("2006-01-02"), time.Now().UTC()).Scan(&count)
+	return count, err
+}
+
+// Run after the write, in its transaction. The write took the lock, so
+// nobody else can have sneaked in since, and if the day's now over
+// capacity the whole thing is rolled back
+func (st *sqliteStore) checkCapacity(ctx context.Context, tx *sql.Tx, visitDate time.Time, capacity int) error {
+	var count, cut int
+	if err := tx.StmtContext(ctx, st.bookedStmt).QueryRowContext(ctx, visitDate.Format("2006-01-02"), time.Now().UTC()).Scan(&count); err != nil {
+		return err
+	}
+	// A day that's been rebalanced never takes more than it was cut to
+	switch err := tx.StmtContext(ctx, st.cutStmt).QueryRowContext(ctx, visitDate.Format("2006-01-02")).Scan(&cut); {
+	case err == nil:
+		capacity = min(capacity, cut)
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	if count > capacity {
+		return ErrDuplicateAppointment
+	}
+	return nil
+}
+
+// Also after the write, so a closure going in at the same time either
+// comes first and is seen here, or comes after and sweeps the booking up
+func (st *sqliteStore) checkOpen(ctx context.Context, tx *sql.Tx, visitDate time.Time) error {
+	var closed bool
+	if err := tx.StmtContext(ctx, st.closedStmt).QueryRowContext(ctx, visitDate.Format("2006-01-02")).Scan(&closed); err != nil {
+		return err
+	}
+	if closed {
+		return ErrDayClosed
+	}
+	return nil
+}
+
+// Every write starts with a statement that takes the write lock, does
+// its thing, reads back the appointment and records the change, all in
+// one transaction
+func (st *sqliteStore) change(ctx context.Context, change string, do func(tx *sql.Tx) (int, error)) (Appointment, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Appointment{}, err
+	}
+	defer tx.Rollback()
+
+	id, err := do(tx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	if isUniqueViolation(err) {
+		return Appointment{}, ErrDuplicateAppointment
+	}
+	if err != nil {
+		return Appointment{}, err
+	}
+
+	appointment, err := scanAppointment(tx.QueryRowContext(ctx, appointmentSelect+" WHERE a.id = ?", id))
+	if err != nil {
+		return Appointment{}, err
+	}
+
+	if err := st.record(ctx, tx, appointment, change); err != nil {
+		return Appointment{}, err
+	}
+	return appointment, tx.Commit()
+}
+
+// Two requests for the last places can both get past Booked,
+// checkCapacity catches the loser, and takes the new person with it
+func (st *sqliteStore) Create(ctx context.Context, req AppointmentRequest, visitDate time.Time, capacity int) (Appointment, error) {
+	return st.change(ctx, RevisionCreated, func(tx *sql.Tx) (int, error) {
+		now := time.Now().UTC()
+		personID, id := req.PersonID, 0
+		if personID == 0 {
+			err := tx.StmtContext(ctx, st.insertPersonStmt).QueryRowContext(ctx, req.FirstName, req.LastName, req.Email, req.PreferredLanguage, now, now, req.Title, req.PreferredName).Scan(&personID)
+			if err != nil {
+				return 0, err
+			}
+		}
+		var createdAt time.Time
+		if err := tx.StmtContext(ctx, st.insertStmt).QueryRowContext(ctx, personID, visitDate.Format("2006-01-02"), encodeBookedBy(req.BookedBy), channelOrOnline(req.Channel), req.Service, encodeCustomFields(req.CustomFields), encodeAddress(req.Address), encodeConsent(req.Consent), encodeExperiments(req.Experiments), encodeFollowUpOf(req.FollowUpOf)).Scan(&id, &createdAt); err != nil {
+			return 0, err
+		}
+		for i, attendee := range req.Attendees {
+			if _, err := tx.StmtContext(ctx, st.attendeeStmt).ExecContext(ctx, id, i+1, attendee.FirstName, attendee.LastName); err != nil {
+				return 0, err
+			}
+		}
+		if err := st.checkOpen(ctx, tx, visitDate); err != nil {
+			return 0, err
+		}
+		return id, st.checkCapacity(ctx, tx, visitDate, capacity)
+	})
+}
+
+func (st *sqliteStore) Reschedule(ctx context.Context, id int, visitDate time.Time, capacity int) (Appointment, error) {
+	return st.change(ctx, RevisionRescheduled, func(tx *sql.Tx) (int, error) {
+		err := tx.QueryRowContext(ctx, "UPDATE appointments SET visit_date = ? WHERE id = ? RETURNING id", visitDate.Format("2006-01-02"), id).Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		if err := st.checkOpen(ctx, tx, visitDate); err != nil {
+			return 0, err
+		}
+		return id, st.checkCapacity(ctx, tx, visitDate, capacity)
+	})
+}
+
+// Checked-in bookings are left alone, they've a ticket in the old queue.
+// Staying on the same day doesn't change how many are coming, so only a
+// move to another day is checked against its capacity, a day that's over
+// its cut already still lets them change service
+func (st *sqliteStore) Transfer(ctx context.Context, id int, service string, fields CustomFields, visitDate time.Time, capacity int) (Appointment, error) {
+	return st.change(ctx, RevisionTransferred, func(tx *sql.Tx) (int, error) {
+		var was string
+		err := tx.QueryRowContext(ctx, "UPDATE appointments SET service = ?, custom_fields = ? WHERE id = ? AND checked_in_at IS NULL RETURNING visit_date",
+			service, encodeCustomFields(fields), id).Scan(&was)
+		if errors.Is(err, sql.ErrNoRows) {
+			var exists int
+			if tx.QueryRowContext(ctx, "SELECT 1 FROM appointments WHERE id = ?", id).Scan(&exists) == nil {
+				return 0, ErrAlreadyCheckedIn
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := st.checkOpen(ctx, tx, visitDate); err != nil {
+			return 0, err
+		}
+		if was == visitDate.Format("2006-01-02") {
+			return id, nil
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE appointments SET visit_date = ? WHERE id = ?", visitDate.Format("2006-01-02"), id); err != nil {
+			return 0, err
+		}
+		return id, st.checkCapacity(ctx, tx, visitDate, capacity)
+	})
+}
+
+// The row goes, the person and the revisions stay. Deleted first and the
+// person read back afterwards, so the write lock is taken straight away
+func (st *sqliteStore) Cancel(ctx context.Context, id int) (Appointment, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Appointment{}, err
+	}
+	defer tx.Rollback()
+
+	var appointment Appointment
+	var bookedBy, address, consent, experiments sql.NullString
+	var followUpOf sql.NullInt64
+	var checkedInAt sql.NullTime
+	var customFields string
+	err = tx.QueryRowContext(ctx, "DELETE FROM appointments WHERE id = ? RETURNING id, person_id, visit_date, created_at, booked_by, checked_in_at, channel, service, custom_fields, address, consent, experiments, follow_up_of", id).Scan(
+		&appointment.ID, &appointment.PersonID, &appointment.VisitDate, &appointment.CreatedAt, &bookedBy, &checkedInAt, &appointment.Channel, &appointment.Service, &customFields, &address, &consent, &experiments, &followUpOf)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	if err != nil {
+		return Appointment{}, err
+	}
+	if checkedInAt.Valid {
+		appointment.CheckedInAt = &checkedInAt.Time
+	}
+	if appointment.BookedBy, err = decodeBookedBy(bookedBy); err != nil {
+		return Appointment{}, err
+	}
+	if appointment.CustomFields, err = decodeCustomFields(customFields); err != nil {
+		return Appointment{}, err
+	}
+	if appointment.Address, err = decodeAddress(address); err != nil {
+		return Appointment{}, err
+	}
+	if appointment.Consent, err = decodeConsent(consent); err != nil {
+		return Appointment{}, err
+	}
+	if appointment.Experiments, err = decodeExperiments(experiments); err != nil {
+		return Appointment{}, err
+	}
+	appointment.FollowUpOf = int(followUpOf.Int64)
+
+	var attendees string
+	err = tx.QueryRowContext(ctx, `
+		SELECT first_name, last_name, email, preferred_language, title, preferred_name,
+			(SELECT json_group_array(json_object('firstName', t.first_name, 'lastName', t.last_name) ORDER BY t.position)
+			FROM appointment_attendees t WHERE t.appointment_id = ?)
+		FROM persons WHERE id = ?`, appointment.ID, appointment.PersonID).Scan(
+		&appointment.FirstName, &appointment.LastName, &appointment.Email, &appointment.PreferredLanguage, &appointment.Title, &appointment.PreferredName, &attendees)
+	if err != nil {
+		return Appointment{}, err
+	}
+	if appointment.Attendees, err = decodeAttendees(attendees); err != nil {
+		return Appointment{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM appointment_attendees WHERE appointment_id = ?", appointment.ID); err != nil {
+		return Appointment{}, err
+	}
+
+	if err := st.record(ctx, tx, appointment, RevisionCancelled); err != nil {
+		return Appointment{}, err
+	}
+	return appointment, tx.Commit()
+}
+
+// Points the merged booking at the kept one's person
+func (st *sqliteStore) Merge(ctx context.Context, keep, merge int) (Appointment, error) {
+	return st.change(ctx, RevisionMerged, func(tx *sql.Tx) (int, error) {
+		var id int
+		err := tx.QueryRowContext(ctx, `
+			UPDATE appointments SET person_id = (SELECT person_id FROM appointments WHERE id = ?)
+			WHERE id = ? AND EXISTS (SELECT 1 FROM appointments WHERE id = ?)
+			RETURNING id`, keep, merge, keep).Scan(&id)
+		return id, err
+	})
+}
+
+func (st *sqliteStore) Get(ctx context.Context, id int) (Appointment, error) {
+	appointment, err := scanAppointment(st.db.QueryRowContext(ctx, appointmentSelect+" WHERE a.id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	return appointment, err
+}
+
+// Only the first check in is a change. After that the update finds
+// nothing to do, and they get the appointment as it is
+func (st *sqliteStore) CheckIn(ctx context.Context, id int) (Appointment, error) {
+	appointment, err := st.change(ctx, RevisionCheckedIn, func(tx *sql.Tx) (int, error) {
+		err := tx.QueryRowContext(ctx, "UPDATE appointments SET checked_in_at = ? WHERE id = ? AND checked_in_at IS NULL RETURNING id", time.Now().UTC(), id).Scan(&id)
+		return id, err
+	})
+	if errors.Is(err, ErrAppointmentNotFound) {
+		return st.Get(ctx, id)
+	}
+	return appointment, err
+}
+
+func (st *sqliteStore) Confirm(ctx context.Context, id int) (Appointment, error) {
+	return st.change(ctx, RevisionConfirmed, func(tx *sql.Tx) (int, error) {
+		err := tx.QueryRowContext(ctx, "SELECT id FROM appointments WHERE id = ?", id).Scan(&id)
+		return id, err
+	})
+}
+
+// Closures, and each booking one affected as it was then. rebooked_as
+// is the booking it became once it's been rebooked
+func (st *sqliteStore) initClosures() error {
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS closures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		starts_on TEXT NOT NULL,
+		ends_on TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		action TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS closure_appointments (
+		appointment_id INTEGER PRIMARY KEY,
+		closure_id INTEGER NOT NULL REFERENCES closures (id),
+		appointment TEXT NOT NULL,
+		rebooked_as INTEGER
+	)`)
+	return err
+}
+
+// The closure goes in first, which takes the write lock, so no booking
+// can land on those days between finding them and cancelling them
+func (st *sqliteStore) Close(ctx context.Context, c Closure) (Closure, []Appointment, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Closure{}, nil, err
+	}
+	defer tx.Rollback()
+
+	c.CreatedBy, c.CreatedAt = actorFrom(ctx), time.Now().UTC()
+	err = tx.QueryRowContext(ctx, "INSERT INTO closures (starts_on, ends_on, reason, action, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		c.From, c.To, c.Reason, c.Action, c.CreatedBy, c.CreatedAt).Scan(&c.ID)
+	if err != nil {
+		return Closure{}, nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, appointmentSelect+" WHERE a.visit_date BETWEEN ? AND ? ORDER BY a.id", c.From, c.To)
+	if err != nil {
+		return Closure{}, nil, err
+	}
+	affected := []Appointment{}
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			rows.Close()
+			return Closure{}, nil, err
+		}
+		affected = append(affected, appointment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Closure{}, nil, err
+	}
+
+	c.Appointments = []int{}
+	for _, appointment := range affected {
+		data, _ := json.Marshal(appointment)
+		// A flagged one still on a day that's closed again stays with the first closure
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO closure_appointments (appointment_id, closure_id, appointment, places) VALUES (?, ?, ?, ?)", appointment.ID, c.ID, string(data), appointment.PartySize()); err != nil {
+			return Closure{}, nil, err
+		}
+		if c.Action == ClosureCancel {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM appointment_attendees WHERE appointment_id = ?", appointment.ID); err != nil {
+				return Closure{}, nil, err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM appointments WHERE id = ?", appointment.ID); err != nil {
+				return Closure{}, nil, err
+			}
+			if err := st.record(ctx, tx, appointment, RevisionCancelled); err != nil {
+				return Closure{}, nil, err
+			}
+		}
+		c.Appointments = append(c.Appointments, appointment.ID)
+	}
+	return c, affected, tx.Commit()
+}
+
+func (st *sqliteStore) Closures(ctx context.Context, from, to time.Time) ([]Closure, error) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT c.id, c.starts_on, c.ends_on, c.reason, c.action, c.created_by, c.created_at,
+			(SELECT json_group_array(t.appointment_id ORDER BY t.appointment_id) FROM closure_appointments t WHERE t.closure_id = c.id)
+		FROM closures c WHERE c.starts_on <= ? AND c.ends_on >= ?
+		ORDER BY c.starts_on, c.id`, to.Format("2006-01-02"), from.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	closures := []Closure{}
+	for rows.Next() {
+		var c Closure
+		var appointments string
+		if err := rows.Scan(&c.ID, &c.From, &c.To, &c.Reason, &c.Action, &c.CreatedBy, &c.CreatedAt, &appointments); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(appointments), &c.Appointments); err != nil {
+			return nil, err
+		}
+		closures = append(closures, c)
+	}
+	return closures, rows.Err()
+}
+
+// Claimed first, which takes the write lock and stops the same link
+// being used twice at once. A flagged booking is still there to move,
+// a cancelled one goes back in for the same person as it was
+func (st *sqliteStore) Rebook(ctx context.Context, id int, visitDate time.Time, capacity int) (Appointment, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Appointment{}, err
+	}
+	defer tx.Rollback()
+
+	var data string
+	err = tx.QueryRowContext(ctx, "UPDATE closure_appointments SET rebooked_as = 0 WHERE appointment_id = ? AND rebooked_as IS NULL RETURNING appointment", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		var found int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM closure_appointments WHERE appointment_id = ?", id).Scan(&found); err != nil {
+			return Appointment{}, err
+		}
+		if found > 0 {
+			return Appointment{}, ErrAlreadyRebooked
+		}
+		return Appointment{}, ErrAppointmentNotFound
+	}
+	if err != nil {
+		return Appointment{}, err
+	}
+	var was Appointment
+	if err := json.Unmarshal([]byte(data), &was); err != nil {
+		return Appointment{}, err
+	}
+
+	date := visitDate.Format("2006-01-02")
+	change, newID := RevisionRescheduled, id
+	err = tx.QueryRowContext(ctx, "UPDATE appointments SET visit_date = ? WHERE id = ? RETURNING id", date, id).Scan(&newID)
+	if errors.Is(err, sql.ErrNoRows) {
+		change = RevisionCreated
+		newID, err = st.insertLike(ctx, tx, was, date)
+	}
+	if err != nil {
+		return Appointment{}, err
+	}
+	if err := st.checkOpen(ctx, tx, visitDate); err != nil {
+		return Appointment{}, err
+	}
+	if err := st.checkCapacity(ctx, tx, visitDate, capacity); err != nil {
+		return Appointment{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE closure_appointments SET rebooked_as = ? WHERE appointment_id = ?", newID, id); err != nil {
+		return Appointment{}, err
+	}
+
+	appointment, err := scanAppointment(tx.QueryRowContext(ctx, appointmentSelect+" WHERE a.id = ?", newID))
+	if err != nil {
+		return Appointment{}, err
+	}
+	if err := st.record(ctx, tx, appointment, change); err != nil {
+		return Appointment{}, err
+	}
+	return appointment, tx.Commit()
+}
+
+// The hold goes in first, which takes the write lock, and is then
+// counted with everything else on the day
+func (st *sqliteStore) Hold(ctx context.Context, id int, visitDate, until time.Time, capacity int) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "UPDATE closure_appointments SET held_on = ?, held_until = ? WHERE appointment_id = ? AND rebooked_as IS NULL RETURNING appointment_id",
+		visitDate.Format("2006-01-02"), until.UTC(), id).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrAppointmentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := st.checkOpen(ctx, tx, visitDate); err != nil {
+		return err
+	}
+	if err := st.checkCapacity(ctx, tx, visitDate, capacity); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st *sqliteStore) Proposal(ctx context.Context, id int) (RebookProposal, error) {
+	p := RebookProposal{AppointmentID: id}
+	var heldOn sql.NullString
+	var heldUntil sql.NullTime
+	var rebookedAs sql.NullInt64
+	err := st.db.QueryRowContext(ctx, "SELECT held_on, held_until, rebooked_as FROM closure_appointments WHERE appointment_id = ?", id).Scan(&heldOn, &heldUntil, &rebookedAs)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || (err == nil && !heldOn.Valid):
+		return RebookProposal{}, ErrAppointmentNotFound
+	case err != nil:
+		return RebookProposal{}, err
+	case rebookedAs.Valid:
+		return RebookProposal{}, ErrAlreadyRebooked
+	}
+	p.VisitDate, p.HeldUntil = heldOn.String, heldUntil.Time
+	return p, nil
+}
+
+// A new booking on date with everything else as it was
+func (st *sqliteStore) insertLike(ctx context.Context, tx *sql.Tx, was Appointment, date string) (int, error) {
+	var id int
+	var createdAt time.Time
+	err := tx.StmtContext(ctx, st.insertStmt).QueryRowContext(ctx, was.PersonID, date, encodeBookedBy(was.BookedBy), channelOrOnline(was.Channel), was.Service, encodeCustomFields(was.CustomFields), encodeAddress(was.Address), encodeConsent(was.Consent), encodeExperiments(was.Experiments), encodeFollowUpOf(was.FollowUpOf)).Scan(&id, &createdAt)
+	if err != nil {
+		return 0, err
+	}
+	for i, attendee := range was.Attendees {
+		if _, err := tx.StmtContext(ctx, st.attendeeStmt).ExecContext(ctx, id, i+1, attendee.FirstName, attendee.LastName); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+func (st *sqliteStore) addRevision(ctx context.Context, tx *sql.Tx, appointment Appointment, change string) error {
+	_, err := tx.StmtContext(ctx, st.revisionStmt).ExecContext(ctx,
+		appointment.ID, change, actorFrom(ctx), time.Now().UTC(), appointment.PersonID,
+		appointment.FirstName, appointment.LastName, appointment.Email, appointment.VisitDate, appointment.PreferredLanguage,
+		encodeAttendees(appointment.Attendees), encodeBookedBy(appointment.BookedBy), appointment.CheckedInAt, appointment.Channel, appointment.Service, encodeCustomFields(appointment.CustomFields), encodeAddress(appointment.Address), encodeConsent(appointment.Consent), encodeExperiments(appointment.Experiments), encodeFollowUpOf(appointment.FollowUpOf), appointment.Title, appointment.PreferredName, appointment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record revision: %w", err)
+	}
+	return nil
+}
+
+func (st *sqliteStore) History(ctx context.Context, id int) ([]Revision, error) {
+	revisions, err := st.revisions(ctx, "WHERE r.appointment_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, ErrAppointmentNotFound
+	}
+	return revisions, nil
+}
+
+func (st *sqliteStore) Revisions(ctx context.Context) ([]Revision, error) {
+	return st.revisions(ctx, "")
+}
+
+// Times are compared in Go rather than SQL, the drivers don't store them alike
+func (st *sqliteStore) List(ctx context.Context, asOf time.Time) ([]Appointment, error) {
+	if !asOf.IsZero() {
+		revisions, err := st.revisions(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		return appointmentsAsOf(revisions, asOf), nil
+	}
+
+	appointments := []Appointment{}
+	err := st.ForEach(ctx, func(appointment Appointment) error {
+		appointments = append(appointments, appointment)
+		return nil
+	})
+	sortByVisitDate(appointments)
+	return appointments, err
+}
+
+func (st *sqliteStore) revisions(ctx context.Context, where string, args ...any) ([]Revision, error) {
+	rows, err := st.db.QueryContext(ctx, `
+		SELECT r.appointment_id, r.version, r.change, r.changed_by, r.changed_at, r.person_id, r.first_name, r.last_name, r.email, r.visit_date, r.preferred_language, r.attendees, r.booked_by, r.checked_in_at, r.channel, r.service, r.custom_fields, r.address, r.consent, r.experiments, r.follow_up_of, r.title, r.preferred_name, a.created_at
+		FROM appointment_revisions r LEFT JOIN appointments a ON a.id = r.appointment_id
+		`+where+` ORDER BY r.appointment_id, r.version`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		var rev Revision
+		var attendees, customFields string
+		var bookedBy, address, consent, experiments sql.NullString
+		var followUpOf sql.NullInt64
+		var checkedInAt, createdAt sql.NullTime
+		err := rows.Scan(&rev.ID, &rev.Version, &rev.Change, &rev.ChangedBy, &rev.ChangedAt, &rev.PersonID,
+			&rev.FirstName, &rev.LastName, &rev.Email, &rev.VisitDate, &rev.PreferredLanguage, &attendees, &bookedBy, &checkedInAt, &rev.Channel, &rev.Service, &customFields, &address, &consent, &experiments, &followUpOf, &rev.Title, &rev.PreferredName, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		if checkedInAt.Valid {
+			rev.CheckedInAt = &checkedInAt.Time
+		}
+		if rev.Attendees, err = decodeAttendees(attendees); err != nil {
+			return nil, err
+		}
+		if rev.BookedBy, err = decodeBookedBy(bookedBy); err != nil {
+			return nil, err
+		}
+		if rev.CustomFields, err = decodeCustomFields(customFields); err != nil {
+			return nil, err
+		}
+		if rev.Address, err = decodeAddress(address); err != nil {
+			return nil, err
+		}
+		if rev.Consent, err = decodeConsent(consent); err != nil {
+			return nil, err
+		}
+		if rev.Experiments, err = decodeExperiments(experiments); err != nil {
+			return nil, err
+		}
+		rev.FollowUpOf = int(followUpOf.Int64)
+		rev.CreatedAt = createdAt.Time
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// The visit_date text sorts like a date, so BETWEEN works on it
+func (st *sqliteStore) Attendance(ctx context.Context, from, to time.Time) (map[string]int, error) {
+	rows, err := st.attendanceStmt.QueryContext(ctx, from.Format("2006-01-02"), to.Format("2006-01-02"), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attendance := map[string]int{}
+	for rows.Next() {
+		var date string
+		var count int
+		if err := rows.Scan(&date, &count); err != nil {
+			return nil, err
+		}
+		attendance[date] = count
+	}
+	return attendance, rows.Err()
+}
+
+// Only asked for with channel quotas, so not prepared
+func (st *sqliteStore) ChannelAttendance(ctx context.Context, from, to time.Time) (map[string]map[string]int, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT a.visit_date, a.channel, SUM("+placesTaken+") FROM appointments a WHERE a.visit_date BETWEEN ? AND ? GROUP BY a.visit_date, a.channel",
+		from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attendance := map[string]map[string]int{}
+	for rows.Next() {
+		var date, channel string
+		var count int
+		if err := rows.Scan(&date, &channel, &count); err != nil {
+			return nil, err
+		}
+		if attendance[date] == nil {
+			attendance[date] = map[string]int{}
+		}
+		attendance[date][channel] = count
+	}
+	return attendance, rows.Err()
+}
+
+// Read a page at a time by ID, so this works for any size of table. Each
+// page is its own short read, done with before fn sees any of it: an
+// export streaming to a slow client would otherwise hold a read lock the
+// whole time, and without WAL that keeps every booking waiting. So it's
+// not a snapshot, a booking made part way through is in it if its ID
+// comes later. Not prepared, it only runs for exports
+func (st *sqliteStore) ForEach(ctx context.Context, fn func(Appointment) error) error {
+	for after := 0; ; {
+		page, err := st.appointmentsPage(ctx, after)
+		if err != nil {
+			return err
+		}
+		for _, appointment := range page {
+			if err := fn(appointment); err != nil {
+				return err
+			}
+		}
+		if len(page) < forEachPage {
+			return nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+const forEachPage = 500
+
+func (st *sqliteStore) appointmentsPage(ctx context.Context, after int) ([]Appointment, error) {
+	rows, err := st.db.QueryContext(ctx, appointmentSelect+" WHERE a.id > ? ORDER BY a.id LIMIT ?", after, forEachPage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []Appointment
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, appointment)
+	}
+	return page, rows.Err()
+}
+
+func (st *sqliteStore) initPersons() error {
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS persons (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		first_name TEXT NOT NULL,
+		last_name TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		preferred_language TEXT NOT NULL DEFAULT 'en',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		preferred_name TEXT NOT NULL DEFAULT ''
+	)`)
+	return err
+}
+
+const personSelect = "SELECT id, first_name, last_name, email, preferred_language, created_at, updated_at, title, preferred_name FROM persons"
+
+func scanPerson(row rowScanner) (Person, error) {
+	var p Person
+	err := row.Scan(&p.ID, &p.FirstName, &p.LastName, &p.Email, &p.PreferredLanguage, &p.CreatedAt, &p.UpdatedAt, &p.Title, &p.PreferredName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Person{}, ErrPersonNotFound
+	}
+	return p, err
+}
+
+func (st *sqliteStore) CreatePerson(ctx context.Context, p Person) (Person, error) {
+	now := time.Now().UTC()
+	return scanPerson(st.db.QueryRowContext(ctx, `
+		INSERT INTO persons (first_name, last_name, email, preferred_language, created_at, updated_at, title, preferred_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, first_name, last_name, email, preferred_language, created_at, updated_at, title, preferred_name`,
+		p.FirstName, p.LastName, p.Email, p.PreferredLanguage, now, now, p.Title, p.PreferredName))
+}
+
+// Each of their bookings gets a revision, so its history shows the new
+// details and who changed them
+func (st *sqliteStore) UpdatePerson(ctx context.Context, p Person) (Person, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Person{}, err
+	}
+	defer tx.Rollback()
+
+	p, err = scanPerson(tx.QueryRowContext(ctx, `
+		UPDATE persons SET first_name = ?, last_name = ?, email = ?, preferred_language = ?, updated_at = ?, title = ?, preferred_name = ?
+		WHERE id = ?
+		RETURNING id, first_name, last_name, email, preferred_language, created_at, updated_at, title, preferred_name`,
+		p.FirstName, p.LastName, p.Email, p.PreferredLanguage, time.Now().UTC(), p.Title, p.PreferredName, p.ID))
+	if err != nil {
+		return Person{}, err
+	}
+
+	rows, err := tx.QueryContext(ctx, appointmentSelect+" WHERE a.person_id = ? ORDER BY a.id", p.ID)
+	if err != nil {
+		return Person{}, err
+	}
+	var affected []Appointment
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			rows.Close()
+			return Person{}, err
+		}
+		affected = append(affected, appointment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Person{}, err
+	}
+	for _, appointment := range affected {
+		if err := st.record(ctx, tx, appointment, RevisionPersonUpdated); err != nil {
+			return Person{}, err
+		}
+	}
+	return p, tx.Commit()
+}
+
+func (st *sqliteStore) GetPerson(ctx context.Context, id int) (Person, error) {
+	return scanPerson(st.db.QueryRowContext(ctx, personSelect+" WHERE id = ?", id))
+}
+
+func (st *sqliteStore) PersonAppointments(ctx context.Context, id int) ([]Appointment, error) {
+	if _, err := st.GetPerson(ctx, id); err != nil {
+		return nil, err
+	}
+
+	return st.appointmentsWhere(ctx, "a.person_id = ?", id)
+}
+
+// Each side of the OR has its index on persons, and then appointments_by_person
+func (st *sqliteStore) AppointmentsLike(ctx context.Context, lastName, email string) ([]Appointment, error) {
+	return st.appointmentsWhere(ctx, `a.person_id IN (
+		SELECT id FROM persons WHERE lower(last_name) = lower(?)
+		UNION SELECT id FROM persons WHERE lower(email) = lower(?) AND email != '')`, lastName, email)
+}
+
+func (st *sqliteStore) appointmentsWhere(ctx context.Context, where string, args ...any) ([]Appointment, error) {
+	rows, err := st.db.QueryContext(ctx, appointmentSelect+" WHERE "+where+" ORDER BY a.visit_date", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appointments := []Appointment{}
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			return nil, err
+		}
+		appointments = append(appointments, appointment)
+	}
+	return appointments, rows.Err()
+}
+
+// SQLite has no ADD COLUMN IF NOT EXISTS, so check table_info first
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// The cut goes in first, which takes the write lock, then each move
+// checks the booking is still on the day and goes under its new day's
+// capacity, and last the day itself has to fit what it's been cut to
+func (st *sqliteStore) Rebalance(ctx context.Context, plan RebalancePlan, capacities map[string]int) ([]Appointment, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO capacity_cuts (visit_date, capacity, cut_by, cut_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (visit_date) DO UPDATE SET capacity = excluded.capacity, cut_by = excluded.cut_by, cut_at = excluded.cut_at`,
+		plan.VisitDate, plan.Capacity, actorFrom(ctx), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	moved := []Appointment{}
+	for _, move := range plan.Moves {
+		id := move.AppointmentID
+		err := tx.QueryRowContext(ctx, "UPDATE appointments SET visit_date = ? WHERE id = ? AND visit_date = ? AND checked_in_at IS NULL RETURNING id", move.ToDate, id, plan.VisitDate).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPlanStale
+		}
+		if err != nil {
+			return nil, err
+		}
+		to, _ := time.Parse("2006-01-02", move.ToDate)
+		if err := st.checkOpen(ctx, tx, to); err != nil {
+			return nil, err
+		}
+		if err := st.checkCapacity(ctx, tx, to, capacities[move.ToDate]); err != nil {
+			return nil, err
+		}
+		appointment, err := scanAppointment(tx.QueryRowContext(ctx, appointmentSelect+" WHERE a.id = ?", id))
+		if err != nil {
+			return nil, err
+		}
+		if err := st.record(ctx, tx, appointment, RevisionRescheduled); err != nil {
+			return nil, err
+		}
+		moved = append(moved, appointment)
+	}
+
+	// Booked onto since the plan was made
+	day, _ := time.Parse("2006-01-02", plan.VisitDate)
+	if err := st.checkCapacity(ctx, tx, day, plan.Capacity); errors.Is(err, ErrDuplicateAppointment) {
+		return nil, ErrPlanStale
+	} else if err != nil {
+		return nil, err
+	}
+	return moved, tx.Commit()
+}
+
+func (st *sqliteStore) CapacityCuts(ctx context.Context, from, to time.Time) (map[string]int, error) {
+	rows, err := st.db.QueryContext(ctx, "SELECT visit_date, capacity FROM capacity_cuts WHERE visit_date BETWEEN ? AND ?", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cuts := map[string]int{}
+	for rows.Next() {
+		var date string
+		var capacity int
+		if err := rows.Scan(&date, &capacity); err != nil {
+			return nil, err
+		}
+		cuts[date] = capacity
+	}
+	return cuts, rows.Err()
+}
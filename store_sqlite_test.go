@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStoreDuplicate(t *testing.T) {
+	server := setupTestServer(t)
+	visitDate := time.Date(2075, 6, 17, 0, 0, 0, 0, time.UTC)
+	req := AppointmentRequest{FirstName: "Dana", LastName: "Valid", PreferredLanguage: DefaultLanguage}
+
+	// Straight to the store, as if two requests both passed the booked check
+	if _, err := server.store.Create(context.Background(), req, visitDate, 1); err != nil {
+		t.Fatalf("Failed to create appointment: %v", err)
+	}
+	if _, err := server.store.Create(context.Background(), req, visitDate, 1); !errors.Is(err, ErrDuplicateAppointment) {
+		t.Errorf("Expected ErrDuplicateAppointment, got %v", err)
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	server := setupTestServer(t)
+	configurePool(server.db, DBPoolConfig{MaxOpenConns: 3, MaxIdleConns: 1, ConnMaxLifetime: time.Minute})
+
+	if got := server.db.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("Expected max open connections of 3, got %d", got)
+	}
+}
+
+func TestSQLiteStoreHonoursContext(t *testing.T) {
+	server := setupTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The client has gone, so the query shouldn't even run
+	if _, err := server.store.Booked(ctx, time.Date(2075, 6, 17, 0, 0, 0, 0, time.UTC)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSQLiteRevisionBackfill(t *testing.T) {
+	server := setupTestServer(t)
+	server.db.SetMaxOpenConns(1) // one :memory: database, not one per connection
+
+	// A booking from before revisions were kept
+	if _, err := server.db.Exec("DELETE FROM appointment_revisions"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.db.Exec("INSERT INTO persons (first_name, last_name, created_at, updated_at) VALUES ('Old', 'Booking', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.db.Exec("INSERT INTO appointments (person_id, visit_date) VALUES (1, '2075-06-17')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.store.Init(); err != nil {
+		t.Fatalf("Failed to re-init store: %v", err)
+	}
+
+	revisions, err := server.store.History(context.Background(), 1)
+	if err != nil || len(revisions) != 1 || revisions[0].ChangedBy != "unknown" || revisions[0].VisitDate != "2075-06-17" {
+		t.Errorf("Expected one backfilled revision, got %+v (%v)", revisions, err)
+	}
+}
+
+func TestSQLiteMigrateToPersons(t *testing.T) {
+	db, err := sql.Open(sqliteDriver, sqliteDSN(":memory:", "rwc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// The table as it was before persons, with two bookings for the same name
+	_, err = db.Exec(`CREATE TABLE appointments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		first_name TEXT NOT NULL,
+		last_name TEXT NOT NULL,
+		visit_date TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO appointments (first_name, last_name, visit_date) VALUES ('Mig', 'Rated', '2075-06-16'), ('Mig', 'Rated', '2075-06-17'), ('Can', 'Celled', '2075-06-18')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM appointments WHERE id = 3"); err != nil {
+		t.Fatal(err)
+	}
+
+	st := newSQLiteStore(db)
+	if err := st.Init(); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if legacy, _ := hasColumn(db, "appointments", "first_name"); legacy {
+		t.Error("Expected first_name to be dropped from appointments")
+	}
+
+	appointments, err := st.List(context.Background(), time.Time{})
+	if err != nil || len(appointments) != 2 {
+		t.Fatalf("Expected both bookings to survive, got %+v (%v)", appointments, err)
+	}
+	for _, a := range appointments {
+		if a.FirstName != "Mig" || a.PreferredLanguage != DefaultLanguage || a.PersonID == 0 {
+			t.Errorf("Expected the details to come from a person, got %+v", a)
+		}
+	}
+	if appointments[0].PersonID == appointments[1].PersonID {
+		t.Error("Expected a person per old booking, merging is left to staff")
+	}
+
+	// And the day isn't limited to one booking any more, nor are IDs reused
+	again, err := st.Create(context.Background(), AppointmentRequest{FirstName: "Second", LastName: "Booking", PreferredLanguage: DefaultLanguage}, time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC), 2)
+	if err != nil || again.ID != 4 {
+		t.Errorf("Expected booking 4 on an already booked day, got %+v (%v)", again, err)
+	}
+
+	// Running again finds nothing to do
+	if err := newSQLiteStore(db).Init(); err != nil {
+		t.Fatalf("Failed to re-init: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// The defaults ship in the binary, but comms like to reword things,
+// so anything dropped into the template dir wins and is reloaded on change
+//
+//go:embed templates/*
+var embeddedTemplates embed.FS
+
+// Message names we know how to render
+const (
+	MessageConfirmation = "confirmation"
+	MessageReminder     = "reminder"
+	MessageCancellation = "cancellation"
+	MessageClosure      = "closure"
+	MessageTransfer     = "transfer"
+	MessageProfileLink  = "profile"
+)
+
+// Translations sit alongside the English as <name>.<lang>.txt, e.g. confirmation.cy.txt
+const DefaultLanguage = "en"
+
+var supportedLanguages = map[string]bool{
+	"en": true, // English
+	"cy": true, // Welsh
+}
+
+// Each message is a <name>.txt (text/template, with a "subject" block)
+// and an optional <name>.html (html/template)
+type RenderedMessage struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type MessageTemplates struct {
+	dir string
+
+	mu       sync.RWMutex
+	text     map[string]*texttemplate.Template
+	html     map[string]*htmltemplate.Template
+	badges   map[string]*texttemplate.Template // by file name, badge.zpl, badge.lobby.escpos
+	modTimes map[string]time.Time
+}
+
+func NewMessageTemplates(dir string) (*MessageTemplates, error) {
+	t := &MessageTemplates{dir: dir}
+	if err := t.Load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// (Re)parse everything, embedded first and then the overrides on top.
+// On a parse error we keep whatever we had before
+func (t *MessageTemplates) Load() error {
+	sources := map[string][]byte{}
+
+	embedded, err := fs.ReadDir(embeddedTemplates, "templates")
+	if err != nil {
+		return fmt.Errorf("failed to read embedded templates: %w", err)
+	}
+	for _, e := range embedded {
+		b, err := embeddedTemplates.ReadFile("templates/" + e.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read embedded template %s: %w", e.Name(), err)
+		}
+		sources[e.Name()] = b
+	}
+
+	modTimes, err := t.scanDir()
+	if err != nil {
+		return err
+	}
+	for name := range modTimes {
+		b, err := os.ReadFile(filepath.Join(t.dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read template %s: %w", name, err)
+		}
+		sources[name] = b
+	}
+
+	text := map[string]*texttemplate.Template{}
+	html := map[string]*htmltemplate.Template{}
+	badges := map[string]*texttemplate.Template{}
+	for file, src := range sources {
+		name := strings.TrimSuffix(file, filepath.Ext(file))
+		switch filepath.Ext(file) {
+		case ".txt":
+			tmpl, err := texttemplate.New(name).Parse(string(src))
+			if err != nil {
+				return fmt.Errorf("failed to parse template %s: %w", file, err)
+			}
+			text[name] = tmpl
+		case ".html":
+			tmpl, err := htmltemplate.New(name).Parse(string(src))
+			if err != nil {
+				return fmt.Errorf("failed to parse template %s: %w", file, err)
+			}
+			html[name] = tmpl
+		case ".zpl", ".escpos":
+			tmpl, err := texttemplate.New(file).Funcs(badgeFuncs).Parse(string(src))
+			if err != nil {
+				return fmt.Errorf("failed to parse template %s: %w", file, err)
+			}
+			badges[file] = tmpl
+		}
+	}
+
+	t.mu.Lock()
+	t.text = text
+	t.html = html
+	t.badges = badges
+	t.modTimes = modTimes
+	t.mu.Unlock()
+	return nil
+}
+
+var templateExtensions = map[string]bool{".txt": true, ".html": true, ".zpl": true, ".escpos": true}
+
+// Modification times of the override templates, empty if there's no dir
+func (t *MessageTemplates) scanDir() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	if t.dir == "" {
+		return modTimes, nil
+	}
+
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template dir: %w", err)
+	}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || !templateExtensions[ext] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat template %s: %w", e.Name(), err)
+		}
+		modTimes[e.Name()] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Has anything in the override dir been added, removed or touched?
+func (t *MessageTemplates) changed() bool {
+	current, err := t.scanDir()
+	if err != nil {
+		log.Printf("Error scanning template dir: %v", err)
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(current) != len(t.modTimes) {
+		return true
+	}
+	for name, mod := range current {
+		if prev, ok := t.modTimes[name]; !ok || !prev.Equal(mod) {
+			return true
+		}
+	}
+	return false
+}
+
+// Poll the override dir and reload when it changes. No fsnotify,
+// a stat every few seconds is plenty for something edited by hand
+func (t *MessageTemplates) Watch(interval time.Duration, stop <-chan struct{}) {
+	if t.dir == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !t.changed() {
+				continue
+			}
+			if err := t.Load(); err != nil {
+				log.Printf("Error reloading templates, keeping previous ones: %v", err)
+				continue
+			}
+			log.Printf("Reloaded message templates from %s", t.dir)
+		}
+	}
+}
+
+// Render the translation if we have one, otherwise fall back to English
+func (t *MessageTemplates) RenderLocalized(name, language string, data any) (RenderedMessage, error) {
+	if language != "" && language != DefaultLanguage {
+		localized := name + "." + language
+		t.mu.RLock()
+		_, ok := t.text[localized]
+		t.mu.RUnlock()
+		if ok {
+			return t.Render(localized, data)
+		}
+	}
+	return t.Render(name, data)
+}
+
+func (t *MessageTemplates) Render(name string, data any) (RenderedMessage, error) {
+	t.mu.RLock()
+	text, ok := t.text[name]
+	html := t.html[name]
+	t.mu.RUnlock()
+
+	if !ok {
+		return RenderedMessage{}, fmt.Errorf("no template for message %q", name)
+	}
+
+	var msg RenderedMessage
+	var buf bytes.Buffer
+
+	if text.Lookup("subject") != nil {
+		if err := text.ExecuteTemplate(&buf, "subject", data); err != nil {
+			return RenderedMessage{}, fmt.Errorf("failed to render %s subject: %w", name, err)
+		}
+		msg.Subject = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+
+	if err := text.Execute(&buf, data); err != nil {
+		return RenderedMessage{}, fmt.Errorf("failed to render %s text: %w", name, err)
+	}
+	msg.Text = buf.String()
+
+	if html != nil {
+		buf.Reset()
+		if err := html.Execute(&buf, data); err != nil {
+			return RenderedMessage{}, fmt.Errorf("failed to render %s html: %w", name, err)
+		}
+		msg.HTML = buf.String()
+	}
+
+	return msg, nil
+}
+
+// Badges for the lobby printer are badge.<format>, with
+// badge.<location>.<format> for a location whose printer takes a
+// different label. Raw printer commands, so there's no HTML part
+func (t *MessageTemplates) RenderBadge(format, location string, data any) ([]byte, error) {
+	t.mu.RLock()
+	tmpl, ok := t.badges["badge."+location+"."+format]
+	if !ok {
+		tmpl, ok = t.badges["badge."+format]
+	}
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no %s badge template", format)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s badge: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedTemplatesRender(t *testing.T) {
+	templates := mustEmbeddedTemplates()
+
+	for _, name := range []string{MessageConfirmation, MessageReminder, MessageCancellation} {
+		msg, err := templates.Render(name, Appointment{ID: 7, FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-15"})
+		if err != nil {
+			t.Fatalf("Failed to render %s: %v", name, err)
+		}
+		if !strings.Contains(msg.Subject, "2075-06-15") {
+			t.Errorf("Expected %s subject to mention the date, got %q", name, msg.Subject)
+		}
+		if msg.HTML == "" {
+			t.Errorf("Expected %s to have an HTML part", name)
+		}
+	}
+}
+
+func TestTemplateOverrideReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "confirmation.txt")
+	if err := os.WriteFile(path, []byte(`{{define "subject"}}Booked{{end}}Hi {{.FirstName}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := NewMessageTemplates(dir)
+	if err != nil {
+		t.Fatalf("Failed to load templates: %v", err)
+	}
+
+	msg, _ := templates.Render(MessageConfirmation, Appointment{FirstName: "Dana"})
+	if msg.Subject != "Booked" || msg.Text != "Hi Dana" {
+		t.Errorf("Expected override to win, got %+v", msg)
+	}
+
+	// Edit the file and make sure the change is noticed
+	if err := os.WriteFile(path, []byte(`{{define "subject"}}Changed{{end}}Bye {{.FirstName}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+
+	if !templates.changed() {
+		t.Fatal("Expected template change to be detected")
+	}
+	if err := templates.Load(); err != nil {
+		t.Fatalf("Failed to reload templates: %v", err)
+	}
+
+	msg, _ = templates.Render(MessageConfirmation, Appointment{FirstName: "Dana"})
+	if msg.Subject != "Changed" || msg.Text != "Bye Dana" {
+		t.Errorf("Expected reloaded template, got %+v", msg)
+	}
+}
+
+func TestLocalizedTemplates(t *testing.T) {
+	templates := mustEmbeddedTemplates()
+	appointment := Appointment{ID: 7, FirstName: "Dana", LastName: "Valid", VisitDate: "2075-06-15"}
+
+	welsh, err := templates.RenderLocalized(MessageConfirmation, "cy", appointment)
+	if err != nil {
+		t.Fatalf("Failed to render Welsh confirmation: %v", err)
+	}
+	if !strings.Contains(welsh.Subject, "wedi'i gadarnhau") {
+		t.Errorf("Expected Welsh subject, got %q", welsh.Subject)
+	}
+
+	// No French templates, so we should get the English ones
+	fallback, err := templates.RenderLocalized(MessageConfirmation, "fr", appointment)
+	if err != nil {
+		t.Fatalf("Failed to render fallback confirmation: %v", err)
+	}
+	if !strings.Contains(fallback.Subject, "is confirmed") {
+		t.Errorf("Expected English fallback subject, got %q", fallback.Subject)
+	}
+}
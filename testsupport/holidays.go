@@ -0,0 +1,132 @@
+// Package testsupport has test doubles for the services CityNext talks
+// to, for its own tests and anyone else's that run it
+package testsupport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A stand-in for the Nager.Date API, the endpoints CityNext uses and
+// nothing else. Point CITYNEXT_HOLIDAY_API_URL (or the config's
+// HolidayAPIURL) at URL. It knows no countries until they're added
+type HolidayProvider struct {
+	URL string
+
+	mu        sync.Mutex
+	countries []Country
+	holidays  map[string][]Holiday // by "year/country"
+	requests  map[string]int       // by path
+}
+
+type Country struct {
+	CountryCode string `json:"countryCode"`
+	Name        string `json:"name"`
+}
+
+// As Nager sends them
+type Holiday struct {
+	Date        string   `json:"date"`
+	LocalName   string   `json:"localName"`
+	Name        string   `json:"name"`
+	CountryCode string   `json:"countryCode"`
+	Fixed       bool     `json:"fixed"`
+	Global      bool     `json:"global"`
+	Counties    []string `json:"counties"`
+	LaunchYear  int      `json:"launchYear"`
+	Types       []string `json:"types"`
+}
+
+// Started now and closed when the test finishes
+func NewHolidayProvider(t testing.TB) *HolidayProvider {
+	p := &HolidayProvider{holidays: make(map[string][]Holiday), requests: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	t.Cleanup(server.Close)
+	p.URL = server.URL
+	return p
+}
+
+func (p *HolidayProvider) AddCountry(code, name string) *HolidayProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addCountry(code, name)
+	return p
+}
+
+// Caller holds the mutex
+func (p *HolidayProvider) addCountry(code, name string) {
+	for _, c := range p.countries {
+		if c.CountryCode == code {
+			return
+		}
+	}
+	p.countries = append(p.countries, Country{CountryCode: code, Name: name})
+}
+
+// The country is added too if it isn't there yet, named by its code. The year is the date's
+func (p *HolidayProvider) AddHoliday(code, date, name string) *HolidayProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addCountry(code, code)
+	key := date[:4] + "/" + code
+	p.holidays[key] = append(p.holidays[key], Holiday{
+		Date: date, LocalName: name, Name: name, CountryCode: code, Fixed: true, Global: true, Types: []string{"Public"},
+	})
+	return p
+}
+
+// Takes one away again, as when a holiday's moved or cancelled
+func (p *HolidayProvider) RemoveHoliday(code, date string) *HolidayProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := date[:4] + "/" + code
+	kept := p.holidays[key][:0]
+	for _, h := range p.holidays[key] {
+		if h.Date != date {
+			kept = append(kept, h)
+		}
+	}
+	p.holidays[key] = kept
+	return p
+}
+
+// How many times path has been asked for, e.g. "/AvailableCountries"
+func (p *HolidayProvider) Requests(path string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests[path]
+}
+
+// Unknown countries get a 404, like the real thing
+func (p *HolidayProvider) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests[r.URL.Path]++
+
+	if r.URL.Path == "/AvailableCountries" {
+		writeJSON(w, p.countries)
+		return
+	}
+	if key, ok := strings.CutPrefix(r.URL.Path, "/PublicHolidays/"); ok {
+		if holidays, ok := p.holidays[key]; ok {
+			writeJSON(w, holidays)
+			return
+		}
+		for _, c := range p.countries {
+			if strings.HasSuffix(key, "/"+c.CountryCode) {
+				writeJSON(w, []Holiday{})
+				return
+			}
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Named routes that stream their response, and so run without a handler
+// timeout. They push the write deadline on as they go instead
+var streamingRoutes = map[string]bool{
+	"export":         true,
+	"queue-events":   true,
+	"display-events": true,
+
+	"waiting-room-events": true,
+}
+
+// Timeouts on the connection itself, so a slowloris client trickling
+// headers can't tie up connections forever
+func newHTTPServer(addr string, handler http.Handler, cfg Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// And a deadline on the work behind each request, answered with a 503
+// in the usual error format. Keep it under the write timeout, otherwise
+// the connection is cut before the client hears why
+func (s *Server) handlerTimeout(next http.Handler) http.Handler {
+	if s.cfg.HandlerTimeout <= 0 {
+		return next
+	}
+
+	body, _ := json.Marshal(ErrorResponse{
+		Error:   CodeTimeout,
+		Message: "The request took too long, please try again",
+	})
+	timeout := http.TimeoutHandler(next, s.cfg.HandlerTimeout, string(body))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// TimeoutHandler buffers the whole response, which is no good for streams
+		if route := mux.CurrentRoute(r); route != nil && streamingRoutes[route.GetName()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Handlers that finish set their own, this is for the timeout body
+		w.Header().Set("Content-Type", "application/json")
+		timeout.ServeHTTP(w, r)
+	})
+}
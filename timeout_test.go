@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.HandlerTimeout = 10 * time.Millisecond
+
+	slow := server.handlerTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	slow.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 on timeout, got %d", w.Code)
+	}
+	var resp ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Error != "timeout" {
+		t.Errorf("Expected JSON timeout error, got %q", w.Body.String())
+	}
+}
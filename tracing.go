@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// W3C trace context (https://www.w3.org/TR/trace-context/), so a booking
+// can be followed from the request that made it to every email it set
+// off, including retries long after the request finished. A traceparent
+// from the caller or the proxy in front is carried on, otherwise each
+// request starts a trace of its own. The trace ID goes back in
+// X-Trace-Id, and is logged by whatever sends on the trace's behalf
+type traceContext struct {
+	TraceID string // 32 hex digits
+	SpanID  string // 16 hex digits, this hop
+	Flags   string // 01 sampled, 00 not
+}
+
+type traceKey struct{}
+
+// "00-<trace id>-<span id>-<flags>", or false if it isn't one
+func parseTraceparent(header string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || !isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) {
+		return traceContext{}, false
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return traceContext{}, false // all zeros is invalid
+	}
+	return traceContext{TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}, true
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func (tc traceContext) String() string {
+	return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + tc.Flags
+}
+
+// The next hop on the same trace
+func (tc traceContext) child() traceContext {
+	tc.SpanID = randomHex(8)
+	return tc
+}
+
+func newTrace() traceContext {
+	return traceContext{TraceID: randomHex(16), SpanID: randomHex(8), Flags: "01"}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withTrace(ctx context.Context, tc traceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+func traceFrom(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(traceContext)
+	return tc, ok
+}
+
+// Where a new span starts for work done on ctx's behalf, a fresh trace
+// if it had none (a scheduled job, say)
+func childTrace(ctx context.Context) traceContext {
+	if tc, ok := traceFrom(ctx); ok {
+		return tc.child()
+	}
+	return newTrace()
+}
+
+func (s *Server) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if ok {
+			tc = tc.child()
+		} else {
+			tc = newTrace()
+		}
+		w.Header().Set("X-Trace-Id", tc.TraceID)
+		next.ServeHTTP(w, r.WithContext(withTrace(r.Context(), tc)))
+	})
+}
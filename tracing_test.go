@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceFollowsDeliveryRetries(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.notifier = failingNotifier{err: errors.New("smtp down")}
+	router := server.routes()
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	body, _ := json.Marshal(AppointmentRequest{FirstName: "Dana", LastName: "Scully", Email: "dana@example.com", VisitDate: "2075-06-16"})
+	r := httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+	r.Header.Set("traceparent", incoming)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || w.Header().Get("X-Trace-Id") != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Expected the booking on the caller's trace, got %d with %q", w.Code, w.Header().Get("X-Trace-Id"))
+	}
+
+	// The confirmation goes out after the response
+	var deliveries []Delivery
+	for deadline := time.Now().Add(time.Second); len(deliveries) == 0 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", "/admin/deliveries", nil))
+		json.NewDecoder(w.Body).Decode(&deliveries)
+	}
+	if len(deliveries) != 1 || deliveries[0].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Expected the failed confirmation to keep the trace, got %+v", deliveries)
+	}
+
+	// The retry, long after the request, is still on the same trace
+	var sent []Message
+	server.notifier = capturingNotifier{sent: &sent}
+	server.db.Exec("UPDATE deliveries SET next_attempt_at = ?", time.Now().UTC().Add(-time.Second))
+	server.retryDueDeliveries(context.Background())
+	if len(sent) != 1 {
+		t.Fatalf("Expected the retry to be sent, got %d", len(sent))
+	}
+	tc, ok := parseTraceparent(sent[0].TraceParent)
+	if !ok || tc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sent[0].TraceParent == incoming {
+		t.Errorf("Expected a new span on the booking's trace, got %q", sent[0].TraceParent)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(header); ok {
+			t.Errorf("Expected %q to be rejected", header)
+		}
+	}
+
+	tc := newTrace()
+	if parsed, ok := parseTraceparent(tc.String()); !ok || parsed != tc {
+		t.Errorf("Expected %s to read back, got %+v", tc, parsed)
+	}
+	if child := tc.child(); child.TraceID != tc.TraceID || child.SpanID == tc.SpanID || !strings.HasSuffix(child.String(), "-01") {
+		t.Errorf("Expected a new span on the same trace, got %s from %s", child, tc)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrAlreadyCheckedIn = errors.New("already checked in")
+
+type TransferRequest struct {
+	Service      string       `json:"service"`
+	Location     string       `json:"location"`
+	VisitDate    string       `json:"visitDate"`    // empty to keep the day it's on
+	CustomFields CustomFields `json:"customFields"` // nil to keep the ones it has
+}
+
+// What the transfer message is rendered with
+type TransferNotice struct {
+	Appointment
+	FromService string
+	FromDate    string
+}
+
+// The service to move to. Bookings don't have a location of their own, a
+// location is the services its display shows, so moving to one is moving
+// to one of those: the one asked for, the one it's already in if the
+// location shows it, or the location's first
+func (s *Server) transferService(w http.ResponseWriter, r *http.Request, req TransferRequest, current string) (string, bool) {
+	if req.Location == "" {
+		return s.resolveService(w, r, req.Service)
+	}
+	services, ok := s.queueLocations()[req.Location]
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownLocation, "No such location")
+		return "", false
+	}
+	switch {
+	case req.Service != "" && !slices.Contains(services, req.Service):
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeUnknownService, req.Service+" isn't seen at "+req.Location)
+		return "", false
+	case req.Service != "":
+		return req.Service, true
+	case slices.Contains(services, current):
+		return current, true
+	}
+	return services[0], true
+}
+
+// POST /admin/appointments/{id}/transfer with {"service": "passports"} or
+// {"location": "annex"}, and optionally a new "visitDate" and "customFields",
+// moves a booking to another service under that service's rules. It keeps
+// its ID, so the reference the citizen has still works
+func (s *Server) transferAppointment(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+	if req.Service == "" && req.Location == "" {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeServiceRequired, "Say which service or location to move it to")
+		return
+	}
+
+	ctx, cancel := withTimeout(r.Context(), s.cfg.DBTimeout)
+	defer cancel()
+
+	before, err := s.store.Get(ctx, id)
+	if errors.Is(err, ErrAppointmentNotFound) {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to load appointment")
+		return
+	}
+
+	service, ok := s.transferService(w, r, req, before.Service)
+	if !ok {
+		return
+	}
+	if !s.checkBookingOpen(w, r, service, today) {
+		return
+	}
+	if req.VisitDate == "" {
+		req.VisitDate = before.VisitDate
+	}
+	visitDate, ok := s.validateVisitDate(w, r, req.VisitDate, today)
+	if !ok {
+		return
+	}
+	if req.CustomFields == nil {
+		req.CustomFields = before.CustomFields
+	}
+	// Kept fields have to suit the new service too
+	if !s.validateCustomFields(w, r, AppointmentRequest{Service: service, CustomFields: req.CustomFields}) {
+		return
+	}
+	if before.Address == nil && s.requiresAddress(service) {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeAddressRequired, service+" needs the address they live at, so it has to be booked afresh")
+		return
+	}
+	// And they have to be able to book it
+	moved := AppointmentRequest{FirstName: before.FirstName, LastName: before.LastName, Email: before.Email, VisitDate: visitDate.Format("2006-01-02"),
+		PreferredLanguage: before.PreferredLanguage, Attendees: before.Attendees, BookedBy: before.BookedBy, Service: service,
+		CustomFields: req.CustomFields, Address: before.Address, Channel: before.Channel}
+	if !s.checkEligibility(w, r, moved, visitDate) || !s.checkChainGaps(ctx, w, r, before, service, visitDate) {
+		return
+	}
+	if service == before.Service && visitDate.Format("2006-01-02") == before.VisitDate {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeNothingToTransfer, "It's already booked for "+service+" on that day")
+		return
+	}
+
+	priority, err := s.appointmentPriority(ctx, id)
+	if err != nil {
+		log.Printf("Error checking appointment %d's priority: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to transfer appointment")
+		return
+	}
+
+	capacity, err := s.capacityOnChannel(ctx, visitDate, s.capacityFor(visitDate, priority), channelOrOnline(before.Channel))
+	if err != nil {
+		log.Printf("Error checking channel quotas: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to transfer appointment")
+		return
+	}
+
+	appointment, err := s.store.Transfer(ctx, id, service, req.CustomFields, visitDate, capacity)
+	switch {
+	case errors.Is(err, ErrAppointmentNotFound):
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeNotFound, "No appointment with that ID")
+		return
+	case errors.Is(err, ErrAlreadyCheckedIn):
+		s.sendErrorResponse(w, r, http.StatusConflict, CodeAlreadyCheckedIn, "They've already checked in, so it can't be moved")
+		return
+	case errors.Is(err, ErrDuplicateAppointment):
+		s.sendFullyBooked(w, r)
+		return
+	case errors.Is(err, ErrDayClosed):
+		s.sendDayClosed(w, r)
+		return
+	case err != nil:
+		log.Printf("Error transferring appointment %d: %v", id, err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeDatabaseError, "Failed to transfer appointment")
+		return
+	}
+
+	s.invalidateAvailability(ctx)
+	if appointment.VisitDate != before.VisitDate {
+		s.noteOverbooking(ctx, appointment, visitDate, RevisionTransferred)
+	}
+	s.respond(w, r, http.StatusOK, appointment)
+
+	go func() {
+		ctx, cancel := withTimeout(context.WithoutCancel(r.Context()), s.cfg.NotifyTimeout)
+		defer cancel()
+		s.notifyWith(ctx, MessageTransfer, appointment, TransferNotice{Appointment: appointment, FromService: before.Service, FromDate: before.VisitDate})
+	}()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransfer(t *testing.T) {
+	for _, store := range []string{"sqlite", "events", "memory"} {
+		t.Run(store, func(t *testing.T) {
+			server, sent := closureServer(t, store)
+			server.cfg.QueueServices = []string{"general", "passports", "parking-permits"}
+			server.cfg.QueueLocations = map[string][]string{"main": {"general", "passports"}, "annex": {"parking-permits"}}
+			server.cfg.CustomFields = map[string]*fieldSchema{}
+			json.Unmarshal([]byte(parkingSchema), &server.cfg.CustomFields)
+			server.cfg.CustomFields["parking-permits"].compile()
+			router := server.routes()
+
+			for _, date := range []string{"2075-01-09", "2075-01-10", "2075-01-10", "2075-01-10"} {
+				if w := postAppointment(t, router, AppointmentRequest{FirstName: "Dana", LastName: "Moved", Email: "dana@example.com", VisitDate: date}); w.Code != http.StatusCreated {
+					t.Fatalf("Expected a booking, got %d: %s", w.Code, w.Body.String())
+				}
+				sent.next(t)
+			}
+			transfer := func(id, body string) (*httptest.ResponseRecorder, Appointment) {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, adminRequest("POST", "/admin/appointments/"+id+"/transfer", []byte(body)))
+				var appointment Appointment
+				json.Unmarshal(w.Body.Bytes(), &appointment)
+				return w, appointment
+			}
+
+			w, appointment := transfer("1", `{"service": "passports"}`)
+			if w.Code != http.StatusOK || appointment.ID != 1 || appointment.Service != "passports" || appointment.VisitDate != "2075-01-09" {
+				t.Fatalf("Expected it moved to passports on the same day, got %d: %s", w.Code, w.Body.String())
+			}
+			msg := sent.next(t)
+			if !strings.Contains(msg.Text, "from general on 2075-01-09 to passports on 2075-01-09") || !strings.Contains(msg.Subject, "passports") {
+				t.Errorf("Expected the transfer message, got %+v", msg)
+			}
+
+			// The annex only does parking permits, which need a vehicle
+			if w, _ := transfer("1", `{"location": "annex"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_custom_fields") {
+				t.Errorf("Expected the fields it hasn't got asked for, got %d: %s", w.Code, w.Body.String())
+			}
+			w, appointment = transfer("1", `{"location": "annex", "visitDate": "2075-01-15", "customFields": {"vehicleReg": "AB12 CDE"}}`)
+			if w.Code != http.StatusOK || appointment.Service != "parking-permits" || appointment.VisitDate != "2075-01-15" || appointment.CustomFields["vehicleReg"] != "AB12 CDE" {
+				t.Fatalf("Expected it moved to the annex, got %d: %s", w.Code, w.Body.String())
+			}
+			sent.next(t)
+
+			for _, c := range []struct {
+				id, body string
+				code     int
+				want     string
+			}{
+				{"1", `{"service": "general"}`, http.StatusBadRequest, "invalid_custom_fields"}, // the vehicle doesn't go with it
+				{"1", `{"location": "annex"}`, http.StatusBadRequest, "nothing_to_transfer"},
+				{"1", `{"location": "annex", "service": "general"}`, http.StatusBadRequest, "unknown_service"},
+				{"1", `{"location": "upstairs"}`, http.StatusBadRequest, "unknown_location"},
+				{"1", `{"service": "passports", "visitDate": "2075-03-18", "customFields": {}}`, http.StatusBadRequest, "holiday"},
+				{"1", `{"service": "passports", "visitDate": "2075-01-10", "customFields": {}}`, http.StatusConflict, "duplicate_appointment"},
+				{"1", `{}`, http.StatusBadRequest, "service_required"},
+				{"9", `{"service": "passports"}`, http.StatusNotFound, "not_found"},
+			} {
+				if w, _ := transfer(c.id, c.body); w.Code != c.code || !strings.Contains(w.Body.String(), c.want) {
+					t.Errorf("Expected %d %s for %s, got %d: %s", c.code, c.want, c.body, w.Code, w.Body.String())
+				}
+			}
+
+			// Moving within a full day is fine, it's the same place
+			if w, _ := transfer("2", `{"service": "passports"}`); w.Code != http.StatusOK {
+				t.Errorf("Expected a change of service on a full day, got %d: %s", w.Code, w.Body.String())
+			}
+			sent.next(t)
+			// Or one with more booked than it takes now its capacity's been cut
+			server.cfg.DailyCapacity = 2
+			if w, _ := transfer("4", `{"service": "passports"}`); w.Code != http.StatusOK {
+				t.Errorf("Expected a change of service on a day over capacity, got %d: %s", w.Code, w.Body.String())
+			}
+			sent.next(t)
+			server.cfg.DailyCapacity = 3
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/1/history", nil))
+			var history History
+			json.Unmarshal(w.Body.Bytes(), &history)
+			if n := len(history.Revisions); n != 3 || history.Revisions[1].Service != "passports" || history.Revisions[2].Change != RevisionTransferred {
+				t.Errorf("Expected both transfers in the history, got %s", w.Body.String())
+			}
+
+			ctx := context.Background()
+			if store == "events" {
+				if _, err := server.store.(*eventStore).Rebuild(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if a, err := server.store.Get(ctx, 1); err != nil || a.Service != "parking-permits" || a.VisitDate != "2075-01-15" || a.CustomFields["vehicleReg"] != "AB12 CDE" {
+					t.Errorf("Expected the transfer replayed, got %+v %v", a, err)
+				}
+			}
+
+			// Not once they're in the queue for the old one
+			if _, err := server.store.CheckIn(ctx, 3); err != nil {
+				t.Fatal(err)
+			}
+			if w, _ := transfer("3", `{"service": "passports"}`); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "already_checked_in") {
+				t.Errorf("Expected a checked-in booking left alone, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
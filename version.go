@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Left empty, the commit and date come from what go build stamped in,
+// which is there for any build from a git checkout
+var (
+	version   = "dev"
+	commit    string
+	buildDate string
+)
+
+type BuildInfo struct {
+	XMLName   xml.Name `json:"-" xml:"build"`
+	Version   string   `json:"version" xml:"version"`
+	Commit    string   `json:"commit" xml:"commit"`
+	BuildDate string   `json:"buildDate" xml:"buildDate"`
+	Modified  bool     `json:"modified,omitempty" xml:"modified,omitempty"` // built with uncommitted changes
+	GoVersion string   `json:"goVersion" xml:"goVersion"`
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+}
+
+// GET /version, so whoever's on call can see exactly what's serving
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
+	s.respond(w, r, http.StatusOK, buildInfo())
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "abc123", "2075-03-01T09:00:00Z"
+
+	w := httptest.NewRecorder()
+	NewServer(nil).routes().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var info BuildInfo
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if info.Version != "1.4.0" || info.Commit != "abc123" || info.BuildDate != "2075-03-01T09:00:00Z" || info.GoVersion == "" {
+		t.Errorf("Expected the ldflags values, got %+v", info)
+	}
+}
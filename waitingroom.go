@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// When a popular booking window opens everyone posts at once, and SQLite
+// can't take it. With the waiting-room feature on, public bookings need
+// a token from POST /waiting-room first. Tokens are let in first come
+// first served, CITYNEXT_ADMISSION_RATE a second, and an admitted token
+// books once within CITYNEXT_ADMISSION_WINDOW. The line's in the shared
+// cache, so a token from one replica is good on all of them, and one
+// replica a tick lets the next lot in
+const waitingRoomHeader = "X-Waiting-Room-Token"
+
+// Someone who hasn't polled or listened for this long has given up, and
+// is dropped rather than let in
+const waitingRoomIdle = 2 * time.Minute
+
+const (
+	waitingRoomJoinedKey  = "waiting-room:joined"  // the last place handed out
+	waitingRoomThroughKey = "waiting-room:through" // the last place let in or passed over
+	waitingRoomLineTTL    = 365 * 24 * time.Hour
+)
+
+type WaitingRoomTicket struct {
+	XMLName       xml.Name   `json:"-" xml:"waitingRoomTicket"`
+	Token         string     `json:"token" xml:"token"`
+	Position      int        `json:"position" xml:"position"` // how many are ahead plus one, 0 once admitted
+	Admitted      bool       `json:"admitted" xml:"admitted"`
+	AdmittedUntil *time.Time `json:"admittedUntil,omitempty" xml:"admittedUntil,omitempty"` // when the token stops being good for a booking
+}
+
+// A place in the line, kept under its number. The token is the number
+// and a secret, so nobody can take someone else's place by counting
+type waitingPlace struct {
+	Secret     string    `json:"secret"`
+	SeenAt     time.Time `json:"seenAt"`
+	AdmittedAt time.Time `json:"admittedAt,omitzero"`
+}
+
+func waitingPlaceKey(seq int64) string { return "waiting-room:place:" + strconv.FormatInt(seq, 10) }
+
+func waitingRoomToken(seq int64, secret string) string {
+	return strconv.FormatInt(seq, 10) + "-" + secret
+}
+
+// This replica's view of the line, for its event streams: how far it's
+// got, and a channel closed the next time it moves
+type waitingRoom struct {
+	mu      sync.Mutex
+	through int64
+	changed chan struct{}
+}
+
+func newWaitingRoom() *waitingRoom {
+	return &waitingRoom{changed: make(chan struct{})}
+}
+
+// Wakes the streams here if the line's moved since they last looked
+func (room *waitingRoom) saw(through int64) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if through != room.through {
+		room.through = through
+		close(room.changed)
+		room.changed = make(chan struct{})
+	}
+}
+
+// Closed the next time anyone's let in
+func (room *waitingRoom) wait() <-chan struct{} {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return room.changed
+}
+
+func (s *Server) cachedInt(ctx context.Context, key string) (int64, error) {
+	b, ok, err := s.cache.Get(ctx, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// How far the line's got and how long it is. The count of places runs
+// out after a year, so if it's started again so does the line
+func (s *Server) waitingLine(ctx context.Context) (through, joined int64, err error) {
+	if joined, err = s.cachedInt(ctx, waitingRoomJoinedKey); err != nil {
+		return 0, 0, err
+	}
+	if through, err = s.cachedInt(ctx, waitingRoomThroughKey); err != nil {
+		return 0, 0, err
+	}
+	if joined < through {
+		through = 0
+	}
+	return through, joined, nil
+}
+
+func (s *Server) waitingPlace(ctx context.Context, seq int64) (waitingPlace, bool, error) {
+	b, ok, err := s.cache.Get(ctx, waitingPlaceKey(seq))
+	if err != nil || !ok {
+		return waitingPlace{}, false, err
+	}
+	var place waitingPlace
+	return place, json.Unmarshal(b, &place) == nil, nil
+}
+
+func (s *Server) putWaitingPlace(ctx context.Context, seq int64, place waitingPlace, ttl time.Duration) error {
+	b, _ := json.Marshal(place)
+	return s.cache.Set(ctx, waitingPlaceKey(seq), b, ttl)
+}
+
+func (s *Server) joinWaitingLine(ctx context.Context, now time.Time) (string, error) {
+	seq, err := s.cache.Incr(ctx, waitingRoomJoinedKey, waitingRoomLineTTL)
+	if err != nil {
+		return "", err
+	}
+	secret := randomHex(16)
+	if err := s.putWaitingPlace(ctx, seq, waitingPlace{Secret: secret, SeenAt: now}, 2*waitingRoomIdle); err != nil {
+		return "", err
+	}
+	return waitingRoomToken(seq, secret), nil
+}
+
+// Where a token stands, false if it's not in the line, and it counts as
+// still being there
+func (s *Server) waitingTicket(ctx context.Context, token string, now time.Time, window time.Duration) (WaitingRoomTicket, bool, error) {
+	seqStr, secret, _ := strings.Cut(token, "-")
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if err != nil || secret == "" {
+		return WaitingRoomTicket{}, false, nil
+	}
+	place, ok, err := s.waitingPlace(ctx, seq)
+	if err != nil || !ok || subtle.ConstantTimeCompare([]byte(place.Secret), []byte(secret)) != 1 {
+		return WaitingRoomTicket{}, false, err
+	}
+
+	t := WaitingRoomTicket{Token: token}
+	if !place.AdmittedAt.IsZero() {
+		until := place.AdmittedAt.Add(window)
+		t.Admitted, t.AdmittedUntil = true, &until
+		return t, now.Before(until), nil
+	}
+	through, _, err := s.waitingLine(ctx)
+	if err != nil {
+		return WaitingRoomTicket{}, false, err
+	}
+	// Passed over while they weren't looking
+	if seq <= through {
+		return WaitingRoomTicket{}, false, nil
+	}
+	t.Position = int(seq - through)
+	place.SeenAt = now
+	return t, true, s.putWaitingPlace(ctx, seq, place, 2*waitingRoomIdle)
+}
+
+// Lets the next n in, passing over anyone who's stopped asking. Admitted
+// places go once their window's up, the rest once they've been idle a while
+func (s *Server) admitWaitingLine(ctx context.Context, n int, now time.Time, window time.Duration) (int, error) {
+	unlock, err := s.locker.Lock(ctx, "lock:"+waitingRoomThroughKey, 10*time.Second)
+	if errors.Is(err, ErrLockHeld) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	through, joined, err := s.waitingLine(ctx)
+	if err != nil {
+		return 0, err
+	}
+	admitted, last := 0, through
+	for seq := through + 1; seq <= joined && admitted < n; seq++ {
+		last = seq
+		place, ok, err := s.waitingPlace(ctx, seq)
+		if err != nil {
+			return admitted, err
+		}
+		if !ok || now.Sub(place.SeenAt) > waitingRoomIdle {
+			s.cache.Delete(ctx, waitingPlaceKey(seq))
+			continue
+		}
+		place.AdmittedAt = now
+		if err := s.putWaitingPlace(ctx, seq, place, window); err != nil {
+			return admitted, err
+		}
+		admitted++
+	}
+	if last != through {
+		err = s.cache.Set(ctx, waitingRoomThroughKey, []byte(strconv.FormatInt(last, 10)), waitingRoomLineTTL)
+	}
+	return admitted, err
+}
+
+// Once a token's booked it's done with
+func (s *Server) leaveWaitingLine(ctx context.Context, token string) {
+	seqStr, _, _ := strings.Cut(token, "-")
+	if seq, err := strconv.ParseInt(seqStr, 10, 64); err == nil {
+		if err := s.cache.Delete(ctx, waitingPlaceKey(seq)); err != nil {
+			log.Printf("Error taking waiting room token %d out of the line: %v", seq, err)
+		}
+	}
+}
+
+func (s *Server) admissionRate() int {
+	if rate := s.live().AdmissionRate; rate > 0 {
+		return rate
+	}
+	return 5
+}
+
+func (s *Server) admissionWindow() time.Duration {
+	if s.cfg.AdmissionWindow > 0 {
+		return s.cfg.AdmissionWindow
+	}
+	return 10 * time.Minute
+}
+
+// Lets the next lot in every second. Every replica ticks, whoever takes
+// the lock lets them in and keeps it until just before the next tick, so
+// it's the admission rate across them all. Each then looks at how far
+// the line's got, for its event streams
+func (s *Server) admitWaiting(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !s.featureEnabled("waiting-room") {
+				continue
+			}
+			ctx := context.Background()
+			if _, err := s.locker.Lock(ctx, "job:waiting-room", interval*9/10); err == nil {
+				if _, err := s.admitWaitingLine(ctx, int(float64(s.admissionRate())*interval.Seconds()), time.Now(), s.admissionWindow()); err != nil {
+					log.Printf("Error letting people in from the waiting room: %v", err)
+				}
+			} else if !errors.Is(err, ErrLockHeld) {
+				log.Printf("Error taking the lock for the waiting room: %v", err)
+			}
+			if through, _, err := s.waitingLine(ctx); err == nil {
+				s.waitingRoom.saw(through)
+			}
+		}
+	}
+}
+
+// POST /waiting-room, rate limited like bookings so nobody can take
+// every place
+func (s *Server) joinWaitingRoom(w http.ResponseWriter, r *http.Request) {
+	if !s.requireFeature(w, r, "waiting-room") {
+		return
+	}
+	now := time.Now()
+	token, err := s.joinWaitingLine(r.Context(), now)
+	var ticket WaitingRoomTicket
+	if err == nil {
+		ticket, _, err = s.waitingTicket(r.Context(), token, now, s.admissionWindow())
+	}
+	if err != nil {
+		log.Printf("Error joining the waiting room: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed to join the waiting room")
+		return
+	}
+	w.Header().Set("Location", "/waiting-room/"+ticket.Token)
+	s.respond(w, r, http.StatusAccepted, ticket)
+}
+
+// Sends the error if the ticket can't be had
+func (s *Server) waitingRoomTicket(w http.ResponseWriter, r *http.Request, token string) (WaitingRoomTicket, bool) {
+	ticket, ok, err := s.waitingTicket(r.Context(), token, time.Now(), s.admissionWindow())
+	if err != nil {
+		log.Printf("Error looking up a waiting room token: %v", err)
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed checking the waiting room")
+		return ticket, false
+	}
+	if !ok {
+		s.sendErrorResponse(w, r, http.StatusNotFound, CodeUnknownToken, "That waiting room token has expired or was never issued")
+	}
+	return ticket, ok
+}
+
+// GET /waiting-room/{token}, for clients that poll. A second apart is plenty
+func (s *Server) getWaitingRoomTicket(w http.ResponseWriter, r *http.Request) {
+	ticket, ok := s.waitingRoomTicket(w, r, mux.Vars(r)["token"])
+	if !ok {
+		return
+	}
+	if !ticket.Admitted {
+		w.Header().Set("Retry-After", "1")
+	}
+	s.respond(w, r, http.StatusOK, ticket)
+}
+
+// GET /waiting-room/{token}/events, a "position" event each time the line
+// moves and "admitted" when it's their turn, which ends the stream
+func (s *Server) waitingRoomEvents(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	changed := s.waitingRoom.wait()
+	ticket, ok := s.waitingRoomTicket(w, r, token)
+	if !ok {
+		return
+	}
+	closing, done := s.streams.start()
+	defer done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	heartbeat := time.NewTicker(queueHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		event := "position"
+		if ticket.Admitted {
+			event = "admitted"
+		}
+		data, _ := json.Marshal(ticket)
+		s.extendWriteDeadline(rc)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+		if ticket.Admitted {
+			return
+		}
+
+	waiting:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-closing:
+				s.sendReconnect(w, rc)
+				return
+			case <-changed:
+				break waiting
+			case <-heartbeat.C:
+				// Listening counts as still being there
+				if _, ok, err := s.waitingTicket(r.Context(), token, time.Now(), s.admissionWindow()); err == nil && !ok {
+					return
+				}
+				s.extendWriteDeadline(rc)
+				io.WriteString(w, ": ping\n\n")
+				rc.Flush()
+			}
+		}
+		// Taken before looking, so a move straight after isn't missed
+		changed = s.waitingRoom.wait()
+		var err error
+		if ticket, ok, err = s.waitingTicket(r.Context(), token, time.Now(), s.admissionWindow()); err != nil || !ok {
+			return
+		}
+	}
+}
+
+// In front of public bookings. The token's used up by a booking that
+// goes through, anything turned away can be fixed and sent again
+func (s *Server) admitted(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.featureEnabled("waiting-room") {
+			next(w, r)
+			return
+		}
+		token := r.Header.Get(waitingRoomHeader)
+		ticket, ok, err := s.waitingTicket(r.Context(), token, time.Now(), s.admissionWindow())
+		if err != nil {
+			log.Printf("Error looking up a waiting room token: %v", err)
+			s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeCacheError, "Failed checking the waiting room")
+			return
+		}
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			s.sendErrorResponse(w, r, http.StatusTooManyRequests, CodeQueueRequired, "Bookings are queued, join with POST /waiting-room and send the token in "+waitingRoomHeader)
+			return
+		}
+		if !ticket.Admitted {
+			w.Header().Set("Retry-After", "1")
+			s.sendErrorResponse(w, r, http.StatusTooManyRequests, CodeNotYourTurn, "Still waiting, position "+strconv.Itoa(ticket.Position))
+			return
+		}
+
+		capture := &capturingWriter{ResponseWriter: w}
+		next(capture, r)
+		if capture.status >= 200 && capture.status < 300 {
+			s.leaveWaitingLine(context.WithoutCancel(r.Context()), token)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitingRoom(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.DailyCapacity = 10
+	server.cfg.Features = map[string]bool{"waiting-room": true}
+	router := server.routes()
+
+	book := func(token string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(AppointmentRequest{FirstName: "Queue", LastName: "Jumper", VisitDate: "2075-06-17"})
+		r := httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+		if token != "" {
+			r.Header.Set(waitingRoomHeader, token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	join := func() WaitingRoomTicket {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/waiting-room", nil))
+		var ticket WaitingRoomTicket
+		if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &ticket) != nil {
+			t.Fatalf("Expected 202 joining, got %d: %s", w.Code, w.Body.String())
+		}
+		return ticket
+	}
+
+	if w := book(""); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "queue_required") {
+		t.Fatalf("Expected 429 queue_required without a token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	first, second := join(), join()
+	if first.Position != 1 || second.Position != 2 {
+		t.Fatalf("Expected positions 1 and 2, got %d and %d", first.Position, second.Position)
+	}
+	if w := book(first.Token); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "not_your_turn") {
+		t.Errorf("Expected 429 not_your_turn before being let in, got %d: %s", w.Code, w.Body.String())
+	}
+
+	server.admitWaitingLine(context.Background(), 1, time.Now(), time.Minute)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/waiting-room/"+second.Token, nil))
+	var status WaitingRoomTicket
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Admitted || status.Position != 1 {
+		t.Errorf("Expected the second to be next in line, got %+v", status)
+	}
+
+	if w := book(first.Token); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 once admitted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := book(first.Token); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the token to be used up, got %d", w.Code)
+	}
+
+	// Switched off, nobody queues
+	server.cfg.Features = nil
+	if w := book(""); w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 with the waiting room off, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWaitingRoomEvents(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.Features = map[string]bool{"waiting-room": true}
+	ts := httptest.NewServer(server.routes())
+	defer ts.Close()
+
+	token, _ := server.joinWaitingLine(context.Background(), time.Now())
+	resp, err := http.Get(ts.URL + "/waiting-room/" + token + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var events []string
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		if event, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+			events = append(events, event)
+			if len(events) == 1 {
+				server.admitWaitingLine(context.Background(), 1, time.Now(), time.Minute)
+				through, _, _ := server.waitingLine(context.Background())
+				server.waitingRoom.saw(through)
+			}
+		}
+	}
+	if strings.Join(events, ",") != "position,admitted" {
+		t.Errorf("Expected position then admitted, got %v", events)
+	}
+}
+
+func TestWaitingRoomDropsIdle(t *testing.T) {
+	server := setupTestServer(t)
+	ctx := context.Background()
+	now := time.Now()
+	gone, _ := server.joinWaitingLine(ctx, now.Add(-time.Hour))
+	here, _ := server.joinWaitingLine(ctx, now)
+
+	if n, err := server.admitWaitingLine(ctx, 5, now, time.Minute); err != nil || n != 1 {
+		t.Errorf("Expected one let in, got %d (%v)", n, err)
+	}
+	if _, ok, _ := server.waitingTicket(ctx, gone, now, time.Minute); ok {
+		t.Error("Expected the idle token to be dropped")
+	}
+	if ticket, _, _ := server.waitingTicket(ctx, here, now, time.Minute); !ticket.Admitted {
+		t.Errorf("Expected the one still there to be let in, got %+v", ticket)
+	}
+	if _, ok, _ := server.waitingTicket(ctx, "2-"+strings.Repeat("0", 32), now, time.Minute); ok {
+		t.Error("Expected a guessed token to be refused")
+	}
+
+	// And admitted tokens go once their time's up
+	if _, ok, _ := server.waitingTicket(ctx, here, now.Add(2*time.Minute), time.Minute); ok {
+		t.Error("Expected the unused token to expire")
+	}
+}
+
+// The line's in the shared cache, so it doesn't matter which replica
+// hands out the token, lets it in or takes the booking
+func TestWaitingRoomAcrossReplicas(t *testing.T) {
+	first, second := setupTestServer(t), setupTestServer(t)
+	second.cache, second.locker = first.cache, first.locker
+	for _, server := range []*Server{first, second} {
+		server.cfg.DailyCapacity = 10
+		server.cfg.Features = map[string]bool{"waiting-room": true}
+		server.cfg.AdmissionRate = 100 // one a tick
+	}
+
+	w := httptest.NewRecorder()
+	first.routes().ServeHTTP(w, httptest.NewRequest("POST", "/waiting-room", nil))
+	var ticket WaitingRoomTicket
+	json.Unmarshal(w.Body.Bytes(), &ticket)
+
+	stop := make(chan struct{})
+	go second.admitWaiting(10*time.Millisecond, stop)
+	defer close(stop)
+	deadline := time.Now().Add(time.Second)
+	for !ticket.Admitted && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		ticket, _, _ = first.waitingTicket(context.Background(), ticket.Token, time.Now(), time.Minute)
+	}
+	if !ticket.Admitted {
+		t.Fatal("Expected the token to be let in by the other replica")
+	}
+
+	body, _ := json.Marshal(AppointmentRequest{FirstName: "Queue", LastName: "Hopper", VisitDate: "2075-06-17"})
+	r := httptest.NewRequest("POST", "/appointments", bytes.NewReader(body))
+	r.Header.Set(waitingRoomHeader, ticket.Token)
+	w = httptest.NewRecorder()
+	second.routes().ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected 201 booking on the other replica, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWaitingRoomJoinRateLimited(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.Features = map[string]bool{"waiting-room": true}
+	server.cfg.RateLimitPerMinute = 2
+	router := server.routes()
+
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/waiting-room", nil))
+		if w.Code != want {
+			t.Errorf("Join %d: expected %d, got %d", i+1, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// POST /admin/walk-ins, for someone who's turned up at the counter
+// without a booking. It's always for today, and today still has to have
+// room and not be a public holiday, the same as booking it online. The
+// booking is marked channel "walk-in" so reports can tell them apart
+func (s *Server) createWalkIn(w http.ResponseWriter, r *http.Request) {
+	if !s.requireFeature(w, r, "walk-ins") {
+		return
+	}
+	today, err := s.today()
+	if err != nil {
+		s.sendErrorResponse(w, r, http.StatusInternalServerError, CodeInvalidYear, "Server year is not configured")
+		return
+	}
+
+	var req AppointmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON format")
+		return
+	}
+
+	date := today.Format("2006-01-02")
+	if req.VisitDate == "" {
+		req.VisitDate = date
+	}
+	if req.VisitDate != date {
+		s.sendErrorResponse(w, r, http.StatusBadRequest, CodeNotToday, "Walk-ins are for today, book any other day as usual")
+		return
+	}
+	req.Channel = ChannelWalkIn
+	s.book(w, r, req, today)
+}
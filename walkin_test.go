@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWalkIns(t *testing.T) {
+	for name, server := range map[string]*Server{"sqlite": setupTestServer(t), "events": setupEventServer(t), "memory": setupTestServer(t)} {
+		t.Run(name, func(t *testing.T) {
+			if name == "memory" {
+				server.db, server.store = nil, newMemoryStore()
+			}
+			server.cfg.AdminToken = "secret"
+			server.cfg.DailyCapacity = 2
+			today := time.Date(2075, 6, 16, 0, 0, 0, 0, time.UTC)
+			server.todayOverride = &today
+			router := server.routes()
+
+			if w := postAppointment(t, router, AppointmentRequest{FirstName: "Online", LastName: "Booker", VisitDate: "2075-06-16"}); w.Code != http.StatusCreated {
+				t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/walk-ins", []byte(`{"firstName":"Walk","lastName":"In"}`)))
+			var created CreatedAppointment
+			if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &created) != nil {
+				t.Fatalf("Expected 201 for a walk-in, got %d: %s", w.Code, w.Body.String())
+			}
+			if created.VisitDate != "2075-06-16" || created.Channel != ChannelWalkIn {
+				t.Errorf("Expected a walk-in for today, got %+v", created.Appointment)
+			}
+
+			// Still only as many as fit
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("POST", "/admin/walk-ins", []byte(`{"firstName":"One","lastName":"Toomany"}`)))
+			if w.Code != http.StatusConflict {
+				t.Errorf("Expected 409 once today is full, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments", nil))
+			var list AppointmentList
+			json.Unmarshal(w.Body.Bytes(), &list)
+			channels := map[string]bool{}
+			for _, appointment := range list.Appointments {
+				channels[appointment.Channel] = true
+			}
+			if !channels[ChannelOnline] || !channels[ChannelWalkIn] {
+				t.Errorf("Expected an online booking and a walk-in, got %v", channels)
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, adminRequest("GET", "/appointments/2/history", nil))
+			var history History
+			if json.Unmarshal(w.Body.Bytes(), &history) != nil || len(history.Revisions) != 1 || history.Revisions[0].Channel != ChannelWalkIn {
+				t.Errorf("Expected the history to say walk-in, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWalkInRules(t *testing.T) {
+	server := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	server.cfg.DailyCapacity = 5
+	today := time.Date(2075, 7, 12, 0, 0, 0, 0, time.UTC)
+	server.todayOverride = &today
+	router := server.routes()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"on a holiday", adminRequest("POST", "/admin/walk-ins", []byte(`{"firstName":"A","lastName":"B"}`)), http.StatusBadRequest},
+		{"for another day", adminRequest("POST", "/admin/walk-ins", []byte(`{"firstName":"A","lastName":"B","visitDate":"2075-07-15"}`)), http.StatusBadRequest},
+		{"without a token", httptest.NewRequest("POST", "/admin/walk-ins", nil), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			if w.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Staff booking some other day say so
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("POST", "/admin/appointments", []byte(`{"firstName":"A","lastName":"B","visitDate":"2075-07-15"}`)))
+	var created CreatedAppointment
+	if json.Unmarshal(w.Body.Bytes(), &created) != nil || created.Channel != ChannelStaff {
+		t.Errorf("Expected a staff booking, got %d: %s", w.Code, w.Body.String())
+	}
+}
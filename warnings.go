@@ -0,0 +1,83 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/xml"
+	"time"
+	"unicode"
+)
+
+const (
+	SeverityError   = "error"   // turned away, 403 not_eligible
+	SeverityWarning = "warning" // booked, with a warning in the 201
+)
+
+// Something the form might want to tell them about a booking that's
+// gone in, without stopping it. Same shape as a rule that didn't hold
+type Warning struct {
+	XMLName xml.Name `json:"-" xml:"warning"`
+	Code    string   `json:"code" xml:"code,attr"` // the rule's name
+	Message string   `json:"message" xml:",chardata"`
+}
+
+// Checked for every service, after its own warning rules. They're rules
+// like the ones in CITYNEXT_ELIGIBILITY_RULES, on fields from ruleFields
+var builtinWarnings = []*eligibilityRule{
+	{Name: "after_bank_holiday", Field: "afterHoliday", In: []string{"false"}, Severity: SeverityWarning,
+		Message: "It's the day after a bank holiday, expect queues"},
+	{Name: "unusual_name", Field: "unusualName", In: []string{"false"}, Severity: SeverityWarning,
+		Message: "A name has characters that aren't usual in names, check it's been typed right"},
+}
+
+// The booking as the rules see it, with what's worked out about it on
+// top: whether the day before is a bank holiday, and whether any name
+// on it looks odd
+func (s *Server) ruleFields(ctx context.Context, req AppointmentRequest, visitDate time.Time) map[string]any {
+	fields := eligibilityFields(req)
+	fields["afterHoliday"] = s.holidaySet(ctx).closed(visitDate.AddDate(0, 0, -1))
+	names := []string{req.FirstName, req.LastName, req.PreferredName}
+	for _, attendee := range req.Attendees {
+		names = append(names, attendee.FirstName, attendee.LastName)
+	}
+	unusual := false
+	for _, name := range names {
+		unusual = unusual || unusualName(name)
+	}
+	fields["unusualName"] = unusual
+	return fields
+}
+
+// Characters the default CITYNEXT_NAME_CHARACTERS wouldn't allow, which
+// get through with "any", or Latin letters mixed with another script's,
+// which is usually a lookalike letter pasted in
+func unusualName(name string) bool {
+	letters := nameCharacters[NameCharactersLetters]
+	latin, other := false, false
+	for _, r := range name {
+		switch {
+		case !letters(r):
+			return true
+		case unicode.Is(unicode.Latin, r):
+			latin = true
+		case unicode.IsLetter(r):
+			other = true
+		}
+	}
+	return latin && other
+}
+
+// The warning rules for the service then the built in ones, each that
+// doesn't hold once. Nil when there aren't any
+func (s *Server) bookingWarnings(ctx context.Context, req AppointmentRequest, visitDate time.Time) []Warning {
+	rules := append(append([]*eligibilityRule(nil), s.live().EligibilityRules[req.Service]...), builtinWarnings...)
+	fields := s.ruleFields(ctx, req, visitDate)
+	var warnings []Warning
+	for _, rule := range rules {
+		if rule.Severity != SeverityWarning || rule.holds(fields, visitDate) {
+			continue
+		}
+		warnings = append(warnings, Warning{Code: rule.Name, Message: cmp.Or(rule.Message, "Worth checking before they come in for "+req.Service)})
+	}
+	return warnings
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnusualName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"O'Brien": false,
+		"María":   false,
+		"Анна":    false, // Анна, all Cyrillic
+		"Mаria":   true,  // a Cyrillic а in the middle
+		"R2":      true,
+		"Jo & Mo": true,
+	} {
+		if got := unusualName(name); got != want {
+			t.Errorf("Expected unusualName(%q) to be %v, got %v", name, want, got)
+		}
+	}
+}
+
+func TestBookingWarnings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `{"general": [{"name": "big_group", "field": "people", "max": 2, "severity": "warning", "message": "Big groups wait longer"}],
+		"passports": [{"name": "odd", "field": "people", "max": 1, "severity": "sometimes"}]}`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CITYNEXT_ELIGIBILITY_RULES", path)
+
+	server, _ := closureServer(t, "sqlite")
+	server.cfg.QueueServices = []string{"general", "passports"}
+	server.cfg.EligibilityRules = envEligibilityRules("CITYNEXT_ELIGIBILITY_RULES")
+	server.cfg.NameCharacters = NameCharactersAny
+	router := server.routes()
+	if _, ok := server.cfg.EligibilityRules["passports"]; ok {
+		t.Errorf("Expected a rule with an unknown severity left out")
+	}
+
+	warnings := func(req AppointmentRequest) []string {
+		t.Helper()
+		w := postAppointment(t, router, req)
+		var created CreatedAppointment
+		if json.Unmarshal(w.Body.Bytes(), &created); w.Code != http.StatusCreated {
+			t.Fatalf("Expected %+v booked anyway, got %d: %s", req, w.Code, w.Body.String())
+		}
+		var codes []string
+		for _, warning := range created.Warnings {
+			codes = append(codes, warning.Code)
+		}
+		return codes
+	}
+	if got := warnings(AppointmentRequest{FirstName: "Plain", LastName: "Day", VisitDate: "2075-01-09"}); len(got) != 0 {
+		t.Errorf("Expected no warnings for an ordinary booking, got %v", got)
+	}
+	// 2075-01-02 is a holiday in the test server
+	if got := warnings(AppointmentRequest{FirstName: "After", LastName: "Holiday", VisitDate: "2075-01-03"}); strings.Join(got, ",") != "after_bank_holiday" {
+		t.Errorf("Expected the day after a bank holiday warned about, got %v", got)
+	}
+	if got := warnings(AppointmentRequest{FirstName: "Mаria", LastName: "Lookalike", VisitDate: "2075-01-10"}); strings.Join(got, ",") != "unusual_name" {
+		t.Errorf("Expected a mixed script name warned about, got %v", got)
+	}
+	// The service's own warning rules come first, and don't turn anyone away
+	got := warnings(AppointmentRequest{FirstName: "Big", LastName: "Family", VisitDate: "2075-01-16",
+		Attendees: []Attendee{{FirstName: "R2", LastName: "Family"}, {FirstName: "Three", LastName: "Family"}}})
+	if strings.Join(got, ",") != "big_group,unusual_name" {
+		t.Errorf("Expected the service's warning then the built in one, got %v", got)
+	}
+
+	// And in XML
+	r := httptest.NewRequest("POST", "/appointments", strings.NewReader(`{"firstName": "Xml", "lastName": "Holiday", "visitDate": "2075-01-03"}`))
+	r.Header.Set("Accept", "application/xml")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `<warning code="after_bank_holiday">`) {
+		t.Errorf("Expected the warning in XML, got %d: %s", w.Code, w.Body.String())
+	}
+}
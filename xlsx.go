@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Just enough SpreadsheetML for one formatted sheet: a bold, frozen header
+// row and real dates. Written straight into a zip on the response, so
+// it streams like the NDJSON export and needs no spreadsheet library
+var xlsxColumns = []struct {
+	title string
+	width int
+}{
+	{"ID", 8},
+	{"First name", 20},
+	{"Last name", 20},
+	{"Email", 32},
+	{"Visit date", 12},
+	{"Language", 10},
+	{"Booked at", 18},
+	{"Also attending", 40},
+	{"Booked by", 28},
+	{"Channel", 10},
+}
+
+// Cell styles, by their index in cellXfs below
+const (
+	xlsxStyleHeader   = 1
+	xlsxStyleDate     = 2
+	xlsxStyleDateTime = 3
+)
+
+var xlsxStaticParts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Appointments" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`},
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd"/><numFmt numFmtId="165" formatCode="yyyy-mm-dd hh:mm"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="4">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+</cellXfs>
+</styleSheet>`},
+}
+
+func writeXLSX(w io.Writer, flush func() error, rows func(func(Appointment) error) error) error {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return err
+		}
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+
+	var head strings.Builder
+	head.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	head.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	head.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	head.WriteString(`<cols>`)
+	for i, col := range xlsxColumns {
+		fmt.Fprintf(&head, `<col min="%d" max="%d" width="%d" customWidth="1"/>`, i+1, i+1, col.width)
+	}
+	head.WriteString(`</cols><sheetData><row>`)
+	for _, col := range xlsxColumns {
+		head.WriteString(xlsxString(col.title, xlsxStyleHeader))
+	}
+	head.WriteString(`</row>`)
+	if _, err := io.WriteString(sheet, head.String()); err != nil {
+		return err
+	}
+
+	err = rows(func(appointment Appointment) error {
+		visitDate, _ := time.Parse("2006-01-02", appointment.VisitDate)
+		row := `<row>` +
+			fmt.Sprintf(`<c><v>%d</v></c>`, appointment.ID) +
+			xlsxString(appointment.FirstName, 0) +
+			xlsxString(appointment.LastName, 0) +
+			xlsxString(appointment.Email, 0) +
+			xlsxDate(visitDate, xlsxStyleDate) +
+			xlsxString(appointment.PreferredLanguage, 0) +
+			xlsxDate(appointment.CreatedAt, xlsxStyleDateTime) +
+			xlsxString(attendeeNames(appointment.Attendees), 0) +
+			xlsxString(appointment.BookedBy.String(), 0) +
+			xlsxString(appointment.Channel, 0) +
+			`</row>`
+		_, err := io.WriteString(sheet, row)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func attendeeNames(attendees []Attendee) string {
+	names := make([]string, len(attendees))
+	for i, attendee := range attendees {
+		names[i] = attendee.FirstName + " " + attendee.LastName
+	}
+	return strings.Join(names, ", ")
+}
+
+// Inline rather than shared strings, so nothing has to be held back until the end
+func xlsxString(value string, style int) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(value))
+	return fmt.Sprintf(`<c t="inlineStr"%s><is><t xml:space="preserve">%s</t></is></c>`, xlsxStyleAttr(style), escaped.String())
+}
+
+// Spreadsheets count days from the end of 1899
+func xlsxDate(t time.Time, style int) string {
+	if t.IsZero() {
+		return `<c/>`
+	}
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	serial := t.UTC().Sub(epoch).Hours() / 24
+	return fmt.Sprintf(`<c%s><v>%s</v></c>`, xlsxStyleAttr(style), strconv.FormatFloat(serial, 'f', -1, 64))
+}
+
+func xlsxStyleAttr(style int) string {
+	if style == 0 {
+		return ""
+	}
+	return fmt.Sprintf(` s="%d"`, style)
+}